@@ -24,13 +24,69 @@ const App = () => {
     }
   }, [token]);
 
+  const saveSession = (data) => {
+    localStorage.setItem('token', data.token);
+    if (data.refresh_token) {
+      localStorage.setItem('refreshToken', data.refresh_token);
+    }
+  };
+
+  const clearSession = () => {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+    setToken(null);
+    setUser(null);
+    setShowAuth(true);
+  };
+
+  // Access tokens are short-lived: on a 401, trade the refresh token for a
+  // new pair and retry once
+  const refreshSession = async () => {
+    const refreshToken = localStorage.getItem('refreshToken');
+    if (!refreshToken) return null;
+    const response = await fetch(`${API_URL}/api/auth/refresh`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json'
+      },
+      body: JSON.stringify({ refresh_token: refreshToken })
+    });
+    if (!response.ok) return null;
+    const data = await response.json();
+    saveSession(data);
+    return data.token;
+  };
+
+  // Failed requests answer {"error": {"code", "message", "request_id"}}
+  const errorMessageOf = async (response, fallback) => {
+    try {
+      const data = await response.json();
+      return data.error?.message || fallback;
+    } catch {
+      return fallback;
+    }
+  };
+
+  const authFetch = async (url, options = {}) => {
+    const withToken = (t) => ({
+      ...options,
+      headers: { ...options.headers, 'Authorization': `Bearer ${t}` }
+    });
+    let response = await fetch(url, withToken(localStorage.getItem('token')));
+    if (response.status === 401) {
+      const refreshed = await refreshSession();
+      if (!refreshed) {
+        clearSession();
+        return response;
+      }
+      response = await fetch(url, withToken(refreshed));
+    }
+    return response;
+  };
+
   const loadUser = async () => {
     try {
-      const response = await fetch(`${API_URL}/api/user`, {
-        headers: {
-          'Authorization': `Bearer ${token}`
-        }
-      });
+      const response = await authFetch(`${API_URL}/api/user`);
       if (response.ok) {
         const userData = await response.json();
         setUser(userData);
@@ -46,11 +102,7 @@ const App = () => {
 
   const loadBackups = async () => {
     try {
-      const response = await fetch(`${API_URL}/api/backups`, {
-        headers: {
-          'Authorization': `Bearer ${token}`
-        }
-      });
+      const response = await authFetch(`${API_URL}/api/backups`);
       if (response.ok) {
         const data = await response.json();
         setBackups(data || []);
@@ -62,11 +114,7 @@ const App = () => {
 
   const loadProjects = async () => {
     try {
-      const response = await fetch(`${API_URL}/api/projects`, {
-        headers: {
-          'Authorization': `Bearer ${token}`
-        }
-      });
+      const response = await authFetch(`${API_URL}/api/projects`);
       if (response.ok) {
         const data = await response.json();
         setProjects(data || []);
@@ -95,23 +143,34 @@ const App = () => {
       if (response.ok) {
         const data = await response.json();
         if (data.token) {
-          localStorage.setItem('token', data.token);
+          saveSession(data);
           setToken(data.token);
           setShowAuth(false);
         }
       } else {
-        setErrorMessage('Authentication failed');
+        setErrorMessage(await errorMessageOf(response, 'Authentication failed'));
       }
     } catch (error) {
       setErrorMessage('Network error');
     }
   };
 
-  const handleLogout = () => {
-    localStorage.removeItem('token');
-    setToken(null);
-    setUser(null);
-    setShowAuth(true);
+  const handleLogout = async () => {
+    const refreshToken = localStorage.getItem('refreshToken');
+    if (refreshToken) {
+      try {
+        await fetch(`${API_URL}/api/auth/logout`, {
+          method: 'POST',
+          headers: {
+            'Content-Type': 'application/json'
+          },
+          body: JSON.stringify({ refresh_token: refreshToken })
+        });
+      } catch (error) {
+        console.error('Logout error:', error);
+      }
+    }
+    clearSession();
   };
 
   const handleFileUpload = async (e) => {
@@ -127,11 +186,8 @@ const App = () => {
       formData.append('file', file);
 
       try {
-        const response = await fetch(`${API_URL}/api/backups`, {
+        const response = await authFetch(`${API_URL}/api/backups`, {
           method: 'POST',
-          headers: {
-            'Authorization': `Bearer ${token}`
-          },
           body: formData
         });
 
@@ -160,10 +216,9 @@ const App = () => {
       project.starred = !project.starred;
       
       try {
-        await fetch(`${API_URL}/api/projects/${projectId}`, {
+        await authFetch(`${API_URL}/api/projects/${projectId}`, {
           method: 'PUT',
           headers: {
-            'Authorization': `Bearer ${token}`,
             'Content-Type': 'application/json'
           },
           body: JSON.stringify(project)
@@ -185,11 +240,8 @@ const App = () => {
     if (!confirm('Delete this project?')) return;
     
     try {
-      await fetch(`${API_URL}/api/projects/${projectId}`, {
-        method: 'DELETE',
-        headers: {
-          'Authorization': `Bearer ${token}`
-        }
+      await authFetch(`${API_URL}/api/projects/${projectId}`, {
+        method: 'DELETE'
       });
       await loadProjects();
     } catch (error) {
@@ -201,11 +253,8 @@ const App = () => {
     if (!confirm('Delete backup and projects?')) return;
     
     try {
-      await fetch(`${API_URL}/api/backups/${backupId}`, {
-        method: 'DELETE',
-        headers: {
-          'Authorization': `Bearer ${token}`
-        }
+      await authFetch(`${API_URL}/api/backups/${backupId}`, {
+        method: 'DELETE'
       });
       await loadData();
     } catch (error) {
@@ -213,6 +262,21 @@ const App = () => {
     }
   };
 
+  const downloadBackup = async (backup) => {
+    try {
+      const response = await authFetch(`${API_URL}/api/backups/${backup.id}/download`);
+      if (!response.ok) throw new Error(`Download failed: ${response.status}`);
+      const url = URL.createObjectURL(await response.blob());
+      const link = document.createElement('a');
+      link.href = url;
+      link.download = backup.name;
+      link.click();
+      URL.revokeObjectURL(url);
+    } catch (error) {
+      console.error('Download error:', error);
+    }
+  };
+
   const formatSize = (bytes) => {
     if (!bytes) return '0 B';
     if (bytes < 1024) return bytes + ' B';
@@ -548,9 +612,14 @@ const App = () => {
                       <span>{formatDate(backup.created_at)}</span>
                     </div>
                   </div>
-                  <button onClick={() => deleteBackup(backup.id)} className="p-2 bg-red-500 hover:bg-red-600 rounded-lg">
-                    <Trash2 className="w-5 h-5" />
-                  </button>
+                  <div className="flex gap-2">
+                    <button onClick={() => downloadBackup(backup)} className="p-2 bg-blue-500 hover:bg-blue-600 rounded-lg">
+                      <Download className="w-5 h-5" />
+                    </button>
+                    <button onClick={() => deleteBackup(backup.id)} className="p-2 bg-red-500 hover:bg-red-600 rounded-lg">
+                      <Trash2 className="w-5 h-5" />
+                    </button>
+                  </div>
                 </div>
               </div>
             ))}
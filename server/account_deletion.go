@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/search"
+	"backup-manager/storage"
+)
+
+const (
+	defaultAccountDeletionGraceDays = 14
+	// Accounts deleted per retention run
+	accountDeletionBatch = 50
+	// accountDeletionJobs bounds the jobs whose files are looked for
+	accountDeletionJobs = 1000
+)
+
+// accountDeletionGrace is how long after its owner asks an account is
+// deleted, during which they can change their mind:
+// ACCOUNT_DELETION_GRACE_DAYS, or 14 days. 0 deletes it at the next
+// retention run.
+func accountDeletionGrace() time.Duration {
+	days, err := strconv.Atoi(config.Get("ACCOUNT_DELETION_GRACE_DAYS"))
+	if err != nil || days < 0 {
+		days = defaultAccountDeletionGraceDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func sendAccountDeletionScheduled(user User, at time.Time) error {
+	return sendEmail(user.Email, "Your account is scheduled for deletion",
+		"You asked for your account to be deleted. On "+at.UTC().Format("2 January 2006 at 15:04 MST")+
+			" it will be, along with your backups, projects and QR codes, and this can't be undone.\n\n"+
+			"If you didn't ask for this, or changed your mind, log in and cancel the deletion: "+
+			frontendLink("/account")+"\n\n"+
+			"To keep a copy of your data, export it before then.")
+}
+
+// deleteAccount deletes a user and everything they own: backups, in the
+// trash or not and including those they made in teams, with their blobs and
+// thumbnails (their chunks are released for pruneChunks, as on any purge);
+// unfinished uploads; their teams, see leaveTeams; projects, QR codes, jobs,
+// sessions, second factors, API keys, webhooks, templates, logos,
+// connectors, data exports and a pending email change, with the user's row;
+// the files jobs made, logo images and export archives; the search
+// documents kept outside the database. Their data key is destroyed last but one, so nothing left over
+// could be read.
+func deleteAccount(ctx context.Context, user User) error {
+	held, err := legalHolds.userHeld(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if held {
+		return errLegalHold
+	}
+	if err := leaveTeams(ctx, user.ID); err != nil {
+		return err
+	}
+
+	backups, err := db.Backups().List(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	trashed, err := db.Backups().ListTrashed(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	projects, err := db.Projects().List(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	jobs, err := db.Jobs().List(ctx, user.ID, accountDeletionJobs)
+	if err != nil {
+		return err
+	}
+	logos, err := db.QRLogos().List(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	exports, err := db.DataExports().List(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	// Sessions end first, so nothing new is made while the rest goes
+	if err := endSessions(ctx, user.ID); err != nil {
+		return err
+	}
+	if err := apiKeys.revokeUser(ctx, user.ID); err != nil {
+		return err
+	}
+
+	if err := discardUploads(ctx, user.ID); err != nil {
+		return err
+	}
+	if err := discardImports(ctx, user.ID); err != nil {
+		return err
+	}
+	var docs []string
+	for _, b := range append(backups, trashed...) {
+		if err := purgeBackup(ctx, b); err != nil {
+			return fmt.Errorf("purging backup %s: %w", b.ID, err)
+		}
+		docs = append(docs, search.DocumentID(search.TypeBackup, b.ID))
+	}
+	for _, p := range projects {
+		docs = append(docs, search.DocumentID(search.TypeProject, p.ID))
+	}
+	if len(docs) > 0 {
+		removeDocuments(docs...)
+	}
+	if blobStore != nil {
+		for _, job := range jobs {
+			if jobsWithFiles[job.Type] && job.Status == storage.JobCompleted {
+				if err := blobStore.Delete(ctx, jobFileKey(job)); err != nil {
+					logger(ctx).Error("Error deleting job file", "job_id", job.ID, "error", err)
+				}
+			}
+		}
+		for _, logo := range logos {
+			if err := blobStore.Delete(ctx, qrLogoBlobKey(user.ID, logo.ID)); err != nil {
+				logger(ctx).Error("Error deleting logo image", "logo_id", logo.ID, "error", err)
+			}
+		}
+	}
+	for _, export := range exports {
+		if err := removeExportArchive(export); err != nil {
+			logger(ctx).Error("Error removing export archive", "export_id", export.ID, "error", err)
+		}
+	}
+
+	if err := userKeys.destroy(ctx, user.ID); err != nil {
+		return err
+	}
+	// Projects, QR codes and their scans, refresh tokens, jobs, the
+	// two-factor enrollment, recovery codes, templates, logos, connectors,
+	// data exports and a pending email change go with the user's row
+	if err := db.Users().Delete(ctx, user.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// runAccountDeletions deletes the accounts whose grace period is over.
+func runAccountDeletions() {
+	ctx := context.Background()
+
+	users, err := db.Users().ListDeletionDue(ctx, time.Now(), accountDeletionBatch)
+	if err != nil {
+		slog.Error("Error loading accounts due for deletion", "error", err)
+		return
+	}
+	deleteAccounts(ctx, users)
+}
+
+// deleteAccounts deletes each of users with deleteAccount and records it.
+// Accounts under legal hold are kept until the hold is released.
+func deleteAccounts(ctx context.Context, users []User) {
+	for _, user := range users {
+		err := deleteAccount(ctx, user)
+		if errors.Is(err, errLegalHold) {
+			slog.Info("Account deletion waits for a legal hold", "user_id", user.ID)
+			continue
+		}
+		if err != nil {
+			slog.Error("Error deleting account", "user_id", user.ID, "error", err)
+			continue
+		}
+		slog.Info("Deleted account", "user_id", user.ID)
+		recordDomainEvent(systemActor, DomainEvent{
+			Type:          "user.deleted",
+			AggregateType: aggregateUser,
+			AggregateID:   user.ID,
+			OwnerID:       user.ID,
+			Before:        snapshot(user),
+		}, nil)
+	}
+}
+
+// Handlers
+
+// deleteAccountHandler schedules the caller's account for deletion after
+// accountDeletionGrace. The password is asked for again, as a session left
+// open shouldn't be enough to lose everything. The account works as before
+// until then, so its owner can log in to cancel or export their data.
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Password string `json:"password" validate:"required"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	user, err := db.Users().Get(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	if !passwordMatches(r.Context(), user.PasswordHash, req.Password) {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+	if user.DeletionScheduledAt != nil {
+		http.Error(w, "Your account is already scheduled for deletion", http.StatusConflict)
+		return
+	}
+	held, err := legalHolds.userHeld(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Legal holds")
+		return
+	}
+	if held {
+		writeError(w, http.StatusConflict, "legal_hold", "Your account is under a legal hold and can't be deleted now")
+		return
+	}
+
+	at := time.Now().Add(accountDeletionGrace())
+	if err := db.Users().ScheduleDeletion(r.Context(), userID, &at); err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	before := user
+	user.DeletionScheduledAt = &at
+
+	if err := sendAccountDeletionScheduled(user, at); err != nil {
+		logger(r.Context()).Error("Error sending account deletion notice", "error", err)
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "account.deletion_scheduled",
+		ResourceType: "user",
+		ResourceID:   userID,
+		Metadata:     map[string]interface{}{"delete_at": at},
+	})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "user.deletion_scheduled",
+		AggregateType: aggregateUser,
+		AggregateID:   userID,
+		OwnerID:       userID,
+		Before:        snapshot(before),
+		After:         snapshot(user),
+	}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deletion_scheduled_at": at,
+		"cancel_url":            "/api/account/deletion/cancel",
+	})
+}
+
+// cancelAccountDeletionHandler keeps an account that was scheduled for
+// deletion.
+func cancelAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	user, err := db.Users().Get(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	if user.DeletionScheduledAt == nil {
+		http.Error(w, "Your account isn't scheduled for deletion", http.StatusNotFound)
+		return
+	}
+	if err := db.Users().ScheduleDeletion(r.Context(), userID, nil); err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	before := user
+	user.DeletionScheduledAt = nil
+
+	recordAudit(r, AuditEvent{Action: "account.deletion_cancelled", ResourceType: "user", ResourceID: userID})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "user.deletion_cancelled",
+		AggregateType: aggregateUser,
+		AggregateID:   userID,
+		OwnerID:       userID,
+		Before:        snapshot(before),
+		After:         snapshot(user),
+	}, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAccountDeletionHandler says whether, and when, the caller's account
+// is to be deleted.
+func getAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := db.Users().Get(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"scheduled":             user.DeletionScheduledAt != nil,
+		"deletion_scheduled_at": user.DeletionScheduledAt,
+		"grace_days":            int(accountDeletionGrace() / (24 * time.Hour)),
+	})
+}
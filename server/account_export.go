@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-manager/storage"
+)
+
+// accountExportPayload is what an account export job puts in its archive.
+type accountExportPayload struct {
+	// IncludeBackups adds each backup's contents, decrypted, under
+	// backups/; otherwise only their metadata is exported
+	IncludeBackups bool `json:"include_backups"`
+}
+
+// runAccountExportJob streams a ZIP of everything held about the job's
+// owner into the blob store for /api/jobs/{id}/result: the files
+// collectUserData gathers and, if asked, the backups themselves.
+func runAccountExportJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload accountExportPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+	if blobStore == nil {
+		return nil, errors.New("no blob store to keep the export in")
+	}
+
+	files, err := collectUserData(ctx, job.UserID)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := db.Backups().List(ctx, job.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// The contents are either in the archive or not exported at all
+	for i := range backups {
+		backups[i].EncryptedData = ""
+	}
+	files["backups.json"] = backups
+
+	if payload.IncludeBackups {
+		entries := make([]map[string]string, len(backups))
+		for i, b := range backups {
+			entries[i] = map[string]string{"id": b.ID, "name": b.Name, "file": accountExportBackupFile(b)}
+		}
+		files["manifest.json"].(map[string]interface{})["backups"] = entries
+	}
+
+	p := jobProgressFrom(ctx)
+	if payload.IncludeBackups {
+		p.update(true, func(ev *ProgressEvent) { ev.Total = len(backups) })
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeAccountExport(ctx, pw, files, backups, payload.IncludeBackups, p))
+	}()
+	err = blobStore.PutStream(ctx, jobFileKey(job), pr, "application/zip")
+	pr.CloseWithError(err)
+	if errors.Is(err, errDataKeyLocked) {
+		return nil, &jobError{"Your data key is locked; log in again or restore it with your recovery key"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"filename":        "account-export-" + time.Now().UTC().Format("2006-01-02") + ".zip",
+		"content_type":    "application/zip",
+		"backups":         len(backups),
+		"include_backups": payload.IncludeBackups,
+	}, nil
+}
+
+// writeAccountExport writes the archive: the JSON files, then each backup
+// decrypted as it is read, so none is held in memory whole.
+func writeAccountExport(ctx context.Context, w io.Writer, files map[string]interface{}, backups []Backup, includeBackups bool, p *jobProgress) error {
+	zw := zip.NewWriter(w)
+	for _, name := range sortedKeys(files) {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files[name]); err != nil {
+			return err
+		}
+	}
+	if includeBackups {
+		for _, b := range backups {
+			if err := writeAccountExportBackup(ctx, zw, b); err != nil {
+				return err
+			}
+			p.itemDone()
+		}
+	}
+	return zw.Close()
+}
+
+func writeAccountExportBackup(ctx context.Context, zw *zip.Writer, b Backup) error {
+	body, err := openBackup(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     accountExportBackupFile(b),
+		Method:   zip.Deflate,
+		Modified: b.Timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, body)
+	return err
+}
+
+// accountExportBackupFile is where b's contents go in the archive. The ID
+// keeps backups of the same name apart.
+func accountExportBackupFile(b Backup) string {
+	name := path.Base(strings.ReplaceAll(b.Name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		name = "backup"
+	}
+	return "backups/" + b.ID + "/" + name
+}
+
+// Handlers
+
+// getAccountExportHandler queues an export of the caller's account, with
+// the backups themselves if include_backups is true; the archive is at
+// /api/jobs/{id}/result once the job completes. Asking again while one is
+// waiting or running returns that job rather than queueing another.
+func getAccountExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var payload accountExportPayload
+	if v := r.URL.Query().Get("include_backups"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "include_backups must be true or false", http.StatusBadRequest)
+			return
+		}
+		payload.IncludeBackups = include
+	}
+
+	jobs, err := db.Jobs().List(r.Context(), userID, jobListLimit, internalJobTypes()...)
+	if err != nil {
+		writeStorageError(w, r, err, "Jobs")
+		return
+	}
+	for _, job := range jobs {
+		if job.Type != jobAccountExport || (job.Status != storage.JobQueued && job.Status != storage.JobRunning) {
+			continue
+		}
+		var pending accountExportPayload
+		if json.Unmarshal(job.Payload, &pending) == nil && pending == payload {
+			writeJobAccepted(w, job)
+			return
+		}
+	}
+
+	job, err := enqueueJob(r.Context(), userID, jobAccountExport, payload)
+	if err != nil {
+		writeEnqueueError(w, r, err)
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "account.export_requested",
+		ResourceType: "user",
+		ResourceID:   userID,
+		Metadata:     map[string]interface{}{"job_id": job.ID, "include_backups": payload.IncludeBackups},
+	})
+	writeJobAccepted(w, job)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAdminUserPage = 50
+	maxAdminUserPage     = 500
+	// passwordResetTTL is how long the link sent when an admin forces a
+	// password reset works
+	passwordResetTTL = 72 * time.Hour
+)
+
+// accountBlocked refuses a login for an account that can't be used, with
+// code telling the frontend why.
+func accountBlocked(w http.ResponseWriter, code string) {
+	writeError(w, http.StatusForbidden, code, accountBlockedMessages[code])
+}
+
+var accountBlockedMessages = map[string]string{
+	"account_disabled":        "This account has been disabled",
+	"password_reset_required": "You must reset your password before logging in",
+}
+
+// checkAccountUsable refuses to log in or refresh the tokens of a disabled
+// account, or of one that must reset its password first. On failure it
+// writes the response and returns false.
+func checkAccountUsable(w http.ResponseWriter, user User) bool {
+	switch {
+	case user.Disabled:
+		accountBlocked(w, "account_disabled")
+		return false
+	case user.PasswordResetRequired:
+		accountBlocked(w, "password_reset_required")
+		return false
+	}
+	return true
+}
+
+// startPasswordReset returns a new reset token for the user, replacing
+// earlier ones.
+func startPasswordReset(ctx context.Context, userID string) (string, error) {
+	token := generateToken()
+	if err := db.PasswordResets().Start(ctx, userID, hashToken(token), time.Now().Add(passwordResetTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func prunePasswordResets() {
+	if err := db.PasswordResets().Prune(context.Background(), time.Now()); err != nil {
+		slog.Error("Failed to prune password resets", "error", err)
+	}
+}
+
+func sendPasswordReset(user User, token string) error {
+	link := frontendLink("/reset-password?token=" + url.QueryEscape(token))
+	return sendEmail(user.Email, "Reset your password",
+		"An administrator has asked you to choose a new password. Your current password no longer works.\n\n"+
+			"Choose a new password: "+link+"\n\n"+
+			fmt.Sprintf("The link expires in %d hours.", int(passwordResetTTL.Hours())))
+}
+
+// loadTargetUser loads the user an admin route is about. On failure it
+// writes the response and returns false.
+func loadTargetUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	user, err := db.Users().Get(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return User{}, false
+	}
+	user.Role = userRole(user)
+	return user, true
+}
+
+// Handlers
+
+func getAdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset := defaultAdminUserPage, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAdminUserPage {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAdminUserPage), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	users, err := db.Users().List(r.Context(), q.Get("q"), limit, offset)
+	if err != nil {
+		writeStorageError(w, r, err, "Users")
+		return
+	}
+	for i := range users {
+		users[i].Role = userRole(users[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":  users,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+func getAdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	methods, err := secondFactors(r.Context(), user.ID)
+	if err != nil {
+		writeStorageError(w, r, err, "Two-factor authentication")
+		return
+	}
+	keys, err := apiKeys.listForUser(r.Context(), user.ID)
+	if err != nil {
+		writeStorageError(w, r, err, "API keys")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":       user,
+		"two_factor": len(methods) > 0,
+		"api_keys":   len(keys),
+	})
+}
+
+// setUserRoleHandler grants or takes away a role. Admins can't change their
+// own, so the last one can't lock everyone out.
+func setUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role string `json:"role" validate:"required"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if _, ok := roleRank[req.Role]; !ok {
+		writeFieldError(w, "role", "oneof", fmt.Sprintf("unknown role %q", req.Role))
+		return
+	}
+
+	user, ok := loadTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == r.Header.Get("X-User-ID") {
+		http.Error(w, "You can't change your own role", http.StatusConflict)
+		return
+	}
+	if isAdminEmail(user.Email) && req.Role != storage.RoleAdmin {
+		http.Error(w, "This user is an admin through ADMIN_EMAILS", http.StatusConflict)
+		return
+	}
+
+	before := user
+	if err := db.Users().UpdateRole(r.Context(), user.ID, req.Role); err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	user.Role = req.Role
+
+	recordAudit(r, AuditEvent{
+		Action:       "admin.user_role_changed",
+		ResourceType: "user",
+		ResourceID:   user.ID,
+		Metadata:     map[string]interface{}{"from": before.Role, "to": user.Role},
+	})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "user.role_changed",
+		AggregateType: aggregateUser,
+		AggregateID:   user.ID,
+		OwnerID:       user.ID,
+		Before:        snapshot(before),
+		After:         snapshot(user),
+	}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// disableUserHandler stops an account from being used: it is logged out
+// everywhere, its API keys are revoked and it can't log in again until it
+// is enabled. Its data is kept.
+func disableUserHandler(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, true)
+}
+
+func enableUserHandler(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, false)
+}
+
+// unlockUserHandler clears a user's failed logins, ending a lockout early.
+// Addresses stay locked.
+func unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadTargetUser(w, r)
+	if !ok {
+		return
+	}
+	recordLoginSuccess(r.Context(), user.Email)
+	recordAudit(r, AuditEvent{Action: "admin.user_unlocked", ResourceType: "user", ResourceID: user.ID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, ok := loadTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if disabled && user.ID == r.Header.Get("X-User-ID") {
+		http.Error(w, "You can't disable your own account", http.StatusConflict)
+		return
+	}
+
+	before := user
+	if err := db.Users().SetDisabled(r.Context(), user.ID, disabled); err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	user.Disabled = disabled
+
+	action, eventType := "admin.user_enabled", "user.enabled"
+	if disabled {
+		action, eventType = "admin.user_disabled", "user.disabled"
+		if err := endSessions(r.Context(), user.ID); err != nil {
+			logger(r.Context()).Error("Error revoking refresh tokens", "user_id", user.ID, "error", err)
+		}
+		if err := apiKeys.revokeUser(r.Context(), user.ID); err != nil {
+			logger(r.Context()).Error("Error revoking API keys", "user_id", user.ID, "error", err)
+		}
+	}
+
+	recordAudit(r, AuditEvent{Action: action, ResourceType: "user", ResourceID: user.ID})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          eventType,
+		AggregateType: aggregateUser,
+		AggregateID:   user.ID,
+		OwnerID:       user.ID,
+		Before:        snapshot(before),
+		After:         snapshot(user),
+	}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// forcePasswordResetHandler makes the user choose a new password: the
+// current one stops working, they are logged out everywhere and a reset
+// link is emailed to them.
+func forcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db.Users().RequirePasswordReset(r.Context(), user.ID); err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	if err := endSessions(r.Context(), user.ID); err != nil {
+		logger(r.Context()).Error("Error revoking refresh tokens", "user_id", user.ID, "error", err)
+	}
+
+	token, err := startPasswordReset(r.Context(), user.ID)
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	if err := sendPasswordReset(user, token); err != nil {
+		logger(r.Context()).Error("Error sending password reset email", "error", err)
+		http.Error(w, "Password reset required, but the email could not be sent", http.StatusBadGateway)
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "admin.password_reset_forced", ResourceType: "user", ResourceID: user.ID})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// getUsageHandler totals what the service holds across all users.
+func getUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := db.Usage(r.Context())
+	if err != nil {
+		logger(r.Context()).Error("Error totalling usage", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// resetPasswordHandler sets a new password with the token from a reset
+// email. The data key stays wrapped by the old password, so it is locked at
+// the next login until restored with the recovery key.
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required,password"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	// Each token works once
+	userID, err := db.PasswordResets().Consume(r.Context(), hashToken(req.Token), time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid or expired reset link", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading password reset", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+
+	hashed, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Error setting password", http.StatusInternalServerError)
+		return
+	}
+	err = db.Users().SetPassword(r.Context(), userID, hashed)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid or expired reset link", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error setting password", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	if err := endSessions(r.Context(), userID); err != nil {
+		logger(r.Context()).Error("Error revoking refresh tokens", "user_id", userID, "error", err)
+	}
+	// Whoever reset the password owns the mailbox, so lift any lockout
+	if user, err := db.Users().Get(r.Context(), userID); err == nil {
+		recordLoginSuccess(r.Context(), user.Email)
+	}
+
+	recordAudit(r, AuditEvent{UserID: userID, Action: "auth.password_reset", ResourceType: "user", ResourceID: userID})
+	emitWebhook(userID, "auth.password_reset", map[string]string{"id": userID})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,231 @@
+// Package analytics stores QR code scans and answers aggregate queries over
+// them. Store is implemented in memory for small installs and by ClickHouse
+// for deployments with millions of scans.
+package analytics
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Aggregation levels for location queries.
+const (
+	LevelCountry = "country"
+	LevelRegion  = "region"
+	LevelCity    = "city"
+)
+
+// Location is where a scan came from, as precisely as the GeoIP database
+// knows. Coordinates are the centre of the city, not of the scanner.
+type Location struct {
+	CountryCode string  `json:"country_code,omitempty"`
+	Country     string  `json:"country,omitempty"`
+	RegionCode  string  `json:"region_code,omitempty"`
+	Region      string  `json:"region,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+}
+
+// At returns the location truncated to an aggregation level.
+func (l Location) At(level string) Location {
+	switch level {
+	case LevelCountry:
+		return Location{CountryCode: l.CountryCode, Country: l.Country}
+	case LevelRegion:
+		return Location{CountryCode: l.CountryCode, Country: l.Country, RegionCode: l.RegionCode, Region: l.Region}
+	default:
+		return l
+	}
+}
+
+// Time series bucket sizes.
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+)
+
+// Scan is one scan of a QR code. IP addresses are never stored. Referrer
+// is only the referring host; most scans come straight from a camera app
+// and have none.
+type Scan struct {
+	QRID      string
+	OwnerID   string
+	ScannedAt time.Time
+	Location  Location
+	UserAgent string
+	Client    Client
+	Referrer  string
+}
+
+// LocationCount is the number of scans from one location.
+type LocationCount struct {
+	Location
+	Scans int64 `json:"scans"`
+}
+
+// GeoQuery selects the scans of one code, owned by OwnerID, from Since
+// onwards, grouped at Level.
+type GeoQuery struct {
+	QRID    string
+	OwnerID string
+	Level   string
+	Since   time.Time
+}
+
+// GeoResult is the scans per location, busiest first. Scans with no known
+// country are counted in Unknown rather than listed.
+type GeoResult struct {
+	Locations []LocationCount
+	Unknown   int64
+}
+
+// SummaryQuery selects the scans of one code, owned by OwnerID, from Since
+// onwards, counted in Bucket sized periods.
+type SummaryQuery struct {
+	QRID    string
+	OwnerID string
+	Since   time.Time
+	Bucket  string
+}
+
+// BucketCount is the scans in the period starting at Start. Periods with no
+// scans are left out.
+type BucketCount struct {
+	Start time.Time `json:"start"`
+	Scans int64     `json:"scans"`
+}
+
+// NameCount is the scans with one value of a breakdown, such as "mobile".
+type NameCount struct {
+	Name  string `json:"name"`
+	Scans int64  `json:"scans"`
+}
+
+// Summary is one code's scans over time and by client. Breakdowns are
+// busiest first.
+type Summary struct {
+	Total     int64
+	Series    []BucketCount
+	Devices   []NameCount
+	OS        []NameCount
+	Browsers  []NameCount
+	Referrers []NameCount
+}
+
+// TotalsQuery selects the scans of all of OwnerID's codes from Since's
+// day onwards.
+type TotalsQuery struct {
+	OwnerID string
+	Since   time.Time
+}
+
+// CodeCount is the scans of one code.
+type CodeCount struct {
+	QRID  string `json:"qr_id"`
+	Scans int64  `json:"scans"`
+}
+
+// Totals is an owner's scans by day and by code, busiest first. Days with
+// no scans are left out.
+type Totals struct {
+	Total  int64
+	Series []BucketCount
+	Codes  []CodeCount
+}
+
+// newTotals builds Totals from per-day and per-code counts of the same
+// scans.
+func newTotals(days map[time.Time]int64, codes map[string]int64) Totals {
+	t := Totals{Series: []BucketCount{}, Codes: []CodeCount{}}
+	for start, n := range days {
+		t.Series = append(t.Series, BucketCount{start, n})
+		t.Total += n
+	}
+	sort.Slice(t.Series, func(i, j int) bool { return t.Series[i].Start.Before(t.Series[j].Start) })
+	for id, n := range codes {
+		t.Codes = append(t.Codes, CodeCount{id, n})
+	}
+	sort.Slice(t.Codes, func(i, j int) bool {
+		if t.Codes[i].Scans != t.Codes[j].Scans {
+			return t.Codes[i].Scans > t.Codes[j].Scans
+		}
+		return t.Codes[i].QRID < t.Codes[j].QRID
+	})
+	return t
+}
+
+// DailyCount is one code's scans from one location on one day.
+type DailyCount struct {
+	QRID    string
+	OwnerID string
+	Date    string // YYYY-MM-DD, UTC
+	Location
+	Scans int64
+}
+
+// Store records scans and aggregates them. Queries only ever see scans
+// belonging to the given owner.
+type Store interface {
+	Record(ctx context.Context, scans ...Scan) error
+	Geo(ctx context.Context, q GeoQuery) (GeoResult, error)
+	Summary(ctx context.Context, q SummaryQuery) (Summary, error)
+	Totals(ctx context.Context, q TotalsQuery) (Totals, error)
+	// Daily returns every code's scans by location on one UTC day, for
+	// bulk export.
+	Daily(ctx context.Context, day time.Time) ([]DailyCount, error)
+	// Prune drops scans from before the given time. Stores that expire
+	// data themselves may do nothing.
+	Prune(ctx context.Context, before time.Time) error
+	Close() error
+}
+
+// Breakdowns a Summary has, as Memory keys them.
+const (
+	fieldDevice   = "device"
+	fieldOS       = "os"
+	fieldBrowser  = "browser"
+	fieldReferrer = "referrer"
+)
+
+// setBreakdowns turns per-field counts into a Summary's sorted breakdowns.
+func (s *Summary) setBreakdowns(counts map[string]map[string]int64) {
+	sorted := func(field string) []NameCount {
+		list := []NameCount{}
+		for name, n := range counts[field] {
+			if name == "" {
+				// Scans without a referrer came straight from the camera;
+				// otherwise they predate the field being recorded
+				name = "unknown"
+				if field == fieldReferrer {
+					name = "direct"
+				}
+			}
+			list = append(list, NameCount{name, n})
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Scans != list[j].Scans {
+				return list[i].Scans > list[j].Scans
+			}
+			return list[i].Name < list[j].Name
+		})
+		return list
+	}
+	s.Devices = sorted(fieldDevice)
+	s.OS = sorted(fieldOS)
+	s.Browsers = sorted(fieldBrowser)
+	s.Referrers = sorted(fieldReferrer)
+}
+
+// sortLocations orders counts busiest first, then by name so equal counts
+// are stable across requests.
+func sortLocations(counts []LocationCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Scans != counts[j].Scans {
+			return counts[i].Scans > counts[j].Scans
+		}
+		a, b := counts[i], counts[j]
+		return a.CountryCode+a.Region+a.City < b.CountryCode+b.Region+b.City
+	})
+}
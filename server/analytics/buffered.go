@@ -0,0 +1,122 @@
+package analytics
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Buffered queues scans for another Store and inserts them in batches, by
+// batch size or on a timer, whichever comes first, so a scan never waits
+// on the analytics database. Queries go straight to the underlying store.
+type Buffered struct {
+	inner     Store
+	batchSize int
+	interval  time.Duration
+
+	scans chan Scan
+	done  chan struct{}
+	once  sync.Once
+}
+
+const bufferedRetries = 3
+
+// NewBuffered starts a background writer that flushes once batchSize scans
+// are queued or every interval. If the queue fills because the store is
+// down, further scans are dropped rather than slowing redirects.
+func NewBuffered(inner Store, batchSize int, interval time.Duration) *Buffered {
+	b := &Buffered{
+		inner:     inner,
+		batchSize: batchSize,
+		interval:  interval,
+		scans:     make(chan Scan, batchSize*20),
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Buffered) Record(_ context.Context, scans ...Scan) error {
+	for _, s := range scans {
+		select {
+		case b.scans <- s:
+		default:
+			slog.Warn("analytics: queue full, dropping scan", "qr_id", s.QRID)
+		}
+	}
+	return nil
+}
+
+func (b *Buffered) Geo(ctx context.Context, q GeoQuery) (GeoResult, error) {
+	return b.inner.Geo(ctx, q)
+}
+
+func (b *Buffered) Summary(ctx context.Context, q SummaryQuery) (Summary, error) {
+	return b.inner.Summary(ctx, q)
+}
+
+func (b *Buffered) Totals(ctx context.Context, q TotalsQuery) (Totals, error) {
+	return b.inner.Totals(ctx, q)
+}
+
+func (b *Buffered) Daily(ctx context.Context, day time.Time) ([]DailyCount, error) {
+	return b.inner.Daily(ctx, day)
+}
+
+func (b *Buffered) Prune(ctx context.Context, before time.Time) error {
+	return b.inner.Prune(ctx, before)
+}
+
+// Close flushes queued scans and closes the underlying store.
+func (b *Buffered) Close() error {
+	b.once.Do(func() { close(b.scans) })
+	<-b.done
+	return b.inner.Close()
+}
+
+func (b *Buffered) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	var pending []Scan
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		b.send(pending)
+		pending = nil
+	}
+
+	for {
+		select {
+		case s, ok := <-b.scans:
+			if !ok {
+				flush()
+				return
+			}
+			pending = append(pending, s)
+			if len(pending) >= b.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (b *Buffered) send(scans []Scan) {
+	for attempt := 1; attempt <= bufferedRetries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := b.inner.Record(ctx, scans...)
+		cancel()
+
+		if err == nil {
+			return
+		}
+		slog.Error("analytics: inserting scans failed", "count", len(scans), "attempt", attempt, "error", err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
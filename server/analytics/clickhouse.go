@@ -0,0 +1,408 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ClickHouse is a Store backed by a ClickHouse server, for deployments where
+// scans number in the millions. Raw scans go to qr_scans; a materialized
+// view keeps qr_scans_geo_daily, a daily rollup by location that queries
+// read instead of scanning raw rows. Both tables expire rows after
+// RetentionDays, so Prune does nothing. It speaks the HTTP interface
+// directly.
+type ClickHouse struct {
+	URL           string // e.g. https://clickhouse.internal:8443
+	Database      string
+	Username      string
+	Password      string
+	RetentionDays int
+	Client        *http.Client
+}
+
+var clickhouseSchema = []string{
+	`CREATE TABLE IF NOT EXISTS qr_scans (
+		qr_id String,
+		owner_id String,
+		scanned_at DateTime64(3, 'UTC'),
+		country_code LowCardinality(String),
+		country LowCardinality(String),
+		region_code LowCardinality(String),
+		region String,
+		city String,
+		latitude Float64,
+		longitude Float64,
+		user_agent String,
+		device LowCardinality(String),
+		os LowCardinality(String),
+		browser LowCardinality(String),
+		referrer String
+	) ENGINE = MergeTree
+	PARTITION BY toYYYYMM(scanned_at)
+	ORDER BY (owner_id, qr_id, scanned_at)
+	TTL toDateTime(scanned_at) + INTERVAL {retention} DAY`,
+
+	// Tables created before scans recorded their client
+	`ALTER TABLE qr_scans
+		ADD COLUMN IF NOT EXISTS user_agent String,
+		ADD COLUMN IF NOT EXISTS device LowCardinality(String),
+		ADD COLUMN IF NOT EXISTS os LowCardinality(String),
+		ADD COLUMN IF NOT EXISTS browser LowCardinality(String),
+		ADD COLUMN IF NOT EXISTS referrer String`,
+
+	// Location columns are all in the key, so SummingMergeTree only sums scans
+	`CREATE TABLE IF NOT EXISTS qr_scans_geo_daily (
+		owner_id String,
+		qr_id String,
+		date Date,
+		country_code LowCardinality(String),
+		country LowCardinality(String),
+		region_code LowCardinality(String),
+		region String,
+		city String,
+		latitude Float64,
+		longitude Float64,
+		scans UInt64
+	) ENGINE = SummingMergeTree(scans)
+	PARTITION BY toYYYYMM(date)
+	ORDER BY (owner_id, qr_id, date, country_code, country, region_code, region, city, latitude, longitude)
+	TTL date + INTERVAL {retention} DAY`,
+
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS qr_scans_geo_daily_mv TO qr_scans_geo_daily AS
+	SELECT owner_id, qr_id, toDate(scanned_at) AS date,
+		country_code, country, region_code, region, city, latitude, longitude,
+		count() AS scans
+	FROM qr_scans
+	GROUP BY owner_id, qr_id, date, country_code, country, region_code, region, city, latitude, longitude`,
+}
+
+// OpenClickHouse checks the server is reachable and creates the tables if
+// they do not exist yet.
+func OpenClickHouse(ctx context.Context, ch *ClickHouse) (*ClickHouse, error) {
+	if ch.Client == nil {
+		ch.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if ch.RetentionDays <= 0 {
+		ch.RetentionDays = 400
+	}
+	ch.URL = strings.TrimRight(ch.URL, "/")
+
+	for _, stmt := range clickhouseSchema {
+		stmt = strings.ReplaceAll(stmt, "{retention}", fmt.Sprint(ch.RetentionDays))
+		resp, err := ch.do(ctx, stmt, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkResponse(resp, "creating tables"); err != nil {
+			return nil, err
+		}
+	}
+	return ch, nil
+}
+
+// do runs query. With a body, the query is sent in the URL and the body is
+// the data it reads, as INSERT needs; otherwise the query is the body.
+// Parameters fill {name:Type} placeholders server side.
+func (ch *ClickHouse) do(ctx context.Context, query string, params map[string]string, body io.Reader) (*http.Response, error) {
+	values := url.Values{}
+	if ch.Database != "" {
+		values.Set("database", ch.Database)
+	}
+	values.Set("output_format_json_quote_64bit_integers", "0")
+	for name, value := range params {
+		values.Set("param_"+name, value)
+	}
+	if body != nil {
+		values.Set("query", query)
+	} else {
+		body = strings.NewReader(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ch.URL+"/?"+values.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if ch.Username != "" {
+		req.Header.Set("X-ClickHouse-User", ch.Username)
+		req.Header.Set("X-ClickHouse-Key", ch.Password)
+	}
+
+	resp, err := ch.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("analytics: clickhouse: %w", err)
+	}
+	return resp, nil
+}
+
+func checkResponse(resp *http.Response, action string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("analytics: clickhouse: %s: %s: %s", action, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+type clickhouseScan struct {
+	QRID        string  `json:"qr_id"`
+	OwnerID     string  `json:"owner_id"`
+	ScannedAt   string  `json:"scanned_at"`
+	CountryCode string  `json:"country_code"`
+	Country     string  `json:"country"`
+	RegionCode  string  `json:"region_code"`
+	Region      string  `json:"region"`
+	City        string  `json:"city"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	UserAgent   string  `json:"user_agent"`
+	Device      string  `json:"device"`
+	OS          string  `json:"os"`
+	Browser     string  `json:"browser"`
+	Referrer    string  `json:"referrer"`
+}
+
+// Record inserts scans in one request. ClickHouse wants few large inserts,
+// so wrap it in a Buffered store rather than calling it once per scan.
+func (ch *ClickHouse) Record(ctx context.Context, scans ...Scan) error {
+	if len(scans) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range scans {
+		enc.Encode(clickhouseScan{
+			QRID:        s.QRID,
+			OwnerID:     s.OwnerID,
+			ScannedAt:   s.ScannedAt.UTC().Format("2006-01-02 15:04:05.000"),
+			CountryCode: s.Location.CountryCode,
+			Country:     s.Location.Country,
+			RegionCode:  s.Location.RegionCode,
+			Region:      s.Location.Region,
+			City:        s.Location.City,
+			Latitude:    s.Location.Latitude,
+			Longitude:   s.Location.Longitude,
+			UserAgent:   s.UserAgent,
+			Device:      s.Client.Device,
+			OS:          s.Client.OS,
+			Browser:     s.Client.Browser,
+			Referrer:    s.Referrer,
+		})
+	}
+
+	resp, err := ch.do(ctx, "INSERT INTO qr_scans FORMAT JSONEachRow", nil, &buf)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "inserting scans")
+}
+
+var clickhouseGeoColumns = map[string]string{
+	LevelCountry: "country_code, country",
+	LevelRegion:  "country_code, country, region_code, region",
+	LevelCity:    "country_code, country, region_code, region, city, latitude, longitude",
+}
+
+func (ch *ClickHouse) Geo(ctx context.Context, q GeoQuery) (GeoResult, error) {
+	columns, ok := clickhouseGeoColumns[q.Level]
+	if !ok {
+		return GeoResult{}, fmt.Errorf("analytics: unknown level %q", q.Level)
+	}
+
+	query := `SELECT ` + columns + `, sum(scans) AS scans
+		FROM qr_scans_geo_daily
+		WHERE owner_id = {owner_id:String} AND qr_id = {qr_id:String} AND date >= {since:Date}
+		GROUP BY ` + columns + `
+		ORDER BY scans DESC
+		FORMAT JSON`
+	params := map[string]string{
+		"owner_id": q.OwnerID,
+		"qr_id":    q.QRID,
+		"since":    q.Since.UTC().Format(dateFormat),
+	}
+
+	resp, err := ch.do(ctx, query, params, nil)
+	if err != nil {
+		return GeoResult{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return GeoResult{}, checkResponse(resp, "querying scans")
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data []LocationCount `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return GeoResult{}, fmt.Errorf("analytics: clickhouse: decoding response: %w", err)
+	}
+
+	result := GeoResult{Locations: []LocationCount{}}
+	for _, row := range body.Data {
+		if row.CountryCode == "" {
+			result.Unknown += row.Scans
+			continue
+		}
+		result.Locations = append(result.Locations, row)
+	}
+	sortLocations(result.Locations)
+	return result, nil
+}
+
+var clickhouseBuckets = map[string]string{
+	BucketHour: "toStartOfHour(scanned_at)",
+	BucketDay:  "toStartOfDay(scanned_at)",
+}
+
+// Summary reads raw scans, which are ordered by code and time, so one
+// code's are cheap to find.
+func (ch *ClickHouse) Summary(ctx context.Context, q SummaryQuery) (Summary, error) {
+	bucket, ok := clickhouseBuckets[q.Bucket]
+	if !ok {
+		return Summary{}, fmt.Errorf("analytics: unknown bucket %q", q.Bucket)
+	}
+	params := map[string]string{
+		"owner_id": q.OwnerID,
+		"qr_id":    q.QRID,
+		"since":    q.Since.UTC().Format("2006-01-02 15:04:05"),
+	}
+	where := `WHERE owner_id = {owner_id:String} AND qr_id = {qr_id:String} AND scanned_at >= {since:DateTime64(3, 'UTC')}`
+
+	var series []struct {
+		Start int64 `json:"start"`
+		Scans int64 `json:"scans"`
+	}
+	if err := ch.query(ctx, `SELECT toUnixTimestamp(`+bucket+`) AS start, count() AS scans FROM qr_scans `+where+`
+		GROUP BY start ORDER BY start FORMAT JSON`, params, &series); err != nil {
+		return Summary{}, err
+	}
+
+	var clients []struct {
+		Device   string `json:"device"`
+		OS       string `json:"os"`
+		Browser  string `json:"browser"`
+		Referrer string `json:"referrer"`
+		Scans    int64  `json:"scans"`
+	}
+	if err := ch.query(ctx, `SELECT device, os, browser, referrer, count() AS scans FROM qr_scans `+where+`
+		GROUP BY device, os, browser, referrer FORMAT JSON`, params, &clients); err != nil {
+		return Summary{}, err
+	}
+
+	result := Summary{Series: []BucketCount{}}
+	for _, row := range series {
+		result.Series = append(result.Series, BucketCount{time.Unix(row.Start, 0).UTC(), row.Scans})
+		result.Total += row.Scans
+	}
+	counts := map[string]map[string]int64{
+		fieldDevice: {}, fieldOS: {}, fieldBrowser: {}, fieldReferrer: {},
+	}
+	for _, row := range clients {
+		counts[fieldDevice][row.Device] += row.Scans
+		counts[fieldOS][row.OS] += row.Scans
+		counts[fieldBrowser][row.Browser] += row.Scans
+		counts[fieldReferrer][row.Referrer] += row.Scans
+	}
+	result.setBreakdowns(counts)
+	return result, nil
+}
+
+// Totals reads the daily rollup, which is ordered by owner first.
+func (ch *ClickHouse) Totals(ctx context.Context, q TotalsQuery) (Totals, error) {
+	var rows []struct {
+		QRID  string `json:"qr_id"`
+		Date  string `json:"date"`
+		Scans int64  `json:"scans"`
+	}
+	if err := ch.query(ctx, `SELECT qr_id, toString(date) AS date, sum(scans) AS scans
+		FROM qr_scans_geo_daily
+		WHERE owner_id = {owner_id:String} AND date >= {since:Date}
+		GROUP BY qr_id, date FORMAT JSON`, map[string]string{
+		"owner_id": q.OwnerID,
+		"since":    q.Since.UTC().Format(dateFormat),
+	}, &rows); err != nil {
+		return Totals{}, err
+	}
+
+	days, codes := map[time.Time]int64{}, map[string]int64{}
+	for _, row := range rows {
+		day, err := time.Parse(dateFormat, row.Date)
+		if err != nil {
+			return Totals{}, fmt.Errorf("analytics: clickhouse: reading date: %w", err)
+		}
+		days[day] += row.Scans
+		codes[row.QRID] += row.Scans
+	}
+	return newTotals(days, codes), nil
+}
+
+// query runs a FORMAT JSON query and decodes its rows into data.
+func (ch *ClickHouse) query(ctx context.Context, query string, params map[string]string, data interface{}) error {
+	resp, err := ch.do(ctx, query, params, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return checkResponse(resp, "querying scans")
+	}
+	defer resp.Body.Close()
+
+	body := struct {
+		Data interface{} `json:"data"`
+	}{data}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("analytics: clickhouse: decoding response: %w", err)
+	}
+	return nil
+}
+
+func (ch *ClickHouse) Daily(ctx context.Context, day time.Time) ([]DailyCount, error) {
+	columns := clickhouseGeoColumns[LevelCity]
+	query := `SELECT qr_id, owner_id, toString(date) AS date, ` + columns + `, sum(scans) AS scans
+		FROM qr_scans_geo_daily
+		WHERE date = {day:Date}
+		GROUP BY qr_id, owner_id, date, ` + columns + `
+		FORMAT JSONEachRow`
+
+	resp, err := ch.do(ctx, query, map[string]string{"day": day.UTC().Format(dateFormat)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, checkResponse(resp, "querying daily scans")
+	}
+	defer resp.Body.Close()
+
+	var counts []DailyCount
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var row struct {
+			QRID    string `json:"qr_id"`
+			OwnerID string `json:"owner_id"`
+			Date    string `json:"date"`
+			LocationCount
+		}
+		if err := dec.Decode(&row); err != nil {
+			return nil, fmt.Errorf("analytics: clickhouse: decoding response: %w", err)
+		}
+		counts = append(counts, DailyCount{QRID: row.QRID, OwnerID: row.OwnerID, Date: row.Date, Location: row.Location, Scans: row.Scans})
+	}
+	return counts, nil
+}
+
+// Prune does nothing: the tables' TTL expires old scans.
+func (ch *ClickHouse) Prune(context.Context, time.Time) error {
+	return nil
+}
+
+func (ch *ClickHouse) Close() error {
+	return nil
+}
@@ -0,0 +1,217 @@
+package analytics
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const dateFormat = "2006-01-02"
+
+// Memory keeps scan counts per code in memory: daily by location and by
+// client, and hourly in total.
+type Memory struct {
+	mu    sync.Mutex
+	codes map[string]*memoryCode
+}
+
+type memoryCode struct {
+	ownerID string
+	days    map[string]map[Location]int64        // date -> location -> scans
+	clients map[string]map[memoryBreakdown]int64 // date -> field value -> scans
+	hours   map[time.Time]int64                  // start of hour, UTC -> scans
+}
+
+type memoryBreakdown struct {
+	field, value string
+}
+
+func NewMemory() *Memory {
+	return &Memory{codes: make(map[string]*memoryCode)}
+}
+
+func (m *Memory) Record(_ context.Context, scans ...Scan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range scans {
+		code, ok := m.codes[s.QRID]
+		if !ok {
+			code = &memoryCode{
+				ownerID: s.OwnerID,
+				days:    make(map[string]map[Location]int64),
+				clients: make(map[string]map[memoryBreakdown]int64),
+				hours:   make(map[time.Time]int64),
+			}
+			m.codes[s.QRID] = code
+		}
+		date := s.ScannedAt.UTC().Format(dateFormat)
+		if code.days[date] == nil {
+			code.days[date] = make(map[Location]int64)
+			code.clients[date] = make(map[memoryBreakdown]int64)
+		}
+		code.days[date][s.Location]++
+		code.clients[date][memoryBreakdown{fieldDevice, s.Client.Device}]++
+		code.clients[date][memoryBreakdown{fieldOS, s.Client.OS}]++
+		code.clients[date][memoryBreakdown{fieldBrowser, s.Client.Browser}]++
+		code.clients[date][memoryBreakdown{fieldReferrer, s.Referrer}]++
+		code.hours[s.ScannedAt.UTC().Truncate(time.Hour)]++
+	}
+	return nil
+}
+
+func (m *Memory) Geo(_ context.Context, q GeoQuery) (GeoResult, error) {
+	since := q.Since.UTC().Format(dateFormat)
+	result := GeoResult{Locations: []LocationCount{}}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	code, ok := m.codes[q.QRID]
+	if !ok || code.ownerID != q.OwnerID {
+		return result, nil
+	}
+
+	totals := make(map[Location]int64)
+	for date, locations := range code.days {
+		// Dates are ISO formatted, so they compare as strings
+		if date < since {
+			continue
+		}
+		for loc, n := range locations {
+			if loc.CountryCode == "" {
+				result.Unknown += n
+				continue
+			}
+			totals[loc.At(q.Level)] += n
+		}
+	}
+
+	for loc, n := range totals {
+		result.Locations = append(result.Locations, LocationCount{loc, n})
+	}
+	sortLocations(result.Locations)
+	return result, nil
+}
+
+// Summary's breakdowns are kept by day, so they cover the whole of Since's
+// day even when the series starts later in it.
+func (m *Memory) Summary(_ context.Context, q SummaryQuery) (Summary, error) {
+	since := q.Since.UTC()
+	result := Summary{Series: []BucketCount{}}
+	counts := map[string]map[string]int64{}
+	for _, field := range []string{fieldDevice, fieldOS, fieldBrowser, fieldReferrer} {
+		counts[field] = map[string]int64{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	code, ok := m.codes[q.QRID]
+	if !ok || code.ownerID != q.OwnerID {
+		result.setBreakdowns(counts)
+		return result, nil
+	}
+
+	buckets := make(map[time.Time]int64)
+	for hour, n := range code.hours {
+		if hour.Before(since.Truncate(time.Hour)) {
+			continue
+		}
+		start := hour
+		if q.Bucket == BucketDay {
+			start = time.Date(hour.Year(), hour.Month(), hour.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		buckets[start] += n
+		result.Total += n
+	}
+	for start, n := range buckets {
+		result.Series = append(result.Series, BucketCount{start, n})
+	}
+	sort.Slice(result.Series, func(i, j int) bool { return result.Series[i].Start.Before(result.Series[j].Start) })
+
+	sinceDate := since.Format(dateFormat)
+	for date, values := range code.clients {
+		if date < sinceDate {
+			continue
+		}
+		for b, n := range values {
+			counts[b.field][b.value] += n
+		}
+	}
+	result.setBreakdowns(counts)
+	return result, nil
+}
+
+func (m *Memory) Totals(_ context.Context, q TotalsQuery) (Totals, error) {
+	since := q.Since.UTC().Format(dateFormat)
+	days, codes := map[time.Time]int64{}, map[string]int64{}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for qrID, code := range m.codes {
+		if code.ownerID != q.OwnerID {
+			continue
+		}
+		for date, locations := range code.days {
+			if date < since {
+				continue
+			}
+			day, err := time.Parse(dateFormat, date)
+			if err != nil {
+				return Totals{}, err
+			}
+			for _, n := range locations {
+				days[day] += n
+				codes[qrID] += n
+			}
+		}
+	}
+	return newTotals(days, codes), nil
+}
+
+func (m *Memory) Daily(_ context.Context, day time.Time) ([]DailyCount, error) {
+	date := day.UTC().Format(dateFormat)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var counts []DailyCount
+	for qrID, code := range m.codes {
+		for loc, n := range code.days[date] {
+			counts = append(counts, DailyCount{QRID: qrID, OwnerID: code.ownerID, Date: date, Location: loc, Scans: n})
+		}
+	}
+	return counts, nil
+}
+
+func (m *Memory) Prune(_ context.Context, before time.Time) error {
+	cutoff := before.UTC().Format(dateFormat)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for qrID, code := range m.codes {
+		for date := range code.days {
+			if date < cutoff {
+				delete(code.days, date)
+				delete(code.clients, date)
+			}
+		}
+		for hour := range code.hours {
+			if hour.Format(dateFormat) < cutoff {
+				delete(code.hours, hour)
+			}
+		}
+		if len(code.days) == 0 {
+			delete(m.codes, qrID)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,83 @@
+package analytics
+
+import "strings"
+
+// Device types a user agent is classified as.
+const (
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
+
+// Client is what a scan's user agent says about the scanner, coarse enough
+// that it can be kept without identifying anyone.
+type Client struct {
+	Device  string
+	OS      string
+	Browser string
+}
+
+// ParseUserAgent classifies a User-Agent header. It only recognises the
+// common families; anything else is "other".
+func ParseUserAgent(ua string) Client {
+	l := strings.ToLower(ua)
+	c := Client{Device: DeviceOther, OS: "other", Browser: "other"}
+	if l == "" {
+		return c
+	}
+
+	switch {
+	case containsAny(l, "bot", "crawler", "spider", "preview", "curl/", "wget/", "python-requests", "go-http-client"):
+		c.Device = DeviceBot
+	case strings.Contains(l, "ipad"), strings.Contains(l, "tablet"),
+		strings.Contains(l, "android") && !strings.Contains(l, "mobile"):
+		c.Device = DeviceTablet
+	case containsAny(l, "mobile", "iphone", "ipod", "android"):
+		c.Device = DeviceMobile
+	case containsAny(l, "windows", "macintosh", "x11", "cros"):
+		c.Device = DeviceDesktop
+	}
+
+	switch {
+	case containsAny(l, "iphone", "ipad", "ipod"):
+		c.OS = "ios"
+	case strings.Contains(l, "android"):
+		c.OS = "android"
+	case strings.Contains(l, "windows"):
+		c.OS = "windows"
+	case strings.Contains(l, "macintosh"), strings.Contains(l, "mac os x"):
+		c.OS = "macos"
+	case strings.Contains(l, "cros"):
+		c.OS = "chromeos"
+	case strings.Contains(l, "linux"):
+		c.OS = "linux"
+	}
+
+	// Order matters: most browsers also claim to be Safari or Chrome
+	switch {
+	case containsAny(l, "edg/", "edga/", "edgios/"):
+		c.Browser = "edge"
+	case containsAny(l, "opr/", "opera"):
+		c.Browser = "opera"
+	case strings.Contains(l, "samsungbrowser"):
+		c.Browser = "samsung"
+	case containsAny(l, "firefox/", "fxios/"):
+		c.Browser = "firefox"
+	case containsAny(l, "chrome/", "crios/"):
+		c.Browser = "chrome"
+	case strings.Contains(l, "safari/"):
+		c.Browser = "safari"
+	}
+	return c
+}
+
+func containsAny(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
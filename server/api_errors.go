@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strings"
+
+	"backup-manager/validate"
+)
+
+// Every failure is answered with the same JSON body:
+//
+//	{"error": {"code": "invalid_token", "message": "Invalid token", "request_id": "..."}}
+//
+// code is stable for the client to act on and message is fit to show a
+// person. Handlers that need a specific code, or fields beyond these, write
+// an apiError; the many that call http.Error are rewritten by errorEnvelope,
+// taking their code from the status.
+
+// Codes clients act on. Others are taken from the status, see
+// statusErrorCodes.
+const (
+	errCodeAuthRequired     = "authorization_required"
+	errCodeInvalidToken     = "invalid_token"
+	errCodeSessionEnded     = "session_ended"
+	errCodeInvalidAPIKey    = "invalid_api_key"
+	errCodeAPIKeyExpired    = "api_key_expired"
+	errCodeAPIKeyForbidden  = "api_key_not_allowed"
+	errCodeMissingScope     = "insufficient_scope"
+	errCodeRoleRequired     = "role_required"
+	errCodeTeamRoleRequired = "team_role_required"
+	errCodeRateLimited      = "rate_limited"
+	errCodeLoginLocked      = "login_locked"
+	errCodeDatabase         = "database_error"
+	errCodeDataKeyLocked    = "data_key_locked"
+	errCodeValidation       = "validation_failed"
+)
+
+// statusErrorCodes are the codes of errors that don't give their own.
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:                   "invalid_request",
+	http.StatusUnauthorized:                 "unauthorized",
+	http.StatusForbidden:                    "forbidden",
+	http.StatusNotFound:                     "not_found",
+	http.StatusMethodNotAllowed:             "method_not_allowed",
+	http.StatusConflict:                     "conflict",
+	http.StatusGone:                         "gone",
+	http.StatusPreconditionFailed:           "precondition_failed",
+	http.StatusRequestEntityTooLarge:        "too_large",
+	http.StatusUnsupportedMediaType:         "unsupported_media_type",
+	http.StatusRequestedRangeNotSatisfiable: "range_not_satisfiable",
+	http.StatusUnprocessableEntity:          "unprocessable",
+	http.StatusLocked:                       "locked",
+	http.StatusTooManyRequests:              errCodeRateLimited,
+	http.StatusInternalServerError:          "internal_error",
+	http.StatusNotImplemented:               "not_implemented",
+	http.StatusBadGateway:                   "bad_gateway",
+	http.StatusServiceUnavailable:           "unavailable",
+	http.StatusGatewayTimeout:               "timeout",
+}
+
+func statusErrorCode(status int) string {
+	if code, ok := statusErrorCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return "internal_error"
+	}
+	return "invalid_request"
+}
+
+// apiError is a failure to report to the client.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	// Details are more fields for the error object, such as the second
+	// factors a login can use
+	Details map[string]interface{}
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+// writeError answers with an error of status, code and message.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, &apiError{Status: status, Code: code, Message: message})
+}
+
+// writeAPIError answers with e. The request ID is the one requestLogging put
+// in the response headers.
+func writeAPIError(w http.ResponseWriter, e *apiError) {
+	body := make(map[string]interface{}, len(e.Details)+3)
+	for k, v := range e.Details {
+		body[k] = v
+	}
+	body["code"] = e.Code
+	body["message"] = e.Message
+	if id := w.Header().Get("X-Request-ID"); id != "" {
+		body["request_id"] = id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": body})
+}
+
+// decodeRequest reads the JSON body into v and checks it against v's
+// validate tags. On failure it answers with the fields at fault and returns
+// false.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			writeValidationError(w, validate.Errors{{
+				Field:   typeErr.Field,
+				Rule:    "type",
+				Message: typeErr.Field + " must be " + jsonTypeName(typeErr.Type.Kind()),
+			}})
+		case errors.As(err, &tooLarge):
+			writeError(w, http.StatusRequestEntityTooLarge, "too_large", "Request body too large")
+		default:
+			writeError(w, http.StatusBadRequest, "invalid_request", "Invalid request")
+		}
+		return false
+	}
+	if errs := validate.Struct(v); len(errs) > 0 {
+		writeValidationError(w, errs)
+		return false
+	}
+	return true
+}
+
+// writeValidationError answers with the fields at fault in a request. Each
+// has its own message, and the error's message joins them.
+func writeValidationError(w http.ResponseWriter, errs validate.Errors) {
+	writeAPIError(w, &apiError{
+		Status:  http.StatusBadRequest,
+		Code:    errCodeValidation,
+		Message: errs.Error(),
+		Details: map[string]interface{}{"fields": errs},
+	})
+}
+
+// writeFieldError answers with one field at fault, for checks tags can't
+// express.
+func writeFieldError(w http.ResponseWriter, field, rule, message string) {
+	writeValidationError(w, validate.Errors{{Field: field, Rule: rule, Message: message}})
+}
+
+func jsonTypeName(k reflect.Kind) string {
+	switch k {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	}
+	return "an object"
+}
+
+// maxErrorMessage bounds how much of a plain-text error is kept.
+const maxErrorMessage = 1024
+
+// errorEnvelope rewrites plain-text errors, as written by http.Error, into
+// the JSON error body, and answers a handler's panic with a 500 rather than
+// a dropped connection.
+func errorEnvelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorEnvelopeWriter{ResponseWriter: w}
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logger(r.Context()).Error("Handler panicked", "panic", v, "stack", string(debug.Stack()))
+				if ew.wrote {
+					// Too late for an error response; drop the connection
+					panic(http.ErrAbortHandler)
+				}
+				ew.status = 0
+				writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+				return
+			}
+			ew.finish()
+		}()
+		next.ServeHTTP(ew, r)
+	})
+}
+
+// errorEnvelopeWriter holds back an error response written as plain text so
+// it can be sent as JSON once the handler is done.
+type errorEnvelopeWriter struct {
+	http.ResponseWriter
+	// status is that of the error being held back, if any
+	status  int
+	message bytes.Buffer
+	wrote   bool
+}
+
+func (e *errorEnvelopeWriter) WriteHeader(status int) {
+	if e.wrote || e.status != 0 {
+		return
+	}
+	if status >= http.StatusBadRequest && plainTextError(e.Header()) {
+		e.status = status
+		return
+	}
+	e.wrote = true
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func plainTextError(h http.Header) bool {
+	ct := h.Get("Content-Type")
+	return ct == "" || strings.HasPrefix(ct, "text/plain")
+}
+
+func (e *errorEnvelopeWriter) Write(b []byte) (int, error) {
+	if e.status != 0 {
+		if room := maxErrorMessage - e.message.Len(); room > 0 {
+			e.message.Write(b[:min(len(b), room)])
+		}
+		return len(b), nil
+	}
+	e.wrote = true
+	return e.ResponseWriter.Write(b)
+}
+
+// FlushError keeps a held-back error from being sent early by a flush.
+func (e *errorEnvelopeWriter) FlushError() error {
+	if e.status != 0 {
+		return nil
+	}
+	e.wrote = true
+	return http.NewResponseController(e.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (e *errorEnvelopeWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+func (e *errorEnvelopeWriter) finish() {
+	if e.status == 0 {
+		return
+	}
+	message := strings.TrimSpace(e.message.String())
+	if message == "" {
+		message = http.StatusText(e.status)
+	}
+	e.Header().Del("Content-Length")
+	writeAPIError(e.ResponseWriter, &apiError{Status: e.status, Code: statusErrorCode(e.status), Message: message})
+}
+
+// methodNotAllowedHandler answers a request for a route that exists with
+// another method; the router's own answer has no body.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/storage"
+)
+
+const (
+	usageDateFormat    = "2006-01-02"
+	usageRetentionDays = 90
+	defaultUsageDays   = 30
+)
+
+// APIKeyUsageDay is one day's rollup of requests made with an API key.
+type APIKeyUsageDay = storage.APIKeyUsageDay
+
+// apiKeyUsageFlushInterval is how long counts wait in memory before they
+// are added to the key's rollup in the database.
+const apiKeyUsageFlushInterval = time.Minute
+
+// apiKeyUsageRegistry counts requests in memory and adds them to the
+// database in batches, so a request doesn't wait on a write. Reads merge in
+// the counts not yet flushed.
+type apiKeyUsageRegistry struct {
+	mu      sync.Mutex
+	pending map[string]*APIKeyUsageDay // key ID and date -> counts since the last flush
+}
+
+var apiKeyUsage = &apiKeyUsageRegistry{
+	pending: make(map[string]*APIKeyUsageDay),
+}
+
+func (reg *apiKeyUsageRegistry) record(keyID string, status int, bytesIn, bytesOut int64) {
+	date := time.Now().UTC().Format(usageDateFormat)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	day, ok := reg.pending[keyID+"/"+date]
+	if !ok {
+		day = &APIKeyUsageDay{KeyID: keyID, Date: date}
+		reg.pending[keyID+"/"+date] = day
+	}
+
+	day.Requests++
+	if status >= 400 {
+		day.Errors++
+	}
+	if status == http.StatusTooManyRequests {
+		day.RateLimited++
+	}
+	if bytesIn > 0 {
+		day.BytesIn += bytesIn
+	}
+	day.BytesOut += bytesOut
+}
+
+// flush adds the pending counts to the database. Counts that fail to save
+// are kept for the next flush.
+func (reg *apiKeyUsageRegistry) flush() {
+	reg.mu.Lock()
+	pending := reg.pending
+	reg.pending = make(map[string]*APIKeyUsageDay)
+	reg.mu.Unlock()
+
+	ctx := context.Background()
+	for id, day := range pending {
+		if err := db.APIKeyUsage().Add(ctx, *day); err != nil {
+			slog.Error("Failed to save API key usage", "api_key_id", day.KeyID, "date", day.Date, "error", err)
+			reg.restore(id, day)
+		}
+	}
+}
+
+func (reg *apiKeyUsageRegistry) restore(id string, day *APIKeyUsageDay) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if cur, ok := reg.pending[id]; ok {
+		addUsage(cur, *day)
+		return
+	}
+	reg.pending[id] = day
+}
+
+// Close flushes the pending counts at shutdown.
+func (reg *apiKeyUsageRegistry) Close() error {
+	reg.flush()
+	return nil
+}
+
+// withPending adds the counts not yet flushed to rollups read from the
+// database.
+func (reg *apiKeyUsageRegistry) withPending(usage []APIKeyUsageDay, keep func(*APIKeyUsageDay) bool) []APIKeyUsageDay {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, day := range reg.pending {
+		if !keep(day) {
+			continue
+		}
+		found := false
+		for i := range usage {
+			if usage[i].KeyID == day.KeyID && usage[i].Date == day.Date {
+				addUsage(&usage[i], *day)
+				found = true
+				break
+			}
+		}
+		if !found {
+			usage = append(usage, *day)
+		}
+	}
+	return usage
+}
+
+func addUsage(to *APIKeyUsageDay, u APIKeyUsageDay) {
+	to.Requests += u.Requests
+	to.Errors += u.Errors
+	to.RateLimited += u.RateLimited
+	to.BytesIn += u.BytesIn
+	to.BytesOut += u.BytesOut
+}
+
+// since returns the key's daily rollups from the given number of days ago
+// until today, oldest first, with zero-filled days.
+func (reg *apiKeyUsageRegistry) since(ctx context.Context, keyID string, days int) ([]APIKeyUsageDay, error) {
+	today := time.Now().UTC()
+	from := today.AddDate(0, 0, -(days - 1)).Format(usageDateFormat)
+	stored, err := db.APIKeyUsage().Since(ctx, keyID, from)
+	if err != nil {
+		return nil, err
+	}
+	stored = reg.withPending(stored, func(d *APIKeyUsageDay) bool {
+		return d.KeyID == keyID && d.Date >= from
+	})
+
+	byDate := make(map[string]APIKeyUsageDay, len(stored))
+	for _, day := range stored {
+		byDate[day.Date] = day
+	}
+	usage := make([]APIKeyUsageDay, 0, days)
+	for i := days - 1; i >= 0; i-- {
+		date := today.AddDate(0, 0, -i).Format(usageDateFormat)
+		if day, ok := byDate[date]; ok {
+			usage = append(usage, day)
+		} else {
+			usage = append(usage, APIKeyUsageDay{KeyID: keyID, Date: date})
+		}
+	}
+	return usage, nil
+}
+
+// onDay returns every key's rollup for date (YYYY-MM-DD, UTC).
+func (reg *apiKeyUsageRegistry) onDay(ctx context.Context, date string) ([]APIKeyUsageDay, error) {
+	usage, err := db.APIKeyUsage().OnDay(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+	return reg.withPending(usage, func(d *APIKeyUsageDay) bool { return d.Date == date }), nil
+}
+
+func (reg *apiKeyUsageRegistry) prune() {
+	// Dates are ISO formatted, so they compare as strings
+	cutoff := time.Now().UTC().AddDate(0, 0, -usageRetentionDays).Format(usageDateFormat)
+	if err := db.APIKeyUsage().Prune(context.Background(), cutoff); err != nil {
+		slog.Error("Failed to prune API key usage", "error", err)
+	}
+}
+
+// usageRecorder captures the status and size of a response, for usage
+// accounting and request logs.
+type usageRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (u *usageRecorder) WriteHeader(status int) {
+	if u.status == 0 {
+		u.status = status
+	}
+	u.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (u *usageRecorder) Unwrap() http.ResponseWriter {
+	return u.ResponseWriter
+}
+
+func (u *usageRecorder) Write(b []byte) (int, error) {
+	if u.status == 0 {
+		u.status = http.StatusOK
+	}
+	n, err := u.ResponseWriter.Write(b)
+	u.bytes += int64(n)
+	return n, err
+}
+
+func summarizeUsage(days []APIKeyUsageDay) map[string]interface{} {
+	var total APIKeyUsageDay
+	for _, d := range days {
+		total.Requests += d.Requests
+		total.Errors += d.Errors
+		total.RateLimited += d.RateLimited
+		total.BytesIn += d.BytesIn
+		total.BytesOut += d.BytesOut
+	}
+
+	errorRate := 0.0
+	if total.Requests > 0 {
+		errorRate = float64(total.Errors) / float64(total.Requests)
+	}
+	return map[string]interface{}{
+		"requests":     total.Requests,
+		"errors":       total.Errors,
+		"error_rate":   errorRate,
+		"rate_limited": total.RateLimited,
+		"bytes_in":     total.BytesIn,
+		"bytes_out":    total.BytesOut,
+	}
+}
+
+// Handlers
+func getAPIKeyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	keys, err := apiKeys.listForUser(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "API keys")
+		return
+	}
+	var name string
+	for _, key := range keys {
+		if key.ID == id {
+			name = key.Name
+		}
+	}
+	if name == "" {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days <= 0 || days > usageRetentionDays {
+		days = defaultUsageDays
+	}
+
+	usage, err := apiKeyUsage.since(r.Context(), id, days)
+	if err != nil {
+		writeStorageError(w, r, err, "API key usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"api_key_id": id,
+		"name":       name,
+		"days":       usage,
+		"totals":     summarizeUsage(usage),
+	})
+}
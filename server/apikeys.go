@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	apiKeyPrefix           = "bmk_"
+	defaultAPIKeyRateLimit = 60 // requests per minute
+)
+
+// Scopes an API key can be granted. Each resource has a read and a write
+// scope; reads cover GET/HEAD, writes everything else. qr:create is the
+// part of qr:write a script generating codes needs: creating them, but not
+// changing where existing ones point.
+var apiKeyScopes = map[string]bool{
+	"backups:read":   true,
+	"backups:write":  true,
+	"projects:read":  true,
+	"projects:write": true,
+	"qr:read":        true,
+	"qr:write":       true,
+	"qr:create":      true,
+}
+
+// APIKey grants programmatic access on behalf of a user; see
+// storage.APIKey.
+type APIKey = storage.APIKey
+
+// apiKeyRegistry finds keys in the database by the hash of the key a
+// request presents.
+type apiKeyRegistry struct{}
+
+var (
+	apiKeys       = &apiKeyRegistry{}
+	apiKeyLimiter = newRateLimiter()
+)
+
+// lookup returns ok false for a key that doesn't exist.
+func (reg *apiKeyRegistry) lookup(ctx context.Context, plaintext string) (APIKey, bool, error) {
+	key, err := db.APIKeys().GetByHash(ctx, hashToken(plaintext))
+	if errors.Is(err, storage.ErrNotFound) {
+		return APIKey{}, false, nil
+	}
+	return key, err == nil, err
+}
+
+func (reg *apiKeyRegistry) touch(ctx context.Context, id string) {
+	if err := db.APIKeys().Touch(ctx, id, time.Now()); err != nil {
+		logger(ctx).Error("Error recording API key use", "key_id", id, "error", err)
+	}
+}
+
+// owner returns the ID of the user a key belongs to, "" if it is gone.
+func (reg *apiKeyRegistry) owner(ctx context.Context, id string) string {
+	key, err := db.APIKeys().Get(ctx, id)
+	if err != nil {
+		return ""
+	}
+	return key.UserID
+}
+
+func (reg *apiKeyRegistry) listForUser(ctx context.Context, userID string) ([]APIKey, error) {
+	return db.APIKeys().List(ctx, userID)
+}
+
+// revokeUser revokes every key of the user, for when the account is
+// disabled.
+func (reg *apiKeyRegistry) revokeUser(ctx context.Context, userID string) error {
+	return db.APIKeys().RevokeUser(ctx, userID)
+}
+
+// requiredScopes maps a request to the scopes an API key needs one of for
+// it. Routes under /api/{resource} need {resource}:read or {resource}:write;
+// anything else (account, key management, admin) is not reachable with an
+// API key.
+func requiredScopes(r *http.Request) ([]string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/"), "/", 2)
+
+	var resource string
+	switch parts[0] {
+	case "backups", "projects", "qr":
+		resource = parts[0]
+	case "uploads":
+		// Resumable uploads make backups; checking how far one has got is
+		// part of making it
+		return []string{"backups:write"}, true
+	case "jobs":
+		// Jobs are of backups or QR codes, and only readable
+		if isReadMethod(r.Method) {
+			return []string{"backups:read", "qr:read", "qr:create"}, true
+		}
+		return nil, false
+	default:
+		return nil, false
+	}
+
+	if isReadMethod(r.Method) {
+		return []string{resource + ":read"}, true
+	}
+	if r.Method == http.MethodPost && (r.URL.Path == "/api/qr" || r.URL.Path == "/api/qr/batch" || r.URL.Path == "/api/qr/batch/jobs") {
+		return []string{"qr:write", "qr:create"}, true
+	}
+	return []string{resource + ":write"}, true
+}
+
+func apiKeyRateLimit() int {
+	return rateLimitSetting("API_KEY_RATE_LIMIT", defaultAPIKeyRateLimit)
+}
+
+// serveWithAPIKey authenticates the request with an API key and, if allowed,
+// serves it with next. Every request made with a known key is counted in
+// its usage, including ones the key is refused for.
+func serveWithAPIKey(w http.ResponseWriter, r *http.Request, plaintext string, next http.HandlerFunc) {
+	key, ok, err := apiKeys.lookup(r.Context(), plaintext)
+	if err != nil {
+		logger(r.Context()).Error("Error loading API key", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	if !ok || !key.IsActive {
+		writeError(w, http.StatusUnauthorized, errCodeInvalidAPIKey, "Invalid API key")
+		return
+	}
+	// The key acts for its owner as they are now, not as they were when it
+	// was made
+	user, err := db.Users().Get(r.Context(), key.UserID)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, http.StatusUnauthorized, errCodeInvalidAPIKey, "Invalid API key")
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading API key owner", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+
+	rec := &usageRecorder{ResponseWriter: w}
+	defer func() {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		apiKeyUsage.record(key.ID, rec.status, r.ContentLength, rec.bytes)
+	}()
+
+	if authorizeAPIKey(rec, r, key, user) {
+		next(rec, r)
+	}
+}
+
+// authorizeAPIKey checks the key may make this request for user, its owner.
+// On failure it writes the response and returns false.
+func authorizeAPIKey(w http.ResponseWriter, r *http.Request, key APIKey, user User) bool {
+	if user.Disabled {
+		accountBlocked(w, "account_disabled")
+		return false
+	}
+	if key.Expired() {
+		writeError(w, http.StatusUnauthorized, errCodeAPIKeyExpired, "API key expired")
+		return false
+	}
+
+	scopes, ok := requiredScopes(r)
+	if !ok {
+		writeError(w, http.StatusForbidden, errCodeAPIKeyForbidden, "This endpoint is not available to API keys")
+		return false
+	}
+	if !key.HasScope(scopes...) {
+		writeError(w, http.StatusForbidden, errCodeMissingScope, fmt.Sprintf("API key lacks the %s scope", scopes[0]))
+		return false
+	}
+
+	if !limitRequest(w, apiKeyLimiter, key.ID, key.RateLimit) {
+		return false
+	}
+
+	apiKeys.touch(r.Context(), key.ID)
+
+	r.Header.Set("X-User-ID", user.ID)
+	r.Header.Set("X-User-Email", user.Email)
+	r.Header.Set("X-API-Key-ID", key.ID)
+	addLogAttrs(r, "user_id", key.UserID, "api_key_id", key.ID)
+	return true
+}
+
+// Handlers
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Name      string     `json:"name" validate:"required,max=100"`
+		Scopes    []string   `json:"scopes" validate:"required"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		RateLimit int        `json:"rate_limit" validate:"min=0"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	for _, scope := range req.Scopes {
+		if !apiKeyScopes[scope] {
+			writeFieldError(w, "scopes", "oneof", fmt.Sprintf("unknown scope %q", scope))
+			return
+		}
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		writeFieldError(w, "expires_at", "future", "expires_at must be in the future")
+		return
+	}
+	maxRate := apiKeyRateLimit()
+	if req.RateLimit <= 0 || req.RateLimit > maxRate {
+		req.RateLimit = maxRate
+	}
+
+	existing, err := apiKeys.listForUser(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "API keys")
+		return
+	}
+	for _, existing := range existing {
+		if existing.IsActive && existing.Name == req.Name {
+			http.Error(w, "An API key with this name already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	plaintext := apiKeyPrefix + generateToken()
+	key := APIKey{
+		ID:        generateID(),
+		UserID:    userID,
+		Name:      req.Name,
+		Prefix:    plaintext[:len(apiKeyPrefix)+8],
+		KeyHash:   hashToken(plaintext),
+		Scopes:    req.Scopes,
+		RateLimit: req.RateLimit,
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now(),
+		IsActive:  true,
+	}
+	if err := db.APIKeys().Create(r.Context(), key); err != nil {
+		writeStorageError(w, r, err, "API key")
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "api_key.created",
+		ResourceType: "api_key",
+		ResourceID:   key.ID,
+		Metadata:     map[string]interface{}{"name": key.Name, "scopes": key.Scopes},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     plaintext,
+		"api_key": key,
+	})
+}
+
+func getAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	keys, err := apiKeys.listForUser(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "API keys")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if err := db.APIKeys().Revoke(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "API key")
+		return
+	}
+
+	logger(r.Context()).Info("API key revoked", "key_id", id)
+	recordAudit(r, AuditEvent{Action: "api_key.revoked", ResourceType: "api_key", ResourceID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEvent is a security-relevant action, stored in audit_logs.
+type AuditEvent struct {
+	ID           string                 `json:"id"`
+	UserID       string                 `json:"user_id,omitempty"`
+	Action       string                 `json:"action"`
+	ResourceType string                 `json:"resource_type,omitempty"`
+	ResourceID   string                 `json:"resource_id,omitempty"`
+	IPAddress    string                 `json:"ip_address"`
+	UserAgent    string                 `json:"user_agent"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt    time.Time              `json:"created_at"`
+}
+
+// auditBufferDays is how long audit events stay in memory, long enough for
+// the nightly warehouse export to pick up a day even after a missed run.
+const auditBufferDays = 7
+
+// auditLogRegistry keeps recent audit events by day.
+type auditLogRegistry struct {
+	mu   sync.Mutex
+	days map[string][]AuditEvent
+}
+
+var auditLog = &auditLogRegistry{days: make(map[string][]AuditEvent)}
+
+func (reg *auditLogRegistry) add(event AuditEvent) {
+	date := event.CreatedAt.UTC().Format(usageDateFormat)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.days[date] = append(reg.days[date], event)
+}
+
+// onDay returns the events recorded on date (YYYY-MM-DD, UTC).
+func (reg *auditLogRegistry) onDay(date string) []AuditEvent {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	return append([]AuditEvent(nil), reg.days[date]...)
+}
+
+func (reg *auditLogRegistry) prune() {
+	cutoff := time.Now().UTC().AddDate(0, 0, -auditBufferDays).Format(usageDateFormat)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for date := range reg.days {
+		if date < cutoff {
+			delete(reg.days, date)
+		}
+	}
+}
+
+// recordAudit stores an audit event for the request, filling in the caller's
+// IP, user agent and user ID when the event does not set them.
+func recordAudit(r *http.Request, event AuditEvent) {
+	event.ID = generateID()
+	event.CreatedAt = time.Now()
+	event.IPAddress = clientIP(r)
+	event.UserAgent = r.UserAgent()
+	if event.UserID == "" {
+		event.UserID = r.Header.Get("X-User-ID")
+	}
+
+	// Store event in audit_logs (implement your DB logic here)
+	auditLog.add(event)
+
+	logger(r.Context()).Info("audit", "event", event)
+}
+
+// clientIP is the address of the caller. Behind the nginx proxy deploy.sh
+// sets up every request comes from the loopback address, so the X-Real-IP
+// header it adds is used instead; from anywhere else the header could be
+// forged and is ignored.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+			return real.String()
+		}
+	}
+	return host
+}
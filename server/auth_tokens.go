@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"backup-manager/storage"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access tokens are short-lived JWTs checked without a database lookup.
+// Refresh tokens are opaque, stored server-side so logout can revoke them,
+// and rotated on every use.
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+func issueAccessToken(user User, sessionID string) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:    user.ID,
+		Email:     user.Email,
+		Role:      userRole(user),
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	return jwtKeys.sign(claims)
+}
+
+// newRefreshToken returns a token record for userID's session and the
+// token to hand to the client.
+func newRefreshToken(userID, sessionID string) (storage.RefreshToken, string) {
+	token := generateToken()
+	now := time.Now()
+	return storage.RefreshToken{
+		ID:        generateID(),
+		UserID:    userID,
+		SessionID: sessionID,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}, token
+}
+
+func writeTokens(w http.ResponseWriter, accessToken, refreshToken string, extra map[string]interface{}) {
+	resp := map[string]interface{}{
+		"token":         accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(accessTokenTTL.Seconds()),
+		"refresh_token": refreshToken,
+	}
+	for k, v := range extra {
+		resp[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// sessionCutoffs are the times from which a user's earlier access tokens
+// stop working, for when an account is disabled or must reset its password
+// and waiting out accessTokenTTL is too long. Only this server knows them;
+// on others the tokens last until they expire.
+type sessionCutoffs struct {
+	mu     sync.Mutex
+	byUser map[string]time.Time
+}
+
+var revokedSessions = &sessionCutoffs{byUser: make(map[string]time.Time)}
+
+func (c *sessionCutoffs) revoke(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.byUser[userID] = time.Now()
+}
+
+// revoked reports whether an access token issued at issuedAt was cut off.
+// Token times are whole seconds, so one issued in the same second as the
+// cutoff counts as before it.
+func (c *sessionCutoffs) revoked(userID string, issuedAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff, ok := c.byUser[userID]
+	return ok && !issuedAt.After(cutoff)
+}
+
+// prune forgets cutoffs older than any token they could still apply to.
+func (c *sessionCutoffs) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for userID, cutoff := range c.byUser {
+		if time.Since(cutoff) > accessTokenTTL {
+			delete(c.byUser, userID)
+		}
+	}
+}
+
+// endSessions logs the user out everywhere: refresh tokens are revoked and
+// access tokens already issued stop being accepted.
+func endSessions(ctx context.Context, userID string) error {
+	revokedSessions.revoke(userID)
+	return db.RefreshTokens().RevokeUser(ctx, userID)
+}
+
+func pruneRefreshTokens() {
+	n, err := db.RefreshTokens().DeleteExpired(context.Background(), time.Now())
+	if err != nil {
+		slog.Error("Error removing expired refresh tokens", "error", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("Removed expired refresh tokens", "count", n)
+	}
+
+	// Access tokens of a session deleted here are refused as if it were
+	// revoked, so ended sessions needn't be kept
+	n, err = db.Sessions().DeleteEnded(context.Background(), time.Now())
+	if err != nil {
+		slog.Error("Error removing ended sessions", "error", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("Removed ended sessions", "count", n)
+	}
+}
+
+// Handlers
+
+// refreshTokenHandler exchanges a refresh token for a new access token and
+// a new refresh token. Presenting a token that was already rotated means it
+// was copied, so every session of its user is revoked.
+func refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	current, err := db.RefreshTokens().GetByHash(r.Context(), hashToken(req.RefreshToken))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading refresh token", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+
+	if current.RevokedAt != nil {
+		if current.ReplacedBy != "" {
+			if err := db.RefreshTokens().RevokeUser(r.Context(), current.UserID); err != nil {
+				logger(r.Context()).Error("Error revoking refresh tokens", "user_id", current.UserID, "error", err)
+			}
+			recordAudit(r, AuditEvent{
+				UserID:       current.UserID,
+				Action:       "auth.refresh_token_reused",
+				ResourceType: "user",
+				ResourceID:   current.UserID,
+			})
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if time.Now().After(current.ExpiresAt) {
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := db.Users().Get(r.Context(), current.UserID)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading user", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	if !checkAccountUsable(w, user) {
+		return
+	}
+
+	next, refreshToken := newRefreshToken(user.ID, current.SessionID)
+	err = db.RefreshTokens().Rotate(r.Context(), current.ID, next)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Lost a race with another refresh of the same token
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error rotating refresh token", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+
+	if current.SessionID != "" {
+		if err := db.Sessions().Touch(r.Context(), current.SessionID, clientIP(r), next.CreatedAt); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger(r.Context()).Error("Error recording session use", "session_id", current.SessionID, "error", err)
+		}
+	}
+
+	accessToken, err := issueAccessToken(user, current.SessionID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, accessToken, refreshToken, nil)
+}
+
+// logoutHandler revokes a refresh token and ends its session, which stops
+// the access tokens issued for it too. Tokens from before sessions were
+// recorded stay valid until they expire, at most accessTokenTTL later.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	token, err := db.RefreshTokens().GetByHash(r.Context(), hashToken(req.RefreshToken))
+	if err == nil && token.RevokedAt == nil {
+		if token.SessionID != "" {
+			err = db.Sessions().Revoke(r.Context(), token.UserID, token.SessionID)
+			sessionChecks.ended(token.SessionID)
+		} else {
+			err = db.RefreshTokens().Revoke(r.Context(), token.ID)
+		}
+	}
+	// Unknown and already revoked tokens are logged out too
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger(r.Context()).Error("Error revoking refresh token", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	if err == nil {
+		recordAudit(r, AuditEvent{UserID: token.UserID, Action: "auth.logout", ResourceType: "user", ResourceID: token.UserID})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
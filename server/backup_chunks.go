@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"backup-manager/chunker"
+	"backup-manager/config"
+	"backup-manager/storage"
+	"backup-manager/streamcrypt"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// chunkManifestMagic starts a backup blob that lists the chunks its
+	// content is stored in, rather than holding the content itself
+	chunkManifestMagic = "\x00BMCHK1\n"
+	// chunkGracePeriod is how long a chunk no backup references is kept,
+	// so an upload that found it has time to reference it
+	chunkGracePeriod  = 24 * time.Hour
+	chunkCleanupBatch = 1000
+
+	compressionZstd = "zstd"
+)
+
+var (
+	// Both are safe for concurrent use through EncodeAll and DecodeAll.
+	// A chunk never decompresses to more than the largest chunk.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(chunker.MaxSize))
+)
+
+// backupCompression is the algorithm chunks are compressed with before
+// they are encrypted: zstd, unless BACKUP_COMPRESSION is "off".
+func backupCompression() string {
+	if config.Get("BACKUP_COMPRESSION") == "off" {
+		return ""
+	}
+	return compressionZstd
+}
+
+// chunkManifest is stored, after chunkManifestMagic, as a backup's blob.
+type chunkManifest struct {
+	Chunks []manifestChunk `json:"chunks"`
+}
+
+type manifestChunk struct {
+	Address     string `json:"address"`
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	Compression string `json:"compression,omitempty"`
+}
+
+func isChunkManifest(head []byte) bool {
+	return string(head) == chunkManifestMagic
+}
+
+// chunkAddressKey derives the key chunk addresses are computed with from
+// the key the chunks are encrypted under. Keyed addresses don't reveal
+// whether someone stored a known file, and chunks under different keys
+// never share an address.
+func chunkAddressKey(key []byte) ([]byte, error) {
+	addressKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("backup chunk address")), addressKey); err != nil {
+		return nil, err
+	}
+	return addressKey, nil
+}
+
+// storeChunk stores data once per owner and key: an identical chunk
+// already stored is reused, however it was compressed. A new chunk is
+// compressed with compression unless that doesn't make it smaller.
+func storeChunk(ctx context.Context, userID string, addressKey, key, data []byte, compression string) (storage.Chunk, error) {
+	mac := hmac.New(sha256.New, addressKey)
+	mac.Write(data)
+	address := hex.EncodeToString(mac.Sum(nil))
+
+	c, err := db.Chunks().Use(ctx, userID, address, time.Now())
+	if !errors.Is(err, storage.ErrNotFound) {
+		return c, err
+	}
+
+	content := data
+	if compression == compressionZstd {
+		if compressed := zstdEncoder.EncodeAll(data, nil); len(compressed) < len(data) {
+			content = compressed
+		} else {
+			compression = ""
+		}
+	}
+
+	var sealed bytes.Buffer
+	enc, err := streamcrypt.NewWriter(&sealed, key)
+	if err != nil {
+		return storage.Chunk{}, err
+	}
+	if _, err := enc.Write(content); err != nil {
+		return storage.Chunk{}, err
+	}
+	if err := enc.Close(); err != nil {
+		return storage.Chunk{}, err
+	}
+	// Each copy gets its own key, so cleanup deleting a chunk can't remove
+	// one stored again in its place
+	c = storage.Chunk{
+		UserID:      userID,
+		Address:     address,
+		BlobKey:     "chunks/" + userID + "/" + generateID(),
+		Size:        int64(len(data)),
+		StoredSize:  int64(sealed.Len()),
+		Compression: compression,
+		UsedAt:      time.Now(),
+	}
+	if err := blobStore.Put(ctx, c.BlobKey, sealed.Bytes(), "application/octet-stream"); err != nil {
+		return storage.Chunk{}, err
+	}
+	err = db.Chunks().Add(ctx, c)
+	if errors.Is(err, storage.ErrConflict) {
+		// Another upload stored the same content first; use theirs
+		if err := blobStore.Delete(ctx, c.BlobKey); err != nil {
+			logger(ctx).Error("Error deleting duplicate chunk", "key", c.BlobKey, "error", err)
+		}
+		return db.Chunks().Use(ctx, userID, address, time.Now())
+	}
+	if err != nil {
+		return storage.Chunk{}, err
+	}
+	return c, nil
+}
+
+// openChunks reads a chunk manifest, after its magic, and returns a reader
+// of the content, fetching, decrypting and decompressing one chunk at a
+// time.
+func openChunks(ctx context.Context, r io.Reader, key []byte) (io.ReadCloser, error) {
+	var manifest chunkManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("reading chunk manifest: %w", err)
+	}
+	return io.NopCloser(&chunkReader{ctx: ctx, chunks: manifest.Chunks, key: key}), nil
+}
+
+type chunkReader struct {
+	ctx    context.Context
+	chunks []manifestChunk
+	key    []byte
+	cur    bytes.Reader
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for r.cur.Len() == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		c := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		data, err := readChunk(r.ctx, c, r.key)
+		if err != nil {
+			return 0, fmt.Errorf("reading chunk %s: %w", c.Address, err)
+		}
+		r.cur.Reset(data)
+	}
+	return r.cur.Read(p)
+}
+
+func readChunk(ctx context.Context, c manifestChunk, key []byte) ([]byte, error) {
+	body, err := blobStore.Get(ctx, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	plaintext, err := streamcrypt.NewReader(body, key)
+	if err != nil {
+		return nil, err
+	}
+	// Compression never grows a stored chunk, so neither form is larger
+	// than the largest chunk
+	data, err := io.ReadAll(io.LimitReader(plaintext, chunker.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	switch c.Compression {
+	case "":
+	case compressionZstd:
+		if data, err = zstdDecoder.DecodeAll(data, nil); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c.Compression)
+	}
+	if int64(len(data)) != c.Size {
+		return nil, errors.New("chunk is not the size its manifest says")
+	}
+	return data, nil
+}
+
+// pruneChunks deletes chunks that no backup has referenced for the grace
+// period, their records first so an upload looking for one stores it again.
+func pruneChunks() {
+	if blobStore == nil {
+		return
+	}
+	ctx := context.Background()
+	cutoff := time.Now().Add(-chunkGracePeriod)
+	chunks, err := db.Chunks().ListUnreferenced(ctx, cutoff, chunkCleanupBatch)
+	if err != nil {
+		slog.Error("Error listing unreferenced backup chunks", "error", err)
+		return
+	}
+
+	removed := 0
+	for _, c := range chunks {
+		err := db.Chunks().Delete(ctx, c, cutoff)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Used again since it was listed
+			continue
+		}
+		if err != nil {
+			slog.Error("Error deleting backup chunk", "key", c.BlobKey, "error", err)
+			continue
+		}
+		if err := blobStore.Delete(ctx, c.BlobKey); err != nil {
+			slog.Error("Error deleting backup chunk blob", "key", c.BlobKey, "error", err)
+		}
+		removed++
+	}
+	if removed > 0 {
+		slog.Info("Removed unreferenced backup chunks", "count", removed)
+	}
+}
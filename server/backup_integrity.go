@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// The check is scheduled once a day; the scheduler looks hourly so a
+	// day isn't missed when servers restart more often than that
+	integritySchedulerInterval = time.Hour
+	defaultIntegritySample     = 100
+	maxIntegrityRuns           = 30
+	maxIntegrityFailures       = 500 // listed per run; counts stay exact
+	integrityModeSample        = "sample"
+	integrityModeAll           = "all"
+	integrityStatusQueued      = "queued"
+	integrityStatusRunning     = "running"
+	integrityStatusCompleted   = "completed"
+	integrityStatusFailed      = "failed"
+	integrityStatusBusy        = "skipped"
+)
+
+// IntegrityFailure is one backup that failed verification.
+type IntegrityFailure = storage.IntegrityFailure
+
+// IntegrityRun is one pass of the integrity check; see storage.IntegrityRun.
+type IntegrityRun = storage.IntegrityRun
+
+type integrityCheckPayload struct {
+	RunID string `json:"run_id"`
+}
+
+func backupChecksum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyBackup checks the stored ciphertext against its checksum, then
+// decrypts it and checks the plaintext. It returns whether the backup was
+// fully verified and, for a corrupt backup, why.
+func verifyBackup(ctx context.Context, b Backup) (verified bool, problem string) {
+	stored, err := readBackupBlob(ctx, b)
+	if err != nil {
+		return true, "reading stored data failed: " + err.Error()
+	}
+	sum := sha256.New()
+	_, err = io.Copy(sum, stored)
+	stored.Close()
+	if err != nil {
+		return true, "reading stored data failed: " + err.Error()
+	}
+	if b.CiphertextChecksum != "" && hex.EncodeToString(sum.Sum(nil)) != b.CiphertextChecksum {
+		return true, "stored data does not match its checksum"
+	}
+
+	plaintext, err := openBackup(ctx, b)
+	if errors.Is(err, errDataKeyLocked) {
+		return false, ""
+	}
+	if err != nil {
+		return true, "decryption failed: " + err.Error()
+	}
+	defer plaintext.Close()
+	sum.Reset()
+	if _, err := io.Copy(sum, plaintext); err != nil {
+		return true, "decryption failed: " + err.Error()
+	}
+	if b.Checksum != "" && hex.EncodeToString(sum.Sum(nil)) != b.Checksum {
+		return true, "decrypted content does not match its checksum"
+	}
+	return true, ""
+}
+
+// recordVerification saves the result of checking b, unless only its
+// ciphertext could be checked, and reports a backup newly found corrupt.
+func recordVerification(ctx context.Context, b Backup, verified bool, problem string) {
+	if !verified {
+		return
+	}
+	if err := db.Backups().SetVerified(ctx, b.ID, time.Now(), problem); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger(ctx).Error("Error saving backup verification", "backup_id", b.ID, "error", err)
+	}
+	if problem == "" || b.Corruption != "" {
+		return
+	}
+	logger(ctx).Error("Backup is corrupt", "backup_id", b.ID, "user_id", b.UserID, "reason", problem)
+	recordDomainEvent(systemActor, DomainEvent{
+		Type:          "backup.corrupted",
+		AggregateType: aggregateBackup,
+		AggregateID:   b.ID,
+		OwnerID:       b.UserID,
+	}, map[string]interface{}{"reason": problem})
+}
+
+// reprDigest is the Repr-Digest header (RFC 9530) of b's download, letting
+// the client check what it received against the checksum taken at upload.
+func reprDigest(b Backup) string {
+	sum, err := hex.DecodeString(b.Checksum)
+	if err != nil || len(sum) == 0 {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// verifyingReader reads a backup's plaintext and checks it against the
+// checksum taken at upload. The last bytes are held back until the check
+// passes, so a download that fails it never looks complete.
+type verifyingReader struct {
+	r         io.Reader
+	sum       hash.Hash
+	remaining int64
+	checksum  string
+}
+
+var errBackupChecksum = errors.New("decrypted content does not match its checksum")
+
+func newVerifyingReader(r io.Reader, b Backup) io.Reader {
+	if b.Checksum == "" {
+		return r
+	}
+	return &verifyingReader{r: r, sum: sha256.New(), remaining: b.Size, checksum: b.Checksum}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if int64(n) > v.remaining {
+		return 0, errBackupChecksum
+	}
+	v.sum.Write(p[:n])
+	v.remaining -= int64(n)
+	if v.remaining == 0 && hex.EncodeToString(v.sum.Sum(nil)) != v.checksum {
+		return 0, errBackupChecksum
+	}
+	if err == io.EOF && v.remaining > 0 {
+		return 0, errBackupChecksum
+	}
+	return n, err
+}
+
+func integrityMode() string {
+	if config.Get("INTEGRITY_CHECK_MODE") == integrityModeAll {
+		return integrityModeAll
+	}
+	return integrityModeSample
+}
+
+func integritySampleSize() int {
+	if n, err := strconv.Atoi(config.Get("INTEGRITY_SAMPLE_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return defaultIntegritySample
+}
+
+// queueScheduledIntegrityCheck queues today's check. Every server tries,
+// and the first to record the run for the day is the one that queues it.
+func queueScheduledIntegrityCheck() {
+	_, err := queueIntegrityCheck(context.Background(), integrityMode(), time.Now().UTC().Format(time.DateOnly))
+	if err != nil && !errors.Is(err, storage.ErrConflict) {
+		slog.Error("Error queueing integrity check", "error", err)
+	}
+}
+
+// queueIntegrityCheck records a run of mode and queues a job to do it.
+// scheduledFor is the day a scheduled run is for; recording a second run
+// for the same day returns storage.ErrConflict.
+func queueIntegrityCheck(ctx context.Context, mode, scheduledFor string) (IntegrityRun, error) {
+	run := IntegrityRun{
+		ID:           generateID(),
+		Mode:         mode,
+		Status:       integrityStatusQueued,
+		ScheduledFor: scheduledFor,
+		Failures:     []IntegrityFailure{},
+		RequestedAt:  time.Now(),
+	}
+	if err := db.IntegrityRuns().Create(ctx, run); err != nil {
+		return IntegrityRun{}, err
+	}
+	if err := db.IntegrityRuns().Prune(ctx, maxIntegrityRuns); err != nil {
+		slog.Error("Error pruning integrity runs", "error", err)
+	}
+	if _, err := enqueueJob(ctx, "", jobIntegrityCheck, integrityCheckPayload{RunID: run.ID}); err != nil {
+		now := time.Now()
+		run.Status = integrityStatusFailed
+		run.CompletedAt = &now
+		db.IntegrityRuns().Update(ctx, run)
+		return IntegrityRun{}, err
+	}
+	return run, nil
+}
+
+// runIntegrityCheckJob verifies backups, either all of them or a random
+// sample, for a run queued by queueIntegrityCheck. A run queued while
+// another is going is skipped. As with chat imports, the run keeps its own
+// status rather than failing the job.
+func runIntegrityCheckJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload integrityCheckPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+	run, err := db.IntegrityRuns().Get(ctx, payload.RunID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A run whose server went away stops counting as going once its job
+	// would have been failed
+	now := time.Now()
+	err = db.IntegrityRuns().Start(ctx, run.ID, now, now.Add(-jobTimeout))
+	if errors.Is(err, storage.ErrNotFound) {
+		if run.Status == integrityStatusQueued {
+			run.Status = integrityStatusBusy
+			run.CompletedAt = &now
+			return nil, db.IntegrityRuns().Update(ctx, run)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	run.Status = integrityStatusRunning
+	run.StartedAt = &now
+	run.Users = map[string]storage.IntegrityTally{}
+
+	err = checkIntegrity(ctx, &run)
+	if ctx.Err() != nil {
+		// Stopped by shutdown; the job is queued again and starts over
+		run.Status = integrityStatusQueued
+		run.Checked, run.OK, run.Corrupt, run.Skipped = 0, 0, 0, 0
+		run.Failures, run.Users = []IntegrityFailure{}, nil
+		return nil, db.IntegrityRuns().Update(context.WithoutCancel(ctx), run)
+	}
+	completed := time.Now()
+	run.CompletedAt = &completed
+	run.Status = integrityStatusCompleted
+	if err != nil {
+		slog.Error("Integrity check: error loading backups", "run_id", run.ID, "error", err)
+		run.Status = integrityStatusFailed
+	}
+	if err := db.IntegrityRuns().Update(ctx, run); err != nil {
+		return nil, err
+	}
+	if run.Status != integrityStatusCompleted {
+		return nil, nil
+	}
+
+	slog.Info("Integrity check finished", "run_id", run.ID, "checked", run.Checked,
+		"ok", run.OK, "corrupt", run.Corrupt, "skipped", run.Skipped)
+	if run.Corrupt > 0 {
+		sendIntegrityAlert(run)
+	}
+	return nil, nil
+}
+
+// checkIntegrity verifies the backups run covers, counting them in run.
+func checkIntegrity(ctx context.Context, run *IntegrityRun) error {
+	backups, err := db.Backups().List(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	// A sample takes the backups checked longest ago, those never checked
+	// first, so daily runs work through every backup in turn
+	if run.Mode == integrityModeSample && len(backups) > integritySampleSize() {
+		sort.SliceStable(backups, func(i, j int) bool {
+			a, b := backups[i].VerifiedAt, backups[j].VerifiedAt
+			return a == nil && b != nil || a != nil && b != nil && a.Before(*b)
+		})
+		backups = backups[:integritySampleSize()]
+	}
+
+	for _, b := range backups {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		verified, problem := verifyBackup(ctx, b)
+		recordVerification(ctx, b, verified, problem)
+		countVerification(run, b, verified, problem)
+	}
+	return nil
+}
+
+func countVerification(run *IntegrityRun, b Backup, verified bool, problem string) {
+	tally := run.Users[b.UserID]
+	run.Checked++
+	tally.Checked++
+
+	switch {
+	case problem != "":
+		run.Corrupt++
+		tally.Corrupt++
+		if len(run.Failures) < maxIntegrityFailures {
+			run.Failures = append(run.Failures, IntegrityFailure{
+				BackupID:   b.ID,
+				UserID:     b.UserID,
+				Reason:     problem,
+				DetectedAt: time.Now(),
+			})
+		}
+	case !verified:
+		run.Skipped++
+		tally.Skipped++
+	default:
+		run.OK++
+		tally.OK++
+	}
+	run.Users[b.UserID] = tally
+}
+
+// integrityRuns returns the runs newest first. For anyone but an admin,
+// counts and failures cover only userID's backups.
+func integrityRuns(ctx context.Context, userID string, admin bool) ([]IntegrityRun, error) {
+	runs, err := db.IntegrityRuns().List(ctx, maxIntegrityRuns)
+	if err != nil || admin {
+		return runs, err
+	}
+	for i, run := range runs {
+		tally := run.Users[userID]
+		run.Checked, run.OK, run.Corrupt, run.Skipped = tally.Checked, tally.OK, tally.Corrupt, tally.Skipped
+		own := []IntegrityFailure{}
+		for _, f := range run.Failures {
+			if f.UserID == userID {
+				own = append(own, f)
+			}
+		}
+		run.Failures = own
+		runs[i] = run
+	}
+	return runs, nil
+}
+
+// integrityAlertRecipients are INTEGRITY_ALERT_EMAILS, or the admins when it
+// is unset.
+func integrityAlertRecipients() []string {
+	list := config.Get("INTEGRITY_ALERT_EMAILS")
+	if list == "" {
+		list = config.Get("ADMIN_EMAILS")
+	}
+	var recipients []string
+	for _, email := range strings.Split(list, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			recipients = append(recipients, email)
+		}
+	}
+	return recipients
+}
+
+func sendIntegrityAlert(run IntegrityRun) {
+	var body strings.Builder
+	fmt.Fprintf(&body, "The backup integrity check started %s found %d corrupt backup(s) out of %d checked.\n\n",
+		run.StartedAt.Format(time.RFC1123), run.Corrupt, run.Checked)
+	for _, f := range run.Failures {
+		fmt.Fprintf(&body, "- backup %s (user %s): %s\n", f.BackupID, f.UserID, f.Reason)
+	}
+	if run.Corrupt > len(run.Failures) {
+		fmt.Fprintf(&body, "- and %d more\n", run.Corrupt-len(run.Failures))
+	}
+	fmt.Fprintf(&body, "\nFull report: %s\n", frontendLink("/admin/reports/integrity"))
+
+	subject := fmt.Sprintf("Backup integrity check: %d corrupt backup(s)", run.Corrupt)
+	for _, to := range integrityAlertRecipients() {
+		if err := sendEmail(to, subject, body.String()); err != nil {
+			slog.Error("Error sending integrity alert", "error", err)
+		}
+	}
+}
+
+// Handlers
+func getIntegrityReportsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	admin, err := userHasRole(r.Context(), userID, storage.RoleAdmin)
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+
+	runs, err := integrityRuns(r.Context(), userID, admin)
+	if err != nil {
+		writeStorageError(w, r, err, "Integrity reports")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"runs": runs,
+	})
+}
+
+func runIntegrityCheckHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	switch req.Mode {
+	case "":
+		req.Mode = integrityMode()
+	case integrityModeSample, integrityModeAll:
+	default:
+		http.Error(w, "mode must be sample or all", http.StatusBadRequest)
+		return
+	}
+
+	// Checking every backup can take a long time, so it runs as a job and
+	// the result appears in the report list
+	run, err := queueIntegrityCheck(r.Context(), req.Mode, "")
+	if err != nil {
+		writeEnqueueError(w, r, err)
+		return
+	}
+	recordAudit(r, AuditEvent{Action: "integrity_check.started", ResourceType: "integrity_check", ResourceID: run.ID,
+		Metadata: map[string]interface{}{"mode": req.Mode}})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
+
+// verifyBackupHandler checks one backup against its checksums now, rather
+// than waiting for the scheduled check to reach it.
+func verifyBackupHandler(w http.ResponseWriter, r *http.Request) {
+	liftDeadlines(w)
+	backup, err := db.Backups().Get(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+
+	verified, problem := verifyBackup(r.Context(), backup)
+	if !verified {
+		writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+		return
+	}
+	recordVerification(r.Context(), backup, verified, problem)
+
+	status := "ok"
+	if problem != "" {
+		status = "corrupt"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backup_id":   backup.ID,
+		"status":      status,
+		"corruption":  problem,
+		"verified_at": time.Now().UTC(),
+	})
+}
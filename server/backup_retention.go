@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-manager/storage"
+)
+
+// Users can set a retention policy for their own backups: keep only the
+// newest versions of each, drop those older than some number of days, and
+// rule differently for backups from particular sources. Enforcement runs
+// with the rest of retention and moves what the policy no longer keeps to
+// the trash, from where it is purged as any deleted backup is. Backups
+// made in teams are the team's and never covered.
+
+const (
+	maxRetentionSources = 50
+	// Bounds of a rule, as in retentionRequest's tags
+	maxRetentionDays = 36500
+	maxRetentionKeep = 10000
+)
+
+// Why a backup is no longer kept.
+const (
+	retentionReasonVersions = "versions"
+	retentionReasonAge      = "age"
+)
+
+// retentionCandidate is a backup a policy no longer keeps. Held backups
+// are under legal hold and stay until it is released.
+type retentionCandidate struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	Version   int       `json:"version"`
+	Size      int64     `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+	Reason    string    `json:"reason"`
+	Held      bool      `json:"held,omitempty"`
+}
+
+// ruleFor returns the rule for backups from source: the policy's rule for
+// it, named in any case, or else its own.
+func ruleFor(p storage.RetentionPolicy, source string) storage.RetentionRule {
+	for name, rule := range p.Sources {
+		if strings.EqualFold(name, source) {
+			return rule
+		}
+	}
+	return p.RetentionRule
+}
+
+// retentionCandidates returns the backups p no longer keeps at now, oldest
+// first.
+func retentionCandidates(p storage.RetentionPolicy, backups []Backup, holds []LegalHold, now time.Time) []retentionCandidate {
+	chains := map[string][]Backup{}
+	for _, b := range backups {
+		chains[b.ChainID] = append(chains[b.ChainID], b)
+	}
+
+	candidates := []retentionCandidate{}
+	for _, chain := range chains {
+		sort.Slice(chain, func(i, j int) bool { return chain[i].Version > chain[j].Version })
+		for i, b := range chain {
+			rule := ruleFor(p, b.Source)
+			reason := ""
+			switch {
+			case rule.KeepVersions > 0 && i >= rule.KeepVersions:
+				reason = retentionReasonVersions
+			case rule.MaxAgeDays > 0 && b.Timestamp.Before(now.AddDate(0, 0, -rule.MaxAgeDays)):
+				reason = retentionReasonAge
+			default:
+				continue
+			}
+			candidates = append(candidates, retentionCandidate{
+				ID:        b.ID,
+				Name:      b.Name,
+				Source:    b.Source,
+				Version:   b.Version,
+				Size:      b.Size,
+				Timestamp: b.Timestamp,
+				Reason:    reason,
+				Held:      len(heldBy(holds, b.ID, b.UserID)) > 0,
+			})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Timestamp.Before(candidates[j].Timestamp) })
+	return candidates
+}
+
+// personalBackups are the user's backups outside teams, which their
+// retention policy covers.
+func personalBackups(ctx context.Context, userID string) ([]Backup, error) {
+	return db.Backups().List(storage.WithPersonal(ctx), userID)
+}
+
+// enforceRetentionPolicies moves the backups each user's policy no longer
+// keeps to the trash.
+func enforceRetentionPolicies() {
+	ctx := context.Background()
+	policies, err := db.Retention().List(ctx)
+	if err != nil {
+		slog.Error("Error loading retention policies", "error", err)
+		return
+	}
+	holds, err := legalHolds.active(ctx)
+	if err != nil {
+		slog.Error("Error loading legal holds for retention", "error", err)
+		return
+	}
+	for _, p := range policies {
+		backups, err := personalBackups(ctx, p.UserID)
+		if err != nil {
+			slog.Error("Error loading backups for retention", "user_id", p.UserID, "error", err)
+			continue
+		}
+		byID := make(map[string]Backup, len(backups))
+		for _, b := range backups {
+			byID[b.ID] = b
+		}
+
+		trashed := 0
+		for _, c := range retentionCandidates(p, backups, holds, time.Now()) {
+			if c.Held {
+				continue
+			}
+			if err := trashBackupForRetention(ctx, byID[c.ID], c.Reason); err != nil {
+				slog.Error("Error applying retention policy", "user_id", p.UserID, "backup_id", c.ID, "error", err)
+				continue
+			}
+			trashed++
+		}
+		if trashed > 0 {
+			slog.Info("Retention policy moved backups to the trash", "user_id", p.UserID, "count", trashed)
+		}
+	}
+}
+
+// trashBackupForRetention moves b and the projects extracted from it to
+// the trash, as deleting it would.
+func trashBackupForRetention(ctx context.Context, b Backup, reason string) error {
+	ctx = storage.WithPersonal(ctx)
+	removed, err := trashSearchDocuments(ctx, b.UserID, b.ID)
+	if err != nil {
+		return err
+	}
+	deletedAt := time.Now()
+	if err := db.Backups().Trash(ctx, b.UserID, b.ID, deletedAt); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	removeDocuments(removed...)
+
+	recordDomainEvent(systemActor, DomainEvent{
+		Type:          "backup.deleted",
+		AggregateType: aggregateBackup,
+		AggregateID:   b.ID,
+		OwnerID:       b.UserID,
+		Before:        snapshot(b),
+	}, map[string]interface{}{"purge_at": purgeAt(&deletedAt), "retention": reason})
+	return nil
+}
+
+// retentionRequest is a policy as sent by the client.
+type retentionRequest struct {
+	KeepVersions int                              `json:"keep_versions" validate:"min=0,max=10000"`
+	MaxAgeDays   int                              `json:"max_age_days" validate:"min=0,max=36500"`
+	Sources      map[string]storage.RetentionRule `json:"sources"`
+}
+
+// decodeRetentionPolicy reads a policy from the request, answering and
+// returning false if it is invalid.
+func decodeRetentionPolicy(w http.ResponseWriter, r *http.Request) (storage.RetentionPolicy, bool) {
+	var req retentionRequest
+	if !decodeRequest(w, r, &req) {
+		return storage.RetentionPolicy{}, false
+	}
+	p := storage.RetentionPolicy{
+		UserID:        r.Header.Get("X-User-ID"),
+		RetentionRule: storage.RetentionRule{KeepVersions: req.KeepVersions, MaxAgeDays: req.MaxAgeDays},
+		Sources:       map[string]storage.RetentionRule{},
+		UpdatedAt:     time.Now(),
+	}
+	if len(req.Sources) > maxRetentionSources {
+		writeFieldError(w, "sources", "max", "sources can have at most 50 entries")
+		return p, false
+	}
+	for name, rule := range req.Sources {
+		name = strings.TrimSpace(name)
+		if name == "" || len(name) > 100 {
+			writeFieldError(w, "sources", "key", "Each source must be named, in at most 100 characters")
+			return p, false
+		}
+		if !validRetentionRule(w, "sources."+name+".", rule) {
+			return p, false
+		}
+		p.Sources[name] = rule
+	}
+	return p, true
+}
+
+// validRetentionRule checks a source's rule, which validate tags don't
+// reach.
+func validRetentionRule(w http.ResponseWriter, prefix string, rule storage.RetentionRule) bool {
+	switch {
+	case rule.KeepVersions < 0 || rule.KeepVersions > maxRetentionKeep:
+		writeFieldError(w, prefix+"keep_versions", "range", prefix+"keep_versions must be between 0 and 10000")
+		return false
+	case rule.MaxAgeDays < 0 || rule.MaxAgeDays > maxRetentionDays:
+		writeFieldError(w, prefix+"max_age_days", "range", prefix+"max_age_days must be between 0 and 36500")
+		return false
+	}
+	return true
+}
+
+// loadRetentionPolicy returns the user's policy, or one that keeps
+// everything if they have none.
+func loadRetentionPolicy(ctx context.Context, userID string) (storage.RetentionPolicy, error) {
+	p, err := db.Retention().Get(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return storage.RetentionPolicy{UserID: userID, Sources: map[string]storage.RetentionRule{}}, nil
+	}
+	return p, err
+}
+
+// Handlers
+func getRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := loadRetentionPolicy(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Retention policy")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func setRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := decodeRetentionPolicy(w, r)
+	if !ok {
+		return
+	}
+	if err := db.Retention().Put(r.Context(), p); err != nil {
+		writeStorageError(w, r, err, "Retention policy")
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "retention_policy.updated",
+		ResourceType: "retention_policy",
+		ResourceID:   p.UserID,
+		Metadata: map[string]interface{}{
+			"keep_versions": p.KeepVersions,
+			"max_age_days":  p.MaxAgeDays,
+			"sources":       len(p.Sources),
+		},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func deleteRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if err := db.Retention().Delete(r.Context(), userID); err != nil {
+		writeStorageError(w, r, err, "Retention policy")
+		return
+	}
+	recordAudit(r, AuditEvent{Action: "retention_policy.deleted", ResourceType: "retention_policy", ResourceID: userID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// previewRetentionHandler lists the backups a policy would move to the
+// trash if it were enforced now, without changing anything. The policy is
+// the one in the body, to try before saving it, or else the saved one.
+func previewRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var p storage.RetentionPolicy
+	if r.ContentLength != 0 {
+		var ok bool
+		if p, ok = decodeRetentionPolicy(w, r); !ok {
+			return
+		}
+	} else {
+		var err error
+		if p, err = loadRetentionPolicy(r.Context(), userID); err != nil {
+			writeStorageError(w, r, err, "Retention policy")
+			return
+		}
+	}
+
+	backups, err := personalBackups(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Backups")
+		return
+	}
+	holds, err := legalHolds.active(r.Context())
+	if err != nil {
+		writeStorageError(w, r, err, "Legal holds")
+		return
+	}
+	candidates := retentionCandidates(p, backups, holds, time.Now())
+	var count int
+	var bytes int64
+	for _, c := range candidates {
+		if !c.Held {
+			count++
+			bytes += c.Size
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"policy":  p,
+		"backups": candidates,
+		"count":   count,
+		"bytes":   bytes,
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backup-manager/extract"
+	"backup-manager/storage"
+	"backup-manager/textdiff"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// versionAttempts is how often an upload retries when another upload
+	// of the same file takes the version it picked
+	versionAttempts = 3
+	// maxDiffBytes is the largest version, of either side, diffed
+	maxDiffBytes = 2 << 20
+	diffContext  = 3 // lines
+)
+
+var errTooLargeToDiff = fmt.Errorf("only backups of up to %d bytes can be diffed", maxDiffBytes)
+
+// createBackupVersion saves b as the next version of the user's backup with
+// the same name and source, or as the first of a new chain if there is none.
+func createBackupVersion(ctx context.Context, b *Backup) error {
+	for attempt := 1; ; attempt++ {
+		latest, err := db.Backups().LatestVersion(ctx, b.UserID, b.Name, b.Source)
+		switch {
+		case err == nil:
+			b.ChainID, b.Version = latest.ChainID, latest.Version+1
+		case errors.Is(err, storage.ErrNotFound):
+			b.ChainID, b.Version = b.ID, 1
+		default:
+			return err
+		}
+
+		err = db.Backups().Create(ctx, *b)
+		if !errors.Is(err, storage.ErrConflict) || attempt == versionAttempts {
+			return err
+		}
+	}
+}
+
+// latestVersions keeps the first, so newest, backup of each chain in
+// backups, with how many versions the chain has.
+func latestVersions(backups []Backup) []listedBackup {
+	counts := map[string]int{}
+	for _, b := range backups {
+		counts[b.ChainID]++
+	}
+	listed := []listedBackup{}
+	for _, b := range backups {
+		if n := counts[b.ChainID]; n > 0 {
+			listed = append(listed, listedBackup{b, n})
+			counts[b.ChainID] = 0
+		}
+	}
+	return listed
+}
+
+type listedBackup struct {
+	Backup
+	Versions int `json:"versions"`
+}
+
+// How a diff compares two versions.
+const (
+	diffFormatMessages = "messages"
+	diffFormatText     = "text"
+)
+
+// conversationDiff is how a conversation changed between two versions of
+// a chat export. Status is "added", "removed" or "changed".
+type conversationDiff struct {
+	ID      string            `json:"id,omitempty"`
+	Title   string            `json:"title"`
+	Status  string            `json:"status"`
+	Added   []extract.Message `json:"added"`
+	Removed []extract.Message `json:"removed"`
+}
+
+// conversationKey matches a conversation across versions of an export: by
+// the export's ID for it, or its title where there is none.
+func conversationKey(c extract.Conversation) string {
+	if c.ID != "" {
+		return "id:" + c.ID
+	}
+	return "title:" + c.Title
+}
+
+// diffConversations lists the conversations added, removed and changed
+// from a to b, in b's order with removed ones last. A message counts as the
+// same one in both when its role and text are.
+func diffConversations(a, b []extract.Conversation) []conversationDiff {
+	before := make(map[string]extract.Conversation, len(a))
+	for _, c := range a {
+		before[conversationKey(c)] = c
+	}
+
+	diffs := []conversationDiff{}
+	seen := make(map[string]bool, len(b))
+	for _, c := range b {
+		key := conversationKey(c)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		old, ok := before[key]
+		if !ok {
+			diffs = append(diffs, conversationDiff{ID: c.ID, Title: c.Title, Status: "added", Added: c.Messages, Removed: []extract.Message{}})
+			continue
+		}
+		d := conversationDiff{ID: c.ID, Title: c.Title, Status: "changed", Added: []extract.Message{}, Removed: []extract.Message{}}
+		for _, e := range textdiff.DiffLines(messageKeys(old.Messages), messageKeys(c.Messages)) {
+			switch e.Op {
+			case textdiff.Insert:
+				d.Added = append(d.Added, c.Messages[e.B])
+			case textdiff.Delete:
+				d.Removed = append(d.Removed, old.Messages[e.A])
+			}
+		}
+		if len(d.Added) > 0 || len(d.Removed) > 0 {
+			diffs = append(diffs, d)
+		}
+	}
+	for _, c := range a {
+		key := conversationKey(c)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		diffs = append(diffs, conversationDiff{ID: c.ID, Title: c.Title, Status: "removed", Added: []extract.Message{}, Removed: c.Messages})
+	}
+	return diffs
+}
+
+// exportConversations reads data as a ChatGPT or Claude conversations
+// file, returning false if it is neither.
+func exportConversations(data string) ([]extract.Conversation, bool) {
+	read := extract.Readers[extract.Detect(strings.NewReader(data))]
+	if read == nil {
+		return nil, false
+	}
+	convs := []extract.Conversation{}
+	err := read(strings.NewReader(data), func(c extract.Conversation) error {
+		convs = append(convs, c)
+		return nil
+	})
+	return convs, err == nil
+}
+
+func messageKeys(messages []extract.Message) []string {
+	keys := make([]string, len(messages))
+	for i, m := range messages {
+		keys[i] = m.Role + "\x00" + m.Text
+	}
+	return keys
+}
+
+// readBackupText decrypts a text backup for diffing.
+func readBackupText(ctx context.Context, b Backup) (string, error) {
+	if b.Size > maxDiffBytes {
+		return "", errTooLargeToDiff
+	}
+	plaintext, err := openBackup(ctx, b)
+	if err != nil {
+		return "", err
+	}
+	defer plaintext.Close()
+	data, err := io.ReadAll(io.LimitReader(plaintext, maxDiffBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxDiffBytes {
+		return "", errTooLargeToDiff
+	}
+	return string(data), nil
+}
+
+// Handlers
+
+// getBackupVersionsHandler lists every version of the backup's chain,
+// newest first. Each version downloads by its own ID.
+func getBackupVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	backup, err := db.Backups().Get(r.Context(), userID, mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	versions, err := db.Backups().Versions(r.Context(), userID, backup.ChainID)
+	if err != nil {
+		writeStorageError(w, r, err, "Backups")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// versionParam finds the version of the chain named by the query
+// parameter, or returns def if it isn't given.
+func versionParam(w http.ResponseWriter, r *http.Request, name string, versions []Backup, def *Backup) (*Backup, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		http.Error(w, name+" must be a version number", http.StatusBadRequest)
+		return nil, false
+	}
+	for i := range versions {
+		if versions[i].Version == version {
+			return &versions[i], true
+		}
+	}
+	http.Error(w, "Version not found", http.StatusNotFound)
+	return nil, false
+}
+
+// diffBackupHandler compares two versions of a text or JSON backup,
+// ?from=N and ?to=M, by default the one before this one and this one.
+// ?version=N is the older name for from. ChatGPT and Claude exports are
+// compared message by message, conversation by conversation; anything else
+// as a unified diff of its lines.
+func diffBackupHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	backup, err := db.Backups().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	versions, err := db.Backups().Versions(r.Context(), userID, backup.ChainID)
+	if err != nil {
+		writeStorageError(w, r, err, "Backups")
+		return
+	}
+
+	to, ok := versionParam(w, r, "to", versions, &backup)
+	if !ok {
+		return
+	}
+	fromParam := "from"
+	if r.URL.Query().Get(fromParam) == "" {
+		fromParam = "version"
+	}
+	from, ok := versionParam(w, r, fromParam, versions, nil)
+	if !ok {
+		return
+	}
+	if from == nil {
+		// Versions are newest first, so the first older one is the previous
+		for i := range versions {
+			if versions[i].Version < to.Version {
+				from = &versions[i]
+				break
+			}
+		}
+		if from == nil {
+			http.Error(w, "This is the first version of the backup", http.StatusNotFound)
+			return
+		}
+	}
+
+	for _, b := range []Backup{*from, *to} {
+		if b.FileType != "text" && b.FileType != "json" {
+			http.Error(w, "Only text and JSON backups can be diffed", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	var texts [2]string
+	for i, b := range []Backup{*from, *to} {
+		texts[i], err = readBackupText(r.Context(), b)
+		if errors.Is(err, errTooLargeToDiff) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, errDataKeyLocked) {
+			writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+			return
+		}
+		if err != nil {
+			logger(r.Context()).Error("Error opening backup", "backup_id", b.ID, "error", err)
+			http.Error(w, "Error decrypting backup", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	type side struct {
+		ID      string `json:"id"`
+		Version int    `json:"version"`
+	}
+	result := struct {
+		From   side   `json:"from"`
+		To     side   `json:"to"`
+		Format string `json:"format"`
+		// Added and Removed count messages in the messages format, and
+		// lines in the text format
+		Added         int                `json:"added"`
+		Removed       int                `json:"removed"`
+		Conversations []conversationDiff `json:"conversations,omitempty"`
+		Diff          string             `json:"diff,omitempty"`
+	}{
+		From: side{from.ID, from.Version},
+		To:   side{to.ID, to.Version},
+	}
+
+	var convs [2][]extract.Conversation
+	var isExport [2]bool
+	if from.FileType == "json" && to.FileType == "json" {
+		for i := range texts {
+			convs[i], isExport[i] = exportConversations(texts[i])
+		}
+	}
+	if isExport[0] && isExport[1] {
+		result.Format = diffFormatMessages
+		result.Conversations = diffConversations(convs[0], convs[1])
+		for _, c := range result.Conversations {
+			result.Added += len(c.Added)
+			result.Removed += len(c.Removed)
+		}
+	} else {
+		edits := textdiff.Diff(texts[0], texts[1])
+		result.Format = diffFormatText
+		result.Added, result.Removed = textdiff.Count(edits)
+		result.Diff = textdiff.Unified(edits,
+			fmt.Sprintf("%s (version %d)", from.Name, from.Version),
+			fmt.Sprintf("%s (version %d)", to.Name, to.Version), diffContext)
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "backup.diffed",
+		ResourceType: "backup",
+		ResourceID:   to.ID,
+		Metadata:     map[string]interface{}{"against": from.ID},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-manager/chunker"
+	"backup-manager/config"
+	"backup-manager/objectstore"
+	"backup-manager/storage"
+	"backup-manager/streamcrypt"
+)
+
+const (
+	defaultReplicationWorkers = 4
+	replicationRetryInterval  = 5 * time.Minute
+	blobTimeout               = time.Minute
+)
+
+var (
+	// blobStore holds encrypted backup contents. Backups uploaded before
+	// uploads were streamed may still be in Backup.EncryptedData instead
+	blobStore objectstore.Store
+	// blobReplication is set when BLOB_REPLICA_URL is, and wraps blobStore
+	blobReplication *objectstore.Replicated
+)
+
+// initBlobStore opens BLOB_STORE_URL, or a directory under the temp dir
+// when it is unset, and, if BLOB_REPLICA_URL is set, a second store in
+// another region that every blob is copied to in the background. The
+// replica uses the same S3 credentials; BLOB_REPLICA_REGION and
+// BLOB_REPLICA_ENDPOINT override the region and endpoint.
+func initBlobStore() {
+	target := config.Get("BLOB_STORE_URL")
+	if target == "" {
+		target = filepath.Join(os.TempDir(), "backup-manager-blobs")
+	}
+	primary, err := objectstore.Open(target, s3ConfigFromEnv())
+	if err != nil {
+		fatal("Invalid BLOB_STORE_URL", "error", err)
+	}
+	blobStore = primary
+
+	replicaTarget := config.Get("BLOB_REPLICA_URL")
+	if replicaTarget == "" {
+		return
+	}
+	cfg := s3ConfigFromEnv()
+	if region := config.Get("BLOB_REPLICA_REGION"); region != "" {
+		cfg.Region = region
+	}
+	if endpoint := config.Get("BLOB_REPLICA_ENDPOINT"); endpoint != "" {
+		cfg.Endpoint = endpoint
+	}
+	secondary, err := objectstore.Open(replicaTarget, cfg)
+	if err != nil {
+		fatal("Invalid BLOB_REPLICA_URL", "error", err)
+	}
+
+	workers := defaultReplicationWorkers
+	if n, err := strconv.Atoi(config.Get("BLOB_REPLICATION_WORKERS")); err == nil && n > 0 {
+		workers = n
+	}
+	blobReplication = objectstore.NewReplicated(primary, secondary, replicationOutbox{}, workers)
+	blobStore = blobReplication
+	slog.Info("Replicating backup blobs", "target", replicaTarget)
+}
+
+func backupBlobKey(userID, backupID string) string {
+	return "backups/" + userID + "/" + backupID
+}
+
+// uploadKey is the key new backups of userID are encrypted with: their data
+// key, or the current server key for accounts that predate per-user keys
+// and for backups in a team, which every member must be able to read. The
+// version is the backup's KeyVersion.
+func uploadKey(ctx context.Context, userID string) ([]byte, int, error) {
+	if storage.TeamFrom(ctx) != "" {
+		return serverKeys.keys[serverKeys.current], serverKeys.current, nil
+	}
+	key, err := userKeys.dataKey(ctx, userID)
+	if errors.Is(err, errNoDataKey) {
+		return serverKeys.keys[serverKeys.current], serverKeys.current, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return key, 0, nil
+}
+
+// backupKey is the key a streamed backup was encrypted with.
+func backupKey(ctx context.Context, b Backup) ([]byte, error) {
+	if b.KeyVersion == 0 {
+		return userKeys.dataKey(ctx, b.UserID)
+	}
+	key, ok := serverKeys.keys[b.KeyVersion]
+	if !ok {
+		return nil, fmt.Errorf("encryption key version %d is not configured", b.KeyVersion)
+	}
+	return key, nil
+}
+
+// writeBackupBlob splits plaintext into content-defined chunks as it is
+// read, holding no more than a chunk of it in memory, stores each chunk
+// compressed and encrypted unless an identical one already is, and stores
+// the list of them as b's blob. It fills in b's size, checksums, blob key,
+// key version and compression. Nothing b needs is left unreferenced if reading plaintext fails.
+func writeBackupBlob(ctx context.Context, b *Backup, plaintext io.Reader, key []byte, keyVersion int) error {
+	addressKey, err := chunkAddressKey(key)
+	if err != nil {
+		return err
+	}
+	plainHash := sha256.New()
+	chunks := chunker.New(io.TeeReader(plaintext, plainHash))
+	manifest := chunkManifest{Chunks: []manifestChunk{}}
+	addresses := []string{}
+	compression := backupCompression()
+	var size int64
+	b.Compression = ""
+	p := jobProgressFrom(ctx)
+	for {
+		data, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		c, err := storeChunk(ctx, b.UserID, addressKey, key, data, compression)
+		if err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, manifestChunk{c.Address, c.BlobKey, c.Size, c.Compression})
+		if c.Compression != "" {
+			b.Compression = c.Compression
+		}
+		addresses = append(addresses, c.Address)
+		size += c.Size
+		p.chunkStored()
+	}
+
+	// The chunks are referenced before the manifest listing them is
+	// stored, so cleanup never sees them unreferenced once it is
+	if err := db.Chunks().AddReferences(ctx, b.UserID, b.ID, addresses); err != nil {
+		return err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	stored := append([]byte(chunkManifestMagic), data...)
+	blobKey := backupBlobKey(b.UserID, b.ID)
+	if err := blobStore.Put(ctx, blobKey, stored, "application/octet-stream"); err != nil {
+		return err
+	}
+	if b.BlobKey != "" {
+		// Rewritten, so the chunks of the earlier copy are no longer needed
+		if err := db.Chunks().SetReferences(ctx, b.UserID, b.ID, addresses); err != nil {
+			logger(ctx).Error("Error releasing replaced backup chunks", "backup_id", b.ID, "error", err)
+		}
+	}
+
+	cipherHash := sha256.Sum256(stored)
+	b.Size = size
+	b.Checksum = hex.EncodeToString(plainHash.Sum(nil))
+	b.CiphertextChecksum = hex.EncodeToString(cipherHash[:])
+	b.BlobKey = blobKey
+	b.EncryptedData = ""
+	b.KeyVersion = keyVersion
+	return nil
+}
+
+// readBackupBlob returns b's encrypted contents as stored, from the blob
+// store or, for older backups, the database row.
+func readBackupBlob(ctx context.Context, b Backup) (io.ReadCloser, error) {
+	if b.BlobKey == "" || blobStore == nil {
+		return io.NopCloser(strings.NewReader(b.EncryptedData)), nil
+	}
+	return blobStore.Get(ctx, b.BlobKey)
+}
+
+// openBackup returns a reader of b's decrypted contents. Chunked and
+// streamed backups are decrypted as they are read; older ones, sealed
+// whole, are decrypted up front.
+func openBackup(ctx context.Context, b Backup) (io.ReadCloser, error) {
+	body, err := readBackupBlob(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(body)
+	if head, _ := br.Peek(len(chunkManifestMagic)); isChunkManifest(head) {
+		defer body.Close()
+		key, err := backupKey(ctx, b)
+		if err != nil {
+			return nil, err
+		}
+		br.Discard(len(chunkManifestMagic))
+		return openChunks(ctx, br, key)
+	}
+	if head, _ := br.Peek(len(streamcrypt.Magic)); streamcrypt.IsStream(head) {
+		key, err := backupKey(ctx, b)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		plaintext, err := streamcrypt.NewReader(br, key)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{plaintext, body}, nil
+	}
+
+	ciphertext, err := io.ReadAll(br)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	plaintext, err := decryptForUser(ctx, b.UserID, string(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(plaintext)), nil
+}
+
+// deleteBackupBlob deletes a backup's blob and releases its chunks, which
+// cleanup deletes once no other backup references them.
+func deleteBackupBlob(ctx context.Context, userID, backupID string) {
+	if blobStore == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, blobTimeout)
+	defer cancel()
+	if err := blobStore.Delete(ctx, backupBlobKey(userID, backupID)); err != nil {
+		logger(ctx).Error("Error deleting blob", "backup_id", backupID, "error", err)
+	}
+	if err := db.Chunks().Release(ctx, backupID); err != nil {
+		logger(ctx).Error("Error releasing backup chunks", "backup_id", backupID, "error", err)
+	}
+}
+
+// replicationOutbox keeps blob changes not yet copied to the replica in
+// the database, so every server can retry them.
+type replicationOutbox struct{}
+
+func (replicationOutbox) Add(ctx context.Context, key, contentType string) (string, error) {
+	now := time.Now()
+	version := generateID()
+	err := db.Replication().Add(ctx, storage.ReplicationChange{
+		Key:          key,
+		ContentType:  contentType,
+		Version:      version,
+		PendingSince: now,
+		ChangedAt:    now,
+	})
+	return version, err
+}
+
+func (replicationOutbox) Done(ctx context.Context, key, version string) error {
+	return db.Replication().Done(ctx, key, version)
+}
+
+func (replicationOutbox) Pending(ctx context.Context, before time.Time, limit int) ([]objectstore.Change, error) {
+	pending, err := db.Replication().Pending(ctx, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]objectstore.Change, 0, len(pending))
+	for _, c := range pending {
+		changes = append(changes, objectstore.Change{Key: c.Key, ContentType: c.ContentType, Version: c.Version})
+	}
+	return changes, nil
+}
+
+func (replicationOutbox) Backlog(ctx context.Context) (int, *time.Time, error) {
+	return db.Replication().Backlog(ctx)
+}
+
+func retryBlobReplication() {
+	if blobReplication == nil {
+		return
+	}
+	if err := blobReplication.Retry(context.Background()); err != nil {
+		slog.Error("Failed to retry blob replication", "error", err)
+	}
+}
+
+// Handlers
+func getReplicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if blobReplication == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+		return
+	}
+	stats, err := blobReplication.Stats(r.Context())
+	if err != nil {
+		logger(r.Context()).Error("Error reading replication backlog", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":     true,
+		"replication": stats,
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"backup-manager/config"
+)
+
+// hCaptcha, reCAPTCHA and Turnstile all share this verification protocol, so
+// switching provider only means changing CAPTCHA_VERIFY_URL.
+const defaultCaptchaVerifyURL = "https://hcaptcha.com/siteverify"
+
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+func captchaEnabled() bool {
+	return config.Get("CAPTCHA_SECRET") != ""
+}
+
+// verifyCaptcha checks a CAPTCHA response token with the provider.
+func verifyCaptcha(token, remoteIP string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	verifyURL := config.Get("CAPTCHA_VERIFY_URL")
+	if verifyURL == "" {
+		verifyURL = defaultCaptchaVerifyURL
+	}
+
+	resp, err := captchaClient.PostForm(verifyURL, url.Values{
+		"secret":   {config.Get("CAPTCHA_SECRET")},
+		"response": {token},
+		"remoteip": {remoteIP},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/extract"
+	"backup-manager/storage"
+	"backup-manager/streamcrypt"
+)
+
+const (
+	importStatusPending    = "pending"
+	importStatusProcessing = "processing"
+	importStatusCompleted  = "completed"
+	importStatusFailed     = "failed"
+
+	// maxImportBytes bounds an uploaded export. Exports with images can be
+	// large, but only the conversations in them are read.
+	maxImportBytes = 4 << 30
+	// maxImportName bounds a backup name made from a conversation title
+	maxImportName = 200
+)
+
+// importSources are the backup sources of each export format.
+var importSources = map[string]string{
+	extract.FormatChatGPT: "ChatGPT",
+	extract.FormatClaude:  "Claude AI",
+}
+
+// ChatImport tracks an uploaded chat export; see storage.ChatImport.
+type ChatImport = storage.ChatImport
+
+type chatImportPayload struct {
+	ImportID string `json:"import_id"`
+}
+
+// importBlobKey is where an export waits to be imported.
+func importBlobKey(userID, importID string) string {
+	return "imports/" + userID + "/" + importID
+}
+
+// queueChatImport stores the export spooled at path, encrypted with key,
+// where any server can read it, records imp and queues a job to import it.
+// The caller still removes path.
+func queueChatImport(ctx context.Context, imp ChatImport, path string, key []byte) (ChatImport, error) {
+	imp.BlobKey = importBlobKey(imp.UserID, imp.ID)
+	if err := stageImport(ctx, imp.BlobKey, path, key); err != nil {
+		return ChatImport{}, err
+	}
+	if err := db.ChatImports().Create(ctx, imp); err != nil {
+		discardImportBlob(ctx, imp)
+		return ChatImport{}, err
+	}
+	if _, err := enqueueJob(ctx, imp.UserID, jobChatImport, chatImportPayload{ImportID: imp.ID}); err != nil {
+		now := time.Now()
+		imp.Status = importStatusFailed
+		imp.Error = "The import couldn't be queued"
+		imp.CompletedAt = &now
+		discardImportBlob(ctx, imp)
+		imp.BlobKey = ""
+		db.ChatImports().Update(ctx, imp)
+		return ChatImport{}, err
+	}
+	progress.publish(imp.UserID, importProgress(imp))
+	return imp, nil
+}
+
+// stageImport encrypts the file at path into the blob store at blobKey.
+func stageImport(ctx context.Context, blobKey, path string, key []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := streamcrypt.NewWriter(pw, key)
+		if err == nil {
+			_, err = io.Copy(enc, f)
+			if cerr := enc.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	if err := blobStore.PutStream(ctx, blobKey, pr, "application/octet-stream"); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	return nil
+}
+
+// fetchImport copies a staged export back to a temporary file, since a zip
+// can only be read with random access.
+func fetchImport(ctx context.Context, imp ChatImport, key []byte) (string, error) {
+	body, err := blobStore.Get(ctx, imp.BlobKey)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	plaintext, err := streamcrypt.NewReader(body, key)
+	if err != nil {
+		return "", err
+	}
+	return spoolImport(plaintext)
+}
+
+func discardImportBlob(ctx context.Context, imp ChatImport) {
+	if err := blobStore.Delete(ctx, imp.BlobKey); err != nil {
+		logger(ctx).Error("Error deleting staged import", "import_id", imp.ID, "error", err)
+	}
+}
+
+// discardImports deletes the exports of a user's imports that haven't
+// run, for deleteAccount. The imports themselves go with the user.
+func discardImports(ctx context.Context, userID string) error {
+	imports, err := db.ChatImports().List(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, imp := range imports {
+		if imp.BlobKey != "" {
+			if err := blobStore.Delete(ctx, imp.BlobKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveImport stores the import's state and pushes it to the owner's
+// progress connections on this server.
+func saveImport(ctx context.Context, imp ChatImport) error {
+	if err := db.ChatImports().Update(ctx, imp); err != nil {
+		return err
+	}
+	progress.publish(imp.UserID, importProgress(imp))
+	return nil
+}
+
+// runChatImportJob imports an export queued by queueChatImport. As with
+// data exports, a failed import isn't a failed job: the import keeps its
+// own status. A run stopped by shutdown leaves the export staged, and the
+// job is queued again to start over.
+func runChatImportJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload chatImportPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	imp, err := db.ChatImports().Get(ctx, job.UserID, payload.ImportID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if imp.BlobKey == "" {
+		// Already imported
+		return nil, nil
+	}
+	imp.Status = importStatusProcessing
+	imp.Conversations, imp.Imported, imp.Skipped, imp.Projects = 0, 0, 0, 0
+	if err := saveImport(ctx, imp); err != nil {
+		return nil, err
+	}
+
+	err = runChatImport(ctx, &imp)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	now := time.Now()
+	imp.Status = importStatusCompleted
+	imp.CompletedAt = &now
+	switch {
+	case errors.Is(err, errDataKeyLocked):
+		imp.Status = importStatusFailed
+		imp.Error = "Your data key is locked; log in again and import the export again"
+	case errors.Is(err, errQuotaExceeded):
+		imp.Status = importStatusFailed
+		imp.Error = "Your storage quota is full; conversations imported so far were kept"
+	case err != nil:
+		slog.Error("Chat import failed", "import_id", imp.ID, "error", err)
+		imp.Status = importStatusFailed
+		imp.Error = "Error reading the export"
+	}
+	discardImportBlob(ctx, imp)
+	imp.BlobKey = ""
+	if err := saveImport(ctx, imp); err != nil {
+		return nil, err
+	}
+	if imp.Status == importStatusCompleted {
+		publishEvent("import.completed", imp.UserID, "import", imp.ID, nil)
+	}
+	return nil, nil
+}
+
+// runChatImport saves each conversation in the export as a backup of its
+// own, counting them in imp. Conversations already imported, by content,
+// are skipped, so the same export can be imported again after a failure or
+// with newer chats.
+func runChatImport(ctx context.Context, imp *ChatImport) error {
+	if imp.TeamID != "" {
+		ctx = storage.WithTeam(ctx, imp.TeamID)
+	}
+	key, err := backupKey(ctx, Backup{UserID: imp.UserID, KeyVersion: imp.KeyVersion})
+	if err != nil {
+		return err
+	}
+
+	existing, err := db.Backups().List(ctx, imp.UserID)
+	if err != nil {
+		return err
+	}
+	imported := map[string]bool{}
+	for _, b := range existing {
+		if b.Checksum != "" {
+			imported[b.Checksum] = true
+		}
+	}
+
+	path, err := fetchImport(ctx, *imp, key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	f, err := extract.OpenExport(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return extract.Readers[imp.Format](f, func(conv extract.Conversation) error {
+		if len(conv.Messages) == 0 {
+			return nil
+		}
+		transcript := conv.Markdown()
+		checksum := backupChecksum(transcript)
+		imp.Conversations++
+		if imported[checksum] {
+			imp.Skipped++
+			return saveImport(ctx, *imp)
+		}
+		projects, err := importConversation(ctx, *imp, conv, transcript, key)
+		if err != nil {
+			return err
+		}
+		imported[checksum] = true
+		imp.Imported++
+		imp.Projects += projects
+		return saveImport(ctx, *imp)
+	})
+}
+
+// importConversation stores one conversation as a Markdown transcript,
+// dated and titled as in the export, and creates the projects in it. It
+// returns how many projects it created.
+func importConversation(ctx context.Context, imp ChatImport, conv extract.Conversation, transcript string, key []byte) (int, error) {
+	title := conv.Title
+	if title == "" {
+		title = "Untitled conversation"
+	}
+	backup := Backup{
+		ID:        generateID(),
+		UserID:    imp.UserID,
+		TeamID:    imp.TeamID,
+		Name:      truncate(strings.NewReplacer("/", "-", "\\", "-").Replace(title), maxImportName) + ".md",
+		Title:     truncate(title, maxImportName),
+		Source:    importSources[imp.Format],
+		Timestamp: conv.CreatedAt,
+	}
+	if backup.Timestamp.IsZero() {
+		backup.Timestamp = imp.RequestedAt
+	}
+	file, err := limitToQuota(ctx, imp.UserID, strings.NewReader(transcript))
+	if err != nil {
+		return 0, err
+	}
+	if err := writeBackupBlob(ctx, &backup, file, key, imp.KeyVersion); err != nil {
+		return 0, fmt.Errorf("storing conversation %q: %w", conv.ID, err)
+	}
+	preview := previewContent(backup.Name, []byte(transcript), backup.Size)
+	backup.FileType = preview.FileType
+	backup.ContentPreview = preview.Text
+	if text := conversationPreview([]extract.Conversation{conv}); text != "" {
+		backup.ContentPreview = text
+	}
+
+	if err := db.Backups().Create(ctx, backup); err != nil {
+		deleteBackupBlob(ctx, imp.UserID, backup.ID)
+		return 0, fmt.Errorf("saving conversation %q: %w", conv.ID, err)
+	}
+
+	// The export's title is kept rather than asking for a generated one
+	doc := backupDocument(backup)
+	indexDocuments(doc)
+	enqueueEmbedding(doc, transcript)
+
+	recordDomainEvent(imp.Actor, DomainEvent{
+		Type:          "backup.created",
+		AggregateType: aggregateBackup,
+		AggregateID:   backup.ID,
+		OwnerID:       imp.UserID,
+		After:         snapshot(backup),
+	}, map[string]interface{}{
+		"name":      backup.Name,
+		"source":    backup.Source,
+		"size":      backup.Size,
+		"file_type": backup.FileType,
+		"import_id": imp.ID,
+	})
+
+	projects := saveExtractedProjects(ctx, imp.Actor, backup, []extract.Conversation{conv}, nil)
+	return len(projects), nil
+}
+
+// spoolImport copies the uploaded export to a temporary file, since a zip
+// can only be read with random access.
+func spoolImport(r io.Reader) (string, error) {
+	f, err := os.CreateTemp("", "backup-manager-import-*")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, maxImportBytes+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > maxImportBytes {
+		err = errImportTooLarge
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+var errImportTooLarge = errors.New("export is too large")
+
+// detectImportFormat names the format of the export at path, or returns
+// "" if it isn't one that can be imported.
+func detectImportFormat(path string) string {
+	f, err := extract.OpenExport(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return extract.Detect(f)
+}
+
+// Handlers
+
+// createImportHandler accepts a chat export, a zip as downloaded or the
+// conversations.json from one, and queues it to be split into backups.
+func createImportHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	liftDeadlines(w)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart upload", http.StatusBadRequest)
+		return
+	}
+	var path string
+	defer func() {
+		if path != "" {
+			os.Remove(path)
+		}
+	}()
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Error reading upload", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" && part.FileName() != "" && path == "" {
+			path, err = spoolImport(part)
+			if errors.Is(err, errImportTooLarge) {
+				http.Error(w, "Export is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				logger(r.Context()).Error("Error spooling chat import", "error", err)
+				http.Error(w, "Error reading upload", http.StatusInternalServerError)
+				return
+			}
+		}
+		part.Close()
+	}
+	if path == "" {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+
+	detected := detectImportFormat(path)
+	if detected == "" {
+		http.Error(w, "Not a recognised chat export", http.StatusUnprocessableEntity)
+		return
+	}
+
+	key, keyVersion, err := uploadKey(r.Context(), userID)
+	if errors.Is(err, errDataKeyLocked) {
+		writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error encrypting data", http.StatusInternalServerError)
+		return
+	}
+
+	imp, err := queueChatImport(r.Context(), ChatImport{
+		ID:          generateID(),
+		UserID:      userID,
+		TeamID:      storage.TeamFrom(r.Context()),
+		Format:      detected,
+		Status:      importStatusPending,
+		RequestedAt: time.Now(),
+		Actor:       requestActor(r),
+		KeyVersion:  keyVersion,
+	}, path, key)
+	if err != nil {
+		writeEnqueueError(w, r, err)
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "import.created",
+		ResourceType: "import",
+		ResourceID:   imp.ID,
+		Metadata:     map[string]interface{}{"format": detected},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(imp)
+}
+
+func getImportsHandler(w http.ResponseWriter, r *http.Request) {
+	imports, err := db.ChatImports().List(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Imports")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(imports)
+}
+
+func getImportHandler(w http.ResponseWriter, r *http.Request) {
+	imp, err := db.ChatImports().Get(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Import")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(imp)
+}
@@ -0,0 +1,83 @@
+// Package chunker splits streams into content-defined chunks. Boundaries
+// fall where a rolling hash of the last 64 bytes hits a pattern, so they
+// follow the content rather than offsets: an edit early in a file changes
+// the chunks around it and leaves the rest as they were, which is what lets
+// a re-upload share most of its chunks with the last one.
+package chunker
+
+import "io"
+
+const (
+	MinSize = 64 << 10
+	AvgSize = 256 << 10
+	MaxSize = 1 << 20
+
+	// window is how many trailing bytes the rolling hash depends on
+	window = 64
+	// mask tests the hash's top bits, which mix the whole window, for one
+	// boundary every AvgSize bytes past MinSize on average
+	mask = uint64(AvgSize-1) << (64 - 18)
+)
+
+// gear maps each byte to a random value for the rolling hash, fixed so
+// the same content is cut the same way across restarts.
+var gear = func() [256]uint64 {
+	var g [256]uint64
+	x := uint64(0x2545f4914f6cdd1d)
+	for i := range g {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		g[i] = z ^ (z >> 31)
+	}
+	return g
+}()
+
+// Chunker reads a stream a chunk at a time, holding at most MaxSize bytes.
+type Chunker struct {
+	r    io.Reader
+	buf  []byte
+	next int // start of what Next hasn't returned yet
+	err  error
+}
+
+func New(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 0, MaxSize)}
+}
+
+// Next returns the next chunk, which is only valid until the following
+// call, or io.EOF after the last one.
+func (c *Chunker) Next() ([]byte, error) {
+	n := copy(c.buf, c.buf[c.next:])
+	c.buf, c.next = c.buf[:n], 0
+	for len(c.buf) < MaxSize && c.err == nil {
+		var read int
+		read, c.err = c.r.Read(c.buf[len(c.buf):MaxSize])
+		c.buf = c.buf[:len(c.buf)+read]
+	}
+	if len(c.buf) == 0 {
+		return nil, c.err
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	c.next = boundary(c.buf)
+	return c.buf[:c.next], nil
+}
+
+// boundary is the length of the chunk data starts with.
+func boundary(data []byte) int {
+	if len(data) <= MinSize {
+		return len(data)
+	}
+	var h uint64
+	for i := MinSize - window; i < len(data); i++ {
+		h = h<<1 + gear[data[i]]
+		if i >= MinSize && h&mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
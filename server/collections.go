@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// Collections are folders for projects beyond tags. They belong to the
+// workspace they were made in, and a project can be in several.
+
+// Handlers
+func createCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Name        string `json:"name" validate:"required,max=100"`
+		Description string `json:"description" validate:"max=1000"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		writeFieldError(w, "name", "required", "name is required")
+		return
+	}
+
+	collection := storage.Collection{
+		ID:          generateID(),
+		UserID:      userID,
+		TeamID:      storage.TeamFrom(r.Context()),
+		Name:        name,
+		Description: strings.TrimSpace(req.Description),
+		CreatedAt:   time.Now(),
+	}
+	if err := db.Collections().Create(r.Context(), collection); err != nil {
+		writeStorageError(w, r, err, "Collection")
+		return
+	}
+	recordAudit(r, AuditEvent{Action: "collection.created", ResourceType: "collection", ResourceID: collection.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(collection)
+}
+
+func getCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	collections, err := db.Collections().List(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Collections")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collections)
+}
+
+// getCollectionHandler returns a collection with its projects, most
+// recently added first.
+func getCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	collection, err := db.Collections().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Collection")
+		return
+	}
+	projects, err := db.Collections().Projects(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"collection": collection,
+		"projects":   projects,
+	})
+}
+
+// updateCollectionHandler renames a collection or changes its description;
+// only the fields present change.
+func updateCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Name        *string `json:"name" validate:"max=100"`
+		Description *string `json:"description" validate:"max=1000"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	collection, err := db.Collections().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Collection")
+		return
+	}
+	var fields []string
+	if req.Name != nil {
+		if collection.Name = strings.TrimSpace(*req.Name); collection.Name == "" {
+			writeFieldError(w, "name", "required", "name is required")
+			return
+		}
+		fields = append(fields, "name")
+	}
+	if req.Description != nil {
+		collection.Description = strings.TrimSpace(*req.Description)
+		fields = append(fields, "description")
+	}
+	if len(fields) == 0 {
+		http.Error(w, "No fields to update", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.Collections().Update(r.Context(), userID, collection); err != nil {
+		writeStorageError(w, r, err, "Collection")
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "collection.updated",
+		ResourceType: "collection",
+		ResourceID:   id,
+		Metadata:     map[string]interface{}{"fields": fields},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collection)
+}
+
+// deleteCollectionHandler removes a collection, leaving its projects be.
+func deleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if err := db.Collections().Delete(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Collection")
+		return
+	}
+	recordAudit(r, AuditEvent{Action: "collection.deleted", ResourceType: "collection", ResourceID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addCollectionProjectHandler puts a project in a collection. Both must be
+// in the workspace; adding a project already there does nothing.
+func addCollectionProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	vars := mux.Vars(r)
+
+	if _, err := db.Collections().Get(r.Context(), userID, vars["id"]); err != nil {
+		writeStorageError(w, r, err, "Collection")
+		return
+	}
+	if _, err := db.Projects().Get(r.Context(), userID, vars["projectId"]); err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	err := db.Collections().AddProject(r.Context(), vars["id"], vars["projectId"], time.Now())
+	if errors.Is(err, storage.ErrConflict) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Collection")
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "collection.project_added",
+		ResourceType: "collection",
+		ResourceID:   vars["id"],
+		Metadata:     map[string]interface{}{"project_id": vars["projectId"]},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeCollectionProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	vars := mux.Vars(r)
+
+	if _, err := db.Collections().Get(r.Context(), userID, vars["id"]); err != nil {
+		writeStorageError(w, r, err, "Collection")
+		return
+	}
+	if err := db.Collections().RemoveProject(r.Context(), vars["id"], vars["projectId"]); err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "collection.project_removed",
+		ResourceType: "collection",
+		ResourceID:   vars["id"],
+		Metadata:     map[string]interface{}{"project_id": vars["projectId"]},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
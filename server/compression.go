@@ -0,0 +1,253 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+
+	"backup-manager/config"
+)
+
+// Responses are compressed when the client accepts it and they are worth
+// it: a compressible type, such as JSON or HTML, and at least
+// COMPRESSION_MIN_SIZE bytes, 1 KiB by default. Images, archives and
+// backups, which are compressed or encrypted already, are sent as they are.
+// Brotli is offered too with COMPRESSION_BROTLI=true; it shrinks JSON more
+// than gzip but costs more CPU.
+
+const defaultCompressionMinSize = 1024
+
+var (
+	compressionMinSize = defaultCompressionMinSize
+	// compressionEncodings are the encodings offered, preferred first
+	compressionEncodings = []string{"gzip", "deflate"}
+)
+
+// resettableWriter is a compressor that can be reused for another response.
+type resettableWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var compressors = map[string]*sync.Pool{
+	"br": {New: func() interface{} { return brotli.NewWriterLevel(nil, 4) }},
+	"gzip": {New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	"deflate": {New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}},
+}
+
+// compressibleTypes are the media types worth compressing, beyond text/*
+// and those with a +json or +xml suffix.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/x-ndjson":   true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+// initCompression reads the compression settings.
+func initCompression() {
+	if n, err := strconv.Atoi(config.Get("COMPRESSION_MIN_SIZE")); err == nil && n >= 0 {
+		compressionMinSize = n
+	}
+	if config.Get("COMPRESSION_BROTLI") == "true" {
+		compressionEncodings = append([]string{"br"}, compressionEncodings...)
+	}
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return compressibleTypes[mediaType] || strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// negotiateEncoding picks the encoding to use from Accept-Encoding: the
+// one with the highest q-value, ties going to the first offered. It returns
+// "" when the client accepts none of them.
+func negotiateEncoding(accept string) string {
+	weights := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			weights[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range compressionEncodings {
+		q, ok := weights[enc]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressResponses compresses responses for clients that accept it.
+// Entity tags are left as they are: they name the content, and If-Match on
+// a later edit has to match whichever encoding the client read it in.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding"))}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	})
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// the response is big enough to compress.
+type compressWriter struct {
+	http.ResponseWriter
+	// encoding is the one negotiated, "" if the client accepts none
+	encoding string
+	status   int
+	// eligible is set when the response may be compressed, once its size
+	// is known
+	eligible bool
+	started  bool
+	pending  []byte
+	enc      resettableWriter
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status != 0 {
+		return
+	}
+	c.status = status
+	h := c.Header()
+	if !compressible(h.Get("Content-Type")) || h.Get("Content-Encoding") != "" {
+		c.start(false)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	// Partial content, redirects and bodiless responses are sent as they are
+	if c.encoding == "" || status != http.StatusOK && status != http.StatusCreated && status < http.StatusBadRequest {
+		c.start(false)
+		return
+	}
+	c.eligible = true
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		c.start(n >= compressionMinSize)
+	}
+}
+
+// start sends the status and whatever is held back, compressed or not.
+func (c *compressWriter) start(compress bool) error {
+	c.started = true
+	if compress {
+		h := c.Header()
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		c.enc = compressors[c.encoding].Get().(resettableWriter)
+		c.enc.Reset(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+
+	pending := c.pending
+	c.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	_, err := c.write(pending)
+	return err
+}
+
+func (c *compressWriter) write(b []byte) (int, error) {
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.started {
+		return c.write(b)
+	}
+	c.pending = append(c.pending, b...)
+	if len(c.pending) >= compressionMinSize {
+		if err := c.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// FlushError sends what has been written so far, compressed if the
+// response is eligible, whatever its size.
+func (c *compressWriter) FlushError() error {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.started {
+		if err := c.start(c.eligible); err != nil {
+			return err
+		}
+	}
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// finish sends a response too small to compress and closes the compressor
+// of one that was.
+func (c *compressWriter) finish() {
+	if c.status != 0 && !c.started {
+		c.start(false)
+	}
+	if c.enc != nil {
+		c.enc.Close()
+		c.enc.Reset(nil)
+		compressors[c.encoding].Put(c.enc)
+		c.enc = nil
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Conditional requests spare clients downloading what they already have
+// and keep one edit from silently overwriting another. Every JSON response
+// to a GET gets an ETag, hashed from its body unless the handler set one,
+// and If-None-Match naming it is answered with 304. Handlers of resources
+// that can be edited check If-Match themselves, see checkIfMatch.
+
+// conditionalGet adds ETags to JSON GET responses and honors If-None-Match.
+func conditionalGet(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &conditionalWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		cw.finish(r)
+	})
+}
+
+// conditionalWriter holds back a successful JSON response so it can be
+// hashed; anything else passes straight through.
+type conditionalWriter struct {
+	http.ResponseWriter
+	started   bool
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (c *conditionalWriter) WriteHeader(status int) {
+	if c.started {
+		return
+	}
+	c.started = true
+	if status == http.StatusOK && strings.HasPrefix(c.Header().Get("Content-Type"), "application/json") {
+		c.buffering = true
+		return
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *conditionalWriter) Write(b []byte) (int, error) {
+	if !c.started {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.buffering {
+		return c.body.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// FlushError does nothing for a response being held back.
+func (c *conditionalWriter) FlushError() error {
+	if !c.started {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.buffering {
+		return nil
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *conditionalWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *conditionalWriter) finish(r *http.Request) {
+	if !c.buffering {
+		return
+	}
+	etag := c.Header().Get("ETag")
+	if etag == "" {
+		sum := sha256.Sum256(c.body.Bytes())
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		c.Header().Set("ETag", etag)
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		c.Header().Del("Content-Type")
+		c.Header().Del("Content-Length")
+		c.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	c.ResponseWriter.WriteHeader(http.StatusOK)
+	c.ResponseWriter.Write(c.body.Bytes())
+}
+
+// etagMatches reports whether header, a list of entity tags as given in
+// If-Match or If-None-Match, names etag or is "*". A weak comparison, as
+// If-None-Match makes, ignores W/ prefixes; otherwise weak tags never match.
+func etagMatches(header, etag string, weak bool) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		} else if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch answers 412 when the request's If-Match doesn't name etag,
+// the current tag of what it would change. A request without If-Match
+// always passes.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, etag, what string) bool {
+	if r.Header.Get("If-Match") == "" || etagMatches(r.Header.Get("If-Match"), etag, false) {
+		return true
+	}
+	http.Error(w, what+" has changed since it was read", http.StatusPreconditionFailed)
+	return false
+}
@@ -0,0 +1,256 @@
+// Package config holds the server's settings. They come from the
+// environment and, optionally, a YAML or TOML file, with the environment
+// overriding the file so one deployment can change a setting without
+// editing it.
+//
+// In a file, a setting is named in lower or upper case, and a section
+// prefixes the settings in it: smtp.host, or host under [smtp], is
+// SMTP_HOST. Lists are joined with commas.
+//
+// Any setting can instead be read from a file named by the setting with
+// _FILE appended, as Docker and Kubernetes mount secrets, and a value can
+// be a reference to a secret in Vault or AWS Secrets Manager.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sources of a setting's value.
+const (
+	SourceEnv        = "env"
+	SourceFile       = "file"
+	SourceSecretFile = "secret file"
+	SourceVault      = "vault"
+	SourceAWS        = "aws secrets manager"
+)
+
+var (
+	mu   sync.RWMutex
+	file = map[string]string{}
+	path string
+)
+
+// Load reads the settings file at p, in YAML or TOML by its extension, and
+// makes it the one Get falls back to. Until then Get only reads the
+// environment.
+func Load(p string) error {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".yaml", ".yml":
+		values, err = parseYAML(string(data))
+	case ".toml":
+		values, err = parseTOML(string(data))
+	default:
+		return fmt.Errorf("config: %s: unknown format, use .yaml, .yml or .toml", p)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %w", p, err)
+	}
+
+	mu.Lock()
+	file, path = values, p
+	mu.Unlock()
+	return nil
+}
+
+// Path is the file loaded, if any.
+func Path() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return path
+}
+
+// Get returns the setting name, "" when it is unset.
+func Get(name string) string {
+	v, _ := Lookup(name)
+	return v
+}
+
+// Lookup returns the setting name and where it came from, "" if it is
+// unset or can't be read. A variable set in the environment wins even when
+// empty, and NAME_FILE is only read when NAME isn't set at all.
+func Lookup(name string) (value, source string) {
+	value, source, _ = lookup(name)
+	return value, source
+}
+
+func lookup(name string) (value, source string, err error) {
+	value, source = lookupRaw(name)
+	if source == "" {
+		p, _ := lookupRaw(name + "_FILE")
+		if p == "" {
+			return "", "", nil
+		}
+		if value, err = readSecretFile(name, p); err != nil {
+			return "", SourceSecretFile, err
+		}
+		source = SourceSecretFile
+	}
+	if isReference(value) {
+		value, source, err = resolve(value)
+		if err != nil {
+			return "", source, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return value, source, nil
+}
+
+func lookupRaw(name string) (value, source string) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, SourceEnv
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if v, ok := file[name]; ok {
+		return v, SourceFile
+	}
+	return "", ""
+}
+
+// WithPrefix returns the set settings whose names start with prefix. One
+// set by a NAME_FILE is returned as NAME.
+func WithPrefix(prefix string) map[string]string {
+	names := map[string]bool{}
+	mu.RLock()
+	for name := range file {
+		names[name] = true
+	}
+	mu.RUnlock()
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		names[name] = true
+	}
+
+	found := map[string]string{}
+	for name := range names {
+		name = strings.TrimSuffix(name, "_FILE")
+		if strings.HasPrefix(name, prefix) {
+			found[name] = Get(name)
+		}
+	}
+	return found
+}
+
+// Validate checks every known setting that is set, and that those required
+// are, returning all the problems at once. Settings in the file that aren't
+// known are reported too, as they are most likely misspelled.
+func Validate() error {
+	var errs []error
+	for _, s := range Settings {
+		for _, name := range s.names() {
+			v, _, err := lookup(name)
+			switch {
+			case err != nil:
+				errs = append(errs, err)
+			case v == "" && s.Required:
+				errs = append(errs, fmt.Errorf("%s is required", name))
+			case v != "":
+				if err := s.Kind.check(v); err != nil {
+					errs = append(errs, fmt.Errorf("%s %w", name, err))
+				}
+			}
+		}
+	}
+
+	mu.RLock()
+	for name := range file {
+		if lookupSetting(name) == nil {
+			errs = append(errs, fmt.Errorf("%s in %s is not a known setting", name, path))
+		}
+	}
+	mu.RUnlock()
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// Entry is one setting as Summary reports it.
+type Entry struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Summary lists the known settings that are set, by name, with secrets
+// redacted and passwords taken out of URLs.
+func Summary() []Entry {
+	var entries []Entry
+	for _, s := range Settings {
+		for _, name := range s.names() {
+			v, source := Lookup(name)
+			if v == "" {
+				continue
+			}
+			entries = append(entries, Entry{Name: name, Value: s.redact(v), Source: source})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// names returns the setting's names. A prefix setting can have several,
+// leaving out settings of their own that share the prefix.
+func (s Setting) names() []string {
+	if !s.Prefix {
+		return []string{s.Name}
+	}
+	var names []string
+	for name := range WithPrefix(s.Name) {
+		if lookupSetting(name).Name != name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s Setting) redact(v string) string {
+	if s.Secret {
+		return "[redacted]"
+	}
+	if strings.Contains(v, "://") {
+		parts := strings.Split(v, ",")
+		for i, part := range parts {
+			if u, err := url.Parse(strings.TrimSpace(part)); err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					u.User = url.UserPassword(u.User.Username(), "redacted")
+					parts[i] = u.String()
+				}
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return v
+}
+
+// lookupSetting finds the setting name is, preferring one of its own to a
+// prefix it starts with. NAME_FILE is the setting NAME.
+func lookupSetting(name string) *Setting {
+	var prefix *Setting
+	for i, s := range Settings {
+		if s.Name == name {
+			return &Settings[i]
+		}
+		if s.Prefix && strings.HasPrefix(name, s.Name) {
+			prefix = &Settings[i]
+		}
+	}
+	if base, ok := strings.CutSuffix(name, "_FILE"); ok {
+		if s := lookupSetting(base); s != nil {
+			return s
+		}
+	}
+	return prefix
+}
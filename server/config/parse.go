@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Files are decoded by their format's own parser and then flattened:
+// nested mappings and tables name settings by their path, and lists of
+// scalars are joined with commas. Anything else, such as a list of
+// mappings, is rejected rather than misread.
+
+// settingName turns the path of a setting in a file into its name.
+func settingName(parts ...string) string {
+	name := strings.Join(parts, "_")
+	name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	return strings.ToUpper(name)
+}
+
+func parseTOML(data string) (map[string]string, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(data, &doc); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	return values, flatten(values, nil, doc)
+}
+
+func parseYAML(data string) (map[string]string, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte(data), &doc); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	return values, flatten(values, nil, doc)
+}
+
+// flatten adds the settings in v, found at path, to values.
+func flatten(values map[string]string, path []string, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if err := flatten(values, append(path[:len(path):len(path)], key), child); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[interface{}]interface{}:
+		for key, child := range v {
+			if err := flatten(values, append(path[:len(path):len(path)], fmt.Sprint(key)), child); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := scalar(item)
+			if !ok {
+				return fmt.Errorf("%s: lists can only hold plain values", strings.Join(path, "."))
+			}
+			items = append(items, s)
+		}
+		values[settingName(path...)] = strings.Join(items, ",")
+		return nil
+	}
+	s, ok := scalar(v)
+	if !ok {
+		return fmt.Errorf("%s: unsupported value", strings.Join(path, "."))
+	}
+	values[settingName(path...)] = s
+	return nil
+}
+
+// scalar formats a plain value as a setting would be written in the
+// environment.
+func scalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case time.Time:
+		return v.Format(time.RFC3339), true
+	}
+	return "", false
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-manager/sigv4"
+)
+
+// A setting can also be given as a reference to a secret manager, fetched
+// when the setting is first read and again on each Refresh:
+//
+//	vault:<path>#<field>    a Vault KV secret, v1 or v2, read with VAULT_TOKEN
+//	aws-sm:<id>#<field>     an AWS Secrets Manager secret, by name or ARN
+//
+// The field may be left out when a Vault secret has only one, or for an AWS
+// secret stored as plain text rather than JSON.
+const (
+	vaultScheme = "vault:"
+	awsScheme   = "aws-sm:"
+)
+
+const secretFetchTimeout = 10 * time.Second
+
+type fetchedSecret struct {
+	value string
+	err   error
+}
+
+var (
+	secretsMu sync.Mutex
+	// Fetched secrets by reference
+	secrets = map[string]fetchedSecret{}
+
+	secretsClient = &http.Client{Timeout: secretFetchTimeout}
+)
+
+func isReference(v string) bool {
+	return strings.HasPrefix(v, vaultScheme) || strings.HasPrefix(v, awsScheme)
+}
+
+// resolve returns the secret ref refers to, fetching it the first time.
+func resolve(ref string) (value, source string, err error) {
+	source = SourceVault
+	if strings.HasPrefix(ref, awsScheme) {
+		source = SourceAWS
+	}
+
+	secretsMu.Lock()
+	s, ok := secrets[ref]
+	secretsMu.Unlock()
+	if !ok {
+		// Fetched unlocked, as fetching reads the settings of the secret
+		// manager. Two readers racing both fetch, which is harmless
+		s.value, s.err = fetchSecret(ref)
+		secretsMu.Lock()
+		secrets[ref] = s
+		secretsMu.Unlock()
+	}
+	return s.value, source, s.err
+}
+
+// Refresh fetches every secret manager reference read so far again, so
+// secrets rotated there are picked up. One that can't be fetched keeps the
+// value it had, and the errors are returned.
+func Refresh() error {
+	secretsMu.Lock()
+	refs := make([]string, 0, len(secrets))
+	for ref := range secrets {
+		refs = append(refs, ref)
+	}
+	secretsMu.Unlock()
+
+	var errs []error
+	for _, ref := range refs {
+		value, err := fetchSecret(ref)
+		secretsMu.Lock()
+		if err == nil || secrets[ref].err != nil {
+			secrets[ref] = fetchedSecret{value: value, err: err}
+		}
+		secretsMu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func fetchSecret(ref string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+
+	if rest, ok := strings.CutPrefix(ref, vaultScheme); ok {
+		path, field, _ := strings.Cut(rest, "#")
+		v, err := fetchVault(ctx, path, field)
+		if err != nil {
+			return "", fmt.Errorf("vault: %s: %w", path, err)
+		}
+		return v, nil
+	}
+	rest := strings.TrimPrefix(ref, awsScheme)
+	id, field, _ := strings.Cut(rest, "#")
+	v, err := fetchAWS(ctx, id, field)
+	if err != nil {
+		return "", fmt.Errorf("aws secrets manager: %s: %w", id, err)
+	}
+	return v, nil
+}
+
+// fetchVault reads field of the secret at path from the Vault at VAULT_ADDR.
+// Path is the API path after /v1/, so for KV version 2 it includes data/,
+// as in secret/data/backup-manager.
+func fetchVault(ctx context.Context, path, field string) (string, error) {
+	addr, token := Get("VAULT_ADDR"), Get("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", errors.New("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := Get("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("unexpected response: %w", err)
+	}
+	data := resp.Data
+	// KV version 2 nests the secret under data, beside its metadata
+	if inner, ok := data["data"]; ok {
+		if _, v2 := data["metadata"]; v2 {
+			data = nil
+			if err := json.Unmarshal(inner, &data); err != nil {
+				return "", fmt.Errorf("unexpected response: %w", err)
+			}
+		}
+	}
+	return secretField(data, field)
+}
+
+// fetchAWS reads the secret id from AWS Secrets Manager in AWS_REGION, with
+// the usual AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+// AWS_SECRETS_MANAGER_ENDPOINT points it elsewhere, such as at LocalStack.
+func fetchAWS(ctx context.Context, id, field string) (string, error) {
+	region := Get("AWS_REGION")
+	if region == "" {
+		return "", errors.New("AWS_REGION must be set")
+	}
+	creds := sigv4.Credentials{
+		AccessKey:    Get("AWS_ACCESS_KEY_ID"),
+		SecretKey:    Get("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: Get("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return "", errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	endpoint := Get("AWS_SECRETS_MANAGER_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	payload, _ := json.Marshal(map[string]string{"SecretId": id})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(endpoint, "/")+"/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	sigv4.Sign(req, payload, creds, region, "secretsmanager", time.Now().UTC())
+
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("unexpected response: %w", err)
+	}
+	if resp.SecretString == nil {
+		return "", errors.New("secret has no string value")
+	}
+	if field == "" {
+		return *resp.SecretString, nil
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*resp.SecretString), &data); err != nil {
+		return "", fmt.Errorf("secret is not JSON, so has no field %q", field)
+	}
+	return secretField(data, field)
+}
+
+func doSecretRequest(req *http.Request) ([]byte, error) {
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body[:min(len(body), 512)])))
+	}
+	return body, nil
+}
+
+// secretField returns field of a secret's data, or its only field when
+// field is "".
+func secretField(data map[string]json.RawMessage, field string) (string, error) {
+	if field == "" {
+		if len(data) != 1 {
+			return "", errors.New("secret has several fields, name one after #")
+		}
+		for name := range data {
+			field = name
+		}
+	}
+	raw, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", fmt.Errorf("field %q is not a string", field)
+	}
+	return v, nil
+}
+
+// readSecretFile reads a setting from the file its _FILE setting names,
+// without the trailing newline editors and `echo` leave.
+func readSecretFile(name, p string) (string, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
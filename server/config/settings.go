@@ -0,0 +1,272 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is what a setting's value must look like.
+type Kind int
+
+const (
+	String Kind = iota
+	Int
+	// Count is an int of at least 1
+	Count
+	Bool
+	Duration
+	Port
+	URL
+	// URLList is a comma-separated list of URLs
+	URLList
+	// Key is a secret of exactly 32 bytes, as AES-256 takes
+	Key
+	// Secret32 is a secret of at least 32 bytes
+	Secret32
+)
+
+func (k Kind) check(v string) error {
+	switch k {
+	case Int:
+		if _, err := strconv.Atoi(v); err != nil {
+			return errors.New("must be a whole number")
+		}
+	case Count:
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			return errors.New("must be a whole number of at least 1")
+		}
+	case Bool:
+		if v != "true" && v != "false" {
+			return errors.New("must be true or false")
+		}
+	case Duration:
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return errors.New(`must be a duration such as "90s" or "5m"`)
+		}
+	case Port:
+		if n, err := strconv.Atoi(v); err != nil || n < 1 || n > 65535 {
+			return errors.New("must be a port number from 1 to 65535")
+		}
+	case URL:
+		return checkURL(v)
+	case URLList:
+		for _, u := range strings.Split(v, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				if err := checkURL(u); err != nil {
+					return err
+				}
+			}
+		}
+	case Key:
+		if len(v) != 32 {
+			return errors.New("must be 32 bytes")
+		}
+	case Secret32:
+		if len(v) < 32 {
+			return errors.New("must be at least 32 bytes")
+		}
+	}
+	return nil
+}
+
+func checkURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme == "" {
+		return fmt.Errorf("must be a URL with a scheme, not %q", redactURL(v))
+	}
+	return nil
+}
+
+// redactURL keeps a malformed URL's password out of error messages.
+func redactURL(v string) string {
+	if at := strings.LastIndex(v, "@"); at >= 0 {
+		return "..." + v[at:]
+	}
+	return v
+}
+
+// Setting is one the server reads.
+type Setting struct {
+	Name string
+	Kind Kind
+	// Secret settings are never shown
+	Secret   bool
+	Required bool
+	// Prefix settings are a family named by Name and a suffix, such as
+	// the ENCRYPTION_KEY_<version> of retired keys
+	Prefix bool
+}
+
+// Settings are all those the server reads. Defaults and the values allowed
+// for choices such as SEARCH_BACKEND are left to the code using them.
+var Settings = []Setting{
+	// Server
+	{Name: "ENV"},
+	{Name: "PORT", Kind: Port},
+	{Name: "HTTP_PORT", Kind: Port},
+	{Name: "DOMAIN"},
+	{Name: "TLS_CERT_FILE"},
+	{Name: "TLS_KEY_FILE"},
+	{Name: "ACME_EMAIL"},
+	{Name: "ACME_CACHE_DIR"},
+	{Name: "ACME_DIRECTORY_URL", Kind: URL},
+	{Name: "FRONTEND_URL", Kind: URL},
+	{Name: "CORS_ALLOWED_ORIGINS"},
+	{Name: "READ_TIMEOUT", Kind: Duration},
+	{Name: "WRITE_TIMEOUT", Kind: Duration},
+	{Name: "SHUTDOWN_TIMEOUT", Kind: Duration},
+	{Name: "COMPRESSION_MIN_SIZE", Kind: Int},
+	{Name: "COMPRESSION_BROTLI", Kind: Bool},
+	{Name: "CONTENT_SECURITY_POLICY"},
+	{Name: "HSTS_MAX_AGE", Kind: Int},
+	{Name: "HSTS_INCLUDE_SUBDOMAINS", Kind: Bool},
+	{Name: "LOG_LEVEL"},
+	{Name: "MAINTENANCE_MODE", Kind: Bool},
+	{Name: "MAINTENANCE_MESSAGE"},
+	{Name: "API_VERSION"},
+	{Name: "SWAGGER_UI_URL", Kind: URL},
+	{Name: "AUTH_RATE_LIMIT", Kind: Count},
+	{Name: "USER_RATE_LIMIT", Kind: Count},
+	{Name: "API_KEY_RATE_LIMIT", Kind: Count},
+
+	// Keys
+	{Name: "JWT_SECRET", Kind: Secret32, Secret: true, Required: true},
+	{Name: "JWT_SECRET_PREVIOUS", Kind: Secret32, Secret: true},
+	{Name: "ENCRYPTION_KEY", Kind: Key, Secret: true, Required: true},
+	{Name: "ENCRYPTION_KEY_VERSION", Kind: Count},
+	{Name: "ENCRYPTION_KEY_", Kind: Key, Secret: true, Prefix: true},
+	{Name: "URL_SIGNING_KEY", Kind: Secret32, Secret: true},
+
+	// Secret managers
+	{Name: "SECRETS_REFRESH_INTERVAL", Kind: Duration},
+	{Name: "VAULT_ADDR", Kind: URL},
+	{Name: "VAULT_TOKEN", Secret: true},
+	{Name: "VAULT_NAMESPACE"},
+	{Name: "AWS_REGION"},
+	{Name: "AWS_ACCESS_KEY_ID"},
+	{Name: "AWS_SECRET_ACCESS_KEY", Secret: true},
+	{Name: "AWS_SESSION_TOKEN", Secret: true},
+	{Name: "AWS_SECRETS_MANAGER_ENDPOINT", Kind: URL},
+
+	// Database and storage
+	{Name: "DATABASE_URL", Kind: URL},
+	{Name: "DATABASE_REPLICA_URLS", Kind: URLList},
+	{Name: "DATABASE_MAX_REPLICA_LAG", Kind: Duration},
+	{Name: "DATABASE_STICKY_WINDOW", Kind: Duration},
+	{Name: "BLOB_STORE_URL"},
+	{Name: "BLOB_REPLICA_URL"},
+	{Name: "BLOB_REPLICA_REGION"},
+	{Name: "BLOB_REPLICA_ENDPOINT"},
+	{Name: "BLOB_REPLICATION_WORKERS", Kind: Count},
+	{Name: "S3_ENDPOINT"},
+	{Name: "S3_REGION"},
+	{Name: "S3_ACCESS_KEY_ID"},
+	{Name: "S3_SECRET_ACCESS_KEY", Secret: true},
+	{Name: "S3_PATH_STYLE", Kind: Bool},
+	{Name: "BACKUP_COMPRESSION"},
+	{Name: "RESUMABLE_UPLOAD_MAX_SIZE"},
+	{Name: "RESUMABLE_UPLOAD_EXPIRY", Kind: Duration},
+	{Name: "STORAGE_QUOTA"},
+	{Name: "STORAGE_QUOTAS"},
+	{Name: "EXPORT_DIR"},
+	{Name: "THUMBNAIL_DIR"},
+	{Name: "JOB_QUEUE_URL", Kind: URL},
+	{Name: "JOB_WORKERS", Kind: Count},
+
+	// Retention and integrity
+	{Name: "TRASH_RETENTION_DAYS", Kind: Int},
+	{Name: "ACCOUNT_RETENTION_DAYS", Kind: Int},
+	{Name: "ACCOUNT_DELETION_GRACE_DAYS", Kind: Int},
+	{Name: "INTEGRITY_CHECK_MODE"},
+	{Name: "INTEGRITY_SAMPLE_SIZE", Kind: Count},
+	{Name: "INTEGRITY_ALERT_EMAILS"},
+
+	// Accounts and sign-in
+	{Name: "ADMIN_EMAILS"},
+	{Name: "PASSWORD_HASHER"},
+	{Name: "PASSWORD_HASH_MEMORY", Kind: Count},
+	{Name: "PASSWORD_HASH_ITERATIONS", Kind: Count},
+	{Name: "PASSWORD_HASH_PARALLELISM", Kind: Count},
+	{Name: "LOGIN_BACKOFF_AFTER", Kind: Count},
+	{Name: "LOGIN_LOCKOUT_AFTER", Kind: Count},
+	{Name: "LOGIN_IP_LOCKOUT_AFTER", Kind: Count},
+	{Name: "LOGIN_LOCKOUT_DURATION", Kind: Duration},
+	{Name: "TOTP_ISSUER"},
+	{Name: "CAPTCHA_SECRET", Secret: true},
+	{Name: "CAPTCHA_VERIFY_URL", Kind: URL},
+	{Name: "OAUTH_REDIRECT_BASE_URL", Kind: URL},
+	{Name: "GOOGLE_CLIENT_ID"},
+	{Name: "GOOGLE_CLIENT_SECRET", Secret: true},
+	{Name: "GITHUB_CLIENT_ID"},
+	{Name: "GITHUB_CLIENT_SECRET", Secret: true},
+	{Name: "TERMS_VERSION"},
+	{Name: "TERMS_URL", Kind: URL},
+	{Name: "PRIVACY_VERSION"},
+	{Name: "PRIVACY_URL", Kind: URL},
+
+	// Email
+	{Name: "SMTP_HOST"},
+	{Name: "SMTP_PORT", Kind: Port},
+	{Name: "SMTP_USERNAME"},
+	{Name: "SMTP_PASSWORD", Secret: true},
+	{Name: "SMTP_FROM"},
+
+	// QR codes and projects
+	{Name: "QR_REDIRECT_BASE_URL", Kind: URL},
+	{Name: "DEMO_QR_WATERMARK"},
+	{Name: "GEOIP_DB_PATH"},
+	{Name: "TRANSLATIONS_DIR"},
+	{Name: "LOC_SKIP_COMMENTS", Kind: Bool},
+
+	// Search
+	{Name: "SEARCH_BACKEND"},
+	{Name: "SEARCH_LANGUAGE"},
+	{Name: "SEARCH_INDEX_PATH"},
+	{Name: "SEARCH_DATABASE_URL", Kind: URL},
+	{Name: "ELASTICSEARCH_URL", Kind: URL},
+	{Name: "ELASTICSEARCH_INDEX"},
+	{Name: "ELASTICSEARCH_USERNAME"},
+	{Name: "ELASTICSEARCH_PASSWORD", Secret: true},
+	{Name: "ELASTICSEARCH_API_KEY", Secret: true},
+	{Name: "EMBEDDINGS_PROVIDER"},
+	{Name: "EMBEDDINGS_BASE_URL", Kind: URL},
+	{Name: "EMBEDDINGS_MODEL"},
+	{Name: "EMBEDDINGS_DIMENSIONS", Kind: Count},
+	{Name: "EMBEDDINGS_API_KEY", Secret: true},
+	{Name: "VECTOR_STORE"},
+	{Name: "VECTOR_INDEX_PATH"},
+	{Name: "PGVECTOR_URL", Kind: URL},
+
+	// Integrations
+	{Name: "LLM_PROVIDER"},
+	{Name: "LLM_BASE_URL", Kind: URL},
+	{Name: "LLM_MODEL"},
+	{Name: "LLM_API_KEY", Secret: true},
+	{Name: "OCR_PROVIDER"},
+	{Name: "OCR_SERVICE_URL", Kind: URL},
+	{Name: "OCR_SERVICE_API_KEY", Secret: true},
+	{Name: "OCR_TESSERACT_PATH"},
+	{Name: "OCR_LANGUAGES"},
+	{Name: "SANDBOX_PROVIDER"},
+	{Name: "SANDBOX_RUNTIME"},
+	{Name: "SANDBOX_SERVICE_URL", Kind: URL},
+	{Name: "SANDBOX_SERVICE_API_KEY", Secret: true},
+	{Name: "SANDBOX_DOCKER_PATH"},
+	{Name: "SANDBOX_MAX_CONCURRENT", Kind: Count},
+	{Name: "ANALYTICS_BACKEND"},
+	{Name: "CLICKHOUSE_URL", Kind: URL},
+	{Name: "CLICKHOUSE_DATABASE"},
+	{Name: "CLICKHOUSE_USERNAME"},
+	{Name: "CLICKHOUSE_PASSWORD", Secret: true},
+	{Name: "WAREHOUSE_EXPORT_URL"},
+	{Name: "EVENT_SINK"},
+	{Name: "KAFKA_BROKERS"},
+	{Name: "KAFKA_TOPIC_PREFIX"},
+	{Name: "KAFKA_USERNAME"},
+	{Name: "KAFKA_PASSWORD", Secret: true},
+	{Name: "KAFKA_TLS", Kind: Bool},
+}
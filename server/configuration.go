@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"backup-manager/config"
+)
+
+// loadConfiguration reads the settings file given by --config, or
+// CONFIG_FILE, sets up logging from it and checks every setting, exiting
+// on any problem. The effective settings are logged with secrets redacted;
+// --print-config prints them and exits instead.
+func loadConfiguration() {
+	path := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML `file` of settings, which the environment overrides")
+	printOnly := flag.Bool("print-config", false, "print the effective settings, secrets redacted, and exit")
+	flag.Parse()
+
+	var loadErr error
+	if *path != "" {
+		loadErr = config.Load(*path)
+	}
+	initLogging()
+	if loadErr != nil {
+		fatal("Error loading configuration", "error", loadErr)
+	}
+
+	invalid := config.Validate()
+	if *printOnly {
+		printSettings(os.Stdout)
+		if invalid != nil {
+			fmt.Fprintf(os.Stderr, "\nProblems:\n  %s\n", strings.ReplaceAll(invalid.Error(), "\n", "\n  "))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if invalid != nil {
+		fatal("Invalid configuration", "problems", strings.Split(invalid.Error(), "\n"))
+	}
+
+	var attrs []any
+	for _, e := range config.Summary() {
+		attrs = append(attrs, slog.String(e.Name, e.Value))
+	}
+	slog.Info("Configuration loaded", "file", config.Path(), slog.Group("settings", attrs...))
+}
+
+func printSettings(w io.Writer) {
+	if p := config.Path(); p != "" {
+		fmt.Fprintf(w, "Settings from %s and the environment:\n\n", p)
+	} else {
+		fmt.Fprint(w, "Settings from the environment:\n\n")
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, e := range config.Summary() {
+		fmt.Fprintf(tw, "%s\t%s\t(%s)\n", e.Name, e.Value, e.Source)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+)
+
+// Kinds of connector. No AI provider offers an API to fetch exports, so a
+// connector either polls a URL an export is published at, such as a cloud
+// drive share link, or watches a WebDAV folder (Nextcloud, ownCloud, Box
+// and most other drives) that exports are saved to.
+const (
+	connectorURL    = "url"
+	connectorWebDAV = "webdav"
+
+	connectorStatusIdle      = "idle"
+	connectorStatusRunning   = storage.ConnectorRunning
+	connectorStatusSucceeded = "succeeded"
+	connectorStatusFailed    = "failed"
+	// The owner's data key is locked, so nothing can be encrypted until
+	// they log in again
+	connectorStatusWaiting = "waiting_for_data_key"
+
+	defaultConnectorInterval   = 6 * time.Hour
+	minConnectorInterval       = 15 * time.Minute
+	maxConnectorInterval       = 7 * 24 * time.Hour
+	connectorSchedulerInterval = time.Minute
+	connectorSchedulerBatch    = 100
+	connectorTimeout           = 30 * time.Minute
+	// connectorLease is how long a run holds its connector; one not
+	// finished by then had its job failed by the sweep, see jobTimeout
+	connectorLease           = jobTimeout
+	maxConnectorFilesPerRun  = 20
+	maxConnectorRuns         = 10 // kept per connector
+	maxConnectorListingBytes = 4 << 20
+	maxConnectorErrorLength  = 500
+)
+
+var (
+	errPrivateAddress   = errors.New("private addresses can't be reached")
+	errConnectorRunning = errors.New("Connector is already running")
+)
+
+// Connector fetches new exports for a user on a schedule and backs them
+// up: chat exports are imported a conversation at a time, anything else
+// is saved as the next version of a backup.
+type Connector = storage.Connector
+
+// ConnectorRun is one scheduled or requested fetch.
+type ConnectorRun = storage.ConnectorRun
+
+func connectorInterval(c Connector) time.Duration {
+	return time.Duration(c.IntervalMinutes) * time.Minute
+}
+
+// connectorClient refuses to connect to the server's own network in
+// production, since what it fetches is handed back to the user. Checking
+// each connection rather than the URL covers redirects and DNS changes.
+var connectorClient = &http.Client{
+	Timeout: connectorTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: connectorDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+func connectorDialControl(network, address string, _ syscall.RawConn) error {
+	if config.Get("ENV") != "production" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateAddress(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// privateAddress reports whether ip is on the server's own network rather
+// than the internet.
+func privateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// connectorRunPayload names the run a connector.run job is for, so a run
+// queued twice, or taken over after its lease ran out, is done once.
+type connectorRunPayload struct {
+	ConnectorID string    `json:"connector_id"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+// startConnector marks the connector running and queues its run. Until the
+// run finishes its next run is a lease, so a run whose server went away is
+// started again by the scheduler. It returns errConnectorRunning if another
+// run holds the lease.
+func startConnector(ctx context.Context, c Connector) (Connector, error) {
+	now := time.Now()
+	if c.Status == connectorStatusRunning && len(c.RecentRuns) > 0 {
+		c.RecentRuns[0].Status = connectorStatusFailed
+		c.RecentRuns[0].Error = "The run was interrupted"
+	}
+	lease := now.Add(connectorLease)
+	c.Status = connectorStatusRunning
+	c.NextRunAt = &lease
+	c.RecentRuns = append([]ConnectorRun{{StartedAt: now, Status: connectorStatusRunning}}, c.RecentRuns...)
+	if len(c.RecentRuns) > maxConnectorRuns {
+		c.RecentRuns = c.RecentRuns[:maxConnectorRuns]
+	}
+	err := db.Connectors().Start(ctx, c, now)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c, errConnectorRunning
+	}
+	if err != nil {
+		return c, err
+	}
+
+	payload := connectorRunPayload{ConnectorID: c.ID, StartedAt: c.RecentRuns[0].StartedAt}
+	if _, err := enqueueJob(ctx, c.UserID, jobConnectorRun, payload); err != nil {
+		// Fail the run rather than leave it holding the lease
+		finishConnectorRun(ctx, c, ConnectorRun{
+			StartedAt: now,
+			Status:    connectorStatusFailed,
+			Error:     "The run couldn't be queued",
+		})
+		return c, err
+	}
+	progress.publish(c.UserID, connectorProgress(c))
+	return c, nil
+}
+
+// finishConnectorRun records run as c's latest and schedules the next.
+func finishConnectorRun(ctx context.Context, c Connector, run ConnectorRun) Connector {
+	now := time.Now()
+	next := now.Add(connectorInterval(c))
+	run.FinishedAt = &now
+	c.Status = run.Status
+	c.LastError = run.Error
+	c.LastRunAt = &now
+	if run.Status == connectorStatusSucceeded {
+		c.LastSuccessAt = &now
+	}
+	c.NextRunAt = &next
+	c.FilesFetched += run.FilesFetched
+	c.BackupsCreated += run.BackupsCreated
+	c.ImportsQueued += run.ImportsQueued
+	if len(c.RecentRuns) > 0 {
+		c.RecentRuns[0] = run
+	}
+	if err := db.Connectors().Finish(ctx, c); err != nil {
+		slog.Error("Error saving connector run", "connector_id", c.ID, "error", err)
+	}
+	progress.publish(c.UserID, connectorProgress(c))
+	return c
+}
+
+// Scheduler
+
+// queueDueConnectors starts every enabled connector whose next run, or
+// lease, is due.
+func queueDueConnectors() {
+	ctx := context.Background()
+
+	due, err := db.Connectors().ListDue(ctx, time.Now(), connectorSchedulerBatch)
+	if err != nil {
+		slog.Error("Error listing due connectors", "error", err)
+		return
+	}
+	for _, c := range due {
+		// errConnectorRunning means another server started it
+		if _, err := startConnector(ctx, c); err != nil && !errors.Is(err, errConnectorRunning) {
+			slog.Error("Error starting connector", "connector_id", c.ID, "error", err)
+		}
+	}
+}
+
+// runConnectorJob does a connector's run. A failed run isn't a failed job:
+// the connector keeps its own status.
+func runConnectorJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload connectorRunPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	c, err := db.Connectors().Get(ctx, "", payload.ConnectorID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Status != connectorStatusRunning || len(c.RecentRuns) == 0 || !c.RecentRuns[0].StartedAt.Equal(payload.StartedAt) {
+		// Queued twice, or its lease ran out and a later run took over
+		return nil, nil
+	}
+	if c.Secret != "" {
+		if c.Secret, err = decrypt(c.Secret); err != nil {
+			return nil, err
+		}
+	}
+	run := runConnector(ctx, c)
+
+	// Settings changed during the run apply from the next
+	latest, err := db.Connectors().Get(ctx, "", c.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	finishConnectorRun(ctx, latest, run)
+	if run.Status == connectorStatusFailed {
+		slog.Error("Connector run failed", "connector_id", c.ID, "error", run.Error)
+	}
+	if run.BackupsCreated > 0 || run.ImportsQueued > 0 {
+		publishEvent("connector.fetched", c.UserID, "connector", c.ID, map[string]interface{}{
+			"backups_created": run.BackupsCreated,
+			"imports_queued":  run.ImportsQueued,
+		})
+	}
+	return nil, nil
+}
+
+// remoteFile is a file a connector can fetch.
+type remoteFile struct {
+	URL  string
+	Name string
+	// Set by a folder listing, so unchanged files aren't downloaded
+	ETag         string
+	LastModified string
+}
+
+// runConnector fetches whatever is new at the connector's source and backs
+// it up, with the owner's key as an upload would be. c.Secret is decrypted.
+func runConnector(ctx context.Context, c Connector) ConnectorRun {
+	run := ConnectorRun{StartedAt: time.Now()}
+	if len(c.RecentRuns) > 0 {
+		run.StartedAt = c.RecentRuns[0].StartedAt
+	}
+
+	key, keyVersion, err := uploadKey(ctx, c.UserID)
+	if errors.Is(err, errDataKeyLocked) {
+		run.Status = connectorStatusWaiting
+		run.Error = "Your data key is locked; log in again to resume fetching"
+		return run
+	}
+	if err == nil {
+		err = fetchConnectorFiles(ctx, c, key, keyVersion, &run)
+	}
+	if err != nil {
+		run.Status = connectorStatusFailed
+		run.Error = truncate(err.Error(), maxConnectorErrorLength)
+		return run
+	}
+	run.Status = connectorStatusSucceeded
+	return run
+}
+
+func fetchConnectorFiles(ctx context.Context, c Connector, key []byte, keyVersion int, run *ConnectorRun) error {
+	var files []remoteFile
+	switch c.Type {
+	case connectorURL:
+		files = []remoteFile{{URL: c.URL}}
+	case connectorWebDAV:
+		var err error
+		if files, err = listWebDAVFolder(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		seen := c.Seen[f.URL]
+		if (f.ETag != "" && f.ETag == seen.ETag) || (f.LastModified != "" && f.LastModified == seen.LastModified) {
+			continue
+		}
+		if run.FilesFetched == maxConnectorFilesPerRun {
+			// The rest are fetched on the next run
+			break
+		}
+		if err := fetchConnectorFile(ctx, c, f, seen, key, keyVersion, run); err != nil {
+			return fmt.Errorf("fetching %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// fetchConnectorFile downloads f, unless it hasn't changed since seen, and
+// backs it up.
+func fetchConnectorFile(ctx context.Context, c Connector, f remoteFile, seen storage.ConnectorSeen, key []byte, keyVersion int, run *ConnectorRun) error {
+	req, err := connectorRequest(ctx, c, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return err
+	}
+	if seen.ETag != "" {
+		req.Header.Set("If-None-Match", seen.ETag)
+	}
+	if seen.LastModified != "" {
+		req.Header.Set("If-Modified-Since", seen.LastModified)
+	}
+	resp, err := connectorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	path, err := spoolImport(resp.Body)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	now := storage.ConnectorSeen{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if now.Checksum, err = fileChecksum(path); err != nil {
+		return err
+	}
+	markSeen := func() {
+		c.Seen[f.URL] = now
+		if err := db.Connectors().SetSeen(ctx, c.ID, c.Seen); err != nil {
+			slog.Error("Error saving connector's fetched files", "connector_id", c.ID, "error", err)
+		}
+	}
+	run.FilesFetched++
+	if now.Checksum == seen.Checksum {
+		markSeen()
+		return nil
+	}
+
+	if format := detectImportFormat(path); format != "" {
+		imp := ChatImport{
+			ID:          generateID(),
+			UserID:      c.UserID,
+			Format:      format,
+			Status:      importStatusPending,
+			RequestedAt: time.Now(),
+			Actor:       systemActor,
+			KeyVersion:  keyVersion,
+		}
+		if _, err := queueChatImport(ctx, imp, path, key); err != nil {
+			return err
+		}
+		run.ImportsQueued++
+		markSeen()
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	name := f.Name
+	if name == "" {
+		name = connectorFileName(resp, c)
+	}
+	if _, _, err := saveBackupFile(ctx, systemActor, c.UserID, name, file, key, keyVersion,
+		map[string]interface{}{"connector_id": c.ID}); err != nil {
+		return err
+	}
+	run.BackupsCreated++
+	markSeen()
+	return nil
+}
+
+func connectorRequest(ctx context.Context, c Connector, method, target string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.Type == connectorWebDAV && (c.Username != "" || c.Secret != ""):
+		req.SetBasicAuth(c.Username, c.Secret)
+	case c.Secret != "":
+		req.Header.Set("Authorization", "Bearer "+c.Secret)
+	}
+	return req, nil
+}
+
+// connectorFileName names a file fetched from a URL by what the server
+// calls it, the end of its path or, failing both, the connector.
+func connectorFileName(resp *http.Response, c Connector) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return c.Name
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// davMultistatus is the part of a PROPFIND response read.
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ETag         string `xml:"getetag"`
+				LastModified string `xml:"getlastmodified"`
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/><d:getlastmodified/><d:resourcetype/></d:prop></d:propfind>`
+
+// listWebDAVFolder lists the files directly in the connector's folder.
+func listWebDAVFolder(ctx context.Context, c Connector) ([]remoteFile, error) {
+	folder, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(folder.Path, "/") {
+		folder.Path += "/"
+	}
+	req, err := connectorRequest(ctx, c, "PROPFIND", folder.String(), strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := connectorClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("listing the folder: server returned %s", resp.Status)
+	}
+
+	var listing davMultistatus
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxConnectorListingBytes)).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("listing the folder: %w", err)
+	}
+	files := []remoteFile{}
+	for _, r := range listing.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		target := folder.ResolveReference(href)
+		if strings.TrimSuffix(target.Path, "/") == strings.TrimSuffix(folder.Path, "/") {
+			continue
+		}
+		f := remoteFile{URL: target.String(), Name: path.Base(target.Path)}
+		collection := false
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			f.ETag = ps.Prop.ETag
+			f.LastModified = ps.Prop.LastModified
+			collection = ps.Prop.ResourceType.Collection != nil
+		}
+		if !collection {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].URL < files[j].URL })
+	return files, nil
+}
+
+// validConnectorURL holds connectors to the rule webhooks follow.
+func validConnectorURL(raw string) bool {
+	return validWebhookURL(raw)
+}
+
+// Handlers
+
+type connectorRequestBody struct {
+	Type            string `json:"type" validate:"oneof=url webdav"`
+	Name            string `json:"name" validate:"max=100"`
+	URL             string `json:"url" validate:"max=2048"`
+	Username        string `json:"username" validate:"max=256"`
+	Password        string `json:"password" validate:"max=1024"`
+	Token           string `json:"token" validate:"max=4096"`
+	IntervalMinutes int    `json:"interval_minutes"`
+	Enabled         *bool  `json:"enabled"`
+}
+
+func validConnectorInterval(minutes int) bool {
+	interval := time.Duration(minutes) * time.Minute
+	return interval >= minConnectorInterval && interval <= maxConnectorInterval
+}
+
+var connectorIntervalError = fmt.Sprintf("interval_minutes must be between %d and %d",
+	int(minConnectorInterval.Minutes()), int(maxConnectorInterval.Minutes()))
+
+// createConnectorHandler connects a source. Its first fetch runs straight
+// away.
+func createConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req connectorRequestBody
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Type == "" {
+		writeFieldError(w, "type", "required", "type is required")
+		return
+	}
+	if !validConnectorURL(req.URL) {
+		writeFieldError(w, "url", "https", "url must be an absolute https URL")
+		return
+	}
+	if req.IntervalMinutes == 0 {
+		req.IntervalMinutes = int(defaultConnectorInterval.Minutes())
+	}
+	if !validConnectorInterval(req.IntervalMinutes) {
+		writeFieldError(w, "interval_minutes", "range", connectorIntervalError)
+		return
+	}
+	secret := req.Token
+	if req.Type == connectorWebDAV {
+		secret = req.Password
+	}
+	if req.Name == "" {
+		u, _ := url.Parse(req.URL)
+		req.Name = u.Host
+	}
+
+	if secret != "" {
+		var err error
+		if secret, err = encrypt(secret); err != nil {
+			http.Error(w, "Error saving connector", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	now := time.Now()
+	c := Connector{
+		ID:              generateID(),
+		UserID:          userID,
+		Type:            req.Type,
+		Name:            truncate(req.Name, 100),
+		URL:             req.URL,
+		Username:        req.Username,
+		HasSecret:       secret != "",
+		IntervalMinutes: req.IntervalMinutes,
+		Enabled:         req.Enabled == nil || *req.Enabled,
+		Status:          connectorStatusIdle,
+		NextRunAt:       &now,
+		RecentRuns:      []ConnectorRun{},
+		CreatedAt:       now,
+		Secret:          secret,
+		Seen:            map[string]storage.ConnectorSeen{},
+	}
+	if err := db.Connectors().Create(r.Context(), c); err != nil {
+		writeStorageError(w, r, err, "Connector")
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "connector.created",
+		ResourceType: "connector",
+		ResourceID:   c.ID,
+		Metadata:     map[string]interface{}{"type": c.Type},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func getConnectorsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := db.Connectors().List(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Connectors")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func getConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	c, err := db.Connectors().Get(r.Context(), userID, mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Connector")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// updateConnectorHandler changes the fields given. A new URL starts over,
+// fetching everything there as new; a new password or token replaces the
+// old one.
+func updateConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req connectorRequestBody
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.URL != "" && !validConnectorURL(req.URL) {
+		writeFieldError(w, "url", "https", "url must be an absolute https URL")
+		return
+	}
+	if req.IntervalMinutes != 0 && !validConnectorInterval(req.IntervalMinutes) {
+		writeFieldError(w, "interval_minutes", "range", connectorIntervalError)
+		return
+	}
+
+	c, err := db.Connectors().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Connector")
+		return
+	}
+	if req.Name != "" {
+		c.Name = truncate(req.Name, 100)
+	}
+	newURL := req.URL != "" && req.URL != c.URL
+	if newURL {
+		c.URL = req.URL
+		c.Seen = map[string]storage.ConnectorSeen{}
+	}
+	if req.Username != "" {
+		c.Username = req.Username
+	}
+	secret := req.Token
+	if c.Type == connectorWebDAV {
+		secret = req.Password
+	}
+	if secret != "" {
+		if c.Secret, err = encrypt(secret); err != nil {
+			http.Error(w, "Error saving connector", http.StatusInternalServerError)
+			return
+		}
+		c.HasSecret = true
+	}
+	newInterval := req.IntervalMinutes != 0 && req.IntervalMinutes != c.IntervalMinutes
+	if newInterval {
+		c.IntervalMinutes = req.IntervalMinutes
+	}
+	if req.Enabled != nil {
+		c.Enabled = *req.Enabled
+	}
+	if err := db.Connectors().Update(r.Context(), c); err != nil {
+		writeStorageError(w, r, err, "Connector")
+		return
+	}
+	if newURL {
+		if err := db.Connectors().SetSeen(r.Context(), c.ID, c.Seen); err != nil {
+			writeStorageError(w, r, err, "Connector")
+			return
+		}
+	}
+	// A running connector is scheduled by the new interval when it
+	// finishes
+	if newInterval && c.LastRunAt != nil {
+		next := c.LastRunAt.Add(connectorInterval(c))
+		err := db.Connectors().Reschedule(r.Context(), userID, id, next)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			writeStorageError(w, r, err, "Connector")
+			return
+		}
+		if err == nil {
+			c.NextRunAt = &next
+		}
+	}
+
+	recordAudit(r, AuditEvent{Action: "connector.updated", ResourceType: "connector", ResourceID: id})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// deleteConnectorHandler stops fetching. Backups it already made are kept.
+func deleteConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if err := db.Connectors().Delete(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Connector")
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "connector.deleted", ResourceType: "connector", ResourceID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runConnectorHandler fetches now rather than waiting for the schedule.
+func runConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	c, err := db.Connectors().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Connector")
+		return
+	}
+	c, err = startConnector(r.Context(), c)
+	if errors.Is(err, errConnectorRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeEnqueueError(w, r, err)
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "connector.run_requested", ResourceType: "connector", ResourceID: id})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/handlers"
+
+	"backup-manager/config"
+)
+
+// devCORSOrigins are allowed outside production, for the frontend's dev
+// servers: the docker-compose frontend and apps/web's next dev.
+var devCORSOrigins = []string{
+	"http://localhost:3000",
+	"http://127.0.0.1:3000",
+	"http://localhost:8888",
+	"http://127.0.0.1:8888",
+}
+
+// originPattern is an origin browsers may call the API from. A host of
+// "*.example.com" matches any subdomain of example.com, at any depth, but
+// not example.com itself.
+type originPattern struct {
+	scheme string
+	host   string
+	port   string
+	// wildcard is set when host is the parent domain of "*."
+	wildcard bool
+}
+
+// parseOriginPattern reads an origin as scheme://host[:port], with nothing
+// after it, allowing "*." before the host.
+func parseOriginPattern(s string) (originPattern, error) {
+	if s == "*" {
+		return originPattern{}, fmt.Errorf("%q would let any site use logged-in users' credentials; list the origins", s)
+	}
+	raw := s
+	wildcard := false
+	if scheme, rest, ok := strings.Cut(s, "://*."); ok {
+		raw, wildcard = scheme+"://"+rest, true
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return originPattern{}, fmt.Errorf("%q is not an http or https origin", s)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return originPattern{}, fmt.Errorf("%q has more than a scheme, host and port", s)
+	}
+	if strings.Contains(u.Hostname(), "*") {
+		return originPattern{}, fmt.Errorf("%q can only have a wildcard as its first label, as in https://*.example.com", s)
+	}
+	if wildcard && !strings.Contains(u.Hostname(), ".") {
+		return originPattern{}, fmt.Errorf("%q would match every subdomain of a top-level domain", s)
+	}
+	return originPattern{scheme: u.Scheme, host: strings.ToLower(u.Hostname()), port: u.Port(), wildcard: wildcard}, nil
+}
+
+func (p originPattern) matches(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != p.scheme || u.Port() != p.port {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+// corsOrigins reads the origins allowed to call the API from a browser:
+// CORS_ALLOWED_ORIGINS, a comma-separated list, or else FRONTEND_URL's
+// origin. Outside production the frontend's dev servers are added.
+func corsOrigins() ([]originPattern, error) {
+	list := config.Get("CORS_ALLOWED_ORIGINS")
+	if list == "" {
+		if u, err := url.Parse(config.Get("FRONTEND_URL")); err == nil && u.Host != "" {
+			list = u.Scheme + "://" + u.Host
+		}
+	}
+	origins := strings.Split(list, ",")
+	if config.Get("ENV") != "production" {
+		origins = append(origins, devCORSOrigins...)
+	}
+
+	var patterns []originPattern
+	for _, o := range origins {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		}
+		p, err := parseOriginPattern(o)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+var corsAllowedOrigins []originPattern
+
+func initCORS() {
+	origins, err := corsOrigins()
+	if err != nil {
+		fatal("Invalid CORS origin", "error", err)
+	}
+	corsAllowedOrigins = origins
+}
+
+// newCORSHandler lets the allowed origins call h with credentials.
+func newCORSHandler(h http.Handler) http.Handler {
+	allowed := func(origin string) bool {
+		for _, p := range corsAllowedOrigins {
+			if p.matches(origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	cors := handlers.CORS(
+		handlers.AllowedOriginValidator(allowed),
+		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "X-API-Key", "X-Request-ID", "X-Team-ID",
+			"If-Match", "If-None-Match", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"}),
+		handlers.ExposedHeaders([]string{"X-Request-ID", "ETag", "Location", "Tus-Resumable", "Tus-Version",
+			"Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Expires"}),
+		handlers.AllowCredentials(),
+	)(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Which origin is allowed back depends on the request's
+		w.Header().Add("Vary", "Origin")
+		// An OPTIONS that isn't a preflight, such as a tus client asking
+		// what the server supports, is the router's to answer
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cors.ServeHTTP(w, r)
+	})
+}
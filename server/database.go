@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+	"backup-manager/store"
+)
+
+const replicaCheckInterval = 15 * time.Second
+
+var db storage.Repository
+
+// initDatabase opens DATABASE_URL, a postgres:// connection string or
+// sqlite:<path>, defaulting to SQLite in the temp directory, and migrates it.
+// With PostgreSQL, DATABASE_REPLICA_URLS is a comma-separated list of read
+// replicas; DATABASE_MAX_REPLICA_LAG and DATABASE_STICKY_WINDOW are
+// durations such as "10s".
+func initDatabase() {
+	cfg := storage.Config{URL: config.Get("DATABASE_URL")}
+	if cfg.URL == "" {
+		cfg.URL = "sqlite:" + filepath.Join(os.TempDir(), "backup-manager.db")
+	}
+	for _, dsn := range strings.Split(config.Get("DATABASE_REPLICA_URLS"), ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			cfg.ReplicaURLs = append(cfg.ReplicaURLs, dsn)
+		}
+	}
+	if v := config.Get("DATABASE_MAX_REPLICA_LAG"); v != "" {
+		lag, err := time.ParseDuration(v)
+		if err != nil {
+			fatal("Invalid DATABASE_MAX_REPLICA_LAG", "error", err)
+		}
+		cfg.MaxReplicaLag = lag
+	}
+	if v := config.Get("DATABASE_STICKY_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil {
+			fatal("Invalid DATABASE_STICKY_WINDOW", "error", err)
+		}
+		cfg.StickyWindow = window
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	opened, err := storage.Open(ctx, cfg)
+	if err != nil {
+		fatal("Error opening database", "error", err)
+	}
+	if err := opened.Migrate(ctx); err != nil {
+		fatal("Error migrating database", "error", err)
+	}
+	db = opened
+	slog.Info("Database open", "replicas", len(cfg.ReplicaURLs))
+}
+
+// writeStorageError answers a failed repository call: 404 for a record
+// that is missing or not the caller's, 500 otherwise.
+func writeStorageError(w http.ResponseWriter, r *http.Request, err error, what string) {
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, what+" not found", http.StatusNotFound)
+		return
+	}
+	logger(r.Context()).Error("Database error", "loading", strings.ToLower(what), "error", err)
+	writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+}
+
+type replicated interface {
+	Replicas() []store.ReplicaStatus
+	CheckReplicas(ctx context.Context)
+}
+
+func checkDatabaseReplicas() {
+	cluster, ok := db.(replicated)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckInterval)
+	defer cancel()
+	cluster.CheckReplicas(ctx)
+}
+
+// Handlers
+func getDatabaseStatusHandler(w http.ResponseWriter, r *http.Request) {
+	replicas := []store.ReplicaStatus{}
+	if cluster, ok := db.(replicated); ok && cluster.Replicas() != nil {
+		replicas = cluster.Replicas()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"replicas": replicas,
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+
+	"backup-manager/config"
+	"backup-manager/qr"
+)
+
+// The demo endpoint makes basic codes without an account, so anyone can try
+// the product before registering. It is limited hard enough that scripting
+// it is less attractive than signing up for an API key.
+const (
+	demoRatePerIP      = 3   // codes per minute per address
+	demoRateGlobal     = 300 // codes per minute across all callers
+	demoMaxContent     = 256 // bytes
+	demoDefaultSize    = 256 // pixels
+	demoMaxSize        = 512
+	demoGlobalLimitKey = "*"
+)
+
+var demoLimiter = newRateLimiter()
+
+// demoWatermark is the caption drawn under demo codes, from DEMO_QR_WATERMARK.
+// Empty means no watermark.
+func demoWatermark() string {
+	return config.Get("DEMO_QR_WATERMARK")
+}
+
+func writeDemoError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, &apiError{Status: status, Code: code, Message: message, Details: map[string]interface{}{
+		"register_url": frontendLink("/register"),
+	}})
+}
+
+// Handlers
+func demoQRHandler(w http.ResponseWriter, r *http.Request) {
+	allowed, remaining, retryAfter := demoLimiter.allow(clientIP(r), demoRatePerIP)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(demoRatePerIP))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if allowed {
+		allowed, _, retryAfter = demoLimiter.allow(demoGlobalLimitKey, demoRateGlobal)
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeDemoError(w, http.StatusTooManyRequests, "rate_limited",
+			"Demo limit reached. Create a free account to generate codes without limits.")
+		return
+	}
+
+	var req struct {
+		Content string `json:"content"`
+		ECLevel string `json:"ec_level"`
+		Size    int    `json:"size"`
+		Format  string `json:"format"` // png or svg
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDemoError(w, http.StatusBadRequest, "invalid_request", "Invalid request")
+		return
+	}
+	if req.Content == "" {
+		writeDemoError(w, http.StatusBadRequest, "invalid_request", "content is required")
+		return
+	}
+	if len(req.Content) > demoMaxContent {
+		writeDemoError(w, http.StatusBadRequest, "content_too_long",
+			"Demo codes hold up to "+strconv.Itoa(demoMaxContent)+" bytes. Create an account for larger codes.")
+		return
+	}
+	level, err := qr.ParseECLevel(req.ECLevel)
+	if err != nil {
+		writeDemoError(w, http.StatusBadRequest, "invalid_request", "ec_level must be L, M, Q or H")
+		return
+	}
+	if req.Size == 0 {
+		req.Size = demoDefaultSize
+	}
+	if req.Size < 0 || req.Size > demoMaxSize {
+		writeDemoError(w, http.StatusBadRequest, "invalid_request", "size must be at most "+strconv.Itoa(demoMaxSize)+" pixels")
+		return
+	}
+	if req.Format != "" && req.Format != "png" && req.Format != "svg" {
+		writeDemoError(w, http.StatusBadRequest, "invalid_request", "format must be png or svg")
+		return
+	}
+
+	code, err := qr.Encode(req.Content, level)
+	if err != nil {
+		writeDemoError(w, http.StatusUnprocessableEntity, "encode_failed", err.Error())
+		return
+	}
+
+	frame := qr.FrameStyle{Template: qr.FrameNone}
+	if text := demoWatermark(); text != "" {
+		frame = qr.FrameStyle{Template: qr.FrameBorder, Text: text, Font: "sans", FrameColor: "#ffffff", TextColor: "#666666"}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Link", "<"+frontendLink("/register")+`>; rel="register"`)
+
+	if req.Format == "svg" {
+		out, err := qr.FrameSVG(code.SVG(qr.QuietZone, "#000000", "#ffffff"), float64(req.Size), frame)
+		if err != nil {
+			logger(r.Context()).Error("Error framing demo QR code", "error", err)
+			writeDemoError(w, http.StatusInternalServerError, "internal_error", "Could not render the code")
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(out))
+		return
+	}
+
+	out, err := qr.DrawFrame(code.Image(req.Size, qr.QuietZone, color.Black, color.White), frame)
+	if err != nil {
+		logger(r.Context()).Error("Error framing demo QR code", "error", err)
+		writeDemoError(w, http.StatusInternalServerError, "internal_error", "Could not render the code")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, out)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backup-manager/storage"
+)
+
+// Aggregates the domain event log covers.
+const (
+	aggregateUser    = "user"
+	aggregateBackup  = "backup"
+	aggregateProject = "project"
+	aggregateQRCode  = "qr_code"
+)
+
+// Who caused a domain event.
+const (
+	actorUser   = "user"
+	actorAPIKey = "api_key"
+	actorSystem = "system"
+)
+
+const (
+	defaultDomainEventPage = 100
+	maxDomainEventPage     = 1000
+)
+
+// DomainActor is who made a change.
+type DomainActor = storage.DomainActor
+
+var systemActor = DomainActor{Type: actorSystem}
+
+// requestActor is the user or API key that sent r.
+func requestActor(r *http.Request) DomainActor {
+	actor := DomainActor{Type: actorUser, UserID: r.Header.Get("X-User-ID")}
+	if keyID := r.Header.Get("X-API-Key-ID"); keyID != "" {
+		actor.Type = actorAPIKey
+		actor.KeyID = keyID
+	}
+	return actor
+}
+
+// DomainEvent is one create, update or delete of a user, backup, project or
+// QR code, as kept in the append-only domain_events table.
+type DomainEvent = storage.DomainEvent
+
+// redactedFields hold user content or secrets. Snapshots replace them with
+// a short hash, which still shows whether they changed.
+var redactedFields = map[string][]string{
+	aggregateBackup:  {"encrypted_data", "content_preview", "title", "summary"},
+	aggregateProject: {"code", "generated_description"},
+	aggregateQRCode:  {"content", "target"},
+}
+
+// snapshot encodes a user, backup, project or QR code for a domain event.
+func snapshot(v interface{}) json.RawMessage {
+	var aggregate string
+	switch v.(type) {
+	case User:
+		aggregate = aggregateUser
+	case Backup:
+		aggregate = aggregateBackup
+	case Project:
+		aggregate = aggregateProject
+	case QRCode:
+		aggregate = aggregateQRCode
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil || len(redactedFields[aggregate]) == 0 {
+		return data
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	for _, name := range redactedFields[aggregate] {
+		if value, ok := fields[name]; ok && value != "" && value != nil {
+			raw, _ := json.Marshal(value)
+			sum := sha256.Sum256(raw)
+			fields[name] = "sha256:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	data, _ = json.Marshal(fields)
+	return data
+}
+
+// recordDomainEvent appends event to the log and then hands it to the event
+// stream and to webhooks, so every subscriber hears about a change from the
+// same place. data is the stream payload; webhooks get it with the
+// aggregate's id added.
+func recordDomainEvent(actor DomainActor, event DomainEvent, data map[string]interface{}) {
+	event.Actor = actor
+	event.ID = generateID()
+	event.OccurredAt = time.Now().UTC()
+	// Subscribers still hear about a change the log failed to keep
+	if _, err := db.DomainEvents().Append(context.Background(), event); err != nil {
+		slog.Error("Error recording domain event", "type", event.Type, "aggregate_id", event.AggregateID, "error", err)
+	}
+
+	publishEvent(event.Type, event.OwnerID, event.AggregateType, event.AggregateID, data)
+
+	if webhookEvents[event.Type] {
+		payload := map[string]interface{}{"id": event.AggregateID}
+		for k, v := range data {
+			payload[k] = v
+		}
+		emitWebhook(event.OwnerID, event.Type, payload)
+	}
+}
+
+// Handlers
+func getDomainEventsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := storage.DomainEventFilter{
+		AggregateType: q.Get("aggregate_type"),
+		AggregateID:   q.Get("aggregate_id"),
+		OwnerID:       q.Get("owner_id"),
+		Limit:         defaultDomainEventPage,
+	}
+	if v := q.Get("after"); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || after < 0 {
+			http.Error(w, "after must be a sequence number", http.StatusBadRequest)
+			return
+		}
+		filter.After = after
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxDomainEventPage {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxDomainEventPage), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := db.DomainEvents().List(r.Context(), filter)
+	if err != nil {
+		writeStorageError(w, r, err, "Domain events")
+		return
+	}
+	resp := map[string]interface{}{"events": events}
+	if len(events) == filter.Limit {
+		// Pass as after to continue
+		resp["next"] = events[len(events)-1].Sequence
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
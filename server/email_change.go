@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"backup-manager/storage"
+)
+
+const emailChangeTTL = 24 * time.Hour
+
+// EmailChange is a pending change of a user's login email; see
+// storage.EmailChange.
+type EmailChange = storage.EmailChange
+
+func generateToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startEmailChange saves a change in place of any pending for the user and
+// returns it with the plaintext tokens for the old and new address.
+func startEmailChange(ctx context.Context, userID, oldEmail, newEmail string) (EmailChange, string, string, error) {
+	oldToken, newToken := generateToken(), generateToken()
+	now := time.Now()
+
+	change := EmailChange{
+		ID:           generateID(),
+		UserID:       userID,
+		OldEmail:     oldEmail,
+		NewEmail:     newEmail,
+		OldTokenHash: hashToken(oldToken),
+		NewTokenHash: hashToken(newToken),
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(emailChangeTTL),
+	}
+	if err := db.EmailChanges().Start(ctx, change); err != nil {
+		return EmailChange{}, "", "", err
+	}
+	return change, oldToken, newToken, nil
+}
+
+// confirmEmailChange marks the side of a change the token was sent to as
+// confirmed. Once both are, the change is deleted and reported complete,
+// to the one caller that deleted it. A token that matches no unexpired
+// change is storage.ErrNotFound.
+func confirmEmailChange(ctx context.Context, token string) (EmailChange, bool, error) {
+	hash := hashToken(token)
+	now := time.Now()
+
+	change, err := db.EmailChanges().ByToken(ctx, hash, now)
+	if err != nil {
+		return EmailChange{}, false, err
+	}
+	isOld := change.OldTokenHash == hash
+	if err := db.EmailChanges().Confirm(ctx, change.ID, isOld, now); err != nil {
+		return EmailChange{}, false, err
+	}
+	if isOld {
+		change.OldConfirmedAt = &now
+	} else {
+		change.NewConfirmedAt = &now
+	}
+	if change.OldConfirmedAt == nil || change.NewConfirmedAt == nil {
+		// The other side may have confirmed since it was read
+		if change, err = db.EmailChanges().ByToken(ctx, hash, now); err != nil {
+			return EmailChange{}, false, err
+		}
+	}
+
+	complete := change.OldConfirmedAt != nil && change.NewConfirmedAt != nil
+	if complete {
+		if err := db.EmailChanges().Delete(ctx, change.ID); err != nil {
+			return EmailChange{}, false, err
+		}
+	}
+	return change, complete, nil
+}
+
+func sendEmailChangeConfirmations(change EmailChange, oldToken, newToken string) error {
+	newLink := frontendLink("/account/email/confirm?token=" + url.QueryEscape(newToken))
+	if err := sendEmail(change.NewEmail, "Confirm your new email address",
+		"Someone asked to use this address for their account.\n\n"+
+			"Confirm the change: "+newLink+"\n\n"+
+			"The link expires in 24 hours. If this wasn't you, ignore this email."); err != nil {
+		return err
+	}
+
+	oldLink := frontendLink("/account/email/confirm?token=" + url.QueryEscape(oldToken))
+	cancelLink := frontendLink("/account/email/cancel?token=" + url.QueryEscape(oldToken))
+	return sendEmail(change.OldEmail, "Confirm your email change",
+		"A request was made to change your login email to "+change.NewEmail+".\n\n"+
+			"Confirm the change: "+oldLink+"\n"+
+			"Not you? Cancel it and secure your account: "+cancelLink+"\n\n"+
+			"This address stays your login and recovery email until the change is confirmed.")
+}
+
+// Handlers
+func requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		NewEmail string `json:"new_email" validate:"required,email"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	user, err := db.Users().Get(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	oldEmail := user.Email
+
+	newEmail := strings.TrimSpace(req.NewEmail)
+	if strings.EqualFold(newEmail, oldEmail) {
+		http.Error(w, "New email must differ from the current one", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Users().GetByEmail(r.Context(), newEmail); err == nil {
+		http.Error(w, "That email address is already in use", http.StatusConflict)
+		return
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+
+	change, oldToken, newToken, err := startEmailChange(r.Context(), userID, oldEmail, newEmail)
+	if err != nil {
+		writeStorageError(w, r, err, "Email change")
+		return
+	}
+	if err := sendEmailChangeConfirmations(change, oldToken, newToken); err != nil {
+		logger(r.Context()).Error("Error sending email change confirmation", "error", err)
+		db.EmailChanges().Cancel(r.Context(), userID)
+		http.Error(w, "Error sending confirmation email", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(change)
+}
+
+func getEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	change, err := db.EmailChanges().Pending(r.Context(), userID, time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "No pending email change", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Email change")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+func cancelEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	err := db.EmailChanges().Cancel(r.Context(), userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "No pending email change", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Email change")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	change, complete, err := confirmEmailChange(r.Context(), req.Token)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Email change")
+		return
+	}
+
+	if complete {
+		if err := db.Users().UpdateEmail(r.Context(), change.UserID, change.NewEmail); err != nil {
+			if errors.Is(err, storage.ErrConflict) {
+				http.Error(w, "That email address is already in use", http.StatusConflict)
+				return
+			}
+			writeStorageError(w, r, err, "User")
+			return
+		}
+
+		recordDomainEvent(DomainActor{Type: actorUser, UserID: change.UserID}, DomainEvent{
+			Type:          "user.email_changed",
+			AggregateType: aggregateUser,
+			AggregateID:   change.UserID,
+			OwnerID:       change.UserID,
+			Before:        snapshot(User{ID: change.UserID, Email: change.OldEmail}),
+			After:         snapshot(User{ID: change.UserID, Email: change.NewEmail}),
+		}, nil)
+
+		logger(r.Context()).Info("User changed email", "user_id", change.UserID)
+		sendEmail(change.OldEmail, "Your email address was changed",
+			"Your login email is now "+change.NewEmail+". If you did not make this change, contact support immediately.")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"complete": complete,
+		"change":   change,
+	})
+}
+
+func cancelEmailChangeByTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	// Only the token sent to the old address can cancel
+	hash := hashToken(req.Token)
+	change, err := db.EmailChanges().ByToken(r.Context(), hash, time.Now())
+	if err == nil && change.OldTokenHash != hash {
+		err = storage.ErrNotFound
+	}
+	if err == nil {
+		err = db.EmailChanges().Delete(r.Context(), change.ID)
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Email change")
+		return
+	}
+
+	logger(r.Context()).Info("Email change cancelled from the old address", "user_id", change.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
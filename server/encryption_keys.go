@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+	"backup-manager/streamcrypt"
+)
+
+const (
+	keyRotationInterval  = 10 * time.Minute
+	keyRotationBatchSize = 100
+	// Ciphertexts without a "v<version>:" tag predate key versions and are
+	// under the first key
+	untaggedKeyVersion = 1
+)
+
+// serverKeyring holds the server's encryption keys. ENCRYPTION_KEY is the
+// current key, used for everything encrypted from now on, and
+// ENCRYPTION_KEY_VERSION its version (1 if unset). Keys it replaced stay
+// readable while they are set as ENCRYPTION_KEY_<version>, which can be
+// removed once the rotation job has moved every backup off them.
+type serverKeyring struct {
+	current int
+	keys    map[int][]byte
+}
+
+var serverKeys *serverKeyring
+
+func loadServerKeys() (*serverKeyring, error) {
+	kr := &serverKeyring{current: 1, keys: map[int][]byte{}}
+	if v := config.Get("ENCRYPTION_KEY_VERSION"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, errors.New("ENCRYPTION_KEY_VERSION must be a positive number")
+		}
+		kr.current = n
+	}
+
+	for name, value := range config.WithPrefix("ENCRYPTION_KEY_") {
+		suffix := strings.TrimPrefix(name, "ENCRYPTION_KEY_")
+		if suffix == "VERSION" {
+			continue
+		}
+		version, err := strconv.Atoi(suffix)
+		if err != nil || version < 1 || value == "" {
+			continue
+		}
+		if version >= kr.current {
+			return nil, fmt.Errorf("%s is not older than ENCRYPTION_KEY_VERSION", name)
+		}
+		kr.keys[version] = []byte(value)
+	}
+	kr.keys[kr.current] = []byte(config.Get("ENCRYPTION_KEY"))
+
+	for version, key := range kr.keys {
+		if len(key) != 32 {
+			if version == kr.current {
+				return nil, errors.New("ENCRYPTION_KEY must be 32 bytes")
+			}
+			return nil, fmt.Errorf("ENCRYPTION_KEY_%d must be 32 bytes", version)
+		}
+	}
+	return kr, nil
+}
+
+func (kr *serverKeyring) versions() []int {
+	versions := make([]int, 0, len(kr.keys))
+	for v := range kr.keys {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// splitKeyVersion separates a ciphertext's key version tag from its body.
+// ok is false for an untagged ciphertext, which is either from before key
+// versions or under a user's data key.
+func splitKeyVersion(ciphertext string) (version int, body string, ok bool) {
+	tag, body, found := strings.Cut(ciphertext, ":")
+	if !found || !strings.HasPrefix(tag, "v") {
+		return 0, ciphertext, false
+	}
+	version, err := strconv.Atoi(tag[1:])
+	if err != nil {
+		return 0, ciphertext, false
+	}
+	return version, body, true
+}
+
+// backupKeyVersion is the KeyVersion to record for a backup's ciphertext.
+func backupKeyVersion(ciphertext string) int {
+	version, _, _ := splitKeyVersion(ciphertext)
+	return version
+}
+
+// KeyRotationRun is one pass of re-encrypting backups under the current key.
+type KeyRotationRun struct {
+	KeyVersion  int        `json:"key_version"`
+	Rotated     int        `json:"rotated"`
+	Skipped     int        `json:"skipped"`
+	Failed      int        `json:"failed"`
+	StartedAt   time.Time  `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type keyRotator struct {
+	mu   sync.Mutex
+	last *KeyRotationRun
+
+	// Only one rotation runs at a time
+	running sync.Mutex
+}
+
+var keyRotation = &keyRotator{}
+
+func runScheduledKeyRotation() {
+	keyRotation.rotate()
+}
+
+// rotate re-encrypts every backup under an older server key with the
+// current one, a batch at a time. It returns false without running if a
+// rotation is already going.
+func (kr *keyRotator) rotate() bool {
+	if !kr.running.TryLock() {
+		return false
+	}
+	defer kr.running.Unlock()
+
+	run := &KeyRotationRun{KeyVersion: serverKeys.current, StartedAt: time.Now()}
+	// Backups that can't be rotated stay behind, so later batches are
+	// fetched past them
+	stuck := map[string]bool{}
+	for {
+		backups, err := db.Backups().ListKeyVersionBelow(context.Background(), serverKeys.current, keyRotationBatchSize+len(stuck))
+		if err != nil {
+			slog.Error("Key rotation: error loading backups", "error", err)
+			break
+		}
+		progressed := false
+		for _, b := range backups {
+			if stuck[b.ID] {
+				continue
+			}
+			progressed = true
+			switch err := rotateBackupKey(b); {
+			case errors.Is(err, errNotServerKey):
+				run.Skipped++
+			case err != nil:
+				slog.Error("Key rotation failed for backup", "backup_id", b.ID, "error", err)
+				run.Failed++
+				stuck[b.ID] = true
+			default:
+				run.Rotated++
+			}
+		}
+		if !progressed {
+			break
+		}
+	}
+
+	now := time.Now()
+	run.CompletedAt = &now
+	kr.mu.Lock()
+	kr.last = run
+	kr.mu.Unlock()
+
+	if run.Rotated > 0 || run.Failed > 0 {
+		slog.Info("Key rotation finished", "key_version", run.KeyVersion,
+			"rotated", run.Rotated, "user_keys", run.Skipped, "failed", run.Failed)
+	}
+	return true
+}
+
+func (kr *keyRotator) lastRun() *KeyRotationRun {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.last == nil {
+		return nil
+	}
+	run := *kr.last
+	return &run
+}
+
+var errNotServerKey = errors.New("backup is under its owner's data key")
+
+// rotateBackupKey re-encrypts b under the current key. Backups still sealed
+// whole or streamed are chunked on the way. One that turns out to
+// be under its owner's data key is marked so and left alone.
+func rotateBackupKey(b Backup) error {
+	ctx := context.Background()
+	stored, err := readBackupBlob(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer stored.Close()
+
+	var plaintext io.Reader
+	br := bufio.NewReader(stored)
+	if head, _ := br.Peek(len(chunkManifestMagic)); isChunkManifest(head) {
+		key, err := backupKey(ctx, b)
+		if err != nil {
+			return err
+		}
+		br.Discard(len(chunkManifestMagic))
+		chunks, err := openChunks(ctx, br, key)
+		if err != nil {
+			return err
+		}
+		// Each chunk is authenticated as it is read, as below
+		defer chunks.Close()
+		plaintext = chunks
+	} else if head, _ := br.Peek(len(streamcrypt.Magic)); streamcrypt.IsStream(head) {
+		key, err := backupKey(ctx, b)
+		if err != nil {
+			return err
+		}
+		// Chunks are authenticated as they are read, and a bad one fails
+		// the write before it replaces the stored copy
+		if plaintext, err = streamcrypt.NewReader(br, key); err != nil {
+			return err
+		}
+	} else {
+		ciphertext, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		text, err := decrypt(string(ciphertext))
+		if err != nil {
+			if _, _, tagged := splitKeyVersion(string(ciphertext)); tagged {
+				return err
+			}
+			b.KeyVersion = 0
+			if err := db.Backups().Update(ctx, b); err != nil {
+				return err
+			}
+			return errNotServerKey
+		}
+		if b.Checksum != "" && backupChecksum(text) != b.Checksum {
+			return errors.New("decrypted content does not match its checksum")
+		}
+		plaintext = strings.NewReader(text)
+	}
+
+	if err := writeBackupBlob(ctx, &b, plaintext, serverKeys.keys[serverKeys.current], serverKeys.current); err != nil {
+		return err
+	}
+	err = db.Backups().Update(ctx, b)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Deleted while it was being rotated; don't leave the new blob behind
+		deleteBackupBlob(ctx, b.UserID, b.ID)
+	}
+	return err
+}
+
+// Handlers
+func getKeyRotationHandler(w http.ResponseWriter, r *http.Request) {
+	counts, err := db.Backups().CountByKeyVersion(r.Context())
+	if err != nil {
+		logger(r.Context()).Error("Error counting backups by key version", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	backups := map[string]int{}
+	pending := 0
+	for version, n := range counts {
+		name := strconv.Itoa(version)
+		if version == 0 {
+			name = "user"
+		}
+		backups[name] = n
+		if version > 0 && version < serverKeys.current {
+			pending += n
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current_version": serverKeys.current,
+		"key_versions":    serverKeys.versions(),
+		"backups":         backups,
+		"pending":         pending,
+		"last_run":        keyRotation.lastRun(),
+	})
+}
+
+// startKeyRotationHandler queues a rotation now rather than waiting for the
+// next scheduled run. Its job's result is the run.
+func startKeyRotationHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := enqueueJob(r.Context(), r.Header.Get("X-User-ID"), jobKeyRotation, struct{}{})
+	if err != nil {
+		writeEnqueueError(w, r, err)
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "encryption_key.rotation_started",
+		ResourceType: "encryption_key",
+		ResourceID:   strconv.Itoa(serverKeys.current),
+		Metadata:     map[string]interface{}{"job_id": job.ID},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      job.Status,
+		"key_version": serverKeys.current,
+		"job_id":      job.ID,
+	})
+}
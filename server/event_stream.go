@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/events"
+)
+
+const (
+	eventQueueSize   = 10000
+	eventBatchSize   = 500
+	eventSendTimeout = 10 * time.Second
+	eventRetries     = 3
+)
+
+var (
+	eventSink  events.Sink = events.Discard{}
+	eventQueue             = make(chan events.Event, eventQueueSize)
+)
+
+// initEventSink connects the event stream selected by EVENT_SINK. It is off
+// by default; "kafka" publishes to KAFKA_BROKERS, a comma-separated list.
+func initEventSink() {
+	switch sink := config.Get("EVENT_SINK"); sink {
+	case "":
+	case "kafka":
+		var brokers []string
+		for _, b := range strings.Split(config.Get("KAFKA_BROKERS"), ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				brokers = append(brokers, b)
+			}
+		}
+		if len(brokers) == 0 {
+			fatal("KAFKA_BROKERS is required when EVENT_SINK is kafka")
+		}
+		prefix := config.Get("KAFKA_TOPIC_PREFIX")
+		if prefix == "" {
+			prefix = "qr"
+		}
+
+		eventSink = events.OpenKafka(&events.Kafka{
+			Brokers:     brokers,
+			TopicPrefix: prefix,
+			Username:    config.Get("KAFKA_USERNAME"),
+			Password:    config.Get("KAFKA_PASSWORD"),
+			TLS:         config.Get("KAFKA_TLS") == "true",
+		})
+		slog.Info("Publishing events to Kafka", "topics", prefix+".*")
+		go runEventPublisher()
+	default:
+		fatal("Unknown EVENT_SINK", "sink", sink)
+	}
+}
+
+// publishEvent queues an event for the stream. It never blocks: the stream
+// is for analytics and must not slow down or fail the request that caused
+// the event, so when the broker falls far enough behind events are dropped.
+func publishEvent(eventType, userID, resourceType, resourceID string, data map[string]interface{}) {
+	if _, off := eventSink.(events.Discard); off {
+		return
+	}
+
+	select {
+	case eventQueue <- events.New(eventType, userID, resourceType, resourceID, data):
+	default:
+		slog.Warn("Event queue full, dropping event", "type", eventType)
+	}
+}
+
+// runEventPublisher sends queued events in batches.
+func runEventPublisher() {
+	for e := range eventQueue {
+		batch := []events.Event{e}
+	drain:
+		for len(batch) < eventBatchSize {
+			select {
+			case next := <-eventQueue:
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+
+		sendEvents(batch)
+	}
+}
+
+func sendEvents(batch []events.Event) {
+	for attempt := 1; attempt <= eventRetries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), eventSendTimeout)
+		err := eventSink.Publish(ctx, batch...)
+		cancel()
+
+		if err == nil {
+			return
+		}
+		slog.Error("Error publishing events", "count", len(batch), "attempt", attempt, "error", err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
@@ -0,0 +1,74 @@
+// Package events publishes scan and domain events to a message broker so
+// data teams can consume them in their own pipelines. The wire format is
+// described in SCHEMA.md; change it only by adding fields, or by bumping
+// SchemaVersion.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// SchemaVersion is sent with every event. Consumers should ignore fields
+// they don't know and reject versions they don't.
+const SchemaVersion = 1
+
+// Event categories. Each is published to its own topic.
+const (
+	CategoryScan   = "scans"
+	CategoryDomain = "domain"
+)
+
+// Event is one thing that happened. Type is "<resource>.<verb>", such as
+// "qr.scanned" or "backup.created".
+type Event struct {
+	ID            string                 `json:"id"`
+	Type          string                 `json:"type"`
+	SchemaVersion int                    `json:"schema_version"`
+	OccurredAt    time.Time              `json:"occurred_at"`
+	UserID        string                 `json:"user_id,omitempty"`
+	ResourceType  string                 `json:"resource_type"`
+	ResourceID    string                 `json:"resource_id"`
+	Data          map[string]interface{} `json:"data,omitempty"`
+}
+
+// New returns an event of the given type that happened now.
+func New(eventType, userID, resourceType, resourceID string, data map[string]interface{}) Event {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return Event{
+		ID:            hex.EncodeToString(id),
+		Type:          eventType,
+		SchemaVersion: SchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		UserID:        userID,
+		ResourceType:  resourceType,
+		ResourceID:    resourceID,
+		Data:          data,
+	}
+}
+
+// Category is the topic family the event belongs to. Scans are far more
+// numerous than everything else, so they get their own topic.
+func (e Event) Category() string {
+	if e.Type == "qr.scanned" {
+		return CategoryScan
+	}
+	return CategoryDomain
+}
+
+// Sink publishes events. Publish returns once the broker has accepted them,
+// so it should be called off the request path. A retried publish can
+// deliver an event twice; consumers de-duplicate on ID.
+type Sink interface {
+	Publish(ctx context.Context, events ...Event) error
+	Close() error
+}
+
+// Discard is the Sink used when no broker is configured.
+type Discard struct{}
+
+func (Discard) Publish(context.Context, ...Event) error { return nil }
+func (Discard) Close() error                            { return nil }
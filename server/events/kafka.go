@@ -0,0 +1,77 @@
+package events
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// Kafka publishes events as JSON to "<TopicPrefix>.scans" and
+// "<TopicPrefix>.domain", keyed by user ID so each user's events stay in
+// order within a partition.
+type Kafka struct {
+	Brokers     []string
+	TopicPrefix string
+	Username    string
+	Password    string
+	TLS         bool
+
+	writer *kafka.Writer
+}
+
+// OpenKafka returns a sink writing to k's brokers. Connections are made on
+// first publish.
+func OpenKafka(k *Kafka) *Kafka {
+	transport := &kafka.Transport{}
+	if k.TLS {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if k.Username != "" {
+		transport.SASL = plain.Mechanism{Username: k.Username, Password: k.Password}
+	}
+
+	k.writer = &kafka.Writer{
+		Addr:         kafka.TCP(k.Brokers...),
+		Balancer:     &kafka.Hash{},
+		BatchSize:    500,
+		BatchTimeout: time.Second,
+		RequiredAcks: kafka.RequireAll,
+		Transport:    transport,
+	}
+	return k
+}
+
+// Topic is the topic an event is published to.
+func (k *Kafka) Topic(e Event) string {
+	return k.TopicPrefix + "." + e.Category()
+}
+
+func (k *Kafka) Publish(ctx context.Context, events ...Event) error {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, e := range events {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, kafka.Message{
+			Topic: k.Topic(e),
+			Key:   []byte(e.UserID),
+			Value: value,
+			Headers: []kafka.Header{
+				{Key: "event_type", Value: []byte(e.Type)},
+				{Key: "schema_version", Value: []byte(strconv.Itoa(SchemaVersion))},
+			},
+		})
+	}
+	return k.writer.WriteMessages(ctx, messages...)
+}
+
+// Close flushes pending messages and closes connections.
+func (k *Kafka) Close() error {
+	return k.writer.Close()
+}
@@ -0,0 +1,168 @@
+package extract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotChatGPT is returned by ReadChatGPT for data that isn't a ChatGPT
+// conversations.json.
+var ErrNotChatGPT = errors.New("extract: not a ChatGPT export")
+
+// chatGPTConversation is one conversation in OpenAI's export. Messages are
+// nodes of a tree, since editing a message or regenerating a reply starts a
+// new branch; CurrentNode is the last message of the branch last shown.
+type chatGPTConversation struct {
+	ID             string                  `json:"id"`
+	ConversationID string                  `json:"conversation_id"`
+	Title          string                  `json:"title"`
+	CreateTime     float64                 `json:"create_time"`
+	CurrentNode    string                  `json:"current_node"`
+	Mapping        map[string]*chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Parent   string          `json:"parent"`
+	Children []string        `json:"children"`
+	Message  *chatGPTMessage `json:"message"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+		// Code interpreter input has its code here instead of in parts
+		Text     string `json:"text"`
+		Language string `json:"language"`
+	} `json:"content"`
+	Metadata struct {
+		Hidden bool `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+// ReadChatGPT reads OpenAI's conversations.json, calling fn with each
+// conversation as it is decoded, so an export of any size takes the memory
+// of one conversation. Each conversation is the branch that was on screen
+// when it was exported, without system and tool messages. An error from fn
+// stops the read and is returned.
+func ReadChatGPT(r io.Reader, fn func(Conversation) error) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return ErrNotChatGPT
+	}
+	for first := true; dec.More(); first = false {
+		var raw chatGPTConversation
+		if err := dec.Decode(&raw); err != nil {
+			if first {
+				return ErrNotChatGPT
+			}
+			return fmt.Errorf("extract: reading ChatGPT export: %w", err)
+		}
+		if raw.Mapping == nil {
+			return ErrNotChatGPT
+		}
+		if err := fn(raw.conversation()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c chatGPTConversation) conversation() Conversation {
+	conv := Conversation{ID: c.ConversationID, Title: strings.TrimSpace(c.Title), CreatedAt: unixTime(c.CreateTime)}
+	if conv.ID == "" {
+		conv.ID = c.ID
+	}
+	for _, id := range c.thread() {
+		node := c.Mapping[id]
+		if node == nil || node.Message == nil || node.Message.Metadata.Hidden {
+			continue
+		}
+		m := node.Message
+		if m.Author.Role != RoleUser && m.Author.Role != RoleAssistant {
+			continue
+		}
+		text := m.text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		conv.Messages = append(conv.Messages, Message{Role: m.Author.Role, Text: text, Time: unixTime(m.CreateTime)})
+	}
+	return conv
+}
+
+// thread returns the IDs of the messages on the current branch, oldest
+// first. Without a current node it follows the newest reply at each step.
+func (c chatGPTConversation) thread() []string {
+	leaf := c.CurrentNode
+	if c.Mapping[leaf] == nil {
+		leaf = ""
+		for id, node := range c.Mapping {
+			if node != nil && (node.Parent == "" || c.Mapping[node.Parent] == nil) {
+				leaf = id
+				break
+			}
+		}
+		for leaf != "" && len(c.Mapping[leaf].Children) > 0 {
+			children := c.Mapping[leaf].Children
+			next := children[len(children)-1]
+			if c.Mapping[next] == nil {
+				break
+			}
+			leaf = next
+		}
+	}
+
+	var ids []string
+	seen := map[string]bool{}
+	for id := leaf; id != "" && !seen[id]; id = c.Mapping[id].Parent {
+		if c.Mapping[id] == nil {
+			break
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids
+}
+
+// text is a message's text. Parts that aren't text, such as images, are
+// left out.
+func (m *chatGPTMessage) text() string {
+	switch m.Content.ContentType {
+	case "text", "multimodal_text":
+		var parts []string
+		for _, raw := range m.Content.Parts {
+			var s string
+			if json.Unmarshal(raw, &s) == nil && s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, "\n\n")
+	case "code":
+		lang := m.Content.Language
+		if lang == "unknown" {
+			lang = ""
+		}
+		return "```" + lang + "\n" + strings.TrimRight(m.Content.Text, "\n") + "\n```"
+	}
+	return ""
+}
+
+func unixTime(sec float64) time.Time {
+	if sec <= 0 {
+		return time.Time{}
+	}
+	whole := int64(sec)
+	return time.Unix(whole, int64((sec-float64(whole))*1e9)).UTC()
+}
@@ -0,0 +1,129 @@
+package extract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotClaude is returned by ReadClaude for data that isn't a Claude
+// conversations.json.
+var ErrNotClaude = errors.New("extract: not a Claude export")
+
+// claudeConversation is one conversation in Anthropic's data export.
+type claudeConversation struct {
+	UUID      string          `json:"uuid"`
+	Name      string          `json:"name"`
+	CreatedAt string          `json:"created_at"`
+	Messages  []claudeMessage `json:"chat_messages"`
+}
+
+type claudeMessage struct {
+	Sender    string `json:"sender"`
+	Text      string `json:"text"`
+	CreatedAt string `json:"created_at"`
+	// Newer exports split a message into blocks, of which only the text
+	// ones are kept; tool calls and their results are left out
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Attachments []struct {
+		FileName         string `json:"file_name"`
+		ExtractedContent string `json:"extracted_content"`
+	} `json:"attachments"`
+}
+
+// ReadClaude reads the conversations.json of a Claude data export, calling
+// fn with each conversation as it is decoded. Attachments the export kept
+// the text of follow their message as code blocks named for the file. An
+// error from fn stops the read and is returned.
+func ReadClaude(r io.Reader, fn func(Conversation) error) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return ErrNotClaude
+	}
+	for first := true; dec.More(); first = false {
+		var raw claudeConversation
+		if err := dec.Decode(&raw); err != nil {
+			if first {
+				return ErrNotClaude
+			}
+			return fmt.Errorf("extract: reading Claude export: %w", err)
+		}
+		// An empty chat_messages decodes to an empty slice, a missing one
+		// to nil
+		if raw.Messages == nil {
+			return ErrNotClaude
+		}
+		if err := fn(raw.conversation()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c claudeConversation) conversation() Conversation {
+	conv := Conversation{ID: c.UUID, Title: strings.TrimSpace(c.Name), CreatedAt: isoTime(c.CreatedAt)}
+	for _, m := range c.Messages {
+		text := strings.TrimSpace(m.text())
+		for _, a := range m.Attachments {
+			if strings.TrimSpace(a.ExtractedContent) != "" {
+				text += "\n\n" + attachmentBlock(a.FileName, a.ExtractedContent)
+			}
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		conv.Messages = append(conv.Messages, Message{
+			Role: normalizeRole(m.Sender),
+			Text: strings.TrimSpace(text),
+			Time: isoTime(m.CreatedAt),
+		})
+	}
+	return conv
+}
+
+func (m claudeMessage) text() string {
+	var parts []string
+	for _, block := range m.Content {
+		if block.Type == "text" && strings.TrimSpace(block.Text) != "" {
+			parts = append(parts, block.Text)
+		}
+	}
+	if len(parts) == 0 {
+		return m.Text
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// attachmentBlock fences an attachment's text, with its language and file
+// name on the fence so CodeBlocks picks both up. Files in no known language
+// are fenced as text, which Projects leaves alone.
+func attachmentBlock(name, content string) string {
+	lang := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if _, ok := languages[lang]; !ok {
+		lang = "text"
+	}
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	info := lang
+	if looksLikeFilename(name) {
+		info += " " + name
+	}
+	return fence + info + "\n" + strings.TrimRight(content, "\n") + "\n" + fence
+}
+
+func isoTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
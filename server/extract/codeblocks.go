@@ -0,0 +1,98 @@
+package extract
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Block is a fenced code block and the prose just before it.
+type Block struct {
+	Language string
+	// Filename is named on the fence, as in ```python app.py
+	Filename string
+	Code     string
+	Before   string
+}
+
+// fence opens or closes a code block: three or more backticks or tildes,
+// with an optional info string on the opening line.
+var fence = regexp.MustCompile("^[ \t]{0,3}(`{3,}|~{3,})[ \t]*([^`]*)$")
+
+// CodeBlocks returns the fenced code blocks in Markdown text. A block left
+// open at the end of the text runs to the end.
+func CodeBlocks(text string) []Block {
+	var (
+		blocks []Block
+		prose  []string
+		code   []string
+		open   string
+		info   string
+	)
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		m := fence.FindStringSubmatch(line)
+		switch {
+		case open == "" && m != nil:
+			open, info, code = m[1], strings.TrimSpace(m[2]), nil
+		case open != "" && m != nil && strings.HasPrefix(m[1], open[:1]) && len(m[1]) >= len(open) && m[2] == "":
+			blocks = append(blocks, newBlock(info, code, prose))
+			open, prose = "", nil
+		case open != "":
+			code = append(code, line)
+		default:
+			prose = append(prose, line)
+		}
+	}
+	if open != "" {
+		blocks = append(blocks, newBlock(info, code, prose))
+	}
+	return blocks
+}
+
+func newBlock(info string, code, prose []string) Block {
+	b := Block{Code: strings.Join(code, "\n"), Before: lastParagraph(prose)}
+	fields := strings.Fields(info)
+	if len(fields) > 0 {
+		// Some tools write the file name into the info string, as
+		// "python app.py", "python:app.py" or "js title=app.js"
+		lang, file, _ := strings.Cut(fields[0], ":")
+		b.Language = lang
+		b.Filename = file
+		for _, f := range fields[1:] {
+			f = strings.Trim(strings.TrimPrefix(strings.TrimPrefix(f, "title="), "filename="), `"'`)
+			if b.Filename == "" && looksLikeFilename(f) {
+				b.Filename = f
+			}
+		}
+	}
+	return b
+}
+
+// lastParagraph is the last non-empty paragraph of lines, on one line.
+func lastParagraph(lines []string) string {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	start := end
+	for start > 0 && strings.TrimSpace(lines[start-1]) != "" {
+		start--
+	}
+	return strings.Join(strings.Fields(strings.Join(lines[start:end], " ")), " ")
+}
+
+var filenamePattern = regexp.MustCompile(`^[\w.-]+(?:/[\w.-]+)*\.[A-Za-z0-9]{1,10}$`)
+
+func looksLikeFilename(s string) bool {
+	return filenamePattern.MatchString(s) && !strings.HasPrefix(s, ".")
+}
+
+// CountLines counts the non-blank lines of code.
+func CountLines(code string) int {
+	n := 0
+	for _, line := range strings.Split(code, "\n") {
+		if strings.TrimSpace(line) != "" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,87 @@
+package extract
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+)
+
+// Export formats an importer reads.
+const (
+	FormatChatGPT = "chatgpt"
+	FormatClaude  = "claude"
+)
+
+// ConversationsFile is the file in an export zip that holds the
+// conversations, in both ChatGPT and Claude exports.
+const ConversationsFile = "conversations.json"
+
+// Readers stream the conversations of an export in each format, calling fn
+// with each one.
+var Readers = map[string]func(r io.Reader, fn func(Conversation) error) error{
+	FormatChatGPT: ReadChatGPT,
+	FormatClaude:  ReadClaude,
+}
+
+// ErrNoConversations is returned by OpenExport for a zip without a
+// conversations file.
+var ErrNoConversations = errors.New("extract: no " + ConversationsFile + " in export")
+
+// OpenExport opens the conversations file of the export at name: the
+// conversations.json inside an export zip, or the file itself when it
+// isn't a zip.
+func OpenExport(name string) (io.ReadCloser, error) {
+	zr, err := zip.OpenReader(name)
+	if errors.Is(err, zip.ErrFormat) {
+		return os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if path.Base(f.Name) != ConversationsFile {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			zr.Close()
+			return nil, err
+		}
+		return &zipEntry{ReadCloser: rc, zr: zr}, nil
+	}
+	zr.Close()
+	return nil, ErrNoConversations
+}
+
+type zipEntry struct {
+	io.ReadCloser
+	zr *zip.ReadCloser
+}
+
+func (e *zipEntry) Close() error {
+	e.ReadCloser.Close()
+	return e.zr.Close()
+}
+
+// Detect names the format of a conversations file from its first
+// conversation, or returns "" for a format it doesn't know.
+func Detect(r io.Reader) string {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return ""
+	}
+	var first map[string]json.RawMessage
+	if err := dec.Decode(&first); err != nil {
+		return ""
+	}
+	switch {
+	case first["mapping"] != nil:
+		return FormatChatGPT
+	case first["chat_messages"] != nil:
+		return FormatClaude
+	}
+	return ""
+}
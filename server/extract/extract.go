@@ -0,0 +1,251 @@
+// Package extract finds the code in AI chat exports and turns it into
+// projects. Parse reads an export into conversations, and Projects picks
+// out the code blocks worth keeping, naming and describing each one from
+// the code itself and the conversation around it.
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Roles a message can have. Exports that don't record one leave it empty.
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleSystem    = "system"
+)
+
+// Message is one turn of a conversation.
+type Message struct {
+	Role string    `json:"role"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time,omitempty"`
+}
+
+// Conversation is one chat from an export. ID is the export's own ID for
+// it, where it has one.
+type Conversation struct {
+	ID        string    `json:"id,omitempty"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	Messages  []Message `json:"messages"`
+}
+
+const (
+	// maxZipEntry bounds how much of any one file in a zip export is read,
+	// and maxZipTotal how much of all of them, since a small zip can
+	// unpack to far more
+	maxZipEntry = 64 << 20
+	maxZipTotal = 256 << 20
+)
+
+// Parse reads the conversations in an export named name: JSON, a zip of
+// JSON and text files, or Markdown and plain text, which are read as a
+// single conversation. It returns nothing for data it can't read.
+func Parse(name string, data []byte) []Conversation {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return parseZip(data)
+	case json.Valid(data):
+		if read := Readers[Detect(bytes.NewReader(data))]; read != nil {
+			if convs, err := readAll(read, data); err == nil {
+				return convs
+			}
+		}
+		return parseJSON(name, data)
+	default:
+		return []Conversation{{
+			Title:    strings.TrimSuffix(path.Base(name), path.Ext(name)),
+			Messages: []Message{{Text: string(data)}},
+		}}
+	}
+}
+
+// readAll collects the conversations a streaming reader finds in data.
+func readAll(read func(io.Reader, func(Conversation) error) error, data []byte) ([]Conversation, error) {
+	var convs []Conversation
+	err := read(bytes.NewReader(data), func(c Conversation) error {
+		convs = append(convs, c)
+		return nil
+	})
+	return convs, err
+}
+
+func parseZip(data []byte) []Conversation {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil
+	}
+
+	var convs []Conversation
+	budget := int64(maxZipTotal)
+	for _, f := range zr.File {
+		switch strings.ToLower(path.Ext(f.Name)) {
+		case ".json", ".md", ".markdown", ".txt":
+		default:
+			continue
+		}
+		if f.UncompressedSize64 > maxZipEntry || int64(f.UncompressedSize64) > budget {
+			continue
+		}
+		entry, err := readZipEntry(f)
+		if err != nil {
+			continue
+		}
+		budget -= int64(len(entry))
+		convs = append(convs, Parse(f.Name, entry)...)
+	}
+	return convs
+}
+
+func readZipEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// The declared size can't be trusted, so the read is bounded too
+	data, err := io.ReadAll(io.LimitReader(rc, maxZipEntry+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxZipEntry {
+		return nil, errors.New("extract: zip entry too large")
+	}
+	return data, nil
+}
+
+// parseJSON reads an export of a format it doesn't know by walking the whole
+// document. Every string with a code fence is taken as a message, and the
+// nearest enclosing "title" or "name" as the conversation it belongs to.
+func parseJSON(name string, data []byte) []Conversation {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+
+	w := &walker{byTitle: map[string]int{}}
+	w.walk(doc, strings.TrimSuffix(path.Base(name), path.Ext(name)), "", time.Time{})
+	return w.convs
+}
+
+type walker struct {
+	convs   []Conversation
+	byTitle map[string]int
+}
+
+func (w *walker) walk(v interface{}, title, role string, at time.Time) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if t := stringField(v, "title", "name"); t != "" {
+			title = t
+		}
+		if r := stringField(v, "role", "sender"); r != "" {
+			role = normalizeRole(r)
+		}
+		if t, ok := timeField(v, "create_time", "created_at", "timestamp"); ok {
+			at = t
+		}
+		// Keys in a fixed order, so the same export always gives the same
+		// conversations
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			w.walk(v[k], title, role, at)
+		}
+	case []interface{}:
+		for _, child := range v {
+			w.walk(child, title, role, at)
+		}
+	case string:
+		if strings.Contains(v, "```") {
+			w.add(title, Message{Role: role, Text: v, Time: at})
+		}
+	}
+}
+
+func (w *walker) add(title string, m Message) {
+	i, ok := w.byTitle[title]
+	if !ok {
+		i = len(w.convs)
+		w.byTitle[title] = i
+		w.convs = append(w.convs, Conversation{Title: title, CreatedAt: m.Time})
+	}
+	w.convs[i].Messages = append(w.convs[i].Messages, m)
+}
+
+func stringField(obj map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if s, ok := obj[name].(string); ok && strings.TrimSpace(s) != "" {
+			return strings.TrimSpace(s)
+		}
+	}
+	return ""
+}
+
+// timeField reads a time given as Unix seconds or RFC 3339.
+func timeField(obj map[string]interface{}, names ...string) (time.Time, bool) {
+	for _, name := range names {
+		switch v := obj[name].(type) {
+		case float64:
+			if v > 0 {
+				return unixTime(v), true
+			}
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// normalizeRole maps the names exports give speakers to the Role constants.
+func normalizeRole(role string) string {
+	switch strings.ToLower(role) {
+	case "user", "human":
+		return RoleUser
+	case "assistant", "ai", "model", "bot", "tool":
+		return RoleAssistant
+	case "system":
+		return RoleSystem
+	}
+	return strings.ToLower(role)
+}
+
+// Markdown renders c as a readable transcript, the form imported
+// conversations are stored in.
+func (c Conversation) Markdown() string {
+	var b strings.Builder
+	title := c.Title
+	if title == "" {
+		title = "Untitled conversation"
+	}
+	b.WriteString("# " + title + "\n")
+	if !c.CreatedAt.IsZero() {
+		b.WriteString("\n_" + c.CreatedAt.UTC().Format("2006-01-02 15:04 MST") + "_\n")
+	}
+	for _, m := range c.Messages {
+		speaker := "Unknown"
+		if m.Role != "" {
+			speaker = strings.ToUpper(m.Role[:1]) + m.Role[1:]
+		}
+		b.WriteString("\n## " + speaker + "\n\n")
+		if !m.Time.IsZero() {
+			b.WriteString("_" + m.Time.UTC().Format("2006-01-02 15:04 MST") + "_\n\n")
+		}
+		b.WriteString(strings.TrimSpace(m.Text) + "\n")
+	}
+	return b.String()
+}
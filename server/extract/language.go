@@ -0,0 +1,132 @@
+package extract
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// languages maps fence info strings and file extensions to language names.
+// The names lowercase to the keys the sandbox runs snippets by.
+var languages = map[string]string{
+	"go": "Go", "golang": "Go",
+	"py": "Python", "python": "Python", "python3": "Python",
+	"js": "JavaScript", "javascript": "JavaScript", "node": "JavaScript", "jsx": "JavaScript", "mjs": "JavaScript", "cjs": "JavaScript",
+	"ts": "TypeScript", "typescript": "TypeScript", "tsx": "TypeScript",
+	"rb": "Ruby", "ruby": "Ruby", "rs": "Rust", "rust": "Rust",
+	"java": "Java", "kt": "Kotlin", "kotlin": "Kotlin", "swift": "Swift",
+	"c": "C", "h": "C", "cpp": "C++", "c++": "C++", "cc": "C++", "cxx": "C++", "hpp": "C++",
+	"cs": "C#", "csharp": "C#", "c#": "C#", "php": "PHP",
+	"sh": "Bash", "bash": "Bash", "shell": "Bash", "zsh": "Bash", "ps1": "PowerShell", "powershell": "PowerShell", "pwsh": "PowerShell",
+	"sql": "SQL", "postgres": "SQL", "postgresql": "SQL", "mysql": "SQL", "sqlite": "SQL",
+	"html": "HTML", "htm": "HTML", "css": "CSS", "scss": "CSS", "sass": "CSS", "less": "CSS",
+	"vue": "Vue", "svelte": "Svelte",
+	"json": "JSON", "yaml": "YAML", "yml": "YAML", "toml": "TOML", "xml": "XML",
+	"dockerfile": "Dockerfile", "docker": "Dockerfile", "makefile": "Makefile", "make": "Makefile",
+	"r": "R", "lua": "Lua", "dart": "Dart", "scala": "Scala", "elixir": "Elixir", "ex": "Elixir",
+	"hs": "Haskell", "haskell": "Haskell", "pl": "Perl", "perl": "Perl",
+	"tf": "HCL", "hcl": "HCL", "terraform": "HCL",
+	"graphql": "GraphQL", "gql": "GraphQL", "proto": "Protobuf", "protobuf": "Protobuf",
+}
+
+// extensions are the usual file extensions of languages, for naming a
+// file of code that came without a name.
+var extensions = map[string]string{
+	"Go": ".go", "Python": ".py", "JavaScript": ".js", "TypeScript": ".ts", "Ruby": ".rb", "Rust": ".rs",
+	"Java": ".java", "Kotlin": ".kt", "Swift": ".swift", "C": ".c", "C++": ".cpp", "C#": ".cs", "PHP": ".php",
+	"Bash": ".sh", "PowerShell": ".ps1", "SQL": ".sql", "HTML": ".html", "CSS": ".css", "Vue": ".vue",
+	"Svelte": ".svelte", "JSON": ".json", "YAML": ".yaml", "TOML": ".toml", "XML": ".xml", "R": ".r",
+	"Lua": ".lua", "Dart": ".dart", "Scala": ".scala", "Elixir": ".ex", "Haskell": ".hs", "Perl": ".pl",
+	"HCL": ".tf", "GraphQL": ".graphql", "Protobuf": ".proto",
+}
+
+// Filename names a file of code in language, as named by DetectLanguage,
+// that came without a name: base with the language's extension, or the
+// name tools look for when the language has one.
+func Filename(base, language string) string {
+	switch language {
+	case "Dockerfile", "Makefile":
+		return language
+	}
+	if ext, ok := extensions[language]; ok {
+		return base + ext
+	}
+	return base + ".txt"
+}
+
+// notCode are info strings of blocks that hold output or prose rather than
+// code.
+var notCode = map[string]bool{
+	"text": true, "txt": true, "plaintext": true, "output": true, "console": true,
+	"log": true, "markdown": true, "md": true, "diff": true, "csv": true,
+}
+
+// contentHints guess a language from code in a block with no info string,
+// most specific first.
+var contentHints = []struct {
+	pattern  *regexp.Regexp
+	language string
+}{
+	{regexp.MustCompile(`(?m)^package \w+\s*$`), "Go"},
+	{regexp.MustCompile(`(?i)^\s*<!doctype html|<html[\s>]`), "HTML"},
+	{regexp.MustCompile(`(?m)^\s*(?:fn main\(\)|use std::|impl\b.*\{$|let mut )`), "Rust"},
+	{regexp.MustCompile(`(?m)^\s*(?:public |private )?(?:static )?class \w+.*\{|public static void main`), "Java"},
+	{regexp.MustCompile(`(?m)^\s*#include\s*<(?:iostream|vector|string)>|std::`), "C++"},
+	{regexp.MustCompile(`(?m)^\s*#include\s*[<"]`), "C"},
+	{regexp.MustCompile(`(?m)^\s*(?:def \w+\(.*\):|from [\w.]+ import |import \w+$|if __name__ ==)`), "Python"},
+	{regexp.MustCompile(`(?m)^\s*(?:interface \w+ \{|type \w+ = |(?:let|const) \w+: \w)`), "TypeScript"},
+	{regexp.MustCompile(`(?m)^\s*(?:const|let|var) \w+ = |function \w*\(|=> \{|require\(|module\.exports|console\.log\(`), "JavaScript"},
+	{regexp.MustCompile(`(?im)^\s*(?:create|alter|drop) table|^\s*select .+ from `), "SQL"},
+	{regexp.MustCompile(`(?m)^\s*<\?php`), "PHP"},
+	{regexp.MustCompile(`(?m)^FROM [\w./:-]+|^RUN |^COPY `), "Dockerfile"},
+	{regexp.MustCompile(`(?m)^\s*(?:sudo |apt(?:-get)? |npm |pip |yarn |cd |mkdir |export \w+=|echo )`), "Bash"},
+	{regexp.MustCompile(`(?m)^\s*[\w.-]+\s*\{[^}]*:\s*[^;]+;`), "CSS"},
+	{regexp.MustCompile(`(?m)^[\w-]+:\s*(?:\S.*)?$\n^\s+[\w-]+:`), "YAML"},
+}
+
+// shebang finds the interpreter a script's first line names, as in
+// "#!/usr/bin/env python3" or "#!/bin/bash".
+var shebang = regexp.MustCompile(`^#!\s*\S*/(?:env\s+(?:-\S+\s+)*)?([A-Za-z]+)`)
+
+// DetectLanguage names the language of a block from its fence info string,
+// the extension of its file name, or failing both, the code itself: the
+// interpreter its shebang names, then what the code looks like. It returns
+// "" when none of them tell.
+func DetectLanguage(info, filename, code string) string {
+	info = strings.ToLower(strings.TrimSpace(info))
+	if lang, ok := languages[info]; ok {
+		return lang
+	}
+	if filename != "" {
+		base := strings.ToLower(path.Base(filename))
+		if lang, ok := languages[base]; ok {
+			return lang
+		}
+		if lang, ok := languages[strings.TrimPrefix(path.Ext(base), ".")]; ok {
+			return lang
+		}
+		// Dockerfile.dev, Dockerfile.prod and the like
+		if strings.HasPrefix(base, "dockerfile.") {
+			return "Dockerfile"
+		}
+	}
+	if info != "" && !notCode[info] {
+		// An unfamiliar language is still better named than guessed
+		return strings.ToUpper(info[:1]) + info[1:]
+	}
+	if m := shebang.FindStringSubmatch(strings.TrimLeft(code, "\n")); m != nil {
+		if lang, ok := languages[strings.ToLower(m[1])]; ok {
+			return lang
+		}
+	}
+	if json.Valid([]byte(code)) && strings.ContainsAny(code, "{[") {
+		return "JSON"
+	}
+	for _, h := range contentHints {
+		if h.pattern.MatchString(code) {
+			return h.language
+		}
+	}
+	return ""
+}
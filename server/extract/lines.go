@@ -0,0 +1,92 @@
+package extract
+
+import "strings"
+
+// commentSyntax is how a language writes comments: the prefixes of line
+// comments and the delimiters of block comments.
+type commentSyntax struct {
+	line       []string
+	blockStart string
+	blockEnd   string
+}
+
+var (
+	cStyle    = commentSyntax{line: []string{"//"}, blockStart: "/*", blockEnd: "*/"}
+	hashStyle = commentSyntax{line: []string{"#"}}
+)
+
+// comments maps language names, as DetectLanguage gives them, to their
+// comment syntax. Languages not here are counted as if they had none.
+var comments = map[string]commentSyntax{
+	"Go": cStyle, "JavaScript": cStyle, "TypeScript": cStyle, "Rust": cStyle, "Java": cStyle,
+	"Kotlin": cStyle, "Swift": cStyle, "C": cStyle, "C++": cStyle, "C#": cStyle, "Dart": cStyle,
+	"Scala": cStyle, "Protobuf": cStyle, "Vue": cStyle, "Svelte": cStyle,
+	"CSS":        {blockStart: "/*", blockEnd: "*/"},
+	"PHP":        {line: []string{"//", "#"}, blockStart: "/*", blockEnd: "*/"},
+	"Python":     {line: []string{"#"}, blockStart: `"""`, blockEnd: `"""`},
+	"Ruby":       {line: []string{"#"}, blockStart: "=begin", blockEnd: "=end"},
+	"Bash":       hashStyle,
+	"PowerShell": {line: []string{"#"}, blockStart: "<#", blockEnd: "#>"},
+	"Perl":       hashStyle, "R": hashStyle, "Elixir": hashStyle, "YAML": hashStyle, "TOML": hashStyle,
+	"Dockerfile": hashStyle, "Makefile": hashStyle, "GraphQL": hashStyle,
+	"HCL":     {line: []string{"#", "//"}, blockStart: "/*", blockEnd: "*/"},
+	"SQL":     {line: []string{"--"}, blockStart: "/*", blockEnd: "*/"},
+	"Lua":     {line: []string{"--"}, blockStart: "--[[", blockEnd: "]]"},
+	"Haskell": {line: []string{"--"}, blockStart: "{-", blockEnd: "-}"},
+	"HTML":    {blockStart: "<!--", blockEnd: "-->"},
+	"XML":     {blockStart: "<!--", blockEnd: "-->"},
+}
+
+// CountCode counts the lines of code in language that hold more than blanks
+// and comments. A line with code and a comment counts. For a language it
+// doesn't know the comments of it counts as CountLines does.
+func CountCode(code, language string) int {
+	syntax, ok := comments[language]
+	if !ok {
+		return CountLines(code)
+	}
+
+	n := 0
+	inBlock := false
+	for _, line := range strings.Split(code, "\n") {
+		line = strings.TrimSpace(line)
+		hasCode := false
+		for line != "" {
+			if inBlock {
+				end := strings.Index(line, syntax.blockEnd)
+				if end < 0 {
+					break
+				}
+				line = strings.TrimSpace(line[end+len(syntax.blockEnd):])
+				inBlock = false
+				continue
+			}
+			// Block first, as Lua's "--[[" starts with its line comment
+			if syntax.blockStart != "" && strings.HasPrefix(line, syntax.blockStart) {
+				line = strings.TrimSpace(line[len(syntax.blockStart):])
+				inBlock = true
+				continue
+			}
+			if lineComment(line, syntax.line) {
+				break
+			}
+			// A comment after code is left alone: the line counts either way,
+			// and a block it opens is rare next to "/*" in a string
+			hasCode = true
+			break
+		}
+		if hasCode {
+			n++
+		}
+	}
+	return n
+}
+
+func lineComment(line string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(line, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,384 @@
+package extract
+
+import (
+	"crypto/sha256"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// MinLines is the fewest non-blank lines a block needs to be a project;
+	// shorter ones are usually commands or fragments of an explanation.
+	MinLines = 3
+
+	maxDescription = 300
+	maxFeatures    = 10
+)
+
+// Project types, from what the code looks like.
+const (
+	TypeComponent = "Component"
+	TypeWebPage   = "Web Page"
+	TypeScript    = "Script"
+	TypeSchema    = "Schema"
+	TypeConfig    = "Config"
+	TypeProgram   = "Program"
+	TypeSnippet   = "Snippet"
+)
+
+// Candidate is a project found in a conversation.
+type Candidate struct {
+	Name        string
+	Type        string
+	Description string
+	Language    string
+	Code        string
+	LinesOfCode int
+	// Features are the functions, classes and other names the code defines
+	Features     []string
+	Conversation string
+	CreatedAt    time.Time
+	// Files are the project's files by path, when the conversation named
+	// them. Code is then that of the entry point.
+	Files []File
+}
+
+// File is one file of a project made of several.
+type File struct {
+	Path     string
+	Language string
+	Code     string
+}
+
+// Projects picks the code blocks in convs worth keeping, at most limit of
+// them. When a conversation revises the same file several times only the
+// last version is kept, and code repeated anywhere in the export is kept
+// once. The files a conversation names are put together as one project.
+func Projects(convs []Conversation, limit int) []Candidate {
+	var out []Candidate
+	seen := map[[32]byte]bool{}
+	for _, conv := range convs {
+		// Later versions replace earlier ones in place, so the
+		// conversation's order is kept
+		byName := map[string]int{}
+		var found []Candidate
+		for _, m := range conv.Messages {
+			for _, b := range CodeBlocks(m.Text) {
+				c, ok := candidate(conv, m, b)
+				if !ok {
+					continue
+				}
+				sum := sha256.Sum256([]byte(strings.TrimSpace(c.Code)))
+				if seen[sum] {
+					continue
+				}
+				seen[sum] = true
+
+				key := strings.ToLower(c.Language + "\x00" + c.Name)
+				if len(c.Files) > 0 {
+					key = strings.ToLower(c.Files[0].Path)
+				}
+				if i, ok := byName[key]; ok {
+					found[i] = c
+					continue
+				}
+				byName[key] = len(found)
+				found = append(found, c)
+			}
+		}
+		for _, c := range assemble(conv, found) {
+			if len(out) == limit {
+				return out
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func candidate(conv Conversation, m Message, b Block) (Candidate, bool) {
+	info := strings.ToLower(b.Language)
+	if notCode[info] || m.Role == RoleSystem {
+		return Candidate{}, false
+	}
+	lines := CountLines(b.Code)
+	if lines < MinLines {
+		return Candidate{}, false
+	}
+
+	filename := b.Filename
+	if filename == "" {
+		filename = commentedFile(b.Code)
+	}
+	lang := DetectLanguage(b.Language, filename, b.Code)
+	features := definitions(b.Code)
+
+	c := Candidate{
+		Type:         projectType(lang, filename, b.Code),
+		Description:  describe(b.Before, conv.Title),
+		Language:     lang,
+		Code:         strings.Trim(b.Code, "\n"),
+		LinesOfCode:  lines,
+		Features:     features,
+		Conversation: conv.Title,
+		CreatedAt:    m.Time,
+	}
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = conv.CreatedAt
+	}
+
+	if p := CleanPath(filename); p != "" {
+		c.Files = []File{{Path: p, Language: lang, Code: c.Code}}
+	}
+
+	switch {
+	case filename != "":
+		c.Name = path.Base(filename)
+	case mentionedFile(b.Before) != "":
+		c.Name = path.Base(mentionedFile(b.Before))
+	case len(features) > 0:
+		c.Name = features[0]
+	default:
+		c.Name = conv.Title
+		if c.Name == "" {
+			c.Name = "Untitled"
+		}
+		if lang != "" {
+			c.Name += " (" + lang + ")"
+		}
+	}
+	return c, true
+}
+
+// assemble puts the files a conversation names together as one project,
+// where the entry point and its first file stood, when there are several.
+// Blocks that name no file stay projects of their own.
+func assemble(conv Conversation, found []Candidate) []Candidate {
+	var files []Candidate
+	for _, c := range found {
+		if len(c.Files) > 0 {
+			files = append(files, c)
+		}
+	}
+	if len(files) < 2 {
+		return found
+	}
+
+	entry := files[0]
+	for _, c := range files {
+		if isEntry(c) {
+			entry = c
+			break
+		}
+	}
+	p := Candidate{
+		Name:         conv.Title,
+		Type:         entry.Type,
+		Description:  entry.Description,
+		Code:         entry.Code,
+		Conversation: conv.Title,
+		Features:     []string{},
+	}
+	if p.Name == "" {
+		p.Name = "Untitled"
+	}
+	if p.Type == TypeSnippet || p.Type == TypeConfig {
+		p.Type = TypeProgram
+	}
+	lines := map[string]int{}
+	seen := map[string]bool{}
+	for _, c := range files {
+		p.Files = append(p.Files, c.Files[0])
+		p.LinesOfCode += c.LinesOfCode
+		lines[c.Language] += c.LinesOfCode
+		if c.CreatedAt.After(p.CreatedAt) {
+			p.CreatedAt = c.CreatedAt
+		}
+		for _, f := range c.Features {
+			if !seen[f] && len(p.Features) < maxFeatures {
+				seen[f] = true
+				p.Features = append(p.Features, f)
+			}
+		}
+	}
+	// The project is in the language most of its code is in
+	for lang, n := range lines {
+		if lang != "" && (n > lines[p.Language] || n == lines[p.Language] && lang < p.Language) {
+			p.Language = lang
+		}
+	}
+	sort.Slice(p.Files, func(i, j int) bool { return p.Files[i].Path < p.Files[j].Path })
+
+	out := make([]Candidate, 0, len(found)-len(files)+1)
+	placed := false
+	for _, c := range found {
+		if len(c.Files) == 0 {
+			out = append(out, c)
+		} else if !placed {
+			out = append(out, p)
+			placed = true
+		}
+	}
+	return out
+}
+
+// entryNames are the base names, without extension, of files that usually
+// start a program.
+var entryNames = map[string]bool{"main": true, "index": true, "app": true, "server": true, "__main__": true}
+
+func isEntry(c Candidate) bool {
+	return IsEntryPoint(c.Files[0].Path, c.Code)
+}
+
+// IsEntryPoint reports whether the file at name is likely where its project
+// starts: it defines a main function, or is named as entry points usually
+// are.
+func IsEntryPoint(name, code string) bool {
+	base := path.Base(name)
+	return entryPattern.MatchString(code) || entryNames[strings.ToLower(strings.TrimSuffix(base, path.Ext(base)))]
+}
+
+// CleanPath makes a file name from a conversation or a user safe to write
+// under a project's folder: relative, with forward slashes and no "..".
+// It returns "" for a name that has nothing left.
+func CleanPath(name string) string {
+	name = path.Clean("/" + strings.ReplaceAll(strings.TrimSpace(name), "\\", "/"))
+	name = strings.TrimPrefix(name, "/")
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// fileComment finds a file name given in a comment on the first lines of a
+// block, as in "// server.js" or "# File: app/main.py".
+var fileComment = regexp.MustCompile(`(?im)^\s*(?://|#|--|/\*|<!--|;)\s*(?:file(?:name)?\s*:\s*)?([\w.-]+(?:/[\w.-]+)*\.[a-z0-9]{1,10})\b`)
+
+// fileMention finds a file name quoted in prose, as in "Save this as `app.py`".
+var fileMention = regexp.MustCompile("[`*\"']([\\w.-]+(?:/[\\w.-]+)*\\.[A-Za-z0-9]{1,10})[`*\"']")
+
+// commentedFile returns the file name a comment on the first lines of code
+// gives, or "".
+func commentedFile(code string) string {
+	if lines := strings.SplitN(code, "\n", 4); len(lines) > 3 {
+		code = strings.Join(lines[:3], "\n")
+	}
+	if m := fileComment.FindStringSubmatch(code); m != nil && knownExtension(m[1]) {
+		return m[1]
+	}
+	return ""
+}
+
+// mentionedFile returns the last file name quoted in prose, or "".
+func mentionedFile(prose string) string {
+	mentions := fileMention.FindAllStringSubmatch(prose, -1)
+	for i := len(mentions) - 1; i >= 0; i-- {
+		if knownExtension(mentions[i][1]) {
+			return mentions[i][1]
+		}
+	}
+	return ""
+}
+
+// knownExtension reports whether name ends in the extension of a language
+// or config file, so "e.g." and version numbers aren't taken for files.
+func knownExtension(name string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	switch ext {
+	case "env", "ini", "cfg", "conf", "properties", "gradle":
+		return true
+	}
+	_, ok := languages[ext]
+	return ok
+}
+
+// definitionPatterns find the names code defines, across common languages.
+var definitionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?m)^\s*func\s+(?:\([^)]*\)\s*)?(\w+)`),
+	regexp.MustCompile(`(?m)^\s*(?:async\s+)?def\s+(\w+)`),
+	regexp.MustCompile(`(?m)^\s*(?:export\s+)?(?:default\s+)?(?:abstract\s+)?(?:public\s+|private\s+)?(?:static\s+)?class\s+(\w+)`),
+	regexp.MustCompile(`(?m)^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\*?\s+(\w+)`),
+	regexp.MustCompile(`(?m)^\s*(?:export\s+)?const\s+([A-Z]\w*)\s*=\s*(?:\([^)]*\)|\w+)\s*=>`),
+	regexp.MustCompile(`(?m)^\s*(?:pub\s+)?(?:fn|struct|enum|trait)\s+(\w+)`),
+	regexp.MustCompile(`(?m)^\s*type\s+(\w+)\s+(?:struct|interface)`),
+	regexp.MustCompile(`(?im)^\s*create\s+table\s+(?:if\s+not\s+exists\s+)?["` + "`" + `]?(\w+)`),
+}
+
+// definitions returns the distinct names code defines, in order, skipping
+// entry points that say nothing about the code.
+func definitions(code string) []string {
+	type found struct {
+		at   int
+		name string
+	}
+	var all []found
+	for _, p := range definitionPatterns {
+		for _, m := range p.FindAllStringSubmatchIndex(code, -1) {
+			all = append(all, found{m[2], code[m[2]:m[3]]})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].at < all[j].at })
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, f := range all {
+		switch f.name {
+		case "main", "init", "__init__", "setUp", "tearDown":
+			continue
+		}
+		if seen[f.name] {
+			continue
+		}
+		seen[f.name] = true
+		if names = append(names, f.name); len(names) == maxFeatures {
+			break
+		}
+	}
+	return names
+}
+
+var (
+	reactPattern  = regexp.MustCompile(`\b(?:useState|useEffect|React\.|from ['"]react['"])|return\s*\(\s*<`)
+	entryPattern  = regexp.MustCompile(`(?m)^\s*(?:func main\(\)|fn main\(\)|if __name__ ==|public static void main|int main\()`)
+	schemaPattern = regexp.MustCompile(`(?i)\bcreate\s+table\b`)
+)
+
+func projectType(lang, filename, code string) string {
+	switch {
+	case reactPattern.MatchString(code), lang == "Vue", lang == "Svelte":
+		return TypeComponent
+	case lang == "HTML":
+		return TypeWebPage
+	case schemaPattern.MatchString(code):
+		return TypeSchema
+	case lang == "JSON", lang == "YAML", lang == "TOML", lang == "XML", lang == "Dockerfile", lang == "HCL",
+		filename != "" && strings.HasPrefix(path.Base(filename), "."):
+		return TypeConfig
+	case lang == "Bash", lang == "PowerShell":
+		return TypeScript
+	case entryPattern.MatchString(code):
+		return TypeProgram
+	}
+	return TypeSnippet
+}
+
+// describe turns the prose before a block into a description, falling back
+// to the conversation it came from.
+func describe(before, title string) string {
+	d := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(before), ":"))
+	if d == "" {
+		if title == "" {
+			return ""
+		}
+		return "From the conversation \"" + title + "\""
+	}
+	if utf8.RuneCountInString(d) > maxDescription {
+		runes := []rune(d)
+		d = strings.TrimSpace(string(runes[:maxDescription-1])) + "…"
+	}
+	return d
+}
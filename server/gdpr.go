@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+)
+
+const (
+	exportStatusPending    = "pending"
+	exportStatusProcessing = "processing"
+	exportStatusCompleted  = "completed"
+	exportStatusFailed     = "failed"
+
+	exportArchiveTTL  = 7 * 24 * time.Hour
+	exportLinkTTL     = 24 * time.Hour
+	retentionInterval = time.Hour
+	retentionBatch    = 100
+)
+
+// DataExport tracks a data-subject export request and the archive it
+// produced; see storage.DataExport.
+type DataExport = storage.DataExport
+
+// dataExportPayload names the export a data.export job builds.
+type dataExportPayload struct {
+	ExportID string `json:"export_id"`
+}
+
+// runDataExportJob builds an export's archive. A failed build isn't a
+// failed job: the export keeps its own status. While it builds, the export
+// expires after jobTimeout, so one whose server went away is dropped by
+// purgeExpiredExports rather than left processing.
+func runDataExportJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload dataExportPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	export, err := db.DataExports().Get(ctx, "", payload.ExportID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if export.Status != exportStatusPending {
+		return nil, nil
+	}
+	lease := time.Now().Add(jobTimeout)
+	export.Status = exportStatusProcessing
+	export.ExpiresAt = &lease
+	if err := db.DataExports().Update(ctx, export); err != nil {
+		return nil, err
+	}
+
+	path, err := buildExportArchive(ctx, export)
+	now := time.Now()
+	expires := now.Add(exportArchiveTTL)
+	export.ExpiresAt = &expires
+	if err != nil {
+		slog.Error("Data export failed", "export_id", export.ID, "error", err)
+		export.Status = exportStatusFailed
+		export.Error = "Error building export archive"
+		return nil, db.DataExports().Update(ctx, export)
+	}
+	export.Status = exportStatusCompleted
+	export.CompletedAt = &now
+	export.ArchivePath = path
+	if err := db.DataExports().Update(ctx, export); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	emitWebhook(export.UserID, "export.completed", map[string]string{"id": export.ID})
+	publishEvent("export.completed", export.UserID, "export", export.ID, nil)
+	return nil, nil
+}
+
+// removeExportArchive deletes an export's archive, if it has one.
+func removeExportArchive(export DataExport) error {
+	if export.ArchivePath == "" {
+		return nil
+	}
+	if err := os.Remove(export.ArchivePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func exportDir() string {
+	if dir := config.Get("EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "backup-manager-exports")
+}
+
+func buildExportArchive(ctx context.Context, export DataExport) (string, error) {
+	if err := os.MkdirAll(exportDir(), 0o700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(exportDir(), export.ID+".zip")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	files, err := collectUserData(ctx, export.UserID)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	zw := zip.NewWriter(f)
+	for _, name := range sortedKeys(files) {
+		w, err := zw.Create(name)
+		if err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files[name]); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// collectUserData gathers everything held about a user, keyed by the file
+// name it is written to inside the export archive.
+func collectUserData(ctx context.Context, userID string) (map[string]interface{}, error) {
+	user, err := db.Users().Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := db.Backups().List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	projects, err := db.Projects().List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	qrCodes, err := db.QRCodes().List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	collections, err := db.Collections().List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := db.QRTemplates().List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"manifest.json": map[string]interface{}{
+			"user_id":      userID,
+			"generated_at": time.Now().Format(time.RFC3339),
+			"files":        []string{"user.json", "backups.json", "projects.json", "collections.json", "qr_codes.json", "qr_templates.json"},
+		},
+		"user.json":         user,
+		"backups.json":      backups,
+		"projects.json":     projects,
+		"collections.json":  collections,
+		"qr_codes.json":     qrCodes,
+		"qr_templates.json": templates,
+	}, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func withDownloadURL(export DataExport) DataExport {
+	if export.Status == exportStatusCompleted {
+		link := urlSigner.Sign("/api/exports/"+export.ID+"/download", scopeExportDownload, exportLinkTTL)
+		export.DownloadURL = link.URL
+	}
+	return export
+}
+
+// Retention
+func runRetention() {
+	purgeExpiredExports()
+	enforceRetentionPolicies()
+	purgeExpiredTrash()
+	runAccountDeletions()
+	deleteExpiredAccounts()
+}
+
+// purgeExpiredExports deletes exports past their expiry, with their
+// archives.
+func purgeExpiredExports() {
+	ctx := context.Background()
+
+	expired, err := db.DataExports().ListExpired(ctx, time.Now(), retentionBatch)
+	if err != nil {
+		slog.Error("Error listing expired exports", "error", err)
+		return
+	}
+	for _, export := range expired {
+		if err := removeExportArchive(export); err != nil {
+			slog.Error("Error removing export archive", "export_id", export.ID, "error", err)
+			continue
+		}
+		if err := db.DataExports().Delete(ctx, export.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			slog.Error("Error deleting export", "export_id", export.ID, "error", err)
+		}
+	}
+}
+
+// deleteExpiredAccounts deletes the accounts no one has logged in to, or
+// used an API key of, for ACCOUNT_RETENTION_DAYS. Admins' accounts are
+// kept. Retention is disabled when it is unset.
+func deleteExpiredAccounts() {
+	days, err := strconv.Atoi(config.Get("ACCOUNT_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		return
+	}
+	ctx := context.Background()
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	users, err := db.Users().ListInactive(ctx, cutoff, retentionBatch)
+	if err != nil {
+		slog.Error("Error loading inactive accounts", "error", err)
+		return
+	}
+	if len(users) > 0 {
+		slog.Info("Account retention: removing inactive accounts", "inactive_since", cutoff, "count", len(users))
+	}
+	deleteAccounts(ctx, users)
+}
+
+// Handlers
+func createExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	export := DataExport{
+		ID:          generateID(),
+		UserID:      userID,
+		Status:      exportStatusPending,
+		RequestedAt: time.Now(),
+	}
+	if err := db.DataExports().Create(r.Context(), export); err != nil {
+		writeStorageError(w, r, err, "Export")
+		return
+	}
+	if _, err := enqueueJob(r.Context(), userID, jobDataExport, dataExportPayload{ExportID: export.ID}); err != nil {
+		db.DataExports().Delete(r.Context(), export.ID)
+		writeEnqueueError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(export)
+}
+
+func getExportsHandler(w http.ResponseWriter, r *http.Request) {
+	exports, err := db.DataExports().List(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Exports")
+		return
+	}
+	for i := range exports {
+		exports[i] = withDownloadURL(exports[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exports)
+}
+
+func getExportHandler(w http.ResponseWriter, r *http.Request) {
+	export, err := db.DataExports().Get(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Export")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(withDownloadURL(export))
+}
+
+func downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	liftDeadlines(w)
+
+	if _, ok := verifySignedLink(w, r, scopeExportDownload); !ok {
+		return
+	}
+
+	export, err := db.DataExports().Get(r.Context(), "", id)
+	if err == nil && export.Status != exportStatusCompleted {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Export")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "data-export-"+export.ID+".zip"))
+	http.ServeFile(w, r, export.ArchivePath)
+}
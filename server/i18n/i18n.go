@@ -0,0 +1,191 @@
+// Package i18n translates server-rendered pages. Translations ship as a
+// bundle of JSON files, one per language, which deployments can extend or
+// override with their own directory.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLanguage is used when nothing better matches, and for keys a
+// language does not translate.
+const DefaultLanguage = "en"
+
+//go:embed locales/*.json
+var builtin embed.FS
+
+// Bundle holds the messages for every language, keyed by lower-case
+// language tag such as "en" or "pt-br".
+type Bundle struct {
+	mu       sync.RWMutex
+	messages map[string]map[string]string
+}
+
+// New returns a bundle with the built-in translations.
+func New() (*Bundle, error) {
+	b := &Bundle{messages: make(map[string]map[string]string)}
+	if err := b.load(builtin, "locales"); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// LoadDir adds the <lang>.json files in dir to the bundle. Keys override the
+// built-in messages, so a deployment can change a single string or add a
+// whole language.
+func (b *Bundle) LoadDir(dir string) error {
+	return b.load(os.DirFS(dir), ".")
+}
+
+func (b *Bundle) load(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, name := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("i18n: %s: %w", name, err)
+		}
+
+		lang := normalize(strings.TrimSuffix(path.Base(name), ".json"))
+		if b.messages[lang] == nil {
+			b.messages[lang] = make(map[string]string)
+		}
+		for key, msg := range messages {
+			b.messages[lang][key] = msg
+		}
+	}
+	return nil
+}
+
+// Languages lists the languages the bundle has messages for.
+func (b *Bundle) Languages() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	langs := make([]string, 0, len(b.messages))
+	for lang := range b.messages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Has reports whether the bundle has messages for lang.
+func (b *Bundle) Has(lang string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.messages[normalize(lang)]
+	return ok
+}
+
+// Match picks the best supported language for the preferred one, falling
+// back from a regional variant to its base language ("pt-BR" to "pt"). It
+// returns "" if neither is supported.
+func (b *Bundle) Match(lang string) string {
+	lang = normalize(lang)
+	if lang == "" {
+		return ""
+	}
+	if b.Has(lang) {
+		return lang
+	}
+	if base, _, ok := strings.Cut(lang, "-"); ok && b.Has(base) {
+		return base
+	}
+	return ""
+}
+
+// Negotiate picks a language from an Accept-Language header, honouring
+// quality values, and falls back to DefaultLanguage.
+func (b *Bundle) Negotiate(acceptLanguage string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag != "" && tag != "*" && q > 0 {
+			candidates = append(candidates, candidate{tag, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, c := range candidates {
+		if lang := b.Match(c.lang); lang != "" {
+			return lang
+		}
+	}
+	return DefaultLanguage
+}
+
+// T returns the message for key in lang, falling back to the base language
+// and then DefaultLanguage. Placeholders like {host} are replaced from args,
+// given as name/value pairs. An untranslated key is returned as is.
+func (b *Bundle) T(lang, key string, args ...string) string {
+	b.mu.RLock()
+	msg, ok := b.lookup(lang, key)
+	b.mu.RUnlock()
+	if !ok {
+		msg = key
+	}
+
+	for i := 0; i+1 < len(args); i += 2 {
+		msg = strings.ReplaceAll(msg, "{"+args[i]+"}", args[i+1])
+	}
+	return msg
+}
+
+// Date formats t with the language's "date.format" layout.
+func (b *Bundle) Date(lang string, t time.Time) string {
+	b.mu.RLock()
+	layout, ok := b.lookup(lang, "date.format")
+	b.mu.RUnlock()
+	if !ok {
+		layout = "2006-01-02"
+	}
+	return t.Format(layout)
+}
+
+// lookup must be called with b.mu held.
+func (b *Bundle) lookup(lang, key string) (string, bool) {
+	lang = normalize(lang)
+	base, _, _ := strings.Cut(lang, "-")
+	for _, l := range []string{lang, base, DefaultLanguage} {
+		if msg, ok := b.messages[l][key]; ok {
+			return msg, true
+		}
+	}
+	return "", false
+}
+
+func normalize(lang string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(lang), "_", "-"))
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/extract"
+	"backup-manager/queue"
+	"backup-manager/storage"
+)
+
+const (
+	jobBackupParse   = "backup.parse"
+	jobQRBatch       = "qr.batch"
+	jobKeyRotation   = "encryption.rotate"
+	jobAccountExport = "account.export"
+
+	jobWebhookDelivery = "webhook.deliver"
+	jobConnectorRun    = "connector.run"
+	jobDataExport      = "data.export"
+	jobChatImport      = "chat.import"
+	jobIntegrityCheck  = "integrity.check"
+	jobWarehouseExport = "warehouse.export"
+
+	jobQueueSize      = 1000
+	defaultJobWorkers = 4
+	jobListLimit      = 50
+	// A queued job no worker has claimed for jobRequeueAfter is pushed
+	// again, in case its ID was lost with a worker or an in-memory queue;
+	// one running for jobTimeout is failed, as its worker must be gone
+	jobRequeueAfter  = 10 * time.Minute
+	jobTimeout       = 2 * time.Hour
+	jobSweepInterval = 5 * time.Minute
+	jobSweepBatch    = 500
+	// jobRetention is how long finished jobs, and files they made, are kept
+	jobRetention = 7 * 24 * time.Hour
+
+	// maxParseBytes bounds how much of a backup a parse job reads
+	maxParseBytes = 256 << 20
+)
+
+var jobQueue queue.Queue
+
+// jobRunner does a job of one type and returns its result, which is
+// stored as JSON. Errors that are a *jobError are shown to the job's
+// owner; others are logged and reported as a failure.
+type jobRunner func(ctx context.Context, job storage.Job) (interface{}, error)
+
+var jobRunners = map[string]jobRunner{
+	jobBackupParse:   runBackupParseJob,
+	jobQRBatch:       runQRBatchJob,
+	jobKeyRotation:   runKeyRotationJob,
+	jobAccountExport: runAccountExportJob,
+
+	jobWebhookDelivery: runWebhookDeliveryJob,
+	jobConnectorRun:    runConnectorJob,
+	jobDataExport:      runDataExportJob,
+	jobChatImport:      runChatImportJob,
+	jobIntegrityCheck:  runIntegrityCheckJob,
+	jobWarehouseExport: runWarehouseExportJob,
+}
+
+// internalJobs are the types of job the server queues for itself rather
+// than for a user to follow. They are owned by the user they act for, but
+// aren't listed or shown to them and publish no progress or job events.
+var internalJobs = map[string]bool{
+	jobWebhookDelivery: true,
+	jobConnectorRun:    true,
+	jobDataExport:      true,
+	jobChatImport:      true,
+	jobIntegrityCheck:  true,
+	jobWarehouseExport: true,
+}
+
+// internalJobTypes lists internalJobs, for leaving them out of job lists.
+func internalJobTypes() []string {
+	types := make([]string, 0, len(internalJobs))
+	for t := range internalJobs {
+		types = append(types, t)
+	}
+	return types
+}
+
+// jobsWithFiles are the types of job that leave a file in the blob store,
+// at jobFileKey, for /api/jobs/{id}/result.
+var jobsWithFiles = map[string]bool{
+	jobQRBatch:       true,
+	jobAccountExport: true,
+}
+
+type jobError struct{ msg string }
+
+func (e *jobError) Error() string { return e.msg }
+
+// initJobQueue connects the queue jobs are passed through. JOB_QUEUE_URL
+// selects a Redis list shared by every server, see queue.Open; without it
+// jobs stay on the server that accepted them.
+func initJobQueue() {
+	var err error
+	jobQueue, err = queue.Open(config.Get("JOB_QUEUE_URL"), "backup-manager:jobs", jobQueueSize)
+	if err != nil {
+		fatal("Invalid JOB_QUEUE_URL", "error", err)
+	}
+}
+
+// enqueueJob saves a job of userID's, or of the server's if userID is
+// empty, and queues it.
+func enqueueJob(ctx context.Context, userID, jobType string, payload interface{}) (storage.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return storage.Job{}, err
+	}
+	now := time.Now()
+	job := storage.Job{
+		ID:        generateID(),
+		UserID:    userID,
+		Type:      jobType,
+		Status:    storage.JobQueued,
+		Payload:   data,
+		CreatedAt: now,
+		QueuedAt:  now,
+	}
+	if err := db.Jobs().Create(ctx, job); err != nil {
+		return storage.Job{}, err
+	}
+	if err := jobQueue.Push(ctx, job.ID); err != nil {
+		// Fail it rather than leave it for the sweep, so the caller can
+		// tell the client to try again later
+		if claimed, cerr := db.Jobs().Claim(ctx, job.ID, now); cerr == nil {
+			finished := time.Now()
+			claimed.Status = storage.JobFailed
+			claimed.Error = "The job queue is full"
+			claimed.FinishedAt = &finished
+			db.Jobs().Finish(ctx, claimed)
+		}
+		return storage.Job{}, fmt.Errorf("queueing job: %w", err)
+	}
+	if !internalJobs[job.Type] {
+		publishJobProgress(job)
+	}
+	return job, nil
+}
+
+// publishJobProgress pushes a job's state to its owner's progress
+// connections on this server. With a shared queue the job may run on
+// another, so clients should also poll /api/jobs/{id}.
+func publishJobProgress(job storage.Job) {
+	progress.publish(job.UserID, ProgressEvent{JobID: job.ID, Kind: job.Type, State: job.Status, Error: job.Error})
+}
+
+// jobWorkers are the workers runJobWorkers started. Cancelling stop makes
+// them stop taking jobs; cancelling cancel also cancels the jobs they run.
+var jobWorkers struct {
+	wg           sync.WaitGroup
+	stop, cancel context.CancelFunc
+}
+
+// runJobWorkers starts JOB_WORKERS workers, 4 by default.
+func runJobWorkers() {
+	workers := defaultJobWorkers
+	if v := config.Get("JOB_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			fatal("Invalid JOB_WORKERS", "value", v)
+		}
+		workers = n
+	}
+	popCtx, stop := context.WithCancel(context.Background())
+	runCtx, cancel := context.WithCancel(context.Background())
+	jobWorkers.stop, jobWorkers.cancel = stop, cancel
+	for i := 0; i < workers; i++ {
+		jobWorkers.wg.Add(1)
+		go func() {
+			defer jobWorkers.wg.Done()
+			runJobWorker(popCtx, runCtx)
+		}()
+	}
+}
+
+// runJobWorker runs jobs with runCtx until popCtx is cancelled.
+func runJobWorker(popCtx, runCtx context.Context) {
+	for {
+		id, err := jobQueue.Pop(popCtx)
+		if popCtx.Err() != nil && err != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("Error taking a job off the queue", "error", err)
+			select {
+			case <-popCtx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		waitOutMaintenance()
+		runJob(runCtx, id)
+	}
+}
+
+// stopJobWorkers stops the workers taking jobs and gives the jobs they are
+// running SHUTDOWN_TIMEOUT to finish. Jobs still running then are cancelled
+// and queued again, for another server or this one once it restarts.
+func stopJobWorkers() {
+	if jobWorkers.stop == nil {
+		return
+	}
+	jobWorkers.stop()
+	done := make(chan struct{})
+	go func() {
+		jobWorkers.wg.Wait()
+		close(done)
+	}()
+
+	timeout := durationSetting("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	slog.Warn("Cancelling jobs still running at shutdown")
+	jobWorkers.cancel()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Error("Jobs didn't stop when cancelled")
+	}
+}
+
+func runJob(ctx context.Context, id string) {
+	job, err := db.Jobs().Claim(ctx, id, time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		// Already run, or deleted
+		return
+	}
+	if err != nil {
+		slog.Error("Error claiming job", "job_id", id, "error", err)
+		return
+	}
+	result, err := runJobSafely(ctx, job)
+	if ctx.Err() != nil {
+		// Cancelled by stopJobWorkers; dated so the next sweep pushes it
+		// again
+		if err := db.Jobs().Release(context.WithoutCancel(ctx), job.ID, time.Now().Add(-jobRequeueAfter)); err != nil {
+			slog.Error("Error queueing cancelled job again", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = storage.JobCompleted
+	var shown *jobError
+	switch {
+	case errors.As(err, &shown):
+		job.Status = storage.JobFailed
+		job.Error = shown.msg
+	case err != nil:
+		slog.Error("Job failed", "job_id", job.ID, "type", job.Type, "error", err)
+		job.Status = storage.JobFailed
+		job.Error = "The job failed"
+	default:
+		if job.Result, err = json.Marshal(result); err != nil {
+			job.Status = storage.JobFailed
+			job.Error = "The job failed"
+		}
+	}
+	if err := db.Jobs().Finish(ctx, job); err != nil {
+		slog.Error("Error saving finished job", "job_id", job.ID, "error", err)
+		return
+	}
+	if internalJobs[job.Type] {
+		return
+	}
+	publishJobProgress(job)
+	publishEvent("job."+job.Status, job.UserID, "job", job.ID, map[string]interface{}{"type": job.Type})
+	emitWebhook(job.UserID, "job."+job.Status, map[string]interface{}{"id": job.ID, "type": job.Type, "error": job.Error})
+}
+
+// runJobSafely runs the job's runner, turning a panic into an error so
+// one bad job doesn't take the worker down.
+func runJobSafely(ctx context.Context, job storage.Job) (result interface{}, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	run, ok := jobRunners[job.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown job type %q", job.Type)
+	}
+	if internalJobs[job.Type] {
+		return run(ctx, job)
+	}
+	p := newJobProgress(job.UserID, job.ID, job.Type)
+	p.state(storage.JobRunning)
+	return run(withJobProgress(ctx, p), job)
+}
+
+// sweepJobs fails jobs whose worker died, queues again jobs whose ID was
+// lost, and deletes finished jobs past retention.
+func sweepJobs() {
+	ctx := context.Background()
+	now := time.Now()
+
+	if n, err := db.Jobs().FailStale(ctx, now.Add(-jobTimeout), "The job didn't finish in time"); err != nil {
+		slog.Error("Error failing stale jobs", "error", err)
+	} else if n > 0 {
+		slog.Warn("Failed jobs that stopped running", "count", n)
+	}
+
+	queued, err := db.Jobs().ListQueued(ctx, now.Add(-jobRequeueAfter), jobSweepBatch)
+	if err != nil {
+		slog.Error("Error listing queued jobs", "error", err)
+	}
+	for _, job := range queued {
+		if err := jobQueue.Push(ctx, job.ID); err != nil {
+			slog.Error("Error queueing job again", "job_id", job.ID, "error", err)
+			break
+		}
+		db.Jobs().Requeue(ctx, job.ID, now)
+	}
+
+	finished, err := db.Jobs().ListFinishedBefore(ctx, now.Add(-jobRetention), jobSweepBatch)
+	if err != nil {
+		slog.Error("Error listing finished jobs", "error", err)
+		return
+	}
+	for _, job := range finished {
+		if jobsWithFiles[job.Type] && job.Status == storage.JobCompleted && blobStore != nil {
+			if err := blobStore.Delete(ctx, jobFileKey(job)); err != nil {
+				slog.Error("Error deleting job file", "job_id", job.ID, "error", err)
+				continue
+			}
+		}
+		if err := db.Jobs().Delete(ctx, job.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			slog.Error("Error deleting job", "job_id", job.ID, "error", err)
+		}
+	}
+}
+
+// jobFileKey is where the file a job made is stored.
+func jobFileKey(job storage.Job) string {
+	return "jobs/" + job.UserID + "/" + job.ID
+}
+
+// jobActor is who a job acts as in domain events: its owner.
+func jobActor(job storage.Job) DomainActor {
+	return DomainActor{Type: actorUser, UserID: job.UserID}
+}
+
+// Runners
+
+type backupParsePayload struct {
+	BackupID string `json:"backup_id"`
+	// TeamID is the team the backup is in, if any
+	TeamID string `json:"team_id,omitempty"`
+}
+
+// runBackupParseJob reads a backup further than an upload looks, up to
+// maxParseBytes, and saves the projects in it that aren't saved already.
+func runBackupParseJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload backupParsePayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+	if payload.TeamID != "" {
+		ctx = storage.WithTeam(ctx, payload.TeamID)
+	}
+	b, err := db.Backups().Get(ctx, job.UserID, payload.BackupID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, &jobError{"Backup not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := openBackup(ctx, b)
+	if errors.Is(err, errDataKeyLocked) {
+		return nil, &jobError{"Your data key is locked; log in again or restore it with your recovery key"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	p := jobProgressFrom(ctx)
+	p.update(true, func(ev *ProgressEvent) { ev.TotalBytes = min(b.Size, maxParseBytes) })
+	content, err := io.ReadAll(io.LimitReader(p.reader(body), maxParseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	truncated := len(content) > maxParseBytes
+	if truncated {
+		content = content[:maxParseBytes]
+	}
+
+	// As at upload, a cut-off JSON document or zip can't be read
+	var convs []extract.Conversation
+	if b.FileType == "text" || (!truncated && (b.FileType == "json" || b.FileType == "zip")) {
+		convs = extract.Parse(b.Name, content)
+	}
+	p.update(true, func(ev *ProgressEvent) {
+		ev.State = progressProcessing
+		ev.Total = len(convs)
+	})
+
+	projects, err := db.Projects().List(ctx, job.UserID)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, project := range projects {
+		if project.BackupID == b.ID {
+			existing[project.Name] = true
+		}
+	}
+	saved := saveExtractedProjects(ctx, jobActor(job), b, convs, existing)
+	return map[string]interface{}{
+		"backup_id":     b.ID,
+		"conversations": len(convs),
+		"projects":      len(saved),
+		"truncated":     truncated,
+	}, nil
+}
+
+type qrBatchPayload struct {
+	Items []qrBatchItem `json:"items"`
+	// Query is the batch's options, as createQRBatchHandler reads them
+	Query string `json:"query"`
+	// TeamID is the team the codes are made in, if any
+	TeamID string `json:"team_id,omitempty"`
+}
+
+// runQRBatchJob renders a batch as createQRBatchHandler does and stores
+// the file for /api/jobs/{id}/result.
+func runQRBatchJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload qrBatchPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+	if payload.TeamID != "" {
+		ctx = storage.WithTeam(ctx, payload.TeamID)
+	}
+	q, err := url.ParseQuery(payload.Query)
+	if err != nil {
+		return nil, err
+	}
+	if blobStore == nil {
+		return nil, errors.New("no blob store to keep the batch in")
+	}
+
+	// The template or logo may have gone since the batch was accepted
+	batch, err := prepareQRBatch(ctx, job.UserID, payload.Items, q)
+	if err != nil {
+		return nil, &jobError{err.Error()}
+	}
+	p := jobProgressFrom(ctx)
+	p.update(true, func(ev *ProgressEvent) { ev.Total = len(payload.Items) })
+	out, err := batch.render(ctx, jobActor(job), p)
+	var invalid *qrBatchInvalid
+	if errors.As(err, &invalid) {
+		return nil, &jobError{err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.state(progressProcessing)
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(out.write(pw)) }()
+	if err := blobStore.PutStream(ctx, jobFileKey(job), pr, out.contentType()); err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
+	return map[string]interface{}{
+		"codes":        len(payload.Items),
+		"filename":     out.filename(),
+		"content_type": out.contentType(),
+	}, nil
+}
+
+// runKeyRotationJob re-encrypts backups under older server keys, as the
+// scheduled rotation does.
+func runKeyRotationJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	if !keyRotation.rotate() {
+		return nil, &jobError{"A key rotation is already running"}
+	}
+	return keyRotation.lastRun(), nil
+}
+
+// Handlers
+
+// writeJobAccepted answers a request that queued job with 202 and where to
+// follow it.
+func writeJobAccepted(w http.ResponseWriter, job storage.Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// writeEnqueueError answers a request whose job couldn't be queued.
+func writeEnqueueError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, queue.ErrFull) {
+		http.Error(w, "Too many jobs are waiting; try again later", http.StatusServiceUnavailable)
+		return
+	}
+	logger(r.Context()).Error("Error queueing job", "error", err)
+	http.Error(w, "Error queueing job", http.StatusInternalServerError)
+}
+
+func getJobsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	jobs, err := db.Jobs().List(r.Context(), userID, jobListLimit, internalJobTypes()...)
+	if err != nil {
+		writeStorageError(w, r, err, "Jobs")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	job, err := db.Jobs().Get(r.Context(), userID, id)
+	if err == nil && internalJobs[job.Type] {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Job")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// getJobResultHandler downloads the file a completed job made.
+func getJobResultHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+	liftDeadlines(w)
+
+	job, err := db.Jobs().Get(r.Context(), userID, id)
+	if err == nil && internalJobs[job.Type] {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Job")
+		return
+	}
+	if !jobsWithFiles[job.Type] {
+		http.Error(w, "This job doesn't make a file", http.StatusNotFound)
+		return
+	}
+	if job.Status != storage.JobCompleted {
+		http.Error(w, "The job hasn't completed", http.StatusConflict)
+		return
+	}
+	var result struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+	}
+	json.Unmarshal(job.Result, &result)
+
+	body, err := blobStore.Get(r.Context(), jobFileKey(job))
+	if err != nil {
+		logger(r.Context()).Error("Error reading job file", "job_id", job.ID, "error", err)
+		http.Error(w, "Error reading the job's file", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", result.ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+result.Filename+`"`)
+	io.Copy(w, body)
+}
+
+// parseBackupHandler queues reading a backup in full for projects, past
+// what was looked at when it was uploaded.
+func parseBackupHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if _, err := db.Backups().Get(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	job, err := enqueueJob(r.Context(), userID, jobBackupParse, backupParsePayload{
+		BackupID: id,
+		TeamID:   storage.TeamFrom(r.Context()),
+	})
+	if err != nil {
+		writeEnqueueError(w, r, err)
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "backup.parse_requested",
+		ResourceType: "backup",
+		ResourceID:   id,
+		Metadata:     map[string]interface{}{"job_id": job.ID},
+	})
+	writeJobAccepted(w, job)
+}
+
+// createQRBatchJobHandler takes a batch as createQRBatchHandler does but
+// renders it in the background; the file is at /api/jobs/{id}/result once
+// the job completes. The batch is checked before it is queued.
+func createQRBatchJobHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	r.Body = http.MaxBytesReader(w, r.Body, maxQRBatchBytes)
+
+	items, err := readQRBatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := prepareQRBatch(r.Context(), userID, items, r.URL.Query()); err != nil {
+		writeQRBatchFailure(w, err)
+		return
+	}
+	job, err := enqueueJob(r.Context(), userID, jobQRBatch, qrBatchPayload{
+		Items:  items,
+		Query:  r.URL.RawQuery,
+		TeamID: storage.TeamFrom(r.Context()),
+	})
+	if err != nil {
+		writeEnqueueError(w, r, err)
+		return
+	}
+	writeJobAccepted(w, job)
+}
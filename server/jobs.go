@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+const maintenancePollInterval = 5 * time.Second
+
+// startPeriodicJob runs fn every interval in its own goroutine. Runs are
+// skipped while maintenance mode is enabled.
+func startPeriodicJob(name string, interval time.Duration, fn func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if maintenance.Enabled() {
+				slog.Info("Skipping job: maintenance mode enabled", "job", name)
+				continue
+			}
+			fn()
+		}
+	}()
+}
+
+// waitOutMaintenance blocks queue workers until maintenance mode is lifted.
+func waitOutMaintenance() {
+	for maintenance.Enabled() {
+		time.Sleep(maintenancePollInterval)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"backup-manager/config"
+)
+
+const defaultSecretsRefreshInterval = 5 * time.Minute
+
+// jwtKeyring holds the secrets access tokens are signed with. JWT_SECRET
+// signs, and each token names its key by a "kid" header. Tokens under the
+// secret it replaced stay valid: JWT_SECRET_PREVIOUS is accepted for as
+// long as it is set, and a secret rotated while the server runs, in its
+// file or secret manager, until the tokens it signed have expired.
+type jwtKeyring struct {
+	mu       sync.RWMutex
+	current  []byte
+	previous []retiredJWTKey
+}
+
+type retiredJWTKey struct {
+	secret []byte
+	// Zero for JWT_SECRET_PREVIOUS, which stays until it is unset
+	until time.Time
+}
+
+var jwtKeys = &jwtKeyring{}
+
+// jwtKeyID names secret in a token's header without giving it away.
+func jwtKeyID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:8])
+}
+
+// load reads the secrets from the configuration. A changed JWT_SECRET
+// retires the one before it; an empty or short one is refused, keeping the
+// keys as they were.
+func (kr *jwtKeyring) load() error {
+	secret := []byte(config.Get("JWT_SECRET"))
+	if len(secret) < 32 {
+		return errors.New("JWT_SECRET must be at least 32 bytes")
+	}
+	var previous []byte
+	if v := config.Get("JWT_SECRET_PREVIOUS"); v != "" {
+		previous = []byte(v)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	now := time.Now()
+	kept := kr.previous[:0]
+	for _, k := range kr.previous {
+		if !k.until.IsZero() && now.Before(k.until) {
+			kept = append(kept, k)
+		}
+	}
+	if kr.current != nil && !bytes.Equal(kr.current, secret) {
+		kept = append(kept, retiredJWTKey{secret: kr.current, until: now.Add(accessTokenTTL)})
+		slog.Info("JWT secret rotated", "kid", jwtKeyID(secret), "previous_kid", jwtKeyID(kr.current))
+	}
+	if previous != nil {
+		kept = append(kept, retiredJWTKey{secret: previous})
+	}
+	kr.current, kr.previous = secret, kept
+	return nil
+}
+
+// sign returns claims as a token signed with the current secret.
+func (kr *jwtKeyring) sign(claims jwt.Claims) (string, error) {
+	kr.mu.RLock()
+	secret := kr.current
+	kr.mu.RUnlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = jwtKeyID(secret)
+	return token.SignedString(secret)
+}
+
+// keyFunc picks the secret to check token with by its kid. Tokens from
+// before kid was set are checked with the current secret.
+func (kr *jwtKeyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" || kid == jwtKeyID(kr.current) {
+		return kr.current, nil
+	}
+	now := time.Now()
+	for _, k := range kr.previous {
+		if (k.until.IsZero() || now.Before(k.until)) && kid == jwtKeyID(k.secret) {
+			return k.secret, nil
+		}
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+// signingKey is the current secret.
+func (kr *jwtKeyring) signingKey() []byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current
+}
+
+// refreshSecrets fetches secrets from their secret managers again and
+// reloads the JWT secrets, so one rotated in a file or secret manager takes
+// over without a restart.
+func refreshSecrets() {
+	if err := config.Refresh(); err != nil {
+		slog.Warn("Error refreshing secrets", "error", err)
+	}
+	if err := jwtKeys.load(); err != nil {
+		slog.Error("Error reloading JWT secret, keeping the current one", "error", err)
+	}
+}
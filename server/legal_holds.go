@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// LegalHold preserves backups; see storage.LegalHold.
+type LegalHold = storage.LegalHold
+
+// legalHoldRegistry reads holds from the database every time it is asked,
+// so a hold placed on one instance stops deletions on all of them.
+type legalHoldRegistry struct{}
+
+var legalHolds = &legalHoldRegistry{}
+
+func (reg *legalHoldRegistry) place(ctx context.Context, hold LegalHold) (LegalHold, error) {
+	hold.ID = generateID()
+	hold.PlacedAt = time.Now()
+	return hold, db.LegalHolds().Create(ctx, hold)
+}
+
+// release returns ErrNotFound unless the hold is active.
+func (reg *legalHoldRegistry) release(ctx context.Context, id, releasedBy string) (LegalHold, error) {
+	if err := db.LegalHolds().Release(ctx, id, releasedBy, time.Now()); err != nil {
+		return LegalHold{}, err
+	}
+	return db.LegalHolds().Get(ctx, id)
+}
+
+// active returns the holds in force, for checking many backups at once
+// with heldBy.
+func (reg *legalHoldRegistry) active(ctx context.Context) ([]LegalHold, error) {
+	return db.LegalHolds().List(ctx, false)
+}
+
+// backupHeld returns the IDs of active holds covering a backup.
+func (reg *legalHoldRegistry) backupHeld(ctx context.Context, backupID, ownerID string) ([]string, error) {
+	holds, err := reg.active(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return heldBy(holds, backupID, ownerID), nil
+}
+
+// heldBy returns the IDs of the holds covering a backup.
+func heldBy(holds []LegalHold, backupID, ownerID string) []string {
+	var ids []string
+	for _, hold := range holds {
+		if contains(hold.BackupIDs, backupID) || contains(hold.UserIDs, ownerID) {
+			ids = append(ids, hold.ID)
+		}
+	}
+	return ids
+}
+
+// userHeld reports whether any active hold covers data owned by the user.
+// Account retention and userKeys.destroy check it, since either would make
+// held backups unrecoverable.
+func (reg *legalHoldRegistry) userHeld(ctx context.Context, userID string) (bool, error) {
+	holds, err := reg.active(ctx)
+	if err != nil {
+		return false, err
+	}
+	var backupIDs []string
+	for _, hold := range holds {
+		if contains(hold.UserIDs, userID) {
+			return true, nil
+		}
+		backupIDs = append(backupIDs, hold.BackupIDs...)
+	}
+
+	// Holds on individual backups cover the user if they own one
+	for _, id := range backupIDs {
+		_, err := db.Backups().Get(ctx, userID, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			// A backup in the trash can still be restored
+			_, err = db.Backups().GetTrashed(ctx, userID, id)
+		}
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			// Fail closed: an unreadable backup may be held
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func writeLegalHoldError(w http.ResponseWriter, holdIDs []string) {
+	writeAPIError(w, &apiError{
+		Status:  http.StatusConflict,
+		Code:    "legal_hold",
+		Message: "This backup is under legal hold and cannot be deleted.",
+		Details: map[string]interface{}{"hold_ids": holdIDs},
+	})
+}
+
+// Handlers
+func deleteBackupHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	backup, err := db.Backups().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+
+	holdIDs, err := legalHolds.backupHeld(r.Context(), id, backup.UserID)
+	if err != nil {
+		writeStorageError(w, r, err, "Legal holds")
+		return
+	}
+	if len(holdIDs) > 0 {
+		recordAudit(r, AuditEvent{
+			Action:       "backup.delete_blocked",
+			ResourceType: "backup",
+			ResourceID:   id,
+			Metadata:     map[string]interface{}{"hold_ids": holdIDs},
+		})
+		writeLegalHoldError(w, holdIDs)
+		return
+	}
+
+	// Projects extracted from the backup go to the trash with it
+	removed, err := trashSearchDocuments(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+	deletedAt := time.Now()
+	if err := db.Backups().Trash(r.Context(), userID, id, deletedAt); err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	removeDocuments(removed...)
+
+	recordAudit(r, AuditEvent{Action: "backup.deleted", ResourceType: "backup", ResourceID: id})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "backup.deleted",
+		AggregateType: aggregateBackup,
+		AggregateID:   id,
+		OwnerID:       userID,
+		Before:        snapshot(backup),
+	}, map[string]interface{}{"purge_at": purgeAt(&deletedAt)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason    string   `json:"reason" validate:"required,max=1000"`
+		BackupIDs []string `json:"backup_ids"`
+		UserIDs   []string `json:"user_ids"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if len(req.BackupIDs) == 0 && len(req.UserIDs) == 0 {
+		writeFieldError(w, "backup_ids", "required", "backup_ids or user_ids is required")
+		return
+	}
+
+	hold, err := legalHolds.place(r.Context(), LegalHold{
+		Reason:    req.Reason,
+		BackupIDs: append([]string{}, req.BackupIDs...),
+		UserIDs:   append([]string{}, req.UserIDs...),
+		PlacedBy:  r.Header.Get("X-User-Email"),
+	})
+	if err != nil {
+		writeStorageError(w, r, err, "Legal hold")
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "legal_hold.placed",
+		ResourceType: "legal_hold",
+		ResourceID:   hold.ID,
+		Metadata: map[string]interface{}{
+			"reason":     hold.Reason,
+			"backup_ids": hold.BackupIDs,
+			"user_ids":   hold.UserIDs,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hold)
+}
+
+func getLegalHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	holds, err := db.LegalHolds().List(r.Context(), r.URL.Query().Get("include_released") == "true")
+	if err != nil {
+		writeStorageError(w, r, err, "Legal holds")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(holds)
+}
+
+func releaseLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	hold, err := legalHolds.release(r.Context(), mux.Vars(r)["id"], r.Header.Get("X-User-Email"))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Active legal hold not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Legal hold")
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "legal_hold.released",
+		ResourceType: "legal_hold",
+		ResourceID:   hold.ID,
+		Metadata: map[string]interface{}{
+			"backup_ids": hold.BackupIDs,
+			"user_ids":   hold.UserIDs,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hold)
+}
@@ -0,0 +1,62 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Embedder turns texts into vectors whose distance reflects how close their
+// meanings are. Vectors from different models are not comparable.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+	Name() string
+}
+
+// OpenAIEmbeddings calls the embeddings API. As with OpenAI, point URL at a
+// compatible server to use a local model.
+type OpenAIEmbeddings struct {
+	URL    string // base URL; https://api.openai.com/v1 when empty
+	APIKey string
+	Model  string
+}
+
+func (o *OpenAIEmbeddings) Name() string {
+	return "openai/" + o.Model
+}
+
+func (o *OpenAIEmbeddings) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	base := strings.TrimRight(o.URL, "/")
+	if base == "" {
+		base = "https://api.openai.com/v1"
+	}
+	headers := map[string]string{}
+	if o.APIKey != "" {
+		headers["Authorization"] = "Bearer " + o.APIKey
+	}
+
+	var resp struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"model": o.Model, "input": texts}
+	if err := postJSON(ctx, defaultClient(nil), base+"/embeddings", headers, body, &resp); err != nil {
+		return nil, fmt.Errorf("llm: openai embeddings: %w", err)
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, d := range resp.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("llm: openai embeddings: index %d out of range", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	for i, v := range vectors {
+		if v == nil {
+			return nil, fmt.Errorf("llm: openai embeddings: no vector for input %d", i)
+		}
+	}
+	return vectors, nil
+}
@@ -0,0 +1,178 @@
+// Package llm sends prompts to large language models and embeds text with
+// them. Providers are interchangeable so each deployment chooses a hosted
+// API or a model it runs itself.
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Prompt is one request: instructions for the model and the text to work on.
+type Prompt struct {
+	System    string
+	User      string
+	MaxTokens int
+}
+
+// Provider completes prompts.
+type Provider interface {
+	Complete(ctx context.Context, p Prompt) (string, error)
+	// Name identifies the provider and model, e.g. "openai/gpt-4o-mini",
+	// so generated text can be traced to what wrote it.
+	Name() string
+}
+
+const defaultMaxTokens = 512
+
+func defaultClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return &http.Client{Timeout: 2 * time.Minute}
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// OpenAI calls the chat completions API. Point URL at any compatible server
+// (Ollama, vLLM, llama.cpp, LM Studio) to use a local model; APIKey may then
+// be empty.
+type OpenAI struct {
+	URL    string // base URL; https://api.openai.com/v1 when empty
+	APIKey string
+	Model  string
+	Client *http.Client
+}
+
+func (o *OpenAI) Name() string {
+	return "openai/" + o.Model
+}
+
+func (o *OpenAI) Complete(ctx context.Context, p Prompt) (string, error) {
+	base := strings.TrimRight(o.URL, "/")
+	if base == "" {
+		base = "https://api.openai.com/v1"
+	}
+	if p.MaxTokens <= 0 {
+		p.MaxTokens = defaultMaxTokens
+	}
+
+	type message struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+	body := map[string]interface{}{
+		"model":      o.Model,
+		"max_tokens": p.MaxTokens,
+		"messages": []message{
+			{Role: "system", Content: p.System},
+			{Role: "user", Content: p.User},
+		},
+	}
+	headers := map[string]string{}
+	if o.APIKey != "" {
+		headers["Authorization"] = "Bearer " + o.APIKey
+	}
+
+	var resp struct {
+		Choices []struct {
+			Message message `json:"message"`
+		} `json:"choices"`
+	}
+	if err := postJSON(ctx, defaultClient(o.Client), base+"/chat/completions", headers, body, &resp); err != nil {
+		return "", fmt.Errorf("llm: openai: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("llm: openai: no choices in response")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// Anthropic calls the Messages API.
+type Anthropic struct {
+	URL    string // base URL; https://api.anthropic.com/v1 when empty
+	APIKey string
+	Model  string
+	Client *http.Client
+}
+
+const anthropicVersion = "2023-06-01"
+
+func (a *Anthropic) Name() string {
+	return "anthropic/" + a.Model
+}
+
+func (a *Anthropic) Complete(ctx context.Context, p Prompt) (string, error) {
+	base := strings.TrimRight(a.URL, "/")
+	if base == "" {
+		base = "https://api.anthropic.com/v1"
+	}
+	if p.MaxTokens <= 0 {
+		p.MaxTokens = defaultMaxTokens
+	}
+
+	body := map[string]interface{}{
+		"model":      a.Model,
+		"max_tokens": p.MaxTokens,
+		"system":     p.System,
+		"messages": []map[string]string{
+			{"role": "user", "content": p.User},
+		},
+	}
+	headers := map[string]string{
+		"x-api-key":         a.APIKey,
+		"anthropic-version": anthropicVersion,
+	}
+
+	var resp struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := postJSON(ctx, defaultClient(a.Client), base+"/messages", headers, body, &resp); err != nil {
+		return "", fmt.Errorf("llm: anthropic: %w", err)
+	}
+
+	var text strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return strings.TrimSpace(text.String()), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+)
+
+// requestIDPattern is what an X-Request-ID from a client or proxy must look
+// like to be kept; anything else is replaced so it can't forge log lines.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// initLogging sends logs, including those of packages still using the log
+// package, to stderr as JSON lines at LOG_LEVEL (debug, info, warn or error).
+func initLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Get("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
+
+// fatal logs msg as an error and exits, for configuration the server can't
+// start without.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestLog is the logger of one request. It is shared by every context
+// derived from the request, so fields added once the route and user are
+// known reach both the handler's logs and the request's own log line.
+type requestLog struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+type requestLogKey struct{}
+
+// logger returns the logger for ctx: the request's, carrying its request ID,
+// route and user, or the default logger outside a request.
+func logger(ctx context.Context) *slog.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return rl.logger
+	}
+	return slog.Default()
+}
+
+// addLogAttrs adds fields to every later log line of the request.
+func addLogAttrs(r *http.Request, args ...any) {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		rl.mu.Lock()
+		rl.logger = rl.logger.With(args...)
+		rl.mu.Unlock()
+	}
+}
+
+// requestLogging gives each request an ID, taken from X-Request-ID when the
+// caller sent a usable one, returns it in the response and logs the request
+// once it is served.
+func requestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := strings.TrimSpace(r.Header.Get("X-Request-ID"))
+		if !requestIDPattern.MatchString(id) {
+			id = generateID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(r.Context(), requestLogKey{}, &requestLog{logger: slog.Default().With("request_id", id)})
+		rec := &usageRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger(ctx).Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"ip", clientIP(r),
+		)
+	})
+}
+
+// routeLogging adds the matched route's template, such as
+// /api/backups/{id}, to the request's logs so requests for different IDs
+// can be grouped.
+func routeLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				addLogAttrs(r, "route", tmpl)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+)
+
+const (
+	defaultLoginBackoffAfter   = 3  // failures before each attempt must wait
+	defaultLoginLockoutAfter   = 10 // failures on an account before it is locked
+	defaultLoginIPLockoutAfter = 50 // failures from an address before it is locked
+	defaultLoginLockout        = 15 * time.Minute
+
+	loginBackoffBase = time.Second
+	maxLoginLockout  = 24 * time.Hour
+	loginWindow      = time.Hour // failures older than this are forgotten
+)
+
+// loginGuard counts failed logins by account and by client address. After
+// LOGIN_BACKOFF_AFTER failures each attempt on the account must wait twice
+// as long as the last, and after LOGIN_LOCKOUT_AFTER it is locked for
+// LOGIN_LOCKOUT_DURATION, doubling with every lockout in the window. An
+// address trying many accounts is locked the same way after
+// LOGIN_IP_LOCKOUT_AFTER failures, without backing off first, as many
+// people may share it.
+//
+// Accounts are counted by the email given, whether or not one has it, so
+// the answers don't tell which emails are registered. A locked account
+// can't log in even with the right password until the lockout ends, a
+// password reset clears it, or an admin unlocks it. The counts are kept in
+// the database, so every server enforces them and an unlock ends the
+// lockout everywhere.
+type loginGuard struct{}
+
+var loginAttempts loginGuard
+
+func loginAccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func loginSetting(name string, def int) int {
+	if n, err := strconv.Atoi(config.Get(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// wait returns how long until key may try again, and whether that is
+// because it is locked rather than backing off.
+func (loginGuard) wait(ctx context.Context, key string) (time.Duration, bool, error) {
+	f, err := db.Attempts().Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if f.LockedUntil != nil {
+		if remaining := time.Until(*f.LockedUntil); remaining > 0 {
+			return remaining, true, nil
+		}
+	}
+	if f.RetryAt != nil {
+		return max(time.Until(*f.RetryAt), 0), false, nil
+	}
+	return 0, false, nil
+}
+
+// fail records a failed attempt for key, returning the failures in the
+// window and the lockout it started, if any. backoffAfter is 0 for keys
+// that only lock.
+func (loginGuard) fail(ctx context.Context, key string, backoffAfter, lockAfter int) (failures int, locked time.Duration, err error) {
+	now := time.Now()
+	f, err := db.Attempts().Fail(ctx, key, now, now.Add(-loginWindow))
+	if err != nil {
+		return 0, 0, err
+	}
+	if f.Failures%lockAfter == 0 {
+		locked = doubled(loginLockout(), f.Lockouts, maxLoginLockout)
+		return f.Failures, locked, db.Attempts().Lock(ctx, key, now.Add(locked))
+	}
+	if extra := f.Failures%lockAfter - backoffAfter; backoffAfter > 0 && extra >= 0 {
+		return f.Failures, 0, db.Attempts().Delay(ctx, key, now.Add(doubled(loginBackoffBase, extra, loginLockout())))
+	}
+	return f.Failures, 0, nil
+}
+
+func (loginGuard) reset(ctx context.Context, key string) error {
+	return db.Attempts().Reset(ctx, key)
+}
+
+// pruneFailedAttempts forgets the failed logins and QR passwords that no
+// longer count.
+func pruneFailedAttempts() {
+	now := time.Now()
+	if err := db.Attempts().Prune(context.Background(), now, now.Add(-max(loginWindow, qrPasswordWindow))); err != nil {
+		slog.Error("Failed to prune failed attempts", "error", err)
+	}
+}
+
+// doubled is d doubled n times, but no more than limit.
+func doubled(d time.Duration, n int, limit time.Duration) time.Duration {
+	for ; n > 0 && d < limit; n-- {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+func loginLockout() time.Duration {
+	return durationSetting("LOGIN_LOCKOUT_DURATION", defaultLoginLockout)
+}
+
+// guardLoginAttempt must run before checking a password for email. It
+// writes a 429 with Retry-After and returns false while the account or
+// the client's address is locked or backing off.
+func guardLoginAttempt(w http.ResponseWriter, r *http.Request, email string) bool {
+	wait, locked, err := loginAttempts.wait(r.Context(), loginAccountKey(email))
+	if err != nil {
+		writeStorageError(w, r, err, "Login attempts")
+		return false
+	}
+	ipWait, ipLocked, err := loginAttempts.wait(r.Context(), loginIPKey(clientIP(r)))
+	if err != nil {
+		writeStorageError(w, r, err, "Login attempts")
+		return false
+	}
+	if ipWait > wait {
+		wait, locked = ipWait, ipLocked
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if locked {
+		writeError(w, http.StatusTooManyRequests, errCodeLoginLocked, "Too many failed login attempts, try again later")
+	} else {
+		writeError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many failed login attempts, slow down")
+	}
+	return false
+}
+
+// recordLoginFailure counts a wrong password, or an unknown email, against
+// the account and the client's address. userID is "" for an unknown email.
+func recordLoginFailure(r *http.Request, email, userID string) {
+	failures, locked, err := loginAttempts.fail(r.Context(), loginAccountKey(email),
+		loginSetting("LOGIN_BACKOFF_AFTER", defaultLoginBackoffAfter),
+		loginSetting("LOGIN_LOCKOUT_AFTER", defaultLoginLockoutAfter))
+	if err != nil {
+		logger(r.Context()).Error("Error counting failed login", "error", err)
+	}
+	ip := clientIP(r)
+	ipFailures, ipLocked, err := loginAttempts.fail(r.Context(), loginIPKey(ip), 0,
+		loginSetting("LOGIN_IP_LOCKOUT_AFTER", defaultLoginIPLockoutAfter))
+	if err != nil {
+		logger(r.Context()).Error("Error counting failed login", "error", err)
+	}
+
+	recordAudit(r, AuditEvent{
+		UserID:       userID,
+		Action:       "auth.login_failed",
+		ResourceType: "user",
+		ResourceID:   userID,
+		Metadata:     map[string]interface{}{"email": email, "failures": failures, "ip_failures": ipFailures},
+	})
+	if locked > 0 {
+		recordAudit(r, AuditEvent{
+			UserID:       userID,
+			Action:       "auth.account_locked",
+			ResourceType: "user",
+			ResourceID:   userID,
+			Metadata:     map[string]interface{}{"email": email, "failures": failures, "locked_for": locked.String()},
+		})
+	}
+	if ipLocked > 0 {
+		recordAudit(r, AuditEvent{
+			UserID:       userID,
+			Action:       "auth.address_locked",
+			ResourceType: "ip_address",
+			ResourceID:   ip,
+			Metadata:     map[string]interface{}{"failures": ipFailures, "locked_for": ipLocked.String()},
+		})
+	}
+}
+
+// recordLoginSuccess clears the account's failures. The address's are kept,
+// so logging in to one account between guesses at others doesn't reset them.
+func recordLoginSuccess(ctx context.Context, email string) {
+	if err := loginAttempts.reset(ctx, loginAccountKey(email)); err != nil {
+		logger(ctx).Error("Error clearing failed logins", "error", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"strings"
+
+	"backup-manager/config"
+)
+
+// sendEmail delivers a plain-text message over SMTP. When SMTP_HOST is not
+// configured the message is logged instead, which is enough for development.
+func sendEmail(to, subject, body string) error {
+	host := config.Get("SMTP_HOST")
+	if host == "" {
+		slog.Info("Email not sent, SMTP_HOST is not set", "to", to, "subject", subject, "body", body)
+		return nil
+	}
+
+	port := config.Get("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := config.Get("SMTP_FROM")
+	if from == "" {
+		from = "no-reply@" + host
+	}
+
+	var auth smtp.Auth
+	if username := config.Get("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, config.Get("SMTP_PASSWORD"), host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(host+":"+port, auth, from, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("sending email to %s: %w", to, err)
+	}
+	return nil
+}
+
+// frontendLink builds an absolute link into the frontend app.
+func frontendLink(path string) string {
+	return strings.TrimRight(config.Get("FRONTEND_URL"), "/") + path
+}
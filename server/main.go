@@ -1,145 +1,200 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
-)
 
-var (
-	jwtSecret     = []byte(os.Getenv("JWT_SECRET"))
-	encryptionKey = []byte(os.Getenv("ENCRYPTION_KEY"))
+	"backup-manager/config"
+	"backup-manager/extract"
+	"backup-manager/storage"
 )
 
-type User struct {
-	ID           string    `json:"id"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	CreatedAt    time.Time `json:"created_at"`
-}
-
-type Backup struct {
-	ID             string    `json:"id"`
-	UserID         string    `json:"user_id"`
-	Name           string    `json:"name"`
-	Source         string    `json:"source"`
-	Size           int64     `json:"size"`
-	Timestamp      time.Time `json:"timestamp"`
-	ContentPreview string    `json:"content_preview"`
-	EncryptedData  string    `json:"encrypted_data"`
-}
-
-type Project struct {
-	ID          string    `json:"id"`
-	UserID      string    `json:"user_id"`
-	BackupID    string    `json:"backup_id"`
-	Name        string    `json:"name"`
-	Type        string    `json:"type"`
-	Description string    `json:"description"`
-	Source      string    `json:"source"`
-	Language    string    `json:"language"`
-	LinesOfCode int       `json:"lines_of_code"`
-	Features    []string  `json:"features"`
-	Code        string    `json:"code"`
-	Timestamp   time.Time `json:"timestamp"`
-	Tags        []string  `json:"tags"`
-	Starred     bool      `json:"starred"`
-}
+// maxProcessedBytes is how much of an upload is kept in memory for its
+// preview, thumbnails, OCR, summary and embedding. Larger files are stored
+// whole but only their start is looked at.
+const maxProcessedBytes = 10 << 20
+
+// The records handlers work with are defined with the storage layer.
+type (
+	User    = storage.User
+	Backup  = storage.Backup
+	Project = storage.Project
+	QRCode  = storage.QRCode
+)
 
 type Claims struct {
 	UserID string `json:"user_id"`
 	Email  string `json:"email"`
+	// Role is for the frontend to show; routes that need a role check it
+	// against the database
+	Role string `json:"role,omitempty"`
+	// SessionID is the login the token was issued for
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
 // Encryption functions
+
+// encrypt seals plaintext with the current server key, tagging the result
+// with the key's version so it can still be opened after a rotation.
 func encrypt(plaintext string) (string, error) {
-	block, err := aes.NewCipher(encryptionKey)
+	ciphertext, err := sealWithKey(serverKeys.keys[serverKeys.current], []byte(plaintext))
 	if err != nil {
 		return "", err
 	}
+	return "v" + strconv.Itoa(serverKeys.current) + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
 
-	gcm, err := cipher.NewGCM(block)
+func decrypt(ciphertext string) (string, error) {
+	version, body, ok := splitKeyVersion(ciphertext)
+	if !ok {
+		version = untaggedKeyVersion
+	}
+	key, ok := serverKeys.keys[version]
+	if !ok {
+		return "", fmt.Errorf("encryption key version %d is not configured", version)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(body)
 	if err != nil {
 		return "", err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	plaintext, err := openWithKey(key, data)
+	if err != nil {
 		return "", err
 	}
-
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	return string(plaintext), nil
 }
 
-func decrypt(ciphertext string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(ciphertext)
+// sealWithKey encrypts with AES-GCM under key, prefixing the random nonce.
+func sealWithKey(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	block, err := aes.NewCipher(encryptionKey)
+	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openWithKey(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
 	}
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	nonceSize := gcm.NonceSize()
 	if len(data) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
-	}
-
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("ciphertext too short")
 	}
 
-	return string(plaintext), nil
+	nonce, sealed := data[:nonceSize], data[nonceSize:]
+	return gcm.Open(nil, nonce, sealed, nil)
 }
 
-// JWT Middleware
+// JWT Middleware. Users who have not accepted the current policies are
+// refused, except by the routes that let them review and accept them.
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return policyExemptMiddleware(policyMiddleware(next))
+}
+
+// policyExemptMiddleware authenticates as authMiddleware does, without
+// requiring the current policies to have been accepted.
+func policyExemptMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	next = workspaceMiddleware(next)
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Never trust a key or session ID supplied by the client
+		r.Header.Del("X-API-Key-ID")
+		r.Header.Del("X-Session-ID")
+
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			serveWithAPIKey(w, r, apiKey, next)
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Authorization required", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, errCodeAuthRequired, "Authorization required")
 			return
 		}
 
 		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
+		if strings.HasPrefix(tokenString, apiKeyPrefix) {
+			serveWithAPIKey(w, r, tokenString, next)
+			return
+		}
+
 		claims := &Claims{}
 
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
+		token, err := jwt.ParseWithClaims(tokenString, claims, jwtKeys.keyFunc)
 
 		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid token")
+			return
+		}
+		if claims.IssuedAt != nil && revokedSessions.revoked(claims.UserID, claims.IssuedAt.Time) {
+			writeError(w, http.StatusUnauthorized, errCodeSessionEnded, "Session ended, log in again")
+			return
+		}
+		if claims.SessionID != "" {
+			active, err := sessionChecks.active(r.Context(), claims.SessionID, claims.UserID, clientIP(r))
+			if err != nil {
+				logger(r.Context()).Error("Error loading session", "error", err)
+				writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+				return
+			}
+			if !active {
+				writeError(w, http.StatusUnauthorized, errCodeSessionEnded, "Session ended, log in again")
+				return
+			}
+		}
+
+		addLogAttrs(r, "user_id", claims.UserID)
+
+		// API keys have limits of their own, checked in serveWithAPIKey
+		if !limitRequest(w, userLimiter, claims.UserID, rateLimitSetting("USER_RATE_LIMIT", defaultUserRateLimit)) {
 			return
 		}
 
 		r.Header.Set("X-User-ID", claims.UserID)
+		r.Header.Set("X-User-Email", claims.Email)
+		r.Header.Set("X-Session-ID", claims.SessionID)
 		next(w, r)
 	}
 }
@@ -147,16 +202,26 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 // Handlers
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email          string `json:"email" validate:"required,email"`
+		Password       string `json:"password" validate:"required,password"`
+		AcceptPolicies bool   `json:"accept_policies"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
 	}
+	req.Email = strings.TrimSpace(req.Email)
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	current, err := policies.current(r.Context())
+	if err != nil {
+		writeStorageError(w, r, err, "Policies")
+		return
+	}
+	if len(current) > 0 && !req.AcceptPolicies {
+		http.Error(w, "You must accept the terms of service and privacy policy", http.StatusBadRequest)
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
@@ -165,11 +230,37 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	user := User{
 		ID:           generateID(),
 		Email:        req.Email,
-		PasswordHash: string(hashedPassword),
+		PasswordHash: hashedPassword,
 		CreatedAt:    time.Now(),
 	}
 
-	// Store user in database (implement your DB logic here)
+	if err := db.Users().Create(r.Context(), user); err != nil {
+		if errors.Is(err, storage.ErrConflict) {
+			http.Error(w, "An account with this email already exists", http.StatusConflict)
+			return
+		}
+		logger(r.Context()).Error("Error storing user", "error", err)
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := userKeys.create(r.Context(), user.ID, req.Password); err != nil {
+		db.Users().Delete(r.Context(), user.ID)
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := policies.acceptCurrent(user.ID, r); err != nil {
+		// The user is asked to accept them again on their first request
+		logger(r.Context()).Error("Error recording policy acceptance", "user_id", user.ID, "error", err)
+	}
+	recordDomainEvent(DomainActor{Type: actorUser, UserID: user.ID}, DomainEvent{
+		Type:          "user.registered",
+		AggregateType: aggregateUser,
+		AggregateID:   user.ID,
+		OwnerID:       user.ID,
+		After:         snapshot(user),
+	}, map[string]interface{}{"email": user.Email})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -180,115 +271,340 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		RecoveryCode string `json:"recovery_code"`
+		TOTPCode     string `json:"totp_code"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if !guardLoginAttempt(w, r, req.Email) {
 		return
 	}
 
-	// Retrieve user from database (implement your DB logic here)
-	// For now, this is a placeholder
-	user := User{
-		ID:           "user123",
-		Email:        req.Email,
-		PasswordHash: "$2a$10$...", // placeholder
+	user, err := db.Users().GetByEmail(r.Context(), req.Email)
+	if errors.Is(err, storage.ErrNotFound) {
+		recordLoginFailure(r, req.Email, "")
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading user", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+	ok, rehash := verifyPassword(r.Context(), user.PasswordHash, req.Password)
+	if !ok {
+		recordLoginFailure(r, req.Email, user.ID)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	recordLoginSuccess(r.Context(), req.Email)
+	if !checkAccountUsable(w, user) {
+		return
+	}
+
+	// Users enrolled in MFA must present a second factor
+	methods, err := secondFactors(r.Context(), user.ID)
+	if err != nil {
+		writeStorageError(w, r, err, "Two-factor authentication")
+		return
+	}
+	if len(methods) > 0 {
+		if !checkSecondFactor(w, r, user.ID, methods, req.TOTPCode, req.RecoveryCode) {
+			return
+		}
+		if req.TOTPCode == "" {
+			logger(r.Context()).Info("User logged in with a recovery code", "user_id", user.ID)
+		}
+	}
 
-	claims := &Claims{
-		UserID: user.ID,
-		Email:  user.Email,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	// After a password reset the old wrapping of the data key no longer
+	// opens; the user can still log in and restore it with a recovery key.
+	dataKeyLocked := errors.Is(userKeys.unlock(r.Context(), user.ID, req.Password), errWrongKey)
+	if rehash {
+		upgradePasswordHash(r.Context(), user, req.Password)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	sessionID, refreshToken, err := startSession(r, user.ID)
+	if err != nil {
+		logger(r.Context()).Error("Error saving session", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	accessToken, err := issueAccessToken(user, sessionID)
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
+	extra := map[string]interface{}{}
+	if dataKeyLocked {
+		extra["data_key"] = "locked"
+	}
+	writeTokens(w, accessToken, refreshToken, extra)
 }
 
 func uploadBackupHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("X-User-ID")
+	liftDeadlines(w)
 
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
+	jobID, ok := progressJobID(r)
+	if !ok {
+		http.Error(w, "Invalid job_id", http.StatusBadRequest)
 		return
 	}
 
-	file, handler, err := r.FormFile("file")
+	// The file is read straight from the request as it is encrypted and
+	// stored, so uploads of any size take the same memory
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Error reading file", http.StatusBadRequest)
+		http.Error(w, "Expected a multipart upload", http.StatusBadRequest)
 		return
 	}
+	var file *multipart.Part
+	for {
+		file, err = reader.NextPart()
+		if err != nil {
+			http.Error(w, "Error reading file", http.StatusBadRequest)
+			return
+		}
+		if file.FormName() == "file" && file.FileName() != "" {
+			break
+		}
+		file.Close()
+	}
 	defer file.Close()
 
-	content, err := io.ReadAll(file)
+	key, keyVersion, err := uploadKey(r.Context(), userID)
+	if errors.Is(err, errDataKeyLocked) {
+		writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error reading file content", http.StatusInternalServerError)
+		http.Error(w, "Error encrypting data", http.StatusInternalServerError)
 		return
 	}
 
-	encryptedContent, err := encrypt(string(content))
+	// The request's length, counting the multipart framing, is as close to
+	// the file's as the client said
+	p := newJobProgress(userID, jobID, progressUpload)
+	p.update(true, func(ev *ProgressEvent) {
+		ev.State = progressRunning
+		ev.TotalBytes = max(r.ContentLength, 0)
+	})
+	ctx := withJobProgress(r.Context(), p)
+	backup, projects, err := saveBackupFile(ctx, requestActor(r), userID, file.FileName(), p.reader(file), key, keyVersion, nil)
+	if errors.Is(err, errQuotaExceeded) {
+		p.failed("Storage quota exceeded")
+		writeQuotaExceeded(w, r)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error encrypting data", http.StatusInternalServerError)
+		logger(r.Context()).Error("Error storing backup", "backup_id", backup.ID, "error", err)
+		p.failed("Error storing backup")
+		http.Error(w, "Error storing backup", http.StatusInternalServerError)
 		return
 	}
+	p.completed(backup.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Backup
+		Projects []Project `json:"projects"`
+	}{backup, append([]Project{}, projects...)})
+}
 
+// saveBackupFile stores what is read from file as the next version of the
+// user's backup named name, in the team ctx is in if any, then previews,
+// indexes and summarizes it and saves the projects in it. eventData is added to its backup.created event.
+// It fails with errQuotaExceeded if the file doesn't fit in the user's
+// storage quota.
+func saveBackupFile(ctx context.Context, actor DomainActor, userID, name string, file io.Reader, key []byte, keyVersion int, eventData map[string]interface{}) (Backup, []Project, error) {
 	backup := Backup{
-		ID:             generateID(),
-		UserID:         userID,
-		Name:           handler.Filename,
-		Source:         detectSource(handler.Filename, string(content)),
-		Size:           handler.Size,
-		Timestamp:      time.Now(),
-		ContentPreview: truncate(string(content), 300),
-		EncryptedData:  encryptedContent,
+		ID:        generateID(),
+		UserID:    userID,
+		TeamID:    storage.TeamFrom(ctx),
+		Name:      name,
+		Timestamp: time.Now(),
+	}
+	file, err := limitToQuota(ctx, userID, file)
+	if err != nil {
+		return backup, nil, err
+	}
+	head := &headBuffer{limit: maxProcessedBytes}
+	if err := writeBackupBlob(ctx, &backup, io.TeeReader(file, head), key, keyVersion); err != nil {
+		return backup, nil, err
+	}
+	jobProgressFrom(ctx).state(progressProcessing)
+	content := head.buf
+
+	preview := previewContent(backup.Name, content, backup.Size)
+	backup.Source = detectSource(backup.Name, preview.SourceHint)
+	backup.FileType = preview.FileType
+	backup.ContentPreview = preview.Text
+
+	// A cut-off JSON document or zip can't be read, but the start of a text
+	// file still holds whole code blocks
+	var convs []extract.Conversation
+	if preview.FileType == "text" || (!head.truncated && (preview.FileType == "json" || preview.FileType == "zip")) {
+		convs = extract.Parse(backup.Name, content)
+	}
+	// An export uploaded as is, rather than through /api/imports, is still
+	// previewed by its conversations
+	if preview.FileType == "json" && !head.truncated {
+		if format := extract.Detect(bytes.NewReader(content)); format != "" {
+			backup.Source = importSources[format]
+			if text := conversationPreview(convs); text != "" {
+				backup.ContentPreview = text
+			}
+		}
 	}
 
-	// Store backup in database (implement your DB logic here)
+	// Only the start of a larger file was kept, which is no use for images
+	if preview.FileType == "image" && !head.truncated {
+		if err := generateThumbnails(userID, backup.ID, content); err != nil {
+			logger(ctx).Error("Error generating thumbnails", "backup_id", backup.ID, "error", err)
+		} else {
+			backup.ThumbnailURL = "/api/backups/" + backup.ID + "/thumbnail"
+		}
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(backup)
+	if err := createBackupVersion(ctx, &backup); err != nil {
+		deleteBackupBlob(ctx, userID, backup.ID)
+		return backup, nil, err
+	}
+
+	doc := backupDocument(backup)
+	indexDocuments(doc)
+	if preview.FileType == "image" && !head.truncated {
+		enqueueOCR(doc, content)
+	}
+	enqueueBackupSummary(backup, content)
+	if preview.FileType == "text" || preview.FileType == "json" {
+		enqueueEmbedding(doc, string(content))
+	}
+
+	projects := saveExtractedProjects(ctx, actor, backup, convs, nil)
+
+	data := map[string]interface{}{
+		"name":      backup.Name,
+		"source":    backup.Source,
+		"size":      backup.Size,
+		"file_type": backup.FileType,
+		"version":   backup.Version,
+		"projects":  len(projects),
+	}
+	for k, v := range eventData {
+		data[k] = v
+	}
+	recordDomainEvent(actor, DomainEvent{
+		Type:          "backup.created",
+		AggregateType: aggregateBackup,
+		AggregateID:   backup.ID,
+		OwnerID:       userID,
+		After:         snapshot(backup),
+	}, data)
+	return backup, projects, nil
 }
 
+// getBackupsHandler lists the latest version of each backup, or every
+// version with ?all_versions=true.
 func getBackupsHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("X-User-ID")
 
-	// Retrieve backups from database for this user
-	backups := []Backup{}
-
-	// Placeholder - implement DB retrieval
-	_ = userID
+	backups, err := db.Backups().List(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Backups")
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(backups)
+	if r.URL.Query().Get("all_versions") == "true" {
+		json.NewEncoder(w).Encode(backups)
+		return
+	}
+	json.NewEncoder(w).Encode(latestVersions(backups))
 }
 
-func getProjectsHandler(w http.ResponseWriter, r *http.Request) {
+// downloadBackupHandler streams a backup's decrypted contents back under
+// its original name. Looking it up by the caller's ID enforces ownership.
+func downloadBackupHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+	liftDeadlines(w)
 
-	// Retrieve projects from database for this user
-	projects := []Project{}
+	backup, err := db.Backups().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+
+	serveBackup(w, r, backup, AuditEvent{Action: "backup.downloaded", ResourceType: "backup", ResourceID: id})
+}
+
+// serveBackup streams the decrypted backup, recording audit once it is
+// known to open.
+func serveBackup(w http.ResponseWriter, r *http.Request, backup Backup, audit AuditEvent) {
+	id := backup.ID
+	plaintext, err := openBackup(r.Context(), backup)
+	if errors.Is(err, errDataKeyLocked) {
+		writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error opening backup", "backup_id", id, "error", err)
+		http.Error(w, "Error decrypting backup", http.StatusInternalServerError)
+		return
+	}
+	defer plaintext.Close()
+
+	// Reading the start also catches a bad first chunk while an error can
+	// still be sent
+	content := bufio.NewReaderSize(plaintext, 512)
+	head, err := content.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		logger(r.Context()).Error("Error decrypting backup", "backup_id", id, "error", err)
+		http.Error(w, "Error decrypting backup", http.StatusInternalServerError)
+		return
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(backup.Name))
+	if contentType == "" {
+		contentType = http.DetectContentType(head)
+	}
 
-	// Placeholder - implement DB retrieval
-	_ = userID
+	recordAudit(r, audit)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": backup.Name}))
+	w.Header().Set("Content-Length", strconv.FormatInt(backup.Size, 10))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if digest := reprDigest(backup); digest != "" {
+		w.Header().Set("Repr-Digest", digest)
+	}
+	if _, err := io.Copy(w, newVerifyingReader(content, backup)); err != nil {
+		logger(r.Context()).Error("Error streaming backup", "backup_id", id, "error", err)
+		if errors.Is(err, errBackupChecksum) {
+			recordVerification(r.Context(), backup, true, err.Error())
+		}
+		// Too late for an error status; dropping the connection tells the
+		// client the download is incomplete, even when the body is
+		// compressed and has no length
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func getProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	projects, err := db.Projects().List(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(projects)
@@ -303,10 +619,14 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Utility functions
+// generateID returns a random (version 4) UUID, the type of the database's
+// id columns.
 func generateID() string {
 	b := make([]byte, 16)
 	rand.Read(b)
-	return fmt.Sprintf("%x", b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
 func detectSource(filename, content string) string {
@@ -332,43 +652,327 @@ func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
 	}
+	// Back up to a rune boundary so multi-byte characters aren't split
+	for maxLen > 0 && !utf8.RuneStart(s[maxLen]) {
+		maxLen--
+	}
 	return s[:maxLen]
 }
 
 func main() {
-	// Validate environment variables
-	if len(jwtSecret) == 0 {
-		log.Fatal("JWT_SECRET environment variable not set")
+	loadConfiguration()
+
+	if err := jwtKeys.load(); err != nil {
+		fatal("Error loading JWT secret", "error", err)
 	}
-	if len(encryptionKey) != 32 {
-		log.Fatal("ENCRYPTION_KEY must be 32 bytes")
+	keys, err := loadServerKeys()
+	if err != nil {
+		fatal("Error loading encryption keys", "error", err)
+	}
+	serverKeys = keys
+
+	initURLSigner()
+	initPasswordHashing()
+	initCompression()
+	initSecurityHeaders()
+	initCORS()
+	initSearch()
+	initTranslations()
+	initGeoIP()
+	initScanAnalytics()
+	initDatabase()
+	initWarehouseExport()
+	initBlobStore()
+	initResumableUploads()
+	initEventSink()
+	initJobQueue()
+	initSandbox()
+	initSummarizer()
+	initSemanticSearch()
+	initOAuth()
+	loadPoliciesFromEnv()
+	loadStorageQuotas()
+
+	// Maintenance mode is shared, so this turns it on for every server
+	// until an admin turns it off
+	if config.Get("MAINTENANCE_MODE") == "true" {
+		if err := maintenance.Set(context.Background(), true, config.Get("MAINTENANCE_MESSAGE")); err != nil {
+			fatal("Error enabling maintenance mode", "error", err)
+		}
 	}
 
 	r := mux.NewRouter()
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	r.Use(routeLogging)
+	r.Use(maintenanceMiddleware)
+	r.Use(conditionalGet)
 
 	// Public routes
 	r.HandleFunc("/health", healthHandler).Methods("GET")
-	r.HandleFunc("/api/auth/register", registerHandler).Methods("POST")
-	r.HandleFunc("/api/auth/login", loginHandler).Methods("POST")
+	r.HandleFunc("/api/status", statusHandler).Methods("GET")
+	r.HandleFunc("/api/openapi.json", openAPIHandler(r)).Methods("GET")
+	r.HandleFunc("/api/docs", swaggerUIHandler).Methods("GET")
+	r.HandleFunc("/api/auth/register", authRateLimit(registerHandler)).Methods("POST")
+	r.HandleFunc("/api/auth/login", authRateLimit(loginHandler)).Methods("POST")
+	r.HandleFunc("/api/auth/refresh", authRateLimit(refreshTokenHandler)).Methods("POST")
+	r.HandleFunc("/api/auth/logout", authRateLimit(logoutHandler)).Methods("POST")
+	r.HandleFunc("/api/auth/password-reset", authRateLimit(resetPasswordHandler)).Methods("POST")
+	r.HandleFunc("/api/auth/oauth", getOAuthProvidersHandler).Methods("GET")
+	r.HandleFunc("/api/auth/oauth/exchange", authRateLimit(exchangeOAuthHandler)).Methods("POST")
+	r.HandleFunc("/api/auth/oauth/{provider}/start", authRateLimit(startOAuthHandler)).Methods("GET")
+	r.HandleFunc("/api/auth/oauth/{provider}/callback", authRateLimit(oauthCallbackHandler)).Methods("GET")
+	r.HandleFunc("/api/exports/{id}/download", downloadExportHandler).Methods("GET")
+	r.HandleFunc("/api/shared/backups/{id}", sharedBackupHandler).Methods("GET")
+	r.HandleFunc("/api/shared/qr/{id}/image", sharedQRImageHandler).Methods("GET")
+	r.HandleFunc("/api/shared/projects/{id}/files/{path:.+}", sharedAttachmentHandler).Methods("GET")
+	r.HandleFunc("/api/policies", getPoliciesHandler).Methods("GET")
+	r.HandleFunc("/api/policies/{type}", getPolicyHandler).Methods("GET")
+	r.HandleFunc("/api/account/email/confirm", authRateLimit(confirmEmailChangeHandler)).Methods("POST")
+	r.HandleFunc("/api/account/email/cancel", authRateLimit(cancelEmailChangeByTokenHandler)).Methods("POST")
+	r.HandleFunc("/api/demo/qr", demoQRHandler).Methods("POST")
+	r.HandleFunc("/r/{code}", qrRedirectHandler).Methods("GET", "POST")
+	r.HandleFunc("/p/{token}", projectShareViewHandler).Methods("GET", "POST")
 
 	// Protected routes
+	r.HandleFunc("/ws", socketAuthMiddleware(progressSocketHandler)).Methods("GET")
+	r.HandleFunc("/api/jobs", authMiddleware(getJobsHandler)).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}", authMiddleware(getJobHandler)).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}/result", authMiddleware(getJobResultHandler)).Methods("GET")
 	r.HandleFunc("/api/backups", authMiddleware(uploadBackupHandler)).Methods("POST")
+	r.HandleFunc("/api/uploads", tusMiddleware(tusOptionsHandler)).Methods("OPTIONS")
+	r.HandleFunc("/api/uploads", tusMiddleware(authMiddleware(createUploadHandler))).Methods("POST")
+	r.HandleFunc("/api/uploads/{id}", tusMiddleware(authMiddleware(headUploadHandler))).Methods("HEAD")
+	r.HandleFunc("/api/uploads/{id}", tusMiddleware(authMiddleware(patchUploadHandler))).Methods("PATCH")
+	r.HandleFunc("/api/uploads/{id}", tusMiddleware(authMiddleware(deleteUploadHandler))).Methods("DELETE")
+	r.HandleFunc("/api/imports", authMiddleware(createImportHandler)).Methods("POST")
+	r.HandleFunc("/api/imports", authMiddleware(getImportsHandler)).Methods("GET")
+	r.HandleFunc("/api/imports/{id}", authMiddleware(getImportHandler)).Methods("GET")
+	r.HandleFunc("/api/connectors", authMiddleware(createConnectorHandler)).Methods("POST")
+	r.HandleFunc("/api/connectors", authMiddleware(getConnectorsHandler)).Methods("GET")
+	r.HandleFunc("/api/connectors/{id}", authMiddleware(getConnectorHandler)).Methods("GET")
+	r.HandleFunc("/api/connectors/{id}", authMiddleware(updateConnectorHandler)).Methods("PUT")
+	r.HandleFunc("/api/connectors/{id}", authMiddleware(deleteConnectorHandler)).Methods("DELETE")
+	r.HandleFunc("/api/connectors/{id}/run", authMiddleware(runConnectorHandler)).Methods("POST")
 	r.HandleFunc("/api/backups", authMiddleware(getBackupsHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{id}", authMiddleware(deleteBackupHandler)).Methods("DELETE")
+	r.HandleFunc("/api/backups/{id}/download", authMiddleware(downloadBackupHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{id}/verify", authMiddleware(verifyBackupHandler)).Methods("POST")
+	r.HandleFunc("/api/backups/{id}/versions", authMiddleware(getBackupVersionsHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{id}/diff", authMiddleware(diffBackupHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{id}/thumbnail", authMiddleware(getBackupThumbnailHandler)).Methods("GET")
+	r.HandleFunc("/api/backups/{id}/summary", authMiddleware(regenerateBackupSummaryHandler)).Methods("POST")
+	r.HandleFunc("/api/backups/{id}/parse", authMiddleware(parseBackupHandler)).Methods("POST")
+	r.HandleFunc("/api/backups/{id}/links", authMiddleware(createBackupLinkHandler)).Methods("POST")
 	r.HandleFunc("/api/projects", authMiddleware(getProjectsHandler)).Methods("GET")
-
-	// CORS configuration
-	corsHandler := handlers.CORS(
-		handlers.AllowedOrigins([]string{os.Getenv("FRONTEND_URL")}),
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
-		handlers.AllowCredentials(),
-	)(r)
-
-	port := os.Getenv("PORT")
+	r.HandleFunc("/api/projects", authMiddleware(createProjectHandler)).Methods("POST")
+	r.HandleFunc("/api/projects/duplicates", authMiddleware(getDuplicateProjectsHandler)).Methods("GET")
+	r.HandleFunc("/api/projects/starred", authMiddleware(getStarredProjectsHandler)).Methods("GET")
+	r.HandleFunc("/api/projects/recent", authMiddleware(getRecentProjectsHandler)).Methods("GET")
+	r.HandleFunc("/api/projects/merge", authMiddleware(mergeProjectsHandler)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}", authMiddleware(getProjectHandler)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}", authMiddleware(updateProjectHandler)).Methods("PUT", "PATCH")
+	r.HandleFunc("/api/projects/{id}", authMiddleware(deleteProjectHandler)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/description", authMiddleware(regenerateProjectDescriptionHandler)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/suggest-tags", authMiddleware(suggestProjectTagsHandler)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/run", authMiddleware(runProjectSnippetHandler)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/download", authMiddleware(downloadProjectHandler)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/share", authMiddleware(createProjectShareHandler)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/shares", authMiddleware(getProjectSharesHandler)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/shares/{shareId}", authMiddleware(revokeProjectShareHandler)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/files/links", authMiddleware(createAttachmentLinkHandler)).Methods("POST")
+	r.HandleFunc("/api/collections", authMiddleware(getCollectionsHandler)).Methods("GET")
+	r.HandleFunc("/api/collections", authMiddleware(createCollectionHandler)).Methods("POST")
+	r.HandleFunc("/api/collections/{id}", authMiddleware(getCollectionHandler)).Methods("GET")
+	r.HandleFunc("/api/collections/{id}", authMiddleware(updateCollectionHandler)).Methods("PUT", "PATCH")
+	r.HandleFunc("/api/collections/{id}", authMiddleware(deleteCollectionHandler)).Methods("DELETE")
+	r.HandleFunc("/api/collections/{id}/projects/{projectId}", authMiddleware(addCollectionProjectHandler)).Methods("PUT")
+	r.HandleFunc("/api/collections/{id}/projects/{projectId}", authMiddleware(removeCollectionProjectHandler)).Methods("DELETE")
+	r.HandleFunc("/api/tags", authMiddleware(getTagsHandler)).Methods("GET")
+	r.HandleFunc("/api/tags/autocomplete", authMiddleware(autocompleteTagsHandler)).Methods("GET")
+	r.HandleFunc("/api/tags/rename", authMiddleware(renameTagHandler)).Methods("POST")
+	r.HandleFunc("/api/tags/merge", authMiddleware(mergeTagsHandler)).Methods("POST")
+	r.HandleFunc("/api/trash", authMiddleware(getTrashHandler)).Methods("GET")
+	r.HandleFunc("/api/trash", authMiddleware(emptyTrashHandler)).Methods("DELETE")
+	r.HandleFunc("/api/trash/backups/{id}/restore", authMiddleware(restoreBackupHandler)).Methods("POST")
+	r.HandleFunc("/api/trash/backups/{id}", authMiddleware(purgeBackupHandler)).Methods("DELETE")
+	r.HandleFunc("/api/trash/projects/{id}/restore", authMiddleware(restoreProjectHandler)).Methods("POST")
+	r.HandleFunc("/api/trash/projects/{id}", authMiddleware(purgeProjectHandler)).Methods("DELETE")
+	r.HandleFunc("/api/sandbox/languages", authMiddleware(getSandboxLanguagesHandler)).Methods("GET")
+	r.HandleFunc("/api/reports/integrity", authMiddleware(getIntegrityReportsHandler)).Methods("GET")
+	r.HandleFunc("/api/search", authMiddleware(searchHandler)).Methods("GET")
+	r.HandleFunc("/api/search/semantic", authMiddleware(semanticSearchHandler)).Methods("GET")
+	r.HandleFunc("/api/qr", authMiddleware(createQRCodeHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/batch", authMiddleware(createQRBatchHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/batch/jobs", authMiddleware(createQRBatchJobHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/decode", authMiddleware(decodeQRHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/logos", authMiddleware(uploadQRLogoHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/logos", authMiddleware(getQRLogosHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/logos/{id}", authMiddleware(getQRLogoImageHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/logos/{id}", authMiddleware(deleteQRLogoHandler)).Methods("DELETE")
+	r.HandleFunc("/api/qr/templates", authMiddleware(createQRTemplateHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/templates", authMiddleware(getQRTemplatesHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/templates/{id}", authMiddleware(getQRTemplateHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/templates/{id}", authMiddleware(updateQRTemplateHandler)).Methods("PUT")
+	r.HandleFunc("/api/qr/templates/{id}", authMiddleware(deleteQRTemplateHandler)).Methods("DELETE")
+	r.HandleFunc("/api/qr/{id}/target", authMiddleware(updateQRTargetHandler)).Methods("PUT")
+	r.HandleFunc("/api/qr/{id}/targets", authMiddleware(getQRTargetsHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/{id}/password", authMiddleware(setQRPasswordHandler)).Methods("PUT")
+	r.HandleFunc("/api/qr/{id}/pages", authMiddleware(updateQRPagesHandler)).Methods("PUT")
+	r.HandleFunc("/api/qr/{id}/links", authMiddleware(createQRLinkHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/{id}/password", authMiddleware(deleteQRPasswordHandler)).Methods("DELETE")
+	r.HandleFunc("/api/qr/label-templates", authMiddleware(getLabelTemplatesHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/sheet-layout", authMiddleware(sheetLayoutHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/contact", authMiddleware(contactPayloadHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/lint", authMiddleware(lintPayloadHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/colors/check", authMiddleware(checkColorsHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/frames", authMiddleware(getFrameTemplatesHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/frames/preview", authMiddleware(previewFrameHandler)).Methods("POST")
+	r.HandleFunc("/api/qr/pages/languages", authMiddleware(getQRPageLanguagesHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/pages/{page}/preview", authMiddleware(previewQRPageHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/{id}/analytics", authMiddleware(getQRAnalyticsHandler)).Methods("GET")
+	r.HandleFunc("/api/qr/{id}/analytics/geo", authMiddleware(getQRGeoAnalyticsHandler)).Methods("GET")
+	r.HandleFunc("/api/policies/accept", policyExemptMiddleware(acceptPolicyHandler)).Methods("POST")
+	r.HandleFunc("/api/account/policies", policyExemptMiddleware(getAccountPoliciesHandler)).Methods("GET")
+	r.HandleFunc("/api/account/sessions", authMiddleware(getSessionsHandler)).Methods("GET")
+	r.HandleFunc("/api/account/sessions", authMiddleware(revokeOtherSessionsHandler)).Methods("DELETE")
+	r.HandleFunc("/api/account/sessions/{id}", authMiddleware(revokeSessionHandler)).Methods("DELETE")
+	r.HandleFunc("/api/account/retention", authMiddleware(getRetentionPolicyHandler)).Methods("GET")
+	r.HandleFunc("/api/account/retention", authMiddleware(setRetentionPolicyHandler)).Methods("PUT")
+	r.HandleFunc("/api/account/retention", authMiddleware(deleteRetentionPolicyHandler)).Methods("DELETE")
+	r.HandleFunc("/api/account/retention/preview", authMiddleware(previewRetentionHandler)).Methods("POST")
+	r.HandleFunc("/api/account/email", authMiddleware(requestEmailChangeHandler)).Methods("POST")
+	r.HandleFunc("/api/account/email", authMiddleware(getEmailChangeHandler)).Methods("GET")
+	r.HandleFunc("/api/account/email", authMiddleware(cancelEmailChangeHandler)).Methods("DELETE")
+	r.HandleFunc("/api/account/recovery-codes", authMiddleware(regenerateRecoveryCodesHandler)).Methods("POST")
+	r.HandleFunc("/api/account/recovery-codes", authMiddleware(getRecoveryCodesHandler)).Methods("GET")
+	r.HandleFunc("/api/account/2fa", authMiddleware(beginTwoFactorHandler)).Methods("POST")
+	r.HandleFunc("/api/account/2fa", authMiddleware(getTwoFactorHandler)).Methods("GET")
+	r.HandleFunc("/api/account/2fa", authMiddleware(disableTwoFactorHandler)).Methods("DELETE")
+	r.HandleFunc("/api/account/2fa/verify", authMiddleware(confirmTwoFactorHandler)).Methods("POST")
+	r.HandleFunc("/api/account/recovery-key", authMiddleware(createRecoveryKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/account/recovery-key", authMiddleware(getRecoveryKeyHandler)).Methods("GET")
+	r.HandleFunc("/api/account/recovery-key", authMiddleware(deleteRecoveryKeyHandler)).Methods("DELETE")
+	r.HandleFunc("/api/account/recovery-key/recover", authMiddleware(recoverDataKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/account/data-key/unlock", authMiddleware(unlockDataKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/webhooks", authMiddleware(createWebhookHandler)).Methods("POST")
+	r.HandleFunc("/api/webhooks", authMiddleware(getWebhooksHandler)).Methods("GET")
+	r.HandleFunc("/api/webhooks/events", authMiddleware(getWebhookEventsHandler)).Methods("GET")
+	r.HandleFunc("/api/webhooks/{id}", authMiddleware(getWebhookHandler)).Methods("GET")
+	r.HandleFunc("/api/webhooks/{id}", authMiddleware(updateWebhookHandler)).Methods("PUT")
+	r.HandleFunc("/api/webhooks/{id}", authMiddleware(deleteWebhookHandler)).Methods("DELETE")
+	r.HandleFunc("/api/webhooks/{id}/rotate-secret", authMiddleware(rotateWebhookSecretHandler)).Methods("POST")
+	r.HandleFunc("/api/webhooks/{id}/enable", authMiddleware(enableWebhookHandler)).Methods("POST")
+	r.HandleFunc("/api/webhooks/{id}/deliveries", authMiddleware(getWebhookDeliveriesHandler)).Methods("GET")
+	r.HandleFunc("/api/webhooks/{id}/deliveries/{deliveryId}/redeliver", authMiddleware(redeliverWebhookHandler)).Methods("POST")
+	r.HandleFunc("/api/account/exports", authMiddleware(createExportHandler)).Methods("POST")
+	r.HandleFunc("/api/keys", authMiddleware(createAPIKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/keys", authMiddleware(getAPIKeysHandler)).Methods("GET")
+	r.HandleFunc("/api/keys/{id}", authMiddleware(revokeAPIKeyHandler)).Methods("DELETE")
+	r.HandleFunc("/api/keys/{id}/usage", authMiddleware(getAPIKeyUsageHandler)).Methods("GET")
+	r.HandleFunc("/api/links", authMiddleware(getSignedLinksHandler)).Methods("GET")
+	r.HandleFunc("/api/links/{id}", authMiddleware(revokeSignedLinkHandler)).Methods("DELETE")
+	r.HandleFunc("/api/account/exports", authMiddleware(getExportsHandler)).Methods("GET")
+	r.HandleFunc("/api/account/exports/{id}", authMiddleware(getExportHandler)).Methods("GET")
+	r.HandleFunc("/api/account/export", authMiddleware(getAccountExportHandler)).Methods("GET")
+	r.HandleFunc("/api/account/usage", authMiddleware(getAccountUsageHandler)).Methods("GET")
+	r.HandleFunc("/api/stats", authMiddleware(getStatsHandler)).Methods("GET")
+	r.HandleFunc("/api/account", authMiddleware(deleteAccountHandler)).Methods("DELETE")
+	r.HandleFunc("/api/account/deletion", authMiddleware(getAccountDeletionHandler)).Methods("GET")
+	r.HandleFunc("/api/account/deletion/cancel", authMiddleware(cancelAccountDeletionHandler)).Methods("POST")
+	r.HandleFunc("/api/teams", authMiddleware(createTeamHandler)).Methods("POST")
+	r.HandleFunc("/api/teams", authMiddleware(listTeamsHandler)).Methods("GET")
+	r.HandleFunc("/api/teams/invites/accept", authMiddleware(acceptTeamInviteHandler)).Methods("POST")
+	r.HandleFunc("/api/teams/{id}", authMiddleware(getTeamHandler)).Methods("GET")
+	r.HandleFunc("/api/teams/{id}", authMiddleware(updateTeamHandler)).Methods("PUT")
+	r.HandleFunc("/api/teams/{id}", authMiddleware(deleteTeamHandler)).Methods("DELETE")
+	r.HandleFunc("/api/teams/{id}/invites", authMiddleware(createTeamInviteHandler)).Methods("POST")
+	r.HandleFunc("/api/teams/{id}/invites", authMiddleware(listTeamInvitesHandler)).Methods("GET")
+	r.HandleFunc("/api/teams/{id}/invites/{inviteId}", authMiddleware(deleteTeamInviteHandler)).Methods("DELETE")
+	r.HandleFunc("/api/teams/{id}/members/{userId}", authMiddleware(updateTeamMemberHandler)).Methods("PUT")
+	r.HandleFunc("/api/teams/{id}/members/{userId}", authMiddleware(removeTeamMemberHandler)).Methods("DELETE")
+
+	// Admin routes
+	r.HandleFunc("/api/admin/maintenance", adminMiddleware(getMaintenanceHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/maintenance", adminMiddleware(setMaintenanceHandler)).Methods("PUT")
+	r.HandleFunc("/api/admin/policies", adminMiddleware(publishPolicyHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/legal-holds", adminMiddleware(createLegalHoldHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/legal-holds", adminMiddleware(getLegalHoldsHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/legal-holds/{id}", adminMiddleware(releaseLegalHoldHandler)).Methods("DELETE")
+	r.HandleFunc("/api/admin/search/rebuild", adminMiddleware(rebuildSearchIndexHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/warehouse-exports", adminMiddleware(createWarehouseExportHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/warehouse-exports", adminMiddleware(getWarehouseExportsHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/reports/integrity", adminMiddleware(runIntegrityCheckHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/encryption", adminMiddleware(getKeyRotationHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/encryption/rotate", adminMiddleware(startKeyRotationHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/replication", adminMiddleware(getReplicationStatusHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/database", adminMiddleware(getDatabaseStatusHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/usage", adminMiddleware(getUsageHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/users", adminMiddleware(getAdminUsersHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}", adminMiddleware(getAdminUserHandler)).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/role", adminMiddleware(setUserRoleHandler)).Methods("PUT")
+	r.HandleFunc("/api/admin/users/{id}/plan", adminMiddleware(setUserPlanHandler)).Methods("PUT")
+	r.HandleFunc("/api/admin/users/{id}/disable", adminMiddleware(disableUserHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/enable", adminMiddleware(enableUserHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/password-reset", adminMiddleware(forcePasswordResetHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/users/{id}/unlock", adminMiddleware(unlockUserHandler)).Methods("POST")
+	r.HandleFunc("/api/admin/domain-events", adminMiddleware(getDomainEventsHandler)).Methods("GET")
+
+	// Background jobs
+	runJobWorkers()
+	startPeriodicJob("webhook retries", webhookRetryInterval, queueDueWebhookDeliveries)
+	initOCR()
+	startPeriodicJob("retention", retentionInterval, runRetention)
+	startPeriodicJob("connector scheduler", connectorSchedulerInterval, queueDueConnectors)
+	startPeriodicJob("job sweep", jobSweepInterval, sweepJobs)
+	startPeriodicJob("rate limiter cleanup", 10*time.Minute, func() {
+		apiKeyLimiter.prune(10 * time.Minute)
+		authLimiter.prune(10 * time.Minute)
+		twoFactorLimiter.prune(10 * time.Minute)
+		userLimiter.prune(10 * time.Minute)
+		qrPasswordLimiter.prune(10 * time.Minute)
+		demoLimiter.prune(10 * time.Minute)
+		snippetLimiter.prune(10 * time.Minute)
+		summaryLimiter.prune(10 * time.Minute)
+	})
+	startPeriodicJob("data key cleanup", 10*time.Minute, userKeys.pruneUnlocked)
+	startPeriodicJob("OAuth login cleanup", 10*time.Minute, pruneOAuthLogins)
+	startPeriodicJob("session cutoff cleanup", 10*time.Minute, revokedSessions.prune)
+	startPeriodicJob("session check cleanup", 10*time.Minute, sessionChecks.prune)
+	startPeriodicJob("failed attempt cleanup", 10*time.Minute, pruneFailedAttempts)
+	startPeriodicJob("password reset cleanup", time.Hour, prunePasswordResets)
+	startPeriodicJob("signed link cleanup", time.Hour, pruneSignedLinks)
+	startPeriodicJob("webhook delivery cleanup", time.Hour, pruneWebhookDeliveries)
+	startPeriodicJob("API key usage flush", apiKeyUsageFlushInterval, apiKeyUsage.flush)
+	startPeriodicJob("API key usage rollup cleanup", 24*time.Hour, apiKeyUsage.prune)
+	startPeriodicJob("scan analytics cleanup", 24*time.Hour, pruneScanAnalytics)
+	startPeriodicJob("audit log buffer cleanup", 24*time.Hour, auditLog.prune)
+	startPeriodicJob("warehouse export", warehouseExportInterval, queueScheduledWarehouseExports)
+	startPeriodicJob("vector index save", vectorSaveInterval, saveVectorIndex)
+	startPeriodicJob("backup integrity check", integritySchedulerInterval, queueScheduledIntegrityCheck)
+	startPeriodicJob("blob replication retry", replicationRetryInterval, retryBlobReplication)
+	startPeriodicJob("database replica check", replicaCheckInterval, checkDatabaseReplicas)
+	startPeriodicJob("refresh token cleanup", time.Hour, pruneRefreshTokens)
+	startPeriodicJob("backup chunk cleanup", time.Hour, pruneChunks)
+	startPeriodicJob("resumable upload cleanup", uploadCleanupInterval, pruneUploads)
+	startPeriodicJob("encryption key rotation", keyRotationInterval, runScheduledKeyRotation)
+	startPeriodicJob("secrets refresh", durationSetting("SECRETS_REFRESH_INTERVAL", defaultSecretsRefreshInterval), refreshSecrets)
+
+	if searchIndexEmpty {
+		go rebuildSearchIndex()
+	}
+
+	corsHandler := newCORSHandler(r)
+
+	port := config.Get("PORT")
 	if port == "" {
-		port = "8080"
+		port = defaultPort()
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, corsHandler))
+	slog.Info("Server starting", "port", port)
+	if err := serve(newServer(":"+port, requestLogging(securityHeaders(compressResponses(errorEnvelope(corsHandler)))))); err != nil {
+		fatal("Server failed", "error", err)
+	}
+	stopJobWorkers()
+	closeResources()
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"backup-manager/storage"
+)
+
+const defaultMaintenanceMessage = "We're performing scheduled maintenance. Your data is safe and read-only access is still available. Please try again shortly."
+
+// maintenanceCacheTTL is how long a server goes on a copy of maintenance
+// mode before reading it again, so a change reaches every server within
+// it.
+const maintenanceCacheTTL = 5 * time.Second
+
+// maintenanceState tracks whether the API is in maintenance mode. While it is
+// enabled reads keep working, writes are rejected with 503 and background
+// jobs skip their runs. The mode is kept in the database, so it is the same
+// on every server and outlives restarts; each server caches it briefly.
+type maintenanceState struct {
+	mu        sync.Mutex
+	current   storage.Maintenance
+	fetchedAt time.Time
+}
+
+var maintenance = &maintenanceState{}
+
+// get returns the cached mode, reading it again once it is stale. If that
+// fails the last mode read stands.
+func (m *maintenanceState) get() storage.Maintenance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.fetchedAt) < maintenanceCacheTTL {
+		return m.current
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	current, err := db.Maintenance().Get(ctx)
+	if err != nil {
+		slog.Error("Failed to read maintenance mode", "error", err)
+	} else {
+		m.current = current
+	}
+	m.fetchedAt = time.Now()
+	return m.current
+}
+
+func (m *maintenanceState) Enabled() bool {
+	return m.get().Enabled
+}
+
+func (m *maintenanceState) Set(ctx context.Context, enabled bool, message string) error {
+	current, err := db.Maintenance().Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	next := storage.Maintenance{Enabled: enabled}
+	if enabled {
+		next.Message = message
+		if next.Message == "" {
+			next.Message = defaultMaintenanceMessage
+		}
+		next.Since = current.Since
+		if !current.Enabled || next.Since == nil {
+			now := time.Now()
+			next.Since = &now
+		}
+	}
+	if err := db.Maintenance().Set(ctx, next); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.current = next
+	m.fetchedAt = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *maintenanceState) status() map[string]interface{} {
+	current := m.get()
+	status := map[string]interface{}{
+		"maintenance": current.Enabled,
+		"message":     current.Message,
+	}
+	if current.Enabled && current.Since != nil {
+		status["since"] = current.Since.Format(time.RFC3339)
+	}
+	return status
+}
+
+// Routes that must keep accepting writes during maintenance, otherwise an
+// admin whose token expired could never switch it off again.
+var maintenanceExemptPaths = map[string]bool{
+	"/api/auth/login":          true,
+	"/api/auth/refresh":        true,
+	"/api/auth/logout":         true,
+	"/api/auth/oauth/exchange": true,
+	"/api/admin/maintenance":   true,
+}
+
+func isReadMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// Maintenance middleware
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !maintenance.Enabled() || isReadMethod(r.Method) || maintenanceExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		status := maintenance.status()
+		message, _ := status["message"].(string)
+		if message == "" {
+			message = "The service is down for maintenance"
+		}
+		w.Header().Set("Retry-After", "300")
+		writeError(w, http.StatusServiceUnavailable, "maintenance", message)
+	})
+}
+
+// Handlers
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance.status())
+}
+
+func getMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance.status())
+}
+
+func setMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled bool   `json:"enabled"`
+		Message string `json:"message"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if err := maintenance.Set(r.Context(), req.Enabled, req.Message); err != nil {
+		writeStorageError(w, r, err, "Maintenance mode")
+		return
+	}
+	logger(r.Context()).Info("Maintenance mode set", "enabled", req.Enabled, "email", r.Header.Get("X-User-Email"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance.status())
+}
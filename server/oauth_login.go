@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/oauth"
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// oauthStateTTL is how long the user has to sign in at the provider
+	oauthStateTTL = 10 * time.Minute
+	// oauthLoginTTL is how long the frontend has to trade the one-time code
+	// from the callback for tokens, or to ask for a second factor and retry
+	oauthLoginTTL    = 5 * time.Minute
+	oauthStateCookie = "oauth_state"
+)
+
+// oauthProviders are the providers with credentials configured, by name.
+var oauthProviders = map[string]*oauth.Provider{}
+
+// initOAuth enables each provider whose client ID and secret are set.
+func initOAuth() {
+	for _, p := range []struct {
+		env string
+		new func(id, secret string) *oauth.Provider
+	}{
+		{"GOOGLE", oauth.Google},
+		{"GITHUB", oauth.GitHub},
+	} {
+		id, secret := config.Get(p.env+"_CLIENT_ID"), config.Get(p.env+"_CLIENT_SECRET")
+		if id == "" && secret == "" {
+			continue
+		}
+		if id == "" || secret == "" {
+			fatal(p.env + "_CLIENT_ID and " + p.env + "_CLIENT_SECRET must be set together")
+		}
+		provider := p.new(id, secret)
+		oauthProviders[provider.Name] = provider
+	}
+}
+
+// oauthCallbackURL is the callback registered with the provider.
+// OAUTH_REDIRECT_BASE_URL is this server's public address; without it the
+// address r came in on is used, which is only right when nothing rewrites
+// the host.
+func oauthCallbackURL(r *http.Request, provider string) string {
+	base := config.Get("OAUTH_REDIRECT_BASE_URL")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimRight(base, "/") + "/api/auth/oauth/" + provider + "/callback"
+}
+
+type (
+	OAuthState = storage.OAuthState
+	OAuthLogin = storage.OAuthLogin
+)
+
+// startOAuthState saves a sign-in started at a provider and returns its
+// state. It is kept in the database, so the callback can land on any server.
+func startOAuthState(ctx context.Context, st OAuthState) (string, error) {
+	state := generateToken()
+	st.StateHash = hashToken(state)
+	st.ExpiresAt = time.Now().Add(oauthStateTTL)
+	return state, db.OAuth().StartState(ctx, st)
+}
+
+// addOAuthLogin saves a finished sign-in and returns the one-time code the
+// frontend trades for its tokens.
+func addOAuthLogin(ctx context.Context, l OAuthLogin) (string, error) {
+	code := generateToken()
+	l.CodeHash = hashToken(code)
+	l.ExpiresAt = time.Now().Add(oauthLoginTTL)
+	return code, db.OAuth().AddLogin(ctx, l)
+}
+
+func pruneOAuthLogins() {
+	if err := db.OAuth().Prune(context.Background(), time.Now()); err != nil {
+		slog.Error("Failed to prune OAuth logins", "error", err)
+	}
+}
+
+// oauthUser finds the account for a provider identity by its verified
+// email, creating one if there is none. New accounts have no password and
+// no data key of their own, so their backups are under the server key.
+func oauthUser(r *http.Request, id oauth.Identity, acceptPolicies bool) (User, bool, error) {
+	user, err := db.Users().GetByEmail(r.Context(), id.Email)
+	if err == nil {
+		return user, false, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return User{}, false, err
+	}
+	current, err := policies.current(r.Context())
+	if err != nil {
+		return User{}, false, err
+	}
+	if len(current) > 0 && !acceptPolicies {
+		return User{}, false, errPoliciesNotAccepted
+	}
+
+	user = User{
+		ID:        generateID(),
+		Email:     id.Email,
+		CreatedAt: time.Now(),
+	}
+	if err := db.Users().Create(r.Context(), user); err != nil {
+		return User{}, false, err
+	}
+	if err := policies.acceptCurrent(user.ID, r); err != nil {
+		// The user is asked to accept them again on their first request
+		logger(r.Context()).Error("Error recording policy acceptance", "user_id", user.ID, "error", err)
+	}
+	recordDomainEvent(DomainActor{Type: actorUser, UserID: user.ID}, DomainEvent{
+		Type:          "user.registered",
+		AggregateType: aggregateUser,
+		AggregateID:   user.ID,
+		OwnerID:       user.ID,
+		After:         snapshot(user),
+	}, map[string]interface{}{"email": user.Email, "provider": id.Provider})
+	return user, true, nil
+}
+
+var errPoliciesNotAccepted = errors.New("policies not accepted")
+
+// redirectOAuthResult sends the browser back to the frontend, which picks up
+// either the one-time code or the error from the query string.
+func redirectOAuthResult(w http.ResponseWriter, r *http.Request, params url.Values) {
+	http.Redirect(w, r, frontendLink("/oauth/callback?"+params.Encode()), http.StatusFound)
+}
+
+func oauthError(w http.ResponseWriter, r *http.Request, code string) {
+	redirectOAuthResult(w, r, url.Values{"oauth_error": {code}})
+}
+
+// Handlers
+
+func getOAuthProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(oauthProviders))
+	for name := range oauthProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"providers": names})
+}
+
+// startOAuthHandler sends the browser to the provider to sign in. The state
+// is also set in a cookie so the callback only completes in the browser
+// that started it. Someone signing up this way passes accept_policies=true.
+func startOAuthHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := oauthProviders[name]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	verifier := oauth.NewVerifier()
+	state, err := startOAuthState(r.Context(), OAuthState{
+		Provider:       name,
+		Verifier:       verifier,
+		AcceptPolicies: r.URL.Query().Get("accept_policies") == "true",
+	})
+	if err != nil {
+		logger(r.Context()).Error("Error saving OAuth state", "provider", name, "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oauth",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		// Lax, so the cookie comes back on the provider's top-level redirect
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.AuthCodeURL(state, verifier, oauthCallbackURL(r, name)), http.StatusFound)
+}
+
+// oauthCallbackHandler is where the provider sends the browser back. It
+// links the identity to an account by verified email and hands the frontend
+// a one-time code to trade for tokens at /api/auth/oauth/exchange, so tokens
+// never appear in a URL.
+func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := oauthProviders[name]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/api/auth/oauth", MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		// Usually the user declining at the provider
+		oauthError(w, r, "access_denied")
+		return
+	}
+	state := q.Get("state")
+	cookie, err := r.Cookie(oauthStateCookie)
+	if state == "" || err != nil || cookie.Value != state {
+		oauthError(w, r, "invalid_state")
+		return
+	}
+	pending, err := db.OAuth().TakeState(r.Context(), hashToken(state), time.Now())
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && pending.Provider != name) {
+		oauthError(w, r, "invalid_state")
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading OAuth state", "provider", name, "error", err)
+		oauthError(w, r, "server_error")
+		return
+	}
+
+	accessToken, err := provider.Exchange(r.Context(), q.Get("code"), pending.Verifier, oauthCallbackURL(r, name))
+	if err != nil {
+		logger(r.Context()).Warn("Error completing OAuth login", "provider", name, "error", err)
+		oauthError(w, r, "provider_error")
+		return
+	}
+	id, err := provider.Identity(r.Context(), accessToken)
+	if errors.Is(err, oauth.ErrUnverifiedEmail) {
+		oauthError(w, r, "unverified_email")
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Warn("Error loading OAuth identity", "provider", name, "error", err)
+		oauthError(w, r, "provider_error")
+		return
+	}
+
+	user, created, err := oauthUser(r, id, pending.AcceptPolicies)
+	if errors.Is(err, errPoliciesNotAccepted) {
+		oauthError(w, r, "policies_not_accepted")
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error linking OAuth identity", "provider", name, "error", err)
+		oauthError(w, r, "server_error")
+		return
+	}
+
+	code, err := addOAuthLogin(r.Context(), OAuthLogin{UserID: user.ID, Provider: name, Created: created})
+	if err != nil {
+		logger(r.Context()).Error("Error saving OAuth login", "provider", name, "error", err)
+		oauthError(w, r, "server_error")
+		return
+	}
+	redirectOAuthResult(w, r, url.Values{"code": {code}})
+}
+
+// exchangeOAuthHandler trades the one-time code from the callback for the
+// same tokens a password login returns. Users with a second factor get
+// mfa_required, like on login, and send the code again with it.
+func exchangeOAuthHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code         string `json:"code" validate:"required"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	login, err := db.OAuth().Login(r.Context(), hashToken(req.Code), time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "OAuth login")
+		return
+	}
+	user, err := db.Users().Get(r.Context(), login.UserID)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading user", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+
+	// OAuth proves control of the address a forced password reset is sent
+	// to, so only disabled accounts are refused here
+	if user.Disabled {
+		accountBlocked(w, "account_disabled")
+		return
+	}
+	methods, err := secondFactors(r.Context(), user.ID)
+	if err != nil {
+		writeStorageError(w, r, err, "Two-factor authentication")
+		return
+	}
+	if len(methods) > 0 && !checkSecondFactor(w, r, user.ID, methods, req.TOTPCode, req.RecoveryCode) {
+		return
+	}
+	// Only the request that deletes the code gets tokens for it
+	err = db.OAuth().FinishLogin(r.Context(), login.CodeHash)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "OAuth login")
+		return
+	}
+
+	sessionID, refreshToken, err := startSession(r, user.ID)
+	if err != nil {
+		logger(r.Context()).Error("Error saving session", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	accessToken, err := issueAccessToken(user, sessionID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		UserID:       user.ID,
+		Action:       "auth.oauth_login",
+		ResourceType: "user",
+		ResourceID:   user.ID,
+		Metadata:     map[string]interface{}{"provider": login.Provider, "created": login.Created},
+	})
+
+	extra := map[string]interface{}{"provider": login.Provider, "created": login.Created}
+	// Without the password an account's own data key stays locked until
+	// the password is sent to /api/account/data-key/unlock
+	if _, err := userKeys.dataKey(r.Context(), user.ID); errors.Is(err, errDataKeyLocked) {
+		extra["data_key"] = "locked"
+	}
+	writeTokens(w, accessToken, refreshToken, extra)
+}
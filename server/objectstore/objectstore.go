@@ -0,0 +1,139 @@
+// Package objectstore writes files to a local directory or an S3-compatible
+// bucket (AWS S3, MinIO, Cloudflare R2, GCS interoperability), behind one
+// interface.
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for a key that does not exist.
+var ErrNotFound = errors.New("objectstore: not found")
+
+// Store holds objects by slash-separated key.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// PutStream writes everything read from r, without holding it all in
+	// memory. Nothing is stored if reading r fails.
+	PutStream(ctx context.Context, key string, r io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// Location describes where a key is stored, for logs and API responses.
+	Location(key string) string
+}
+
+// Open returns the store for a URL: "s3://bucket/prefix" for S3, with
+// credentials from cfg, or a filesystem path (optionally "file://") for a
+// local directory. Keys are stored under the URL's prefix.
+func Open(rawURL string, cfg S3Config) (Store, error) {
+	if !strings.Contains(rawURL, "://") {
+		return &Dir{Root: rawURL}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("objectstore: invalid URL %q: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return &Dir{Root: u.Path}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("objectstore: %q has no bucket", rawURL)
+		}
+		cfg.Bucket = u.Host
+		cfg.Prefix = strings.Trim(u.Path, "/")
+		return NewS3(cfg), nil
+	default:
+		return nil, fmt.Errorf("objectstore: unsupported scheme %q", u.Scheme)
+	}
+}
+
+// Dir stores objects as files under Root.
+type Dir struct {
+	Root string
+}
+
+func (d *Dir) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("objectstore: invalid key %q", key)
+	}
+	return filepath.Join(d.Root, clean), nil
+}
+
+// Put writes to a temporary file and renames it, so readers never see a
+// partial object.
+func (d *Dir) Put(_ context.Context, key string, data []byte, _ string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d *Dir) PutStream(_ context.Context, key string, r io.Reader, _ string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d *Dir) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (d *Dir) Delete(_ context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *Dir) Location(key string) string {
+	path, _ := d.path(key)
+	return path
+}
@@ -0,0 +1,285 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Replicated writes to a primary store and copies every change to a
+// secondary, usually a bucket in another region, in the background. Reads
+// fall back to the secondary when the primary fails, so a regional outage
+// degrades to serving the last replicated copy.
+//
+// Each change is recorded in an Outbox before the primary is written, so
+// the backlog outlives a restart and Retry on any server copies what
+// another left behind.
+type Replicated struct {
+	primary   Store
+	secondary Store
+	outbox    Outbox
+
+	queue chan replicationOp
+
+	mu            sync.Mutex
+	inFlight      map[string]bool // key and version of ops this process has queued
+	replicated    int64
+	failed        int64
+	failoverReads int64
+	lastSuccess   time.Time
+}
+
+// Outbox keeps the keys with changes not yet copied to the secondary.
+type Outbox interface {
+	// Add records a change to key and returns its version.
+	Add(ctx context.Context, key, contentType string) (string, error)
+	// Done clears key if version is still its latest change.
+	Done(ctx context.Context, key, version string) error
+	// Pending returns up to limit changes made at or before before, those
+	// behind longest first.
+	Pending(ctx context.Context, before time.Time, limit int) ([]Change, error)
+	// Backlog returns how many keys are pending and, if any are, when the
+	// oldest fell behind.
+	Backlog(ctx context.Context) (int, *time.Time, error)
+}
+
+// Change is a key waiting in an Outbox.
+type Change struct {
+	Key         string
+	ContentType string
+	Version     string
+}
+
+type replicationOp struct {
+	key         string
+	contentType string
+	delete      bool
+	version     string
+}
+
+// ReplicationStats describe how far the secondary is behind. Pending and
+// LagSeconds come from the outbox; the counters are this server's.
+type ReplicationStats struct {
+	Pending int `json:"pending"`
+	// LagSeconds is the age of the oldest change not yet replicated, 0 when
+	// the secondary is up to date.
+	LagSeconds    float64    `json:"lag_seconds"`
+	Replicated    int64      `json:"replicated"`
+	Failed        int64      `json:"failed"`
+	FailoverReads int64      `json:"failover_reads"`
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+}
+
+const (
+	// Long enough to stream a large backup between regions
+	replicationTimeout = time.Hour
+	replicationRetries = 3
+	// retryDelay leaves a change to the server that made it for a while,
+	// since that server is most likely still copying it
+	retryDelay = time.Minute
+	retryBatch = 1000
+)
+
+// NewReplicated starts workers copying changes from primary to secondary.
+func NewReplicated(primary, secondary Store, outbox Outbox, workers int) *Replicated {
+	r := &Replicated{
+		primary:   primary,
+		secondary: secondary,
+		outbox:    outbox,
+		queue:     make(chan replicationOp, 10000),
+		inFlight:  make(map[string]bool),
+	}
+	for i := 0; i < workers; i++ {
+		go r.run()
+	}
+	return r
+}
+
+// Put writes to the primary and queues the copy. It returns once the
+// primary has the object.
+func (r *Replicated) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	version, err := r.outbox.Add(ctx, key, contentType)
+	if err != nil {
+		return fmt.Errorf("recording change for replication: %w", err)
+	}
+	if err := r.primary.Put(ctx, key, data, contentType); err != nil {
+		return err
+	}
+	r.send(replicationOp{key: key, contentType: contentType, version: version})
+	return nil
+}
+
+func (r *Replicated) PutStream(ctx context.Context, key string, body io.Reader, contentType string) error {
+	version, err := r.outbox.Add(ctx, key, contentType)
+	if err != nil {
+		return fmt.Errorf("recording change for replication: %w", err)
+	}
+	if err := r.primary.PutStream(ctx, key, body, contentType); err != nil {
+		return err
+	}
+	r.send(replicationOp{key: key, contentType: contentType, version: version})
+	return nil
+}
+
+// Get reads from the primary, or from the secondary if the primary fails
+// or has lost the object.
+func (r *Replicated) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := r.primary.Get(ctx, key)
+	if err == nil {
+		return body, nil
+	}
+
+	fallback, ferr := r.secondary.Get(ctx, key)
+	if ferr != nil {
+		// The primary's answer is the meaningful one
+		return nil, err
+	}
+	slog.Warn("objectstore: read from secondary after primary failed", "key", key, "error", err)
+	r.mu.Lock()
+	r.failoverReads++
+	r.mu.Unlock()
+	return fallback, nil
+}
+
+func (r *Replicated) Delete(ctx context.Context, key string) error {
+	version, err := r.outbox.Add(ctx, key, "")
+	if err != nil {
+		return fmt.Errorf("recording change for replication: %w", err)
+	}
+	if err := r.primary.Delete(ctx, key); err != nil {
+		return err
+	}
+	r.send(replicationOp{key: key, delete: true, version: version})
+	return nil
+}
+
+func (r *Replicated) Location(key string) string {
+	return r.primary.Location(key)
+}
+
+// Stats reports the replication backlog.
+func (r *Replicated) Stats(ctx context.Context) (ReplicationStats, error) {
+	pending, oldest, err := r.outbox.Backlog(ctx)
+	if err != nil {
+		return ReplicationStats{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := ReplicationStats{
+		Pending:       pending,
+		Replicated:    r.replicated,
+		Failed:        r.failed,
+		FailoverReads: r.failoverReads,
+	}
+	if oldest != nil {
+		stats.LagSeconds = time.Since(*oldest).Seconds()
+	}
+	if !r.lastSuccess.IsZero() {
+		last := r.lastSuccess
+		stats.LastSuccess = &last
+	}
+	return stats, nil
+}
+
+// Retry queues changes still pending in the outbox, for when the queue
+// overflowed, the secondary was down for longer than the retries cover or
+// a server stopped before copying its changes.
+func (r *Replicated) Retry(ctx context.Context) error {
+	changes, err := r.outbox.Pending(ctx, time.Now().Add(-retryDelay), retryBatch)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		// Whether it was a put or a delete, copying the primary's current
+		// state (present or not) is what the secondary needs
+		r.send(replicationOp{key: c.Key, contentType: c.ContentType, version: c.Version})
+	}
+	return nil
+}
+
+func (r *Replicated) send(op replicationOp) {
+	id := op.key + "\x00" + op.version
+	r.mu.Lock()
+	if r.inFlight[id] {
+		r.mu.Unlock()
+		return
+	}
+	r.inFlight[id] = true
+	r.mu.Unlock()
+
+	select {
+	case r.queue <- op:
+	default:
+		// Still in the outbox, so Retry picks it up later
+		r.mu.Lock()
+		delete(r.inFlight, id)
+		r.mu.Unlock()
+		slog.Warn("objectstore: replication queue full, deferring", "key", op.key)
+	}
+}
+
+func (r *Replicated) run() {
+	for op := range r.queue {
+		var err error
+		for attempt := 1; attempt <= replicationRetries; attempt++ {
+			if err = r.replicate(op); err == nil {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err == nil {
+			err = r.done(op)
+		}
+
+		r.mu.Lock()
+		delete(r.inFlight, op.key+"\x00"+op.version)
+		if err != nil {
+			r.failed++
+		} else {
+			r.replicated++
+			r.lastSuccess = time.Now()
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			slog.Error("objectstore: replicating failed", "key", op.key, "error", err)
+		}
+	}
+}
+
+func (r *Replicated) done(op replicationOp) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := r.outbox.Done(ctx, op.key, op.version); err != nil {
+		return fmt.Errorf("clearing outbox: %w", err)
+	}
+	return nil
+}
+
+// replicate makes the secondary match the primary for one key. The data is
+// read back from the primary rather than kept in the queue, so a later
+// write to the same key is never overwritten by an older copy.
+func (r *Replicated) replicate(op replicationOp) error {
+	ctx, cancel := context.WithTimeout(context.Background(), replicationTimeout)
+	defer cancel()
+
+	if op.delete {
+		return r.secondary.Delete(ctx, op.key)
+	}
+
+	body, err := r.primary.Get(ctx, op.key)
+	if errors.Is(err, ErrNotFound) {
+		return r.secondary.Delete(ctx, op.key)
+	}
+	if err != nil {
+		return fmt.Errorf("reading primary: %w", err)
+	}
+	defer body.Close()
+	return r.secondary.PutStream(ctx, op.key, body, op.contentType)
+}
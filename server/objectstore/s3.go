@@ -0,0 +1,280 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-manager/sigv4"
+)
+
+// S3Config configures an S3-compatible bucket. Endpoint defaults to AWS for
+// Region; set it, usually with PathStyle, for MinIO and other services.
+type S3Config struct {
+	Endpoint  string // e.g. https://minio.internal:9000
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	Client    *http.Client
+}
+
+// S3 stores objects in a bucket, signing requests with AWS Signature
+// Version 4. It speaks the REST API directly.
+type S3 struct {
+	cfg S3Config
+}
+
+func NewS3(cfg S3Config) *S3 {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	if cfg.Client == nil {
+		// No overall timeout, since reading a large object takes as long as
+		// it takes; callers bound requests with their context instead
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = time.Minute
+		cfg.Client = &http.Client{Transport: transport}
+	}
+	return &S3{cfg: cfg}
+}
+
+func (s *S3) objectURL(key string) string {
+	if s.cfg.Prefix != "" {
+		key = s.cfg.Prefix + "/" + strings.TrimLeft(key, "/")
+	}
+	escaped := (&url.URL{Path: "/" + key}).EscapedPath()
+
+	if s.cfg.PathStyle {
+		return s.cfg.Endpoint + "/" + s.cfg.Bucket + escaped
+	}
+	u, _ := url.Parse(s.cfg.Endpoint)
+	return u.Scheme + "://" + s.cfg.Bucket + "." + u.Host + escaped
+}
+
+func (s *S3) Location(key string) string {
+	if s.cfg.Prefix != "" {
+		key = s.cfg.Prefix + "/" + strings.TrimLeft(key, "/")
+	}
+	return "s3://" + s.cfg.Bucket + "/" + key
+}
+
+func (s *S3) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req, data)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "put "+key)
+}
+
+// s3PartSize is how much of a stream is buffered per multipart upload
+// part; S3 needs at least 5 MiB for every part but the last.
+const s3PartSize = 8 << 20
+
+// PutStream sends a stream that fits in one part as a plain PUT and
+// anything larger as a multipart upload, which is aborted if r fails.
+func (s *S3) PutStream(ctx context.Context, key string, r io.Reader, contentType string) error {
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return s.Put(ctx, key, buf[:n], contentType)
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.createMultipartUpload(ctx, key, contentType)
+	if err != nil {
+		return err
+	}
+	var parts []completedPart
+	for number := 1; ; number++ {
+		etag, err := s.uploadPart(ctx, key, uploadID, number, buf[:n])
+		if err != nil {
+			s.abortMultipartUpload(key, uploadID)
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+
+		n, err = io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			s.abortMultipartUpload(key, uploadID)
+			return err
+		}
+	}
+
+	if err := s.completeMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		s.abortMultipartUpload(key, uploadID)
+		return err
+	}
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3) createMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.objectURL(key)+"?uploads", nil)
+	if err != nil {
+		return "", err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", checkResponse(resp, "create multipart upload "+key)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("objectstore: s3: create multipart upload %s: no upload ID in response", key)
+	}
+	return result.UploadID, nil
+}
+
+func (s *S3) uploadPart(ctx context.Context, key, uploadID string, number int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key)+"?"+query.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.do(req, data)
+	if err != nil {
+		return "", err
+	}
+	etag := resp.Header.Get("ETag")
+	if err := checkResponse(resp, fmt.Sprintf("upload part %d of %s", number, key)); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+func (s *S3) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	query := url.Values{"uploadId": {uploadID}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.objectURL(key)+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 can report a failed completion in the body of a 200
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK || bytes.Contains(msg, []byte("<Error>")) {
+		return fmt.Errorf("objectstore: s3: complete multipart upload %s: %s: %s", key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// abortMultipartUpload discards the parts of a failed upload. It runs even
+// when the caller's context is done, so S3 doesn't keep billing for them.
+func (s *S3) abortMultipartUpload(key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	query := url.Values{"uploadId": {uploadID}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key)+"?"+query.Encode(), nil)
+	if err != nil {
+		return
+	}
+	if resp, err := s.do(req, nil); err == nil {
+		checkResponse(resp, "abort multipart upload "+key)
+	}
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		return nil, checkResponse(resp, "get "+key)
+	}
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "delete "+key)
+}
+
+func (s *S3) do(req *http.Request, body []byte) (*http.Response, error) {
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("objectstore: s3: %w", err)
+	}
+	return resp, nil
+}
+
+func checkResponse(resp *http.Response, action string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("objectstore: s3: %s: %s: %s", action, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	creds := sigv4.Credentials{AccessKey: s.cfg.AccessKey, SecretKey: s.cfg.SecretKey}
+	sigv4.Sign(req, body, creds, s.cfg.Region, "s3", now)
+}
@@ -0,0 +1,93 @@
+// Package ocr extracts text from images. Engines are interchangeable so a
+// deployment can use a local tesseract install or a hosted OCR service.
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Engine extracts text from an encoded image (PNG, JPEG, ...).
+type Engine interface {
+	Extract(ctx context.Context, image []byte) (string, error)
+}
+
+// Tesseract runs the tesseract command-line tool.
+type Tesseract struct {
+	// Path to the tesseract binary; "tesseract" on $PATH when empty.
+	Path string
+	// Languages in tesseract's format, e.g. "eng+deu". Defaults to "eng".
+	Languages string
+}
+
+func (t *Tesseract) Extract(ctx context.Context, image []byte) (string, error) {
+	path := t.Path
+	if path == "" {
+		path = "tesseract"
+	}
+	langs := t.Languages
+	if langs == "" {
+		langs = "eng"
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, "stdin", "stdout", "-l", langs)
+	cmd.Stdin = bytes.NewReader(image)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ocr: tesseract: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Service posts images to an external OCR service. The service receives the
+// raw image as the request body and must answer with {"text": "..."}.
+type Service struct {
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+func (s *Service) Extract(ctx context.Context, image []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(image))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(image))
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("ocr: service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("ocr: service returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("ocr: decoding service response: %w", err)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/ocr"
+	"backup-manager/search"
+)
+
+const ocrTimeout = 2 * time.Minute
+
+type ocrJob struct {
+	doc   search.Document
+	image []byte
+}
+
+var (
+	ocrEngine ocr.Engine
+	ocrQueue  = make(chan ocrJob, 100)
+)
+
+// initOCR configures the optional OCR step from OCR_PROVIDER ("tesseract" or
+// "service"). OCR stays disabled when it is unset.
+func initOCR() {
+	switch config.Get("OCR_PROVIDER") {
+	case "":
+		return
+	case "tesseract":
+		ocrEngine = &ocr.Tesseract{
+			Path:      config.Get("OCR_TESSERACT_PATH"),
+			Languages: config.Get("OCR_LANGUAGES"),
+		}
+	case "service":
+		if config.Get("OCR_SERVICE_URL") == "" {
+			fatal("OCR_SERVICE_URL must be set when OCR_PROVIDER=service")
+		}
+		ocrEngine = &ocr.Service{
+			URL:    config.Get("OCR_SERVICE_URL"),
+			APIKey: config.Get("OCR_SERVICE_API_KEY"),
+		}
+	default:
+		fatal("Unknown OCR_PROVIDER", "provider", config.Get("OCR_PROVIDER"))
+	}
+
+	go runOCRWorker()
+}
+
+// enqueueOCR schedules text extraction for an uploaded image whose search
+// document is doc. It never blocks the upload; when the queue is full the
+// image is skipped.
+func enqueueOCR(doc search.Document, image []byte) {
+	if ocrEngine == nil {
+		return
+	}
+
+	select {
+	case ocrQueue <- ocrJob{doc: doc, image: image}:
+	default:
+		slog.Warn("OCR queue full, skipping", "type", doc.Type, "id", doc.ID)
+	}
+}
+
+func runOCRWorker() {
+	for job := range ocrQueue {
+		waitOutMaintenance()
+
+		ctx, cancel := context.WithTimeout(context.Background(), ocrTimeout)
+		text, err := ocrEngine.Extract(ctx, job.image)
+		cancel()
+
+		if err != nil {
+			slog.Error("OCR failed", "type", job.doc.Type, "id", job.doc.ID, "error", err)
+			continue
+		}
+		if text == "" {
+			continue
+		}
+
+		indexExtractedText(job.doc, text)
+	}
+}
+
+// indexExtractedText re-indexes an item with the text recovered from its
+// image so it is searchable alongside the item's own metadata.
+func indexExtractedText(doc search.Document, text string) {
+	// Save extracted text on the item record (implement your DB logic here)
+
+	doc.Body = strings.TrimSpace(doc.Body + "\n" + text)
+	indexDocuments(doc)
+	enqueueEmbedding(doc, "")
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+)
+
+// The OpenAPI document is built from the router, so every route is in it
+// whether or not it is described below. apiOperations adds what the router
+// can't know: a summary, whether the route is public, its success status
+// and what it returns.
+
+// apiOperation describes one route, keyed by "METHOD /path/{template}".
+type apiOperation struct {
+	Summary string
+	Public  bool
+	// Status is the success status, http.StatusOK if zero
+	Status int
+	// Response is a value of the type the route returns as JSON
+	Response interface{}
+	// ContentType is what the route returns when it isn't JSON
+	ContentType string
+}
+
+var apiOperations = map[string]apiOperation{
+	"GET /health":                                               {Summary: "Check the server is up", Public: true},
+	"GET /api/status":                                           {Summary: "Get maintenance status", Public: true},
+	"GET /api/openapi.json":                                     {Summary: "Get this OpenAPI document", Public: true},
+	"GET /api/docs":                                             {Summary: "Browse the API documentation", Public: true, ContentType: "text/html"},
+	"POST /api/auth/register":                                   {Summary: "Create an account", Public: true},
+	"POST /api/auth/login":                                      {Summary: "Log in", Public: true},
+	"POST /api/auth/refresh":                                    {Summary: "Exchange a refresh token for new tokens", Public: true},
+	"POST /api/auth/logout":                                     {Summary: "Revoke a refresh token", Public: true, Status: http.StatusNoContent},
+	"POST /api/auth/password-reset":                             {Summary: "Set a new password with a reset token", Public: true, Status: http.StatusNoContent},
+	"GET /api/auth/oauth":                                       {Summary: "List OAuth login providers", Public: true},
+	"POST /api/auth/oauth/exchange":                             {Summary: "Exchange an OAuth login code for tokens", Public: true},
+	"GET /api/auth/oauth/{provider}/start":                      {Summary: "Start an OAuth login", Public: true, Status: http.StatusFound},
+	"GET /api/auth/oauth/{provider}/callback":                   {Summary: "Finish an OAuth login", Public: true, Status: http.StatusFound},
+	"GET /api/exports/{id}/download":                            {Summary: "Download a data export with a signed link", Public: true, ContentType: "application/zip"},
+	"GET /api/shared/backups/{id}":                              {Summary: "Download a backup with a signed link", Public: true, ContentType: "application/octet-stream"},
+	"GET /api/shared/qr/{id}/image":                             {Summary: "Get a QR code's image with a signed link", Public: true, ContentType: "image/png"},
+	"GET /api/shared/projects/{id}/files/{path:.+}":             {Summary: "Download a project file with a signed link", Public: true, ContentType: "text/plain"},
+	"GET /api/policies":                                         {Summary: "List current policies", Public: true},
+	"GET /api/policies/{type}":                                  {Summary: "Get the current policy of a type", Public: true},
+	"POST /api/account/email/confirm":                           {Summary: "Confirm an email change", Public: true},
+	"POST /api/account/email/cancel":                            {Summary: "Cancel an email change from its notice", Public: true, Status: http.StatusNoContent},
+	"POST /api/demo/qr":                                         {Summary: "Render a demo QR code", Public: true, ContentType: "image/png"},
+	"GET /r/{code}":                                             {Summary: "Follow a dynamic QR code", Public: true, Status: http.StatusFound},
+	"POST /r/{code}":                                            {Summary: "Enter a dynamic QR code's password", Public: true, Status: http.StatusSeeOther},
+	"GET /p/{token}":                                            {Summary: "View a shared project", Public: true, ContentType: "text/html"},
+	"POST /p/{token}":                                           {Summary: "View a password-protected shared project", Public: true, ContentType: "text/html"},
+	"GET /ws":                                                   {Summary: "Receive job progress over a WebSocket", Status: http.StatusSwitchingProtocols},
+	"GET /api/jobs":                                             {Summary: "List jobs", Response: []storage.Job{}},
+	"GET /api/jobs/{id}":                                        {Summary: "Get a job", Response: storage.Job{}},
+	"GET /api/jobs/{id}/result":                                 {Summary: "Download a job's result", ContentType: "application/octet-stream"},
+	"POST /api/backups":                                         {Summary: "Upload a backup", Response: Backup{}},
+	"GET /api/backups":                                          {Summary: "List backups", Response: []listedBackup{}},
+	"OPTIONS /api/uploads":                                      {Summary: "Get the tus protocol versions and extensions supported", Public: true, Status: http.StatusNoContent},
+	"POST /api/uploads":                                         {Summary: "Start a resumable upload of a backup (tus)", Status: http.StatusCreated},
+	"HEAD /api/uploads/{id}":                                    {Summary: "Get how much of a resumable upload is stored"},
+	"PATCH /api/uploads/{id}":                                   {Summary: "Add to a resumable upload; the last part returns the backup", Response: Backup{}},
+	"DELETE /api/uploads/{id}":                                  {Summary: "Cancel a resumable upload", Status: http.StatusNoContent},
+	"DELETE /api/backups/{id}":                                  {Summary: "Move a backup to the trash", Status: http.StatusNoContent},
+	"GET /api/backups/{id}/download":                            {Summary: "Download a backup", ContentType: "application/octet-stream"},
+	"POST /api/backups/{id}/verify":                             {Summary: "Check a backup against its checksums"},
+	"GET /api/backups/{id}/versions":                            {Summary: "List a backup's versions", Response: []Backup{}},
+	"GET /api/backups/{id}/diff":                                {Summary: "Compare two versions of a backup"},
+	"GET /api/backups/{id}/thumbnail":                           {Summary: "Get a backup's thumbnail", ContentType: "image/png"},
+	"POST /api/backups/{id}/summary":                            {Summary: "Summarize a backup again"},
+	"POST /api/backups/{id}/parse":                              {Summary: "Extract a backup's projects in the background", Status: http.StatusAccepted, Response: storage.Job{}},
+	"POST /api/backups/{id}/links":                              {Summary: "Make a signed link to download a backup", Status: http.StatusCreated, Response: SignedLink{}},
+	"POST /api/imports":                                         {Summary: "Import a chat export from a URL", Status: http.StatusAccepted, Response: ChatImport{}},
+	"GET /api/imports":                                          {Summary: "List imports", Response: []ChatImport{}},
+	"GET /api/imports/{id}":                                     {Summary: "Get an import", Response: ChatImport{}},
+	"POST /api/connectors":                                      {Summary: "Create a connector", Status: http.StatusCreated, Response: Connector{}},
+	"GET /api/connectors":                                       {Summary: "List connectors", Response: []Connector{}},
+	"GET /api/connectors/{id}":                                  {Summary: "Get a connector", Response: Connector{}},
+	"PUT /api/connectors/{id}":                                  {Summary: "Update a connector", Response: Connector{}},
+	"DELETE /api/connectors/{id}":                               {Summary: "Delete a connector", Status: http.StatusNoContent},
+	"POST /api/connectors/{id}/run":                             {Summary: "Run a connector now", Status: http.StatusAccepted},
+	"GET /api/projects":                                         {Summary: "List projects", Response: []Project{}},
+	"POST /api/projects":                                        {Summary: "Create a project", Status: http.StatusCreated, Response: Project{}},
+	"GET /api/projects/duplicates":                              {Summary: "Find duplicate projects"},
+	"GET /api/projects/starred":                                 {Summary: "List starred projects", Response: []Project{}},
+	"GET /api/projects/recent":                                  {Summary: "List recently opened projects", Response: []Project{}},
+	"POST /api/projects/merge":                                  {Summary: "Merge projects"},
+	"GET /api/projects/{id}":                                    {Summary: "Get a project", Response: Project{}},
+	"PUT /api/projects/{id}":                                    {Summary: "Update a project", Response: Project{}},
+	"PATCH /api/projects/{id}":                                  {Summary: "Update a project", Response: Project{}},
+	"DELETE /api/projects/{id}":                                 {Summary: "Move a project to the trash", Status: http.StatusNoContent},
+	"POST /api/projects/{id}/description":                       {Summary: "Describe a project again"},
+	"GET /api/projects/{id}/suggest-tags":                       {Summary: "Suggest tags for a project"},
+	"POST /api/projects/{id}/run":                               {Summary: "Run a project's snippet in the sandbox"},
+	"GET /api/projects/{id}/download":                           {Summary: "Download a project's files as a ZIP", ContentType: "application/zip"},
+	"POST /api/projects/{id}/share":                             {Summary: "Create a read-only link to a project", Response: projectShareView{}, Status: http.StatusCreated},
+	"GET /api/projects/{id}/shares":                             {Summary: "List a project's links", Response: []projectShareView{}},
+	"DELETE /api/projects/{id}/shares/{shareId}":                {Summary: "Revoke a project link", Status: http.StatusNoContent},
+	"POST /api/projects/{id}/files/links":                       {Summary: "Make a signed link to download a project file", Status: http.StatusCreated, Response: SignedLink{}},
+	"GET /api/collections":                                      {Summary: "List collections", Response: []storage.Collection{}},
+	"POST /api/collections":                                     {Summary: "Create a collection", Status: http.StatusCreated, Response: storage.Collection{}},
+	"GET /api/collections/{id}":                                 {Summary: "Get a collection with its projects"},
+	"PUT /api/collections/{id}":                                 {Summary: "Update a collection", Response: storage.Collection{}},
+	"PATCH /api/collections/{id}":                               {Summary: "Update a collection", Response: storage.Collection{}},
+	"DELETE /api/collections/{id}":                              {Summary: "Delete a collection", Status: http.StatusNoContent},
+	"PUT /api/collections/{id}/projects/{projectId}":            {Summary: "Add a project to a collection", Status: http.StatusNoContent},
+	"DELETE /api/collections/{id}/projects/{projectId}":         {Summary: "Remove a project from a collection", Status: http.StatusNoContent},
+	"GET /api/tags":                                             {Summary: "List tags with how many projects have each", Response: []TagCount{}},
+	"GET /api/tags/autocomplete":                                {Summary: "Complete a tag from its start", Response: []TagCount{}},
+	"POST /api/tags/rename":                                     {Summary: "Rename a tag on every project"},
+	"POST /api/tags/merge":                                      {Summary: "Merge tags into one on every project"},
+	"GET /api/trash":                                            {Summary: "List the trash"},
+	"DELETE /api/trash":                                         {Summary: "Empty the trash"},
+	"POST /api/trash/backups/{id}/restore":                      {Summary: "Restore a backup from the trash"},
+	"DELETE /api/trash/backups/{id}":                            {Summary: "Delete a backup for good", Status: http.StatusNoContent},
+	"POST /api/trash/projects/{id}/restore":                     {Summary: "Restore a project from the trash"},
+	"DELETE /api/trash/projects/{id}":                           {Summary: "Delete a project for good", Status: http.StatusNoContent},
+	"GET /api/sandbox/languages":                                {Summary: "List languages snippets can run in"},
+	"GET /api/reports/integrity":                                {Summary: "List backup integrity reports"},
+	"GET /api/search":                                           {Summary: "Search backups and projects"},
+	"GET /api/search/semantic":                                  {Summary: "Search backups and projects by meaning"},
+	"POST /api/qr":                                              {Summary: "Create a QR code", Status: http.StatusCreated, ContentType: "image/png"},
+	"POST /api/qr/batch":                                        {Summary: "Create QR codes in a batch", Status: http.StatusCreated, ContentType: "application/zip"},
+	"POST /api/qr/batch/jobs":                                   {Summary: "Create QR codes in a batch in the background", Status: http.StatusAccepted, Response: storage.Job{}},
+	"POST /api/qr/decode":                                       {Summary: "Decode QR codes in an image"},
+	"POST /api/qr/logos":                                        {Summary: "Upload a logo", Status: http.StatusCreated, Response: QRLogo{}},
+	"GET /api/qr/logos":                                         {Summary: "List logos", Response: []QRLogo{}},
+	"GET /api/qr/logos/{id}":                                    {Summary: "Get a logo's image", ContentType: "image/png"},
+	"DELETE /api/qr/logos/{id}":                                 {Summary: "Delete a logo", Status: http.StatusNoContent},
+	"POST /api/qr/templates":                                    {Summary: "Create a QR template", Status: http.StatusCreated, Response: QRTemplate{}},
+	"GET /api/qr/templates":                                     {Summary: "List QR templates", Response: []QRTemplate{}},
+	"GET /api/qr/templates/{id}":                                {Summary: "Get a QR template", Response: QRTemplate{}},
+	"PUT /api/qr/templates/{id}":                                {Summary: "Update a QR template", Response: QRTemplate{}},
+	"DELETE /api/qr/templates/{id}":                             {Summary: "Delete a QR template", Status: http.StatusNoContent},
+	"PUT /api/qr/{id}/target":                                   {Summary: "Change where a dynamic code leads"},
+	"GET /api/qr/{id}/targets":                                  {Summary: "List where a dynamic code has led"},
+	"PUT /api/qr/{id}/password":                                 {Summary: "Set a dynamic code's password", Response: QRCode{}},
+	"DELETE /api/qr/{id}/password":                              {Summary: "Remove a dynamic code's password", Response: QRCode{}},
+	"PUT /api/qr/{id}/pages":                                    {Summary: "Set a dynamic code's scan pages and live period", Response: QRCode{}},
+	"POST /api/qr/{id}/links":                                   {Summary: "Make a signed link to a QR code's image", Status: http.StatusCreated, Response: SignedLink{}},
+	"GET /api/qr/label-templates":                               {Summary: "List label sheet templates"},
+	"POST /api/qr/sheet-layout":                                 {Summary: "Lay out codes on a label sheet"},
+	"POST /api/qr/contact":                                      {Summary: "Build a contact card payload"},
+	"POST /api/qr/lint":                                         {Summary: "Check a payload for scanning problems"},
+	"POST /api/qr/colors/check":                                 {Summary: "Check colors have enough contrast"},
+	"GET /api/qr/frames":                                        {Summary: "List frame templates"},
+	"POST /api/qr/frames/preview":                               {Summary: "Preview a code in a frame", ContentType: "image/png"},
+	"GET /api/qr/pages/languages":                               {Summary: "List languages of hosted pages"},
+	"GET /api/qr/pages/{page}/preview":                          {Summary: "Preview a hosted page", ContentType: "text/html"},
+	"GET /api/qr/{id}/analytics":                                {Summary: "Get a code's scan analytics"},
+	"GET /api/qr/{id}/analytics/geo":                            {Summary: "Get where a code was scanned"},
+	"POST /api/policies/accept":                                 {Summary: "Accept a policy"},
+	"GET /api/account/policies":                                 {Summary: "List the policies you accepted"},
+	"GET /api/account/sessions":                                 {Summary: "List the devices you are logged in on", Response: []sessionInfo{}},
+	"DELETE /api/account/sessions":                              {Summary: "Log out everywhere else"},
+	"DELETE /api/account/sessions/{id}":                         {Summary: "Log a device out", Status: http.StatusNoContent},
+	"GET /api/account/retention":                                {Summary: "Get your backup retention policy", Response: storage.RetentionPolicy{}},
+	"PUT /api/account/retention":                                {Summary: "Set your backup retention policy", Response: storage.RetentionPolicy{}},
+	"DELETE /api/account/retention":                             {Summary: "Keep all your backups again", Status: http.StatusNoContent},
+	"POST /api/account/retention/preview":                       {Summary: "List the backups a retention policy would move to the trash"},
+	"POST /api/account/email":                                   {Summary: "Ask to change your email", Status: http.StatusAccepted},
+	"GET /api/account/email":                                    {Summary: "Get a pending email change"},
+	"DELETE /api/account/email":                                 {Summary: "Cancel a pending email change", Status: http.StatusNoContent},
+	"POST /api/account/recovery-codes":                          {Summary: "Generate new recovery codes"},
+	"GET /api/account/recovery-codes":                           {Summary: "Count unused recovery codes"},
+	"POST /api/account/2fa":                                     {Summary: "Start setting up two-factor login"},
+	"GET /api/account/2fa":                                      {Summary: "Get two-factor login status"},
+	"DELETE /api/account/2fa":                                   {Summary: "Turn off two-factor login", Status: http.StatusNoContent},
+	"POST /api/account/2fa/verify":                              {Summary: "Finish setting up two-factor login"},
+	"POST /api/account/recovery-key":                            {Summary: "Create a data recovery key"},
+	"GET /api/account/recovery-key":                             {Summary: "Get data recovery key status"},
+	"DELETE /api/account/recovery-key":                          {Summary: "Delete the data recovery key", Status: http.StatusNoContent},
+	"POST /api/account/recovery-key/recover":                    {Summary: "Restore the data key with a recovery key"},
+	"POST /api/account/data-key/unlock":                         {Summary: "Unlock the data key with your password"},
+	"POST /api/webhooks":                                        {Summary: "Create a webhook", Status: http.StatusCreated},
+	"GET /api/webhooks":                                         {Summary: "List webhooks", Response: []WebhookEndpoint{}},
+	"GET /api/webhooks/events":                                  {Summary: "List events webhooks can subscribe to", Response: []string{}},
+	"GET /api/webhooks/{id}":                                    {Summary: "Get a webhook", Response: WebhookEndpoint{}},
+	"PUT /api/webhooks/{id}":                                    {Summary: "Update a webhook", Response: WebhookEndpoint{}},
+	"DELETE /api/webhooks/{id}":                                 {Summary: "Delete a webhook", Status: http.StatusNoContent},
+	"POST /api/webhooks/{id}/rotate-secret":                     {Summary: "Rotate a webhook's signing secret"},
+	"POST /api/webhooks/{id}/enable":                            {Summary: "Enable a disabled webhook"},
+	"GET /api/webhooks/{id}/deliveries":                         {Summary: "List a webhook's deliveries", Response: []WebhookDelivery{}},
+	"POST /api/webhooks/{id}/deliveries/{deliveryId}/redeliver": {Summary: "Send a delivery again", Status: http.StatusAccepted},
+	"POST /api/account/exports":                                 {Summary: "Export your data", Status: http.StatusAccepted, Response: DataExport{}},
+	"GET /api/account/exports":                                  {Summary: "List data exports", Response: []DataExport{}},
+	"GET /api/account/exports/{id}":                             {Summary: "Get a data export", Response: DataExport{}},
+	"DELETE /api/account":                                       {Summary: "Schedule your account for deletion", Status: http.StatusAccepted},
+	"GET /api/account/deletion":                                 {Summary: "Get when your account is to be deleted"},
+	"GET /api/account/usage":                                    {Summary: "Get your storage usage and quota", Response: accountUsage{}},
+	"GET /api/stats":                                            {Summary: "Get the aggregates for your dashboard"},
+	"POST /api/account/deletion/cancel":                         {Summary: "Cancel your account's deletion", Status: http.StatusNoContent},
+	"GET /api/account/export":                                   {Summary: "Export your account as a ZIP, in the background", Status: http.StatusAccepted, Response: storage.Job{}},
+	"POST /api/teams":                                           {Summary: "Create a team", Status: http.StatusCreated, Response: storage.Team{}},
+	"GET /api/teams":                                            {Summary: "List your teams", Response: []storage.Team{}},
+	"POST /api/teams/invites/accept":                            {Summary: "Accept an invite to a team", Response: storage.Team{}},
+	"GET /api/teams/{id}":                                       {Summary: "Get a team and its members"},
+	"PUT /api/teams/{id}":                                       {Summary: "Rename a team", Response: storage.Team{}},
+	"DELETE /api/teams/{id}":                                    {Summary: "Delete a team and everything in it", Status: http.StatusNoContent},
+	"POST /api/teams/{id}/invites":                              {Summary: "Invite someone to a team", Status: http.StatusCreated, Response: TeamInvite{}},
+	"GET /api/teams/{id}/invites":                               {Summary: "List a team's pending invites", Response: []TeamInvite{}},
+	"DELETE /api/teams/{id}/invites/{inviteId}":                 {Summary: "Revoke an invite", Status: http.StatusNoContent},
+	"PUT /api/teams/{id}/members/{userId}":                      {Summary: "Change a member's role", Response: storage.TeamMember{}},
+	"DELETE /api/teams/{id}/members/{userId}":                   {Summary: "Remove a member, or leave a team", Status: http.StatusNoContent},
+	"POST /api/keys":                                            {Summary: "Create an API key", Status: http.StatusCreated},
+	"GET /api/keys":                                             {Summary: "List API keys", Response: []APIKey{}},
+	"DELETE /api/keys/{id}":                                     {Summary: "Revoke an API key", Status: http.StatusNoContent},
+	"GET /api/keys/{id}/usage":                                  {Summary: "Get an API key's usage"},
+	"GET /api/links":                                            {Summary: "List signed links", Response: []SignedLink{}},
+	"DELETE /api/links/{id}":                                    {Summary: "Revoke a signed link", Status: http.StatusNoContent},
+	"GET /api/admin/maintenance":                                {Summary: "Get maintenance mode"},
+	"PUT /api/admin/maintenance":                                {Summary: "Set maintenance mode"},
+	"POST /api/admin/policies":                                  {Summary: "Publish a policy version", Status: http.StatusCreated},
+	"POST /api/admin/legal-holds":                               {Summary: "Place a legal hold", Status: http.StatusCreated},
+	"GET /api/admin/legal-holds":                                {Summary: "List legal holds"},
+	"DELETE /api/admin/legal-holds/{id}":                        {Summary: "Release a legal hold"},
+	"POST /api/admin/search/rebuild":                            {Summary: "Rebuild the search index", Status: http.StatusAccepted},
+	"POST /api/admin/warehouse-exports":                         {Summary: "Export analytics to the warehouse", Status: http.StatusAccepted},
+	"GET /api/admin/warehouse-exports":                          {Summary: "List warehouse exports"},
+	"POST /api/admin/reports/integrity":                         {Summary: "Check backup integrity", Status: http.StatusAccepted, Response: IntegrityRun{}},
+	"GET /api/admin/encryption":                                 {Summary: "Get encryption key rotation status"},
+	"POST /api/admin/encryption/rotate":                         {Summary: "Re-encrypt data under the current key", Status: http.StatusAccepted},
+	"GET /api/admin/replication":                                {Summary: "Get blob replication status"},
+	"GET /api/admin/database":                                   {Summary: "Get database status"},
+	"GET /api/admin/usage":                                      {Summary: "Get usage across accounts"},
+	"GET /api/admin/users":                                      {Summary: "List users"},
+	"GET /api/admin/users/{id}":                                 {Summary: "Get a user"},
+	"PUT /api/admin/users/{id}/role":                            {Summary: "Set a user's role"},
+	"PUT /api/admin/users/{id}/plan":                            {Summary: "Set a user's plan and storage quota"},
+	"POST /api/admin/users/{id}/disable":                        {Summary: "Disable a user"},
+	"POST /api/admin/users/{id}/enable":                         {Summary: "Enable a user"},
+	"POST /api/admin/users/{id}/password-reset":                 {Summary: "Make a user reset their password", Status: http.StatusAccepted},
+	"POST /api/admin/users/{id}/unlock":                         {Summary: "Clear a user's failed logins and lockout", Status: http.StatusNoContent},
+	"GET /api/admin/domain-events":                              {Summary: "List domain events"},
+}
+
+// OpenAPI 3.0 document, as much of it as is generated.
+type (
+	openAPIDoc struct {
+		OpenAPI    string                          `json:"openapi"`
+		Info       openAPIInfo                     `json:"info"`
+		Servers    []map[string]string             `json:"servers"`
+		Paths      map[string]map[string]openAPIOp `json:"paths"`
+		Components openAPIComponents               `json:"components"`
+	}
+	openAPIInfo struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	}
+	openAPIComponents struct {
+		Schemas         map[string]jsonSchema `json:"schemas"`
+		SecuritySchemes map[string]jsonSchema `json:"securitySchemes"`
+	}
+	openAPIOp struct {
+		OperationID string                     `json:"operationId"`
+		Summary     string                     `json:"summary,omitempty"`
+		Description string                     `json:"description,omitempty"`
+		Tags        []string                   `json:"tags,omitempty"`
+		Parameters  []openAPIParam             `json:"parameters,omitempty"`
+		Security    []map[string][]string      `json:"security"`
+		Responses   map[string]openAPIResponse `json:"responses"`
+		// APIKeyScopes are the scopes an API key needs, any one of them
+		APIKeyScopes []string `json:"x-api-key-scopes,omitempty"`
+	}
+	openAPIParam struct {
+		Name     string     `json:"name"`
+		In       string     `json:"in"`
+		Required bool       `json:"required"`
+		Schema   jsonSchema `json:"schema"`
+	}
+	openAPIResponse struct {
+		Description string                `json:"description"`
+		Content     map[string]jsonSchema `json:"content,omitempty"`
+	}
+	jsonSchema = map[string]interface{}
+)
+
+// errorEnvelopeSchema is the body of every failure, see writeAPIError.
+var errorEnvelopeSchema = jsonSchema{
+	"type":     "object",
+	"required": []string{"error"},
+	"properties": jsonSchema{
+		"error": jsonSchema{
+			"type":     "object",
+			"required": []string{"code", "message"},
+			"properties": jsonSchema{
+				"code":       jsonSchema{"type": "string"},
+				"message":    jsonSchema{"type": "string"},
+				"request_id": jsonSchema{"type": "string"},
+			},
+			"additionalProperties": true,
+		},
+	},
+}
+
+// buildOpenAPI describes the routes on r.
+func buildOpenAPI(r *mux.Router) (*openAPIDoc, error) {
+	doc := &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "Backup Manager API", Version: apiVersion()},
+		Servers: []map[string]string{{"url": "/"}},
+		Paths:   map[string]map[string]openAPIOp{},
+		Components: openAPIComponents{
+			Schemas: map[string]jsonSchema{},
+			SecuritySchemes: map[string]jsonSchema{
+				"bearerAuth": {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey":     {"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+	doc.Components.Schemas["Error"] = errorEnvelopeSchema
+	schemas := &schemaBuilder{components: doc.Components.Schemas}
+
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path, params := openAPIPath(tmpl)
+		for _, method := range methods {
+			op := apiOperations[method+" "+tmpl]
+			if doc.Paths[path] == nil {
+				doc.Paths[path] = map[string]openAPIOp{}
+			}
+			doc.Paths[path][strings.ToLower(method)] = describeRoute(method, tmpl, path, params, op, schemas)
+		}
+		return nil
+	})
+	return doc, err
+}
+
+// openAPIPath turns a route template into an OpenAPI path, dropping any
+// patterns from its variables, and returns the variables' names.
+func openAPIPath(tmpl string) (string, []string) {
+	var params []string
+	segments := strings.Split(tmpl, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			name, _, _ := strings.Cut(s[1:len(s)-1], ":")
+			params = append(params, name)
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func describeRoute(method, tmpl, path string, params []string, op apiOperation, schemas *schemaBuilder) openAPIOp {
+	out := openAPIOp{
+		OperationID: operationID(method, path),
+		Summary:     op.Summary,
+		Security:    []map[string][]string{},
+		Responses:   map[string]openAPIResponse{},
+	}
+	segments := strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, "/api"), "/"), "/")
+	if segments[0] != "" && segments[0] != "admin" {
+		out.Tags = []string{segments[0]}
+	} else if len(segments) > 1 {
+		out.Tags = []string{"admin"}
+	}
+	for _, name := range params {
+		out.Parameters = append(out.Parameters, openAPIParam{Name: name, In: "path", Required: true, Schema: jsonSchema{"type": "string"}})
+	}
+
+	if !op.Public {
+		out.Security = append(out.Security, map[string][]string{"bearerAuth": {}})
+		// Ask requiredScopes about a request to this route, so the document
+		// says what authorizeAPIKey will check
+		req, err := http.NewRequest(method, strings.NewReplacer("{", "", "}", "").Replace(path), nil)
+		if err == nil {
+			if scopes, ok := requiredScopes(req); ok {
+				out.Security = append(out.Security, map[string][]string{"apiKey": {}})
+				out.APIKeyScopes = scopes
+			}
+		}
+		if strings.HasPrefix(tmpl, "/api/admin/") {
+			out.Description = "Requires the admin role."
+		} else if !strings.HasPrefix(tmpl, "/api/teams") {
+			// See workspaceMiddleware
+			out.Parameters = append(out.Parameters, openAPIParam{Name: "X-Team-ID", In: "header", Schema: jsonSchema{"type": "string"}})
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := openAPIResponse{Description: http.StatusText(status)}
+	switch {
+	case op.ContentType != "":
+		resp.Content = map[string]jsonSchema{op.ContentType: {"schema": jsonSchema{"type": "string", "format": "binary"}}}
+	case op.Response != nil:
+		resp.Content = map[string]jsonSchema{"application/json": {"schema": schemas.schema(reflect.TypeOf(op.Response))}}
+	}
+	out.Responses[strconv.Itoa(status)] = resp
+	out.Responses["default"] = openAPIResponse{
+		Description: "Error",
+		Content:     map[string]jsonSchema{"application/json": {"schema": jsonSchema{"$ref": "#/components/schemas/Error"}}},
+	}
+	return out
+}
+
+// operationID names an operation for generated clients, such as
+// "getBackupsIdVersions" for GET /api/backups/{id}/versions.
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, s := range strings.Split(strings.TrimPrefix(path, "/api"), "/") {
+		s = strings.Trim(s, "{}")
+		for _, word := range strings.FieldsFunc(s, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// schemaBuilder writes JSON schemas for Go types as their encoding/json
+// encoding, putting named structs in components.
+type schemaBuilder struct {
+	components map[string]jsonSchema
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	rawMessageType  = reflect.TypeOf(json.RawMessage{})
+	jsonMarshalType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+func (sb *schemaBuilder) schema(t reflect.Type) jsonSchema {
+	if t.Kind() == reflect.Pointer {
+		s := sb.schema(t.Elem())
+		if _, ref := s["$ref"]; ref {
+			return jsonSchema{"allOf": []jsonSchema{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	}
+	switch {
+	case t == timeType:
+		return jsonSchema{"type": "string", "format": "date-time"}
+	case t == rawMessageType, t.Implements(jsonMarshalType):
+		return jsonSchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonSchema{"type": "string", "format": "byte"}
+		}
+		return jsonSchema{"type": "array", "items": sb.schema(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": sb.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.object(t)
+		}
+		if _, ok := sb.components[t.Name()]; !ok {
+			// Claim the name first in case the type refers to itself
+			sb.components[t.Name()] = jsonSchema{}
+			sb.components[t.Name()] = sb.object(t)
+		}
+		return jsonSchema{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return jsonSchema{}
+}
+
+// object describes a struct's exported fields by their JSON names, taking in
+// the fields of embedded structs as encoding/json does.
+func (sb *schemaBuilder) object(t reflect.Type) jsonSchema {
+	props := jsonSchema{}
+	var required []string
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					add(ft)
+					continue
+				}
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = sb.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+
+	s := jsonSchema{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+// apiVersion is what the document gives as the API's version: API_VERSION,
+// or "1.0.0".
+func apiVersion() string {
+	if v := config.Get("API_VERSION"); v != "" {
+		return v
+	}
+	return "1.0.0"
+}
+
+// Handlers
+
+// openAPIHandler serves the document describing r, built the first time it
+// is asked for, once every route is registered.
+func openAPIHandler(r *mux.Router) http.HandlerFunc {
+	var once sync.Once
+	var spec []byte
+	var specErr error
+	return func(w http.ResponseWriter, req *http.Request) {
+		once.Do(func() {
+			var doc *openAPIDoc
+			if doc, specErr = buildOpenAPI(r); specErr == nil {
+				spec, specErr = json.Marshal(doc)
+			}
+		})
+		if specErr != nil {
+			logger(req.Context()).Error("Error building OpenAPI document", "error", specErr)
+			http.Error(w, "Error building API description", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Write(spec)
+	}
+}
+
+//go:embed docs/swagger.html
+var swaggerPage string
+
+var swaggerTemplate = template.Must(template.New("swagger").Parse(swaggerPage))
+
+// defaultSwaggerUIURL is where Swagger UI's script and styles are loaded
+// from unless SWAGGER_UI_URL points at a copy served elsewhere.
+const defaultSwaggerUIURL = "https://unpkg.com/swagger-ui-dist@5.17.14"
+
+// swaggerUIHandler serves Swagger UI for /api/openapi.json.
+func swaggerUIHandler(w http.ResponseWriter, r *http.Request) {
+	assets := strings.TrimSuffix(config.Get("SWAGGER_UI_URL"), "/")
+	if assets == "" {
+		assets = defaultSwaggerUIURL
+	}
+	nonce := scriptNonce()
+	origin := sourceOrigin(assets)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src "+origin+" 'nonce-"+nonce+"'; "+
+		"style-src "+origin+" 'unsafe-inline'; img-src 'self' data: "+origin+"; font-src "+origin+"; "+
+		"connect-src 'self'; frame-ancestors 'none'; base-uri 'none'")
+	if err := swaggerTemplate.Execute(w, map[string]string{"Assets": assets, "Spec": "/api/openapi.json", "Nonce": nonce}); err != nil {
+		logger(r.Context()).Error("Error rendering API docs", "error", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Package passhash hashes passwords with argon2id, or bcrypt, and verifies
+// hashes made with either.
+//
+// Argon2id hashes are stored in the PHC string format,
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+//
+// so the parameters a hash was made with travel with it and can be raised
+// without invalidating existing hashes. Verify reports when a hash should
+// be replaced: when it is bcrypt, or argon2id with other parameters, and
+// the Hasher is configured otherwise.
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrMismatch = errors.New("passhash: password does not match")
+	ErrFormat   = errors.New("passhash: unrecognised hash")
+)
+
+// Algorithms a Hasher can hash with.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+const (
+	saltLen = 16
+	keyLen  = 32
+)
+
+// Params tune argon2id. Memory is in KiB.
+type Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultParams are the second recommendation of RFC 9106, for when
+// 2 GiB a hash is too much: 64 MiB, three passes, four lanes.
+var DefaultParams = Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 4}
+
+// Hasher hashes new passwords with Algorithm: argon2id with Params, or
+// bcrypt at its default cost.
+type Hasher struct {
+	Algorithm string
+	Params    Params
+}
+
+// Default hashes with argon2id and DefaultParams.
+var Default = Hasher{Algorithm: Argon2id, Params: DefaultParams}
+
+// Hash returns the hash of password to store.
+func (h Hasher) Hash(password string) (string, error) {
+	if h.Algorithm == Bcrypt {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hashed), err
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := h.Params
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks password against hash, returning ErrMismatch if it is
+// wrong. rehash is true when the password is right but hash isn't what
+// Hash would make now, so it should be replaced.
+func (h Hasher) Verify(password, hash string) (rehash bool, err error) {
+	if isBcrypt(hash) {
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, ErrMismatch
+			}
+			return false, err
+		}
+		return h.Algorithm != Bcrypt, nil
+	}
+
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	got := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return false, ErrMismatch
+	}
+	return h.Algorithm == Bcrypt || p != h.Params || len(key) != keyLen, nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func parseArgon2id(hash string) (p Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	if len(parts) != 6 || parts[0] != "" || parts[1] != Argon2id {
+		return p, nil, nil, ErrFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil ||
+		p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, ErrFormat
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrFormat
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, ErrFormat
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"backup-manager/config"
+	"backup-manager/passhash"
+	"backup-manager/storage"
+)
+
+// passwordHasher hashes new passwords: argon2id unless PASSWORD_HASHER is
+// bcrypt, tuned by PASSWORD_HASH_MEMORY (KiB), PASSWORD_HASH_ITERATIONS and
+// PASSWORD_HASH_PARALLELISM. Hashes made any other way, older bcrypt ones
+// included, still verify and are replaced at the next login.
+var passwordHasher = passhash.Default
+
+func initPasswordHashing() {
+	h := passhash.Default
+	switch alg := config.Get("PASSWORD_HASHER"); alg {
+	case "", passhash.Argon2id:
+	case passhash.Bcrypt:
+		h.Algorithm = passhash.Bcrypt
+	default:
+		fatal("Invalid PASSWORD_HASHER, use argon2id or bcrypt", "value", alg)
+	}
+
+	h.Params.Memory = uint32(hashSetting("PASSWORD_HASH_MEMORY", uint64(h.Params.Memory), 32))
+	h.Params.Iterations = uint32(hashSetting("PASSWORD_HASH_ITERATIONS", uint64(h.Params.Iterations), 32))
+	h.Params.Parallelism = uint8(hashSetting("PASSWORD_HASH_PARALLELISM", uint64(h.Params.Parallelism), 8))
+	// Argon2 needs at least 8 KiB per lane
+	if h.Params.Memory < 8*uint32(h.Params.Parallelism) {
+		fatal("PASSWORD_HASH_MEMORY must be at least 8 KiB per PASSWORD_HASH_PARALLELISM lane")
+	}
+	passwordHasher = h
+}
+
+// hashSetting reads a positive setting that fits in an unsigned integer of
+// the given size.
+func hashSetting(name string, def uint64, bits int) uint64 {
+	v := config.Get(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseUint(v, 10, bits)
+	if err != nil || n < 1 {
+		fatal("Invalid "+name, "value", v)
+	}
+	return n
+}
+
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// passwordMatches reports whether password is the one hash was made from.
+func passwordMatches(ctx context.Context, hash, password string) bool {
+	ok, _ := verifyPassword(ctx, hash, password)
+	return ok
+}
+
+// verifyPassword is passwordMatches, also reporting whether hash should be
+// made again with the current hasher.
+func verifyPassword(ctx context.Context, hash, password string) (ok, rehash bool) {
+	rehash, err := passwordHasher.Verify(password, hash)
+	if err != nil {
+		if !errors.Is(err, passhash.ErrMismatch) {
+			logger(ctx).Error("Error verifying password hash", "error", err)
+		}
+		return false, false
+	}
+	return true, rehash
+}
+
+// upgradePasswordHash replaces user's password hash with one made by the
+// current hasher, now that the password is known to be right. A failure
+// only means trying again at the next login.
+func upgradePasswordHash(ctx context.Context, user User, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		logger(ctx).Error("Error rehashing password", "user_id", user.ID, "error", err)
+		return
+	}
+	err = db.Users().ReplacePasswordHash(ctx, user.ID, user.PasswordHash, hash)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger(ctx).Error("Error saving rehashed password", "user_id", user.ID, "error", err)
+		return
+	}
+	if err == nil {
+		logger(ctx).Info("Upgraded password hash", "user_id", user.ID, "algorithm", passwordHasher.Algorithm)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+)
+
+const (
+	policyTerms   = "terms"
+	policyPrivacy = "privacy"
+)
+
+type (
+	PolicyDocument   = storage.PolicyDocument
+	PolicyAcceptance = storage.PolicyAcceptance
+)
+
+// policyRegistry reads the published documents and users' acceptances from
+// the database, so every instance agrees on them and they outlive restarts.
+type policyRegistry struct{}
+
+var policies = &policyRegistry{}
+
+// publish returns storage.ErrConflict if the version was published already.
+func (reg *policyRegistry) publish(ctx context.Context, doc PolicyDocument) (PolicyDocument, error) {
+	doc.PublishedAt = time.Now()
+	return doc, db.Policies().Publish(ctx, doc)
+}
+
+// current returns the latest version of each document.
+func (reg *policyRegistry) current(ctx context.Context) ([]PolicyDocument, error) {
+	all, err := db.Policies().Documents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]PolicyDocument{}
+	for _, doc := range all {
+		latest[doc.Type] = doc
+	}
+
+	docs := []PolicyDocument{}
+	for _, doc := range latest {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Type < docs[j].Type })
+	return docs, nil
+}
+
+// find returns a version of a document, the latest if version is empty.
+func (reg *policyRegistry) find(ctx context.Context, docType, version string) (PolicyDocument, bool, error) {
+	all, err := db.Policies().Documents(ctx)
+	if err != nil {
+		return PolicyDocument{}, false, err
+	}
+	var found PolicyDocument
+	ok := false
+	for _, doc := range all {
+		if doc.Type == docType && (version == "" || doc.Version == version) {
+			found, ok = doc, true
+		}
+	}
+	return found, ok, nil
+}
+
+// pending returns the current documents the user still has to accept.
+func (reg *policyRegistry) pending(ctx context.Context, userID string) ([]PolicyDocument, error) {
+	current, err := reg.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accepted, err := reg.acceptedBy(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []PolicyDocument{}
+	for _, doc := range current {
+		if !doc.RequireAcceptance {
+			continue
+		}
+		if a, ok := accepted[doc.Type]; !ok || a.Version != doc.Version {
+			pending = append(pending, doc)
+		}
+	}
+	return pending, nil
+}
+
+// acceptedBy returns the user's latest acceptance of each document.
+func (reg *policyRegistry) acceptedBy(ctx context.Context, userID string) (map[string]PolicyAcceptance, error) {
+	acceptances, err := db.Policies().Acceptances(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	accepted := make(map[string]PolicyAcceptance)
+	for _, a := range acceptances {
+		accepted[a.Type] = a
+	}
+	return accepted, nil
+}
+
+func (reg *policyRegistry) acceptCurrent(userID string, r *http.Request) error {
+	current, err := reg.current(r.Context())
+	if err != nil {
+		return err
+	}
+	for _, doc := range current {
+		if err := db.Policies().Accept(r.Context(), newPolicyAcceptance(userID, doc, r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newPolicyAcceptance(userID string, doc PolicyDocument, r *http.Request) PolicyAcceptance {
+	return PolicyAcceptance{
+		UserID:     userID,
+		Type:       doc.Type,
+		Version:    doc.Version,
+		AcceptedAt: time.Now(),
+		IPAddress:  clientIP(r),
+		UserAgent:  r.UserAgent(),
+	}
+}
+
+// loadPoliciesFromEnv publishes the documents configured through
+// TERMS_VERSION/TERMS_URL and PRIVACY_VERSION/PRIVACY_URL, unless those
+// versions were published already.
+func loadPoliciesFromEnv() {
+	docs := []PolicyDocument{
+		{Type: policyTerms, Version: config.Get("TERMS_VERSION"), Title: "Terms of Service", URL: config.Get("TERMS_URL")},
+		{Type: policyPrivacy, Version: config.Get("PRIVACY_VERSION"), Title: "Privacy Policy", URL: config.Get("PRIVACY_URL")},
+	}
+	for _, doc := range docs {
+		if doc.Version == "" {
+			continue
+		}
+		doc.RequireAcceptance = true
+		if _, err := policies.publish(context.Background(), doc); err != nil && !errors.Is(err, storage.ErrConflict) {
+			slog.Error("Error publishing policy", "type", doc.Type, "version", doc.Version, "error", err)
+		}
+	}
+}
+
+// Policy middleware. Rejects requests from users who have not accepted the
+// current version of every document that requires acceptance.
+func policyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pending, err := policies.pending(r.Context(), r.Header.Get("X-User-ID"))
+		if err != nil {
+			writeStorageError(w, r, err, "Policies")
+			return
+		}
+		if len(pending) == 0 {
+			next(w, r)
+			return
+		}
+
+		writeAPIError(w, &apiError{
+			Status:  http.StatusForbidden,
+			Code:    "policy_acceptance_required",
+			Message: "Please review and accept the updated policies to continue.",
+			Details: map[string]interface{}{"documents": pending},
+		})
+	}
+}
+
+// Handlers
+func getPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	docs, err := policies.current(r.Context())
+	if err != nil {
+		writeStorageError(w, r, err, "Policies")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(docs)
+}
+
+func getPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	doc, ok, err := policies.find(r.Context(), mux.Vars(r)["type"], r.URL.Query().Get("version"))
+	if err != nil {
+		writeStorageError(w, r, err, "Policy")
+		return
+	}
+	if !ok {
+		http.Error(w, "Policy not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+func acceptPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Type    string `json:"type" validate:"required,oneof=terms privacy"`
+		Version string `json:"version" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	current, ok, err := policies.find(r.Context(), req.Type, "")
+	if err != nil {
+		writeStorageError(w, r, err, "Policy")
+		return
+	}
+	if !ok {
+		http.Error(w, "Policy not found", http.StatusNotFound)
+		return
+	}
+	if req.Version != current.Version {
+		http.Error(w, "Only the current policy version can be accepted", http.StatusConflict)
+		return
+	}
+
+	acceptance := newPolicyAcceptance(userID, current, r)
+	if err := db.Policies().Accept(r.Context(), acceptance); err != nil {
+		writeStorageError(w, r, err, "Policy acceptance")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(acceptance)
+}
+
+func getAccountPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	accepted, err := policies.acceptedBy(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Policies")
+		return
+	}
+	pending, err := policies.pending(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Policies")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accepted": accepted,
+		"pending":  pending,
+	})
+}
+
+func publishPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type              string `json:"type" validate:"required,oneof=terms privacy"`
+		Version           string `json:"version" validate:"required,max=50"`
+		Title             string `json:"title" validate:"max=200"`
+		URL               string `json:"url" validate:"url"`
+		Content           string `json:"content"`
+		RequireAcceptance bool   `json:"require_acceptance"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	published, err := policies.publish(r.Context(), PolicyDocument{
+		Type:              req.Type,
+		Version:           req.Version,
+		Title:             req.Title,
+		URL:               req.URL,
+		Content:           req.Content,
+		RequireAcceptance: req.RequireAcceptance,
+	})
+	if errors.Is(err, storage.ErrConflict) {
+		http.Error(w, "Policy version already published", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Policy")
+		return
+	}
+	logger(r.Context()).Info("Published policy", "type", req.Type, "version", req.Version, "email", r.Header.Get("X-User-Email"))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(published)
+}
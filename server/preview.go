@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+
+	"backup-manager/extract"
+)
+
+const (
+	previewLength      = 300
+	previewZipEntries  = 20
+	previewSniffLength = 8192
+)
+
+// contentPreview is what we show for an upload without decrypting it: a
+// human-readable summary plus the sniffed file type.
+type contentPreview struct {
+	FileType string
+	Text     string
+	// SourceHint is text suitable for detectSource. It is empty for opaque
+	// binaries so their bytes aren't matched as if they were words.
+	SourceHint string
+}
+
+// previewContent sniffs the content type and builds a preview appropriate
+// for it, rather than dumping raw bytes of binaries into the preview.
+// content may be only the start of a file of size bytes.
+func previewContent(filename string, content []byte, size int64) contentPreview {
+	mimeType := http.DetectContentType(content)
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	switch {
+	case mimeType == "application/zip" || ext == ".zip":
+		if p, ok := previewZip(content); ok {
+			return p
+		}
+	case strings.HasPrefix(mimeType, "image/"):
+		if p, ok := previewImage(content); ok {
+			return p
+		}
+	case mimeType == "application/pdf":
+		if p, ok := previewPDF(content); ok {
+			return p
+		}
+	}
+
+	if isText(content) {
+		fileType := "text"
+		if ext == ".json" {
+			fileType = "json"
+		}
+		return contentPreview{
+			FileType:   fileType,
+			Text:       truncate(string(content), previewLength),
+			SourceHint: string(content),
+		}
+	}
+
+	return contentPreview{
+		FileType: "binary",
+		Text:     fmt.Sprintf("Binary file (%s, %s)", mimeType, formatBytes(size)),
+	}
+}
+
+// conversationPreview previews chats by the first thing the user asked,
+// rather than the transcript heading or the JSON around it. It returns ""
+// when no conversation has a user message.
+func conversationPreview(convs []extract.Conversation) string {
+	for _, c := range convs {
+		for _, m := range c.Messages {
+			if m.Role == extract.RoleUser && strings.TrimSpace(m.Text) != "" {
+				return truncate(strings.TrimSpace(m.Text), previewLength)
+			}
+		}
+	}
+	return ""
+}
+
+func previewZip(content []byte) (contentPreview, bool) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return contentPreview{}, false
+	}
+
+	var b strings.Builder
+	names := make([]string, 0, len(zr.File))
+	fmt.Fprintf(&b, "ZIP archive, %d files", len(zr.File))
+	for i, f := range zr.File {
+		names = append(names, f.Name)
+		if i < previewZipEntries {
+			fmt.Fprintf(&b, "\n%s (%s)", f.Name, formatBytes(int64(f.UncompressedSize64)))
+		}
+	}
+	if len(zr.File) > previewZipEntries {
+		fmt.Fprintf(&b, "\n… and %d more", len(zr.File)-previewZipEntries)
+	}
+
+	return contentPreview{
+		FileType:   "zip",
+		Text:       b.String(),
+		SourceHint: strings.Join(names, "\n"),
+	}, true
+}
+
+func previewImage(content []byte) (contentPreview, bool) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return contentPreview{}, false
+	}
+
+	return contentPreview{
+		FileType: "image",
+		Text:     fmt.Sprintf("%s image, %dx%d (%s)", strings.ToUpper(format), cfg.Width, cfg.Height, formatBytes(int64(len(content)))),
+	}, true
+}
+
+func previewPDF(content []byte) (p contentPreview, ok bool) {
+	// The PDF parser panics on some malformed files; a bad upload must not
+	// take the request down with it.
+	defer func() {
+		if recover() != nil {
+			p, ok = contentPreview{}, false
+		}
+	}()
+
+	r, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return contentPreview{}, false
+	}
+
+	summary := fmt.Sprintf("PDF document, %d pages", r.NumPage())
+	if r.NumPage() == 0 {
+		return contentPreview{FileType: "pdf", Text: summary}, true
+	}
+
+	text := pageText(r.Page(1))
+
+	return contentPreview{
+		FileType:   "pdf",
+		Text:       truncate(summary+"\n"+text, previewLength),
+		SourceHint: text,
+	}, true
+}
+
+// pageText reassembles a page's text from its positioned glyphs. PDFs rarely
+// contain literal spaces, so a gap wider than a fraction of the font size
+// between neighbouring glyphs on a line is treated as one.
+func pageText(page pdf.Page) string {
+	var b strings.Builder
+	var prev *pdf.Text
+
+	glyphs := page.Content().Text
+	for i := range glyphs {
+		g := &glyphs[i]
+		if prev != nil && (g.Y != prev.Y || g.X-(prev.X+prev.W) > g.FontSize*0.15) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(g.S)
+		prev = g
+	}
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// headBuffer keeps the first limit bytes written to it and discards the
+// rest, so an upload can be inspected without holding all of it.
+type headBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if room := h.limit - len(h.buf); room < len(p) {
+		h.buf = append(h.buf, p[:max(room, 0)]...)
+		h.truncated = true
+	} else {
+		h.buf = append(h.buf, p...)
+	}
+	return len(p), nil
+}
+
+// isText reports whether content looks like text: valid UTF-8 with no NUL
+// bytes in the sniffed prefix.
+func isText(content []byte) bool {
+	sample := content
+	if len(sample) > previewSniffLength {
+		sample = sample[:previewSniffLength]
+		// Don't let a multi-byte rune cut at the boundary fail validation
+		for i := 0; i < utf8.UTFMax && !utf8.Valid(sample); i++ {
+			sample = sample[:len(sample)-1]
+		}
+	}
+	return utf8.Valid(sample) && bytes.IndexByte(sample, 0) == -1
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
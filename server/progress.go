@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"backup-manager/websocket"
+)
+
+const (
+	progressUpload    = "upload"
+	progressQRBatch   = "qr_batch"
+	progressImport    = "import"
+	progressConnector = "connector"
+
+	progressRunning    = "running"
+	progressProcessing = "processing"
+	progressCompleted  = "completed"
+	progressFailed     = "failed"
+
+	// progressInterval is how often a job reports counts that keep changing
+	progressInterval = 250 * time.Millisecond
+	// wsPingInterval keeps idle connections open through proxies; a client
+	// that sends nothing, not even a pong, for wsReadTimeout is gone
+	wsPingInterval = 30 * time.Second
+	wsReadTimeout  = 2 * wsPingInterval
+	wsWriteTimeout = 10 * time.Second
+)
+
+// ProgressEvent is the state of one of a user's jobs, pushed over /ws as
+// it changes. Uploads and QR batches are keyed by the job_id the client
+// chose for them; imports and connector runs by the import's or
+// connector's ID.
+type ProgressEvent struct {
+	JobID string `json:"job_id"`
+	Kind  string `json:"kind"`
+	State string `json:"state"`
+	// Bytes uploaded so far, of TotalBytes when the client said
+	Bytes      int64 `json:"bytes,omitempty"`
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+	// Chunks of an upload stored so far
+	Chunks int `json:"chunks,omitempty"`
+	// Done items of Total: codes rendered, conversations or files read
+	Done     int       `json:"done,omitempty"`
+	Total    int       `json:"total,omitempty"`
+	ResultID string    `json:"result_id,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// progressHub fans events out to each user's open connections.
+type progressHub struct {
+	mu   sync.Mutex
+	subs map[string]map[*progressSub]bool
+}
+
+var progress = &progressHub{subs: make(map[string]map[*progressSub]bool)}
+
+// socketsClosing is closed when the server shuts down, which tells open
+// progress connections to close.
+var (
+	socketsClosing   = make(chan struct{})
+	closeSocketsOnce sync.Once
+)
+
+func closeProgressSockets() {
+	closeSocketsOnce.Do(func() { close(socketsClosing) })
+}
+
+// progressSub holds what a connection hasn't been sent yet: the latest
+// event of each job, in the order the jobs first changed. A slow client
+// misses intermediate counts but never a job's final state.
+type progressSub struct {
+	mu      sync.Mutex
+	pending map[string]ProgressEvent
+	order   []string
+	notify  chan struct{}
+}
+
+func (h *progressHub) subscribe(userID string) *progressSub {
+	sub := &progressSub{pending: make(map[string]ProgressEvent), notify: make(chan struct{}, 1)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*progressSub]bool)
+	}
+	h.subs[userID][sub] = true
+	return sub
+}
+
+func (h *progressHub) unsubscribe(userID string, sub *progressSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subs[userID], sub)
+	if len(h.subs[userID]) == 0 {
+		delete(h.subs, userID)
+	}
+}
+
+// publish never blocks, so jobs report progress whether or not anyone is
+// watching.
+func (h *progressHub) publish(userID string, ev ProgressEvent) {
+	ev.Time = time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs[userID] {
+		sub.push(ev)
+	}
+}
+
+func (s *progressSub) push(ev ProgressEvent) {
+	s.mu.Lock()
+	if _, ok := s.pending[ev.JobID]; !ok {
+		s.order = append(s.order, ev.JobID)
+	}
+	s.pending[ev.JobID] = ev
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *progressSub) take() []ProgressEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]ProgressEvent, 0, len(s.order))
+	for _, id := range s.order {
+		events = append(events, s.pending[id])
+	}
+	s.pending = make(map[string]ProgressEvent)
+	s.order = nil
+	return events
+}
+
+// jobProgress reports one job's progress. A nil jobProgress, for a job
+// the client didn't ask to follow, ignores every call.
+type jobProgress struct {
+	userID string
+
+	mu   sync.Mutex
+	ev   ProgressEvent
+	last time.Time
+}
+
+func newJobProgress(userID, jobID, kind string) *jobProgress {
+	if jobID == "" {
+		return nil
+	}
+	return &jobProgress{userID: userID, ev: ProgressEvent{JobID: jobID, Kind: kind}}
+}
+
+// progressJobID reads the job_id a client follows a request's progress
+// by. It is empty, with ok still true, if none was given.
+func progressJobID(r *http.Request) (string, bool) {
+	id := r.URL.Query().Get("job_id")
+	return id, id == "" || requestIDPattern.MatchString(id)
+}
+
+// update applies fn and publishes the result, at most every
+// progressInterval unless force is set.
+func (p *jobProgress) update(force bool, fn func(*ProgressEvent)) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	fn(&p.ev)
+	if !force && time.Since(p.last) < progressInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.last = time.Now()
+	ev := p.ev
+	p.mu.Unlock()
+	progress.publish(p.userID, ev)
+}
+
+func (p *jobProgress) state(state string) {
+	p.update(true, func(ev *ProgressEvent) { ev.State = state })
+}
+
+func (p *jobProgress) completed(resultID string) {
+	p.update(true, func(ev *ProgressEvent) {
+		ev.State = progressCompleted
+		ev.ResultID = resultID
+	})
+}
+
+// failed reports the job failed with msg, which the client is shown.
+func (p *jobProgress) failed(msg string) {
+	p.update(true, func(ev *ProgressEvent) {
+		ev.State = progressFailed
+		ev.Error = msg
+	})
+}
+
+func (p *jobProgress) chunkStored() {
+	p.update(false, func(ev *ProgressEvent) { ev.Chunks++ })
+}
+
+func (p *jobProgress) itemDone() {
+	p.update(false, func(ev *ProgressEvent) { ev.Done++ })
+}
+
+// reader counts the bytes read from r as uploaded.
+func (p *jobProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *jobProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.p.update(false, func(ev *ProgressEvent) { ev.Bytes += int64(n) })
+	}
+	return n, err
+}
+
+type progressKey struct{}
+
+// withJobProgress carries p to code deep in a job, such as writeBackupBlob
+// counting chunks.
+func withJobProgress(ctx context.Context, p *jobProgress) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+func jobProgressFrom(ctx context.Context) *jobProgress {
+	p, _ := ctx.Value(progressKey{}).(*jobProgress)
+	return p
+}
+
+// importProgress is the progress event of a chat import.
+func importProgress(imp ChatImport) ProgressEvent {
+	ev := ProgressEvent{JobID: imp.ID, Kind: progressImport, Done: imp.Conversations, Error: imp.Error}
+	switch imp.Status {
+	case importStatusPending, importStatusProcessing:
+		ev.State = progressRunning
+	default:
+		ev.State = imp.Status
+	}
+	return ev
+}
+
+// connectorProgress is the progress event of a connector's run.
+func connectorProgress(c Connector) ProgressEvent {
+	ev := ProgressEvent{JobID: c.ID, Kind: progressConnector, Error: c.LastError}
+	switch c.Status {
+	case connectorStatusRunning:
+		ev.State = progressRunning
+	case connectorStatusSucceeded:
+		ev.State = progressCompleted
+	case connectorStatusWaiting:
+		ev.State = connectorStatusWaiting
+	default:
+		ev.State = progressFailed
+	}
+	if len(c.RecentRuns) > 0 {
+		ev.Done = c.RecentRuns[0].FilesFetched
+	}
+	return ev
+}
+
+// progressSocketHandler streams the caller's progress events as JSON text
+// messages. Browsers can't set headers on a WebSocket, so the access token
+// may come as ?access_token= instead.
+func progressSocketHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	conn, err := websocket.Upgrade(w, r)
+	if errors.Is(err, websocket.ErrNotWebSocket) {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error upgrading to WebSocket", "error", err)
+		return
+	}
+	sub := progress.subscribe(userID)
+	defer progress.unsubscribe(userID, sub)
+
+	// Nothing the client sends means anything; reading just answers its
+	// pings and notices when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.Read(wsReadTimeout); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-gone:
+			conn.Close(websocket.CloseNormal, "")
+			return
+		case <-socketsClosing:
+			conn.Close(websocket.CloseGoingAway, "server shutting down")
+			return
+		case <-ping.C:
+			if err := conn.Ping(wsWriteTimeout); err != nil {
+				conn.Close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-sub.notify:
+			for _, ev := range sub.take() {
+				data, err := json.Marshal(ev)
+				if err != nil {
+					slog.Error("Error encoding progress event", "error", err)
+					continue
+				}
+				if err := conn.WriteMessage(websocket.OpText, data, wsWriteTimeout); err != nil {
+					conn.Close(websocket.CloseGoingAway, "")
+					return
+				}
+			}
+		}
+	}
+}
+
+// socketAuthMiddleware accepts the access token of a WebSocket handshake
+// from the query string, then authenticates as authMiddleware does.
+func socketAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	auth := authMiddleware(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		auth(w, r)
+	}
+}
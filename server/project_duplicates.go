@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"backup-manager/search"
+	"backup-manager/similarity"
+)
+
+const (
+	defaultDuplicateThreshold = 0.8
+	minDuplicateThreshold     = 0.5
+	// Projects shorter than this many tokens are too small to call copies
+	minDuplicateTokens = 20
+)
+
+type duplicateProject struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Language    string `json:"language"`
+	LinesOfCode int    `json:"lines_of_code"`
+	BackupID    string `json:"backup_id"`
+}
+
+type duplicateCluster struct {
+	Projects      []duplicateProject `json:"projects"`
+	MinSimilarity float64            `json:"min_similarity"`
+	MaxSimilarity float64            `json:"max_similarity"`
+}
+
+// mergeProjects folds the tags, features and star of merged into keep, so
+// nothing the user added to a copy is lost when the copies are deleted.
+func mergeProjects(keep Project, merged []Project) Project {
+	for _, p := range merged {
+		for _, tag := range p.Tags {
+			if !contains(keep.Tags, tag) {
+				keep.Tags = append(keep.Tags, tag)
+			}
+		}
+		for _, feature := range p.Features {
+			if !contains(keep.Features, feature) {
+				keep.Features = append(keep.Features, feature)
+			}
+		}
+		keep.Starred = keep.Starred || p.Starred
+		if keep.Description == "" {
+			keep.Description = p.Description
+		}
+	}
+	return keep
+}
+
+// Handlers
+func getDuplicateProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	threshold := defaultDuplicateThreshold
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < minDuplicateThreshold || t > 1 {
+			http.Error(w, "threshold must be between 0.5 and 1", http.StatusBadRequest)
+			return
+		}
+		threshold = t
+	}
+
+	projects, err := db.Projects().List(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+
+	byID := make(map[string]Project, len(projects))
+	items := make([]similarity.Item, 0, len(projects))
+	for _, p := range projects {
+		byID[p.ID] = p
+		items = append(items, similarity.Item{ID: p.ID, Signature: similarity.Sign(p.Code)})
+	}
+
+	clusters := []duplicateCluster{}
+	for _, c := range similarity.Clusters(items, threshold, minDuplicateTokens) {
+		cluster := duplicateCluster{MinSimilarity: c.MinSimilarity, MaxSimilarity: c.MaxSimilarity}
+		for _, id := range c.IDs {
+			p := byID[id]
+			cluster.Projects = append(cluster.Projects, duplicateProject{
+				ID:          p.ID,
+				Name:        p.Name,
+				Language:    p.Language,
+				LinesOfCode: p.LinesOfCode,
+				BackupID:    p.BackupID,
+			})
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"threshold": threshold,
+		"clusters":  clusters,
+	})
+}
+
+// mergeProjectsHandler keeps one project of a duplicate cluster, folds the
+// others into it and deletes them.
+func mergeProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		KeepID   string   `json:"keep_id" validate:"required"`
+		MergeIDs []string `json:"merge_ids" validate:"required,max=100"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if contains(req.MergeIDs, req.KeepID) {
+		writeFieldError(w, "merge_ids", "exclude", "keep_id cannot also be merged")
+		return
+	}
+
+	keep, err := db.Projects().Get(r.Context(), userID, req.KeepID)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	merged := make([]Project, 0, len(req.MergeIDs))
+	for _, id := range req.MergeIDs {
+		p, err := db.Projects().Get(r.Context(), userID, id)
+		if err != nil {
+			writeStorageError(w, r, err, "Project")
+			return
+		}
+		merged = append(merged, p)
+	}
+
+	before := keep
+	keep = mergeProjects(keep, merged)
+
+	if err := db.Projects().Merge(r.Context(), keep, req.MergeIDs); err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	keep.Version++
+
+	removed := make([]string, 0, len(req.MergeIDs))
+	for _, id := range req.MergeIDs {
+		removed = append(removed, search.DocumentID(search.TypeProject, id))
+	}
+	removeDocuments(removed...)
+	indexDocuments(projectDocument(keep))
+
+	recordAudit(r, AuditEvent{
+		Action:       "project.merged",
+		ResourceType: "project",
+		ResourceID:   keep.ID,
+		Metadata:     map[string]interface{}{"merged_ids": req.MergeIDs},
+	})
+	actor := requestActor(r)
+	for _, p := range merged {
+		recordDomainEvent(actor, DomainEvent{
+			Type:          "project.deleted",
+			AggregateType: aggregateProject,
+			AggregateID:   p.ID,
+			OwnerID:       userID,
+			Before:        snapshot(p),
+		}, map[string]interface{}{"merged_into": keep.ID})
+	}
+	recordDomainEvent(actor, DomainEvent{
+		Type:          "project.merged",
+		AggregateType: aggregateProject,
+		AggregateID:   keep.ID,
+		OwnerID:       userID,
+		Before:        snapshot(before),
+		After:         snapshot(keep),
+	}, map[string]interface{}{"merged_ids": req.MergeIDs})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keep)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	"backup-manager/extract"
+)
+
+// maxExtractedProjects caps the projects created from one backup.
+const maxExtractedProjects = 100
+
+// saveExtractedProjects creates a project for each piece of code worth
+// keeping in convs, linked to the backup b they came from, except those
+// named in existing. It returns them with suggested tags; failures to save
+// are logged and skipped.
+func saveExtractedProjects(ctx context.Context, actor DomainActor, b Backup, convs []extract.Conversation, existing map[string]bool) []Project {
+	candidates := extract.Projects(convs, maxExtractedProjects)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	used := userTagCounts(b.UserID)
+	projects := make([]Project, 0, len(candidates))
+	for _, c := range candidates {
+		if len(c.Code) > maxProjectCode || existing[truncate(c.Name, maxProjectName)] {
+			continue
+		}
+		p := Project{
+			ID:          generateID(),
+			UserID:      b.UserID,
+			TeamID:      b.TeamID,
+			BackupID:    b.ID,
+			Name:        truncate(c.Name, maxProjectName),
+			Type:        c.Type,
+			Description: c.Description,
+			Source:      b.Source,
+			Language:    truncate(c.Language, maxProjectLanguage),
+			LinesOfCode: c.LinesOfCode,
+			Features:    c.Features,
+			Code:        c.Code,
+			Files:       projectFiles(c.Files),
+			Tags:        []string{},
+			Timestamp:   c.CreatedAt,
+		}
+		if p.Timestamp.IsZero() {
+			p.Timestamp = b.Timestamp
+		}
+		syncProjectCode(&p)
+
+		if err := createProject(ctx, actor, p); err != nil {
+			logger(ctx).Error("Error saving extracted project", "backup_id", b.ID, "error", err)
+			continue
+		}
+		emitWebhook(b.UserID, "project.extracted", map[string]interface{}{
+			"id":        p.ID,
+			"backup_id": b.ID,
+			"name":      p.Name,
+			"type":      p.Type,
+			"language":  p.Language,
+		})
+		projects = append(projects, withSuggestedTags(p, used))
+	}
+	return projects
+}
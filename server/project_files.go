@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"backup-manager/config"
+	"backup-manager/extract"
+	"backup-manager/storage"
+	"backup-manager/validate"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxProjectFiles    = 200
+	maxProjectFilePath = 255
+)
+
+// validateProjectFiles tidies a project's files, naming each by a path
+// within the project and filling in languages it can tell, and adds the
+// files at fault to errs. Together the files are held to the size of code.
+func validateProjectFiles(p *Project, errs *validate.Errors) {
+	if len(p.Files) > maxProjectFiles {
+		errs.Add("files", "max", fmt.Sprintf("at most %d files are allowed", maxProjectFiles))
+		return
+	}
+	seen := map[string]bool{}
+	size := 0
+	for i := range p.Files {
+		f := &p.Files[i]
+		field := fmt.Sprintf("files[%d].path", i)
+		f.Path = extract.CleanPath(f.Path)
+		f.Language = strings.TrimSpace(f.Language)
+		switch {
+		case f.Path == "":
+			errs.Add(field, "required", field+" is required")
+		case utf8.RuneCountInString(f.Path) > maxProjectFilePath:
+			errs.Add(field, "max", fmt.Sprintf("%s must be at most %d characters", field, maxProjectFilePath))
+		case seen[strings.ToLower(f.Path)]:
+			errs.Add(field, "unique", f.Path+" is given more than once")
+		}
+		seen[strings.ToLower(f.Path)] = true
+		if f.Language == "" {
+			f.Language = extract.DetectLanguage("", f.Path, f.Content)
+		}
+		if utf8.RuneCountInString(f.Language) > maxProjectLanguage {
+			errs.Add(fmt.Sprintf("files[%d].language", i), "max",
+				fmt.Sprintf("files[%d].language must be at most %d characters", i, maxProjectLanguage))
+		}
+		size += len(f.Content)
+	}
+	if size > maxProjectCode {
+		errs.Add("files", "max", "files must be at most 1 MiB together")
+	}
+}
+
+// countProjectLines counts the lines of code in language. Blank lines never
+// count; LOC_SKIP_COMMENTS=true leaves out comments too.
+func countProjectLines(code, language string) int {
+	if config.Get("LOC_SKIP_COMMENTS") == "true" {
+		return extract.CountCode(code, language)
+	}
+	return extract.CountLines(code)
+}
+
+// syncProjectCode keeps Code, Language and LinesOfCode in step with a
+// project's files: Code is its entry point's, as is Language if unset, and
+// the lines are counted across all of them. Without files, an unset
+// Language is detected from the code.
+func syncProjectCode(p *Project) {
+	if len(p.Files) == 0 {
+		if p.Language == "" {
+			p.Language = extract.DetectLanguage("", "", p.Code)
+		}
+		p.LinesOfCode = countProjectLines(p.Code, p.Language)
+		return
+	}
+	entry := p.Files[0]
+	for _, f := range p.Files {
+		if extract.IsEntryPoint(f.Path, f.Content) {
+			entry = f
+			break
+		}
+	}
+	p.Code = entry.Content
+	if p.Language == "" {
+		p.Language = entry.Language
+	}
+	p.LinesOfCode = 0
+	for _, f := range p.Files {
+		p.LinesOfCode += countProjectLines(f.Content, f.Language)
+	}
+}
+
+// projectFiles converts the files extraction found.
+func projectFiles(files []extract.File) []storage.ProjectFile {
+	if len(files) == 0 {
+		return nil
+	}
+	out := make([]storage.ProjectFile, len(files))
+	for i, f := range files {
+		out[i] = storage.ProjectFile{Path: f.Path, Language: truncate(f.Language, maxProjectLanguage), Content: f.Code}
+	}
+	return out
+}
+
+// projectFolder is the name of the folder a project is exported in, made
+// safe for a file name.
+func projectFolder(p Project) string {
+	name := strings.Trim(unsafeFilenameChars.ReplaceAllString(p.Name, "-"), "-.")
+	if name = truncate(name, 100); name == "" {
+		name = "project"
+	}
+	return name
+}
+
+// Handlers
+
+// downloadProjectHandler exports a project as a ZIP of its files in a
+// folder named after it. A project of one piece of code has a single file,
+// named for its language.
+func downloadProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+
+	folder := projectFolder(project)
+	files := project.Files
+	if len(files) == 0 {
+		lang := project.Language
+		if lang == "" {
+			lang = extract.DetectLanguage("", "", project.Code)
+		}
+		files = []storage.ProjectFile{{Path: extract.Filename(folder, lang), Content: project.Code}}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": folder + ".zip"}))
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     folder + "/" + f.Path,
+			Method:   zip.Deflate,
+			Modified: project.Timestamp,
+		})
+		if err == nil {
+			_, err = fw.Write([]byte(f.Content))
+		}
+		if err != nil {
+			logger(r.Context()).Error("Error writing project archive", "project_id", id, "error", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logger(r.Context()).Error("Error writing project archive", "project_id", id, "error", err)
+		return
+	}
+
+	touchProject(r.Context(), id)
+	recordAudit(r, AuditEvent{
+		Action:       "project.downloaded",
+		ResourceType: "project",
+		ResourceID:   id,
+		Metadata:     map[string]interface{}{"files": len(files)},
+	})
+}
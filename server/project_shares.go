@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// maxShareLifetime bounds expires_in_hours on a project share.
+const maxShareLifetime = 365 * 24 * time.Hour
+
+// shareStatus describes a share for its owner: active, expired or revoked.
+func shareStatus(sh storage.ProjectShare) string {
+	switch {
+	case sh.RevokedAt != nil:
+		return "revoked"
+	case sh.ExpiresAt != nil && time.Now().After(*sh.ExpiresAt):
+		return "expired"
+	}
+	return "active"
+}
+
+// projectShareView is a share as listed to its project's owner. The link
+// itself is only returned when the share is created, as only its hash is
+// kept.
+type projectShareView struct {
+	storage.ProjectShare
+	URL         string `json:"url,omitempty"`
+	HasPassword bool   `json:"has_password"`
+	Status      string `json:"status"`
+}
+
+func newProjectShareView(sh storage.ProjectShare) projectShareView {
+	return projectShareView{ProjectShare: sh, HasPassword: sh.PasswordHash != "", Status: shareStatus(sh)}
+}
+
+// sharedProject loads the project a share is for, in the team's workspace
+// if it was shared from one.
+func sharedProject(r *http.Request, sh storage.ProjectShare) (Project, error) {
+	if sh.TeamID != "" {
+		return db.Projects().Get(storage.WithTeam(r.Context(), sh.TeamID), "", sh.ProjectID)
+	}
+	return db.Projects().Get(r.Context(), sh.UserID, sh.ProjectID)
+}
+
+var projectShareTemplate = template.Must(template.New("project_share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Project}}{{.Project.Name}}{{else}}Shared project{{end}}</title>
+<style>
+body{font-family:system-ui,sans-serif;margin:0;background:#f5f5f5;color:#222}
+main{background:#fff;max-width:60rem;margin:2rem auto;padding:2rem;border-radius:.75rem;box-shadow:0 1px 4px rgba(0,0,0,.1)}
+h1{font-size:1.4rem;margin-top:0}
+h2{font-size:1rem;font-family:ui-monospace,monospace;margin:1.5rem 0 .5rem}
+dl{display:grid;grid-template-columns:max-content 1fr;gap:.3rem 1rem}
+dt{color:#666}
+dd{margin:0}
+pre{background:#f7f7f9;border:1px solid #e3e3e8;border-radius:.4rem;padding:1rem;overflow:auto;font-size:.85rem}
+.error{color:#b00020}
+input{width:100%;max-width:20rem;box-sizing:border-box;padding:.6rem;margin:.4rem 0 1rem;font-size:1rem;display:block}
+button{padding:.6rem 1.2rem;background:#1a4d8f;color:#fff;border:0;border-radius:.4rem;font-size:1rem;cursor:pointer}
+footer{margin-top:2rem;font-size:.8rem;color:#888}
+</style>
+</head>
+<body>
+<main>
+{{with .Project}}<h1>{{.Name}}</h1>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+<dl>
+{{if .Language}}<dt>Language</dt><dd>{{.Language}}</dd>{{end}}
+{{if .Type}}<dt>Type</dt><dd>{{.Type}}</dd>{{end}}
+<dt>Lines of code</dt><dd>{{.LinesOfCode}}</dd>
+{{if .Features}}<dt>Features</dt><dd>{{range $i, $f := .Features}}{{if $i}}, {{end}}{{$f}}{{end}}</dd>{{end}}
+{{if .Tags}}<dt>Tags</dt><dd>{{range $i, $t := .Tags}}{{if $i}}, {{end}}{{$t}}{{end}}</dd>{{end}}
+<dt>Updated</dt><dd>{{.Timestamp.Format "2 January 2006"}}</dd>
+</dl>
+{{range .Files}}<h2>{{.Path}}</h2>
+<pre><code>{{.Content}}</code></pre>
+{{else}}<pre><code>{{.Code}}</code></pre>{{end}}
+{{else}}<h1>{{.Heading}}</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Error}}<p class="error" role="alert">{{.Error}}</p>{{end}}
+{{if .Password}}<form method="post">
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="off" required autofocus>
+<button type="submit">View project</button>
+</form>{{end}}
+{{end}}
+<footer>Shared read-only with QR Creation</footer>
+</main>
+</body>
+</html>
+`))
+
+// projectSharePage is what a share link shows: the project, or a heading
+// and message when it can't be shown, with the password form if Password.
+type projectSharePage struct {
+	Project  *Project
+	Heading  string
+	Message  string
+	Error    string
+	Password bool
+}
+
+func renderProjectSharePage(w http.ResponseWriter, r *http.Request, status int, page projectSharePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", pageContentSecurityPolicy)
+	w.Header().Set("Cache-Control", "no-store")
+	// The token is in the path; keep it out of links followed from the page
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	if err := projectShareTemplate.Execute(w, page); err != nil {
+		logger(r.Context()).Error("Error rendering project share page", "error", err)
+	}
+}
+
+// Handlers
+
+// createProjectShareHandler makes a public, read-only link to a project.
+// The link can be given a password and a lifetime in hours; without them it
+// works for anyone who has it until revoked.
+func createProjectShareHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Password       string `json:"password" validate:"max=72"`
+		ExpiresInHours int    `json:"expires_in_hours" validate:"min=0"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if time.Duration(req.ExpiresInHours)*time.Hour > maxShareLifetime {
+		writeFieldError(w, "expires_in_hours", "max", "expires_in_hours must be at most "+strconv.Itoa(int(maxShareLifetime.Hours())))
+		return
+	}
+
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+
+	token := generateToken()
+	share := storage.ProjectShare{
+		ID:        generateID(),
+		ProjectID: project.ID,
+		UserID:    userID,
+		TeamID:    project.TeamID,
+		TokenHash: hashToken(token),
+		CreatedAt: time.Now(),
+	}
+	if req.Password != "" {
+		hashed, err := hashPassword(req.Password)
+		if err != nil {
+			http.Error(w, "Error hashing password", http.StatusInternalServerError)
+			return
+		}
+		share.PasswordHash = hashed
+	}
+	if req.ExpiresInHours > 0 {
+		expiresAt := share.CreatedAt.Add(time.Duration(req.ExpiresInHours) * time.Hour)
+		share.ExpiresAt = &expiresAt
+	}
+	if err := db.ProjectShares().Create(r.Context(), share); err != nil {
+		writeStorageError(w, r, err, "Project share")
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "project.shared",
+		ResourceType: "project",
+		ResourceID:   project.ID,
+		Metadata: map[string]interface{}{
+			"share_id":     share.ID,
+			"has_password": share.PasswordHash != "",
+			"expires_at":   share.ExpiresAt,
+		},
+	})
+
+	view := newProjectShareView(share)
+	view.URL = publicLink(r, "/p/"+token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(view)
+}
+
+func getProjectSharesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if _, err := db.Projects().Get(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	shares, err := db.ProjectShares().List(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project shares")
+		return
+	}
+
+	views := make([]projectShareView, len(shares))
+	for i, sh := range shares {
+		views[i] = newProjectShareView(sh)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func revokeProjectShareHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	vars := mux.Vars(r)
+
+	if _, err := db.Projects().Get(r.Context(), userID, vars["id"]); err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	if err := db.ProjectShares().Revoke(r.Context(), vars["id"], vars["shareId"], time.Now()); err != nil {
+		writeStorageError(w, r, err, "Project share")
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "project.share_revoked",
+		ResourceType: "project",
+		ResourceID:   vars["id"],
+		Metadata:     map[string]interface{}{"share_id": vars["shareId"]},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// projectShareViewHandler shows a shared project to anyone with the link.
+// A password-protected share shows a form instead, which posts back here;
+// wrong passwords count towards the same lockout as QR page passwords.
+// Each view of the project is counted.
+func projectShareViewHandler(w http.ResponseWriter, r *http.Request) {
+	share, err := db.ProjectShares().GetByHash(r.Context(), hashToken(mux.Vars(r)["token"]))
+	if errors.Is(err, storage.ErrNotFound) {
+		renderProjectSharePage(w, r, http.StatusNotFound, projectSharePage{
+			Heading: "Link not found",
+			Message: "Check the link you were given.",
+		})
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading project share", "error", err)
+		http.Error(w, "Error loading shared project", http.StatusInternalServerError)
+		return
+	}
+	if status := shareStatus(share); status != "active" {
+		message := "This link has expired."
+		if status == "revoked" {
+			message = "This link has been revoked."
+		}
+		renderProjectSharePage(w, r, http.StatusGone, projectSharePage{
+			Heading: "Link no longer available",
+			Message: message + " Ask whoever shared it for a new one.",
+		})
+		return
+	}
+
+	if share.PasswordHash != "" {
+		if r.Method != http.MethodPost {
+			renderProjectSharePage(w, r, http.StatusOK, projectSharePage{
+				Heading:  "Password required",
+				Message:  "Enter the password for this project.",
+				Password: true,
+			})
+			return
+		}
+		if !checkProjectSharePassword(w, r, share) {
+			return
+		}
+	}
+
+	project, err := sharedProject(r, share)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Deleted or in the trash
+		renderProjectSharePage(w, r, http.StatusGone, projectSharePage{
+			Heading: "Link no longer available",
+			Message: "The shared project has been removed.",
+		})
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading shared project", "share_id", share.ID, "error", err)
+		http.Error(w, "Error loading shared project", http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.ProjectShares().RecordAccess(r.Context(), share.ID, time.Now()); err != nil {
+		logger(r.Context()).Error("Error counting project share access", "share_id", share.ID, "error", err)
+	}
+	renderProjectSharePage(w, r, http.StatusOK, projectSharePage{Project: &project})
+}
+
+// checkProjectSharePassword checks the password posted for a share, rendering
+// the form again with the reason and returning false when it is refused.
+func checkProjectSharePassword(w http.ResponseWriter, r *http.Request, share storage.ProjectShare) bool {
+	key := "project_share:" + share.ID
+	retry := func(status int, message string, after time.Duration) bool {
+		if after > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(after.Seconds()))))
+		}
+		renderProjectSharePage(w, r, status, projectSharePage{
+			Heading:  "Password required",
+			Error:    message,
+			Password: true,
+		})
+		return false
+	}
+
+	if allowed, _, retryAfter := qrPasswordLimiter.allow(key+"|"+clientIP(r), qrPasswordIPRate); !allowed {
+		return retry(http.StatusTooManyRequests, "Too many attempts, slow down.", retryAfter)
+	}
+	_, lockedFor, err := qrPasswordAttempts.check(r.Context(), key)
+	if err != nil {
+		writeStorageError(w, r, err, "Password attempts")
+		return false
+	}
+	if lockedFor > 0 {
+		return retry(http.StatusTooManyRequests, "Too many failed attempts. Try again later.", lockedFor)
+	}
+
+	password := r.PostFormValue("password")
+	if passwordMatches(r.Context(), share.PasswordHash, password) {
+		if err := qrPasswordAttempts.reset(r.Context(), key); err != nil {
+			logger(r.Context()).Error("Error clearing failed share passwords", "error", err)
+		}
+		return true
+	}
+
+	failures, err := qrPasswordAttempts.fail(r.Context(), key)
+	if err != nil {
+		logger(r.Context()).Error("Error counting failed share password", "error", err)
+	}
+	if failures >= qrPasswordCaptchaAfter {
+		recordAudit(r, AuditEvent{
+			Action:       "project.share_password_failed",
+			ResourceType: "project",
+			ResourceID:   share.ProjectID,
+			Metadata: map[string]interface{}{
+				"share_id": share.ID,
+				"failures": failures,
+				"locked":   failures%qrPasswordLockAfter == 0,
+			},
+		})
+	}
+	return retry(http.StatusUnauthorized, "Wrong password.", 0)
+}
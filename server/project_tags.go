@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/tagsuggest"
+)
+
+const (
+	maxTagSuggestions = 8
+
+	defaultTagCompletions = 10
+	maxTagCompletions     = 50
+)
+
+// TagCount is a tag and the number of projects it is on.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// projectTagCounts lists the tags on projects, most used first and then by
+// name.
+func projectTagCounts(projects []Project) []TagCount {
+	counts := map[string]int{}
+	for _, p := range projects {
+		for _, tag := range p.Tags {
+			counts[tag]++
+		}
+	}
+	tags := make([]TagCount, 0, len(counts))
+	for tag, n := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: n})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return strings.ToLower(tags[i].Tag) < strings.ToLower(tags[j].Tag)
+	})
+	return tags
+}
+
+// mergeTags replaces the tags in from, compared case-insensitively, with
+// into on every project that has one of them. A project that already has
+// into keeps it once. It returns the projects changed.
+func mergeTags(ctx context.Context, userID string, from []string, into string) ([]Project, error) {
+	merged := map[string]bool{}
+	for _, tag := range from {
+		merged[strings.ToLower(strings.TrimSpace(tag))] = true
+	}
+
+	projects, err := db.Projects().List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var changed []Project
+	updates := map[string][]string{}
+	for _, p := range projects {
+		tags := make([]string, 0, len(p.Tags))
+		found := false
+		for _, tag := range p.Tags {
+			if merged[strings.ToLower(tag)] {
+				found = true
+				tag = into
+			}
+			tags = append(tags, tag)
+		}
+		if !found {
+			continue
+		}
+		// Drops the duplicates merging made; the tags were valid before
+		p.Tags, _ = cleanList(tags, "tags", len(tags), maxProjectTagLength)
+		updates[p.ID] = p.Tags
+		changed = append(changed, p)
+	}
+	if len(updates) == 0 {
+		return nil, nil
+	}
+	if err := db.Projects().SetTags(ctx, userID, updates); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// userTagCounts returns the tags userID has used and on how many items.
+func userTagCounts(userID string) map[string]int {
+	counts := map[string]int{}
+	projects, err := db.Projects().List(context.Background(), userID)
+	if err != nil {
+		slog.Error("Error loading tags", "user_id", userID, "error", err)
+		return counts
+	}
+	for _, p := range projects {
+		for _, tag := range p.Tags {
+			counts[tag]++
+		}
+	}
+	return counts
+}
+
+// withSuggestedTags fills in p.SuggestedTags, so projects returned from
+// extraction come with tags ready to accept.
+func withSuggestedTags(p Project, used map[string]int) Project {
+	p.SuggestedTags = []string{}
+	for _, s := range tagsuggest.Suggest(p.Code, p.Language, used, p.Tags, maxTagSuggestions) {
+		p.SuggestedTags = append(p.SuggestedTags, s.Tag)
+	}
+	return p
+}
+
+// Handlers
+func suggestProjectTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+
+	suggestions := tagsuggest.Suggest(project.Code, project.Language, userTagCounts(userID), project.Tags, maxTagSuggestions)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"project_id":  project.ID,
+		"suggestions": suggestions,
+	})
+}
+
+// getTagsHandler lists the tags on projects in the workspace with how many
+// projects have each, most used first.
+func getTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	projects, err := db.Projects().List(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projectTagCounts(projects))
+}
+
+// autocompleteTagsHandler completes ?q= to tags that start with it,
+// ignoring case, most used first. ?limit= defaults to 10.
+func autocompleteTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	prefix := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+
+	limit := defaultTagCompletions
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTagCompletions {
+			writeFieldError(w, "limit", "range", "limit must be between 1 and "+strconv.Itoa(maxTagCompletions))
+			return
+		}
+		limit = n
+	}
+
+	projects, err := db.Projects().List(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+	completions := []TagCount{}
+	for _, t := range projectTagCounts(projects) {
+		if strings.HasPrefix(strings.ToLower(t.Tag), prefix) {
+			if completions = append(completions, t); len(completions) == limit {
+				break
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(completions)
+}
+
+// renameTagHandler renames a tag on every project in the workspace. Renaming
+// to a tag already in use merges the two.
+func renameTagHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From string `json:"from" validate:"required"`
+		To   string `json:"to" validate:"required,max=50"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	updateTags(w, r, "tag.renamed", []string{req.From}, "to", req.To)
+}
+
+// mergeTagsHandler replaces several tags with one on every project in the
+// workspace.
+func mergeTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tags []string `json:"tags" validate:"required,max=50"`
+		Into string   `json:"into" validate:"required,max=50"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	updateTags(w, r, "tag.merged", req.Tags, "into", req.Into)
+}
+
+// updateTags merges from into into, given as field of the request, and
+// answers with how many projects changed.
+func updateTags(w http.ResponseWriter, r *http.Request, action string, from []string, field, into string) {
+	userID := r.Header.Get("X-User-ID")
+	into = strings.TrimSpace(into)
+	if into == "" {
+		writeFieldError(w, field, "required", field+" is required")
+		return
+	}
+
+	projects, err := mergeTags(r.Context(), userID, from, into)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	for _, p := range projects {
+		indexDocuments(projectDocument(p))
+	}
+
+	ids := make([]string, len(projects))
+	for i, p := range projects {
+		ids[i] = p.ID
+	}
+	recordAudit(r, AuditEvent{
+		Action:       action,
+		ResourceType: "tag",
+		ResourceID:   into,
+		Metadata:     map[string]interface{}{"from": from, "projects": ids},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tag":      into,
+		"projects": len(projects),
+	})
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/extract"
+	"backup-manager/search"
+	"backup-manager/storage"
+	"backup-manager/validate"
+)
+
+const (
+	// Column sizes from the projects table
+	maxProjectName     = 500
+	maxProjectType     = 100
+	maxProjectLanguage = 50
+
+	maxProjectDescription = 10000
+	maxProjectCode        = 1 << 20
+	maxProjectTags        = 20
+	maxProjectTagLength   = 50
+	maxProjectFeatures    = 50
+	maxProjectFeature     = 200
+
+	defaultRecentProjects = 20
+	maxRecentProjects     = 100
+
+	// Source of projects a user creates by hand rather than by extraction
+	sourceManual = "Manual"
+)
+
+// cleanList trims items, drops empty ones and duplicates, and checks the
+// list against its limits. Duplicates are compared case-insensitively.
+func cleanList(items []string, what string, maxItems, maxLength int) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		key := strings.ToLower(item)
+		if item == "" || seen[key] {
+			continue
+		}
+		if utf8.RuneCountInString(item) > maxLength {
+			return nil, fmt.Errorf("%s must be at most %d characters each", what, maxLength)
+		}
+		seen[key] = true
+		out = append(out, item)
+	}
+	if len(out) > maxItems {
+		return nil, fmt.Errorf("at most %d %s are allowed", maxItems, what)
+	}
+	return out, nil
+}
+
+// validateProject checks and tidies the fields a user sets on a project,
+// returning every field at fault.
+func validateProject(p *Project) validate.Errors {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Type = strings.TrimSpace(p.Type)
+	p.Language = strings.TrimSpace(p.Language)
+	p.Description = strings.TrimSpace(p.Description)
+
+	var errs validate.Errors
+	maxLength := func(field, value string, max int) {
+		if utf8.RuneCountInString(value) > max {
+			errs.Add(field, "max", fmt.Sprintf("%s must be at most %d characters", field, max))
+		}
+	}
+	if p.Name == "" {
+		errs.Add("name", "required", "name is required")
+	}
+	maxLength("name", p.Name, maxProjectName)
+	maxLength("type", p.Type, maxProjectType)
+	maxLength("language", p.Language, maxProjectLanguage)
+	maxLength("description", p.Description, maxProjectDescription)
+	if len(p.Code) > maxProjectCode {
+		errs.Add("code", "max", "code must be at most 1 MiB")
+	}
+	validateProjectFiles(p, &errs)
+
+	var err error
+	if p.Tags, err = cleanList(p.Tags, "tags", maxProjectTags, maxProjectTagLength); err != nil {
+		errs.Add("tags", "max", err.Error())
+	}
+	if p.Features, err = cleanList(p.Features, "features", maxProjectFeatures, maxProjectFeature); err != nil {
+		errs.Add("features", "max", err.Error())
+	}
+	return errs
+}
+
+// createProject saves a new project and queues its indexing and
+// description.
+func createProject(ctx context.Context, actor DomainActor, p Project) error {
+	if err := db.Projects().Create(ctx, p); err != nil {
+		return err
+	}
+
+	doc := projectDocument(p)
+	indexDocuments(doc)
+	enqueueEmbedding(doc, "")
+	if p.Code != "" {
+		enqueueProjectDescription(p)
+	}
+
+	recordDomainEvent(actor, DomainEvent{
+		Type:          "project.created",
+		AggregateType: aggregateProject,
+		AggregateID:   p.ID,
+		OwnerID:       p.UserID,
+		After:         snapshot(p),
+	}, nil)
+	return nil
+}
+
+// Handlers
+
+// createProjectHandler saves a project made by hand. It can be one piece of
+// code or several files, in which case code is taken from the entry point.
+func createProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		BackupID    string   `json:"backup_id"`
+		Name        string   `json:"name"`
+		Type        string   `json:"type"`
+		Description string   `json:"description"`
+		Language    string   `json:"language"`
+		Code        string   `json:"code"`
+		Features    []string `json:"features"`
+		Tags        []string `json:"tags"`
+		Starred     bool     `json:"starred"`
+
+		Files []storage.ProjectFile `json:"files"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	project := Project{
+		ID:          generateID(),
+		UserID:      userID,
+		TeamID:      storage.TeamFrom(r.Context()),
+		BackupID:    strings.TrimSpace(req.BackupID),
+		Name:        req.Name,
+		Type:        req.Type,
+		Description: req.Description,
+		Source:      sourceManual,
+		Language:    req.Language,
+		Code:        req.Code,
+		Features:    req.Features,
+		Tags:        req.Tags,
+		Starred:     req.Starred,
+		Files:       req.Files,
+		Timestamp:   time.Now(),
+		Version:     1,
+	}
+	if errs := validateProject(&project); len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+	if project.Type == "" {
+		project.Type = extract.TypeSnippet
+	}
+	syncProjectCode(&project)
+
+	// A project can only be linked to one of its owner's own backups
+	if project.BackupID != "" {
+		backup, err := db.Backups().Get(r.Context(), userID, project.BackupID)
+		if err != nil {
+			writeStorageError(w, r, err, "Backup")
+			return
+		}
+		project.Source = backup.Source
+	}
+
+	if err := createProject(r.Context(), requestActor(r), project); err != nil {
+		logger(r.Context()).Error("Error creating project", "error", err)
+		http.Error(w, "Error creating project", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "project.created", ResourceType: "project", ResourceID: project.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(project)
+}
+
+// updateProjectHandler serves both PUT and PATCH. Only the fields present in
+// the body change, so a client can star a project or replace its tags
+// without resending the rest. Files replace all of a project's files. Code
+// can only be edited on a project without files; its language is detected
+// again unless the body gives one. With If-Match, the edit is only made if
+// the project hasn't changed since the client read it.
+func updateProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Name        *string   `json:"name"`
+		Description *string   `json:"description"`
+		Language    *string   `json:"language"`
+		Code        *string   `json:"code"`
+		Features    *[]string `json:"features"`
+		Tags        *[]string `json:"tags"`
+		Starred     *bool     `json:"starred"`
+
+		Files *[]storage.ProjectFile `json:"files"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	if !checkIfMatch(w, r, projectETag(project), "Project") {
+		return
+	}
+	before := project
+
+	var fields []string
+	if req.Name != nil {
+		project.Name = *req.Name
+		fields = append(fields, "name")
+	}
+	if req.Description != nil {
+		project.Description = *req.Description
+		fields = append(fields, "description")
+	}
+	if req.Code != nil {
+		if len(project.Files) > 0 && req.Files == nil {
+			writeFieldError(w, "code", "files", "code comes from the project's files; change them instead")
+			return
+		}
+		project.Code = *req.Code
+		if lang := extract.DetectLanguage("", "", project.Code); lang != "" {
+			project.Language = lang
+		}
+		fields = append(fields, "code")
+	}
+	if req.Language != nil {
+		project.Language = *req.Language
+		fields = append(fields, "language")
+	}
+	if req.Features != nil {
+		project.Features = *req.Features
+		fields = append(fields, "features")
+	}
+	if req.Tags != nil {
+		project.Tags = *req.Tags
+		fields = append(fields, "tags")
+	}
+	if req.Starred != nil {
+		project.Starred = *req.Starred
+		fields = append(fields, "starred")
+	}
+	if req.Files != nil {
+		project.Files = *req.Files
+		fields = append(fields, "files")
+	}
+	if len(fields) == 0 {
+		http.Error(w, "No fields to update", http.StatusBadRequest)
+		return
+	}
+	if errs := validateProject(&project); len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+	if req.Files != nil || req.Code != nil || req.Language != nil {
+		syncProjectCode(&project)
+	}
+
+	if r.Header.Get("If-Match") != "" {
+		err = db.Projects().UpdateIfVersion(r.Context(), project, before.Version)
+	} else {
+		err = db.Projects().Update(r.Context(), project)
+	}
+	if errors.Is(err, storage.ErrStale) {
+		http.Error(w, "Project has changed since it was read", http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	project.Version++
+	indexDocuments(projectDocument(project))
+
+	recordAudit(r, AuditEvent{
+		Action:       "project.updated",
+		ResourceType: "project",
+		ResourceID:   id,
+		Metadata:     map[string]interface{}{"fields": fields},
+	})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "project.updated",
+		AggregateType: aggregateProject,
+		AggregateID:   id,
+		OwnerID:       userID,
+		Before:        snapshot(before),
+		After:         snapshot(project),
+	}, map[string]interface{}{"fields": fields})
+
+	w.Header().Set("ETag", projectETag(project))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// projectETag is the entity tag of a project, which changes with its
+// version. Opening a project leaves it be, though the body shows when.
+func projectETag(p Project) string {
+	sum := sha256.Sum256([]byte(p.ID + ":" + strconv.Itoa(p.Version)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// touchProject records that a project was accessed, for the recent list.
+// Failures are only logged.
+func touchProject(ctx context.Context, id string) {
+	if err := db.Projects().Touch(ctx, id, time.Now()); err != nil {
+		logger(ctx).Error("Error recording project access", "project_id", id, "error", err)
+	}
+}
+
+// getProjectHandler returns one project, counting as an access for the
+// recent list.
+func getProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	touchProject(r.Context(), id)
+
+	w.Header().Set("ETag", projectETag(project))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+func getStarredProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	projects, err := db.Projects().ListStarred(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+// getRecentProjectsHandler lists the projects opened or downloaded most
+// recently, up to ?limit=, 20 by default.
+func getRecentProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	limit := defaultRecentProjects
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRecentProjects {
+			writeFieldError(w, "limit", "range", "limit must be between 1 and "+strconv.Itoa(maxRecentProjects))
+			return
+		}
+		limit = n
+	}
+
+	projects, err := db.Projects().ListRecent(r.Context(), userID, limit)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+// deleteProjectHandler moves a project to the trash. With If-Match, only if
+// it hasn't changed since the client read it.
+func deleteProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	if !checkIfMatch(w, r, projectETag(project), "Project") {
+		return
+	}
+	deletedAt := time.Now()
+	if err := db.Projects().Trash(r.Context(), userID, id, deletedAt); err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	removeDocuments(search.DocumentID(search.TypeProject, id))
+
+	recordAudit(r, AuditEvent{Action: "project.deleted", ResourceType: "project", ResourceID: id})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "project.deleted",
+		AggregateType: aggregateProject,
+		AggregateID:   id,
+		OwnerID:       userID,
+		Before:        snapshot(project),
+	}, map[string]interface{}{"purge_at": purgeAt(&deletedAt)})
+	w.WriteHeader(http.StatusNoContent)
+}
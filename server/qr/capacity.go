@@ -0,0 +1,79 @@
+package qr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ECLevel is a QR error correction level. Higher levels survive more damage
+// at the cost of capacity.
+type ECLevel string
+
+const (
+	ECLow      ECLevel = "L" // ~7% recovery
+	ECMedium   ECLevel = "M" // ~15%
+	ECQuartile ECLevel = "Q" // ~25%
+	ECHigh     ECLevel = "H" // ~30%
+
+	MinVersion = 1
+	MaxVersion = 40
+)
+
+// ParseECLevel accepts "L", "M", "Q" or "H" in either case. An empty
+// string means ECMedium.
+func ParseECLevel(s string) (ECLevel, error) {
+	switch level := ECLevel(strings.ToUpper(s)); level {
+	case "":
+		return ECMedium, nil
+	case ECLow, ECMedium, ECQuartile, ECHigh:
+		return level, nil
+	default:
+		return "", fmt.Errorf("qr: unknown error correction level %q", s)
+	}
+}
+
+// byteCapacity is how many bytes fit in byte mode for each version (rows)
+// and error correction level (L, M, Q, H), from ISO/IEC 18004.
+var byteCapacity = [MaxVersion][4]int{
+	{17, 14, 11, 7}, {32, 26, 20, 14}, {53, 42, 32, 24}, {78, 62, 46, 34},
+	{106, 84, 60, 44}, {134, 106, 74, 58}, {154, 122, 86, 64}, {192, 152, 108, 84},
+	{230, 180, 130, 98}, {271, 213, 151, 119}, {321, 251, 177, 137}, {367, 287, 203, 155},
+	{425, 331, 241, 177}, {458, 362, 258, 194}, {520, 412, 292, 220}, {586, 450, 322, 250},
+	{644, 504, 364, 280}, {718, 560, 394, 310}, {792, 624, 442, 338}, {858, 666, 482, 382},
+	{929, 711, 509, 403}, {1003, 779, 565, 439}, {1091, 857, 611, 461}, {1171, 911, 661, 511},
+	{1273, 997, 715, 535}, {1367, 1059, 751, 593}, {1465, 1125, 805, 625}, {1528, 1190, 868, 658},
+	{1628, 1264, 908, 698}, {1732, 1370, 982, 742}, {1840, 1452, 1030, 790}, {1952, 1538, 1112, 842},
+	{2068, 1628, 1168, 898}, {2188, 1722, 1228, 958}, {2303, 1809, 1283, 983}, {2431, 1911, 1351, 1051},
+	{2563, 1989, 1423, 1093}, {2699, 2099, 1499, 1139}, {2809, 2213, 1579, 1219}, {2953, 2331, 1663, 1273},
+}
+
+func (l ECLevel) index() int {
+	return strings.Index("LMQH", string(l))
+}
+
+// Capacity is the number of bytes a code of the given version and level
+// holds in byte mode.
+func Capacity(version int, level ECLevel) int {
+	if version < MinVersion || version > MaxVersion || level.index() < 0 {
+		return 0
+	}
+	return byteCapacity[version-1][level.index()]
+}
+
+// VersionFor returns the smallest version that holds n bytes at level, or
+// false if none does. It assumes byte mode, which is what URLs and free text
+// use; purely numeric payloads can be denser.
+func VersionFor(n int, level ECLevel) (int, bool) {
+	for v := MinVersion; v <= MaxVersion; v++ {
+		if Capacity(v, level) >= n {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// Modules is the width of a code of the given version, in modules, not
+// counting the quiet zone.
+func Modules(version int) int {
+	return 17 + 4*version
+}
@@ -0,0 +1,162 @@
+package qr
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Contact formats a contact QR can carry.
+const (
+	FormatVCard  = "vcard"
+	FormatMeCard = "mecard"
+	FormatAuto   = "auto"
+)
+
+// Contact is the content of a contact QR code.
+type Contact struct {
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Organization string `json:"organization"`
+	Title        string `json:"title"`
+	Phone        string `json:"phone"`
+	Email        string `json:"email"`
+	URL          string `json:"url"`
+	Address      string `json:"address"`
+	Note         string `json:"note"`
+}
+
+// VCard renders the contact as a vCard 3.0 (RFC 2426), which every phone
+// understands and which carries every field.
+func (c Contact) VCard() string {
+	esc := strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace
+	// Phone numbers, emails and URLs aren't text values, so aren't escaped,
+	// but still can't break the line
+	flat := strings.NewReplacer("\r", "", "\n", "").Replace
+
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"N:" + esc(c.LastName) + ";" + esc(c.FirstName) + ";;;",
+		"FN:" + esc(strings.TrimSpace(c.FirstName+" "+c.LastName)),
+	}
+	add := func(prop, value string) {
+		if value != "" {
+			lines = append(lines, prop+":"+value)
+		}
+	}
+	add("ORG", esc(c.Organization))
+	add("TITLE", esc(c.Title))
+	add("TEL;TYPE=CELL", flat(c.Phone))
+	add("EMAIL;TYPE=INTERNET", flat(c.Email))
+	add("URL", flat(c.URL))
+	if c.Address != "" {
+		// Free-form address goes in the street component
+		lines = append(lines, "ADR:;;"+esc(c.Address)+";;;;")
+	}
+	add("NOTE", esc(c.Note))
+	lines = append(lines, "END:VCARD")
+
+	for i, line := range lines {
+		lines[i] = foldLine(line)
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// foldLine splits a content line longer than 75 octets into continuation
+// lines starting with a space, as RFC 2425 asks, without splitting a UTF-8
+// sequence.
+func foldLine(line string) string {
+	const max = 75
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		n := utf8.RuneLen(r)
+		if width+n > max {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += n
+	}
+	return b.String()
+}
+
+// MeCard renders the contact as a MeCard, which is much more compact than a
+// vCard and so produces a smaller, easier to scan code. It has no title
+// field, so Title is dropped.
+func (c Contact) MeCard() string {
+	esc := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, ":", `\:`, "\n", " ").Replace
+
+	var b strings.Builder
+	b.WriteString("MECARD:")
+	name := esc(c.LastName)
+	if c.FirstName != "" {
+		name += "," + esc(c.FirstName)
+	}
+	b.WriteString("N:" + name + ";")
+
+	add := func(field, value string) {
+		if value != "" {
+			b.WriteString(field + ":" + esc(value) + ";")
+		}
+	}
+	add("ORG", c.Organization)
+	add("TEL", c.Phone)
+	add("EMAIL", c.Email)
+	add("URL", c.URL)
+	add("ADR", c.Address)
+	add("NOTE", c.Note)
+	b.WriteString(";")
+
+	return b.String()
+}
+
+// EncodedContact is a contact payload and the code it needs.
+type EncodedContact struct {
+	Payload string `json:"payload"`
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Modules int    `json:"modules"`
+	// Fields the chosen format could not carry.
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// EncodeContact renders c in the requested format. FormatAuto prefers vCard
+// and falls back to MeCard when the vCard would need a larger code than
+// maxVersion allows. It fails if the chosen payload does not fit.
+func EncodeContact(c Contact, format string, level ECLevel, maxVersion int) (EncodedContact, error) {
+	if maxVersion < MinVersion || maxVersion > MaxVersion {
+		maxVersion = MaxVersion
+	}
+
+	candidates := map[string][]string{
+		FormatVCard:  {FormatVCard},
+		FormatMeCard: {FormatMeCard},
+		FormatAuto:   {FormatVCard, FormatMeCard},
+		"":           {FormatVCard, FormatMeCard},
+	}[format]
+	if candidates == nil {
+		return EncodedContact{}, fmt.Errorf("qr: unknown contact format %q", format)
+	}
+
+	var smallest int
+	for _, f := range candidates {
+		payload := c.VCard()
+		if f == FormatMeCard {
+			payload = c.MeCard()
+		}
+
+		version, ok := VersionFor(len(payload), level)
+		if ok && version <= maxVersion {
+			encoded := EncodedContact{Payload: payload, Format: f, Version: version, Modules: Modules(version)}
+			if f == FormatMeCard && c.Title != "" {
+				encoded.Dropped = []string{"title"}
+			}
+			return encoded, nil
+		}
+		smallest = len(payload)
+	}
+
+	return EncodedContact{}, fmt.Errorf("qr: contact needs %d bytes, more than a version %d code holds at level %s", smallest, maxVersion, level)
+}
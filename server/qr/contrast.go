@@ -0,0 +1,147 @@
+package qr
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Contrast ratios (WCAG definition, 1 to 21) between the dark and light
+// modules. Scanners binarize the image, so low contrast fails outright
+// rather than degrading gracefully.
+const (
+	MinContrast         = 3.0
+	RecommendedContrast = 4.5
+)
+
+// ColorPair is a foreground (dark module) and background color as hex.
+type ColorPair struct {
+	Foreground string `json:"foreground"`
+	Background string `json:"background"`
+}
+
+// ContrastResult is the contrast of a color pair and, when it is too low,
+// the closest pair that meets RecommendedContrast.
+type ContrastResult struct {
+	Ratio     float64    `json:"ratio"`
+	Inverted  bool       `json:"inverted"`
+	Suggested *ColorPair `json:"suggested,omitempty"`
+}
+
+// ParseHexColor parses "#rrggbb" or "#rgb", with or without the "#".
+func ParseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("qr: invalid color %q", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("qr: invalid color %q", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// HexColor formats c as "#rrggbb".
+func HexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// RelativeLuminance is the WCAG relative luminance of c, from 0 to 1.
+func RelativeLuminance(c color.RGBA) float64 {
+	channel := func(v uint8) float64 {
+		s := float64(v) / 255
+		if s <= 0.03928 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	return 0.2126*channel(c.R) + 0.7152*channel(c.G) + 0.0722*channel(c.B)
+}
+
+// ContrastRatio is the WCAG contrast ratio between two colors.
+func ContrastRatio(a, b color.RGBA) float64 {
+	la, lb := RelativeLuminance(a), RelativeLuminance(b)
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
+
+func mix(c, toward color.RGBA, t float64) color.RGBA {
+	lerp := func(a, b uint8) uint8 { return uint8(math.Round(float64(a) + (float64(b)-float64(a))*t)) }
+	return color.RGBA{R: lerp(c.R, toward.R), G: lerp(c.G, toward.G), B: lerp(c.B, toward.B), A: 0xff}
+}
+
+// SuggestColors finds the pair closest to fg and bg with at least the given
+// contrast, keeping each color's hue by darkening the foreground toward
+// black and, if that is not enough, lightening the background toward white.
+func SuggestColors(fg, bg color.RGBA, ratio float64) ColorPair {
+	black := color.RGBA{A: 0xff}
+	white := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+	const steps = 100
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / steps
+		// Prefer changing only the foreground, then only the background,
+		// then both by the same amount.
+		candidates := []ColorPair{
+			{HexColor(mix(fg, black, t)), HexColor(bg)},
+			{HexColor(fg), HexColor(mix(bg, white, t))},
+			{HexColor(mix(fg, black, t)), HexColor(mix(bg, white, t))},
+		}
+		for _, c := range candidates {
+			f, _ := ParseHexColor(c.Foreground)
+			b, _ := ParseHexColor(c.Background)
+			if ContrastRatio(f, b) >= ratio {
+				return c
+			}
+		}
+	}
+	return ColorPair{Foreground: HexColor(black), Background: HexColor(white)}
+}
+
+// CheckContrast measures a foreground/background pair and adds warnings to
+// result. Below MinContrast is an error; below RecommendedContrast, or a
+// light-on-dark code that many scanners cannot read, is a warning.
+func CheckContrast(result *LintResult, foreground, background string) (ContrastResult, error) {
+	fg, err := ParseHexColor(foreground)
+	if err != nil {
+		return ContrastResult{}, err
+	}
+	bg, err := ParseHexColor(background)
+	if err != nil {
+		return ContrastResult{}, err
+	}
+
+	ratio := ContrastRatio(fg, bg)
+	check := ContrastResult{
+		Ratio:    math.Round(ratio*100) / 100,
+		Inverted: RelativeLuminance(fg) > RelativeLuminance(bg),
+	}
+
+	if check.Inverted {
+		result.add(SeverityWarning, "inverted_colors",
+			"The foreground is lighter than the background. Many scanners only read dark codes on a light background.")
+		fg, bg = bg, fg
+	}
+
+	switch {
+	case ratio < MinContrast:
+		result.add(SeverityError, "low_contrast",
+			"The colors have a contrast ratio of %.1f:1; at least %.1f:1 is needed to scan reliably.", ratio, MinContrast)
+	case ratio < RecommendedContrast:
+		result.add(SeverityWarning, "marginal_contrast",
+			"The colors have a contrast ratio of %.1f:1; %.1f:1 or more scans better in poor light.", ratio, RecommendedContrast)
+	}
+
+	if check.Inverted || ratio < RecommendedContrast {
+		suggested := SuggestColors(fg, bg, RecommendedContrast)
+		check.Suggested = &suggested
+	}
+	return check, nil
+}
@@ -0,0 +1,586 @@
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrNotFound   = errors.New("qr: no QR code found")
+	ErrUnreadable = errors.New("qr: found a QR code but couldn't read it")
+)
+
+// Decoded is a code read back from an image.
+type Decoded struct {
+	Content string  `json:"content"`
+	Version int     `json:"version"`
+	Level   ECLevel `json:"ec_level"`
+	Mask    int     `json:"mask"`
+	// Corrected is how many codewords error correction repaired; a clean
+	// render has none.
+	Corrected int `json:"corrected"`
+}
+
+// Decode finds a QR code in img and reads it. Codes may be rotated, at an
+// angle or lit unevenly; mirrored codes and Kanji text aren't read.
+func Decode(img image.Image) (*Decoded, error) {
+	gray := grayscale(img)
+	located := false
+	for _, binarize := range []func(*image.Gray) *bitmap{otsuThreshold, localThreshold} {
+		b := binarize(gray)
+		finders, ok := pickFinders(b.findFinders())
+		if !ok {
+			continue
+		}
+		located = true
+		if d, err := b.decodeAt(finders); err == nil {
+			return d, nil
+		}
+	}
+	if located {
+		return nil, ErrUnreadable
+	}
+	return nil, ErrNotFound
+}
+
+// decodeAt reads the code with finder patterns f, trying the sizes the
+// distance between them suggests.
+func (b *bitmap) decodeAt(f [3]finderPattern) (*Decoded, error) {
+	module := b.moduleSize(f)
+	across := (distance(f[0].point, f[1].point)+distance(f[0].point, f[2].point))/2/module + 7
+	// Sizes are 4v+17 modules
+	version := int(math.Round((across - 17) / 4))
+
+	tried := map[int]bool{}
+	var try func(v int) (*Decoded, error)
+	try = func(v int) (*Decoded, error) {
+		if v < MinVersion || v > MaxVersion || tried[v] {
+			return nil, ErrUnreadable
+		}
+		tried[v] = true
+		for _, grid := range b.sample(f, v, module) {
+			d, err := readGrid(grid, v)
+			var wrong wrongVersion
+			if errors.As(err, &wrong) {
+				return try(int(wrong))
+			}
+			if err == nil {
+				return d, nil
+			}
+		}
+		return nil, ErrUnreadable
+	}
+	for _, v := range []int{version, version - 1, version + 1} {
+		if d, err := try(v); err == nil {
+			return d, nil
+		}
+	}
+	return nil, ErrUnreadable
+}
+
+// sample reads the modules of a code of version v with finder patterns f,
+// once mapped through each likely bottom right alignment pattern and once
+// assuming the code is flat.
+func (b *bitmap) sample(f [3]finderPattern, v int, module float64) [][][]bool {
+	n := Modules(v)
+	size := float64(n)
+	from := [4]point{{3.5, 3.5}, {size - 3.5, 3.5}, {3.5, size - 3.5}}
+	to := [4]point{f[0].point, f[1].point, f[2].point}
+
+	var corners [][2]point
+	if v >= 2 {
+		// Where the alignment pattern would be if the code were flat
+		t := 1 - 3/(size-7)
+		estimate := point{
+			f[0].x + t*(f[1].x-f[0].x+f[2].x-f[0].x),
+			f[0].y + t*(f[1].y-f[0].y+f[2].y-f[0].y),
+		}
+		for _, allowance := range []int{4, 8, 16} {
+			found := b.findAlignments(estimate, module, allowance)
+			for _, p := range found {
+				corners = append(corners, [2]point{{size - 6.5, size - 6.5}, p})
+			}
+			if len(found) > 0 {
+				break
+			}
+		}
+	}
+	corners = append(corners, [2]point{{size - 3.5, size - 3.5}, {f[1].x + f[2].x - f[0].x, f[1].y + f[2].y - f[0].y}})
+
+	var grids [][][]bool
+	for _, c := range corners {
+		from[3], to[3] = c[0], c[1]
+		h, ok := newHomography(from, to)
+		if !ok {
+			continue
+		}
+		grid := make([][]bool, n)
+		for y := range grid {
+			grid[y] = make([]bool, n)
+			for x := range grid[y] {
+				p := h.apply(point{float64(x) + 0.5, float64(y) + 0.5})
+				grid[y][x] = b.get(int(p.x), int(p.y))
+			}
+		}
+		grids = append(grids, grid)
+	}
+	return grids
+}
+
+// ecBlocks is how each version (rows) and level (L, M, Q, H) splits its
+// codewords: error correction codewords per block, then the number of
+// blocks and data codewords in each of the two groups of blocks.
+var ecBlocks = [MaxVersion][4][5]int{
+	{{7, 1, 19, 0, 0}, {10, 1, 16, 0, 0}, {13, 1, 13, 0, 0}, {17, 1, 9, 0, 0}},
+	{{10, 1, 34, 0, 0}, {16, 1, 28, 0, 0}, {22, 1, 22, 0, 0}, {28, 1, 16, 0, 0}},
+	{{15, 1, 55, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 17, 0, 0}, {22, 2, 13, 0, 0}},
+	{{20, 1, 80, 0, 0}, {18, 2, 32, 0, 0}, {26, 2, 24, 0, 0}, {16, 4, 9, 0, 0}},
+	{{26, 1, 108, 0, 0}, {24, 2, 43, 0, 0}, {18, 2, 15, 2, 16}, {22, 2, 11, 2, 12}},
+	{{18, 2, 68, 0, 0}, {16, 4, 27, 0, 0}, {24, 4, 19, 0, 0}, {28, 4, 15, 0, 0}},
+	{{20, 2, 78, 0, 0}, {18, 4, 31, 0, 0}, {18, 2, 14, 4, 15}, {26, 4, 13, 1, 14}},
+	{{24, 2, 97, 0, 0}, {22, 2, 38, 2, 39}, {22, 4, 18, 2, 19}, {26, 4, 14, 2, 15}},
+	{{30, 2, 116, 0, 0}, {22, 3, 36, 2, 37}, {20, 4, 16, 4, 17}, {24, 4, 12, 4, 13}},
+	{{18, 2, 68, 2, 69}, {26, 4, 43, 1, 44}, {24, 6, 19, 2, 20}, {28, 6, 15, 2, 16}},
+	{{20, 4, 81, 0, 0}, {30, 1, 50, 4, 51}, {28, 4, 22, 4, 23}, {24, 3, 12, 8, 13}},
+	{{24, 2, 92, 2, 93}, {22, 6, 36, 2, 37}, {26, 4, 20, 6, 21}, {28, 7, 14, 4, 15}},
+	{{26, 4, 107, 0, 0}, {22, 8, 37, 1, 38}, {24, 8, 20, 4, 21}, {22, 12, 11, 4, 12}},
+	{{30, 3, 115, 1, 116}, {24, 4, 40, 5, 41}, {20, 11, 16, 5, 17}, {24, 11, 12, 5, 13}},
+	{{22, 5, 87, 1, 88}, {24, 5, 41, 5, 42}, {30, 5, 24, 7, 25}, {24, 11, 12, 7, 13}},
+	{{24, 5, 98, 1, 99}, {28, 7, 45, 3, 46}, {24, 15, 19, 2, 20}, {30, 3, 15, 13, 16}},
+	{{28, 1, 107, 5, 108}, {28, 10, 46, 1, 47}, {28, 1, 22, 15, 23}, {28, 2, 14, 17, 15}},
+	{{30, 5, 120, 1, 121}, {26, 9, 43, 4, 44}, {28, 17, 22, 1, 23}, {28, 2, 14, 19, 15}},
+	{{28, 3, 113, 4, 114}, {26, 3, 44, 11, 45}, {26, 17, 21, 4, 22}, {26, 9, 13, 16, 14}},
+	{{28, 3, 107, 5, 108}, {26, 3, 41, 13, 42}, {30, 15, 24, 5, 25}, {28, 15, 15, 10, 16}},
+	{{28, 4, 116, 4, 117}, {26, 17, 42, 0, 0}, {28, 17, 22, 6, 23}, {30, 19, 16, 6, 17}},
+	{{28, 2, 111, 7, 112}, {28, 17, 46, 0, 0}, {30, 7, 24, 16, 25}, {24, 34, 13, 0, 0}},
+	{{30, 4, 121, 5, 122}, {28, 4, 47, 14, 48}, {30, 11, 24, 14, 25}, {30, 16, 15, 14, 16}},
+	{{30, 6, 117, 4, 118}, {28, 6, 45, 14, 46}, {30, 11, 24, 16, 25}, {30, 30, 16, 2, 17}},
+	{{26, 8, 106, 4, 107}, {28, 8, 47, 13, 48}, {30, 7, 24, 22, 25}, {30, 22, 15, 13, 16}},
+	{{28, 10, 114, 2, 115}, {28, 19, 46, 4, 47}, {28, 28, 22, 6, 23}, {30, 33, 16, 4, 17}},
+	{{30, 8, 122, 4, 123}, {28, 22, 45, 3, 46}, {30, 8, 23, 26, 24}, {30, 12, 15, 28, 16}},
+	{{30, 3, 117, 10, 118}, {28, 3, 45, 23, 46}, {30, 4, 24, 31, 25}, {30, 11, 15, 31, 16}},
+	{{30, 7, 116, 7, 117}, {28, 21, 45, 7, 46}, {30, 1, 23, 37, 24}, {30, 19, 15, 26, 16}},
+	{{30, 5, 115, 10, 116}, {28, 19, 47, 10, 48}, {30, 15, 24, 25, 25}, {30, 23, 15, 25, 16}},
+	{{30, 13, 115, 3, 116}, {28, 2, 46, 29, 47}, {30, 42, 24, 1, 25}, {30, 23, 15, 28, 16}},
+	{{30, 17, 115, 0, 0}, {28, 10, 46, 23, 47}, {30, 10, 24, 35, 25}, {30, 19, 15, 35, 16}},
+	{{30, 17, 115, 1, 116}, {28, 14, 46, 21, 47}, {30, 29, 24, 19, 25}, {30, 11, 15, 46, 16}},
+	{{30, 13, 115, 6, 116}, {28, 14, 46, 23, 47}, {30, 44, 24, 7, 25}, {30, 59, 16, 1, 17}},
+	{{30, 12, 121, 7, 122}, {28, 12, 47, 26, 48}, {30, 39, 24, 14, 25}, {30, 22, 15, 41, 16}},
+	{{30, 6, 121, 14, 122}, {28, 6, 47, 34, 48}, {30, 46, 24, 10, 25}, {30, 2, 15, 64, 16}},
+	{{30, 17, 122, 4, 123}, {28, 29, 46, 14, 47}, {30, 49, 24, 10, 25}, {30, 24, 15, 46, 16}},
+	{{30, 4, 122, 18, 123}, {28, 13, 46, 32, 47}, {30, 48, 24, 14, 25}, {30, 42, 15, 32, 16}},
+	{{30, 20, 117, 4, 118}, {28, 40, 47, 7, 48}, {30, 43, 24, 22, 25}, {30, 10, 15, 67, 16}},
+	{{30, 19, 118, 6, 119}, {28, 18, 47, 31, 48}, {30, 34, 24, 34, 25}, {30, 20, 15, 61, 16}},
+}
+
+// alignmentCenters are the rows and columns of each version's alignment
+// patterns.
+var alignmentCenters = [MaxVersion + 1][]int{
+	{}, {},
+	{6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50}, {6, 30, 54}, {6, 32, 58}, {6, 34, 62},
+	{6, 26, 46, 66}, {6, 26, 48, 70}, {6, 26, 50, 74}, {6, 30, 54, 78}, {6, 30, 56, 82}, {6, 30, 58, 86}, {6, 34, 62, 90},
+	{6, 28, 50, 72, 94}, {6, 26, 50, 74, 98}, {6, 30, 54, 78, 102}, {6, 28, 54, 80, 106}, {6, 32, 58, 84, 110}, {6, 30, 58, 86, 114}, {6, 34, 62, 90, 118},
+	{6, 26, 50, 74, 98, 122}, {6, 30, 54, 78, 102, 126}, {6, 26, 52, 78, 104, 130}, {6, 30, 56, 82, 108, 134}, {6, 34, 60, 86, 112, 138}, {6, 30, 58, 86, 114, 142}, {6, 34, 62, 90, 118, 146},
+	{6, 30, 54, 78, 102, 126, 150}, {6, 24, 50, 76, 102, 128, 154}, {6, 28, 54, 80, 106, 132, 158}, {6, 32, 58, 84, 110, 136, 162}, {6, 26, 54, 82, 110, 138, 166}, {6, 30, 58, 86, 114, 142, 170},
+}
+
+// bch appends the remainder of value divided by poly, as format and version
+// information do.
+func bch(value, poly int) int {
+	degree := bits.Len(uint(poly)) - 1
+	r := value << degree
+	for bits.Len(uint(r)) > degree {
+		r ^= poly << (bits.Len(uint(r)) - 1 - degree)
+	}
+	return value<<degree | r
+}
+
+// closest returns which of the codes bch(0..count-1) read is nearest,
+// allowing up to 3 bits wrong.
+func closest(read []int, count, poly, mask int) (int, bool) {
+	best, bestDist := 0, 4
+	for value := 0; value < count; value++ {
+		code := bch(value, poly) ^ mask
+		for _, r := range read {
+			if d := bits.OnesCount(uint(r ^ code)); d < bestDist {
+				best, bestDist = value, d
+			}
+		}
+	}
+	return best, bestDist < 4
+}
+
+// levelBits maps format information's level bits to the level.
+var levelBits = [4]ECLevel{ECMedium, ECLow, ECHigh, ECQuartile}
+
+// wrongVersion is the version a code's version information names when the
+// grid was sampled at another.
+type wrongVersion int
+
+func (v wrongVersion) Error() string {
+	return fmt.Sprintf("qr: code is version %d", int(v))
+}
+
+// readGrid decodes the modules of a code sampled as version v.
+func readGrid(grid [][]bool, v int) (*Decoded, error) {
+	n := len(grid)
+	at := func(x, y int) int {
+		if grid[y][x] {
+			return 1
+		}
+		return 0
+	}
+
+	// Format information is next to the top left finder pattern, and
+	// split between the other two
+	var format [2]int
+	for x := 0; x <= 5; x++ {
+		format[0] = format[0]<<1 | at(x, 8)
+	}
+	format[0] = format[0]<<1 | at(7, 8)
+	format[0] = format[0]<<1 | at(8, 8)
+	format[0] = format[0]<<1 | at(8, 7)
+	for y := 5; y >= 0; y-- {
+		format[0] = format[0]<<1 | at(8, y)
+	}
+	for y := n - 1; y >= n-7; y-- {
+		format[1] = format[1]<<1 | at(8, y)
+	}
+	for x := n - 8; x < n; x++ {
+		format[1] = format[1]<<1 | at(x, 8)
+	}
+	info, ok := closest(format[:], 32, 0x537, 0x5412)
+	if !ok {
+		return nil, ErrUnreadable
+	}
+	level, mask := levelBits[info>>3], info&7
+
+	if v >= 7 {
+		var version [2]int
+		for y := 5; y >= 0; y-- {
+			for x := n - 9; x >= n-11; x-- {
+				version[0] = version[0]<<1 | at(x, y)
+			}
+		}
+		for x := 5; x >= 0; x-- {
+			for y := n - 9; y >= n-11; y-- {
+				version[1] = version[1]<<1 | at(x, y)
+			}
+		}
+		read, ok := closest(version[:], MaxVersion+1, 0x1f25, 0)
+		if ok && read >= 7 && read != v {
+			return nil, wrongVersion(read)
+		}
+	}
+
+	function := functionModules(v)
+	var codewords []byte
+	var current byte
+	count := 0
+	up := true
+	for right := n - 1; right > 0; right -= 2 {
+		// The vertical timing pattern shifts the columns after it
+		if right == 6 {
+			right--
+		}
+		for i := 0; i < n; i++ {
+			y := i
+			if up {
+				y = n - 1 - i
+			}
+			for col := 0; col < 2; col++ {
+				x := right - col
+				if function[y][x] {
+					continue
+				}
+				bit := grid[y][x] != masked(mask, x, y)
+				current <<= 1
+				if bit {
+					current |= 1
+				}
+				count++
+				if count == 8 {
+					codewords = append(codewords, current)
+					current, count = 0, 0
+				}
+			}
+		}
+		up = !up
+	}
+
+	data, corrected, err := correctCodewords(codewords, v, level)
+	if err != nil {
+		return nil, err
+	}
+	content, err := parseSegments(data, v)
+	if err != nil {
+		return nil, err
+	}
+	return &Decoded{Content: content, Version: v, Level: level, Mask: mask, Corrected: corrected}, nil
+}
+
+// masked reports whether mask pattern m flips the module at (x, y).
+func masked(m, x, y int) bool {
+	switch m {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (y/2+x/3)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// functionModules marks the modules of version v that don't carry data:
+// finder patterns and their separators, format and version information,
+// timing and alignment patterns.
+func functionModules(v int) [][]bool {
+	n := Modules(v)
+	f := make([][]bool, n)
+	for y := range f {
+		f[y] = make([]bool, n)
+	}
+	fill := func(x0, y0, w, h int) {
+		for y := y0; y < y0+h; y++ {
+			for x := x0; x < x0+w; x++ {
+				f[y][x] = true
+			}
+		}
+	}
+	fill(0, 0, 9, 9)
+	fill(n-8, 0, 8, 9)
+	fill(0, n-8, 9, 8)
+	fill(6, 0, 1, n)
+	fill(0, 6, n, 1)
+	centers := alignmentCenters[v]
+	for _, cy := range centers {
+		for _, cx := range centers {
+			// Alignment patterns give way to the finder patterns
+			first, last := 6, n-7
+			if cx == first && (cy == first || cy == last) || cy == first && cx == last {
+				continue
+			}
+			fill(cx-2, cy-2, 5, 5)
+		}
+	}
+	if v >= 7 {
+		fill(n-11, 0, 3, 6)
+		fill(0, n-11, 6, 3)
+	}
+	return f
+}
+
+// correctCodewords splits the interleaved codewords into blocks, corrects
+// each and returns their data codewords in order.
+func correctCodewords(codewords []byte, v int, level ECLevel) ([]byte, int, error) {
+	layout := ecBlocks[v-1][level.index()]
+	ecLen := layout[0]
+	var dataLens []int
+	for i := 0; i < layout[1]; i++ {
+		dataLens = append(dataLens, layout[2])
+	}
+	for i := 0; i < layout[3]; i++ {
+		dataLens = append(dataLens, layout[4])
+	}
+
+	blocks := make([][]byte, len(dataLens))
+	total := 0
+	for i, n := range dataLens {
+		blocks[i] = make([]byte, 0, n+ecLen)
+		total += n + ecLen
+	}
+	if len(codewords) < total {
+		return nil, 0, ErrUnreadable
+	}
+
+	// Data codewords are dealt round the blocks, the longer ones last,
+	// then the error correction codewords likewise
+	next := 0
+	for i := 0; i < layout[2]+1; i++ {
+		for b, n := range dataLens {
+			if i < n {
+				blocks[b] = append(blocks[b], codewords[next])
+				next++
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[next])
+			next++
+		}
+	}
+
+	var data []byte
+	corrected := 0
+	for b, block := range blocks {
+		fixed, err := correctBlock(block, ecLen)
+		if err != nil {
+			return nil, 0, ErrUnreadable
+		}
+		corrected += fixed
+		data = append(data, block[:dataLens[b]]...)
+	}
+	return data, corrected, nil
+}
+
+// bitReader reads big-endian bit fields from data codewords.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) left() int {
+	return len(r.data)*8 - r.pos
+}
+
+func (r *bitReader) read(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | int(bit)
+		r.pos++
+	}
+	return v
+}
+
+const alphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// parseSegments reads the content from a code's data codewords: numeric,
+// alphanumeric and byte segments, with ECI switching how bytes are read.
+func parseSegments(data []byte, v int) (string, error) {
+	// Character count fields grow with the version
+	countBits := func(small, medium, large int) int {
+		switch {
+		case v <= 9:
+			return small
+		case v <= 26:
+			return medium
+		}
+		return large
+	}
+
+	r := &bitReader{data: data}
+	var out strings.Builder
+	var raw []byte // byte segments, decoded once the charset is known
+	latin1 := false
+	flush := func() {
+		if len(raw) == 0 {
+			return
+		}
+		// ISO-8859-1 is the standard's default, but nearly every encoder
+		// writes UTF-8 without saying so
+		if latin1 || !utf8.Valid(raw) {
+			for _, c := range raw {
+				out.WriteRune(rune(c))
+			}
+		} else {
+			out.Write(raw)
+		}
+		raw = raw[:0]
+	}
+	fail := func() (string, error) { return "", ErrUnreadable }
+
+	for r.left() >= 4 {
+		mode := r.read(4)
+		switch mode {
+		case 0x0: // terminator
+			flush()
+			return out.String(), nil
+		case 0x1: // numeric
+			flush()
+			n := r.read(countBits(10, 12, 14))
+			for ; n >= 3; n -= 3 {
+				if r.left() < 10 {
+					return fail()
+				}
+				fmt.Fprintf(&out, "%03d", r.read(10))
+			}
+			switch n {
+			case 2:
+				if r.left() < 7 {
+					return fail()
+				}
+				fmt.Fprintf(&out, "%02d", r.read(7))
+			case 1:
+				if r.left() < 4 {
+					return fail()
+				}
+				fmt.Fprintf(&out, "%d", r.read(4))
+			}
+		case 0x2: // alphanumeric
+			flush()
+			n := r.read(countBits(9, 11, 13))
+			for ; n >= 2; n -= 2 {
+				if r.left() < 11 {
+					return fail()
+				}
+				pair := r.read(11)
+				if pair >= 45*45 {
+					return fail()
+				}
+				out.WriteByte(alphanumeric[pair/45])
+				out.WriteByte(alphanumeric[pair%45])
+			}
+			if n == 1 {
+				if r.left() < 6 {
+					return fail()
+				}
+				c := r.read(6)
+				if c >= 45 {
+					return fail()
+				}
+				out.WriteByte(alphanumeric[c])
+			}
+		case 0x4: // byte
+			n := r.read(countBits(8, 16, 16))
+			if r.left() < 8*n {
+				return fail()
+			}
+			for i := 0; i < n; i++ {
+				raw = append(raw, byte(r.read(8)))
+			}
+		case 0x7: // ECI
+			flush()
+			var designator int
+			switch first := r.read(8); {
+			case first&0x80 == 0:
+				designator = first
+			case first&0xc0 == 0x80:
+				designator = (first&0x3f)<<8 | r.read(8)
+			default:
+				designator = (first&0x1f)<<16 | r.read(16)
+			}
+			// 3 and 1 are ISO-8859-1, 26 UTF-8
+			latin1 = designator == 1 || designator == 3
+		case 0x3: // structured append: which part of a set this is
+			r.read(16)
+		case 0x5, 0x9: // FNC1 markers
+			if mode == 0x9 {
+				r.read(8)
+			}
+		case 0x8:
+			return "", errors.New("qr: Kanji text isn't supported")
+		default:
+			return fail()
+		}
+	}
+	flush()
+	return out.String(), nil
+}
@@ -0,0 +1,525 @@
+package qr
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"sort"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// maxDecodeEdge is the longest edge an image is scanned at; larger ones,
+// like phone photos, are scaled down first.
+const maxDecodeEdge = 1600
+
+// bitmap is a black and white image, true is dark.
+type bitmap struct {
+	w, h int
+	dark []bool
+}
+
+func (b *bitmap) get(x, y int) bool {
+	return x >= 0 && y >= 0 && x < b.w && y < b.h && b.dark[y*b.w+x]
+}
+
+// grayscale flattens img onto white, as it would be printed, scaled down to
+// maxDecodeEdge.
+func grayscale(img image.Image) *image.Gray {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if longest := max(w, h); longest > maxDecodeEdge {
+		w = max(1, w*maxDecodeEdge/longest)
+		h = max(1, h*maxDecodeEdge/longest)
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+	if w == b.Dx() && h == b.Dy() {
+		draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Over)
+	} else {
+		xdraw.BiLinear.Scale(rgba, rgba.Bounds(), img, b, xdraw.Over, nil)
+	}
+
+	gray := image.NewGray(rgba.Bounds())
+	for i := 0; i < w*h; i++ {
+		p := rgba.Pix[i*4 : i*4+3]
+		gray.Pix[i] = uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000)
+	}
+	return gray
+}
+
+// otsuThreshold splits the image at the gray level that best separates its
+// dark and light pixels, which suits evenly lit images like renders and
+// scans.
+func otsuThreshold(g *image.Gray) *bitmap {
+	var hist [256]int
+	for _, v := range g.Pix {
+		hist[v]++
+	}
+	total := len(g.Pix)
+	sum := 0
+	for i, n := range hist {
+		sum += i * n
+	}
+
+	best, threshold := -1.0, 128
+	sumDark, countDark := 0, 0
+	for t := 0; t < 256; t++ {
+		countDark += hist[t]
+		if countDark == 0 {
+			continue
+		}
+		countLight := total - countDark
+		if countLight == 0 {
+			break
+		}
+		sumDark += t * hist[t]
+		meanDark := float64(sumDark) / float64(countDark)
+		meanLight := float64(sum-sumDark) / float64(countLight)
+		between := float64(countDark) * float64(countLight) * (meanDark - meanLight) * (meanDark - meanLight)
+		if between > best {
+			best, threshold = between, t
+		}
+	}
+
+	b := &bitmap{w: g.Rect.Dx(), h: g.Rect.Dy(), dark: make([]bool, total)}
+	for i, v := range g.Pix {
+		b.dark[i] = int(v) <= threshold
+	}
+	return b
+}
+
+// localThreshold compares each pixel with the mean of its surroundings,
+// which copes with photos lit unevenly across the code.
+func localThreshold(g *image.Gray) *bitmap {
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	integral := make([]int, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		row := 0
+		for x := 0; x < w; x++ {
+			row += int(g.Pix[y*g.Stride+x])
+			integral[(y+1)*(w+1)+x+1] = integral[y*(w+1)+x+1] + row
+		}
+	}
+
+	// The window must be wider than a finder pattern's dark center
+	r := max(8, min(w, h)/8)
+	b := &bitmap{w: w, h: h, dark: make([]bool, w*h)}
+	for y := 0; y < h; y++ {
+		y0, y1 := max(0, y-r), min(h, y+r+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := max(0, x-r), min(w, x+r+1)
+			sum := integral[y1*(w+1)+x1] - integral[y0*(w+1)+x1] - integral[y1*(w+1)+x0] + integral[y0*(w+1)+x0]
+			count := (x1 - x0) * (y1 - y0)
+			b.dark[y*w+x] = int(g.Pix[y*g.Stride+x])*count*100 < sum*88
+		}
+	}
+	return b
+}
+
+type point struct{ x, y float64 }
+
+func distance(a, b point) float64 {
+	return math.Hypot(a.x-b.x, a.y-b.y)
+}
+
+// finderPattern is one of the three nested squares in a code's corners.
+type finderPattern struct {
+	point
+	module float64 // estimated module size in pixels
+	count  int     // scan lines it was seen on
+}
+
+// crossesFinder reports whether runs of dark, light, dark, light, dark
+// pixels are in the 1:1:3:1:1 proportions of a finder pattern.
+func crossesFinder(runs [5]int) bool {
+	total := 0
+	for _, n := range runs {
+		if n == 0 {
+			return false
+		}
+		total += n
+	}
+	if total < 7 {
+		return false
+	}
+	module := float64(total) / 7
+	tolerance := module / 2
+	near := func(n int, want float64) bool { return math.Abs(float64(n)-want) < want/module*tolerance }
+	return near(runs[0], module) && near(runs[1], module) && near(runs[2], 3*module) &&
+		near(runs[3], module) && near(runs[4], module)
+}
+
+// finderCenter is the middle of the runs ending at end.
+func finderCenter(runs [5]int, end int) float64 {
+	return float64(end-runs[4]-runs[3]) - float64(runs[2])/2
+}
+
+// crossCheck counts runs through (x, y) along (dx, dy) both ways and
+// returns the center of the finder pattern they cross, if they do.
+func (b *bitmap) crossCheck(x, y, dx, dy, maxRun, wantTotal int) (float64, int, bool) {
+	var runs [5]int
+	inside := func(x, y int) bool { return x >= 0 && y >= 0 && x < b.w && y < b.h }
+
+	cx, cy := x, y
+	for inside(cx, cy) && b.get(cx, cy) {
+		runs[2]++
+		cx, cy = cx-dx, cy-dy
+	}
+	for inside(cx, cy) && !b.get(cx, cy) && runs[1] <= maxRun {
+		runs[1]++
+		cx, cy = cx-dx, cy-dy
+	}
+	for inside(cx, cy) && b.get(cx, cy) && runs[0] <= maxRun {
+		runs[0]++
+		cx, cy = cx-dx, cy-dy
+	}
+
+	cx, cy = x+dx, y+dy
+	for inside(cx, cy) && b.get(cx, cy) {
+		runs[2]++
+		cx, cy = cx+dx, cy+dy
+	}
+	for inside(cx, cy) && !b.get(cx, cy) && runs[3] <= maxRun {
+		runs[3]++
+		cx, cy = cx+dx, cy+dy
+	}
+	end := 0
+	for inside(cx, cy) && b.get(cx, cy) && runs[4] <= maxRun {
+		runs[4]++
+		cx, cy = cx+dx, cy+dy
+	}
+	if dx != 0 {
+		end = cx
+	} else {
+		end = cy
+	}
+
+	total := runs[0] + runs[1] + runs[2] + runs[3] + runs[4]
+	if 5*abs(total-wantTotal) >= 2*wantTotal || !crossesFinder(runs) {
+		return 0, 0, false
+	}
+	return finderCenter(runs, end), total, true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// findFinders scans every row for finder patterns, confirming each column
+// and row through a candidate's center.
+func (b *bitmap) findFinders() []finderPattern {
+	var found []finderPattern
+	add := func(p finderPattern) {
+		for i := range found {
+			f := &found[i]
+			if math.Abs(f.x-p.x) <= f.module && math.Abs(f.y-p.y) <= f.module &&
+				math.Abs(f.module-p.module) <= math.Max(1, f.module/2) {
+				n := float64(f.count)
+				f.x = (f.x*n + p.x) / (n + 1)
+				f.y = (f.y*n + p.y) / (n + 1)
+				f.module = (f.module*n + p.module) / (n + 1)
+				f.count++
+				return
+			}
+		}
+		found = append(found, p)
+	}
+
+	check := func(runs [5]int, y, end int) {
+		total := runs[0] + runs[1] + runs[2] + runs[3] + runs[4]
+		cx := finderCenter(runs, end)
+		cy, _, ok := b.crossCheck(int(cx), y, 0, 1, runs[2], total)
+		if !ok {
+			return
+		}
+		cx, total, ok = b.crossCheck(int(cx), int(cy), 1, 0, runs[2], total)
+		if !ok {
+			return
+		}
+		add(finderPattern{point: point{cx, cy}, module: float64(total) / 7, count: 1})
+	}
+
+	for y := 0; y < b.h; y++ {
+		var runs [5]int
+		state := 0
+		for x := 0; x < b.w; x++ {
+			if b.get(x, y) {
+				if state%2 == 1 {
+					state++
+				}
+				runs[state]++
+				continue
+			}
+			if state%2 == 1 {
+				runs[state]++
+				continue
+			}
+			if state < 4 {
+				state++
+				runs[state]++
+				continue
+			}
+			if crossesFinder(runs) {
+				check(runs, y, x)
+			}
+			// Keep the last dark, light, dark in case they start a pattern
+			runs = [5]int{runs[2], runs[3], runs[4], 1, 0}
+			state = 3
+		}
+		if state == 4 && crossesFinder(runs) {
+			check(runs, y, b.w)
+		}
+	}
+	return found
+}
+
+// pickFinders chooses the three patterns that best form a code's corners,
+// a right isosceles triangle of patterns the same size, ordered top left,
+// top right, bottom left.
+func pickFinders(found []finderPattern) ([3]finderPattern, bool) {
+	// Patterns seen on one line only are usually noise
+	sort.Slice(found, func(i, j int) bool { return found[i].count > found[j].count })
+	if len(found) > 12 {
+		found = found[:12]
+	}
+
+	var best [3]finderPattern
+	bestScore := math.Inf(1)
+	for i := 0; i < len(found); i++ {
+		for j := i + 1; j < len(found); j++ {
+			for k := j + 1; k < len(found); k++ {
+				tri := [3]finderPattern{found[i], found[j], found[k]}
+				minModule := math.Min(tri[0].module, math.Min(tri[1].module, tri[2].module))
+				maxModule := math.Max(tri[0].module, math.Max(tri[1].module, tri[2].module))
+				if maxModule > 1.5*minModule {
+					continue
+				}
+
+				// The corner opposite the longest side is the top left
+				d01, d12, d02 := distance(tri[0].point, tri[1].point), distance(tri[1].point, tri[2].point), distance(tri[0].point, tri[2].point)
+				var tl, a, c finderPattern
+				var hyp, legA, legC float64
+				switch {
+				case d12 >= d01 && d12 >= d02:
+					tl, a, c, hyp, legA, legC = tri[0], tri[1], tri[2], d12, d01, d02
+				case d02 >= d01:
+					tl, a, c, hyp, legA, legC = tri[1], tri[0], tri[2], d02, d01, d12
+				default:
+					tl, a, c, hyp, legA, legC = tri[2], tri[0], tri[1], d01, d02, d12
+				}
+				if legA < 7*minModule || legC < 7*minModule {
+					continue
+				}
+				legs := math.Abs(legA-legC) / math.Max(legA, legC)
+				angle := math.Abs(hyp/math.Sqrt(legA*legA+legC*legC) - 1)
+				if legs > 0.5 || angle > 0.25 {
+					continue
+				}
+				if score := legs + angle + (maxModule-minModule)/maxModule; score < bestScore {
+					// Top right is clockwise from bottom left around the top
+					// left, in image coordinates where y grows down
+					if (a.x-tl.x)*(c.y-tl.y)-(a.y-tl.y)*(c.x-tl.x) < 0 {
+						a, c = c, a
+					}
+					best, bestScore = [3]finderPattern{tl, a, c}, score
+				}
+			}
+		}
+	}
+	return best, !math.IsInf(bestScore, 1)
+}
+
+// moduleSize measures the module size along the lines joining the finder
+// patterns. Those run parallel to the code's edges, unlike the scan lines
+// patterns were found on, which cross a rotated code's patterns at a slant.
+func (b *bitmap) moduleSize(f [3]finderPattern) float64 {
+	var sizes []float64
+	for _, pair := range [][2]point{
+		{f[0].point, f[1].point}, {f[1].point, f[0].point},
+		{f[0].point, f[2].point}, {f[2].point, f[0].point},
+	} {
+		from, to := pair[0], pair[1]
+		d := distance(from, to)
+		if d == 0 {
+			continue
+		}
+		dx, dy := (to.x-from.x)/d, (to.y-from.y)/d
+		toward, ok1 := b.finderRadius(from, dx, dy)
+		away, ok2 := b.finderRadius(from, -dx, -dy)
+		if ok1 && ok2 {
+			sizes = append(sizes, (toward+away)/7)
+		}
+	}
+	if len(sizes) == 0 {
+		return (f[0].module + f[1].module + f[2].module) / 3
+	}
+	total := 0.0
+	for _, s := range sizes {
+		total += s
+	}
+	return total / float64(len(sizes))
+}
+
+// finderRadius is the distance from a finder pattern's center to its outer
+// edge along (dx, dy), three and a half modules.
+func (b *bitmap) finderRadius(center point, dx, dy float64) (float64, bool) {
+	state := 0 // dark center, light ring, dark ring
+	for t := 0.0; ; t += 0.5 {
+		x, y := center.x+dx*t, center.y+dy*t
+		if x < 0 || y < 0 || x >= float64(b.w) || y >= float64(b.h) {
+			return 0, false
+		}
+		dark := b.get(int(x), int(y))
+		switch {
+		case state == 0 && !dark, state == 1 && dark:
+			state++
+		case state == 2 && !dark:
+			return t, true
+		}
+	}
+}
+
+// maxAlignmentCandidates bounds the patterns findAlignments returns; on a
+// busy code several places can look like one.
+const maxAlignmentCandidates = 3
+
+// findAlignments looks for alignment patterns, a dark module ringed by light
+// then dark, within allowance modules of the estimate, nearest first.
+func (b *bitmap) findAlignments(estimate point, module float64, allowance int) []point {
+	reach := int(float64(allowance) * module)
+	x0, x1 := max(0, int(estimate.x)-reach), min(b.w, int(estimate.x)+reach)
+	y0, y1 := max(0, int(estimate.y)-reach), min(b.h, int(estimate.y)+reach)
+	near := func(n int) bool { return math.Abs(float64(n)-module) < module/2+1 }
+
+	var found []point
+	for y := y0; y < y1; y++ {
+		// Runs are measured a little past the window so the light ones
+		// either side aren't cut short
+		start := max(0, x0-2*int(module))
+		end := min(b.w, x1+2*int(module))
+		type run struct {
+			start, n int
+			dark     bool
+		}
+		var runs []run
+		for x := start; x < end; x++ {
+			d := b.get(x, y)
+			if len(runs) > 0 && runs[len(runs)-1].dark == d {
+				runs[len(runs)-1].n++
+			} else {
+				runs = append(runs, run{x, 1, d})
+			}
+		}
+		for i := 1; i+1 < len(runs); i++ {
+			r := runs[i]
+			if !r.dark || !near(r.n) || !near(runs[i-1].n) || !near(runs[i+1].n) {
+				continue
+			}
+			cx := float64(r.start) + float64(r.n)/2
+			if cx < float64(x0) || cx >= float64(x1) {
+				continue
+			}
+			cy, ok := b.crossCheckAlignment(int(cx), y, module)
+			if !ok {
+				continue
+			}
+			p := point{cx, cy}
+			// Rows through the same pattern find it again
+			seen := false
+			for _, q := range found {
+				if distance(p, q) < module {
+					seen = true
+					break
+				}
+			}
+			if !seen {
+				found = append(found, p)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return distance(found[i], estimate) < distance(found[j], estimate)
+	})
+	if len(found) > maxAlignmentCandidates {
+		found = found[:maxAlignmentCandidates]
+	}
+	return found
+}
+
+// crossCheckAlignment confirms the column through (x, y) crosses light,
+// dark, light runs of about a module and returns their center.
+func (b *bitmap) crossCheckAlignment(x, y int, module float64) (float64, bool) {
+	limit := int(2 * module)
+	up, down := 0, 0
+	for b.get(x, y-up-1) && up <= limit {
+		up++
+	}
+	for b.get(x, y+down+1) && down <= limit {
+		down++
+	}
+	dark := up + down + 1
+	top, bottom := y-up-1, y+down+1
+	lightUp, lightDown := 0, 0
+	for top-lightUp >= 0 && !b.get(x, top-lightUp) && lightUp <= limit {
+		lightUp++
+	}
+	for bottom+lightDown < b.h && !b.get(x, bottom+lightDown) && lightDown <= limit {
+		lightDown++
+	}
+	near := func(n int) bool { return math.Abs(float64(n)-module) < module/2+1 }
+	if !near(dark) || !near(lightUp) || !near(lightDown) {
+		return 0, false
+	}
+	return float64(top+1) + float64(dark)/2, true
+}
+
+// homography maps points of one plane onto another, for sampling a code
+// photographed at an angle.
+type homography [8]float64
+
+// newHomography maps each of from onto the matching point of to.
+func newHomography(from, to [4]point) (homography, bool) {
+	var m [8][9]float64
+	for i := 0; i < 4; i++ {
+		u, v, x, y := from[i].x, from[i].y, to[i].x, to[i].y
+		m[2*i] = [9]float64{u, v, 1, 0, 0, 0, -u * x, -v * x, x}
+		m[2*i+1] = [9]float64{0, 0, 0, u, v, 1, -u * y, -v * y, y}
+	}
+	// Gaussian elimination with partial pivoting
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return homography{}, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			f := m[row][col] / m[col][col]
+			for k := col; k < 9; k++ {
+				m[row][k] -= f * m[col][k]
+			}
+		}
+	}
+	var h homography
+	for i := range h {
+		h[i] = m[i][8] / m[i][i]
+	}
+	return h, true
+}
+
+func (h homography) apply(p point) point {
+	d := h[6]*p.x + h[7]*p.y + 1
+	return point{(h[0]*p.x + h[1]*p.y + h[2]) / d, (h[3]*p.x + h[4]*p.y + h[5]) / d}
+}
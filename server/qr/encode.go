@@ -0,0 +1,109 @@
+package qr
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// QuietZone is the blank margin the spec asks for around a code, in
+// modules.
+const QuietZone = 4
+
+// Code is an encoded QR code: the smallest version that holds the content
+// at Level, and its modules without the quiet zone.
+type Code struct {
+	Content string
+	Version int
+	Level   ECLevel
+	Modules [][]bool // [y][x], true is dark
+}
+
+var recoveryLevels = map[ECLevel]qrcode.RecoveryLevel{
+	ECLow:      qrcode.Low,
+	ECMedium:   qrcode.Medium,
+	ECQuartile: qrcode.High, // the library names levels by recovery, Q is its High
+	ECHigh:     qrcode.Highest,
+}
+
+// Encode encodes content at level, choosing the smallest version that fits.
+func Encode(content string, level ECLevel) (*Code, error) {
+	rl, ok := recoveryLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("qr: unknown error correction level %q", level)
+	}
+	q, err := qrcode.New(content, rl)
+	if err != nil {
+		return nil, fmt.Errorf("qr: %w", err)
+	}
+	q.DisableBorder = true
+
+	return &Code{
+		Content: content,
+		Version: q.VersionNumber,
+		Level:   level,
+		Modules: q.Bitmap(),
+	}, nil
+}
+
+// Size is the width of the code in modules, not counting the quiet zone.
+func (c *Code) Size() int {
+	return len(c.Modules)
+}
+
+// Image draws the code size pixels square with quietZone modules of margin.
+// Modules are whole pixels so edges stay sharp; any leftover space is added
+// to the margin. size is raised if it is too small for one pixel a module.
+func (c *Code) Image(size, quietZone int, fg, bg color.Color) image.Image {
+	total := c.Size() + 2*quietZone
+	if size < total {
+		size = total
+	}
+	scale := size / total
+	offset := (size - c.Size()*scale) / 2
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{bg, fg})
+	for y, row := range c.Modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				start := img.PixOffset(offset+x*scale, offset+y*scale+py)
+				for px := 0; px < scale; px++ {
+					img.Pix[start+px] = 1
+				}
+			}
+		}
+	}
+	return img
+}
+
+// SVG draws the code as a single path in a viewBox measured in modules, so
+// it scales to any size. Colors are CSS colors.
+func (c *Code) SVG(quietZone int, fg, bg string) string {
+	total := c.Size() + 2*quietZone
+
+	var path strings.Builder
+	for y, row := range c.Modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			// Runs of dark modules become one rectangle
+			run := 1
+			for x+run < len(row) && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", x+quietZone, y+quietZone, run, run)
+			x += run - 1
+		}
+	}
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="%s"/><path d="%s" fill="%s"/></svg>`,
+		total, total, bg, path.String(), fg)
+}
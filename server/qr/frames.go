@@ -0,0 +1,389 @@
+package qr
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Frame templates drawn around a code.
+const (
+	FrameNone   = "none"
+	FrameBorder = "border" // rounded outline, caption under the code
+	FrameBanner = "banner" // solid frame with the caption in a band below
+	FrameArrow  = "arrow"  // caption above an arrow pointing at the code
+)
+
+var (
+	FrameTemplates = []string{FrameNone, FrameBorder, FrameBanner, FrameArrow}
+	FrameFonts     = map[string][]byte{
+		"sans":      goregular.TTF,
+		"sans-bold": gobold.TTF,
+		"mono":      gomono.TTF,
+	}
+)
+
+const maxCaptionLength = 40
+
+// FrameStyle is the frame part of a QR style: which template, the caption
+// and its font, and colors as hex. It is stored as JSON with the rest of a
+// style so every output format draws the same frame.
+type FrameStyle struct {
+	Template   string `json:"template"`
+	Text       string `json:"text,omitempty"`
+	Font       string `json:"font,omitempty"`
+	TextColor  string `json:"text_color,omitempty"`
+	FrameColor string `json:"frame_color,omitempty"`
+	Background string `json:"background,omitempty"`
+}
+
+// withDefaults fills in the caption and colors a template needs.
+func (s FrameStyle) withDefaults() FrameStyle {
+	if s.Template == "" {
+		s.Template = FrameNone
+	}
+	if s.Text == "" && s.Template != FrameNone {
+		s.Text = "Scan me"
+	}
+	if s.Font == "" {
+		s.Font = "sans-bold"
+	}
+	if s.FrameColor == "" {
+		s.FrameColor = "#000000"
+	}
+	if s.Background == "" {
+		s.Background = "#ffffff"
+	}
+	if s.TextColor == "" {
+		if s.Template == FrameBanner {
+			s.TextColor = s.Background
+		} else {
+			s.TextColor = s.FrameColor
+		}
+	}
+	return s
+}
+
+// Validate checks the template, font and colors, and that the caption is
+// legible against what it is drawn on.
+func (s FrameStyle) Validate() error {
+	s = s.withDefaults()
+
+	known := false
+	for _, t := range FrameTemplates {
+		known = known || t == s.Template
+	}
+	if !known {
+		return fmt.Errorf("qr: unknown frame template %q", s.Template)
+	}
+	if _, ok := FrameFonts[s.Font]; !ok {
+		return fmt.Errorf("qr: unknown frame font %q", s.Font)
+	}
+	if len([]rune(s.Text)) > maxCaptionLength {
+		return fmt.Errorf("qr: frame caption is longer than %d characters", maxCaptionLength)
+	}
+
+	colors, err := s.colors()
+	if err != nil {
+		return err
+	}
+	captionOn := colors.background
+	if s.Template == FrameBanner {
+		captionOn = colors.frame
+	}
+	if s.Template != FrameNone && ContrastRatio(colors.text, captionOn) < MinContrast {
+		return fmt.Errorf("qr: frame caption needs a contrast ratio of at least %.1f:1 with what it is drawn on", MinContrast)
+	}
+	return nil
+}
+
+type frameColors struct {
+	text, frame, background color.RGBA
+}
+
+func (s FrameStyle) colors() (frameColors, error) {
+	var c frameColors
+	var err error
+	if c.text, err = ParseHexColor(s.TextColor); err != nil {
+		return c, err
+	}
+	if c.frame, err = ParseHexColor(s.FrameColor); err != nil {
+		return c, err
+	}
+	if c.background, err = ParseHexColor(s.Background); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// frameLayout is where things go in a framed image, in units of the code's
+// width so raster and vector output agree.
+type frameLayout struct {
+	width, height  float64
+	codeX, codeY   float64
+	caption        [4]float64 // x, y, width, height
+	stroke, radius float64
+	arrow          [3][2]float64
+	banner         bool
+	border         bool
+	hasArrow       bool
+}
+
+func layoutFrame(template string) frameLayout {
+	const pad, captionH, stroke, arrowH = 0.08, 0.2, 0.03, 0.1
+
+	switch template {
+	case FrameBorder:
+		return frameLayout{
+			width: 1 + 2*pad, height: 1 + 2*pad + captionH,
+			codeX: pad, codeY: pad,
+			caption: [4]float64{pad, 1 + pad, 1, captionH},
+			stroke:  stroke, radius: pad, border: true,
+		}
+	case FrameBanner:
+		return frameLayout{
+			width: 1 + 2*pad, height: 1 + 2*pad + captionH,
+			codeX: pad, codeY: pad,
+			caption: [4]float64{pad, 1 + 1.5*pad, 1, captionH - pad/2},
+			stroke:  stroke, radius: pad, banner: true,
+		}
+	case FrameArrow:
+		top := captionH + arrowH
+		return frameLayout{
+			width: 1 + 2*pad, height: 1 + 2*pad + top,
+			codeX: pad, codeY: pad + top,
+			caption: [4]float64{pad, pad / 2, 1, captionH},
+			arrow: [3][2]float64{
+				{0.5 + pad - arrowH, pad/2 + captionH},
+				{0.5 + pad + arrowH, pad/2 + captionH},
+				{0.5 + pad, pad + top - pad/4},
+			},
+			hasArrow: true,
+		}
+	default:
+		return frameLayout{width: 1, height: 1}
+	}
+}
+
+// DrawFrame composites code into a frame described by style and returns the
+// framed image. The code is drawn at its original size.
+func DrawFrame(code image.Image, style FrameStyle) (image.Image, error) {
+	if err := style.Validate(); err != nil {
+		return nil, err
+	}
+	style = style.withDefaults()
+	if style.Template == FrameNone {
+		return code, nil
+	}
+
+	colors, _ := style.colors()
+	l := layoutFrame(style.Template)
+	unit := float64(code.Bounds().Dx())
+	px := func(v float64) int { return int(math.Round(v * unit)) }
+
+	dst := image.NewRGBA(image.Rect(0, 0, px(l.width), px(l.height)))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(colors.background), image.Point{}, draw.Src)
+
+	w, h := float64(dst.Bounds().Dx()), float64(dst.Bounds().Dy())
+	r := l.radius * unit
+	switch {
+	case l.banner:
+		fillRoundedRect(dst, 0, 0, w, h, r, colors.frame)
+		// The code sits on a background-colored panel inside the frame
+		inset := l.stroke * unit
+		fillRoundedRect(dst, inset, inset, w-inset, l.caption[1]*unit-inset/2, r-inset, colors.background)
+	case l.border:
+		fillRoundedRect(dst, 0, 0, w, h, r, colors.frame)
+		inset := l.stroke * unit
+		fillRoundedRect(dst, inset, inset, w-inset, h-inset, r-inset, colors.background)
+	}
+	if l.hasArrow {
+		var pts [3][2]float64
+		for i, p := range l.arrow {
+			pts[i] = [2]float64{p[0] * unit, p[1] * unit}
+		}
+		fillTriangle(dst, pts, colors.frame)
+	}
+
+	draw.Draw(dst, code.Bounds().Sub(code.Bounds().Min).Add(image.Pt(px(l.codeX), px(l.codeY))), code, code.Bounds().Min, draw.Src)
+
+	if style.Text != "" {
+		c := l.caption
+		if err := drawCaption(dst, style.Text, style.Font, colors.text,
+			c[0]*unit, c[1]*unit, c[2]*unit, c[3]*unit); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+func fillRoundedRect(dst *image.RGBA, x0, y0, x1, y1, r float64, c color.RGBA) {
+	inside := func(x, y float64) bool {
+		cx := math.Max(x0+r, math.Min(x, x1-r))
+		cy := math.Max(y0+r, math.Min(y, y1-r))
+		return x >= x0 && x <= x1 && y >= y0 && y <= y1 && (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r
+	}
+	fillShape(dst, image.Rect(int(x0), int(y0), int(math.Ceil(x1)), int(math.Ceil(y1))), inside, c)
+}
+
+func fillTriangle(dst *image.RGBA, p [3][2]float64, c color.RGBA) {
+	sign := func(ax, ay, bx, by, cx, cy float64) float64 {
+		return (ax-cx)*(by-cy) - (bx-cx)*(ay-cy)
+	}
+	inside := func(x, y float64) bool {
+		d1 := sign(x, y, p[0][0], p[0][1], p[1][0], p[1][1])
+		d2 := sign(x, y, p[1][0], p[1][1], p[2][0], p[2][1])
+		d3 := sign(x, y, p[2][0], p[2][1], p[0][0], p[0][1])
+		neg := d1 < 0 || d2 < 0 || d3 < 0
+		pos := d1 > 0 || d2 > 0 || d3 > 0
+		return !(neg && pos)
+	}
+	minX := math.Min(p[0][0], math.Min(p[1][0], p[2][0]))
+	maxX := math.Max(p[0][0], math.Max(p[1][0], p[2][0]))
+	minY := math.Min(p[0][1], math.Min(p[1][1], p[2][1]))
+	maxY := math.Max(p[0][1], math.Max(p[1][1], p[2][1]))
+	fillShape(dst, image.Rect(int(minX), int(minY), int(math.Ceil(maxX)), int(math.Ceil(maxY))), inside, c)
+}
+
+// fillShape blends c into every pixel of bounds in proportion to how much
+// of it inside covers, sampled 4x4 for anti-aliased edges.
+func fillShape(dst *image.RGBA, bounds image.Rectangle, inside func(x, y float64) bool, c color.RGBA) {
+	shadeShape(dst, bounds, inside, func(x, y int) color.RGBA { return c })
+}
+
+// shadeShape is fillShape with a color for each pixel, for gradients.
+func shadeShape(dst *image.RGBA, bounds image.Rectangle, inside func(x, y float64) bool, shade func(x, y int) color.RGBA) {
+	const samples = 4
+	bounds = bounds.Intersect(dst.Bounds())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			hits := 0
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					if inside(float64(x)+(float64(sx)+0.5)/samples, float64(y)+(float64(sy)+0.5)/samples) {
+						hits++
+					}
+				}
+			}
+			if hits == 0 {
+				continue
+			}
+			a := float64(hits) / (samples * samples)
+			c := shade(x, y)
+			bg := dst.RGBAAt(x, y)
+			blend := func(f, b uint8) uint8 { return uint8(math.Round(float64(f)*a + float64(b)*(1-a))) }
+			dst.SetRGBA(x, y, color.RGBA{R: blend(c.R, bg.R), G: blend(c.G, bg.G), B: blend(c.B, bg.B), A: 0xff})
+		}
+	}
+}
+
+var (
+	parsedFontsMu sync.Mutex
+	parsedFonts   = map[string]*opentype.Font{}
+)
+
+func parseFont(name string) (*opentype.Font, error) {
+	parsedFontsMu.Lock()
+	defer parsedFontsMu.Unlock()
+
+	if f, ok := parsedFonts[name]; ok {
+		return f, nil
+	}
+	f, err := opentype.Parse(FrameFonts[name])
+	if err != nil {
+		return nil, err
+	}
+	parsedFonts[name] = f
+	return f, nil
+}
+
+// drawCaption centres text in the box, shrinking the font until it fits.
+func drawCaption(dst *image.RGBA, text, fontName string, c color.RGBA, x, y, w, h float64) error {
+	f, err := parseFont(fontName)
+	if err != nil {
+		return err
+	}
+
+	for size := h * 0.6; size >= 6; size *= 0.9 {
+		face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return err
+		}
+
+		d := &font.Drawer{Dst: dst, Src: image.NewUniform(c), Face: face}
+		width := float64(d.MeasureString(text)) / 64
+		if width > w && size*0.9 >= 6 {
+			face.Close()
+			continue
+		}
+
+		m := face.Metrics()
+		textH := float64(m.Ascent+m.Descent) / 64
+		d.Dot = fixed.P(int(x+(w-width)/2), int(y+(h-textH)/2+float64(m.Ascent)/64))
+		d.DrawString(text)
+		face.Close()
+		return nil
+	}
+	return nil
+}
+
+// FrameSVG wraps an SVG rendering of a code, size units square, in the
+// frame described by style, matching DrawFrame's layout.
+func FrameSVG(codeSVG string, size float64, style FrameStyle) (string, error) {
+	if err := style.Validate(); err != nil {
+		return "", err
+	}
+	style = style.withDefaults()
+	if style.Template == FrameNone {
+		return codeSVG, nil
+	}
+
+	l := layoutFrame(style.Template)
+	u := func(v float64) string { return fmt.Sprintf("%.2f", v*size) }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %s %s" width="%s" height="%s">`,
+		u(l.width), u(l.height), u(l.width), u(l.height))
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`, style.Background)
+
+	switch {
+	case l.banner:
+		fmt.Fprintf(&b, `<rect width="%s" height="%s" rx="%s" fill="%s"/>`, u(l.width), u(l.height), u(l.radius), style.FrameColor)
+		fmt.Fprintf(&b, `<rect x="%s" y="%s" width="%s" height="%s" rx="%s" fill="%s"/>`,
+			u(l.stroke), u(l.stroke), u(l.width-2*l.stroke), u(l.caption[1]-1.5*l.stroke), u(l.radius-l.stroke), style.Background)
+	case l.border:
+		half := l.stroke / 2
+		fmt.Fprintf(&b, `<rect x="%s" y="%s" width="%s" height="%s" rx="%s" fill="none" stroke="%s" stroke-width="%s"/>`,
+			u(half), u(half), u(l.width-l.stroke), u(l.height-l.stroke), u(l.radius-half), style.FrameColor, u(l.stroke))
+	}
+	if l.hasArrow {
+		fmt.Fprintf(&b, `<polygon points="%s,%s %s,%s %s,%s" fill="%s"/>`,
+			u(l.arrow[0][0]), u(l.arrow[0][1]), u(l.arrow[1][0]), u(l.arrow[1][1]), u(l.arrow[2][0]), u(l.arrow[2][1]), style.FrameColor)
+	}
+
+	fmt.Fprintf(&b, `<svg x="%s" y="%s" width="%s" height="%s">%s</svg>`, u(l.codeX), u(l.codeY), u(1), u(1), codeSVG)
+
+	if style.Text != "" {
+		family := map[string]string{"sans": "sans-serif", "sans-bold": "sans-serif", "mono": "monospace"}[style.Font]
+		weight := map[bool]string{true: "bold", false: "normal"}[style.Font == "sans-bold"]
+		c := l.caption
+		fmt.Fprintf(&b, `<text x="%s" y="%s" font-family="%s" font-weight="%s" font-size="%s" fill="%s" text-anchor="middle" dominant-baseline="central" textLength="%s" lengthAdjust="spacingAndGlyphs">%s</text>`,
+			u(c[0]+c[2]/2), u(c[1]+c[3]/2), family, weight, u(c[3]*0.6), style.TextColor,
+			u(math.Min(c[2], c[3]*0.33*float64(len([]rune(style.Text))))), html.EscapeString(style.Text))
+	}
+
+	b.WriteString(`</svg>`)
+	return b.String(), nil
+}
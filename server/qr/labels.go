@@ -0,0 +1,198 @@
+// Package qr builds QR code payloads and lays them out for printing.
+package qr
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const inch = 25.4 // millimetres
+
+// LabelTemplate describes a sheet of commercial label stock. All dimensions
+// are in millimetres, measured from the top-left corner of the page.
+type LabelTemplate struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	PageWidth   float64 `json:"page_width_mm"`
+	PageHeight  float64 `json:"page_height_mm"`
+	Columns     int     `json:"columns"`
+	Rows        int     `json:"rows"`
+	LabelWidth  float64 `json:"label_width_mm"`
+	LabelHeight float64 `json:"label_height_mm"`
+	MarginTop   float64 `json:"margin_top_mm"`
+	MarginLeft  float64 `json:"margin_left_mm"`
+	// Distance between the left (top) edges of neighbouring labels.
+	PitchX float64 `json:"pitch_x_mm"`
+	PitchY float64 `json:"pitch_y_mm"`
+}
+
+// PerSheet is the number of labels on one sheet.
+func (t LabelTemplate) PerSheet() int {
+	return t.Columns * t.Rows
+}
+
+// LabelTemplates are the supported label sheets, by name. Dimensions come
+// from the manufacturers' published templates.
+var LabelTemplates = map[string]LabelTemplate{
+	"avery-5160": {
+		Name:        "avery-5160",
+		Description: "Avery 5160 address labels, 1\" x 2-5/8\", 30 per US Letter sheet",
+		PageWidth:   8.5 * inch, PageHeight: 11 * inch,
+		Columns: 3, Rows: 10,
+		LabelWidth: 2.625 * inch, LabelHeight: 1 * inch,
+		MarginTop: 0.5 * inch, MarginLeft: 0.1875 * inch,
+		PitchX: 2.75 * inch, PitchY: 1 * inch,
+	},
+	"avery-5163": {
+		Name:        "avery-5163",
+		Description: "Avery 5163 shipping labels, 2\" x 4\", 10 per US Letter sheet",
+		PageWidth:   8.5 * inch, PageHeight: 11 * inch,
+		Columns: 2, Rows: 5,
+		LabelWidth: 4 * inch, LabelHeight: 2 * inch,
+		MarginTop: 0.5 * inch, MarginLeft: 0.15625 * inch,
+		PitchX: 4.1875 * inch, PitchY: 2 * inch,
+	},
+	"a4-l7160": {
+		Name:        "a4-l7160",
+		Description: "A4 label stock (Avery L7160), 63.5 x 38.1 mm, 21 per sheet",
+		PageWidth:   210, PageHeight: 297,
+		Columns: 3, Rows: 7,
+		LabelWidth: 63.5, LabelHeight: 38.1,
+		MarginTop: 15.15, MarginLeft: 7.25,
+		PitchX: 66.04, PitchY: 38.1,
+	},
+	"a4-l7163": {
+		Name:        "a4-l7163",
+		Description: "A4 label stock (Avery L7163), 99.1 x 38.1 mm, 14 per sheet",
+		PageWidth:   210, PageHeight: 297,
+		Columns: 2, Rows: 7,
+		LabelWidth: 99.1, LabelHeight: 38.1,
+		MarginTop: 15.15, MarginLeft: 4.65,
+		PitchX: 101.6, PitchY: 38.1,
+	},
+	"a4-l7651": {
+		Name:        "a4-l7651",
+		Description: "A4 label stock (Avery L7651), 38.1 x 21.2 mm, 65 per sheet",
+		PageWidth:   210, PageHeight: 297,
+		Columns: 5, Rows: 13,
+		LabelWidth: 38.1, LabelHeight: 21.2,
+		MarginTop: 10.7, MarginLeft: 4.75,
+		PitchX: 40.64, PitchY: 21.2,
+	},
+}
+
+// SortedLabelTemplates returns the templates ordered by name.
+func SortedLabelTemplates() []LabelTemplate {
+	templates := make([]LabelTemplate, 0, len(LabelTemplates))
+	for _, t := range LabelTemplates {
+		templates = append(templates, t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates
+}
+
+// Rect is a rectangle in millimetres from the top-left corner of the page.
+type Rect struct {
+	X      float64 `json:"x_mm"`
+	Y      float64 `json:"y_mm"`
+	Width  float64 `json:"width_mm"`
+	Height float64 `json:"height_mm"`
+}
+
+// rounded trims floating point noise to a hundredth of a millimetre, well
+// below any printer's precision.
+func (r Rect) rounded() Rect {
+	round := func(v float64) float64 { return math.Round(v*100) / 100 }
+	return Rect{X: round(r.X), Y: round(r.Y), Width: round(r.Width), Height: round(r.Height)}
+}
+
+// Placement is where one QR code and its caption go on a sheet.
+type Placement struct {
+	Index   int  `json:"index"` // position in the input, 0-based
+	Sheet   int  `json:"sheet"` // 0-based
+	Column  int  `json:"column"`
+	Row     int  `json:"row"`
+	Label   Rect `json:"label"`
+	Code    Rect `json:"code"`
+	Caption Rect `json:"caption"`
+}
+
+// LayoutOptions control how codes are placed within each label.
+type LayoutOptions struct {
+	// Skip leaves the first labels of the first sheet empty, for reusing a
+	// partly used sheet.
+	Skip int
+	// Padding inside each label edge, in millimetres. Defaults to 2.
+	Padding float64
+	// CaptionSize reserves room for a caption beside the code on wide
+	// labels, or below it on tall ones, in millimetres. Zero means no caption.
+	CaptionSize float64
+}
+
+// Layout places count codes on sheets of the template, filling rows left to
+// right, top to bottom. Each code is square and as large as fits its label
+// after padding and caption space.
+func Layout(t LabelTemplate, count int, opts LayoutOptions) ([]Placement, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("qr: negative label count")
+	}
+	if opts.Skip < 0 || opts.Skip >= t.PerSheet() {
+		return nil, fmt.Errorf("qr: skip must be between 0 and %d", t.PerSheet()-1)
+	}
+	if opts.Padding <= 0 {
+		opts.Padding = 2
+	}
+
+	innerW := t.LabelWidth - 2*opts.Padding
+	innerH := t.LabelHeight - 2*opts.Padding
+	wide := innerW >= innerH
+
+	// The caption goes along the label's long side
+	codeSize := math.Min(innerW, innerH)
+	if opts.CaptionSize > 0 {
+		if wide {
+			codeSize = math.Min(innerH, innerW-opts.CaptionSize-opts.Padding)
+		} else {
+			codeSize = math.Min(innerW, innerH-opts.CaptionSize-opts.Padding)
+		}
+	}
+	if codeSize <= 0 {
+		return nil, fmt.Errorf("qr: caption leaves no room for the code on %s labels", t.Name)
+	}
+
+	placements := make([]Placement, 0, count)
+	for i := 0; i < count; i++ {
+		slot := i + opts.Skip
+		sheet, pos := slot/t.PerSheet(), slot%t.PerSheet()
+		col, row := pos%t.Columns, pos/t.Columns
+
+		label := Rect{
+			X:      t.MarginLeft + float64(col)*t.PitchX,
+			Y:      t.MarginTop + float64(row)*t.PitchY,
+			Width:  t.LabelWidth,
+			Height: t.LabelHeight,
+		}
+		p := Placement{Index: i, Sheet: sheet, Column: col, Row: row, Label: label}
+
+		inner := Rect{X: label.X + opts.Padding, Y: label.Y + opts.Padding, Width: innerW, Height: innerH}
+		switch {
+		case opts.CaptionSize > 0 && wide:
+			// Code on the left, vertically centred; caption fills the rest
+			p.Code = Rect{X: inner.X, Y: inner.Y + (innerH-codeSize)/2, Width: codeSize, Height: codeSize}
+			captionX := inner.X + codeSize + opts.Padding
+			p.Caption = Rect{X: captionX, Y: inner.Y, Width: inner.X + innerW - captionX, Height: innerH}
+		case opts.CaptionSize > 0:
+			// Code on top, horizontally centred; caption below
+			p.Code = Rect{X: inner.X + (innerW-codeSize)/2, Y: inner.Y, Width: codeSize, Height: codeSize}
+			captionY := inner.Y + codeSize + opts.Padding
+			p.Caption = Rect{X: inner.X, Y: captionY, Width: innerW, Height: inner.Y + innerH - captionY}
+		default:
+			p.Code = Rect{X: inner.X + (innerW-codeSize)/2, Y: inner.Y + (innerH-codeSize)/2, Width: codeSize, Height: codeSize}
+		}
+
+		p.Label, p.Code, p.Caption = p.Label.rounded(), p.Code.rounded(), p.Caption.rounded()
+		placements = append(placements, p)
+	}
+	return placements, nil
+}
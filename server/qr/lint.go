@@ -0,0 +1,189 @@
+package qr
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Warning severities. Errors mean the code cannot be generated as asked or
+// will very likely fail to scan; warnings are worth fixing.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+const (
+	defaultQuietZone = 4 // modules, as the standard requires
+
+	// Module sizes below these are unreliable with phone cameras.
+	minModuleMM         = 0.3
+	recommendedModuleMM = 0.5
+
+	denseVersion = 15 // codes this large are slow to scan from a distance
+	longURL      = 300
+)
+
+// Warning is one problem found with a QR payload or its print settings.
+type Warning struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// LintOptions describe how the code will be generated and printed.
+type LintOptions struct {
+	ECLevel ECLevel
+	// Version forces a code version; zero picks the smallest that fits.
+	Version int
+	// PrintSizeMM is the printed width of the code including its quiet
+	// zone. Zero skips the print size checks.
+	PrintSizeMM float64
+	// QuietZone in modules; defaults to 4.
+	QuietZone int
+	// Foreground and Background colors as hex; contrast is checked when
+	// either is set, with the other defaulting to black or white.
+	Foreground string
+	Background string
+}
+
+// LintResult is the outcome of Lint: the code the payload needs and any
+// warnings.
+type LintResult struct {
+	Version      int             `json:"version,omitempty"`
+	Modules      int             `json:"modules,omitempty"`
+	ModuleSizeMM float64         `json:"module_size_mm,omitempty"`
+	Contrast     *ContrastResult `json:"contrast,omitempty"`
+	Warnings     []Warning       `json:"warnings"`
+}
+
+// HasErrors reports whether any warning is an error.
+func (r LintResult) HasErrors() bool {
+	for _, w := range r.Warnings {
+		if w.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *LintResult) add(severity, code, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, Warning{Code: code, Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// Lint checks a payload will fit and scan: that it fits the version and
+// error correction level, that URLs are well formed and use https, that
+// modules are large enough at the printed size, and that custom colors have
+// enough contrast.
+func Lint(payload string, opts LintOptions) LintResult {
+	result := LintResult{Warnings: []Warning{}}
+	if opts.ECLevel == "" {
+		opts.ECLevel = ECMedium
+	}
+	if opts.QuietZone <= 0 {
+		opts.QuietZone = defaultQuietZone
+	}
+
+	if opts.Foreground != "" || opts.Background != "" {
+		lintColors(&result, opts.Foreground, opts.Background)
+	}
+
+	if payload == "" {
+		result.add(SeverityError, "empty_payload", "The QR content is empty.")
+		return result
+	}
+	if strings.TrimSpace(payload) != payload {
+		result.add(SeverityWarning, "surrounding_whitespace", "The content starts or ends with whitespace, which some scanners keep.")
+	}
+
+	lintURL(&result, strings.TrimSpace(payload))
+
+	version, ok := VersionFor(len(payload), opts.ECLevel)
+	if !ok {
+		result.add(SeverityError, "payload_too_long",
+			"The content is %d bytes; the largest code holds %d at error correction level %s. Shorten it or use a short link.",
+			len(payload), Capacity(MaxVersion, opts.ECLevel), opts.ECLevel)
+		return result
+	}
+	if opts.Version != 0 {
+		if opts.Version < MinVersion || opts.Version > MaxVersion {
+			result.add(SeverityError, "invalid_version", "Version must be between %d and %d.", MinVersion, MaxVersion)
+			return result
+		}
+		if opts.Version < version {
+			result.add(SeverityError, "exceeds_version",
+				"The content needs version %d at level %s, but version %d holds only %d bytes.",
+				version, opts.ECLevel, opts.Version, Capacity(opts.Version, opts.ECLevel))
+			return result
+		}
+		version = opts.Version
+	}
+
+	result.Version = version
+	result.Modules = Modules(version)
+
+	if version >= denseVersion {
+		result.add(SeverityWarning, "dense_code",
+			"The code needs version %d (%d modules across), which is slow to scan. Shorten the content or lower the error correction level.",
+			version, result.Modules)
+	}
+
+	if opts.PrintSizeMM > 0 {
+		moduleMM := opts.PrintSizeMM / float64(result.Modules+2*opts.QuietZone)
+		result.ModuleSizeMM = math.Round(moduleMM*1000) / 1000
+
+		switch {
+		case moduleMM < minModuleMM:
+			result.add(SeverityError, "modules_too_small",
+				"At %.0f mm each module is %.2f mm, too small for phone cameras. Print at least %.0f mm wide.",
+				opts.PrintSizeMM, moduleMM, minPrintSize(result.Modules, opts.QuietZone, minModuleMM))
+		case moduleMM < recommendedModuleMM:
+			result.add(SeverityWarning, "small_modules",
+				"At %.0f mm each module is %.2f mm, which may be hard to scan. %.0f mm or wider is recommended.",
+				opts.PrintSizeMM, moduleMM, minPrintSize(result.Modules, opts.QuietZone, recommendedModuleMM))
+		}
+	}
+
+	return result
+}
+
+func minPrintSize(modules, quietZone int, moduleMM float64) float64 {
+	return math.Ceil(float64(modules+2*quietZone) * moduleMM)
+}
+
+func lintColors(result *LintResult, foreground, background string) {
+	if foreground == "" {
+		foreground = "#000000"
+	}
+	if background == "" {
+		background = "#ffffff"
+	}
+
+	contrast, err := CheckContrast(result, foreground, background)
+	if err != nil {
+		result.add(SeverityError, "invalid_color", "Colors must be hex, like #1a2b3c.")
+		return
+	}
+	result.Contrast = &contrast
+}
+
+func lintURL(result *LintResult, payload string) {
+	lower := strings.ToLower(payload)
+	switch {
+	case strings.HasPrefix(lower, "http://"):
+		result.add(SeverityWarning, "insecure_url", "The URL uses http. Use https so scanners don't warn and the link can't be tampered with.")
+	case strings.HasPrefix(lower, "https://"):
+	case strings.HasPrefix(lower, "www."):
+		result.add(SeverityWarning, "missing_scheme", "The URL has no https:// prefix, so some scanners show it as plain text.")
+	default:
+		return
+	}
+
+	if strings.IndexFunc(payload, unicode.IsSpace) >= 0 {
+		result.add(SeverityWarning, "url_whitespace", "The URL contains whitespace; encode spaces as %%20.")
+	}
+	if len(payload) > longURL {
+		result.add(SeverityWarning, "long_url", "The URL is %d characters. A short or dynamic link makes a smaller, easier to scan code.", len(payload))
+	}
+}
@@ -0,0 +1,75 @@
+package qr
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Logo sizes, as a fraction of the code's width. At MaxLogoScale the logo
+// hides under a tenth of the modules, well within what LogoLevel recovers,
+// and stays clear of the finder patterns.
+const (
+	DefaultLogoScale = 0.2
+	MinLogoScale     = 0.1
+	MaxLogoScale     = 0.3
+)
+
+// LogoLevel is the error correction level for codes with a logo, whose
+// hidden modules are read back like damage.
+const LogoLevel = ECHigh
+
+// EmbedLogo draws logo over the middle of img, a rendering of the code in
+// style s, fitted into a square scale times the code's width. The square is
+// cleared to the background on whole modules first, so none are left half
+// covered for a scanner to misread.
+func (c *Code) EmbedLogo(img image.Image, s Style, logo image.Image, scale float64) (image.Image, error) {
+	if scale < MinLogoScale || scale > MaxLogoScale {
+		return nil, fmt.Errorf("qr: logo scale must be between %.1f and %.1f", MinLogoScale, MaxLogoScale)
+	}
+	s = s.withDefaults()
+	colors, err := s.colors()
+	if err != nil {
+		return nil, err
+	}
+
+	size := img.Bounds().Dx()
+	n := c.Size()
+	unit := size / (n + 2*s.Margin())
+	offset := (size - n*unit) / 2
+
+	// An odd code needs an odd number of modules cleared to stay centered
+	cover := int(scale * float64(n))
+	if cover%2 != n%2 {
+		cover--
+	}
+	if cover < 1 || unit < 1 {
+		return img, nil
+	}
+	start := offset + (n-cover)/2*unit
+	box := image.Rect(start, start, start+cover*unit, start+cover*unit)
+
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	draw.Draw(dst, box, image.NewUniform(colors.bg), image.Point{}, draw.Src)
+
+	// Half a module of background around the logo keeps it apart from the
+	// modules beside it
+	inner := box.Inset(unit / 2)
+	lb := logo.Bounds()
+	if inner.Empty() || lb.Empty() {
+		return dst, nil
+	}
+	w, h := inner.Dx(), inner.Dy()
+	if lb.Dx() >= lb.Dy() {
+		h = max(1, lb.Dy()*w/lb.Dx())
+	} else {
+		w = max(1, lb.Dx()*h/lb.Dy())
+	}
+	x0 := inner.Min.X + (inner.Dx()-w)/2
+	y0 := inner.Min.Y + (inner.Dy()-h)/2
+	xdraw.CatmullRom.Scale(dst, image.Rect(x0, y0, x0+w, y0+h), logo, lb, xdraw.Over, nil)
+	return dst, nil
+}
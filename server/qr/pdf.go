@@ -0,0 +1,318 @@
+package qr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+const pointsPerMM = 72 / inch
+
+// captionFontSize is the largest caption drawn, in points; smaller labels
+// get smaller text.
+const captionFontSize = 9
+
+// Label is one code to print on a label sheet, with the caption under or
+// beside it.
+type Label struct {
+	Code *Code
+	// Image is drawn instead of the modules when set, for styles and logos
+	// PDF can't draw as shapes. It should include the quiet zone.
+	Image   image.Image
+	Caption string
+}
+
+// LabelSheetPDF lays labels out on sheets of template t, one PDF page per
+// sheet. Plain codes are drawn as vector shapes in the style's colors, so
+// they print sharp at any size; captions are set in Helvetica.
+func LabelSheetPDF(t LabelTemplate, labels []Label, opts LayoutOptions, style Style) ([]byte, error) {
+	if err := style.Validate(); err != nil {
+		return nil, err
+	}
+	style = style.withDefaults()
+	colors, _ := style.colors()
+
+	placements, err := Layout(t, len(labels), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &pdfDoc{}
+	catalog := doc.reserve()
+	pages := doc.reserve()
+	font := doc.add([]byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>"))
+
+	pageHeight := t.PageHeight * pointsPerMM
+	var pageIDs []int
+	var content bytes.Buffer
+	var images []string
+	flush := func() {
+		var xobjects strings.Builder
+		for i, id := range images {
+			fmt.Fprintf(&xobjects, "/Im%d %s ", i, id)
+		}
+		stream := doc.add(pdfStream("", content.Bytes()))
+		pageIDs = append(pageIDs, doc.add([]byte(fmt.Sprintf(
+			"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 %d 0 R >> /XObject << %s>> >> /Contents %d 0 R >>",
+			pages, pdfNum(t.PageWidth*pointsPerMM), pdfNum(pageHeight), font, xobjects.String(), stream))))
+		content.Reset()
+		images = images[:0]
+	}
+
+	sheet := 0
+	for i, p := range placements {
+		for ; sheet < p.Sheet; sheet++ {
+			flush()
+		}
+		label := labels[i]
+		code := pdfRect(p.Code, pageHeight)
+
+		if label.Image != nil {
+			id := doc.add(pdfImage(label.Image))
+			images = append(images, fmt.Sprintf("%d 0 R", id))
+			fmt.Fprintf(&content, "q %s 0 0 %s %s %s cm /Im%d Do Q\n",
+				pdfNum(code.Width), pdfNum(code.Height), pdfNum(code.X), pdfNum(code.Y), len(images)-1)
+		} else if label.Code != nil {
+			writeModules(&content, label.Code, code, style.Margin(), colors)
+		}
+
+		if label.Caption != "" && p.Caption.Width > 0 && p.Caption.Height > 0 {
+			writeCaption(&content, label.Caption, pdfRect(p.Caption, pageHeight))
+		}
+	}
+	flush()
+
+	kids := make([]string, len(pageIDs))
+	for i, id := range pageIDs {
+		kids[i] = fmt.Sprintf("%d 0 R", id)
+	}
+	doc.set(pages, []byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))))
+	doc.set(catalog, []byte(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages)))
+	return doc.bytes(catalog), nil
+}
+
+// pdfRect converts r to points from the bottom-left corner of the page, as
+// PDF measures.
+func pdfRect(r Rect, pageHeight float64) Rect {
+	return Rect{
+		X:      r.X * pointsPerMM,
+		Y:      pageHeight - (r.Y+r.Height)*pointsPerMM,
+		Width:  r.Width * pointsPerMM,
+		Height: r.Height * pointsPerMM,
+	}
+}
+
+// writeModules draws the code filling r, quiet zone included, with each
+// row's runs of dark modules as one rectangle.
+func writeModules(w *bytes.Buffer, c *Code, r Rect, quietZone int, colors styleColors) {
+	n := c.Size()
+	unit := r.Width / float64(n+2*quietZone)
+	top := r.Y + r.Height
+
+	fmt.Fprintf(w, "%s rg %s %s %s %s re f\n", pdfColor(colors.bg), pdfNum(r.X), pdfNum(r.Y), pdfNum(r.Width), pdfNum(r.Height))
+	fmt.Fprintf(w, "%s rg\n", pdfColor(colors.fg))
+	for y, row := range c.Modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			run := 1
+			for x+run < len(row) && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(w, "%s %s %s %s re\n",
+				pdfNum(r.X+float64(x+quietZone)*unit), pdfNum(top-float64(y+quietZone+1)*unit),
+				pdfNum(float64(run)*unit), pdfNum(unit))
+			x += run - 1
+		}
+	}
+	w.WriteString("f\n")
+}
+
+// writeCaption sets text in r, wrapped at spaces into as many lines as fit
+// and cut short with an ellipsis past that.
+func writeCaption(w *bytes.Buffer, text string, r Rect) {
+	size := math.Min(captionFontSize, r.Height)
+	leading := size * 1.2
+	maxLines := max(1, int(r.Height/leading))
+
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(pdfText(text)) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if textWidth(candidate, size) <= r.Width || line == "" {
+			line = candidate
+			continue
+		}
+		lines = append(lines, line)
+		line = word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+		lines[maxLines-1] += "..."
+	}
+	for i, l := range lines {
+		// Words longer than the label are cut
+		for textWidth(l, size) > r.Width && len(l) > 3 {
+			l = l[:len(l)-4] + "..."
+		}
+		lines[i] = l
+	}
+
+	w.WriteString("0 0 0 rg\n")
+	for i, l := range lines {
+		baseline := r.Y + r.Height - size - float64(i)*leading
+		fmt.Fprintf(w, "BT /F1 %s Tf %s %s Td (%s) Tj ET\n", pdfNum(size), pdfNum(r.X), pdfNum(baseline), pdfEscape(l))
+	}
+}
+
+// winAnsiPunctuation is where WinAnsi puts the punctuation Latin-1 lacks.
+var winAnsiPunctuation = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92,
+	'“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// pdfText maps s to the WinAnsi characters Helvetica has, as bytes;
+// anything else becomes a question mark.
+func pdfText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 0x20 && r < 0x7f, r >= 0xa0 && r <= 0xff:
+			b.WriteByte(byte(r))
+		case r == '\t' || r == '\n' || r == '\r':
+			b.WriteByte(' ')
+		case winAnsiPunctuation[r] != 0:
+			b.WriteByte(winAnsiPunctuation[r])
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func pdfEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s)
+}
+
+// helveticaWidths are the advance widths of Helvetica's printable ASCII
+// characters, from space, in thousandths of the font size.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// textWidth measures WinAnsi text in points. Other characters are taken to
+// be as wide as a digit, close enough for wrapping.
+func textWidth(s string, size float64) float64 {
+	total := 0
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 0x20 && c < 0x7f {
+			total += helveticaWidths[c-0x20]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+func pdfNum(v float64) string {
+	s := fmt.Sprintf("%.3f", v)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+func pdfColor(c color.RGBA) string {
+	return fmt.Sprintf("%s %s %s", pdfNum(float64(c.R)/255), pdfNum(float64(c.G)/255), pdfNum(float64(c.B)/255))
+}
+
+// pdfImage is an image XObject of img, flattened onto white.
+func pdfImage(img image.Image) []byte {
+	b := img.Bounds()
+	pixels := make([]byte, 0, b.Dx()*b.Dy()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			white := 0xffff - a
+			pixels = append(pixels, byte((r+white)>>8), byte((g+white)>>8), byte((bl+white)>>8))
+		}
+	}
+	return pdfStream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8",
+		b.Dx(), b.Dy()), pixels)
+}
+
+// pdfStream is a stream object with the extra dictionary entries in dict,
+// compressed.
+func pdfStream(dict string, data []byte) []byte {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(data)
+	zw.Close()
+
+	if dict != "" {
+		dict += " "
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "<< %s/Filter /FlateDecode /Length %d >>\nstream\n", dict, z.Len())
+	out.Write(z.Bytes())
+	out.WriteString("\nendstream")
+	return out.Bytes()
+}
+
+// pdfDoc collects numbered objects and writes them out with the
+// cross-reference table readers use to find them.
+type pdfDoc struct {
+	objects [][]byte // object n is objects[n-1]
+}
+
+func (d *pdfDoc) add(obj []byte) int {
+	d.objects = append(d.objects, obj)
+	return len(d.objects)
+}
+
+// reserve numbers an object written later with set, for objects that refer
+// to ones not made yet.
+func (d *pdfDoc) reserve() int {
+	return d.add(nil)
+}
+
+func (d *pdfDoc) set(n int, obj []byte) {
+	d.objects[n-1] = obj
+}
+
+func (d *pdfDoc) bytes(root int) []byte {
+	var out bytes.Buffer
+	// The binary comment tells transfer tools the file isn't text
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(d.objects))
+	for i, obj := range d.objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		out.Write(obj)
+		out.WriteString("\nendobj\n")
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(d.objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(d.objects)+1, root, xref)
+	return out.Bytes()
+}
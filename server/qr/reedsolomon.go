@@ -0,0 +1,161 @@
+package qr
+
+import "errors"
+
+// QR codes correct errors with Reed-Solomon codes over GF(256), built from
+// the polynomial x^8+x^4+x^3+x^2+1 with generator roots α^0, α^1, ...
+
+var gfExp, gfLog = func() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	// Doubled so products of two logs need no modulo
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// gfPow is α^n for any n, negative included.
+func gfPow(n int) byte {
+	n %= 255
+	if n < 0 {
+		n += 255
+	}
+	return gfExp[n]
+}
+
+// polyEval evaluates p, lowest degree first, at x.
+func polyEval(p []byte, x byte) byte {
+	var y byte
+	for i := len(p) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ p[i]
+	}
+	return y
+}
+
+var errTooManyErrors = errors.New("qr: too many errors to correct")
+
+// correctBlock fixes block, data codewords followed by ecLen error
+// correction codewords, in place and returns how many codewords it changed.
+func correctBlock(block []byte, ecLen int) (int, error) {
+	n := len(block)
+	// Codeword i is the coefficient of x^(n-1-i)
+	coef := func(i int) int { return n - 1 - i }
+
+	synd := make([]byte, ecLen)
+	clean := true
+	for i := range synd {
+		x := gfPow(i)
+		var s byte
+		for _, c := range block {
+			s = gfMul(s, x) ^ c
+		}
+		synd[i] = s
+		clean = clean && s == 0
+	}
+	if clean {
+		return 0, nil
+	}
+
+	// Berlekamp-Massey finds the error locator Λ, lowest degree first
+	locator := []byte{1}
+	prev := []byte{1}
+	errs, shift := 0, 1
+	prevDelta := byte(1)
+	for k := 0; k < ecLen; k++ {
+		delta := synd[k]
+		for i := 1; i <= errs && i < len(locator); i++ {
+			delta ^= gfMul(locator[i], synd[k-i])
+		}
+		if delta == 0 {
+			shift++
+			continue
+		}
+		scale := gfDiv(delta, prevDelta)
+		next := make([]byte, max(len(locator), len(prev)+shift))
+		copy(next, locator)
+		for i, c := range prev {
+			next[i+shift] ^= gfMul(scale, c)
+		}
+		if 2*errs <= k {
+			prev, prevDelta = locator, delta
+			errs = k + 1 - errs
+			shift = 1
+		} else {
+			shift++
+		}
+		locator = next
+	}
+	if 2*errs > ecLen {
+		return 0, errTooManyErrors
+	}
+
+	// Chien search: an error at codeword i makes Λ(α^-coef(i)) zero
+	var positions []int
+	for i := 0; i < n; i++ {
+		if polyEval(locator, gfPow(-coef(i))) == 0 {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) != errs {
+		return 0, errTooManyErrors
+	}
+
+	// Forney: the evaluator Ω = SΛ mod x^ecLen gives each error's value
+	omega := make([]byte, ecLen)
+	for i, s := range synd {
+		for j, l := range locator {
+			if i+j < ecLen {
+				omega[i+j] ^= gfMul(s, l)
+			}
+		}
+	}
+	for _, i := range positions {
+		x := gfPow(coef(i))
+		xInv := gfPow(-coef(i))
+		// Λ' keeps the odd terms, as 2 = 0 in GF(2^8)
+		var deriv byte
+		for j := 1; j < len(locator); j += 2 {
+			deriv ^= gfMul(locator[j], gfPow(int(gfLog[xInv])*(j-1)))
+		}
+		if deriv == 0 {
+			return 0, errTooManyErrors
+		}
+		block[i] ^= gfDiv(gfMul(x, polyEval(omega, xInv)), deriv)
+	}
+
+	for i := range synd {
+		x := gfPow(i)
+		var s byte
+		for _, c := range block {
+			s = gfMul(s, x) ^ c
+		}
+		if s != 0 {
+			return 0, errTooManyErrors
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,257 @@
+package qr
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Module shapes.
+const (
+	ModuleSquare  = "square"
+	ModuleRounded = "rounded" // corners with no dark neighbour are rounded
+	ModuleDots    = "dots"    // circles; finder patterns stay rounded squares
+)
+
+// Gradient types, both running from the foreground to the end color.
+const (
+	GradientLinear = "linear" // top left to bottom right
+	GradientRadial = "radial" // center outwards
+)
+
+// MaxQuietZone is the widest margin a style can ask for, in modules.
+const MaxQuietZone = 16
+
+var ModuleShapes = []string{ModuleSquare, ModuleRounded, ModuleDots}
+
+// Gradient fills the dark modules with a blend from the style's foreground
+// to End.
+type Gradient struct {
+	Type string `json:"type"`
+	End  string `json:"end"`
+}
+
+// Style is how the code itself is drawn: colors as hex, module shape and
+// the quiet zone. Every color the dark modules take must contrast with the
+// background enough to scan.
+type Style struct {
+	Foreground string    `json:"foreground,omitempty"`
+	Background string    `json:"background,omitempty"`
+	Modules    string    `json:"modules,omitempty"`
+	Gradient   *Gradient `json:"gradient,omitempty"`
+	// QuietZone is the margin in modules; nil is the standard's 4
+	QuietZone *int `json:"quiet_zone,omitempty"`
+}
+
+func (s Style) withDefaults() Style {
+	if s.Foreground == "" {
+		s.Foreground = "#000000"
+	}
+	if s.Background == "" {
+		s.Background = "#ffffff"
+	}
+	if s.Modules == "" {
+		s.Modules = ModuleSquare
+	}
+	if s.Gradient != nil && s.Gradient.Type == "" {
+		g := *s.Gradient
+		g.Type = GradientLinear
+		s.Gradient = &g
+	}
+	return s
+}
+
+// Margin is the quiet zone the style draws, in modules.
+func (s Style) Margin() int {
+	if s.QuietZone == nil {
+		return QuietZone
+	}
+	return *s.QuietZone
+}
+
+// Validate checks the shape, gradient and quiet zone, and that the dark
+// modules keep at least MinContrast with the background across the whole
+// gradient.
+func (s Style) Validate() error {
+	s = s.withDefaults()
+
+	known := false
+	for _, m := range ModuleShapes {
+		known = known || m == s.Modules
+	}
+	if !known {
+		return fmt.Errorf("qr: unknown module shape %q", s.Modules)
+	}
+	if s.Gradient != nil && s.Gradient.Type != GradientLinear && s.Gradient.Type != GradientRadial {
+		return fmt.Errorf("qr: unknown gradient type %q", s.Gradient.Type)
+	}
+	if m := s.Margin(); m < 0 || m > MaxQuietZone {
+		return fmt.Errorf("qr: quiet zone must be between 0 and %d modules", MaxQuietZone)
+	}
+
+	colors, err := s.colors()
+	if err != nil {
+		return err
+	}
+	// A blend can be lighter than both its ends, so check along its length
+	const steps = 10
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / steps
+		if ratio := ContrastRatio(mix(colors.fg, colors.end, t), colors.bg); ratio < MinContrast {
+			return fmt.Errorf("qr: the code's colors have a contrast ratio of %.1f:1 with the background; at least %.1f:1 is needed to scan",
+				ratio, MinContrast)
+		}
+	}
+	return nil
+}
+
+type styleColors struct {
+	fg, end, bg color.RGBA
+}
+
+func (s Style) colors() (styleColors, error) {
+	var c styleColors
+	var err error
+	if c.fg, err = ParseHexColor(s.Foreground); err != nil {
+		return c, err
+	}
+	if c.bg, err = ParseHexColor(s.Background); err != nil {
+		return c, err
+	}
+	c.end = c.fg
+	if s.Gradient != nil {
+		if c.end, err = ParseHexColor(s.Gradient.End); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// Plain reports whether the style draws square modules in one color, which
+// Image already does with sharper, smaller output.
+func (s Style) Plain() bool {
+	s = s.withDefaults()
+	return s.Modules == ModuleSquare && s.Gradient == nil
+}
+
+// Render draws the code size pixels square in style s. As with Image,
+// modules are whole pixels, leftover space goes to the margin and size is
+// raised if it is too small for one pixel a module.
+func (c *Code) Render(size int, s Style) (image.Image, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	s = s.withDefaults()
+	colors, _ := s.colors()
+	if s.Plain() {
+		return c.Image(size, s.Margin(), colors.fg, colors.bg), nil
+	}
+
+	n := c.Size()
+	total := n + 2*s.Margin()
+	if size < total {
+		size = total
+	}
+	scale := size / total
+	offset := (size - n*scale) / 2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(colors.bg), image.Point{}, draw.Src)
+
+	shade := gradientShade(s.Gradient, colors, float64(offset), float64(n*scale))
+	dark := func(x, y int) bool {
+		return x >= 0 && y >= 0 && x < n && y < n && c.Modules[y][x]
+	}
+	unit := float64(scale)
+	for y, row := range c.Modules {
+		for x, on := range row {
+			if !on {
+				continue
+			}
+			x0, y0 := float64(offset+x*scale), float64(offset+y*scale)
+			var inside func(px, py float64) bool
+			if s.Modules == ModuleDots && !inFinder(x, y, n) {
+				cx, cy, r := x0+unit/2, y0+unit/2, unit*0.45
+				inside = func(px, py float64) bool { return (px-cx)*(px-cx)+(py-cy)*(py-cy) <= r*r }
+			} else if s.Modules == ModuleSquare {
+				inside = func(px, py float64) bool { return true }
+			} else {
+				inside = roundedModule(x0, y0, unit, [4]bool{
+					!dark(x-1, y) && !dark(x, y-1), // top left
+					!dark(x+1, y) && !dark(x, y-1), // top right
+					!dark(x+1, y) && !dark(x, y+1), // bottom right
+					!dark(x-1, y) && !dark(x, y+1), // bottom left
+				})
+			}
+			bounds := image.Rect(offset+x*scale, offset+y*scale, offset+(x+1)*scale, offset+(y+1)*scale)
+			shadeShape(dst, bounds, inside, shade)
+		}
+	}
+	return dst, nil
+}
+
+// RenderSVG draws the code in style s as SVG, which scales to any size.
+// Only plain styles, square modules in one color, can be drawn this way.
+func (c *Code) RenderSVG(s Style) (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+	s = s.withDefaults()
+	if !s.Plain() {
+		return "", fmt.Errorf("qr: SVG output only draws square modules in one color")
+	}
+	colors, _ := s.colors()
+	return c.SVG(s.Margin(), HexColor(colors.fg), HexColor(colors.bg)), nil
+}
+
+// inFinder reports whether module (x, y) is part of one of the three finder
+// patterns, which scanners look for first and so keep their square outline.
+func inFinder(x, y, n int) bool {
+	near := func(v int) bool { return v < 7 }
+	far := func(v int) bool { return v >= n-7 }
+	return (near(x) && near(y)) || (far(x) && near(y)) || (near(x) && far(y))
+}
+
+// roundedModule is a module's square with the chosen corners rounded to a
+// radius of half a module, so a module on its own is a circle.
+func roundedModule(x0, y0, unit float64, round [4]bool) func(x, y float64) bool {
+	r := unit / 2
+	x1, y1 := x0+unit, y0+unit
+	centers := [4][2]float64{{x0 + r, y0 + r}, {x1 - r, y0 + r}, {x1 - r, y1 - r}, {x0 + r, y1 - r}}
+	return func(x, y float64) bool {
+		for i, c := range centers {
+			if !round[i] {
+				continue
+			}
+			// Only the quarter of the square beyond the corner's center
+			// is cut
+			outX := (i == 0 || i == 3) && x < c[0] || (i == 1 || i == 2) && x > c[0]
+			outY := (i == 0 || i == 1) && y < c[1] || (i == 2 || i == 3) && y > c[1]
+			if outX && outY && (x-c[0])*(x-c[0])+(y-c[1])*(y-c[1]) > r*r {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// gradientShade colors a pixel of the code, whose modules span width pixels
+// from offset on both axes.
+func gradientShade(g *Gradient, colors styleColors, offset, width float64) func(x, y int) color.RGBA {
+	if g == nil || width <= 0 {
+		return func(x, y int) color.RGBA { return colors.fg }
+	}
+	return func(x, y int) color.RGBA {
+		px, py := float64(x)+0.5-offset, float64(y)+0.5-offset
+		var t float64
+		if g.Type == GradientRadial {
+			half := width / 2
+			t = math.Hypot(px-half, py-half) / (half * math.Sqrt2)
+		} else {
+			t = (px + py) / (2 * width)
+		}
+		return mix(colors.fg, colors.end, math.Max(0, math.Min(1, t)))
+	}
+}
@@ -0,0 +1,80 @@
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// WiFi authentication types.
+const (
+	WiFiWPA    = "WPA" // WPA, WPA2 and WPA3 personal
+	WiFiWEP    = "WEP"
+	WiFiNoPass = "nopass"
+)
+
+// WiFi is the content of a code that joins a network.
+type WiFi struct {
+	SSID     string `json:"ssid"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"` // WPA, WEP or nopass
+	Hidden   bool   `json:"hidden"`
+}
+
+var hexOnly = regexp.MustCompile(`^[0-9A-Fa-f]+$`)
+
+// Payload renders the network in the WIFI: scheme phones read. An empty
+// Auth is WPA when there is a password and nopass otherwise.
+func (w WiFi) Payload() (string, error) {
+	if w.SSID == "" {
+		return "", errors.New("ssid is required")
+	}
+	if len(w.SSID) > 32 {
+		return "", errors.New("ssid is at most 32 bytes")
+	}
+
+	auth := w.Auth
+	switch strings.ToUpper(auth) {
+	case "":
+		auth = WiFiNoPass
+		if w.Password != "" {
+			auth = WiFiWPA
+		}
+	case WiFiWPA, "WPA2", "WPA3":
+		auth = WiFiWPA
+	case WiFiWEP:
+		auth = WiFiWEP
+	case strings.ToUpper(WiFiNoPass), "NONE":
+		auth = WiFiNoPass
+	default:
+		return "", fmt.Errorf("auth must be %s, %s or %s", WiFiWPA, WiFiWEP, WiFiNoPass)
+	}
+	if auth == WiFiNoPass && w.Password != "" {
+		return "", errors.New("an open network has no password")
+	}
+	if auth != WiFiNoPass && w.Password == "" {
+		return "", errors.New("password is required")
+	}
+
+	var b strings.Builder
+	b.WriteString("WIFI:T:" + auth + ";S:" + wifiValue(w.SSID) + ";")
+	if auth != WiFiNoPass {
+		b.WriteString("P:" + wifiValue(w.Password) + ";")
+	}
+	if w.Hidden {
+		b.WriteString("H:true;")
+	}
+	b.WriteString(";")
+	return b.String(), nil
+}
+
+// wifiValue escapes the scheme's special characters. A value that is all
+// hex digits is quoted, or readers take it for a hex-encoded key.
+func wifiValue(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, ":", `\:`, `"`, `\"`).Replace(s)
+	if hexOnly.MatchString(s) {
+		s = `"` + s + `"`
+	}
+	return s
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-manager/qr"
+	"backup-manager/storage"
+)
+
+const (
+	maxQRBatchItems = 1000
+	maxQRBatchBytes = 5 << 20
+	qrBatchWorkers  = 8
+
+	defaultQRFilename = "qr-{index}"
+	// Longest {content} substituted into a file name
+	maxFilenameContent = 40
+
+	// defaultQRCaptionSize is the room kept for captions on PDF label
+	// sheets, in millimetres
+	defaultQRCaptionSize = 5
+)
+
+// qrBatchItem is one code to render. Empty options fall back to the
+// batch's defaults. Caption is printed under the code on label sheets,
+// where it defaults to the content.
+type qrBatchItem struct {
+	Content  string `json:"content"`
+	ECLevel  string `json:"ec_level"`
+	Size     int    `json:"size"`
+	Filename string `json:"filename"`
+	Caption  string `json:"caption"`
+}
+
+type qrBatchError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type renderedQRCode struct {
+	code    QRCode
+	encoded *qr.Code
+	name    string
+	file    []byte
+	// image is set for label sheets when the code can't be drawn as shapes
+	image image.Image
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// qrBatchFilename expands a file name template for the item at index
+// (0-based) of count, ending in ext. {index} is the 1-based position,
+// zero-padded so names sort in order, {content} is the payload made safe
+// for a file name, and {id} is the saved code's ID.
+func qrBatchFilename(template string, index, count int, content, id, ext string) string {
+	content = strings.Trim(unsafeFilenameChars.ReplaceAllString(content, "_"), "_.")
+	content = truncate(content, maxFilenameContent)
+	name := strings.NewReplacer(
+		"{index}", fmt.Sprintf("%0*d", len(strconv.Itoa(count)), index+1),
+		"{content}", content,
+		"{id}", id,
+	).Replace(template)
+	name = strings.Trim(unsafeFilenameChars.ReplaceAllString(name, "_"), "_.")
+	if name == "" {
+		name = id
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ext) {
+		name += ext
+	}
+	return name
+}
+
+// readQRBatch reads the items from a JSON array, or from a CSV file
+// uploaded as "file" with a header row naming the content, ec_level, size,
+// filename and caption columns. Only content is required.
+func readQRBatch(r *http.Request) ([]qrBatchItem, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		var items []qrBatchItem
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			return nil, fmt.Errorf("body must be a JSON array of items")
+		}
+		return items, nil
+	}
+
+	if err := r.ParseMultipartForm(maxQRBatchBytes); err != nil {
+		return nil, fmt.Errorf("CSV file too large")
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, fmt.Errorf("file is required")
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("CSV has no header row")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["content"]; !ok {
+		return nil, fmt.Errorf("CSV needs a content column")
+	}
+
+	var items []qrBatchItem
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading CSV: %v", err)
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		item := qrBatchItem{
+			Content:  field("content"),
+			ECLevel:  field("ec_level"),
+			Filename: field("filename"),
+			Caption:  field("caption"),
+		}
+		if v := field("size"); v != "" {
+			size, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: size must be a number", len(items)+2)
+			}
+			item.Size = size
+		}
+		items = append(items, item)
+		if len(items) > maxQRBatchItems {
+			break
+		}
+	}
+	return items, nil
+}
+
+// renderQRBatch encodes and draws the items on a pool of workers, all with
+// the same style, format and logo, counting each one done on p. Results are
+// in item order; items that failed are reported instead.
+func renderQRBatch(userID string, items []qrBatchItem, levels []qr.ECLevel, sizes []int, opts qrRenderOptions, logo image.Image, p *jobProgress) ([]renderedQRCode, []qrBatchError) {
+	rendered := make([]renderedQRCode, len(items))
+	failures := make([]error, len(items))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < qrBatchWorkers && i < len(items); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				code, err := qr.Encode(items[i].Content, levels[i])
+				if err != nil {
+					failures[i] = err
+					p.itemDone()
+					continue
+				}
+				var file []byte
+				var img image.Image
+				switch {
+				case opts.Format != qrFormatPDF:
+					file, _, err = renderQR(code, sizes[i], opts, logo)
+				case !opts.Style.Plain() || logo != nil:
+					img, err = renderQRImage(code, sizes[i], opts, logo)
+				}
+				if err != nil {
+					failures[i] = err
+					p.itemDone()
+					continue
+				}
+				rendered[i] = renderedQRCode{
+					code: QRCode{
+						ID:        generateID(),
+						UserID:    userID,
+						Content:   items[i].Content,
+						ECLevel:   string(code.Level),
+						Size:      sizes[i],
+						Version:   code.Version,
+						CreatedAt: time.Now(),
+					},
+					encoded: code,
+					file:    file,
+					image:   img,
+				}
+				p.itemDone()
+			}
+		}()
+	}
+	for i := range items {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var errs []qrBatchError
+	for i, err := range failures {
+		if err != nil {
+			errs = append(errs, qrBatchError{Index: i, Error: err.Error()})
+		}
+	}
+	return rendered, errs
+}
+
+// readQRSheetOptions reads the label stock and layout for count codes from
+// a batch's query string. Errors are fit to show the client.
+func readQRSheetOptions(q url.Values, count int) (qr.LabelTemplate, qr.LayoutOptions, error) {
+	var layout qr.LayoutOptions
+	name := q.Get("label")
+	if name == "" {
+		return qr.LabelTemplate{}, layout, fmt.Errorf("label is required for PDF output")
+	}
+	sheet, ok := qr.LabelTemplates[name]
+	if !ok {
+		return qr.LabelTemplate{}, layout, fmt.Errorf("unknown label template %q", name)
+	}
+
+	layout.CaptionSize = defaultQRCaptionSize
+	if v := q.Get("caption_size"); v != "" {
+		size, err := strconv.ParseFloat(v, 64)
+		if err != nil || size < 0 {
+			return sheet, layout, fmt.Errorf("caption_size must be a number of millimetres")
+		}
+		layout.CaptionSize = size
+	}
+	if v := q.Get("skip"); v != "" {
+		skip, err := strconv.Atoi(v)
+		if err != nil {
+			return sheet, layout, fmt.Errorf("skip must be a number")
+		}
+		layout.Skip = skip
+	}
+	// Catch a layout that can't work before anything is rendered
+	if _, err := qr.Layout(sheet, count, layout); err != nil {
+		return sheet, layout, err
+	}
+	return sheet, layout, nil
+}
+
+func writeQRBatchErrors(w http.ResponseWriter, status int, errs []qrBatchError) {
+	writeAPIError(w, &apiError{
+		Status:  status,
+		Code:    "invalid_items",
+		Message: "Some items in the batch are invalid",
+		Details: map[string]interface{}{"items": errs},
+	})
+}
+
+// qrBatchInvalid is a batch the client must fix: status and msg to answer
+// with, or the items at fault.
+type qrBatchInvalid struct {
+	status int
+	msg    string
+	items  []qrBatchError
+}
+
+func (e *qrBatchInvalid) Error() string {
+	if len(e.items) > 0 {
+		return fmt.Sprintf("%d of the items are invalid, the first: %s", len(e.items), e.items[0].Error)
+	}
+	return e.msg
+}
+
+func writeQRBatchFailure(w http.ResponseWriter, err error) {
+	var invalid *qrBatchInvalid
+	switch {
+	case errors.As(err, &invalid) && len(invalid.items) > 0:
+		writeQRBatchErrors(w, invalid.status, invalid.items)
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.msg, invalid.status)
+	default:
+		writeQRLogoError(w, err)
+	}
+}
+
+// qrBatch is a batch checked and ready to render.
+type qrBatch struct {
+	userID          string
+	items           []qrBatchItem
+	levels          []qr.ECLevel
+	sizes           []int
+	opts            qrRenderOptions
+	sheet           qr.LabelTemplate
+	layout          qr.LayoutOptions
+	logo            image.Image
+	defaultFilename string
+}
+
+// prepareQRBatch checks items against the options in q, described at
+// createQRBatchHandler, and loads the template and logo they name. Its
+// errors are a *qrBatchInvalid or from loading the logo.
+func prepareQRBatch(ctx context.Context, userID string, items []qrBatchItem, q url.Values) (*qrBatch, error) {
+	if len(items) == 0 {
+		return nil, &qrBatchInvalid{status: http.StatusBadRequest, msg: "at least one item is required"}
+	}
+	if len(items) > maxQRBatchItems {
+		return nil, &qrBatchInvalid{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("at most %d items per batch", maxQRBatchItems)}
+	}
+	b := &qrBatch{userID: userID, items: items}
+
+	var err error
+	defaultSize := 0
+	if v := q.Get("size"); v != "" {
+		if defaultSize, err = strconv.Atoi(v); err != nil {
+			return nil, &qrBatchInvalid{status: http.StatusBadRequest, msg: "size must be a number"}
+		}
+	}
+	b.defaultFilename = q.Get("filename")
+	if b.defaultFilename == "" {
+		b.defaultFilename = defaultQRFilename
+	}
+
+	if id := q.Get("template_id"); id != "" {
+		template, err := db.QRTemplates().Get(ctx, userID, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, &qrBatchInvalid{status: http.StatusNotFound, msg: "Template not found"}
+		} else if err != nil {
+			logger(ctx).Error("Database error", "loading", "template", "error", err)
+			return nil, &qrBatchInvalid{status: http.StatusInternalServerError, msg: "Database error"}
+		}
+		applyQRTemplate(template, &b.opts)
+	}
+	format := q.Get("format")
+	if format == qrFormatPDF {
+		b.opts.Format = ""
+	} else if format != "" {
+		b.opts.Format = format
+	}
+	if _, _, err := b.opts.check(); err != nil {
+		return nil, &qrBatchInvalid{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if format == qrFormatPDF {
+		b.opts.Format = qrFormatPDF
+		if b.sheet, b.layout, err = readQRSheetOptions(q, len(items)); err != nil {
+			return nil, &qrBatchInvalid{status: http.StatusBadRequest, msg: err.Error()}
+		}
+	}
+	if b.opts.wanted() {
+		if b.logo, err = b.opts.load(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	b.levels = make([]qr.ECLevel, len(items))
+	b.sizes = make([]int, len(items))
+	var invalid []qrBatchError
+	for i, item := range items {
+		if item.Content == "" {
+			invalid = append(invalid, qrBatchError{Index: i, Error: "content is required"})
+			continue
+		}
+		if item.ECLevel == "" {
+			item.ECLevel = q.Get("ec_level")
+		}
+		if item.ECLevel == "" {
+			item.ECLevel = b.opts.ECLevel
+		}
+		if item.Size == 0 {
+			item.Size = defaultSize
+		}
+		if item.Size == 0 {
+			item.Size = b.opts.Size
+		}
+		if b.levels[i], b.sizes[i], err = parseQROptions(item.ECLevel, item.Size); err != nil {
+			invalid = append(invalid, qrBatchError{Index: i, Error: err.Error()})
+		}
+		if b.logo != nil {
+			b.levels[i] = qr.LogoLevel
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, &qrBatchInvalid{status: http.StatusBadRequest, items: invalid}
+	}
+	return b, nil
+}
+
+// qrBatchOutput is a rendered batch, saved and ready to send.
+type qrBatchOutput struct {
+	format   string
+	rendered []renderedQRCode
+	pdf      []byte
+}
+
+// render draws every code, counting them done on p, and saves them to the
+// user's account as actor. Items that fail to render come back as a
+// *qrBatchInvalid, and then nothing is saved.
+func (b *qrBatch) render(ctx context.Context, actor DomainActor, p *jobProgress) (*qrBatchOutput, error) {
+	rendered, errs := renderQRBatch(b.userID, b.items, b.levels, b.sizes, b.opts, b.logo, p)
+	if len(errs) > 0 {
+		return nil, &qrBatchInvalid{status: http.StatusUnprocessableEntity, items: errs}
+	}
+	out := &qrBatchOutput{format: b.opts.Format, rendered: rendered}
+
+	if b.opts.Format == qrFormatPDF {
+		labels := make([]qr.Label, len(rendered))
+		for i, c := range rendered {
+			caption := b.items[i].Caption
+			if caption == "" {
+				caption = b.items[i].Content
+			}
+			labels[i] = qr.Label{Code: c.encoded, Image: c.image, Caption: caption}
+		}
+		pdf, err := qr.LabelSheetPDF(b.sheet, labels, b.layout, b.opts.Style)
+		if err != nil {
+			return nil, fmt.Errorf("drawing label sheets: %w", err)
+		}
+		out.pdf = pdf
+	}
+
+	ext := "." + b.opts.Format
+	taken := map[string]bool{"manifest.csv": true}
+	for i := range rendered {
+		template := b.items[i].Filename
+		if template == "" {
+			template = b.defaultFilename
+		}
+		name := qrBatchFilename(template, i, len(b.items), b.items[i].Content, rendered[i].code.ID, ext)
+		base := name[:len(name)-len(ext)]
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d%s", base, n, ext)
+		}
+		taken[name] = true
+		rendered[i].name = name
+	}
+
+	for _, c := range rendered {
+		c.code.TeamID = storage.TeamFrom(ctx)
+		if err := createQRCode(ctx, actor, c.code); err != nil {
+			return nil, fmt.Errorf("saving QR code: %w", err)
+		}
+	}
+	return out, nil
+}
+
+func (o *qrBatchOutput) contentType() string {
+	if o.pdf != nil {
+		return "application/pdf"
+	}
+	return "application/zip"
+}
+
+func (o *qrBatchOutput) filename() string {
+	if o.pdf != nil {
+		return "qr-codes.pdf"
+	}
+	return "qr-codes.zip"
+}
+
+// write writes the PDF of label sheets, or the ZIP of codes with a
+// manifest.csv listing each file's code.
+func (o *qrBatchOutput) write(w io.Writer) error {
+	if o.pdf != nil {
+		_, err := w.Write(o.pdf)
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	manifest, err := zw.Create("manifest.csv")
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(manifest)
+	cw.Write([]string{"filename", "id", "content", "ec_level", "version", "size"})
+	for _, c := range o.rendered {
+		cw.Write([]string{c.name, c.code.ID, c.code.Content, c.code.ECLevel,
+			strconv.Itoa(c.code.Version), strconv.Itoa(c.code.Size)})
+	}
+	cw.Flush()
+	for _, c := range o.rendered {
+		// PNGs are already compressed
+		method := zip.Store
+		if o.format == qrFormatSVG {
+			method = zip.Deflate
+		}
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: c.name, Method: method, Modified: c.code.CreatedAt})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(c.file); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Handlers
+
+// createQRBatchHandler renders many codes at once and returns them as a ZIP
+// of PNGs, with a manifest.csv listing each file's code. The query string
+// sets defaults for ec_level, size and filename (a template, see
+// qrBatchFilename), and template_id draws every code with a saved
+// template's style, logo and format. Every code is saved to the caller's
+// account; nothing is saved unless all of them render.
+//
+// format=svg makes the ZIP of SVGs instead, and format=pdf returns a PDF of
+// label sheets for printing: label names the stock (see
+// /api/qr/label-templates), skip leaves labels at the start of a partly
+// used sheet empty and caption_size is the room in millimetres for each
+// code's caption, 0 for none.
+func createQRBatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	r.Body = http.MaxBytesReader(w, r.Body, maxQRBatchBytes)
+
+	jobID, ok := progressJobID(r)
+	if !ok {
+		http.Error(w, "Invalid job_id", http.StatusBadRequest)
+		return
+	}
+
+	items, err := readQRBatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batch, err := prepareQRBatch(r.Context(), userID, items, r.URL.Query())
+	if err != nil {
+		writeQRBatchFailure(w, err)
+		return
+	}
+
+	p := newJobProgress(userID, jobID, progressQRBatch)
+	p.update(true, func(ev *ProgressEvent) {
+		ev.State = progressRunning
+		ev.Total = len(items)
+	})
+	out, err := batch.render(r.Context(), requestActor(r), p)
+	var invalid *qrBatchInvalid
+	if errors.As(err, &invalid) {
+		p.failed(err.Error())
+		writeQRBatchFailure(w, err)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error rendering QR batch", "error", err)
+		p.failed("Error rendering QR codes")
+		http.Error(w, "Error rendering QR codes", http.StatusInternalServerError)
+		return
+	}
+	p.completed("")
+
+	w.Header().Set("Content-Type", out.contentType())
+	w.Header().Set("Content-Disposition", `attachment; filename="`+out.filename()+`"`)
+	w.WriteHeader(http.StatusCreated)
+	if err := out.write(w); err != nil {
+		logger(r.Context()).Error("Error writing QR batch", "error", err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"time"
+
+	"backup-manager/qr"
+	"backup-manager/storage"
+)
+
+const (
+	qrDefaultSize = 256 // pixels
+	qrMaxSize     = 2048
+)
+
+// Image formats codes are rendered in.
+const (
+	qrFormatPNG = "png"
+	qrFormatSVG = "svg"
+	qrFormatPDF = "pdf" // label sheets, for batches
+)
+
+// Payload types POST /api/qr builds a code's content from.
+const (
+	qrTypeText  = "text"
+	qrTypeVCard = "vcard"
+	qrTypeWiFi  = "wifi"
+)
+
+// qrPayload is the content of a code, either given as is or built from
+// structured fields so clients don't assemble the formats themselves.
+type qrPayload struct {
+	Type string `json:"type" validate:"oneof=text vcard wifi"`
+	// The most any code holds, as alphanumeric characters at level L
+	Content string      `json:"content" validate:"max=4296"`
+	VCard   *qr.Contact `json:"vcard"`
+	WiFi    *qr.WiFi    `json:"wifi"`
+}
+
+// build returns the content to encode. Errors are fit to show the client.
+func (p qrPayload) build() (string, error) {
+	switch p.Type {
+	case "", qrTypeText:
+		if p.Content == "" {
+			return "", errors.New("content is required")
+		}
+		return p.Content, nil
+	case qrTypeVCard:
+		if p.VCard == nil || (p.VCard.FirstName == "" && p.VCard.LastName == "") {
+			return "", errors.New("vcard needs a first or last name")
+		}
+		return p.VCard.VCard(), nil
+	case qrTypeWiFi:
+		if p.WiFi == nil {
+			return "", errors.New("wifi is required")
+		}
+		return p.WiFi.Payload()
+	}
+	return "", fmt.Errorf("unknown type %q", p.Type)
+}
+
+// parseQROptions checks an error correction level and size in pixels,
+// filling in the defaults. Errors are fit to show the client.
+func parseQROptions(ecLevel string, size int) (qr.ECLevel, int, error) {
+	level, err := qr.ParseECLevel(ecLevel)
+	if err != nil {
+		return "", 0, errors.New("ec_level must be L, M, Q or H")
+	}
+	if size == 0 {
+		size = qrDefaultSize
+	}
+	if size < 0 || size > qrMaxSize {
+		return "", 0, fmt.Errorf("size must be at most %d pixels", qrMaxSize)
+	}
+	return level, size, nil
+}
+
+// qrRenderOptions is how a code is drawn, set on a request or saved in a
+// template.
+type qrRenderOptions struct {
+	qrLogoOptions
+	ECLevel string   `json:"ec_level" validate:"oneofci=L M Q H"`
+	Size    int      `json:"size" validate:"min=0,max=2048"`
+	Format  string   `json:"format" validate:"oneof=png svg"`
+	Style   qr.Style `json:"style"`
+}
+
+// check validates the options, filling in the default format, and returns
+// the parsed level and size. Errors are fit to show the client.
+func (o *qrRenderOptions) check() (qr.ECLevel, int, error) {
+	level, size, err := parseQROptions(o.ECLevel, o.Size)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := o.Style.Validate(); err != nil {
+		return "", 0, err
+	}
+	switch o.Format {
+	case "":
+		o.Format = qrFormatPNG
+	case qrFormatPNG:
+	case qrFormatSVG:
+		if o.wanted() {
+			return "", 0, errors.New("logos can only be drawn in PNG")
+		}
+		if !o.Style.Plain() {
+			return "", 0, errors.New("SVG only draws square modules in one color")
+		}
+	default:
+		return "", 0, errors.New("format must be png or svg")
+	}
+	return level, size, nil
+}
+
+// renderQR draws code in the chosen format, returning the file and its
+// content type.
+func renderQR(code *qr.Code, size int, o qrRenderOptions, logo image.Image) ([]byte, string, error) {
+	if o.Format == qrFormatSVG {
+		svg, err := code.RenderSVG(o.Style)
+		return []byte(svg), "image/svg+xml", err
+	}
+	img, err := renderQRImage(code, size, o, logo)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// renderQRImage draws code in its style with the logo, if any.
+func renderQRImage(code *qr.Code, size int, o qrRenderOptions, logo image.Image) (image.Image, error) {
+	img, err := code.Render(size, o.Style)
+	if err == nil && logo != nil {
+		img, err = code.EmbedLogo(img, o.Style, logo, o.LogoScale)
+	}
+	return img, err
+}
+
+// saveQRCode stores a newly rendered code on the caller's account.
+func saveQRCode(r *http.Request, qrCode QRCode) error {
+	return createQRCode(r.Context(), requestActor(r), qrCode)
+}
+
+// createQRCode saves a code made by actor outside of a request, such as
+// in a background job.
+func createQRCode(ctx context.Context, actor DomainActor, qrCode QRCode) error {
+	if err := db.QRCodes().Create(ctx, qrCode); err != nil {
+		return err
+	}
+	recordDomainEvent(actor, DomainEvent{
+		Type:          "qr_code.created",
+		AggregateType: aggregateQRCode,
+		AggregateID:   qrCode.ID,
+		OwnerID:       qrCode.UserID,
+		After:         snapshot(qrCode),
+	}, map[string]interface{}{
+		"ec_level": qrCode.ECLevel,
+		"version":  qrCode.Version,
+	})
+	return nil
+}
+
+// Handlers
+
+// createQRCodeHandler renders content as a PNG, or SVG if format asks, and
+// saves the code to the caller's account. The new code's ID is in the
+// X-QR-Code-ID header. Content is taken as is unless type asks for it to be
+// built, see qrPayload, and style sets colors, module shape, gradient and
+// quiet zone. A logo, saved or sent inline, goes in the middle and raises
+// the error correction level to H so the modules it hides can be recovered.
+// template_id fills in the options the request leaves out from a template.
+//
+// A dynamic code encodes a short redirect to target instead of content, so
+// the destination can be changed later; X-QR-Short-Code names it.
+func createQRCodeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		qrPayload
+		qrRenderOptions
+		TemplateID string `json:"template_id"`
+		Dynamic    bool   `json:"dynamic"`
+		Target     string `json:"target"`
+	}
+	// Room for an inline logo, base64 encoded
+	r.Body = http.MaxBytesReader(w, r.Body, maxQRLogoBytes*4/3+64*1024)
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	var content string
+	var err error
+	if req.Dynamic {
+		if req.Type != "" && req.Type != qrTypeText {
+			http.Error(w, "dynamic codes can only redirect to a target", http.StatusBadRequest)
+			return
+		}
+		err = validateTarget(req.Target)
+	} else {
+		content, err = req.build()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.TemplateID != "" {
+		template, err := db.QRTemplates().Get(r.Context(), userID, req.TemplateID)
+		if err != nil {
+			writeStorageError(w, r, err, "Template")
+			return
+		}
+		applyQRTemplate(template, &req.qrRenderOptions)
+	}
+	level, size, err := req.check()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var logo image.Image
+	if req.wanted() {
+		if logo, err = req.qrLogoOptions.load(r.Context(), userID); err != nil {
+			writeQRLogoError(w, err)
+			return
+		}
+		level = qr.LogoLevel
+	}
+
+	qrCode := QRCode{
+		ID:        generateID(),
+		UserID:    userID,
+		TeamID:    storage.TeamFrom(r.Context()),
+		Content:   content,
+		Size:      size,
+		CreatedAt: time.Now(),
+	}
+	if req.Dynamic {
+		qrCode.Target = req.Target
+	}
+
+	var code *qr.Code
+	for attempt := 1; ; attempt++ {
+		if req.Dynamic {
+			qrCode.ShortCode = newShortCode()
+			qrCode.Content = redirectLink(r, qrCode.ShortCode)
+		}
+		code, err = qr.Encode(qrCode.Content, level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		qrCode.ECLevel = string(code.Level)
+		qrCode.Version = code.Version
+
+		err = saveQRCode(r, qrCode)
+		// A short code collision just needs another short code
+		if !req.Dynamic || !errors.Is(err, storage.ErrConflict) || attempt == shortCodeAttempts {
+			break
+		}
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error saving QR code", "error", err)
+		http.Error(w, "Error saving QR code", http.StatusInternalServerError)
+		return
+	}
+
+	out, contentType, err := renderQR(code, size, req.qrRenderOptions, logo)
+	if err != nil {
+		logger(r.Context()).Error("Error rendering QR code", "error", err)
+		http.Error(w, "Error rendering QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-QR-Code-ID", qrCode.ID)
+	if qrCode.Dynamic() {
+		w.Header().Set("X-QR-Short-Code", qrCode.ShortCode)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(out)
+}
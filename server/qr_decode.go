@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+
+	"backup-manager/qr"
+)
+
+const maxQRDecodeBytes = 10 << 20
+
+// decodeQRHandler reads the QR code in an uploaded image, multipart field
+// "file", and returns its content, version and error correction level. An
+// optional "expected" field is compared with the content, for checking a
+// render or a print scans as intended.
+func decodeQRHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxQRDecodeBytes+4096)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Expected an image of at most %d bytes in the file field", maxQRDecodeBytes), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Error reading file", http.StatusBadRequest)
+		return
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "file must be a PNG, JPEG or GIF image", http.StatusBadRequest)
+		return
+	}
+	if cfg.Width*cfg.Height > maxQRLogoPixels {
+		http.Error(w, fmt.Sprintf("image is too large: %dx%d", cfg.Width, cfg.Height), http.StatusBadRequest)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "file must be a PNG, JPEG or GIF image", http.StatusBadRequest)
+		return
+	}
+
+	decoded, err := qr.Decode(img)
+	if err != nil {
+		// No code, an unreadable one or content this reader doesn't support
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	resp := struct {
+		*qr.Decoded
+		Matches *bool `json:"matches,omitempty"`
+	}{Decoded: decoded}
+	if _, ok := r.MultipartForm.Value["expected"]; ok {
+		matches := decoded.Content == r.FormValue("expected")
+		resp.Matches = &matches
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backup-manager/analytics"
+	"backup-manager/config"
+
+	"github.com/gorilla/mux"
+	"github.com/oschwald/geoip2-golang"
+)
+
+const defaultGeoDays = 30
+
+// geoDB is the MaxMind GeoLite2/GeoIP2 City database from GEOIP_DB_PATH.
+// Without it scans are still counted, under an unknown location.
+var geoDB *geoip2.Reader
+
+func initGeoIP() {
+	path := config.Get("GEOIP_DB_PATH")
+	if path == "" {
+		return
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		fatal("Failed to open GeoIP database", "path", path, "error", err)
+	}
+	geoDB = db
+}
+
+func lookupGeo(ip string) analytics.Location {
+	parsed := net.ParseIP(ip)
+	if geoDB == nil || parsed == nil {
+		return analytics.Location{}
+	}
+	record, err := geoDB.City(parsed)
+	if err != nil {
+		return analytics.Location{}
+	}
+
+	loc := analytics.Location{
+		CountryCode: record.Country.IsoCode,
+		Country:     record.Country.Names["en"],
+		City:        record.City.Names["en"],
+		// Round to about 1km so the rollup can't single anyone out
+		Latitude:  math.Round(record.Location.Latitude*100) / 100,
+		Longitude: math.Round(record.Location.Longitude*100) / 100,
+	}
+	if len(record.Subdivisions) > 0 {
+		loc.RegionCode = record.Subdivisions[0].IsoCode
+		loc.Region = record.Subdivisions[0].Names["en"]
+	}
+	return loc
+}
+
+// Handlers
+func getQRGeoAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	level := r.URL.Query().Get("level")
+	switch level {
+	case "":
+		level = analytics.LevelCountry
+	case analytics.LevelCountry, analytics.LevelRegion, analytics.LevelCity:
+	default:
+		http.Error(w, "level must be country, region or city", http.StatusBadRequest)
+		return
+	}
+
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days <= 0 || days > scanRetentionDays {
+		days = defaultGeoDays
+	}
+
+	// Someone else's code looks the same as one with no scans, so IDs can't
+	// be probed
+	since := time.Now().UTC().AddDate(0, 0, -(days - 1))
+	result, err := scanAnalytics.Geo(r.Context(), analytics.GeoQuery{QRID: id, OwnerID: userID, Level: level, Since: since})
+	if err != nil {
+		logger(r.Context()).Error("Error querying scan locations", "qr_id", id, "error", err)
+		http.Error(w, "Error loading analytics", http.StatusInternalServerError)
+		return
+	}
+
+	total := result.Unknown
+	for _, l := range result.Locations {
+		total += l.Scans
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"qr_id":     id,
+		"level":     level,
+		"days":      days,
+		"total":     total,
+		"unknown":   result.Unknown,
+		"locations": result.Locations,
+	})
+}
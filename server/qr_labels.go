@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"backup-manager/qr"
+)
+
+// Handlers
+func getLabelTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(qr.SortedLabelTemplates())
+}
+
+// sheetLayoutHandler returns where each code and caption goes on the chosen
+// label stock, so printed stickers line up without manual margin math.
+func sheetLayoutHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Template    string  `json:"template" validate:"required"`
+		Count       int     `json:"count" validate:"min=1,max=1000"`
+		Skip        int     `json:"skip" validate:"min=0"`
+		Padding     float64 `json:"padding_mm"`
+		CaptionSize float64 `json:"caption_size_mm"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	template, ok := qr.LabelTemplates[req.Template]
+	if !ok {
+		writeFieldError(w, "template", "oneof", "Unknown label template")
+		return
+	}
+
+	placements, err := qr.Layout(template, req.Count, qr.LayoutOptions{
+		Skip:        req.Skip,
+		Padding:     req.Padding,
+		CaptionSize: req.CaptionSize,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sheets := 0
+	if len(placements) > 0 {
+		sheets = placements[len(placements)-1].Sheet + 1
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"template":   template,
+		"sheets":     sheets,
+		"placements": placements,
+	})
+}
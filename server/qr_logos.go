@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"backup-manager/qr"
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	maxQRLogoBytes  = 1 << 20
+	maxQRLogoPixels = 16_000_000 // refuse to decode anything larger
+	// qrLogoEdge is the longest edge logos are stored at; a logo covers at
+	// most 30% of a code of up to qrMaxSize pixels
+	qrLogoEdge = 640
+)
+
+// QRLogo is an image saved to put in the middle of codes. The image itself
+// is a PNG in the blob store, encrypted like backup thumbnails.
+type QRLogo = storage.QRLogo
+
+func qrLogoBlobKey(userID, id string) string {
+	return "qr-logos/" + userID + "/" + id + ".png.enc"
+}
+
+// decodeLogo reads a PNG, JPEG or GIF and scales it down to qrLogoEdge,
+// keeping transparency. Errors are fit to show the client.
+func decodeLogo(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("logo must be a PNG, JPEG or GIF image")
+	}
+	if cfg.Width*cfg.Height > maxQRLogoPixels {
+		return nil, fmt.Errorf("logo is too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("logo must be a PNG, JPEG or GIF image")
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= qrLogoEdge && h <= qrLogoEdge {
+		return src, nil
+	}
+	if w >= h {
+		w, h = qrLogoEdge, max(1, h*qrLogoEdge/w)
+	} else {
+		w, h = max(1, w*qrLogoEdge/h), qrLogoEdge
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, b, xdraw.Src, nil)
+	return dst, nil
+}
+
+// decodeInlineLogo reads a logo sent with a request as base64, optionally
+// as a data: URL.
+func decodeInlineLogo(data string) (image.Image, error) {
+	if i := strings.Index(data, ","); strings.HasPrefix(data, "data:") && i >= 0 {
+		data = data[i+1:]
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, errors.New("logo must be base64")
+	}
+	if len(raw) > maxQRLogoBytes {
+		return nil, fmt.Errorf("logo must be at most %d bytes", maxQRLogoBytes)
+	}
+	return decodeLogo(raw)
+}
+
+func loadLogoImage(ctx context.Context, logo QRLogo) (image.Image, error) {
+	rc, err := blobStore.Get(ctx, qrLogoBlobKey(logo.UserID, logo.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	encrypted, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decrypt(string(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(strings.NewReader(plaintext))
+}
+
+// qrLogoOptions is how a request asks for a logo: a saved one by ID or an
+// image sent along, and its size as a fraction of the code's width.
+type qrLogoOptions struct {
+	LogoID    string  `json:"logo_id"`
+	Logo      string  `json:"logo"`
+	LogoScale float64 `json:"logo_scale"`
+}
+
+func (o qrLogoOptions) wanted() bool {
+	return o.LogoID != "" || o.Logo != ""
+}
+
+// load returns the requested logo image, filling in the default scale. A
+// saved logo that is missing is errQRLogoNotFound and one that can't be
+// read errQRLogoUnavailable; other errors are fit to show the client.
+func (o *qrLogoOptions) load(ctx context.Context, userID string) (image.Image, error) {
+	if o.LogoID != "" && o.Logo != "" {
+		return nil, errors.New("give logo_id or logo, not both")
+	}
+	if o.LogoScale == 0 {
+		o.LogoScale = qr.DefaultLogoScale
+	}
+	if o.LogoScale < qr.MinLogoScale || o.LogoScale > qr.MaxLogoScale {
+		return nil, fmt.Errorf("logo_scale must be between %.1f and %.1f", qr.MinLogoScale, qr.MaxLogoScale)
+	}
+	if o.Logo != "" {
+		return decodeInlineLogo(o.Logo)
+	}
+	logo, err := db.QRLogos().Get(ctx, userID, o.LogoID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, errQRLogoNotFound
+	} else if err != nil {
+		logger(ctx).Error("Database error", "loading", "logo", "error", err)
+		return nil, errQRLogoUnavailable
+	}
+	img, err := loadLogoImage(ctx, logo)
+	if err != nil {
+		logger(ctx).Error("Error loading logo", "logo_id", logo.ID, "error", err)
+		return nil, errQRLogoUnavailable
+	}
+	return img, nil
+}
+
+var (
+	errQRLogoNotFound    = errors.New("Logo not found")
+	errQRLogoUnavailable = errors.New("Error loading logo")
+)
+
+// writeQRLogoError responds to an error from qrLogoOptions.load.
+func writeQRLogoError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errQRLogoNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errQRLogoUnavailable):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// Handlers
+
+// uploadQRLogoHandler saves a logo from a multipart upload, field "file",
+// with an optional "name".
+func uploadQRLogoHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxQRLogoBytes+4096)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Expected a logo of at most %d bytes in the file field", maxQRLogoBytes), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Error reading file", http.StatusBadRequest)
+		return
+	}
+	img, err := decodeLogo(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, "Error saving logo", http.StatusInternalServerError)
+		return
+	}
+	encrypted, err := encrypt(buf.String())
+	if err != nil {
+		http.Error(w, "Error saving logo", http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = header.Filename
+	}
+	logo := QRLogo{
+		ID:        generateID(),
+		UserID:    userID,
+		Name:      truncate(name, 100),
+		Width:     img.Bounds().Dx(),
+		Height:    img.Bounds().Dy(),
+		CreatedAt: time.Now(),
+	}
+	if err := blobStore.Put(r.Context(), qrLogoBlobKey(userID, logo.ID), []byte(encrypted), "application/octet-stream"); err != nil {
+		logger(r.Context()).Error("Error storing logo", "error", err)
+		http.Error(w, "Error saving logo", http.StatusInternalServerError)
+		return
+	}
+	if err := db.QRLogos().Create(r.Context(), logo); err != nil {
+		blobStore.Delete(r.Context(), qrLogoBlobKey(userID, logo.ID))
+		writeStorageError(w, r, err, "Logo")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(logo)
+}
+
+func getQRLogosHandler(w http.ResponseWriter, r *http.Request) {
+	logos, err := db.QRLogos().List(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Logos")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logos)
+}
+
+// getQRLogoImageHandler returns the stored logo as a PNG.
+func getQRLogoImageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	logo, err := db.QRLogos().Get(r.Context(), userID, mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Logo")
+		return
+	}
+	img, err := loadLogoImage(r.Context(), logo)
+	if err != nil {
+		logger(r.Context()).Error("Error loading logo", "error", err)
+		http.Error(w, "Error loading logo", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, img)
+}
+
+func deleteQRLogoHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if err := db.QRLogos().Delete(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Logo")
+		return
+	}
+	if err := blobStore.Delete(r.Context(), qrLogoBlobKey(userID, id)); err != nil {
+		logger(r.Context()).Warn("Error deleting logo image", "logo_id", id, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
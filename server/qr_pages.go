@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/i18n"
+
+	"github.com/gorilla/mux"
+)
+
+// Pages shown to someone who scans a QR code instead of, or before, being
+// redirected.
+const (
+	qrPageLanding  = "landing"
+	qrPagePassword = "password"
+	qrPageExpired  = "expired"
+	qrPageNotLive  = "not_live"
+)
+
+var translations *i18n.Bundle
+
+// initTranslations loads the built-in translations and any overrides in
+// TRANSLATIONS_DIR.
+func initTranslations() {
+	bundle, err := i18n.New()
+	if err != nil {
+		fatal("Failed to load translations", "error", err)
+	}
+	if dir := config.Get("TRANSLATIONS_DIR"); dir != "" {
+		if err := bundle.LoadDir(dir); err != nil {
+			fatal("Failed to load translations", "dir", dir, "error", err)
+		}
+	}
+	translations = bundle
+}
+
+// qrPageLanguage picks the language for a scan page: the QR code's own
+// language if its owner chose one we support, otherwise whatever the
+// scanner's browser asks for.
+func qrPageLanguage(r *http.Request, qrLanguage string) string {
+	if lang := translations.Match(qrLanguage); lang != "" {
+		return lang
+	}
+	return translations.Negotiate(r.Header.Get("Accept-Language"))
+}
+
+// qrPageData is what a scan page shows. Target is the destination for the
+// landing page, Date the expiry or go-live time, and Error a password page
+// error code from writeQRPasswordError.
+type qrPageData struct {
+	Slug   string
+	Target string
+	Date   time.Time
+	Error  string
+}
+
+var qrPageTemplate = template.Must(template.New("qr_page").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+<style>
+body{font-family:system-ui,sans-serif;margin:0;min-height:100vh;display:flex;align-items:center;justify-content:center;background:#f5f5f5;color:#222}
+main{background:#fff;max-width:26rem;margin:1rem;padding:2rem;border-radius:.75rem;box-shadow:0 1px 4px rgba(0,0,0,.1)}
+h1{font-size:1.3rem;margin-top:0}
+.error{color:#b00020}
+input{width:100%;box-sizing:border-box;padding:.6rem;margin:.4rem 0 1rem;font-size:1rem}
+a.button,button{display:inline-block;padding:.6rem 1.2rem;background:#1a4d8f;color:#fff;border:0;border-radius:.4rem;font-size:1rem;text-decoration:none;cursor:pointer}
+footer{margin-top:2rem;font-size:.8rem;color:#888}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Heading}}</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Error}}<p class="error" role="alert">{{.Error}}</p>{{end}}
+{{if eq .Page "landing"}}<p><a class="button" href="{{.Target}}" rel="noopener">{{.Continue}}</a></p>{{end}}
+{{if eq .Page "password"}}<form method="post">
+<label for="password">{{.PasswordLabel}}</label>
+<input id="password" name="password" type="password" autocomplete="off" required autofocus>
+<button type="submit">{{.Submit}}</button>
+</form>{{end}}
+<footer>{{.Footer}}</footer>
+</main>
+</body>
+</html>
+`))
+
+// renderQRPage writes a scan page in the language picked by qrPageLanguage.
+func renderQRPage(w http.ResponseWriter, r *http.Request, status int, page, qrLanguage string, data qrPageData) {
+	lang := qrPageLanguage(r, qrLanguage)
+	t := func(key string, args ...string) string { return translations.T(lang, key, args...) }
+
+	view := map[string]interface{}{
+		"Lang":   lang,
+		"Page":   page,
+		"Title":  t("page.title"),
+		"Footer": t("footer"),
+	}
+	switch page {
+	case qrPageLanding:
+		host := data.Target
+		if u, err := url.Parse(data.Target); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		view["Heading"] = t("landing.heading")
+		view["Message"] = t("landing.message", "host", host)
+		view["Continue"] = t("landing.continue")
+		view["Target"] = data.Target
+	case qrPagePassword:
+		view["Heading"] = t("password.heading")
+		view["Message"] = t("password.message")
+		view["PasswordLabel"] = t("password.label")
+		view["Submit"] = t("password.submit")
+		switch data.Error {
+		case "wrong_password":
+			view["Error"] = t("password.wrong")
+		case "locked":
+			view["Error"] = t("password.locked")
+		case "captcha_required":
+			view["Error"] = t("password.captcha")
+		}
+	case qrPageExpired:
+		view["Heading"] = t("expired.heading")
+		view["Message"] = t("expired.message", "date", translations.Date(lang, data.Date))
+	case qrPageNotLive:
+		view["Heading"] = t("not_live.heading")
+		view["Message"] = t("not_live.message", "date", translations.Date(lang, data.Date))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", pageContentSecurityPolicy)
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	if err := qrPageTemplate.Execute(w, view); err != nil {
+		logger(r.Context()).Error("Error rendering QR page", "page", page, "error", err)
+	}
+}
+
+// Handlers
+func getQRPageLanguagesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"languages": translations.Languages(),
+		"default":   i18n.DefaultLanguage,
+	})
+}
+
+// updateQRPagesHandler sets a dynamic code's page language, the period it
+// redirects in and whether it shows a landing page. Fields left out are
+// cleared.
+func updateQRPagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Language    string     `json:"language" validate:"max=16"`
+		LiveAt      *time.Time `json:"live_at"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+		LandingPage bool       `json:"landing_page"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Language != "" && translations.Match(req.Language) == "" {
+		writeFieldError(w, "language", "oneof", "Unsupported language: "+req.Language)
+		return
+	}
+	if req.LiveAt != nil && req.ExpiresAt != nil && !req.ExpiresAt.After(*req.LiveAt) {
+		writeFieldError(w, "expires_at", "gtfield", "expires_at must be after live_at")
+		return
+	}
+
+	code, err := db.QRCodes().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+	if !code.Dynamic() {
+		http.Error(w, "Only dynamic QR codes have scan pages", http.StatusConflict)
+		return
+	}
+
+	before := code
+	code.Language, code.LiveAt, code.ExpiresAt, code.LandingPage = req.Language, req.LiveAt, req.ExpiresAt, req.LandingPage
+	if err := db.QRCodes().UpdatePages(r.Context(), userID, code); err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "qr_code.updated",
+		AggregateType: aggregateQRCode,
+		AggregateID:   id,
+		OwnerID:       code.UserID,
+		Before:        snapshot(before),
+		After:         snapshot(code),
+	}, map[string]interface{}{"fields": []string{"language", "live_at", "expires_at", "landing_page"}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(code)
+}
+
+// previewQRPageHandler renders a scan page with sample data so owners can
+// see it in each language. ?lang= picks the language as a QR code's own
+// language setting would; without it Accept-Language is used.
+func previewQRPageHandler(w http.ResponseWriter, r *http.Request) {
+	page := mux.Vars(r)["page"]
+	data := qrPageData{Slug: "preview", Target: "https://example.com/", Error: r.URL.Query().Get("error")}
+
+	switch page {
+	case qrPageExpired:
+		data.Date = time.Now().AddDate(0, 0, -1)
+	case qrPageNotLive:
+		data.Date = time.Now().AddDate(0, 0, 7)
+	case qrPageLanding, qrPagePassword:
+	default:
+		http.Error(w, "Unknown page", http.StatusNotFound)
+		return
+	}
+
+	renderQRPage(w, r, http.StatusOK, page, r.URL.Query().Get("lang"), data)
+}
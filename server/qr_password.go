@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	qrPasswordCaptchaAfter = 3  // failures before a CAPTCHA is required
+	qrPasswordLockAfter    = 10 // failures before the slug is locked
+	qrPasswordLockDuration = 15 * time.Minute
+	qrPasswordWindow       = time.Hour // failures older than this are forgotten
+	qrPasswordIPRate       = 10        // attempts per minute per IP and slug
+)
+
+// qrPasswordGuard counts failed password attempts per QR slug. Counting by
+// slug rather than by IP means an attacker rotating addresses still trips the
+// CAPTCHA and lockout thresholds. The counts are kept in the database with
+// the failed logins, so every server sees them.
+type qrPasswordGuard struct{}
+
+var (
+	qrPasswordAttempts qrPasswordGuard
+	qrPasswordLimiter  = newRateLimiter()
+)
+
+func qrPasswordKey(slug string) string {
+	return "qr:" + slug
+}
+
+func (qrPasswordGuard) check(ctx context.Context, key string) (captchaRequired bool, lockedFor time.Duration, err error) {
+	a, err := db.Attempts().Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	if a.LockedUntil != nil {
+		if remaining := time.Until(*a.LockedUntil); remaining > 0 {
+			return true, remaining, nil
+		}
+	}
+	if time.Since(a.LastFailure) > qrPasswordWindow {
+		return false, 0, nil
+	}
+	return a.Failures >= qrPasswordCaptchaAfter, 0, nil
+}
+
+// fail records a failed attempt and returns the failure count in the window.
+func (qrPasswordGuard) fail(ctx context.Context, key string) (int, error) {
+	now := time.Now()
+	a, err := db.Attempts().Fail(ctx, key, now, now.Add(-qrPasswordWindow))
+	if err != nil {
+		return 0, err
+	}
+	if a.Failures%qrPasswordLockAfter == 0 {
+		return a.Failures, db.Attempts().Lock(ctx, key, now.Add(qrPasswordLockDuration))
+	}
+	return a.Failures, nil
+}
+
+func (qrPasswordGuard) reset(ctx context.Context, key string) error {
+	return db.Attempts().Reset(ctx, key)
+}
+
+// checkQRPassword checks the password posted for a protected QR code,
+// rendering the password page again with the reason and returning false
+// when it is refused: the attempt is rate limited, the slug is locked, a
+// valid CAPTCHA is missing or the password is wrong.
+func checkQRPassword(w http.ResponseWriter, r *http.Request, code QRCode) bool {
+	if !guardQRPasswordAttempt(w, r, code, r.PostFormValue("captcha_token")) {
+		return false
+	}
+	ok := passwordMatches(r.Context(), code.PasswordHash, r.PostFormValue("password"))
+	recordQRPasswordResult(r, code, ok)
+	if !ok {
+		writeQRPasswordError(w, r, code, http.StatusUnauthorized, "wrong_password", 0)
+	}
+	return ok
+}
+
+// guardQRPasswordAttempt must run before checking the password submitted for
+// a protected QR page. It writes the rejection and returns false when the
+// attempt is rate limited, the slug is locked, or a valid CAPTCHA is missing.
+func guardQRPasswordAttempt(w http.ResponseWriter, r *http.Request, code QRCode, captchaToken string) bool {
+	slug := code.ShortCode
+	ip := clientIP(r)
+
+	if allowed, _, retryAfter := qrPasswordLimiter.allow(slug+"|"+ip, qrPasswordIPRate); !allowed {
+		writeQRPasswordError(w, r, code, http.StatusTooManyRequests, "locked", retryAfter)
+		return false
+	}
+
+	captchaRequired, lockedFor, err := qrPasswordAttempts.check(r.Context(), qrPasswordKey(slug))
+	if err != nil {
+		writeStorageError(w, r, err, "Password attempts")
+		return false
+	}
+	if lockedFor > 0 {
+		writeQRPasswordError(w, r, code, http.StatusTooManyRequests, "locked", lockedFor)
+		return false
+	}
+
+	if captchaRequired && captchaEnabled() {
+		ok, err := verifyCaptcha(captchaToken, ip)
+		if err != nil {
+			logger(r.Context()).Error("Error verifying CAPTCHA", "error", err)
+		}
+		if !ok {
+			writeQRPasswordError(w, r, code, http.StatusForbidden, "captcha_required", 0)
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordQRPasswordResult updates the slug's counters after a password check
+// and audits repeated failures.
+func recordQRPasswordResult(r *http.Request, code QRCode, success bool) {
+	key := qrPasswordKey(code.ShortCode)
+	if success {
+		if err := qrPasswordAttempts.reset(r.Context(), key); err != nil {
+			logger(r.Context()).Error("Error clearing failed QR passwords", "error", err)
+		}
+		return
+	}
+
+	failures, err := qrPasswordAttempts.fail(r.Context(), key)
+	if err != nil {
+		logger(r.Context()).Error("Error counting failed QR password", "error", err)
+	}
+	if failures >= qrPasswordCaptchaAfter {
+		recordAudit(r, AuditEvent{
+			Action:       "qr.password_failed",
+			ResourceType: "qr_code",
+			ResourceID:   code.ID,
+			Metadata: map[string]interface{}{
+				"slug":     code.ShortCode,
+				"failures": failures,
+				"locked":   failures%qrPasswordLockAfter == 0,
+			},
+		})
+	}
+}
+
+// writeQRPasswordError renders the password page again with the error
+// code, asking the scanner to wait retryAfter if it is set.
+func writeQRPasswordError(w http.ResponseWriter, r *http.Request, qr QRCode, status int, code string, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	renderQRPage(w, r, status, qrPagePassword, qr.Language, qrPageData{Slug: qr.ShortCode, Error: code})
+}
+
+// Handlers
+
+// setQRPasswordHandler makes scanners of a dynamic code enter a password
+// before they are redirected, replacing any password it had.
+func setQRPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Password string `json:"password" validate:"required,min=4,max=128"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+	updateQRPassword(w, r, userID, id, hash)
+}
+
+func deleteQRPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	updateQRPassword(w, r, r.Header.Get("X-User-ID"), mux.Vars(r)["id"], "")
+}
+
+func updateQRPassword(w http.ResponseWriter, r *http.Request, userID, id, hash string) {
+	code, err := db.QRCodes().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+	if !code.Dynamic() {
+		http.Error(w, "Only dynamic QR codes can have a password", http.StatusConflict)
+		return
+	}
+	if err := db.QRCodes().SetPassword(r.Context(), userID, id, hash); err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+
+	before := code
+	code.PasswordHash, code.HasPassword = hash, hash != ""
+	action := "qr.password_set"
+	if hash == "" {
+		action = "qr.password_removed"
+	}
+	recordAudit(r, AuditEvent{Action: action, ResourceType: "qr_code", ResourceID: id})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "qr_code.updated",
+		AggregateType: aggregateQRCode,
+		AggregateID:   id,
+		OwnerID:       code.UserID,
+		Before:        snapshot(before),
+		After:         snapshot(code),
+	}, map[string]interface{}{"fields": []string{"password"}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(code)
+}
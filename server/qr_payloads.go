@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"sort"
+
+	"backup-manager/qr"
+)
+
+// Handlers
+func contactPayloadHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Contact     qr.Contact `json:"contact"`
+		Format      string     `json:"format" validate:"oneof=vcard mecard auto"`
+		ECLevel     string     `json:"ec_level" validate:"oneofci=L M Q H"`
+		MaxVersion  int        `json:"max_version"`
+		PrintSizeMM float64    `json:"print_size_mm"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	level, _ := qr.ParseECLevel(req.ECLevel)
+	if req.Contact.FirstName == "" && req.Contact.LastName == "" {
+		writeFieldError(w, "contact", "required", "contact needs a first or last name")
+		return
+	}
+
+	encoded, err := qr.EncodeContact(req.Contact, req.Format, level, req.MaxVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	lint := qr.Lint(encoded.Payload, qr.LintOptions{ECLevel: level, PrintSizeMM: req.PrintSizeMM})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		qr.EncodedContact
+		Warnings []qr.Warning `json:"warnings"`
+	}{encoded, lint.Warnings})
+}
+
+// lintPayloadHandler checks content and print settings before a code is
+// generated, returning the version it needs and structured warnings.
+func lintPayloadHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Content     string  `json:"content"`
+		ECLevel     string  `json:"ec_level" validate:"oneofci=L M Q H"`
+		Version     int     `json:"version" validate:"min=0,max=40"`
+		PrintSizeMM float64 `json:"print_size_mm"`
+		QuietZone   int     `json:"quiet_zone"`
+		Foreground  string  `json:"foreground"`
+		Background  string  `json:"background"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	level, _ := qr.ParseECLevel(req.ECLevel)
+	result := qr.Lint(req.Content, qr.LintOptions{
+		ECLevel:     level,
+		Version:     req.Version,
+		PrintSizeMM: req.PrintSizeMM,
+		QuietZone:   req.QuietZone,
+		Foreground:  req.Foreground,
+		Background:  req.Background,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkColorsHandler rates a foreground/background pair for scanning and
+// suggests the nearest pair with enough contrast when it falls short.
+func checkColorsHandler(w http.ResponseWriter, r *http.Request) {
+	var req qr.ColorPair
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	result := qr.LintResult{Warnings: []qr.Warning{}}
+	contrast, err := qr.CheckContrast(&result, req.Foreground, req.Background)
+	if err != nil {
+		http.Error(w, "foreground and background must be hex colors", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		qr.ContrastResult
+		Acceptable bool         `json:"acceptable"`
+		Warnings   []qr.Warning `json:"warnings"`
+	}{contrast, !result.HasErrors(), result.Warnings})
+}
+
+// getFrameTemplatesHandler lists the frames and caption fonts a style can use.
+func getFrameTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	fonts := make([]string, 0, len(qr.FrameFonts))
+	for name := range qr.FrameFonts {
+		fonts = append(fonts, name)
+	}
+	sort.Strings(fonts)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"templates": qr.FrameTemplates,
+		"fonts":     fonts,
+	})
+}
+
+// previewFrameHandler draws a frame around a placeholder code so a style can
+// be checked before it is saved. ?format=svg returns SVG instead of PNG.
+func previewFrameHandler(w http.ResponseWriter, r *http.Request) {
+	var style qr.FrameStyle
+	if !decodeRequest(w, r, &style) {
+		return
+	}
+	if err := style.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	const size = 256
+	if r.URL.Query().Get("format") == "svg" {
+		placeholder := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d"><rect width="100%%" height="100%%" fill="#cccccc"/></svg>`, size, size)
+		out, err := qr.FrameSVG(placeholder, size, style)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(out))
+		return
+	}
+
+	placeholder := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(placeholder, placeholder.Bounds(), image.NewUniform(color.Gray{Y: 0xcc}), image.Point{}, draw.Src)
+	out, err := qr.DrawFrame(placeholder, style)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, out)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	shortCodeLength   = 8
+	shortCodeAlphabet = "23456789abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ" // no 0/O, 1/l/I
+	maxTargetLength   = 2048
+	// Attempts at an unused short code before giving up
+	shortCodeAttempts = 5
+)
+
+func newShortCode() string {
+	b := make([]byte, shortCodeLength)
+	max := big.NewInt(int64(len(shortCodeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = shortCodeAlphabet[n.Int64()]
+	}
+	return string(b)
+}
+
+// redirectLink is the URL a dynamic code encodes.
+func redirectLink(r *http.Request, shortCode string) string {
+	return publicLink(r, "/r/"+shortCode)
+}
+
+// publicLink is the URL of path on this server for people without an
+// account. QR_REDIRECT_BASE_URL is this server's public address; without it
+// the address r came in on is used, which is only right when nothing
+// rewrites the host.
+func publicLink(r *http.Request, path string) string {
+	base := config.Get("QR_REDIRECT_BASE_URL")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+// validateTarget checks a redirect destination is an absolute http(s) URL.
+func validateTarget(target string) error {
+	if target == "" {
+		return errors.New("target is required")
+	}
+	if len(target) > maxTargetLength {
+		return errors.New("target is too long")
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("target must be an http or https URL")
+	}
+	return nil
+}
+
+// Handlers
+
+// qrRedirectHandler sends someone who scanned a dynamic code on to its
+// current target. The redirect is temporary so browsers don't cache it past
+// a target change. Outside the code's live period a page says so instead; a
+// code with a password shows the password page first, which posts back
+// here; and one with a landing page shows the target there.
+func qrRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	code, err := db.QRCodes().GetByShortCode(r.Context(), mux.Vars(r)["code"])
+	if errors.Is(err, storage.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error loading QR code for redirect", "error", err)
+		http.Error(w, "Error loading QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	now := time.Now()
+	if code.LiveAt != nil && now.Before(*code.LiveAt) {
+		renderQRPage(w, r, http.StatusForbidden, qrPageNotLive, code.Language, qrPageData{Slug: code.ShortCode, Date: *code.LiveAt})
+		return
+	}
+	if code.ExpiresAt != nil && !now.Before(*code.ExpiresAt) {
+		renderQRPage(w, r, http.StatusGone, qrPageExpired, code.Language, qrPageData{Slug: code.ShortCode, Date: *code.ExpiresAt})
+		return
+	}
+
+	status := http.StatusFound
+	if code.PasswordHash != "" {
+		if r.Method != http.MethodPost {
+			renderQRPage(w, r, http.StatusOK, qrPagePassword, code.Language, qrPageData{Slug: code.ShortCode})
+			return
+		}
+		if !checkQRPassword(w, r, code) {
+			return
+		}
+		// Have the browser follow with a GET rather than repost the form
+		status = http.StatusSeeOther
+	}
+
+	recordQRScan(r, code.ID, code.UserID)
+	if code.LandingPage {
+		renderQRPage(w, r, http.StatusOK, qrPageLanding, code.Language, qrPageData{Slug: code.ShortCode, Target: code.Target})
+		return
+	}
+	http.Redirect(w, r, code.Target, status)
+}
+
+func updateQRTargetHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Target string `json:"target" validate:"required,max=2048"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := validateTarget(req.Target); err != nil {
+		writeFieldError(w, "target", "url", err.Error())
+		return
+	}
+
+	code, err := db.QRCodes().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+	if !code.Dynamic() {
+		http.Error(w, "Only dynamic QR codes have a target", http.StatusConflict)
+		return
+	}
+
+	before := code
+	code.Target = req.Target
+	err = db.QRCodes().UpdateTarget(r.Context(), userID, storage.QRTarget{
+		QRCodeID:  id,
+		Target:    req.Target,
+		ChangedBy: userID,
+		ChangedAt: time.Now(),
+	})
+	if err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "qr_code.updated",
+		AggregateType: aggregateQRCode,
+		AggregateID:   id,
+		OwnerID:       userID,
+		Before:        snapshot(before),
+		After:         snapshot(code),
+	}, map[string]interface{}{"fields": []string{"target"}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(code)
+}
+
+func getQRTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	targets, err := db.QRCodes().Targets(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"qr_code_id": id,
+		"targets":    targets,
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"backup-manager/qr"
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const maxQRTemplates = 100 // per user
+
+// QRTemplate is a named set of rendering options; see storage.QRTemplate.
+type QRTemplate = storage.QRTemplate
+
+// applyQRTemplate fills in the options o leaves out from t. Style is merged
+// field by field, so a request can change one color and keep the rest.
+func applyQRTemplate(t QRTemplate, o *qrRenderOptions) {
+	if o.ECLevel == "" {
+		o.ECLevel = t.ECLevel
+	}
+	if o.Size == 0 {
+		o.Size = t.Size
+	}
+	if o.Format == "" {
+		o.Format = t.Format
+	}
+	if !o.wanted() {
+		o.LogoID = t.LogoID
+	}
+	if o.LogoScale == 0 {
+		o.LogoScale = t.LogoScale
+	}
+
+	s := &o.Style
+	if s.Foreground == "" {
+		s.Foreground = t.Style.Foreground
+	}
+	if s.Background == "" {
+		s.Background = t.Style.Background
+	}
+	if s.Modules == "" {
+		s.Modules = t.Style.Modules
+	}
+	if s.Gradient == nil {
+		s.Gradient = t.Style.Gradient
+	}
+	if s.QuietZone == nil {
+		s.QuietZone = t.Style.QuietZone
+	}
+}
+
+var (
+	errQRTemplateNameTaken = errors.New("A template with this name already exists")
+	errQRTemplateLimit     = fmt.Errorf("at most %d templates per user", maxQRTemplates)
+)
+
+// readQRTemplate reads and checks a template from a request body. The logo,
+// if any, must be one the user has saved. On failure it writes the response
+// and returns false.
+func readQRTemplate(w http.ResponseWriter, r *http.Request) (QRTemplate, bool) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Name string `json:"name" validate:"required,max=100"`
+		qrRenderOptions
+	}
+	if !decodeRequest(w, r, &req) {
+		return QRTemplate{}, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Logo != "" {
+		writeFieldError(w, "logo", "unsupported", "templates take a saved logo_id, not an inline logo")
+		return QRTemplate{}, false
+	}
+	format := req.Format
+	if _, _, err := req.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return QRTemplate{}, false
+	}
+	if req.LogoID != "" {
+		if _, err := db.QRLogos().Get(r.Context(), userID, req.LogoID); errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Logo not found", http.StatusBadRequest)
+			return QRTemplate{}, false
+		} else if err != nil {
+			writeStorageError(w, r, err, "Logo")
+			return QRTemplate{}, false
+		}
+	}
+	if req.LogoScale != 0 && (req.LogoScale < qr.MinLogoScale || req.LogoScale > qr.MaxLogoScale) {
+		http.Error(w, fmt.Sprintf("logo_scale must be between %.1f and %.1f", qr.MinLogoScale, qr.MaxLogoScale), http.StatusBadRequest)
+		return QRTemplate{}, false
+	}
+
+	// Unset options stay unset, so the defaults apply when it is used
+	return QRTemplate{
+		UserID:    userID,
+		Name:      truncate(req.Name, 100),
+		ECLevel:   strings.ToUpper(req.ECLevel),
+		Size:      req.Size,
+		Format:    format,
+		Style:     req.Style,
+		LogoID:    req.LogoID,
+		LogoScale: req.LogoScale,
+	}, true
+}
+
+func writeQRTemplateError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, storage.ErrConflict) {
+		http.Error(w, errQRTemplateNameTaken.Error(), http.StatusConflict)
+		return
+	}
+	writeStorageError(w, r, err, "Template")
+}
+
+// Handlers
+
+func createQRTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	template, ok := readQRTemplate(w, r)
+	if !ok {
+		return
+	}
+	count, err := db.QRTemplates().Count(r.Context(), template.UserID)
+	if err != nil {
+		writeStorageError(w, r, err, "Templates")
+		return
+	}
+	if count >= maxQRTemplates {
+		http.Error(w, errQRTemplateLimit.Error(), http.StatusBadRequest)
+		return
+	}
+	template.ID = generateID()
+	template.CreatedAt = time.Now()
+	template.UpdatedAt = template.CreatedAt
+	if err := db.QRTemplates().Create(r.Context(), template); err != nil {
+		writeQRTemplateError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(template)
+}
+
+func getQRTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := db.QRTemplates().List(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Templates")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+func getQRTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	template, err := db.QRTemplates().Get(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Template")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+// updateQRTemplateHandler replaces a template's name and options. Codes
+// already made from it are unchanged.
+func updateQRTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	existing, err := db.QRTemplates().Get(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Template")
+		return
+	}
+	template, ok := readQRTemplate(w, r)
+	if !ok {
+		return
+	}
+	template.ID = existing.ID
+	template.CreatedAt = existing.CreatedAt
+	template.UpdatedAt = time.Now()
+	if err := db.QRTemplates().Update(r.Context(), template); err != nil {
+		writeQRTemplateError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+func deleteQRTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if err := db.QRTemplates().Delete(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"]); err != nil {
+		writeStorageError(w, r, err, "Template")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
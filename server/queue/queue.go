@@ -0,0 +1,73 @@
+// Package queue hands job IDs from the servers that accept work to the
+// workers that do it: through a channel within one server, or through a
+// Redis list shared by several.
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ErrFull is returned by Push when an in-memory queue has no room.
+var ErrFull = errors.New("queue: full")
+
+// Queue is first in, first out. Delivery is at most once: an ID popped by
+// a worker that dies is gone, so whoever tracks the jobs must notice and
+// push it again.
+type Queue interface {
+	Push(ctx context.Context, id string) error
+	// Pop blocks until an ID is available or ctx is done.
+	Pop(ctx context.Context) (string, error)
+	Close() error
+}
+
+// Open returns the queue for a URL: "redis://[:password@]host:port[/db]",
+// or "rediss://" for Redis over TLS, holding the list named key, or an
+// in-memory queue of size IDs when rawURL is empty.
+func Open(rawURL, key string, size int) (Queue, error) {
+	if rawURL == "" {
+		return NewMemory(size), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("queue: invalid URL: %w", err)
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		return newRedis(u, key)
+	default:
+		return nil, fmt.Errorf("queue: unsupported scheme %q", u.Scheme)
+	}
+}
+
+// Memory is a queue within one process. IDs in it are lost on restart.
+type Memory struct {
+	ids chan string
+}
+
+func NewMemory(size int) *Memory {
+	return &Memory{ids: make(chan string, size)}
+}
+
+// Push never blocks; it returns ErrFull instead.
+func (m *Memory) Push(ctx context.Context, id string) error {
+	select {
+	case m.ids <- id:
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+func (m *Memory) Pop(ctx context.Context) (string, error) {
+	select {
+	case id := <-m.ids:
+		return id, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (m *Memory) Close() error { return nil }
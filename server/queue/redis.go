@@ -0,0 +1,233 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	redisTimeout     = 10 * time.Second
+	// redisPopWait is how long one BRPOP blocks, which bounds how late Pop
+	// notices its context is done
+	redisPopWait = 5
+)
+
+// Redis is a queue in a Redis list: Push is LPUSH and Pop is BRPOP. It
+// speaks just enough of the protocol for that, over one connection for
+// pushes and one per concurrent Pop.
+type Redis struct {
+	addr     string
+	tls      bool
+	password string
+	db       int
+	key      string
+
+	mu   sync.Mutex
+	push *redisConn
+	idle []*redisConn
+}
+
+func newRedis(u *url.URL, key string) (*Redis, error) {
+	r := &Redis{addr: u.Host, tls: u.Scheme == "rediss", key: key}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		// redis://:password@host has an empty user name
+		if p, ok := u.User.Password(); ok {
+			r.password = p
+		} else {
+			r.password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("queue: invalid Redis database %q", db)
+		}
+		r.db = n
+	}
+	return r, nil
+}
+
+func (r *Redis) Push(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.push == nil {
+		c, err := r.dial(ctx)
+		if err != nil {
+			return err
+		}
+		r.push = c
+	}
+	if _, err := r.push.do(redisTimeout, "LPUSH", r.key, id); err != nil {
+		r.push.Close()
+		r.push = nil
+		return err
+	}
+	return nil
+}
+
+func (r *Redis) Pop(ctx context.Context) (string, error) {
+	c, err := r.take(ctx)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			r.put(c)
+			return "", err
+		}
+		reply, err := c.do(redisTimeout+redisPopWait*time.Second, "BRPOP", r.key, strconv.Itoa(redisPopWait))
+		if err != nil {
+			c.Close()
+			return "", err
+		}
+		// A timeout is a nil reply; an ID comes as [key, id]
+		if items, ok := reply.([]interface{}); ok && len(items) == 2 {
+			if id, ok := items[1].(string); ok {
+				r.put(c)
+				return id, nil
+			}
+		}
+	}
+}
+
+func (r *Redis) take(ctx context.Context) (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+	return r.dial(ctx)
+}
+
+func (r *Redis) put(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idle = append(r.idle, c)
+}
+
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.push != nil {
+		r.push.Close()
+		r.push = nil
+	}
+	for _, c := range r.idle {
+		c.Close()
+	}
+	r.idle = nil
+	return nil
+}
+
+func (r *Redis) dial(ctx context.Context) (*redisConn, error) {
+	d := &net.Dialer{Timeout: redisDialTimeout}
+	var conn net.Conn
+	var err error
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.addr)
+		conn, err = (&tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}).DialContext(ctx, "tcp", r.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("queue: connecting to Redis: %w", err)
+	}
+	c := &redisConn{conn: conn, br: bufio.NewReader(conn)}
+	if r.password != "" {
+		if _, err := c.do(redisTimeout, "AUTH", r.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.do(redisTimeout, "SELECT", strconv.Itoa(r.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type redisConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (c *redisConn) Close() error { return c.conn.Close() }
+
+// do sends a command and reads its reply: a string, an int64, nil, or a
+// slice of those. An error reply is returned as an error.
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("queue: empty Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("queue: Redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.br, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("queue: unexpected Redis reply %q", line)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+)
+
+// errQuotaExceeded is returned when storing a backup would take its owner
+// past their storage quota. Its message is fit to show the owner.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// storageQuotas are the storage quotas, in bytes, of each plan. A user
+// without one of their own, on a plan not listed, has defaultStorageQuota;
+// with neither, storage is unlimited.
+var (
+	storageQuotas       = map[string]int64{}
+	defaultStorageQuota int64
+)
+
+// loadStorageQuotas reads STORAGE_QUOTA, the quota of every plan, and
+// STORAGE_QUOTAS, those of particular plans as "free=1GB,pro=100GB".
+// Sizes are in bytes or with a KB, MB, GB or TB suffix, in powers of 1024.
+func loadStorageQuotas() {
+	if v := config.Get("STORAGE_QUOTA"); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			fatal("Invalid STORAGE_QUOTA", "value", v, "error", err)
+		}
+		defaultStorageQuota = n
+	}
+	for _, entry := range strings.Split(config.Get("STORAGE_QUOTAS"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		plan, size, ok := strings.Cut(entry, "=")
+		n, err := parseByteSize(size)
+		if !ok || strings.TrimSpace(plan) == "" || err != nil {
+			fatal("Invalid STORAGE_QUOTAS", "entry", entry)
+		}
+		storageQuotas[strings.TrimSpace(plan)] = n
+	}
+}
+
+var byteSizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize reads a size such as "500MB" or "1073741824".
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	scale := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, scale = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return n * scale, nil
+}
+
+// storageQuota returns the user's quota in bytes, and false if they have
+// none.
+func storageQuota(user User) (int64, bool) {
+	if user.StorageQuota != nil {
+		return *user.StorageQuota, true
+	}
+	if n, ok := storageQuotas[user.Plan]; ok {
+		return n, true
+	}
+	return defaultStorageQuota, defaultStorageQuota > 0
+}
+
+// storageRemaining returns how many more bytes of backups the user can
+// store, and false if there is no limit.
+func storageRemaining(ctx context.Context, userID string) (int64, bool, error) {
+	user, err := db.Users().Get(ctx, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	quota, limited := storageQuota(user)
+	if !limited {
+		return 0, false, nil
+	}
+	usage, err := db.UserUsage(ctx, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	return max(quota-usage.BackupBytes, 0), true, nil
+}
+
+// quotaReader fails with errQuotaExceeded once more than remaining bytes
+// are read, so a stream is cut off as soon as it goes over rather than
+// after it is stored.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(b []byte) (int, error) {
+	n, err := q.r.Read(b)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// limitToQuota bounds what is read from r by the user's remaining quota.
+// It fails with errQuotaExceeded if the quota is already used up.
+func limitToQuota(ctx context.Context, userID string, r io.Reader) (io.Reader, error) {
+	remaining, limited, err := storageRemaining(ctx, userID)
+	if err != nil || !limited {
+		return r, err
+	}
+	if remaining == 0 {
+		return nil, errQuotaExceeded
+	}
+	return &quotaReader{r: r, remaining: remaining}, nil
+}
+
+// accountUsage is what GET /api/account/usage answers. Quota and
+// remaining are null when storage is unlimited.
+type accountUsage struct {
+	storage.UserUsage
+	Plan           string `json:"plan"`
+	QuotaBytes     *int64 `json:"quota_bytes"`
+	RemainingBytes *int64 `json:"remaining_bytes"`
+}
+
+func loadAccountUsage(ctx context.Context, user User) (accountUsage, error) {
+	usage, err := db.UserUsage(ctx, user.ID)
+	if err != nil {
+		return accountUsage{}, err
+	}
+	out := accountUsage{UserUsage: usage, Plan: user.Plan}
+	if quota, limited := storageQuota(user); limited {
+		remaining := max(quota-usage.BackupBytes, 0)
+		out.QuotaBytes, out.RemainingBytes = &quota, &remaining
+	}
+	return out, nil
+}
+
+// writeQuotaExceeded answers an upload that doesn't fit in the caller's
+// quota, saying how much of it is used.
+func writeQuotaExceeded(w http.ResponseWriter, r *http.Request) {
+	e := &apiError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    "quota_exceeded",
+		Message: "This upload doesn't fit in your storage quota; delete backups or empty the trash to make room",
+	}
+	user, err := db.Users().Get(r.Context(), r.Header.Get("X-User-ID"))
+	if err == nil {
+		if usage, err := loadAccountUsage(r.Context(), user); err == nil && usage.QuotaBytes != nil {
+			e.Message = fmt.Sprintf("This upload doesn't fit in your storage quota of %s, of which %s is used; delete backups or empty the trash to make room",
+				formatBytes(*usage.QuotaBytes), formatBytes(usage.BackupBytes))
+			e.Details = map[string]interface{}{
+				"quota_bytes":     *usage.QuotaBytes,
+				"used_bytes":      usage.BackupBytes,
+				"remaining_bytes": *usage.RemainingBytes,
+			}
+		}
+	}
+	writeAPIError(w, e)
+}
+
+// Handlers
+
+// getAccountUsageHandler says how much the caller stores and how much of
+// their quota is left.
+func getAccountUsageHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := db.Users().Get(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	usage, err := loadAccountUsage(r.Context(), user)
+	if err != nil {
+		logger(r.Context()).Error("Error totalling usage", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// setUserPlanHandler moves a user to another plan and, with quota_bytes,
+// gives them a storage quota of their own. Without it they have their
+// plan's.
+func setUserPlanHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Plan       string `json:"plan" validate:"required,max=50"`
+		QuotaBytes *int64 `json:"quota_bytes" validate:"min=0"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	user, ok := loadTargetUser(w, r)
+	if !ok {
+		return
+	}
+	before := user
+	if err := db.Users().SetPlan(r.Context(), user.ID, req.Plan, req.QuotaBytes); err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	user.Plan, user.StorageQuota = req.Plan, req.QuotaBytes
+
+	recordAudit(r, AuditEvent{
+		Action:       "admin.user_plan_changed",
+		ResourceType: "user",
+		ResourceID:   user.ID,
+		Metadata:     map[string]interface{}{"from": before.Plan, "to": user.Plan, "quota_bytes": req.QuotaBytes},
+	})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "user.plan_changed",
+		AggregateType: aggregateUser,
+		AggregateID:   user.ID,
+		OwnerID:       user.ID,
+		Before:        snapshot(before),
+		After:         snapshot(user),
+	}, nil)
+
+	usage, err := loadAccountUsage(r.Context(), user)
+	if err != nil {
+		logger(r.Context()).Error("Error totalling usage", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "usage": usage})
+}
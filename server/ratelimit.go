@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"backup-manager/config"
+)
+
+const (
+	defaultAuthRateLimit = 20  // requests per minute per address
+	defaultUserRateLimit = 300 // requests per minute per user
+)
+
+var (
+	authLimiter = newRateLimiter()
+	userLimiter = newRateLimiter()
+)
+
+// rateLimiter is a set of token buckets keyed by caller. Each bucket holds up
+// to perMinute tokens and refills continuously, so short bursts are allowed
+// while the sustained rate stays at perMinute.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the key's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (l *rateLimiter) allow(key string, perMinute int) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	capacity := float64(perMinute)
+	refill := capacity / 60 // tokens per second
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*refill)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / refill * float64(time.Second))
+		return false, 0, wait
+	}
+
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// prune drops buckets that have been idle long enough to be full again.
+func (l *rateLimiter) prune(maxIdle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if time.Since(b.last) > maxIdle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitSetting reads a requests-per-minute limit from the environment
+// variable name, falling back to def when it is unset or not positive.
+func rateLimitSetting(name string, def int) int {
+	if limit, err := strconv.Atoi(config.Get(name)); err == nil && limit > 0 {
+		return limit
+	}
+	return def
+}
+
+// limitRequest takes a token from key's bucket in l, setting the rate limit
+// headers. When the bucket is empty it writes a 429 with Retry-After and
+// returns false.
+func limitRequest(w http.ResponseWriter, l *rateLimiter, key string, perMinute int) bool {
+	allowed, remaining, retryAfter := l.allow(key, perMinute)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(perMinute))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, errCodeRateLimited, "Rate limit exceeded")
+		return false
+	}
+	return true
+}
+
+// authRateLimit limits the endpoints used before logging in by client
+// address, AUTH_RATE_LIMIT requests a minute, so passwords and emailed
+// tokens can't be guessed at speed.
+func authRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limitRequest(w, authLimiter, clientIP(r), rateLimitSetting("AUTH_RATE_LIMIT", defaultAuthRateLimit)) {
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"backup-manager/storage"
+)
+
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+	// No 0/o, 1/l/i so codes survive being read aloud or handwritten.
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// recoveryCodeRegistry keeps hashes of users' recovery codes in the
+// database. Codes are a fallback for the authenticator app, so they are
+// only issued, and only accepted, while two-factor authentication is on.
+type recoveryCodeRegistry struct{}
+
+var recoveryCodes = &recoveryCodeRegistry{}
+
+func generateRecoveryCode() string {
+	// Reject bytes past the largest multiple of the alphabet size so every
+	// character is equally likely.
+	limit := 256 - 256%len(recoveryCodeAlphabet)
+
+	code := make([]byte, 0, recoveryCodeLength)
+	buf := make([]byte, 1)
+	for len(code) < recoveryCodeLength {
+		rand.Read(buf)
+		if int(buf[0]) >= limit {
+			continue
+		}
+		code = append(code, recoveryCodeAlphabet[int(buf[0])%len(recoveryCodeAlphabet)])
+	}
+	return string(code[:5]) + "-" + string(code[5:])
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.Join(strings.Fields(code), "")
+}
+
+// regenerate issues a fresh set of codes for the user, invalidating any
+// previous set. The plaintext codes are only ever returned from here.
+func (reg *recoveryCodeRegistry) regenerate(ctx context.Context, userID string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = generateRecoveryCode()
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	if err := db.RecoveryCodes().Replace(ctx, userID, hashes, time.Now()); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// consume checks a code and marks it used. Each code works exactly once.
+func (reg *recoveryCodeRegistry) consume(ctx context.Context, userID, code string) (bool, error) {
+	err := db.RecoveryCodes().Use(ctx, userID, hashToken(normalizeRecoveryCode(code)), time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (reg *recoveryCodeRegistry) enrolled(ctx context.Context, userID string) (bool, error) {
+	_, err := db.RecoveryCodes().Get(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (reg *recoveryCodeRegistry) remove(ctx context.Context, userID string) error {
+	if err := db.RecoveryCodes().Delete(ctx, userID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (reg *recoveryCodeRegistry) status(ctx context.Context, userID string) (map[string]interface{}, error) {
+	set, err := db.RecoveryCodes().Get(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return map[string]interface{}{"enrolled": false, "remaining": 0}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"enrolled":     true,
+		"remaining":    set.Remaining,
+		"generated_at": set.GeneratedAt.Format(time.RFC3339),
+	}, nil
+}
+
+// Handlers
+
+// regenerateRecoveryCodesHandler replaces the user's recovery codes. It
+// takes the account password or a current two-factor code, so a stolen
+// session alone can't mint codes that get past the second factor.
+func regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Password == "" && req.Code == "" {
+		writeFieldError(w, "password", "required", "Give your password or a two-factor code")
+		return
+	}
+
+	enabled, err := twoFactor.enabled(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Two-factor authentication")
+		return
+	}
+	if !enabled {
+		http.Error(w, "Recovery codes need two-factor authentication to be enabled", http.StatusConflict)
+		return
+	}
+	if !limitRequest(w, twoFactorLimiter, userID, twoFactorAttemptsPerMinute) {
+		return
+	}
+	if req.Code != "" {
+		ok, err := twoFactor.verify(r.Context(), userID, req.Code)
+		if err != nil {
+			writeStorageError(w, r, err, "Two-factor authentication")
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		user, err := db.Users().Get(r.Context(), userID)
+		if err != nil {
+			writeStorageError(w, r, err, "User")
+			return
+		}
+		if !passwordMatches(r.Context(), user.PasswordHash, req.Password) {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	codes, err := recoveryCodes.regenerate(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Recovery codes")
+		return
+	}
+	logger(r.Context()).Info("Recovery codes regenerated")
+
+	if r.URL.Query().Get("download") == "true" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="recovery-codes.txt"`)
+		fmt.Fprintf(w, "Recovery codes for %s\n", r.Header.Get("X-User-Email"))
+		fmt.Fprintf(w, "Generated %s. Each code can be used once.\n\n", time.Now().Format(time.RFC1123))
+		for _, code := range codes {
+			fmt.Fprintln(w, code)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"codes": codes,
+	})
+}
+
+func getRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	status, err := recoveryCodes.status(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Recovery codes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+	"backup-manager/streamcrypt"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io), version 1.0.0
+// with its creation, expiration and termination extensions, so a large
+// export sent over a poor connection picks up where it stopped instead of
+// starting over. POST /api/uploads starts one, HEAD reports how much of it
+// is stored, and each PATCH adds bytes at that offset. What arrives is
+// stored in encrypted parts as it is read, so a dropped connection loses at
+// most the part in flight; once the last byte is in, the parts are read
+// back in order into the same pipeline as POST /api/backups.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	// tusContentType is the only body a PATCH may have
+	tusContentType = "application/offset+octet-stream"
+
+	// uploadPartSize bounds how much of a PATCH is held in memory before it
+	// is stored, and so how much a dropped connection can lose
+	uploadPartSize          = 8 << 20
+	defaultUploadMaxSize    = 10 << 30
+	defaultUploadExpiry     = 24 * time.Hour
+	uploadCleanupInterval   = time.Hour
+	maxUploadNameLength     = 255
+	defaultUploadFileName   = "upload"
+	uploadPartBlobKeyPrefix = "uploads/"
+)
+
+var (
+	uploadMaxSize int64 = defaultUploadMaxSize
+	uploadExpiry        = defaultUploadExpiry
+)
+
+// initResumableUploads reads RESUMABLE_UPLOAD_MAX_SIZE, the largest upload
+// that can be started, and RESUMABLE_UPLOAD_EXPIRY, how long one is kept
+// after its last part arrived.
+func initResumableUploads() {
+	if v := config.Get("RESUMABLE_UPLOAD_MAX_SIZE"); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil || n == 0 {
+			fatal("Invalid RESUMABLE_UPLOAD_MAX_SIZE", "value", v)
+		}
+		uploadMaxSize = n
+	}
+	uploadExpiry = durationSetting("RESUMABLE_UPLOAD_EXPIRY", defaultUploadExpiry)
+}
+
+// tusMiddleware answers the headers every tus response carries, and refuses
+// a request for another version of the protocol. OPTIONS, which clients
+// send to discover what is supported, needs no version.
+func tusMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "Unsupported Tus-Resumable version, expected "+tusVersion, http.StatusPreconditionFailed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func uploadPartBlobKey(userID, uploadID string) string {
+	return uploadPartBlobKeyPrefix + userID + "/" + uploadID + "/" + generateID()
+}
+
+// uploadName reads the file name from Upload-Metadata, a comma-separated
+// list of keys each followed by a base64 value. tus clients send it as
+// "filename"; "name" is taken as well.
+func uploadName(metadata string) (string, bool) {
+	values := map[string]string{}
+	for _, pair := range strings.Split(metadata, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", false
+		}
+		values[key] = string(decoded)
+	}
+
+	name := values["filename"]
+	if name == "" {
+		name = values["name"]
+	}
+	// A path sent by the client is never used as one
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" || name == "." || name == "/" {
+		name = defaultUploadFileName
+	}
+	if len(name) > maxUploadNameLength {
+		name = name[:maxUploadNameLength]
+	}
+	return name, true
+}
+
+func writeUploadHeaders(w http.ResponseWriter, u storage.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// getUpload returns the caller's upload in the request's path, answering
+// and returning false if there is no such upload or it has expired.
+func getUpload(w http.ResponseWriter, r *http.Request) (storage.Upload, bool) {
+	u, err := db.Uploads().Get(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Upload")
+		return u, false
+	}
+	if time.Now().After(u.ExpiresAt) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return u, false
+	}
+	return u, true
+}
+
+// storeUploadPart encrypts data and stores it as u's next part, at offset
+// from. It returns ErrStale, with nothing stored, if another request added
+// a part first.
+func storeUploadPart(ctx context.Context, u *storage.Upload, from int64, data, key []byte) error {
+	var sealed bytes.Buffer
+	enc, err := streamcrypt.NewWriter(&sealed, key)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Write(data); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	part := storage.UploadPart{BlobKey: uploadPartBlobKey(u.UserID, u.ID), Size: int64(len(data))}
+	if err := blobStore.Put(ctx, part.BlobKey, sealed.Bytes(), "application/octet-stream"); err != nil {
+		return err
+	}
+
+	next := *u
+	next.Parts = append(append([]storage.UploadPart{}, u.Parts...), part)
+	next.Offset = from + part.Size
+	next.ExpiresAt = time.Now().Add(uploadExpiry)
+	if err := db.Uploads().Append(ctx, next, from); err != nil {
+		if err := blobStore.Delete(ctx, part.BlobKey); err != nil {
+			logger(ctx).Error("Error deleting upload part", "upload_id", u.ID, "error", err)
+		}
+		return err
+	}
+	*u = next
+	return nil
+}
+
+// uploadPartsReader reads an upload's parts in order, fetching and
+// decrypting one at a time.
+type uploadPartsReader struct {
+	ctx     context.Context
+	parts   []storage.UploadPart
+	key     []byte
+	current io.Reader
+	body    io.Closer
+}
+
+func (p *uploadPartsReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			body, err := blobStore.Get(p.ctx, p.parts[0].BlobKey)
+			if err != nil {
+				return 0, err
+			}
+			plaintext, err := streamcrypt.NewReader(body, p.key)
+			if err != nil {
+				body.Close()
+				return 0, err
+			}
+			p.parts = p.parts[1:]
+			p.current, p.body = plaintext, body
+		}
+		n, err := p.current.Read(b)
+		if err == io.EOF {
+			p.body.Close()
+			p.current, p.body = nil, nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (p *uploadPartsReader) Close() error {
+	if p.body != nil {
+		return p.body.Close()
+	}
+	return nil
+}
+
+// discardUpload deletes an upload and its parts.
+func discardUpload(ctx context.Context, u storage.Upload) error {
+	if err := db.Uploads().Delete(ctx, u.UserID, u.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	for _, part := range u.Parts {
+		if err := blobStore.Delete(ctx, part.BlobKey); err != nil {
+			logger(ctx).Error("Error deleting upload part", "upload_id", u.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// discardUploads deletes all of a user's uploads, for deleteAccount.
+func discardUploads(ctx context.Context, userID string) error {
+	uploads, err := db.Uploads().List(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		if err := discardUpload(ctx, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pruneUploads() {
+	ctx := context.Background()
+	uploads, err := db.Uploads().ListExpired(ctx, time.Now())
+	if err != nil {
+		slog.Error("Error listing expired uploads", "error", err)
+		return
+	}
+	for _, u := range uploads {
+		if err := discardUpload(ctx, u); err != nil {
+			slog.Error("Error removing expired upload", "upload_id", u.ID, "error", err)
+			return
+		}
+	}
+	if len(uploads) > 0 {
+		slog.Info("Removed expired uploads", "count", len(uploads))
+	}
+}
+
+// finishUpload saves a complete upload as a backup, in the workspace it was
+// started in, and deletes it. It answers with the backup as POST
+// /api/backups does. An upload that doesn't fit in the quota is kept, so it
+// can be finished once there is room by sending an empty PATCH.
+func finishUpload(w http.ResponseWriter, r *http.Request, u storage.Upload) {
+	key, err := backupKey(r.Context(), Backup{UserID: u.UserID, KeyVersion: u.KeyVersion})
+	if errors.Is(err, errDataKeyLocked) {
+		writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error encrypting data", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	if u.TeamID != "" {
+		ctx = storage.WithTeam(ctx, u.TeamID)
+	}
+	parts := &uploadPartsReader{ctx: ctx, parts: u.Parts, key: key}
+	defer parts.Close()
+	backup, projects, err := saveBackupFile(ctx, requestActor(r), u.UserID, u.Name, parts, key, u.KeyVersion,
+		map[string]interface{}{"upload_id": u.ID})
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaExceeded(w, r)
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("Error storing uploaded backup", "upload_id", u.ID, "backup_id", backup.ID, "error", err)
+		http.Error(w, "Error storing backup", http.StatusInternalServerError)
+		return
+	}
+	if err := discardUpload(context.WithoutCancel(ctx), u); err != nil {
+		logger(ctx).Error("Error deleting finished upload", "upload_id", u.ID, "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Backup
+		Projects []Project `json:"projects"`
+	}{backup, append([]Project{}, projects...)})
+}
+
+// Handlers
+func tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(uploadMaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createUploadHandler starts an upload of Upload-Length bytes. The backup
+// is made in the workspace the upload is started in, and encrypted with
+// the key a direct upload would be.
+func createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported; send Upload-Length", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length == 0 {
+		http.Error(w, "The file is empty", http.StatusBadRequest)
+		return
+	}
+	if length > uploadMaxSize {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(uploadMaxSize, 10))
+		http.Error(w, "Upload is larger than "+formatBytes(uploadMaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	name, ok := uploadName(r.Header.Get("Upload-Metadata"))
+	if !ok {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	remaining, limited, err := storageRemaining(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	if limited && length > remaining {
+		writeQuotaExceeded(w, r)
+		return
+	}
+
+	_, keyVersion, err := uploadKey(r.Context(), userID)
+	if errors.Is(err, errDataKeyLocked) {
+		writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error encrypting data", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	u := storage.Upload{
+		ID:         generateID(),
+		UserID:     userID,
+		TeamID:     storage.TeamFrom(r.Context()),
+		Name:       name,
+		Length:     length,
+		KeyVersion: keyVersion,
+		Parts:      []storage.UploadPart{},
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(uploadExpiry),
+	}
+	if err := db.Uploads().Create(r.Context(), u); err != nil {
+		writeStorageError(w, r, err, "Upload")
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+u.ID)
+	writeUploadHeaders(w, u)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func headUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := getUpload(w, r)
+	if !ok {
+		return
+	}
+	writeUploadHeaders(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchUploadHandler adds the body to the upload at Upload-Offset, which
+// must be how much of it is stored. The body is stored in parts as it is
+// read, and whatever arrived before a dropped connection is kept. The PATCH
+// that brings the upload to its length makes the backup and answers with
+// it; one that leaves it short answers 204 with the new Upload-Offset.
+func patchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	liftDeadlines(w)
+
+	if ct := r.Header.Get("Content-Type"); ct != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	u, ok := getUpload(w, r)
+	if !ok {
+		return
+	}
+	if u.TeamID != storage.TeamFrom(r.Context()) {
+		http.Error(w, "Continue the upload in the workspace it was started in", http.StatusForbidden)
+		return
+	}
+	if offset != u.Offset {
+		writeUploadHeaders(w, u)
+		http.Error(w, "Upload-Offset doesn't match the "+strconv.FormatInt(u.Offset, 10)+" bytes stored", http.StatusConflict)
+		return
+	}
+	if r.ContentLength > u.Length-u.Offset {
+		http.Error(w, "Body runs past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	key, err := backupKey(r.Context(), Backup{UserID: u.UserID, KeyVersion: u.KeyVersion})
+	if errors.Is(err, errDataKeyLocked) {
+		writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error encrypting data", http.StatusInternalServerError)
+		return
+	}
+
+	// Parts are stored even after the client has gone, so what it sent
+	// before the connection dropped is kept
+	ctx := context.WithoutCancel(r.Context())
+	buf := make([]byte, min(uploadPartSize, u.Length-u.Offset))
+	var readErr error
+	for u.Offset < u.Length && readErr == nil {
+		n, err := io.ReadFull(r.Body, buf[:min(int64(len(buf)), u.Length-u.Offset)])
+		if err != nil {
+			readErr = err
+		}
+		if n == 0 {
+			break
+		}
+		err = storeUploadPart(ctx, &u, u.Offset, buf[:n], key)
+		if errors.Is(err, storage.ErrStale) {
+			http.Error(w, "Another request added to the upload first", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logger(ctx).Error("Error storing upload part", "upload_id", u.ID, "error", err)
+			http.Error(w, "Error storing upload", http.StatusInternalServerError)
+			return
+		}
+	}
+	if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+		logger(ctx).Info("Upload interrupted", "upload_id", u.ID, "offset", u.Offset, "error", readErr)
+		writeUploadHeaders(w, u)
+		http.Error(w, "Error reading upload", http.StatusBadRequest)
+		return
+	}
+	writeUploadHeaders(w, u)
+	if u.Offset < u.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+		http.Error(w, "Body runs past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	finishUpload(w, r, u)
+}
+
+func deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := db.Uploads().Get(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Upload")
+		return
+	}
+	if err := discardUpload(r.Context(), u); err != nil {
+		writeStorageError(w, r, err, "Upload")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+)
+
+// roleRank orders roles so a route open to a role is open to every role
+// above it.
+var roleRank = map[string]int{
+	storage.RoleUser:  1,
+	storage.RoleAdmin: 2,
+}
+
+// userRole is the role user has. Addresses in ADMIN_EMAILS are admins
+// whatever the database says, so a new deployment has someone who can
+// grant the role to others.
+func userRole(user User) string {
+	if isAdminEmail(user.Email) {
+		return storage.RoleAdmin
+	}
+	if user.Role == "" {
+		return storage.RoleUser
+	}
+	return user.Role
+}
+
+func isAdminEmail(email string) bool {
+	if email == "" {
+		return false
+	}
+	for _, admin := range strings.Split(config.Get("ADMIN_EMAILS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(admin), email) {
+			return true
+		}
+	}
+	return false
+}
+
+// userHasRole reports whether the user has role or one above it. The role
+// is read from the database rather than the access token, so a role taken
+// away stops working at once.
+func userHasRole(ctx context.Context, userID, role string) (bool, error) {
+	user, err := db.Users().Get(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return !user.Disabled && roleRank[userRole(user)] >= roleRank[role], nil
+}
+
+// requireRole serves next only to logged-in users with role. API keys never
+// carry a role beyond their owner's scopes, so they are refused.
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key-ID") != "" {
+			writeError(w, http.StatusForbidden, errCodeAPIKeyForbidden, "This endpoint is not available to API keys")
+			return
+		}
+		ok, err := userHasRole(r.Context(), r.Header.Get("X-User-ID"), role)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger(r.Context()).Error("Error loading user role", "error", err)
+			writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusForbidden, errCodeRoleRequired, "This requires the "+role+" role")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Admin middleware.
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return requireRole(storage.RoleAdmin, next)
+}
@@ -0,0 +1,133 @@
+package sandbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// MaxCodeBytes is the largest snippet a Docker runner accepts. The code
+// travels in an environment variable, which Linux caps at 128 KiB.
+const MaxCodeBytes = 64 << 10
+
+// Docker runs each snippet in a throwaway container with no network, a
+// read-only root filesystem, no capabilities and an unprivileged user. Set
+// Runtime to "runsc" to run containers under gVisor for a second layer of
+// isolation from the host kernel.
+type Docker struct {
+	// Path to the docker binary; "docker" on $PATH when empty. Any CLI
+	// compatible with docker run, such as podman, works.
+	Path    string
+	Runtime string
+	Limits  Limits
+}
+
+func (d *Docker) Run(ctx context.Context, req Request) (Result, error) {
+	lang, err := lookup(req.Language)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(req.Code) > MaxCodeBytes {
+		return Result{}, fmt.Errorf("sandbox: code is larger than %d bytes", MaxCodeBytes)
+	}
+
+	path := d.Path
+	if path == "" {
+		path = "docker"
+	}
+	limits := d.Limits
+	if limits.Timeout <= 0 {
+		limits = DefaultLimits
+	}
+
+	name := "sandbox-" + randomSuffix()
+	args := []string{
+		"run", "--rm", "-i",
+		"--name", name,
+		"--network", "none",
+		"--read-only",
+		"--tmpfs", "/tmp:rw,exec,size=64m",
+		"--workdir", "/tmp",
+		"--user", "65534:65534",
+		"--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges",
+		"--memory", fmt.Sprintf("%dm", limits.MemoryMB),
+		"--memory-swap", fmt.Sprintf("%dm", limits.MemoryMB),
+		"--cpus", fmt.Sprintf("%g", limits.CPUs),
+		"--pids-limit", fmt.Sprint(limits.Processes),
+		"--env", "HOME=/tmp",
+		"--env", "XDG_CACHE_HOME=/tmp/.cache",
+		"--env", "SNIPPET=" + base64.StdEncoding.EncodeToString([]byte(req.Code)),
+	}
+	if d.Runtime != "" {
+		args = append(args, "--runtime", d.Runtime)
+	}
+	// The code is unpacked inside the container, so nothing from the host
+	// is mounted and the runner works against a remote daemon too
+	script := fmt.Sprintf(`echo "$SNIPPET" | base64 -d > %s && unset SNIPPET && exec %s`, lang.File, strings.Join(lang.Command, " "))
+	args = append(args, lang.Image, "sh", "-c", script)
+
+	runCtx, cancel := context.WithTimeout(ctx, limits.Timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{max: limits.OutputBytes}
+	stderr := &limitedBuffer{max: limits.OutputBytes}
+	cmd := exec.CommandContext(runCtx, path, args...)
+	cmd.Stdin = strings.NewReader(req.Stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err = cmd.Run()
+	result := Result{
+		Stdout:     stdout.String(),
+		Stderr:     stderr.String(),
+		Truncated:  stdout.truncated || stderr.truncated,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+
+	if runCtx.Err() != nil {
+		// Killing the client leaves the container running
+		d.remove(path, name)
+		if ctx.Err() != nil {
+			return Result{}, ctx.Err()
+		}
+		result.TimedOut = true
+		result.ExitCode = -1
+		return result, nil
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return result, nil
+	case errors.As(err, &exitErr):
+		// docker run exits 125 when it could not start the container at all
+		if exitErr.ExitCode() == 125 {
+			return Result{}, fmt.Errorf("sandbox: docker: %s", strings.TrimSpace(result.Stderr))
+		}
+		result.ExitCode = exitErr.ExitCode()
+		return result, nil
+	default:
+		return Result{}, fmt.Errorf("sandbox: docker: %w", err)
+	}
+}
+
+func (d *Docker) remove(path, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	exec.CommandContext(ctx, path, "rm", "-f", name).Run()
+}
+
+func randomSuffix() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
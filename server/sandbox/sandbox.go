@@ -0,0 +1,118 @@
+// Package sandbox runs small code snippets in isolation and reports what
+// they printed. Runners are interchangeable so a deployment can use a local
+// container runtime (optionally gVisor) or a separate execution service.
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Language is how to run one kind of snippet: the container image, the file
+// the code is written to, and the command that runs it.
+type Language struct {
+	Name    string   `json:"name"`
+	Image   string   `json:"-"`
+	File    string   `json:"-"`
+	Command []string `json:"-"`
+}
+
+// Languages are the snippet languages runners support, keyed by the names
+// projects use.
+var Languages = map[string]Language{
+	"python":     {Name: "python", Image: "python:3.12-alpine", File: "main.py", Command: []string{"python3", "main.py"}},
+	"javascript": {Name: "javascript", Image: "node:20-alpine", File: "main.js", Command: []string{"node", "main.js"}},
+	"typescript": {Name: "typescript", Image: "denoland/deno:alpine", File: "main.ts", Command: []string{"deno", "run", "--no-prompt", "main.ts"}},
+	"ruby":       {Name: "ruby", Image: "ruby:3.3-alpine", File: "main.rb", Command: []string{"ruby", "main.rb"}},
+	"go":         {Name: "go", Image: "golang:1.22-alpine", File: "main.go", Command: []string{"go", "run", "main.go"}},
+	"bash":       {Name: "bash", Image: "bash:5", File: "main.sh", Command: []string{"bash", "main.sh"}},
+}
+
+// LanguageNames returns the supported language names, sorted.
+func LanguageNames() []string {
+	names := make([]string, 0, len(Languages))
+	for name := range Languages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Limits bound what one run may use.
+type Limits struct {
+	Timeout     time.Duration
+	MemoryMB    int
+	CPUs        float64
+	Processes   int
+	OutputBytes int // per stream; the rest is dropped and Truncated set
+}
+
+// DefaultLimits suit short scripts that print a little output.
+var DefaultLimits = Limits{
+	Timeout:     10 * time.Second,
+	MemoryMB:    128,
+	CPUs:        0.5,
+	Processes:   64,
+	OutputBytes: 64 << 10,
+}
+
+// Request is a snippet to run. Stdin is fed to the program.
+type Request struct {
+	Language string `json:"language"`
+	Code     string `json:"code"`
+	Stdin    string `json:"stdin,omitempty"`
+}
+
+// Result is what a run produced. A snippet that fails or times out is still
+// a successful run; the error from Run is reserved for the runner itself.
+type Result struct {
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	ExitCode   int    `json:"exit_code"`
+	TimedOut   bool   `json:"timed_out"`
+	Truncated  bool   `json:"truncated"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Runner executes snippets.
+type Runner interface {
+	Run(ctx context.Context, req Request) (Result, error)
+}
+
+// ErrUnsupportedLanguage is returned for languages not in Languages.
+var ErrUnsupportedLanguage = errors.New("sandbox: unsupported language")
+
+func lookup(name string) (Language, error) {
+	lang, ok := Languages[name]
+	if !ok {
+		return Language{}, fmt.Errorf("%w %q", ErrUnsupportedLanguage, name)
+	}
+	return lang, nil
+}
+
+// limitedBuffer keeps the first max bytes written to it and notes whether
+// anything was dropped.
+type limitedBuffer struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - len(b.buf); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf = append(b.buf, p[:room]...)
+		}
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return string(b.buf)
+}
@@ -0,0 +1,62 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Service posts snippets to a separate execution service, for deployments
+// that keep untrusted code off the API hosts entirely. The service receives
+// a Request as JSON and must answer with a Result.
+type Service struct {
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+func (s *Service) Run(ctx context.Context, req Request) (Result, error) {
+	if _, err := lookup(req.Language); err != nil {
+		return Result{}, err
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Result{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if s.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+s.APIKey)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultLimits.Timeout + 30*time.Second}
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return Result{}, fmt.Errorf("sandbox: service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Result{}, fmt.Errorf("sandbox: service returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Result{}, fmt.Errorf("sandbox: decoding service response: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-manager/analytics"
+	"backup-manager/config"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	scanRetentionDays = 400 // a year of scans plus room for year-on-year
+
+	defaultAnalyticsDays = 30
+	// Longest period hourly buckets are offered for
+	maxHourlyAnalyticsDays = 14
+	maxUserAgentLength     = 512
+
+	clickhouseBatchSize     = 1000
+	clickhouseFlushInterval = 5 * time.Second
+)
+
+var scanAnalytics analytics.Store = analytics.NewMemory()
+
+// initScanAnalytics opens the store selected by ANALYTICS_BACKEND: in memory
+// by default, or ClickHouse for deployments with millions of scans.
+func initScanAnalytics() {
+	switch backend := config.Get("ANALYTICS_BACKEND"); backend {
+	case "", "memory":
+	case "clickhouse":
+		url := config.Get("CLICKHOUSE_URL")
+		if url == "" {
+			fatal("CLICKHOUSE_URL is required when ANALYTICS_BACKEND is clickhouse")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		ch, err := analytics.OpenClickHouse(ctx, &analytics.ClickHouse{
+			URL:           url,
+			Database:      config.Get("CLICKHOUSE_DATABASE"),
+			Username:      config.Get("CLICKHOUSE_USERNAME"),
+			Password:      config.Get("CLICKHOUSE_PASSWORD"),
+			RetentionDays: scanRetentionDays,
+		})
+		if err != nil {
+			fatal("Error connecting to ClickHouse", "url", url, "error", err)
+		}
+		scanAnalytics = analytics.NewBuffered(ch, clickhouseBatchSize, clickhouseFlushInterval)
+	default:
+		fatal("Unknown ANALYTICS_BACKEND", "backend", backend)
+	}
+}
+
+// referrerHost is the host of the page that linked to the scan, if any. The
+// rest of the URL is dropped, since it can identify the scanner.
+func referrerHost(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// recordQRScan counts a scan of a QR code by the requester's location and
+// client. It is called at redirect time, before the scanner is sent on.
+func recordQRScan(r *http.Request, qrID, ownerID string) {
+	loc := lookupGeo(clientIP(r))
+	client := analytics.ParseUserAgent(r.UserAgent())
+
+	scan := map[string]interface{}{"device": client.Device}
+	for field, value := range map[string]string{"country_code": loc.CountryCode, "region_code": loc.RegionCode, "city": loc.City} {
+		if value != "" {
+			scan[field] = value
+		}
+	}
+	publishEvent("qr.scanned", ownerID, "qr_code", qrID, scan)
+	webhookData := map[string]interface{}{"id": qrID}
+	for k, v := range scan {
+		webhookData[k] = v
+	}
+	emitWebhook(ownerID, "qr.scanned", webhookData)
+
+	err := scanAnalytics.Record(r.Context(), analytics.Scan{
+		QRID:      qrID,
+		OwnerID:   ownerID,
+		ScannedAt: time.Now(),
+		Location:  loc,
+		UserAgent: truncate(r.UserAgent(), maxUserAgentLength),
+		Client:    client,
+		Referrer:  referrerHost(r),
+	})
+	if err != nil {
+		logger(r.Context()).Error("Error recording scan", "qr_id", qrID, "error", err)
+	}
+}
+
+func pruneScanAnalytics() {
+	cutoff := time.Now().UTC().AddDate(0, 0, -scanRetentionDays)
+	if err := scanAnalytics.Prune(context.Background(), cutoff); err != nil {
+		slog.Error("Error pruning scan analytics", "error", err)
+	}
+}
+
+// fillBuckets adds the empty periods between since and now to series, so
+// charts don't have to.
+func fillBuckets(series []analytics.BucketCount, since time.Time, step time.Duration) []analytics.BucketCount {
+	counts := make(map[time.Time]int64, len(series))
+	for _, b := range series {
+		counts[b.Start.UTC()] = b.Scans
+	}
+	filled := []analytics.BucketCount{}
+	for start := since; !start.After(time.Now()); start = start.Add(step) {
+		filled = append(filled, analytics.BucketCount{Start: start, Scans: counts[start]})
+	}
+	return filled
+}
+
+// Handlers
+
+// getQRAnalyticsHandler reports a code's scans over the last ?days= days:
+// the total, a series of ?bucket= (day or hour) counts, and breakdowns by
+// device, OS, browser and referrer.
+func getQRAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	days := defaultAnalyticsDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 1 || d > scanRetentionDays {
+			http.Error(w, "days must be between 1 and "+strconv.Itoa(scanRetentionDays), http.StatusBadRequest)
+			return
+		}
+		days = d
+	}
+	bucket := r.URL.Query().Get("bucket")
+	switch bucket {
+	case "":
+		bucket = analytics.BucketDay
+	case analytics.BucketDay:
+	case analytics.BucketHour:
+		if days > maxHourlyAnalyticsDays {
+			http.Error(w, "hourly buckets cover at most "+strconv.Itoa(maxHourlyAnalyticsDays)+" days", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "bucket must be day or hour", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.QRCodes().Get(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -(days - 1))
+	step := 24 * time.Hour
+	if bucket == analytics.BucketHour {
+		step = time.Hour
+	}
+
+	summary, err := scanAnalytics.Summary(r.Context(), analytics.SummaryQuery{QRID: id, OwnerID: userID, Since: since, Bucket: bucket})
+	if err != nil {
+		logger(r.Context()).Error("Error querying scans", "qr_id", id, "error", err)
+		http.Error(w, "Error loading analytics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"qr_id":     id,
+		"days":      days,
+		"bucket":    bucket,
+		"total":     summary.Total,
+		"series":    fillBuckets(summary.Series, since, step),
+		"devices":   summary.Devices,
+		"os":        summary.OS,
+		"browsers":  summary.Browsers,
+		"referrers": summary.Referrers,
+	})
+}
@@ -0,0 +1,193 @@
+package search
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// Bleve is an Index stored on local disk, so self-hosted installs get real
+// search without running a separate engine.
+type Bleve struct {
+	path string
+
+	mu    sync.RWMutex
+	index bleve.Index
+}
+
+// OpenBleve opens the index at path, creating it if it does not exist.
+func OpenBleve(path string) (*Bleve, error) {
+	index, err := bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		index, err = bleve.New(path, newMapping())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Bleve{path: path, index: index}, nil
+}
+
+func newMapping() mapping.IndexMapping {
+	keyword := bleve.NewKeywordFieldMapping()
+
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = "en"
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("item_id", keyword)
+	doc.AddFieldMappingsAt("user_id", keyword)
+	doc.AddFieldMappingsAt("type", keyword)
+	doc.AddFieldMappingsAt("source", keyword)
+	doc.AddFieldMappingsAt("language", keyword)
+	doc.AddFieldMappingsAt("tags", keyword)
+	doc.AddFieldMappingsAt("title", text)
+	doc.AddFieldMappingsAt("body", text)
+	doc.AddFieldMappingsAt("created_at", bleve.NewDateTimeFieldMapping())
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	return m
+}
+
+func (b *Bleve) Index(ctx context.Context, docs ...Document) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	batch := b.index.NewBatch()
+	for _, d := range docs {
+		if err := batch.Index(DocumentID(d.Type, d.ID), map[string]interface{}{
+			"item_id":    d.ID,
+			"user_id":    d.UserID,
+			"type":       d.Type,
+			"source":     d.Source,
+			"language":   strings.ToLower(d.Language),
+			"tags":       lowerAll(d.Tags),
+			"title":      d.Title,
+			"body":       d.Body,
+			"created_at": d.CreatedAt,
+		}); err != nil {
+			return err
+		}
+	}
+	return b.index.Batch(batch)
+}
+
+func (b *Bleve) Delete(ctx context.Context, ids ...string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	batch := b.index.NewBatch()
+	for _, id := range ids {
+		batch.Delete(id)
+	}
+	return b.index.Batch(batch)
+}
+
+func (b *Bleve) Search(ctx context.Context, q Query) (Results, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	req := bleve.NewSearchRequestOptions(buildQuery(q), limit, q.Offset, false)
+	req.Fields = []string{"item_id", "type", "title"}
+	req.Highlight = bleve.NewHighlight()
+	req.Highlight.AddField("title")
+	req.Highlight.AddField("body")
+
+	res, err := b.index.SearchInContext(ctx, req)
+	if err != nil {
+		return Results{}, err
+	}
+
+	results := Results{Total: res.Total, Hits: make([]Hit, 0, len(res.Hits))}
+	for _, h := range res.Hits {
+		itemID, _ := h.Fields["item_id"].(string)
+		docType, _ := h.Fields["type"].(string)
+		title, _ := h.Fields["title"].(string)
+		results.Hits = append(results.Hits, Hit{
+			ID:        itemID,
+			Type:      docType,
+			Title:     title,
+			Score:     h.Score,
+			Fragments: h.Fragments,
+		})
+	}
+	return results, nil
+}
+
+func buildQuery(q Query) query.Query {
+	owner := bleve.NewTermQuery(q.UserID)
+	owner.SetField("user_id")
+
+	title := bleve.NewMatchQuery(q.Text)
+	title.SetField("title")
+	title.SetBoost(3)
+	body := bleve.NewMatchQuery(q.Text)
+	body.SetField("body")
+	tag := bleve.NewTermQuery(strings.ToLower(q.Text))
+	tag.SetField("tags")
+	tag.SetBoost(2)
+
+	conjuncts := []query.Query{owner, bleve.NewDisjunctionQuery(title, body, tag)}
+
+	if len(q.Types) > 0 {
+		types := make([]query.Query, len(q.Types))
+		for i, t := range q.Types {
+			tq := bleve.NewTermQuery(t)
+			tq.SetField("type")
+			types[i] = tq
+		}
+		conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(types...))
+	}
+	for _, t := range q.Tags {
+		tq := bleve.NewTermQuery(strings.ToLower(t))
+		tq.SetField("tags")
+		conjuncts = append(conjuncts, tq)
+	}
+
+	return bleve.NewConjunctionQuery(conjuncts...)
+}
+
+func lowerAll(ss []string) []string {
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
+
+// Reset deletes the on-disk index and starts an empty one in its place.
+func (b *Bleve) Reset(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.index.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(b.path); err != nil {
+		return err
+	}
+
+	index, err := bleve.New(b.path, newMapping())
+	if err != nil {
+		return err
+	}
+	b.index = index
+	return nil
+}
+
+func (b *Bleve) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.index.Close()
+}
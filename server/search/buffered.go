@@ -0,0 +1,147 @@
+package search
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type bufferedOp struct {
+	doc    Document
+	id     string
+	delete bool
+}
+
+// Buffered queues writes to another Index and sends them in bulk, by batch
+// size or on a timer, whichever comes first. Callers don't wait on the
+// search cluster, and many small writes become one bulk request. Searches
+// and resets go straight to the underlying index.
+type Buffered struct {
+	inner     Index
+	batchSize int
+	interval  time.Duration
+
+	ops  chan bufferedOp
+	done chan struct{}
+	once sync.Once
+}
+
+const bufferedRetries = 3
+
+// NewBuffered starts a background writer that flushes once batchSize
+// distinct documents are queued or every interval.
+func NewBuffered(inner Index, batchSize int, interval time.Duration) *Buffered {
+	b := &Buffered{
+		inner:     inner,
+		batchSize: batchSize,
+		interval:  interval,
+		ops:       make(chan bufferedOp, batchSize*10),
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *Buffered) Index(ctx context.Context, docs ...Document) error {
+	for _, d := range docs {
+		select {
+		case b.ops <- bufferedOp{doc: d, id: DocumentID(d.Type, d.ID)}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *Buffered) Delete(ctx context.Context, ids ...string) error {
+	for _, id := range ids {
+		select {
+		case b.ops <- bufferedOp{id: id, delete: true}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *Buffered) Search(ctx context.Context, q Query) (Results, error) {
+	return b.inner.Search(ctx, q)
+}
+
+func (b *Buffered) Reset(ctx context.Context) error {
+	return b.inner.Reset(ctx)
+}
+
+// Close flushes queued writes and closes the underlying index.
+func (b *Buffered) Close() error {
+	b.once.Do(func() { close(b.ops) })
+	<-b.done
+	return b.inner.Close()
+}
+
+func (b *Buffered) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	// Keyed by document ID so only the latest write for a document is sent
+	pending := make(map[string]bufferedOp)
+	order := []string{}
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		var docs []Document
+		var deletes []string
+		for _, id := range order {
+			op := pending[id]
+			if op.delete {
+				deletes = append(deletes, id)
+			} else {
+				docs = append(docs, op.doc)
+			}
+		}
+		b.send(docs, deletes)
+		pending = make(map[string]bufferedOp)
+		order = order[:0]
+	}
+
+	for {
+		select {
+		case op, ok := <-b.ops:
+			if !ok {
+				flush()
+				return
+			}
+			if _, seen := pending[op.id]; !seen {
+				order = append(order, op.id)
+			}
+			pending[op.id] = op
+			if len(pending) >= b.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (b *Buffered) send(docs []Document, deletes []string) {
+	for attempt := 1; attempt <= bufferedRetries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := b.inner.Index(ctx, docs...)
+		if err == nil && len(deletes) > 0 {
+			err = b.inner.Delete(ctx, deletes...)
+		}
+		cancel()
+
+		if err == nil {
+			return
+		}
+		slog.Error("search: bulk write failed", "documents", len(docs), "deletes", len(deletes), "attempt", attempt, "error", err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
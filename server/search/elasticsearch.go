@@ -0,0 +1,299 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Elasticsearch is an Index backed by an Elasticsearch or OpenSearch cluster,
+// for hosted deployments that outgrow a local Bleve index. It speaks the
+// REST API directly; both engines accept the same requests used here.
+type Elasticsearch struct {
+	URL       string // e.g. https://search.internal:9200
+	IndexName string
+	Username  string
+	Password  string
+	APIKey    string
+	Client    *http.Client
+}
+
+var esMapping = map[string]interface{}{
+	"settings": map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"normalizer": map[string]interface{}{
+				"lowercase": map[string]interface{}{"type": "custom", "filter": []string{"lowercase"}},
+			},
+		},
+	},
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"item_id":    map[string]string{"type": "keyword"},
+			"user_id":    map[string]string{"type": "keyword"},
+			"type":       map[string]string{"type": "keyword"},
+			"source":     map[string]string{"type": "keyword"},
+			"language":   map[string]string{"type": "keyword", "normalizer": "lowercase"},
+			"tags":       map[string]string{"type": "keyword", "normalizer": "lowercase"},
+			"title":      map[string]string{"type": "text", "analyzer": "english"},
+			"body":       map[string]string{"type": "text", "analyzer": "english"},
+			"created_at": map[string]string{"type": "date"},
+		},
+	},
+}
+
+// OpenElasticsearch checks the cluster is reachable and creates the index
+// with its mapping if it does not exist yet.
+func OpenElasticsearch(ctx context.Context, es *Elasticsearch) (*Elasticsearch, error) {
+	if es.Client == nil {
+		es.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	es.URL = strings.TrimRight(es.URL, "/")
+
+	resp, err := es.do(ctx, http.MethodHead, "/"+es.IndexName, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return es, nil
+	case http.StatusNotFound:
+		if err := es.createIndex(ctx); err != nil {
+			return nil, err
+		}
+		return es, nil
+	default:
+		return nil, fmt.Errorf("search: elasticsearch: checking index: %s", resp.Status)
+	}
+}
+
+func (es *Elasticsearch) createIndex(ctx context.Context) error {
+	body, _ := json.Marshal(esMapping)
+	resp, err := es.do(ctx, http.MethodPut, "/"+es.IndexName, bytes.NewReader(body), "application/json")
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "creating index")
+}
+
+func (es *Elasticsearch) do(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, es.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	switch {
+	case es.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+es.APIKey)
+	case es.Username != "":
+		req.SetBasicAuth(es.Username, es.Password)
+	}
+
+	resp, err := es.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("search: elasticsearch: %w", err)
+	}
+	return resp, nil
+}
+
+func checkResponse(resp *http.Response, action string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("search: elasticsearch: %s: %s: %s", action, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (es *Elasticsearch) Index(ctx context.Context, docs ...Document) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, d := range docs {
+		enc.Encode(map[string]interface{}{
+			"index": map[string]string{"_index": es.IndexName, "_id": DocumentID(d.Type, d.ID)},
+		})
+		enc.Encode(map[string]interface{}{
+			"item_id":    d.ID,
+			"user_id":    d.UserID,
+			"type":       d.Type,
+			"source":     d.Source,
+			"language":   d.Language,
+			"tags":       d.Tags,
+			"title":      d.Title,
+			"body":       d.Body,
+			"created_at": d.CreatedAt,
+		})
+	}
+	return es.bulk(ctx, &buf)
+}
+
+func (es *Elasticsearch) Delete(ctx context.Context, ids ...string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, id := range ids {
+		enc.Encode(map[string]interface{}{
+			"delete": map[string]string{"_index": es.IndexName, "_id": id},
+		})
+	}
+	return es.bulk(ctx, &buf)
+}
+
+func (es *Elasticsearch) bulk(ctx context.Context, body *bytes.Buffer) error {
+	if body.Len() == 0 {
+		return nil
+	}
+
+	resp, err := es.do(ctx, http.MethodPost, "/_bulk", body, "application/x-ndjson")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return checkResponse(resp, "bulk")
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("search: elasticsearch: decoding bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+
+	failed := 0
+	var first string
+	for _, item := range result.Items {
+		for action, r := range item {
+			// Deleting a document that was never indexed is not a failure
+			if r.Error == nil || (action == "delete" && r.Status == http.StatusNotFound) {
+				continue
+			}
+			failed++
+			if first == "" {
+				first = string(r.Error)
+			}
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("search: elasticsearch: %d bulk items failed, first error: %s", failed, first)
+}
+
+func (es *Elasticsearch) Search(ctx context.Context, q Query) (Results, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	filters := []interface{}{
+		map[string]interface{}{"term": map[string]string{"user_id": q.UserID}},
+	}
+	if len(q.Types) > 0 {
+		filters = append(filters, map[string]interface{}{"terms": map[string][]string{"type": q.Types}})
+	}
+	for _, tag := range q.Tags {
+		filters = append(filters, map[string]interface{}{"term": map[string]string{"tags": tag}})
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"from":    q.Offset,
+		"size":    limit,
+		"_source": []string{"item_id", "type", "title"},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": filters,
+				"must": map[string]interface{}{
+					"multi_match": map[string]interface{}{
+						"query":  q.Text,
+						"fields": []string{"title^3", "body", "tags^2"},
+					},
+				},
+			},
+		},
+		"highlight": map[string]interface{}{
+			"pre_tags":  []string{"<mark>"},
+			"post_tags": []string{"</mark>"},
+			"fields":    map[string]interface{}{"title": map[string]interface{}{}, "body": map[string]interface{}{}},
+		},
+	})
+
+	resp, err := es.do(ctx, http.MethodPost, "/"+es.IndexName+"/_search", bytes.NewReader(body), "application/json")
+	if err != nil {
+		return Results{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Results{}, checkResponse(resp, "search")
+	}
+
+	var result struct {
+		Hits struct {
+			Total struct {
+				Value uint64 `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Score  float64 `json:"_score"`
+				Source struct {
+					ItemID string `json:"item_id"`
+					Type   string `json:"type"`
+					Title  string `json:"title"`
+				} `json:"_source"`
+				Highlight map[string][]string `json:"highlight"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Results{}, fmt.Errorf("search: elasticsearch: decoding search response: %w", err)
+	}
+
+	results := Results{Total: result.Hits.Total.Value, Hits: make([]Hit, 0, len(result.Hits.Hits))}
+	for _, h := range result.Hits.Hits {
+		results.Hits = append(results.Hits, Hit{
+			ID:        h.Source.ItemID,
+			Type:      h.Source.Type,
+			Title:     h.Source.Title,
+			Score:     h.Score,
+			Fragments: h.Highlight,
+		})
+	}
+	return results, nil
+}
+
+// Reset deletes and recreates the index.
+func (es *Elasticsearch) Reset(ctx context.Context) error {
+	resp, err := es.do(ctx, http.MethodDelete, "/"+es.IndexName, nil, "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		if err := checkResponse(resp, "deleting index"); err != nil {
+			return err
+		}
+	} else {
+		resp.Body.Close()
+	}
+	return es.createIndex(ctx)
+}
+
+func (es *Elasticsearch) Close() error {
+	es.Client.CloseIdleConnections()
+	return nil
+}
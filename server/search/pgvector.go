@@ -0,0 +1,136 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// PGVector is a VectorIndex in PostgreSQL using the pgvector extension, for
+// hosted deployments. With Dimensions set, an HNSW index keeps searches fast
+// as the table grows.
+type PGVector struct {
+	DB         *sql.DB
+	Dimensions int
+}
+
+// OpenPGVector enables the extension and creates the chunk table if needed.
+func OpenPGVector(ctx context.Context, p *PGVector) (*PGVector, error) {
+	column := "vector"
+	if p.Dimensions > 0 {
+		column = fmt.Sprintf("vector(%d)", p.Dimensions)
+	}
+
+	stmts := []string{
+		`CREATE EXTENSION IF NOT EXISTS vector`,
+		`CREATE TABLE IF NOT EXISTS semantic_chunks (
+			doc_key TEXT NOT NULL,
+			chunk INTEGER NOT NULL,
+			doc_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			title TEXT NOT NULL,
+			text TEXT NOT NULL,
+			embedding ` + column + ` NOT NULL,
+			PRIMARY KEY (doc_key, chunk)
+		)`,
+		`CREATE INDEX IF NOT EXISTS semantic_chunks_user_id ON semantic_chunks (user_id)`,
+	}
+	if p.Dimensions > 0 {
+		stmts = append(stmts, `CREATE INDEX IF NOT EXISTS semantic_chunks_embedding ON semantic_chunks USING hnsw (embedding vector_cosine_ops)`)
+	}
+
+	for _, stmt := range stmts {
+		if _, err := p.DB.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("search: pgvector: creating schema: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// vectorLiteral formats v in pgvector's text form, [1,2,3].
+func vectorLiteral(v []float32) string {
+	parts := make([]string, len(v))
+	for i, x := range v {
+		parts[i] = strconv.FormatFloat(float64(x), 'g', -1, 32)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+func (p *PGVector) Replace(ctx context.Context, docType, docID string, chunks []Chunk) error {
+	key := DocumentID(docType, docID)
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("search: pgvector: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM semantic_chunks WHERE doc_key = $1`, key); err != nil {
+		return fmt.Errorf("search: pgvector: %w", err)
+	}
+	for _, c := range chunks {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO semantic_chunks (doc_key, chunk, doc_id, user_id, type, title, text, embedding)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8::vector)`,
+			key, c.Index, c.DocID, c.UserID, c.Type, c.Title, c.Text, vectorLiteral(c.Vector))
+		if err != nil {
+			return fmt.Errorf("search: pgvector: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("search: pgvector: %w", err)
+	}
+	return nil
+}
+
+func (p *PGVector) Delete(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := p.DB.ExecContext(ctx, `DELETE FROM semantic_chunks WHERE doc_key = ANY($1)`, pq.Array(ids)); err != nil {
+		return fmt.Errorf("search: pgvector: %w", err)
+	}
+	return nil
+}
+
+func (p *PGVector) Search(ctx context.Context, q VectorQuery) ([]VectorHit, error) {
+	query := `SELECT doc_id, type, title, text, 1 - (embedding <=> $2::vector) AS score
+		FROM semantic_chunks
+		WHERE user_id = $1`
+	args := []interface{}{q.UserID, vectorLiteral(q.Vector)}
+	if len(q.Types) > 0 {
+		query += ` AND type = ANY($3)`
+		args = append(args, pq.Array(q.Types))
+	}
+	// Several chunks can come from one document, so fetch extra to still
+	// have Limit documents after keeping each one's best chunk
+	query += fmt.Sprintf(` ORDER BY embedding <=> $2::vector LIMIT %d`, q.Limit*5)
+
+	rows, err := p.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("search: pgvector: %w", err)
+	}
+	defer rows.Close()
+
+	var hits []VectorHit
+	for rows.Next() {
+		var h VectorHit
+		if err := rows.Scan(&h.ID, &h.Type, &h.Title, &h.Snippet, &h.Score); err != nil {
+			return nil, fmt.Errorf("search: pgvector: %w", err)
+		}
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search: pgvector: %w", err)
+	}
+	return bestPerDocument(hits, q.Limit), nil
+}
+
+func (p *PGVector) Close() error {
+	return p.DB.Close()
+}
@@ -0,0 +1,185 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Postgres is an Index in PostgreSQL's own full-text search, so deployments
+// already on PostgreSQL need no separate search service. Titles rank above
+// tags and tags above bodies.
+type Postgres struct {
+	DB *sql.DB
+	// Config is the text search configuration, "english" by default.
+	Config string
+}
+
+// fragmentDelimiter separates the fragments ts_headline returns.
+const fragmentDelimiter = "\x1f"
+
+// OpenPostgres creates the document table if needed.
+func OpenPostgres(ctx context.Context, p *Postgres) (*Postgres, error) {
+	if p.Config == "" {
+		p.Config = "english"
+	}
+
+	config := pq.QuoteLiteral(p.Config) + "::regconfig"
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS search_documents (
+			doc_key TEXT PRIMARY KEY,
+			doc_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			title TEXT NOT NULL,
+			body TEXT NOT NULL,
+			tags TEXT[] NOT NULL,
+			source TEXT NOT NULL,
+			language TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			document TSVECTOR GENERATED ALWAYS AS (
+				setweight(to_tsvector(` + config + `, title), 'A') ||
+				setweight(to_tsvector(` + config + `, array_to_string(tags, ' ')), 'B') ||
+				setweight(to_tsvector(` + config + `, body), 'C')
+			) STORED
+		)`,
+		`CREATE INDEX IF NOT EXISTS search_documents_user_id ON search_documents (user_id)`,
+		`CREATE INDEX IF NOT EXISTS search_documents_document ON search_documents USING gin (document)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := p.DB.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("search: postgres: creating schema: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Empty reports whether nothing has been indexed yet, as when the table was
+// just created for an existing database.
+func (p *Postgres) Empty(ctx context.Context) (bool, error) {
+	var exists bool
+	if err := p.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM search_documents)`).Scan(&exists); err != nil {
+		return false, fmt.Errorf("search: postgres: %w", err)
+	}
+	return !exists, nil
+}
+
+func (p *Postgres) Index(ctx context.Context, docs ...Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("search: postgres: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx,
+		`INSERT INTO search_documents (doc_key, doc_id, user_id, type, title, body, tags, source, language, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (doc_key) DO UPDATE SET
+			user_id = EXCLUDED.user_id, title = EXCLUDED.title, body = EXCLUDED.body,
+			tags = EXCLUDED.tags, source = EXCLUDED.source, language = EXCLUDED.language,
+			created_at = EXCLUDED.created_at`)
+	if err != nil {
+		return fmt.Errorf("search: postgres: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, d := range docs {
+		_, err := stmt.ExecContext(ctx, DocumentID(d.Type, d.ID), d.ID, d.UserID, d.Type,
+			d.Title, d.Body, pq.Array(lowerAll(d.Tags)), d.Source, strings.ToLower(d.Language), d.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("search: postgres: indexing %s: %w", DocumentID(d.Type, d.ID), err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("search: postgres: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) Delete(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := p.DB.ExecContext(ctx, `DELETE FROM search_documents WHERE doc_key = ANY($1)`, pq.Array(ids)); err != nil {
+		return fmt.Errorf("search: postgres: %w", err)
+	}
+	return nil
+}
+
+// Search matches q.Text as websearch_to_tsquery reads it: words, "quoted
+// phrases", OR and -excluded words. Fragments come from the title and body
+// only where they match, with matches in <mark> as the other backends do.
+func (p *Postgres) Search(ctx context.Context, q Query) (Results, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	headline := `StartSel=<mark>, StopSel=</mark>, MaxFragments=3, MaxWords=20, MinWords=8, FragmentDelimiter="` + fragmentDelimiter + `"`
+	query := `SELECT doc_id, type, title,
+			ts_rank_cd(document, query) AS score,
+			CASE WHEN to_tsvector($2::regconfig, title) @@ query
+				THEN ts_headline($2::regconfig, title, query, $4) END,
+			CASE WHEN to_tsvector($2::regconfig, body) @@ query
+				THEN ts_headline($2::regconfig, body, query, $4) END,
+			COUNT(*) OVER ()
+		FROM search_documents, websearch_to_tsquery($2::regconfig, $3) AS query
+		WHERE user_id = $1 AND document @@ query`
+	args := []interface{}{q.UserID, p.Config, q.Text, headline}
+	if len(q.Types) > 0 {
+		args = append(args, pq.Array(q.Types))
+		query += fmt.Sprintf(` AND type = ANY($%d)`, len(args))
+	}
+	if len(q.Tags) > 0 {
+		args = append(args, pq.Array(lowerAll(q.Tags)))
+		query += fmt.Sprintf(` AND tags @> $%d`, len(args))
+	}
+	query += fmt.Sprintf(` ORDER BY score DESC, created_at DESC LIMIT %d OFFSET %d`, limit, q.Offset)
+
+	rows, err := p.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return Results{}, fmt.Errorf("search: postgres: %w", err)
+	}
+	defer rows.Close()
+
+	results := Results{Hits: []Hit{}}
+	for rows.Next() {
+		var (
+			h           Hit
+			title, body sql.NullString
+		)
+		if err := rows.Scan(&h.ID, &h.Type, &h.Title, &h.Score, &title, &body, &results.Total); err != nil {
+			return Results{}, fmt.Errorf("search: postgres: %w", err)
+		}
+		h.Fragments = map[string][]string{}
+		if title.Valid {
+			h.Fragments["title"] = []string{title.String}
+		}
+		if body.Valid {
+			h.Fragments["body"] = strings.Split(body.String, fragmentDelimiter)
+		}
+		results.Hits = append(results.Hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		return Results{}, fmt.Errorf("search: postgres: %w", err)
+	}
+	return results, nil
+}
+
+func (p *Postgres) Reset(ctx context.Context) error {
+	if _, err := p.DB.ExecContext(ctx, `TRUNCATE search_documents`); err != nil {
+		return fmt.Errorf("search: postgres: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) Close() error {
+	return p.DB.Close()
+}
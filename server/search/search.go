@@ -0,0 +1,74 @@
+// Package search indexes backups, projects, conversations and tags for
+// full-text search. Index is implemented by an embedded Bleve index for
+// self-hosted installs, by PostgreSQL full-text search for installs on
+// PostgreSQL, and by Elasticsearch/OpenSearch for large hosted deployments.
+package search
+
+import (
+	"context"
+	"time"
+)
+
+// Document types.
+const (
+	TypeBackup       = "backup"
+	TypeProject      = "project"
+	TypeConversation = "conversation"
+)
+
+// Document is one searchable item. Every document belongs to a user and
+// searches never cross users.
+type Document struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Type      string    `json:"type"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Tags      []string  `json:"tags"`
+	Source    string    `json:"source"`
+	Language  string    `json:"language"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Query is a search for one user's documents.
+type Query struct {
+	UserID string
+	Text   string
+	// Types restricts results to these document types; all when empty.
+	Types  []string
+	Tags   []string
+	Limit  int
+	Offset int
+}
+
+// Hit is one search result with highlighted fragments of the matching text.
+type Hit struct {
+	ID        string              `json:"id"`
+	Type      string              `json:"type"`
+	Title     string              `json:"title"`
+	Score     float64             `json:"score"`
+	Fragments map[string][]string `json:"fragments,omitempty"`
+}
+
+// Results is a page of hits and the total number of matches.
+type Results struct {
+	Total uint64 `json:"total"`
+	Hits  []Hit  `json:"hits"`
+}
+
+// Index is a full-text search backend.
+type Index interface {
+	// Index adds or replaces documents by ID.
+	Index(ctx context.Context, docs ...Document) error
+	Delete(ctx context.Context, ids ...string) error
+	Search(ctx context.Context, q Query) (Results, error)
+	// Reset drops every document so the index can be rebuilt from scratch.
+	Reset(ctx context.Context) error
+	Close() error
+}
+
+// DocumentID namespaces an item ID by type so backups and projects can
+// never collide in the index.
+func DocumentID(docType, id string) string {
+	return docType + ":" + id
+}
@@ -0,0 +1,131 @@
+package search
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Chunk is one embedded passage of a document. Long documents are split so
+// a match points at the part of a conversation that is relevant, not just
+// the conversation.
+type Chunk struct {
+	DocID  string    `json:"doc_id"` // the item's ID, as in Document.ID
+	Index  int       `json:"index"`
+	UserID string    `json:"user_id"`
+	Type   string    `json:"type"`
+	Title  string    `json:"title"`
+	Text   string    `json:"text"`
+	Vector []float32 `json:"vector"`
+}
+
+// VectorQuery is a nearest-neighbour search over one user's chunks.
+type VectorQuery struct {
+	UserID string
+	Vector []float32
+	// Types restricts results to these document types; all when empty.
+	Types []string
+	Limit int
+}
+
+// VectorHit is a document whose best chunk is close to the query. Snippet
+// is that chunk's text and Score its cosine similarity.
+type VectorHit struct {
+	ID      string  `json:"id"`
+	Type    string  `json:"type"`
+	Title   string  `json:"title"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+// VectorIndex stores embedded chunks for semantic search. It is implemented
+// by a local in-process index and by PostgreSQL with pgvector.
+type VectorIndex interface {
+	// Replace swaps all chunks of a document for chunks, which may be empty.
+	Replace(ctx context.Context, docType, docID string, chunks []Chunk) error
+	// Delete drops documents by DocumentID.
+	Delete(ctx context.Context, ids ...string) error
+	Search(ctx context.Context, q VectorQuery) ([]VectorHit, error)
+	Close() error
+}
+
+// SplitText cuts text into chunks of about size bytes that overlap by
+// overlap bytes, breaking at whitespace where possible so words stay whole.
+func SplitText(text string, size, overlap int) []string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	if overlap >= size {
+		overlap = size / 4
+	}
+
+	var chunks []string
+	for start := 0; start < len(text); {
+		end := start + size
+		if end >= len(text) {
+			chunks = append(chunks, text[start:])
+			break
+		}
+		if cut := strings.LastIndexAny(text[start+size/2:end], " \n\t"); cut >= 0 {
+			end = start + size/2 + cut
+		}
+		for end > start && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		chunks = append(chunks, strings.TrimSpace(text[start:end]))
+
+		// Start the next chunk overlap bytes back, at a word boundary
+		next := end - overlap
+		if next <= start {
+			next = end
+		} else if i := strings.IndexAny(text[next:end], " \n\t"); i >= 0 {
+			next += i + 1
+		}
+		for next < len(text) && !utf8.RuneStart(text[next]) {
+			next++
+		}
+		start = next
+	}
+	return chunks
+}
+
+// normalize scales v to unit length so a dot product is cosine similarity.
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(1 / math.Sqrt(sum))
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = x * norm
+	}
+	return out
+}
+
+// bestPerDocument keeps the highest scoring hit for each document, best
+// first, at most limit.
+func bestPerDocument(hits []VectorHit, limit int) []VectorHit {
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+
+	seen := make(map[string]bool)
+	out := []VectorHit{}
+	for _, h := range hits {
+		key := DocumentID(h.Type, h.ID)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, h)
+		if len(out) == limit {
+			break
+		}
+	}
+	return out
+}
@@ -0,0 +1,140 @@
+package search
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LocalVectors is a VectorIndex held in memory and saved to a file, for
+// self-hosted installs. Search compares the query with every chunk of the
+// user, which is fast enough for one person's archive.
+type LocalVectors struct {
+	path string
+
+	mu     sync.RWMutex
+	chunks map[string][]Chunk // DocumentID -> chunks, vectors normalized
+	dirty  bool
+}
+
+// OpenLocalVectors loads the index saved at path, or starts an empty one if
+// there is none. An empty path keeps the index in memory only.
+func OpenLocalVectors(path string) (*LocalVectors, error) {
+	l := &LocalVectors{path: path, chunks: make(map[string][]Chunk)}
+	if path == "" {
+		return l, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&l.chunks); err != nil {
+		return nil, fmt.Errorf("search: reading vector index %s: %w", path, err)
+	}
+	return l, nil
+}
+
+func (l *LocalVectors) Replace(_ context.Context, docType, docID string, chunks []Chunk) error {
+	stored := make([]Chunk, len(chunks))
+	for i, c := range chunks {
+		c.Vector = normalize(c.Vector)
+		stored[i] = c
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(stored) == 0 {
+		delete(l.chunks, DocumentID(docType, docID))
+	} else {
+		l.chunks[DocumentID(docType, docID)] = stored
+	}
+	l.dirty = true
+	return nil
+}
+
+func (l *LocalVectors) Delete(_ context.Context, ids ...string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, id := range ids {
+		delete(l.chunks, id)
+	}
+	l.dirty = true
+	return nil
+}
+
+func (l *LocalVectors) Search(_ context.Context, q VectorQuery) ([]VectorHit, error) {
+	query := normalize(q.Vector)
+	types := make(map[string]bool)
+	for _, t := range q.Types {
+		types[t] = true
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var hits []VectorHit
+	for _, chunks := range l.chunks {
+		for _, c := range chunks {
+			if c.UserID != q.UserID || (len(types) > 0 && !types[c.Type]) || len(c.Vector) != len(query) {
+				continue
+			}
+			var score float32
+			for i := range query {
+				score += query[i] * c.Vector[i]
+			}
+			hits = append(hits, VectorHit{ID: c.DocID, Type: c.Type, Title: c.Title, Score: float64(score), Snippet: c.Text})
+		}
+	}
+	return bestPerDocument(hits, q.Limit), nil
+}
+
+// Save writes the index to its file if it changed since the last save.
+func (l *LocalVectors) Save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".vectors-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(l.chunks); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// Close saves the index.
+func (l *LocalVectors) Close() error {
+	return l.Save()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/search"
+	"backup-manager/storage"
+)
+
+const (
+	maxSearchResults = 100
+	// Documents per indexDocuments call during a rebuild
+	searchRebuildBatch = 500
+
+	esBulkSize      = 500
+	esFlushInterval = 2 * time.Second
+)
+
+var (
+	searchIndex search.Index
+	// searchIndexEmpty is set when a new PostgreSQL index was opened for an
+	// existing database, which then needs a rebuild to fill it
+	searchIndexEmpty bool
+
+	// Only one rebuild may run at a time
+	rebuildMu sync.Mutex
+)
+
+// initSearch opens the index selected by SEARCH_BACKEND: PostgreSQL
+// full-text search when DATABASE_URL is PostgreSQL and a local Bleve index
+// otherwise, or an Elasticsearch/OpenSearch cluster for hosted deployments.
+func initSearch() {
+	backend := config.Get("SEARCH_BACKEND")
+	if backend == "" {
+		backend = "bleve"
+		if url := config.Get("DATABASE_URL"); strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+			backend = "postgres"
+		}
+	}
+
+	switch backend {
+	case "bleve":
+		path := config.Get("SEARCH_INDEX_PATH")
+		if path == "" {
+			path = filepath.Join(os.TempDir(), "backup-manager-search.bleve")
+		}
+
+		index, err := search.OpenBleve(path)
+		if err != nil {
+			fatal("Error opening search index", "path", path, "error", err)
+		}
+		searchIndex = index
+	case "postgres":
+		searchIndex = openPostgresSearch()
+	case "elasticsearch", "opensearch":
+		searchIndex = openElasticsearch()
+	default:
+		fatal("Unknown SEARCH_BACKEND", "backend", backend)
+	}
+}
+
+// openPostgresSearch keeps the index in the database itself, or in
+// SEARCH_DATABASE_URL if set. SEARCH_LANGUAGE picks the text search
+// configuration used for stemming, "english" by default.
+func openPostgresSearch() search.Index {
+	url := config.Get("SEARCH_DATABASE_URL")
+	if url == "" {
+		url = config.Get("DATABASE_URL")
+	}
+	if url == "" {
+		fatal("DATABASE_URL or SEARCH_DATABASE_URL is required when SEARCH_BACKEND is postgres")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		fatal("Error opening search database", "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	index, err := search.OpenPostgres(ctx, &search.Postgres{DB: db, Config: config.Get("SEARCH_LANGUAGE")})
+	if err != nil {
+		fatal("Error opening PostgreSQL search index", "error", err)
+	}
+	if searchIndexEmpty, err = index.Empty(ctx); err != nil {
+		fatal("Error opening PostgreSQL search index", "error", err)
+	}
+	return index
+}
+
+func openElasticsearch() search.Index {
+	url := config.Get("ELASTICSEARCH_URL")
+	if url == "" {
+		fatal("ELASTICSEARCH_URL is required when SEARCH_BACKEND is elasticsearch")
+	}
+	name := config.Get("ELASTICSEARCH_INDEX")
+	if name == "" {
+		name = "backup-manager"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	es, err := search.OpenElasticsearch(ctx, &search.Elasticsearch{
+		URL:       url,
+		IndexName: name,
+		Username:  config.Get("ELASTICSEARCH_USERNAME"),
+		Password:  config.Get("ELASTICSEARCH_PASSWORD"),
+		APIKey:    config.Get("ELASTICSEARCH_API_KEY"),
+	})
+	if err != nil {
+		fatal("Error opening Elasticsearch index", "index", name, "error", err)
+	}
+
+	// Writes go through a queue and are sent with the bulk API, so uploads
+	// don't wait on the cluster.
+	return search.NewBuffered(es, esBulkSize, esFlushInterval)
+}
+
+// searchOwner is who a record is indexed and searched under: its team, so
+// that every member finds it, or else its user.
+func searchOwner(userID, teamID string) string {
+	if teamID != "" {
+		return "team:" + teamID
+	}
+	return userID
+}
+
+func backupDocument(b Backup) search.Document {
+	return search.Document{
+		ID:        b.ID,
+		UserID:    searchOwner(b.UserID, b.TeamID),
+		Type:      search.TypeBackup,
+		Title:     b.Name,
+		Body:      strings.TrimSpace(b.Title + "\n" + b.Summary + "\n" + b.ContentPreview),
+		Source:    b.Source,
+		CreatedAt: b.Timestamp,
+	}
+}
+
+func projectDocument(p Project) search.Document {
+	body := p.Description + "\n" + p.GeneratedDescription + "\n" + strings.Join(p.Features, "\n") + "\n" + p.Code
+	for _, f := range p.Files {
+		// Code is already the entry point's
+		if f.Content != p.Code {
+			body += "\n" + f.Path + "\n" + f.Content
+		}
+	}
+	return search.Document{
+		ID:        p.ID,
+		UserID:    searchOwner(p.UserID, p.TeamID),
+		Type:      search.TypeProject,
+		Title:     p.Name,
+		Body:      body,
+		Tags:      p.Tags,
+		Source:    p.Source,
+		Language:  p.Language,
+		CreatedAt: p.Timestamp,
+	}
+}
+
+// indexDocuments adds documents to the search index. Indexing failures are
+// logged rather than failing the request; a rebuild repairs the index.
+func indexDocuments(docs ...search.Document) {
+	if err := searchIndex.Index(context.Background(), docs...); err != nil {
+		slog.Error("Error indexing documents", "count", len(docs), "error", err)
+	}
+}
+
+// removeDocuments drops documents from the search index, by search.DocumentID.
+func removeDocuments(ids ...string) {
+	if err := searchIndex.Delete(context.Background(), ids...); err != nil {
+		slog.Error("Error removing documents from search index", "count", len(ids), "error", err)
+	}
+	removeEmbeddings(ids...)
+}
+
+// rebuildSearchIndex drops the index and re-indexes everything from the
+// database.
+func rebuildSearchIndex() {
+	if !rebuildMu.TryLock() {
+		slog.Info("Search index rebuild already running")
+		return
+	}
+	defer rebuildMu.Unlock()
+
+	start := time.Now()
+	if err := searchIndex.Reset(context.Background()); err != nil {
+		slog.Error("Error resetting search index", "error", err)
+		return
+	}
+
+	ctx := context.Background()
+	backups, err := db.Backups().List(ctx, "")
+	if err != nil {
+		slog.Error("Error loading backups for search index", "error", err)
+		return
+	}
+	projects, err := db.Projects().List(ctx, "")
+	if err != nil {
+		slog.Error("Error loading projects for search index", "error", err)
+		return
+	}
+
+	docs := make([]search.Document, 0, searchRebuildBatch)
+	flush := func() {
+		if len(docs) > 0 {
+			indexDocuments(docs...)
+			docs = docs[:0]
+		}
+	}
+	for _, b := range backups {
+		if docs = append(docs, backupDocument(b)); len(docs) == searchRebuildBatch {
+			flush()
+		}
+	}
+	for _, p := range projects {
+		if docs = append(docs, projectDocument(p)); len(docs) == searchRebuildBatch {
+			flush()
+		}
+	}
+	flush()
+
+	slog.Info("Search index rebuilt", "duration_ms", time.Since(start).Milliseconds())
+}
+
+// Handlers
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	params := r.URL.Query()
+
+	q := strings.TrimSpace(params.Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit, _ := strconv.Atoi(params.Get("limit"))
+	if limit <= 0 || limit > maxSearchResults {
+		limit = 20
+	}
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	results, err := searchIndex.Search(r.Context(), search.Query{
+		UserID: searchOwner(userID, storage.TeamFrom(r.Context())),
+		Text:   q,
+		Types:  params["type"],
+		Tags:   params["tag"],
+		Limit:  limit,
+		Offset: offset,
+	})
+	if err != nil {
+		logger(r.Context()).Error("Search error", "error", err)
+		http.Error(w, "Error searching", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func rebuildSearchIndexHandler(w http.ResponseWriter, r *http.Request) {
+	logger(r.Context()).Info("Search index rebuild requested", "email", r.Header.Get("X-User-Email"))
+	go rebuildSearchIndex()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "rebuilding",
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"backup-manager/config"
+	"backup-manager/llm"
+	"backup-manager/search"
+	"backup-manager/storage"
+)
+
+const (
+	embeddingTimeout   = 2 * time.Minute
+	embeddingChunkSize = 2000 // bytes
+	embeddingOverlap   = 200
+	embeddingBatchSize = 32 // chunks per embeddings request
+	maxEmbeddingChunks = 200
+	vectorSaveInterval = time.Minute
+)
+
+var (
+	embedder       llm.Embedder
+	vectorIndex    search.VectorIndex
+	embeddingQueue = make(chan embeddingJob, 100)
+)
+
+// embeddingJob is a document to embed. text is the full text to split into
+// chunks, which for backups is more than the document's preview body.
+type embeddingJob struct {
+	doc  search.Document
+	text string
+}
+
+// initSemanticSearch configures embeddings from EMBEDDINGS_PROVIDER
+// ("openai", or "local" for an OpenAI-compatible server) and the vector
+// store from VECTOR_STORE ("local" by default, or "pgvector"). Semantic
+// search stays disabled when no provider is set.
+func initSemanticSearch() {
+	provider := config.Get("EMBEDDINGS_PROVIDER")
+	if provider == "" {
+		return
+	}
+	model := config.Get("EMBEDDINGS_MODEL")
+	if model == "" {
+		fatal("EMBEDDINGS_MODEL must be set when EMBEDDINGS_PROVIDER is")
+	}
+
+	switch provider {
+	case "openai":
+	case "local":
+		if config.Get("EMBEDDINGS_BASE_URL") == "" {
+			fatal("EMBEDDINGS_BASE_URL must be set when EMBEDDINGS_PROVIDER=local")
+		}
+	default:
+		fatal("Unknown EMBEDDINGS_PROVIDER", "provider", provider)
+	}
+	embedder = &llm.OpenAIEmbeddings{
+		URL:    config.Get("EMBEDDINGS_BASE_URL"),
+		APIKey: config.Get("EMBEDDINGS_API_KEY"),
+		Model:  model,
+	}
+
+	switch store := config.Get("VECTOR_STORE"); store {
+	case "", "local":
+		path := config.Get("VECTOR_INDEX_PATH")
+		if path == "" {
+			path = filepath.Join(os.TempDir(), "backup-manager-vectors.gob")
+		}
+		index, err := search.OpenLocalVectors(path)
+		if err != nil {
+			fatal("Error opening vector index", "path", path, "error", err)
+		}
+		vectorIndex = index
+	case "pgvector":
+		vectorIndex = openPGVector()
+	default:
+		fatal("Unknown VECTOR_STORE", "store", store)
+	}
+
+	go runEmbeddingWorker()
+}
+
+func openPGVector() search.VectorIndex {
+	url := config.Get("PGVECTOR_URL")
+	if url == "" {
+		fatal("PGVECTOR_URL is required when VECTOR_STORE is pgvector")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		fatal("Error opening pgvector database", "error", err)
+	}
+	dims, _ := strconv.Atoi(config.Get("EMBEDDINGS_DIMENSIONS"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	index, err := search.OpenPGVector(ctx, &search.PGVector{DB: db, Dimensions: dims})
+	if err != nil {
+		fatal("Error opening pgvector index", "error", err)
+	}
+	return index
+}
+
+// saveVectorIndex persists the local vector index. Other stores save as
+// they go.
+func saveVectorIndex() {
+	if local, ok := vectorIndex.(*search.LocalVectors); ok {
+		if err := local.Save(); err != nil {
+			slog.Error("Error saving vector index", "error", err)
+		}
+	}
+}
+
+// enqueueEmbedding schedules doc for semantic indexing using text, or the
+// document's own title and body when text is empty. It never blocks; when
+// the queue is full the document is skipped until the next rebuild.
+func enqueueEmbedding(doc search.Document, text string) {
+	if embedder == nil {
+		return
+	}
+	if text == "" {
+		text = doc.Title + "\n" + doc.Body
+	}
+
+	select {
+	case embeddingQueue <- embeddingJob{doc: doc, text: text}:
+	default:
+		slog.Warn("Embedding queue full, skipping", "type", doc.Type, "id", doc.ID)
+	}
+}
+
+// removeEmbeddings drops documents from the vector index, by
+// search.DocumentID.
+func removeEmbeddings(ids ...string) {
+	if vectorIndex == nil {
+		return
+	}
+	if err := vectorIndex.Delete(context.Background(), ids...); err != nil {
+		slog.Error("Error removing documents from vector index", "count", len(ids), "error", err)
+	}
+}
+
+func runEmbeddingWorker() {
+	for job := range embeddingQueue {
+		waitOutMaintenance()
+
+		ctx, cancel := context.WithTimeout(context.Background(), embeddingTimeout)
+		err := embedDocument(ctx, job.doc, job.text)
+		cancel()
+
+		if err != nil {
+			slog.Error("Embedding failed", "type", job.doc.Type, "id", job.doc.ID, "error", err)
+		}
+	}
+}
+
+// embedDocument splits text into overlapping chunks, embeds them and
+// replaces the document's chunks in the vector index.
+func embedDocument(ctx context.Context, doc search.Document, text string) error {
+	texts := search.SplitText(text, embeddingChunkSize, embeddingOverlap)
+	if len(texts) > maxEmbeddingChunks {
+		texts = texts[:maxEmbeddingChunks]
+	}
+
+	chunks := make([]search.Chunk, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		vectors, err := embedder.Embed(ctx, texts[start:end])
+		if err != nil {
+			return err
+		}
+		for i, v := range vectors {
+			chunks = append(chunks, search.Chunk{
+				DocID:  doc.ID,
+				Index:  start + i,
+				UserID: doc.UserID,
+				Type:   doc.Type,
+				Title:  doc.Title,
+				Text:   texts[start+i],
+				Vector: v,
+			})
+		}
+	}
+
+	return vectorIndex.Replace(ctx, doc.Type, doc.ID, chunks)
+}
+
+// Handlers
+func semanticSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if embedder == nil {
+		http.Error(w, "Semantic search is not enabled on this server", http.StatusNotImplemented)
+		return
+	}
+
+	userID := r.Header.Get("X-User-ID")
+	params := r.URL.Query()
+
+	q := strings.TrimSpace(params.Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(params.Get("limit"))
+	if limit <= 0 || limit > maxSearchResults {
+		limit = 10
+	}
+
+	vectors, err := embedder.Embed(r.Context(), []string{q})
+	if err != nil {
+		logger(r.Context()).Error("Error embedding search query", "error", err)
+		http.Error(w, "Error searching", http.StatusBadGateway)
+		return
+	}
+
+	hits, err := vectorIndex.Search(r.Context(), search.VectorQuery{
+		UserID: searchOwner(userID, storage.TeamFrom(r.Context())),
+		Vector: vectors[0],
+		Types:  params["type"],
+		Limit:  limit,
+	})
+	if err != nil {
+		logger(r.Context()).Error("Semantic search error", "error", err)
+		http.Error(w, "Error searching", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hits": hits,
+	})
+}
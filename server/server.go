@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"backup-manager/config"
+)
+
+// Server timeouts. READ_TIMEOUT and WRITE_TIMEOUT bound whole requests and
+// responses so a slow client can't hold a connection open; handlers that
+// stream backups lift them with liftDeadlines. SHUTDOWN_TIMEOUT is how long
+// requests in flight, and then running jobs, get to finish once the server
+// is asked to stop.
+const (
+	readHeaderTimeout      = 10 * time.Second
+	idleTimeout            = 2 * time.Minute
+	defaultReadTimeout     = time.Minute
+	defaultWriteTimeout    = 2 * time.Minute
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// durationSetting reads a duration such as "90s" from the environment
+// variable name, falling back to def when it is unset.
+func durationSetting(name string, def time.Duration) time.Duration {
+	v := config.Get(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		fatal("Invalid "+name, "value", v)
+	}
+	return d
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       durationSetting("READ_TIMEOUT", defaultReadTimeout),
+		WriteTimeout:      durationSetting("WRITE_TIMEOUT", defaultWriteTimeout),
+		IdleTimeout:       idleTimeout,
+	}
+	// Shutdown doesn't wait for or close hijacked connections
+	srv.RegisterOnShutdown(closeProgressSockets)
+	return srv
+}
+
+// serve runs srv, over TLS if configured to, until SIGINT or SIGTERM, then
+// stops accepting connections and waits for requests in flight to finish.
+// It returns an error only when the server couldn't start; a second signal
+// during shutdown exits at once.
+func serve(srv *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	start, companion := configureTLS(srv)
+	errc := make(chan error, 2)
+	go func() { errc <- start() }()
+	if companion != nil {
+		go func() { errc <- companion.ListenAndServe() }()
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	timeout := durationSetting("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	slog.Info("Shutting down", "timeout", timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if companion != nil {
+		companion.Shutdown(shutdownCtx)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Requests still running at shutdown were cut off", "error", err)
+	}
+	return nil
+}
+
+// closeResources flushes buffered writes and closes connections to the
+// database and other backends once no requests are left to use them.
+func closeResources() {
+	type closer struct {
+		name string
+		c    io.Closer
+	}
+	closers := []closer{
+		{"search index", searchIndex},
+		{"vector index", vectorIndex},
+		{"scan analytics", scanAnalytics},
+		{"event sink", eventSink},
+		{"job queue", jobQueue},
+		{"API key usage", apiKeyUsage},
+	}
+	if geoDB != nil {
+		closers = append(closers, closer{"GeoIP database", geoDB})
+	}
+	// Last, since flushing the others may still write to it
+	closers = append(closers, closer{"database", db})
+	for _, cl := range closers {
+		if cl.c == nil {
+			continue
+		}
+		if err := cl.c.Close(); err != nil {
+			slog.Error("Error closing "+cl.name, "error", err)
+		}
+	}
+}
+
+// liftDeadlines removes the server's read and write timeouts from a request
+// that streams a body of any size, such as a backup upload or download.
+func liftDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/storage"
+)
+
+// sessionCheckInterval is how long authMiddleware trusts what it last read
+// of a session. A session revoked on another server is refused within it;
+// one revoked on this server, at once.
+const sessionCheckInterval = 30 * time.Second
+
+// Session is one login on one device.
+type Session = storage.Session
+
+type sessionCheck struct {
+	active bool
+	at     time.Time
+}
+
+type sessionChecker struct {
+	mu      sync.Mutex
+	checked map[string]sessionCheck
+}
+
+var sessionChecks = &sessionChecker{checked: make(map[string]sessionCheck)}
+
+// active reports whether the session id of userID is still active. Reading
+// it from the database also records the session being used from ip.
+func (c *sessionChecker) active(ctx context.Context, id, userID, ip string) (bool, error) {
+	c.mu.Lock()
+	check, ok := c.checked[id]
+	c.mu.Unlock()
+	if ok && time.Since(check.at) < sessionCheckInterval {
+		return check.active, nil
+	}
+
+	now := time.Now()
+	session, err := db.Sessions().Get(ctx, id)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return false, err
+	}
+	active := err == nil && session.UserID == userID && session.RevokedAt == nil && now.Before(session.ExpiresAt)
+	if active {
+		if err := db.Sessions().Touch(ctx, id, ip, now); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger(ctx).Error("Error recording session use", "session_id", id, "error", err)
+		}
+	}
+
+	c.mu.Lock()
+	c.checked[id] = sessionCheck{active: active, at: now}
+	c.mu.Unlock()
+	return active, nil
+}
+
+// ended marks the session id revoked on this server.
+func (c *sessionChecker) ended(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checked[id] = sessionCheck{active: false, at: time.Now()}
+}
+
+// prune forgets checks too old to be trusted again.
+func (c *sessionChecker) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, check := range c.checked {
+		if time.Since(check.at) > sessionCheckInterval {
+			delete(c.checked, id)
+		}
+	}
+}
+
+// startSession records a login from the device r came from and returns
+// its ID with the first refresh token for it.
+func startSession(r *http.Request, userID string) (sessionID, refreshToken string, err error) {
+	refresh, refreshToken := newRefreshToken(userID, generateID())
+	session := Session{
+		ID:         refresh.SessionID,
+		UserID:     userID,
+		UserAgent:  truncate(r.UserAgent(), 512),
+		IPAddress:  clientIP(r),
+		CreatedAt:  refresh.CreatedAt,
+		LastUsedAt: refresh.CreatedAt,
+		ExpiresAt:  refresh.ExpiresAt,
+	}
+	if err := db.Sessions().Create(r.Context(), session); err != nil {
+		return "", "", err
+	}
+	if err := db.RefreshTokens().Create(r.Context(), refresh); err != nil {
+		return "", "", err
+	}
+	return session.ID, refreshToken, nil
+}
+
+// describeDevice names the browser and system in a User-Agent, such as
+// "Firefox on Windows", for the session list. Other clients are shown by
+// their product token.
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	var browser string
+	for _, b := range []struct{ token, name string }{
+		// Edge and Opera also claim to be Chrome, and Chrome to be Safari
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	var system string
+	for _, s := range []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	product, _, _ := strings.Cut(userAgent, " ")
+	return product
+}
+
+// Handlers
+
+type sessionInfo struct {
+	Session
+	Device string `json:"device"`
+	// Current is the session the request was made with
+	Current bool `json:"current"`
+}
+
+func getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := db.Sessions().ListActive(r.Context(), r.Header.Get("X-User-ID"), time.Now())
+	if err != nil {
+		writeStorageError(w, r, err, "Sessions")
+		return
+	}
+	current := r.Header.Get("X-Session-ID")
+	infos := make([]sessionInfo, len(sessions))
+	for i, s := range sessions {
+		infos[i] = sessionInfo{Session: s, Device: describeDevice(s.UserAgent), Current: s.ID == current}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// revokeSessionHandler logs one of the user's devices out. Its access
+// tokens stop working along with its refresh token.
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+	if err := db.Sessions().Revoke(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Session")
+		return
+	}
+	sessionChecks.ended(id)
+	recordAudit(r, AuditEvent{Action: "auth.session_revoked", ResourceType: "session", ResourceID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeOtherSessionsHandler logs the user out everywhere but the session
+// making the request. Made with an API key, it ends every session.
+func revokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	current := r.Header.Get("X-Session-ID")
+	others, err := db.Sessions().ListActive(r.Context(), userID, time.Now())
+	if err != nil {
+		writeStorageError(w, r, err, "Sessions")
+		return
+	}
+	n, err := db.Sessions().RevokeOthers(r.Context(), userID, current)
+	if err != nil {
+		writeStorageError(w, r, err, "Sessions")
+		return
+	}
+	for _, s := range others {
+		if s.ID != current {
+			sessionChecks.ended(s.ID)
+		}
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "auth.sessions_revoked",
+		ResourceType: "user",
+		ResourceID:   userID,
+		Metadata:     map[string]interface{}{"revoked": n},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"revoked": n})
+}
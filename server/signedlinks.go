@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/qr"
+	"backup-manager/signedurl"
+	"backup-manager/storage"
+)
+
+// Scopes for signed links. A link signed for one scope is never accepted
+// for another, even on the same path.
+const (
+	scopeExportDownload = "export:download"
+	scopeBackupShare    = "backup:share"
+	scopeQRAsset        = "qr:asset"
+	scopeAttachmentRead = "attachment:read"
+)
+
+const (
+	defaultSignedLinkTTL = 7 * 24 * time.Hour
+	maxSignedLinkTTL     = 30 * 24 * time.Hour
+)
+
+// SignedLink is a link a user handed out; see storage.SignedLink.
+type SignedLink = storage.SignedLink
+
+var urlSigner *signedurl.Signer
+
+// initURLSigner sets up link signing. URL_SIGNING_KEY lets links be rotated
+// independently of sessions; it falls back to the JWT secret the server
+// started with.
+//
+// Links users hand out to a backup, a QR code's image or a project file
+// are recorded, so they can be revoked one by one. Export links are signed
+// afresh each time the export is read and stop working when it is deleted.
+func initURLSigner() {
+	key := []byte(config.Get("URL_SIGNING_KEY"))
+	if len(key) == 0 {
+		key = jwtKeys.signingKey()
+	}
+	urlSigner = signedurl.New(key, signedLinkRevocations{})
+}
+
+type signedLinkRevocations struct{}
+
+func (signedLinkRevocations) IsRevoked(ctx context.Context, linkID string) (bool, error) {
+	return db.SignedLinks().IsRevoked(ctx, linkID)
+}
+
+// verifySignedLink checks the request carries a valid signed link for scope,
+// writing the rejection and returning false when it does not.
+func verifySignedLink(w http.ResponseWriter, r *http.Request, scope string) (string, bool) {
+	id, err := urlSigner.Verify(r.Context(), r.URL.Path, r.URL.Query(), scope)
+	switch {
+	case err == nil:
+		return id, true
+	case errors.Is(err, signedurl.ErrExpired):
+		http.Error(w, "Link expired", http.StatusForbidden)
+	case errors.Is(err, signedurl.ErrRevoked):
+		http.Error(w, "Link revoked", http.StatusForbidden)
+	case errors.Is(err, signedurl.ErrMissing), errors.Is(err, signedurl.ErrSignature):
+		http.Error(w, "Invalid link", http.StatusForbidden)
+	default:
+		logger(r.Context()).Error("Error checking signed link", "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Database error")
+	}
+	return "", false
+}
+
+// loadSignedLink verifies the request's link for scope and returns its
+// record, which names the user it gives access for.
+func loadSignedLink(w http.ResponseWriter, r *http.Request, scope string) (SignedLink, bool) {
+	id, ok := verifySignedLink(w, r, scope)
+	if !ok {
+		return SignedLink{}, false
+	}
+	link, err := db.SignedLinks().Get(r.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Signed, but not by handing it out
+		http.Error(w, "Invalid link", http.StatusForbidden)
+		return SignedLink{}, false
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Link")
+		return SignedLink{}, false
+	}
+	return link, true
+}
+
+// decodeSignedLinkTTL reads how long a new link should last from
+// expires_in_hours, a week if unset.
+func decodeSignedLinkTTL(w http.ResponseWriter, r *http.Request, req interface{}, hours *int) (time.Duration, bool) {
+	if !decodeRequest(w, r, req) {
+		return 0, false
+	}
+	ttl := time.Duration(*hours) * time.Hour
+	if ttl > maxSignedLinkTTL {
+		writeFieldError(w, "expires_in_hours", "max", "expires_in_hours must be at most "+strconv.Itoa(int(maxSignedLinkTTL.Hours())))
+		return 0, false
+	}
+	if ttl == 0 {
+		ttl = defaultSignedLinkTTL
+	}
+	return ttl, true
+}
+
+// handOutSignedLink signs a link to path for the caller and records it,
+// answering with the link and its URL.
+func handOutSignedLink(w http.ResponseWriter, r *http.Request, scope, resourceID, path string, ttl time.Duration) {
+	userID := r.Header.Get("X-User-ID")
+	signed := urlSigner.Sign(path, scope, ttl)
+	link := SignedLink{
+		ID:         signed.ID,
+		UserID:     userID,
+		Scope:      scope,
+		ResourceID: resourceID,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  signed.ExpiresAt,
+	}
+	if err := db.SignedLinks().Create(r.Context(), link); err != nil {
+		writeStorageError(w, r, err, "Link")
+		return
+	}
+	link.URL = signed.URL
+
+	recordAudit(r, AuditEvent{Action: "link.created", ResourceType: "signed_link", ResourceID: link.ID,
+		Metadata: map[string]interface{}{"scope": scope, "resource_id": resourceID}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+func pruneSignedLinks() {
+	if err := db.SignedLinks().Prune(context.Background(), time.Now()); err != nil {
+		slog.Error("Failed to prune signed links", "error", err)
+	}
+}
+
+// Handlers
+func createBackupLinkHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req struct {
+		ExpiresInHours int `json:"expires_in_hours" validate:"min=0"`
+	}
+	ttl, ok := decodeSignedLinkTTL(w, r, &req, &req.ExpiresInHours)
+	if !ok {
+		return
+	}
+	if _, err := db.Backups().Get(r.Context(), r.Header.Get("X-User-ID"), id); err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	handOutSignedLink(w, r, scopeBackupShare, id, "/api/shared/backups/"+id, ttl)
+}
+
+func createQRLinkHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req struct {
+		ExpiresInHours int `json:"expires_in_hours" validate:"min=0"`
+	}
+	ttl, ok := decodeSignedLinkTTL(w, r, &req, &req.ExpiresInHours)
+	if !ok {
+		return
+	}
+	if _, err := db.QRCodes().Get(r.Context(), r.Header.Get("X-User-ID"), id); err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+	handOutSignedLink(w, r, scopeQRAsset, id, "/api/shared/qr/"+id+"/image", ttl)
+}
+
+// createAttachmentLinkHandler hands out a link to one of a project's files.
+func createAttachmentLinkHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req struct {
+		Path           string `json:"path" validate:"required"`
+		ExpiresInHours int    `json:"expires_in_hours" validate:"min=0"`
+	}
+	ttl, ok := decodeSignedLinkTTL(w, r, &req, &req.ExpiresInHours)
+	if !ok {
+		return
+	}
+	project, err := db.Projects().Get(r.Context(), r.Header.Get("X-User-ID"), id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	if _, ok := projectFile(project, req.Path); !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	handOutSignedLink(w, r, scopeAttachmentRead, id+"/"+req.Path, "/api/shared/projects/"+id+"/files/"+req.Path, ttl)
+}
+
+func projectFile(p Project, path string) (storage.ProjectFile, bool) {
+	for _, f := range p.Files {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return storage.ProjectFile{}, false
+}
+
+func getSignedLinksHandler(w http.ResponseWriter, r *http.Request) {
+	links, err := db.SignedLinks().List(r.Context(), r.Header.Get("X-User-ID"), time.Now())
+	if err != nil {
+		writeStorageError(w, r, err, "Links")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
+
+func revokeSignedLinkHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := db.SignedLinks().Revoke(r.Context(), r.Header.Get("X-User-ID"), id, time.Now()); err != nil {
+		writeStorageError(w, r, err, "Link")
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "link.revoked", ResourceType: "signed_link", ResourceID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sharedBackupHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	liftDeadlines(w)
+
+	link, ok := loadSignedLink(w, r, scopeBackupShare)
+	if !ok {
+		return
+	}
+	backup, err := db.Backups().Get(r.Context(), link.UserID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	serveBackup(w, r, backup, AuditEvent{UserID: link.UserID, Action: "backup.downloaded", ResourceType: "backup",
+		ResourceID: id, Metadata: map[string]interface{}{"link_id": link.ID}})
+}
+
+// sharedQRImageHandler draws a saved code as a PNG at its saved size, in
+// the default style.
+func sharedQRImageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	link, ok := loadSignedLink(w, r, scopeQRAsset)
+	if !ok {
+		return
+	}
+	qrCode, err := db.QRCodes().Get(r.Context(), link.UserID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "QR code")
+		return
+	}
+
+	out, err := renderSavedQR(qrCode)
+	if err != nil {
+		logger(r.Context()).Error("Error rendering QR code", "qr_id", id, "error", err)
+		http.Error(w, "Error rendering QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(out)
+}
+
+func renderSavedQR(qrCode QRCode) ([]byte, error) {
+	level, size, err := parseQROptions(qrCode.ECLevel, qrCode.Size)
+	if err != nil {
+		return nil, err
+	}
+	code, err := qr.Encode(qrCode.Content, level)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := renderQR(code, size, qrRenderOptions{}, nil)
+	return out, err
+}
+
+func sharedAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	link, ok := loadSignedLink(w, r, scopeAttachmentRead)
+	if !ok {
+		return
+	}
+	project, err := db.Projects().Get(r.Context(), link.UserID, vars["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	file, ok := projectFile(project, vars["path"])
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(file.Path)}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write([]byte(file.Content))
+}
@@ -0,0 +1,221 @@
+// Package similarity finds near-copies of source code. Code is reduced to a
+// MinHash signature over shingles of its tokens, so reformatting, comments
+// and small edits barely change it, and locality-sensitive hashing finds
+// similar pairs without comparing every pair.
+package similarity
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	numHashes    = 128
+	bands        = 32
+	rowsPerBand  = numHashes / bands
+	shingleWidth = 3 // tokens
+)
+
+// Signature is a MinHash signature of some code.
+type Signature struct {
+	Hashes [numHashes]uint64
+	// Tokens is how many tokens the code had; tiny snippets match too
+	// easily to be called duplicates.
+	Tokens int
+}
+
+var (
+	commentPattern = regexp.MustCompile(`(?s)/\*.*?\*/|//[^\n]*|#[^\n]*`)
+	tokenPattern   = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*|\d+(?:\.\d+)?|"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|[^\sA-Za-z0-9_]`)
+)
+
+// Tokenize splits code into tokens with comments dropped and identifiers
+// lowercased. Strings are kept, as they often carry what code is for.
+func Tokenize(code string) []string {
+	code = commentPattern.ReplaceAllString(code, " ")
+	tokens := tokenPattern.FindAllString(code, -1)
+	for i, t := range tokens {
+		tokens[i] = strings.ToLower(t)
+	}
+	return tokens
+}
+
+// mixers are the odd multipliers that derive each MinHash function from one
+// base hash of a shingle.
+var mixers = func() [numHashes]uint64 {
+	var m [numHashes]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range m {
+		// splitmix64, so the functions are fixed across restarts
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		m[i] = (z ^ (z >> 31)) | 1
+	}
+	return m
+}()
+
+// Sign computes the MinHash signature of code.
+func Sign(code string) Signature {
+	tokens := Tokenize(code)
+	sig := Signature{Tokens: len(tokens)}
+	for i := range sig.Hashes {
+		sig.Hashes[i] = ^uint64(0)
+	}
+
+	width := shingleWidth
+	if len(tokens) < width {
+		width = len(tokens)
+	}
+	for i := 0; i+width <= len(tokens) && width > 0; i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(tokens[i:i+width], "\x00")))
+		base := h.Sum64()
+		for j, m := range mixers {
+			v := base * m
+			v ^= v >> 29
+			if v < sig.Hashes[j] {
+				sig.Hashes[j] = v
+			}
+		}
+	}
+	return sig
+}
+
+// Similarity estimates the Jaccard similarity of the two codes' shingles,
+// from 0 (nothing shared) to 1 (the same tokens).
+func Similarity(a, b Signature) float64 {
+	same := 0
+	for i := range a.Hashes {
+		if a.Hashes[i] == b.Hashes[i] {
+			same++
+		}
+	}
+	return float64(same) / numHashes
+}
+
+// Item is something to compare, identified by ID.
+type Item struct {
+	ID        string
+	Signature Signature
+}
+
+// Pair is two items and their estimated similarity.
+type Pair struct {
+	A, B       string
+	Similarity float64
+}
+
+// Cluster is a group of items that are near-copies of each other, directly
+// or through other members.
+type Cluster struct {
+	IDs []string
+	// MinSimilarity and MaxSimilarity range over the pairs that linked the
+	// cluster together.
+	MinSimilarity float64
+	MaxSimilarity float64
+}
+
+// Clusters groups items whose similarity is at least threshold. Items with
+// fewer than minTokens tokens are ignored. Clusters are largest first.
+func Clusters(items []Item, threshold float64, minTokens int) []Cluster {
+	pairs := similarPairs(items, threshold, minTokens)
+
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(id string) string {
+		if parent[id] == id {
+			return id
+		}
+		parent[id] = find(parent[id])
+		return parent[id]
+	}
+	for _, p := range pairs {
+		for _, id := range []string{p.A, p.B} {
+			if _, ok := parent[id]; !ok {
+				parent[id] = id
+			}
+		}
+		if ra, rb := find(p.A), find(p.B); ra != rb {
+			parent[ra] = rb
+		}
+	}
+
+	byRoot := make(map[string]*Cluster)
+	for _, p := range pairs {
+		root := find(p.A)
+		c, ok := byRoot[root]
+		if !ok {
+			c = &Cluster{MinSimilarity: 1}
+			byRoot[root] = c
+		}
+		if p.Similarity < c.MinSimilarity {
+			c.MinSimilarity = p.Similarity
+		}
+		if p.Similarity > c.MaxSimilarity {
+			c.MaxSimilarity = p.Similarity
+		}
+	}
+	for id := range parent {
+		c := byRoot[find(id)]
+		c.IDs = append(c.IDs, id)
+	}
+
+	clusters := make([]Cluster, 0, len(byRoot))
+	for _, c := range byRoot {
+		sort.Strings(c.IDs)
+		clusters = append(clusters, *c)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].IDs) != len(clusters[j].IDs) {
+			return len(clusters[i].IDs) > len(clusters[j].IDs)
+		}
+		return clusters[i].IDs[0] < clusters[j].IDs[0]
+	})
+	return clusters
+}
+
+// similarPairs finds candidate pairs by banding the signatures: items whose
+// signatures agree on every row of some band share a bucket. Candidates are
+// then checked against the full signature.
+func similarPairs(items []Item, threshold float64, minTokens int) []Pair {
+	buckets := make(map[[2]uint64][]int)
+	for i, item := range items {
+		if item.Signature.Tokens < minTokens {
+			continue
+		}
+		for band := 0; band < bands; band++ {
+			h := fnv.New64a()
+			var buf [8]byte
+			for _, v := range item.Signature.Hashes[band*rowsPerBand : (band+1)*rowsPerBand] {
+				binary.LittleEndian.PutUint64(buf[:], v)
+				h.Write(buf[:])
+			}
+			key := [2]uint64{uint64(band), h.Sum64()}
+			buckets[key] = append(buckets[key], i)
+		}
+	}
+
+	seen := make(map[[2]int]bool)
+	var pairs []Pair
+	for _, members := range buckets {
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				i, j := members[x], members[y]
+				if seen[[2]int{i, j}] {
+					continue
+				}
+				seen[[2]int{i, j}] = true
+
+				if s := Similarity(items[i].Signature, items[j].Signature); s >= threshold {
+					pairs = append(pairs, Pair{A: items[i].ID, B: items[j].ID, Similarity: s})
+				}
+			}
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/sandbox"
+)
+
+// Snippet execution is opt-in: it only runs when SANDBOX_PROVIDER is set,
+// because even sandboxed, running users' code needs a deliberate decision
+// by whoever operates the deployment.
+const (
+	snippetRunsPerMinute  = 10 // per user
+	defaultSandboxWorkers = 4
+	maxSnippetStdin       = 64 << 10
+)
+
+var (
+	sandboxRunner  sandbox.Runner
+	sandboxSlots   chan struct{}
+	snippetLimiter = newRateLimiter()
+)
+
+// initSandbox configures snippet execution from SANDBOX_PROVIDER ("docker"
+// or "service"). It stays disabled when unset.
+func initSandbox() {
+	switch config.Get("SANDBOX_PROVIDER") {
+	case "":
+		return
+	case "docker":
+		sandboxRunner = &sandbox.Docker{
+			Path:    config.Get("SANDBOX_DOCKER_PATH"),
+			Runtime: config.Get("SANDBOX_RUNTIME"),
+			Limits:  sandbox.DefaultLimits,
+		}
+	case "service":
+		if config.Get("SANDBOX_SERVICE_URL") == "" {
+			fatal("SANDBOX_SERVICE_URL must be set when SANDBOX_PROVIDER=service")
+		}
+		sandboxRunner = &sandbox.Service{
+			URL:    config.Get("SANDBOX_SERVICE_URL"),
+			APIKey: config.Get("SANDBOX_SERVICE_API_KEY"),
+		}
+	default:
+		fatal("Unknown SANDBOX_PROVIDER", "provider", config.Get("SANDBOX_PROVIDER"))
+	}
+
+	workers := defaultSandboxWorkers
+	if n, err := strconv.Atoi(config.Get("SANDBOX_MAX_CONCURRENT")); err == nil && n > 0 {
+		workers = n
+	}
+	sandboxSlots = make(chan struct{}, workers)
+}
+
+// Handlers
+func getSandboxLanguagesHandler(w http.ResponseWriter, r *http.Request) {
+	languages := []string{}
+	if sandboxRunner != nil {
+		languages = sandbox.LanguageNames()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":   sandboxRunner != nil,
+		"languages": languages,
+	})
+}
+
+// runProjectSnippetHandler runs a project's code, or an edited version of
+// it sent in the request, and returns what it printed.
+func runProjectSnippetHandler(w http.ResponseWriter, r *http.Request) {
+	if sandboxRunner == nil {
+		http.Error(w, "Snippet execution is not enabled on this server", http.StatusNotImplemented)
+		return
+	}
+
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Language string `json:"language"`
+		Code     string `json:"code"`
+		Stdin    string `json:"stdin"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, sandbox.MaxCodeBytes+maxSnippetStdin+4096)
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Stdin) > maxSnippetStdin {
+		http.Error(w, "stdin is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+
+	if req.Code == "" {
+		req.Code = project.Code
+	}
+	if req.Language == "" {
+		req.Language = project.Language
+	}
+	req.Language = strings.ToLower(req.Language)
+	if strings.TrimSpace(req.Code) == "" {
+		http.Error(w, "Project has no code to run", http.StatusBadRequest)
+		return
+	}
+	if _, ok := sandbox.Languages[req.Language]; !ok {
+		http.Error(w, "Unsupported language; see /api/sandbox/languages", http.StatusBadRequest)
+		return
+	}
+
+	if allowed, _, retryAfter := snippetLimiter.allow(userID, snippetRunsPerMinute); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too many runs, slow down", http.StatusTooManyRequests)
+		return
+	}
+
+	// Runs are heavy, so only a few happen at once; the rest wait briefly
+	// and are turned away rather than piling up
+	select {
+	case sandboxSlots <- struct{}{}:
+		defer func() { <-sandboxSlots }()
+	case <-time.After(5 * time.Second):
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "All sandboxes are busy, try again shortly", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+
+	result, err := sandboxRunner.Run(ctx, sandbox.Request{Language: req.Language, Code: req.Code, Stdin: req.Stdin})
+	if err != nil {
+		if errors.Is(err, sandbox.ErrUnsupportedLanguage) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger(r.Context()).Error("Error running snippet", "project_id", id, "error", err)
+		http.Error(w, "Error running snippet", http.StatusBadGateway)
+		return
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "project.snippet_run",
+		ResourceType: "project",
+		ResourceID:   id,
+		Metadata: map[string]interface{}{
+			"language":  req.Language,
+			"exit_code": result.ExitCode,
+			"timed_out": result.TimedOut,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
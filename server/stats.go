@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backup-manager/analytics"
+)
+
+// topScannedCodes is how many of the most scanned codes stats list
+const topScannedCodes = 10
+
+// Handlers
+
+// getStatsHandler answers the dashboard: projects per language, lines of
+// code and storage over the last ?days= days, backups per source and QR
+// scan totals, all aggregated by the database. Counts cover the workspace
+// of the request; scans are of the codes the user made.
+func getStatsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	days := defaultAnalyticsDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 1 || d > scanRetentionDays {
+			http.Error(w, "days must be between 1 and "+strconv.Itoa(scanRetentionDays), http.StatusBadRequest)
+			return
+		}
+		days = d
+	}
+	now := time.Now().UTC()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -(days - 1))
+
+	stats, err := db.Stats(r.Context(), userID, since)
+	if err != nil {
+		writeStorageError(w, r, err, "Stats")
+		return
+	}
+	scans, err := scanAnalytics.Totals(r.Context(), analytics.TotalsQuery{OwnerID: userID, Since: since})
+	if err != nil {
+		logger(r.Context()).Error("Error querying scans", "error", err)
+		http.Error(w, "Error loading stats", http.StatusInternalServerError)
+		return
+	}
+	if len(scans.Codes) > topScannedCodes {
+		scans.Codes = scans.Codes[:topScannedCodes]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"days":                 days,
+		"since":                since,
+		"projects_by_language": stats.ProjectsByLanguage,
+		"lines_over_time":      stats.LinesOverTime,
+		"backups_by_source":    stats.BackupsBySource,
+		"storage_growth":       stats.StorageGrowth,
+		"qr_codes": map[string]interface{}{
+			"count":       stats.QRCodes,
+			"scans":       scans.Total,
+			"scan_series": fillBuckets(scans.Series, since, 24*time.Hour),
+			"top_codes":   scans.Codes,
+		},
+	})
+}
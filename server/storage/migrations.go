@@ -0,0 +1,758 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migrations are applied in order and never edited once released; change
+// the schema by appending one. {{uuid}}, {{json}} and {{timestamp}} are the
+// dialect's types for those columns, and {{serial}} an integer key the
+// database numbers.
+var migrations = []struct {
+	version int
+	name    string
+	stmts   []string
+}{
+	// The tables database/schema.sql creates, so a database initialised from
+	// it (as docker-compose does) and an empty one end up the same
+	{1, "baseline", []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			id {{uuid}} PRIMARY KEY,
+			email VARCHAR(255) UNIQUE NOT NULL,
+			password_hash VARCHAR(255) NOT NULL,
+			company_name VARCHAR(255),
+			created_at {{timestamp}} DEFAULT CURRENT_TIMESTAMP,
+			updated_at {{timestamp}} DEFAULT CURRENT_TIMESTAMP,
+			last_login {{timestamp}},
+			is_active BOOLEAN DEFAULT TRUE,
+			subscription_tier VARCHAR(50) DEFAULT 'free'
+		)`,
+		`CREATE TABLE IF NOT EXISTS backups (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name VARCHAR(500) NOT NULL,
+			source VARCHAR(100) NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			content_preview TEXT,
+			encrypted_data TEXT NOT NULL,
+			encryption_iv VARCHAR(255),
+			file_type VARCHAR(50),
+			checksum VARCHAR(64),
+			created_at {{timestamp}} DEFAULT CURRENT_TIMESTAMP,
+			updated_at {{timestamp}} DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT size_positive CHECK (size_bytes > 0)
+		)`,
+		`CREATE TABLE IF NOT EXISTS projects (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			backup_id {{uuid}} REFERENCES backups (id) ON DELETE CASCADE,
+			name VARCHAR(500) NOT NULL,
+			type VARCHAR(100) NOT NULL,
+			description TEXT,
+			source VARCHAR(100) NOT NULL,
+			language VARCHAR(50),
+			lines_of_code INTEGER,
+			features {{json}} DEFAULT '[]',
+			code TEXT NOT NULL,
+			tags {{json}} DEFAULT '[]',
+			starred BOOLEAN DEFAULT FALSE,
+			created_at {{timestamp}} DEFAULT CURRENT_TIMESTAMP,
+			updated_at {{timestamp}} DEFAULT CURRENT_TIMESTAMP,
+			CONSTRAINT loc_positive CHECK (lines_of_code >= 0)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_backups_user_id ON backups (user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_backups_created_at ON backups (created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_projects_user_id ON projects (user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_projects_backup_id ON projects (backup_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_projects_created_at ON projects (created_at DESC)`,
+	}},
+	{2, "server columns and qr codes", []string{
+		// Addresses are compared case-insensitively, which the baseline's
+		// UNIQUE constraint doesn't enforce
+		`CREATE UNIQUE INDEX idx_users_email_lower ON users (lower(email))`,
+		`ALTER TABLE backups ADD COLUMN thumbnail_url TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE backups ADD COLUMN title TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE backups ADD COLUMN summary TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE backups ADD COLUMN summary_model VARCHAR(100) NOT NULL DEFAULT ''`,
+		`ALTER TABLE backups ADD COLUMN ciphertext_checksum VARCHAR(64) NOT NULL DEFAULT ''`,
+		`ALTER TABLE backups ADD COLUMN blob_key TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE projects ADD COLUMN generated_description TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE projects ADD COLUMN description_model VARCHAR(100) NOT NULL DEFAULT ''`,
+		`CREATE TABLE qr_codes (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			content TEXT NOT NULL,
+			ec_level VARCHAR(1) NOT NULL,
+			size INTEGER NOT NULL,
+			version INTEGER NOT NULL,
+			created_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_qr_codes_user_id ON qr_codes (user_id)`,
+	}},
+	{3, "refresh tokens", []string{
+		`CREATE TABLE refresh_tokens (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			created_at {{timestamp}} NOT NULL,
+			expires_at {{timestamp}} NOT NULL,
+			revoked_at {{timestamp}},
+			replaced_by {{uuid}}
+		)`,
+		`CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens (user_id)`,
+		`CREATE INDEX idx_refresh_tokens_expires_at ON refresh_tokens (expires_at)`,
+	}},
+	{4, "dynamic qr codes", []string{
+		`ALTER TABLE qr_codes ADD COLUMN short_code VARCHAR(16)`,
+		`ALTER TABLE qr_codes ADD COLUMN target TEXT NOT NULL DEFAULT ''`,
+		`CREATE UNIQUE INDEX idx_qr_codes_short_code ON qr_codes (short_code)`,
+		`CREATE TABLE qr_code_targets (
+			qr_code_id {{uuid}} NOT NULL REFERENCES qr_codes (id) ON DELETE CASCADE,
+			target TEXT NOT NULL,
+			changed_by {{uuid}} NOT NULL,
+			changed_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_qr_code_targets_qr_code_id ON qr_code_targets (qr_code_id, changed_at)`,
+	}},
+	{5, "backup key versions", []string{
+		// Existing backups were encrypted with the only server key there
+		// was, or with their owner's data key
+		`ALTER TABLE backups ADD COLUMN key_version INTEGER NOT NULL DEFAULT 1`,
+		`CREATE INDEX idx_backups_key_version ON backups (key_version)`,
+	}},
+	{6, "user roles", []string{
+		// Disabling an account clears the baseline's is_active
+		`ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user'`,
+		`ALTER TABLE users ADD COLUMN password_reset_required BOOLEAN NOT NULL DEFAULT FALSE`,
+	}},
+	{7, "trash", []string{
+		`ALTER TABLE backups ADD COLUMN deleted_at {{timestamp}}`,
+		`ALTER TABLE projects ADD COLUMN deleted_at {{timestamp}}`,
+		`CREATE INDEX idx_backups_deleted_at ON backups (deleted_at)`,
+		`CREATE INDEX idx_projects_deleted_at ON projects (deleted_at)`,
+	}},
+	{8, "backup versions", []string{
+		// Every backup so far starts its own chain
+		`ALTER TABLE backups ADD COLUMN chain_id {{uuid}}`,
+		`ALTER TABLE backups ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		`UPDATE backups SET chain_id = id`,
+		`CREATE UNIQUE INDEX idx_backups_chain_version ON backups (chain_id, version)`,
+		`CREATE INDEX idx_backups_user_name ON backups (user_id, name)`,
+	}},
+	{9, "backup chunks", []string{
+		// Chunks outlive their owner's account until cleanup finds them
+		// unreferenced, so their blobs go with them
+		`CREATE TABLE chunks (
+			user_id {{uuid}} NOT NULL,
+			address VARCHAR(64) NOT NULL,
+			blob_key TEXT NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			stored_bytes BIGINT NOT NULL,
+			used_at {{timestamp}} NOT NULL,
+			PRIMARY KEY (user_id, address)
+		)`,
+		`CREATE INDEX idx_chunks_used_at ON chunks (used_at)`,
+		// A backup references its chunks before its row is saved
+		`CREATE TABLE backup_chunks (
+			backup_id {{uuid}} NOT NULL,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			address VARCHAR(64) NOT NULL,
+			PRIMARY KEY (backup_id, address)
+		)`,
+		`CREATE INDEX idx_backup_chunks_address ON backup_chunks (user_id, address)`,
+	}},
+	{10, "backup compression", []string{
+		`ALTER TABLE backups ADD COLUMN compression VARCHAR(16) NOT NULL DEFAULT ''`,
+		`ALTER TABLE chunks ADD COLUMN compression VARCHAR(16) NOT NULL DEFAULT ''`,
+	}},
+	{11, "jobs", []string{
+		`CREATE TABLE jobs (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			type VARCHAR(32) NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			payload {{json}} NOT NULL,
+			result {{json}},
+			error TEXT NOT NULL DEFAULT '',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			created_at {{timestamp}} NOT NULL,
+			queued_at {{timestamp}} NOT NULL,
+			started_at {{timestamp}},
+			finished_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_jobs_user_id ON jobs (user_id, created_at)`,
+		`CREATE INDEX idx_jobs_status ON jobs (status, queued_at)`,
+	}},
+	{12, "account deletion", []string{
+		`ALTER TABLE users ADD COLUMN deletion_scheduled_at {{timestamp}}`,
+	}},
+	{13, "storage quotas", []string{
+		`ALTER TABLE users ADD COLUMN storage_quota_bytes BIGINT`,
+	}},
+	{14, "teams", []string{
+		`CREATE TABLE teams (
+			id {{uuid}} PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			created_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE TABLE team_members (
+			team_id {{uuid}} NOT NULL REFERENCES teams (id) ON DELETE CASCADE,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			role VARCHAR(16) NOT NULL,
+			created_at {{timestamp}} NOT NULL,
+			PRIMARY KEY (team_id, user_id)
+		)`,
+		`CREATE INDEX idx_team_members_user_id ON team_members (user_id)`,
+		`ALTER TABLE backups ADD COLUMN team_id {{uuid}} REFERENCES teams (id) ON DELETE CASCADE`,
+		`ALTER TABLE projects ADD COLUMN team_id {{uuid}} REFERENCES teams (id) ON DELETE CASCADE`,
+		`ALTER TABLE qr_codes ADD COLUMN team_id {{uuid}} REFERENCES teams (id) ON DELETE CASCADE`,
+		`CREATE INDEX idx_backups_team_id ON backups (team_id)`,
+		`CREATE INDEX idx_projects_team_id ON projects (team_id)`,
+		`CREATE INDEX idx_qr_codes_team_id ON qr_codes (team_id)`,
+	}},
+	{15, "project_shares", []string{
+		`CREATE TABLE project_shares (
+			id {{uuid}} PRIMARY KEY,
+			project_id {{uuid}} NOT NULL REFERENCES projects (id) ON DELETE CASCADE,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			team_id {{uuid}} REFERENCES teams (id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) NOT NULL UNIQUE,
+			password_hash VARCHAR(255),
+			created_at {{timestamp}} NOT NULL,
+			expires_at {{timestamp}},
+			revoked_at {{timestamp}},
+			access_count INTEGER NOT NULL DEFAULT 0,
+			last_accessed_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_project_shares_project_id ON project_shares (project_id)`,
+	}},
+	{16, "project_files", []string{
+		`ALTER TABLE projects ADD COLUMN files {{json}}`,
+	}},
+	{17, "collections", []string{
+		`ALTER TABLE projects ADD COLUMN last_accessed_at {{timestamp}}`,
+		`CREATE INDEX idx_projects_last_accessed_at ON projects (user_id, last_accessed_at)`,
+		`CREATE TABLE collections (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			team_id {{uuid}} REFERENCES teams (id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			created_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_collections_user_id ON collections (user_id)`,
+		`CREATE INDEX idx_collections_team_id ON collections (team_id)`,
+		`CREATE TABLE collection_projects (
+			collection_id {{uuid}} NOT NULL REFERENCES collections (id) ON DELETE CASCADE,
+			project_id {{uuid}} NOT NULL REFERENCES projects (id) ON DELETE CASCADE,
+			added_at {{timestamp}} NOT NULL,
+			PRIMARY KEY (collection_id, project_id)
+		)`,
+		`CREATE INDEX idx_collection_projects_project_id ON collection_projects (project_id)`,
+	}},
+	{18, "project_versions", []string{
+		`ALTER TABLE projects ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	}},
+	{19, "sessions", []string{
+		`CREATE TABLE sessions (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			user_agent VARCHAR(512) NOT NULL DEFAULT '',
+			ip_address VARCHAR(64) NOT NULL DEFAULT '',
+			created_at {{timestamp}} NOT NULL,
+			last_used_at {{timestamp}} NOT NULL,
+			expires_at {{timestamp}} NOT NULL,
+			revoked_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_sessions_user_id ON sessions (user_id)`,
+		`CREATE INDEX idx_sessions_expires_at ON sessions (expires_at)`,
+		`ALTER TABLE refresh_tokens ADD COLUMN session_id {{uuid}} REFERENCES sessions (id) ON DELETE CASCADE`,
+	}},
+	{20, "uploads", []string{
+		`CREATE TABLE uploads (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			team_id {{uuid}} REFERENCES teams (id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			length_bytes BIGINT NOT NULL,
+			offset_bytes BIGINT NOT NULL DEFAULT 0,
+			key_version INTEGER NOT NULL DEFAULT 0,
+			parts {{json}} NOT NULL,
+			created_at {{timestamp}} NOT NULL,
+			expires_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_uploads_user_id ON uploads (user_id)`,
+		`CREATE INDEX idx_uploads_expires_at ON uploads (expires_at)`,
+	}},
+	{21, "backup_verification", []string{
+		`ALTER TABLE backups ADD COLUMN verified_at {{timestamp}}`,
+		`ALTER TABLE backups ADD COLUMN corruption TEXT NOT NULL DEFAULT ''`,
+	}},
+	{22, "retention_policies", []string{
+		`CREATE TABLE retention_policies (
+			user_id {{uuid}} PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			keep_versions INTEGER NOT NULL DEFAULT 0,
+			max_age_days INTEGER NOT NULL DEFAULT 0,
+			sources {{json}} NOT NULL,
+			updated_at {{timestamp}} NOT NULL
+		)`,
+	}},
+	{23, "user_keyrings", []string{
+		`CREATE TABLE user_keyrings (
+			user_id {{uuid}} PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			password_salt TEXT NOT NULL,
+			wrapped_by_password TEXT NOT NULL,
+			wrapped_by_recovery TEXT NOT NULL DEFAULT '',
+			recovery_created_at {{timestamp}}
+		)`,
+	}},
+	{24, "two_factor", []string{
+		`CREATE TABLE two_factor (
+			user_id {{uuid}} PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			secret TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			last_step BIGINT NOT NULL DEFAULT 0,
+			created_at {{timestamp}} NOT NULL,
+			enabled_at {{timestamp}}
+		)`,
+	}},
+	{25, "recovery_codes", []string{
+		`CREATE TABLE recovery_codes (
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			code_hash TEXT NOT NULL,
+			created_at {{timestamp}} NOT NULL,
+			used_at {{timestamp}},
+			PRIMARY KEY (user_id, code_hash)
+		)`,
+	}},
+	{26, "legal_holds", []string{
+		`CREATE TABLE legal_holds (
+			id {{uuid}} PRIMARY KEY,
+			reason TEXT NOT NULL,
+			backup_ids {{json}} NOT NULL,
+			user_ids {{json}} NOT NULL,
+			placed_by VARCHAR(255) NOT NULL,
+			placed_at {{timestamp}} NOT NULL,
+			released_by VARCHAR(255) NOT NULL DEFAULT '',
+			released_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_legal_holds_active ON legal_holds (released_at)`,
+	}},
+	{27, "api_keys", []string{
+		`CREATE TABLE api_keys (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			prefix VARCHAR(20) NOT NULL,
+			key_hash VARCHAR(64) NOT NULL UNIQUE,
+			scopes {{json}} NOT NULL,
+			rate_limit INTEGER NOT NULL,
+			expires_at {{timestamp}},
+			last_used_at {{timestamp}},
+			created_at {{timestamp}} NOT NULL,
+			is_active BOOLEAN NOT NULL DEFAULT TRUE
+		)`,
+		`CREATE INDEX idx_api_keys_user_id ON api_keys (user_id)`,
+	}},
+	{28, "policies", []string{
+		`CREATE TABLE policy_documents (
+			type VARCHAR(20) NOT NULL,
+			version VARCHAR(50) NOT NULL,
+			title VARCHAR(200) NOT NULL DEFAULT '',
+			url TEXT NOT NULL DEFAULT '',
+			content TEXT NOT NULL DEFAULT '',
+			require_acceptance BOOLEAN NOT NULL DEFAULT FALSE,
+			published_at {{timestamp}} NOT NULL,
+			PRIMARY KEY (type, version)
+		)`,
+		`CREATE TABLE policy_acceptances (
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			type VARCHAR(20) NOT NULL,
+			version VARCHAR(50) NOT NULL,
+			accepted_at {{timestamp}} NOT NULL,
+			ip_address VARCHAR(64) NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (user_id, type, version)
+		)`,
+	}},
+	{29, "webhooks", []string{
+		`CREATE TABLE webhook_endpoints (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			url TEXT NOT NULL,
+			events {{json}} NOT NULL,
+			secrets {{json}} NOT NULL,
+			disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			disabled_reason TEXT NOT NULL DEFAULT '',
+			consecutive_failures INTEGER NOT NULL DEFAULT 0,
+			failing_since {{timestamp}},
+			created_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_webhook_endpoints_user_id ON webhook_endpoints (user_id, created_at)`,
+		`CREATE TABLE webhook_deliveries (
+			id {{uuid}} PRIMARY KEY,
+			endpoint_id {{uuid}} NOT NULL REFERENCES webhook_endpoints (id) ON DELETE CASCADE,
+			user_id {{uuid}} NOT NULL,
+			event VARCHAR(64) NOT NULL,
+			payload {{json}} NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			response_status INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at {{timestamp}},
+			created_at {{timestamp}} NOT NULL,
+			delivered_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_webhook_deliveries_endpoint_id ON webhook_deliveries (endpoint_id, created_at)`,
+		`CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`,
+	}},
+	{30, "domain_events", []string{
+		// Append-only: rows are never updated or deleted, and outlive the
+		// aggregates they describe
+		`CREATE TABLE domain_events (
+			sequence {{serial}} PRIMARY KEY,
+			id {{uuid}} NOT NULL UNIQUE,
+			type VARCHAR(64) NOT NULL,
+			aggregate_type VARCHAR(20) NOT NULL,
+			aggregate_id TEXT NOT NULL,
+			owner_id TEXT NOT NULL DEFAULT '',
+			actor {{json}} NOT NULL,
+			before_state {{json}},
+			after_state {{json}},
+			occurred_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_domain_events_aggregate ON domain_events (aggregate_type, aggregate_id, sequence)`,
+		`CREATE INDEX idx_domain_events_owner_id ON domain_events (owner_id, sequence)`,
+	}},
+	{31, "qr_code_passwords", []string{
+		`ALTER TABLE qr_codes ADD COLUMN password_hash TEXT NOT NULL DEFAULT ''`,
+	}},
+	{32, "qr_code_pages", []string{
+		`ALTER TABLE qr_codes ADD COLUMN language VARCHAR(16) NOT NULL DEFAULT ''`,
+		`ALTER TABLE qr_codes ADD COLUMN live_at {{timestamp}}`,
+		`ALTER TABLE qr_codes ADD COLUMN expires_at {{timestamp}}`,
+		`ALTER TABLE qr_codes ADD COLUMN landing_page BOOLEAN NOT NULL DEFAULT FALSE`,
+	}},
+	{33, "qr_templates", []string{
+		`CREATE TABLE qr_templates (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			ec_level VARCHAR(1) NOT NULL DEFAULT '',
+			size INTEGER NOT NULL DEFAULT 0,
+			format VARCHAR(8) NOT NULL DEFAULT '',
+			style {{json}} NOT NULL,
+			logo_id TEXT NOT NULL DEFAULT '',
+			logo_scale DOUBLE PRECISION NOT NULL DEFAULT 0,
+			created_at {{timestamp}} NOT NULL,
+			updated_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX idx_qr_templates_name ON qr_templates (user_id, LOWER(name))`,
+	}},
+	{34, "qr_logos", []string{
+		`CREATE TABLE qr_logos (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name VARCHAR(100) NOT NULL,
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			created_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_qr_logos_user ON qr_logos (user_id, created_at)`,
+	}},
+	{35, "connectors", []string{
+		`CREATE TABLE connectors (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			type VARCHAR(16) NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			url TEXT NOT NULL,
+			username VARCHAR(256) NOT NULL DEFAULT '',
+			secret TEXT NOT NULL DEFAULT '',
+			interval_minutes INTEGER NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			status VARCHAR(32) NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			last_run_at {{timestamp}},
+			last_success_at {{timestamp}},
+			next_run_at {{timestamp}},
+			files_fetched INTEGER NOT NULL DEFAULT 0,
+			backups_created INTEGER NOT NULL DEFAULT 0,
+			imports_queued INTEGER NOT NULL DEFAULT 0,
+			recent_runs {{json}} NOT NULL,
+			seen {{json}} NOT NULL,
+			created_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_connectors_user ON connectors (user_id, created_at)`,
+		`CREATE INDEX idx_connectors_next_run ON connectors (next_run_at)`,
+	}},
+	{36, "team_invites", []string{
+		`CREATE TABLE team_invites (
+			id {{uuid}} PRIMARY KEY,
+			team_id {{uuid}} NOT NULL REFERENCES teams (id) ON DELETE CASCADE,
+			email VARCHAR(255) NOT NULL,
+			role VARCHAR(16) NOT NULL,
+			invited_by {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) NOT NULL UNIQUE,
+			created_at {{timestamp}} NOT NULL,
+			expires_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_team_invites_team_id ON team_invites (team_id)`,
+	}},
+	{37, "email_changes", []string{
+		`CREATE TABLE email_changes (
+			user_id {{uuid}} PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			id {{uuid}} NOT NULL UNIQUE,
+			old_email VARCHAR(255) NOT NULL,
+			new_email VARCHAR(255) NOT NULL,
+			old_token_hash VARCHAR(64) NOT NULL UNIQUE,
+			new_token_hash VARCHAR(64) NOT NULL UNIQUE,
+			old_confirmed_at {{timestamp}},
+			new_confirmed_at {{timestamp}},
+			created_at {{timestamp}} NOT NULL,
+			expires_at {{timestamp}} NOT NULL
+		)`,
+	}},
+	{38, "data_exports", []string{
+		`CREATE TABLE data_exports (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			status VARCHAR(16) NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			archive_path TEXT NOT NULL DEFAULT '',
+			requested_at {{timestamp}} NOT NULL,
+			completed_at {{timestamp}},
+			expires_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_data_exports_user_id ON data_exports (user_id, requested_at)`,
+		`CREATE INDEX idx_data_exports_expires_at ON data_exports (expires_at)`,
+	}},
+	{39, "api_key_usage", []string{
+		`CREATE TABLE api_key_usage (
+			key_id {{uuid}} NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE,
+			usage_date VARCHAR(10) NOT NULL,
+			requests BIGINT NOT NULL DEFAULT 0,
+			errors BIGINT NOT NULL DEFAULT 0,
+			rate_limited BIGINT NOT NULL DEFAULT 0,
+			bytes_in BIGINT NOT NULL DEFAULT 0,
+			bytes_out BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (key_id, usage_date)
+		)`,
+		`CREATE INDEX idx_api_key_usage_usage_date ON api_key_usage (usage_date)`,
+	}},
+	{40, "password_resets", []string{
+		`CREATE TABLE password_resets (
+			user_id {{uuid}} PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) NOT NULL UNIQUE,
+			expires_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_password_resets_expires_at ON password_resets (expires_at)`,
+	}},
+	{41, "blob_replication", []string{
+		`CREATE TABLE blob_replication (
+			blob_key VARCHAR(1024) PRIMARY KEY,
+			content_type VARCHAR(255) NOT NULL,
+			version VARCHAR(64) NOT NULL,
+			pending_since {{timestamp}} NOT NULL,
+			changed_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_blob_replication_pending_since ON blob_replication (pending_since)`,
+		`CREATE INDEX idx_blob_replication_changed_at ON blob_replication (changed_at)`,
+	}},
+	{42, "signed_links", []string{
+		`CREATE TABLE signed_links (
+			id VARCHAR(32) PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			scope VARCHAR(50) NOT NULL,
+			resource_id VARCHAR(1024) NOT NULL,
+			created_at {{timestamp}} NOT NULL,
+			expires_at {{timestamp}} NOT NULL,
+			revoked_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_signed_links_user_id ON signed_links (user_id)`,
+		`CREATE INDEX idx_signed_links_expires_at ON signed_links (expires_at)`,
+	}},
+	{43, "maintenance_mode", []string{
+		`CREATE TABLE maintenance_mode (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			enabled BOOLEAN NOT NULL,
+			message TEXT NOT NULL,
+			since {{timestamp}}
+		)`,
+	}},
+	{44, "chat_imports", []string{
+		`CREATE TABLE chat_imports (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			team_id {{uuid}} REFERENCES teams (id) ON DELETE CASCADE,
+			format VARCHAR(50) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			conversations INTEGER NOT NULL DEFAULT 0,
+			imported INTEGER NOT NULL DEFAULT 0,
+			skipped INTEGER NOT NULL DEFAULT 0,
+			projects INTEGER NOT NULL DEFAULT 0,
+			actor {{json}} NOT NULL,
+			blob_key VARCHAR(255) NOT NULL DEFAULT '',
+			key_version INTEGER NOT NULL DEFAULT 0,
+			requested_at {{timestamp}} NOT NULL,
+			completed_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_chat_imports_user_id ON chat_imports (user_id, requested_at)`,
+	}},
+	{45, "integrity_runs", []string{
+		`CREATE TABLE integrity_runs (
+			id {{uuid}} PRIMARY KEY,
+			mode VARCHAR(20) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			scheduled_for VARCHAR(10) UNIQUE,
+			checked INTEGER NOT NULL DEFAULT 0,
+			ok INTEGER NOT NULL DEFAULT 0,
+			corrupt INTEGER NOT NULL DEFAULT 0,
+			skipped INTEGER NOT NULL DEFAULT 0,
+			failures {{json}} NOT NULL,
+			users {{json}} NOT NULL,
+			requested_at {{timestamp}} NOT NULL,
+			started_at {{timestamp}},
+			completed_at {{timestamp}}
+		)`,
+		`CREATE INDEX idx_integrity_runs_requested_at ON integrity_runs (requested_at)`,
+	}},
+	// Jobs the server queues for itself have no owner. SQLite can't drop
+	// NOT NULL from a column, so the table is rebuilt.
+	{46, "system jobs", []string{
+		`CREATE TABLE jobs_new (
+			id {{uuid}} PRIMARY KEY,
+			user_id {{uuid}} REFERENCES users (id) ON DELETE CASCADE,
+			type VARCHAR(32) NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			payload {{json}} NOT NULL,
+			result {{json}},
+			error TEXT NOT NULL DEFAULT '',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			created_at {{timestamp}} NOT NULL,
+			queued_at {{timestamp}} NOT NULL,
+			started_at {{timestamp}},
+			finished_at {{timestamp}}
+		)`,
+		`INSERT INTO jobs_new (id, user_id, type, status, payload, result, error, attempts, created_at, queued_at,
+			started_at, finished_at)
+			SELECT id, user_id, type, status, payload, result, error, attempts, created_at, queued_at,
+			started_at, finished_at FROM jobs`,
+		`DROP TABLE jobs`,
+		`ALTER TABLE jobs_new RENAME TO jobs`,
+		`CREATE INDEX idx_jobs_user_id ON jobs (user_id, created_at)`,
+		`CREATE INDEX idx_jobs_status ON jobs (status, queued_at)`,
+	}},
+	{47, "warehouse_exports", []string{
+		`CREATE TABLE warehouse_exports (
+			id {{uuid}} PRIMARY KEY,
+			date VARCHAR(10) NOT NULL,
+			scheduled BOOLEAN NOT NULL DEFAULT FALSE,
+			datasets {{json}} NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			files {{json}} NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			requested_by VARCHAR(255) NOT NULL DEFAULT '',
+			started_at {{timestamp}} NOT NULL,
+			completed_at {{timestamp}}
+		)`,
+		`CREATE UNIQUE INDEX idx_warehouse_exports_scheduled ON warehouse_exports (date) WHERE scheduled`,
+		`CREATE INDEX idx_warehouse_exports_started_at ON warehouse_exports (started_at)`,
+	}},
+	{48, "oauth_logins", []string{
+		`CREATE TABLE oauth_states (
+			state_hash VARCHAR(64) PRIMARY KEY,
+			provider VARCHAR(50) NOT NULL,
+			verifier VARCHAR(255) NOT NULL,
+			accept_policies BOOLEAN NOT NULL DEFAULT FALSE,
+			expires_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_oauth_states_expires_at ON oauth_states (expires_at)`,
+		`CREATE TABLE oauth_logins (
+			code_hash VARCHAR(64) PRIMARY KEY,
+			user_id {{uuid}} NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			provider VARCHAR(50) NOT NULL,
+			created BOOLEAN NOT NULL DEFAULT FALSE,
+			expires_at {{timestamp}} NOT NULL
+		)`,
+		`CREATE INDEX idx_oauth_logins_expires_at ON oauth_logins (expires_at)`,
+	}},
+	{49, "failed_attempts", []string{
+		`CREATE TABLE failed_attempts (
+			attempt_key VARCHAR(512) PRIMARY KEY,
+			failures INTEGER NOT NULL DEFAULT 0,
+			lockouts INTEGER NOT NULL DEFAULT 0,
+			last_failure {{timestamp}} NOT NULL,
+			retry_at {{timestamp}},
+			locked_until {{timestamp}}
+		)`,
+		`CREATE INDEX idx_failed_attempts_last_failure ON failed_attempts (last_failure)`,
+	}},
+}
+
+// migrationLock is the PostgreSQL advisory lock held while migrating, so
+// servers starting together don't apply the same migration twice.
+const migrationLock = 727340
+
+func (s *SQL) Migrate(ctx context.Context) error {
+	types := strings.NewReplacer("{{uuid}}", "UUID", "{{json}}", "JSONB", "{{timestamp}}", "TIMESTAMPTZ", "{{serial}}", "BIGSERIAL")
+	timestampType := "TIMESTAMPTZ"
+	if s.dialect == sqlite {
+		// The SQLite driver only converts columns declared TIMESTAMP back
+		// to time.Time
+		types = strings.NewReplacer("{{uuid}}", "TEXT", "{{json}}", "TEXT", "{{timestamp}}", "TIMESTAMP", "{{serial}}", "INTEGER")
+		timestampType = "TIMESTAMP"
+	}
+
+	db := s.writer("")
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at `+timestampType+` NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("storage: creating schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if s.dialect == postgres {
+			if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("storage: locking migrations: %w", err)
+			}
+		}
+
+		var applied int
+		if err := tx.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), m.version).Scan(&applied); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if applied > 0 {
+			tx.Rollback()
+			continue
+		}
+
+		for _, stmt := range m.stmts {
+			if _, err := tx.ExecContext(ctx, types.Replace(stmt)); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("storage: migration %d (%s): %w", m.version, m.name, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`),
+			m.version, m.name, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,885 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	"backup-manager/qr"
+)
+
+// Roles a user can have. Admins can use the /api/admin routes.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Statuses of a job. A job is queued until a worker claims it.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// Statuses of a webhook delivery. A delivery is pending until it succeeds
+// or runs out of attempts.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Roles a member can have in a team, from least to most. Viewers can read
+// what the team holds, editors can change it too, and owners can also
+// manage the team and its members.
+const (
+	TeamViewer = "viewer"
+	TeamEditor = "editor"
+	TeamOwner  = "owner"
+)
+
+type User struct {
+	ID           string    `json:"id"`
+	Email        string    `json:"email"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	Role         string    `json:"role"`
+	// Disabled accounts can't log in or refresh their tokens
+	Disabled bool `json:"disabled"`
+	// PasswordResetRequired is set by an admin. The password stops working
+	// until it is reset with the link emailed to the user.
+	PasswordResetRequired bool `json:"password_reset_required"`
+	// DeletionScheduledAt is when the account, and everything it owns, is
+	// deleted, if its owner asked for that
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	// Plan is the subscription tier, which sets the default storage quota
+	Plan string `json:"plan"`
+	// StorageQuota, in bytes, is set for this user alone over their plan's
+	StorageQuota *int64 `json:"storage_quota,omitempty"`
+}
+
+// Usage is how much the whole service holds, for admins.
+type Usage struct {
+	Users         int   `json:"users"`
+	DisabledUsers int   `json:"disabled_users"`
+	Admins        int   `json:"admins"`
+	Backups       int   `json:"backups"`
+	BackupBytes   int64 `json:"backup_bytes"`
+	// StoredBytes is what the deduplicated chunks of backups take up
+	StoredBytes    int64 `json:"stored_bytes"`
+	Projects       int   `json:"projects"`
+	QRCodes        int   `json:"qr_codes"`
+	DynamicQRCodes int   `json:"dynamic_qr_codes"`
+}
+
+// UserUsage is how much one user holds. Backups in the trash count, as
+// they are still stored.
+type UserUsage struct {
+	Backups     int   `json:"backups"`
+	BackupBytes int64 `json:"backup_bytes"`
+	Projects    int   `json:"projects"`
+	QRCodes     int   `json:"qr_codes"`
+}
+
+// Stats are the aggregates behind a user's dashboard, over what they can
+// see in the workspace queried. Series are by UTC day, from the Since given
+// to Stats, and leave out days with nothing added; their totals include
+// everything from before.
+type Stats struct {
+	ProjectsByLanguage []LanguageStats `json:"projects_by_language"`
+	LinesOverTime      []LinesDay      `json:"lines_over_time"`
+	BackupsBySource    []SourceStats   `json:"backups_by_source"`
+	// StorageGrowth counts backups still stored, trash included, by the
+	// day they were uploaded
+	StorageGrowth []StorageDay `json:"storage_growth"`
+	QRCodes       int          `json:"qr_codes"`
+}
+
+// LanguageStats is the projects in one language; Language is empty for
+// those it couldn't be detected for.
+type LanguageStats struct {
+	Language    string `json:"language"`
+	Projects    int    `json:"projects"`
+	LinesOfCode int64  `json:"lines_of_code"`
+}
+
+type LinesDay struct {
+	Date       string `json:"date"` // YYYY-MM-DD
+	Projects   int    `json:"projects"`
+	Lines      int64  `json:"lines"`
+	TotalLines int64  `json:"total_lines"`
+}
+
+type SourceStats struct {
+	Source  string `json:"source"`
+	Backups int    `json:"backups"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type StorageDay struct {
+	Date       string `json:"date"` // YYYY-MM-DD
+	Backups    int    `json:"backups"`
+	Bytes      int64  `json:"bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+}
+
+type Backup struct {
+	ID             string    `json:"id"`
+	UserID         string    `json:"user_id"`
+	Name           string    `json:"name"`
+	Source         string    `json:"source"`
+	Size           int64     `json:"size"`
+	FileType       string    `json:"file_type"`
+	ThumbnailURL   string    `json:"thumbnail_url,omitempty"`
+	Timestamp      time.Time `json:"timestamp"`
+	ContentPreview string    `json:"content_preview"`
+	EncryptedData  string    `json:"encrypted_data"`
+	Title          string    `json:"title,omitempty"`
+	Summary        string    `json:"summary,omitempty"`
+	SummaryModel   string    `json:"summary_model,omitempty"`
+
+	// Checksums are SHA-256, of the plaintext and of EncryptedData
+	Checksum           string `json:"checksum,omitempty"`
+	CiphertextChecksum string `json:"-"`
+
+	// VerifiedAt is when the backup was last checked against its
+	// checksums, and Corruption what was wrong with it then, if anything
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	Corruption string     `json:"corruption,omitempty"`
+
+	// BlobKey is where EncryptedData lives when it is kept in the blob
+	// store rather than in the database row
+	BlobKey string `json:"-"`
+
+	// KeyVersion is the server key EncryptedData is under, or 0 when it is
+	// under the owner's data key
+	KeyVersion int `json:"-"`
+
+	// DeletedAt is set while the backup is in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// Uploading a file with the same name from the same source again makes
+	// a new version: a backup with the next Version in the same chain.
+	// ChainID is the ID of the chain's first backup.
+	ChainID string `json:"chain_id"`
+	Version int    `json:"version"`
+
+	// Compression is the algorithm the content was compressed with before
+	// it was encrypted, or empty if it wasn't
+	Compression string `json:"compression,omitempty"`
+
+	// TeamID is set when the backup belongs to a team rather than to UserID
+	// alone, who is then the member who made it
+	TeamID string `json:"team_id,omitempty"`
+}
+
+type Project struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	BackupID    string    `json:"backup_id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Source      string    `json:"source"`
+	Language    string    `json:"language"`
+	LinesOfCode int       `json:"lines_of_code"`
+	Features    []string  `json:"features"`
+	Code        string    `json:"code"`
+	Timestamp   time.Time `json:"timestamp"`
+	Tags        []string  `json:"tags"`
+	Starred     bool      `json:"starred"`
+
+	GeneratedDescription string `json:"generated_description,omitempty"`
+	DescriptionModel     string `json:"description_model,omitempty"`
+	// SuggestedTags is only set on freshly extracted projects
+	SuggestedTags []string `json:"suggested_tags,omitempty"`
+
+	// DeletedAt is set while the project is in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// TeamID is set for a project in a team's workspace, as for backups
+	TeamID string `json:"team_id,omitempty"`
+
+	// Files are set for a project of several files; Code is then that of
+	// its entry point
+	Files []ProjectFile `json:"files,omitempty"`
+
+	// LastAccessedAt is when the project was last opened or downloaded
+	LastAccessedAt *time.Time `json:"last_accessed_at,omitempty"`
+
+	// Version starts at 1 and goes up with every change to the project's
+	// content; opening it doesn't count
+	Version int `json:"version"`
+}
+
+// ProjectFile is one file of a project, by its path within the project.
+type ProjectFile struct {
+	Path     string `json:"path"`
+	Language string `json:"language,omitempty"`
+	Content  string `json:"content"`
+}
+
+type QRCode struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Content   string    `json:"content"`
+	ECLevel   string    `json:"ec_level"`
+	Size      int       `json:"size"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Dynamic codes encode a redirect through ShortCode, so Target can
+	// change after the code is printed. Both are empty for static codes.
+	ShortCode string `json:"short_code,omitempty"`
+	Target    string `json:"target,omitempty"`
+	// PasswordHash is set for a dynamic code that asks whoever scans it
+	// for a password before redirecting.
+	PasswordHash string `json:"-"`
+	HasPassword  bool   `json:"has_password"`
+	// A dynamic code's scan pages are in Language, or the scanner's own if
+	// it is empty. Before LiveAt and after ExpiresAt scanners get a page
+	// saying so instead of the redirect; LandingPage shows the target on a
+	// page of its own rather than redirecting straight to it.
+	Language    string     `json:"language,omitempty"`
+	LiveAt      *time.Time `json:"live_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LandingPage bool       `json:"landing_page"`
+
+	// TeamID is set for a code made in a team's workspace
+	TeamID string `json:"team_id,omitempty"`
+}
+
+// QRTarget is one destination a dynamic code has pointed at.
+type QRTarget struct {
+	QRCodeID  string    `json:"qr_code_id"`
+	Target    string    `json:"target"`
+	ChangedBy string    `json:"changed_by"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+func (q QRCode) Dynamic() bool {
+	return q.ShortCode != ""
+}
+
+// Team is a workspace whose members share backups, projects and QR codes.
+type Team struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role is that of the member the team was listed for
+	Role string `json:"role,omitempty"`
+}
+
+type TeamMember struct {
+	TeamID   string    `json:"team_id"`
+	UserID   string    `json:"user_id"`
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// TeamInvite asks someone, by email, to join a team. Only the SHA-256 of
+// the token emailed to them is kept.
+type TeamInvite struct {
+	ID        string    `json:"id"`
+	TeamID    string    `json:"team_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	TokenHash string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Collection is a folder of projects, kept in a workspace like them. A
+// project can be in any number of collections.
+type Collection struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	TeamID      string    `json:"team_id,omitempty"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	// ProjectCount counts the projects in the collection, leaving out those
+	// in the trash
+	ProjectCount int `json:"project_count"`
+}
+
+// ProjectShare is a public, read-only link to a project. Only the SHA-256
+// of its token is stored, and the bcrypt hash of its password if it has one.
+type ProjectShare struct {
+	ID           string     `json:"id"`
+	ProjectID    string     `json:"project_id"`
+	UserID       string     `json:"user_id"`
+	TeamID       string     `json:"team_id,omitempty"`
+	TokenHash    string     `json:"-"`
+	PasswordHash string     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+
+	AccessCount    int        `json:"access_count"`
+	LastAccessedAt *time.Time `json:"last_accessed_at,omitempty"`
+}
+
+// RefreshToken is a long-lived login, exchanged for short-lived access
+// tokens. Only the SHA-256 of the token is stored.
+type RefreshToken struct {
+	ID     string
+	UserID string
+	// SessionID is the login the token belongs to, "" for tokens issued
+	// before sessions were recorded
+	SessionID string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// RevokedAt is set on logout and when the token is rotated, in which
+	// case ReplacedBy is the ID of the token issued in its place
+	RevokedAt  *time.Time
+	ReplacedBy string
+}
+
+// Session is one login, on one device, lasting across the refresh tokens
+// rotated from it. Access tokens name theirs, so revoking it logs the
+// device out.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// RetentionPolicy is how long a user keeps their own backups, leaving out
+// those made in teams. Sources holds rules for backups from particular
+// sources, by name, in place of the policy's own rule.
+type RetentionPolicy struct {
+	UserID string `json:"-"`
+	RetentionRule
+	Sources   map[string]RetentionRule `json:"sources"`
+	UpdatedAt time.Time                `json:"updated_at"`
+}
+
+// RetentionRule says which backups are no longer kept: all but the newest
+// KeepVersions versions of each, and those uploaded more than MaxAgeDays
+// ago. Zero leaves either unlimited.
+type RetentionRule struct {
+	KeepVersions int `json:"keep_versions"`
+	MaxAgeDays   int `json:"max_age_days"`
+}
+
+// Upload is a backup being uploaded in parts, which can be resumed after a
+// dropped connection from the last part stored. Once Offset reaches Length
+// the parts are joined into a backup and the upload is deleted.
+type Upload struct {
+	ID     string
+	UserID string
+	// TeamID is the team the backup is made in, "" for the user's own
+	TeamID string
+	Name   string
+	Length int64
+	Offset int64
+	// KeyVersion is that of the key the parts, and the backup made from
+	// them, are encrypted with, as for Backup.KeyVersion
+	KeyVersion int
+	Parts      []UploadPart
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// UploadPart is one stored piece of an upload, in order.
+type UploadPart struct {
+	BlobKey string `json:"blob_key"`
+	Size    int64  `json:"size"`
+}
+
+// Chunk is a piece of backup content stored once per owner and key, however
+// many backups contain it.
+type Chunk struct {
+	UserID string
+	// Address identifies the content: a SHA-256 HMAC of it keyed from the
+	// key it is encrypted under
+	Address string
+	BlobKey string
+	// Size is of the plaintext, StoredSize of the encrypted blob
+	Size       int64
+	StoredSize int64
+	// Compression is the algorithm the chunk was compressed with before it
+	// was encrypted, or empty for one that didn't compress
+	Compression string
+	UsedAt      time.Time
+}
+
+// Job is heavy work, such as rendering a large QR batch, run in the
+// background by whichever server's worker takes it off the queue.
+type Job struct {
+	ID string `json:"id"`
+	// UserID is the job's owner, "" for one the server queued for itself
+	UserID string `json:"user_id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	// Payload is what the job works on and Result what it produced, JSON
+	// whose shape depends on Type
+	Payload    json.RawMessage `json:"-"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Attempts   int             `json:"attempts"`
+	CreatedAt  time.Time       `json:"created_at"`
+	QueuedAt   time.Time       `json:"-"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Keyring is a user's data key wrapped under each secret that can unlock
+// it: their password, with its salt, and optionally a recovery key. The
+// data key itself is never stored.
+type Keyring struct {
+	UserID            string
+	PasswordSalt      []byte
+	WrappedByPassword []byte
+	WrappedByRecovery []byte
+	RecoveryCreatedAt *time.Time
+}
+
+// TwoFactor is a user's authenticator enrollment. Secret is encrypted by
+// the caller; it only guards logins once Enabled.
+type TwoFactor struct {
+	UserID    string
+	Secret    string
+	Enabled   bool
+	CreatedAt time.Time
+	EnabledAt *time.Time
+	// LastStep is the time step of the last code accepted, so no code
+	// works twice.
+	LastStep int64
+}
+
+// RecoveryCodes summarises a user's set of recovery codes, which are only
+// stored hashed.
+type RecoveryCodes struct {
+	Total       int
+	Remaining   int
+	GeneratedAt time.Time
+}
+
+// LegalHold preserves backups for litigation or investigation. While a hold
+// is active, the backups it covers cannot be deleted by their owner, removed
+// by retention, or have their encryption keys destroyed. A hold names
+// specific backups, custodians (every backup a user owns), or both.
+type LegalHold struct {
+	ID         string     `json:"id"`
+	Reason     string     `json:"reason"`
+	BackupIDs  []string   `json:"backup_ids"`
+	UserIDs    []string   `json:"user_ids"`
+	PlacedBy   string     `json:"placed_by"`
+	PlacedAt   time.Time  `json:"placed_at"`
+	ReleasedBy string     `json:"released_by,omitempty"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+}
+
+// APIKey grants programmatic access on behalf of a user. Only a hash of
+// the key is stored.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  int        `json:"rate_limit"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	IsActive   bool       `json:"is_active"`
+}
+
+// HasScope reports whether the key was granted any of scopes.
+func (k APIKey) HasScope(scopes ...string) bool {
+	for _, s := range k.Scopes {
+		for _, scope := range scopes {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (k APIKey) Expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// PolicyDocument is one published version of a legal document.
+type PolicyDocument struct {
+	Type              string    `json:"type"`
+	Version           string    `json:"version"`
+	Title             string    `json:"title"`
+	URL               string    `json:"url,omitempty"`
+	Content           string    `json:"content,omitempty"`
+	RequireAcceptance bool      `json:"require_acceptance"`
+	PublishedAt       time.Time `json:"published_at"`
+}
+
+// PolicyAcceptance records that a user accepted a document version.
+type PolicyAcceptance struct {
+	UserID     string    `json:"user_id"`
+	Type       string    `json:"type"`
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+// WebhookEndpoint is a URL that receives signed event notifications.
+type WebhookEndpoint struct {
+	ID                  string     `json:"id"`
+	UserID              string     `json:"user_id"`
+	URL                 string     `json:"url"`
+	Events              []string   `json:"events"`
+	Disabled            bool       `json:"disabled"`
+	DisabledReason      string     `json:"disabled_reason,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	FailingSince        *time.Time `json:"failing_since,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+
+	// Secrets sign deliveries, newest first. Their values are encrypted by
+	// the caller.
+	Secrets []WebhookSecret `json:"-"`
+}
+
+// WebhookSecret is one of an endpoint's signing secrets. One replaced by a
+// rotation keeps signing until ExpiresAt.
+type WebhookSecret struct {
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// WebhookDelivery is one event sent to one endpoint, with its retry state.
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	EndpointID     string          `json:"endpoint_id"`
+	UserID         string          `json:"-"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// DomainActor is who made a change. API key changes carry the key's owner
+// in UserID and the key in KeyID.
+type DomainActor struct {
+	Type   string `json:"type"`
+	UserID string `json:"user_id,omitempty"`
+	KeyID  string `json:"key_id,omitempty"`
+}
+
+// DomainEvent is one create, update or delete of a user, backup, project or
+// QR code. Events are never changed once recorded, and Sequence orders them,
+// so replaying them from any point rebuilds whatever was derived from them.
+type DomainEvent struct {
+	ID            string          `json:"id"`
+	Sequence      int64           `json:"sequence"`
+	Type          string          `json:"type"`
+	AggregateType string          `json:"aggregate_type"`
+	AggregateID   string          `json:"aggregate_id"`
+	OwnerID       string          `json:"owner_id,omitempty"`
+	Actor         DomainActor     `json:"actor"`
+	Before        json.RawMessage `json:"before,omitempty"`
+	After         json.RawMessage `json:"after,omitempty"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+}
+
+// DomainEventFilter selects domain events. Empty fields match any event.
+type DomainEventFilter struct {
+	AggregateType string
+	AggregateID   string
+	OwnerID       string
+	// After is the sequence to start after.
+	After int64
+	Limit int
+}
+
+// QRTemplate is a named set of rendering options a user saves once and then
+// names with template_id, instead of sending them with every code. Options
+// left unset take their defaults when it is used.
+type QRTemplate struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	ECLevel   string    `json:"ec_level,omitempty"`
+	Size      int       `json:"size,omitempty"`
+	Format    string    `json:"format,omitempty"`
+	Style     qr.Style  `json:"style"`
+	LogoID    string    `json:"logo_id,omitempty"`
+	LogoScale float64   `json:"logo_scale,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// QRLogo is an image saved to put in the middle of codes. The image itself
+// is kept in the blob store by the caller; this is its record.
+type QRLogo struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Connector fetches new exports for a user on a schedule and backs them up.
+// Secret, the WebDAV password or the URL's bearer token, is encrypted by
+// the caller.
+type Connector struct {
+	ID              string         `json:"id"`
+	UserID          string         `json:"user_id"`
+	Type            string         `json:"type"`
+	Name            string         `json:"name"`
+	URL             string         `json:"url"`
+	Username        string         `json:"username,omitempty"`
+	Secret          string         `json:"-"`
+	HasSecret       bool           `json:"has_secret"`
+	IntervalMinutes int            `json:"interval_minutes"`
+	Enabled         bool           `json:"enabled"`
+	Status          string         `json:"status"`
+	LastError       string         `json:"last_error,omitempty"`
+	LastRunAt       *time.Time     `json:"last_run_at,omitempty"`
+	LastSuccessAt   *time.Time     `json:"last_success_at,omitempty"`
+	NextRunAt       *time.Time     `json:"next_run_at,omitempty"`
+	FilesFetched    int            `json:"files_fetched"`
+	BackupsCreated  int            `json:"backups_created"`
+	ImportsQueued   int            `json:"imports_queued"`
+	RecentRuns      []ConnectorRun `json:"recent_runs"`
+	CreatedAt       time.Time      `json:"created_at"`
+
+	// Seen is what was last fetched from each file URL
+	Seen map[string]ConnectorSeen `json:"-"`
+}
+
+// ConnectorRunning is the status of a connector while it runs.
+const ConnectorRunning = "running"
+
+// ConnectorRun is one scheduled or requested fetch.
+type ConnectorRun struct {
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Status         string     `json:"status"`
+	Error          string     `json:"error,omitempty"`
+	FilesFetched   int        `json:"files_fetched"`
+	BackupsCreated int        `json:"backups_created"`
+	ImportsQueued  int        `json:"imports_queued"`
+}
+
+// ConnectorSeen identifies a version of a remote file, by the validators
+// its server gave and by content for servers that give none.
+type ConnectorSeen struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+}
+
+// EmailChange is a pending change of a user's login email. The old address
+// stays in effect, and remains the recovery address, until both the old and
+// the new address have confirmed the change. Only the SHA-256 of the token
+// sent to each is kept.
+type EmailChange struct {
+	ID             string     `json:"id"`
+	UserID         string     `json:"user_id"`
+	OldEmail       string     `json:"old_email"`
+	NewEmail       string     `json:"new_email"`
+	OldTokenHash   string     `json:"-"`
+	NewTokenHash   string     `json:"-"`
+	OldConfirmedAt *time.Time `json:"old_confirmed_at,omitempty"`
+	NewConfirmedAt *time.Time `json:"new_confirmed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+}
+
+// DataExport tracks a data-subject export request and the archive it
+// produced, kept on the server's disk at ArchivePath.
+type DataExport struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"user_id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	ArchivePath string     `json:"-"`
+	RequestedAt time.Time  `json:"requested_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	// DownloadURL is a signed link the caller sets once it is completed
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// APIKeyUsageDay is one day's rollup of requests made with an API key.
+// Requests rejected by the rate limiter count as errors, since they are
+// exactly what a user looks here to find.
+type APIKeyUsageDay struct {
+	KeyID       string `json:"-"`
+	Date        string `json:"date"`
+	Requests    int64  `json:"requests"`
+	Errors      int64  `json:"errors"`
+	RateLimited int64  `json:"rate_limited"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+}
+
+// ReplicationChange is a blob key that changed since it was last copied to
+// the replica. Version identifies the latest change, so finishing an older
+// copy does not clear a newer one; PendingSince is when the key first fell
+// behind.
+type ReplicationChange struct {
+	Key          string
+	ContentType  string
+	Version      string
+	PendingSince time.Time
+	ChangedAt    time.Time
+}
+
+// SignedLink is a signed URL a user handed out to something of theirs,
+// kept so they can see and revoke it before it expires. The URL itself is
+// only returned when the link is made.
+type SignedLink struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Scope      string     `json:"scope"`
+	ResourceID string     `json:"resource_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	URL        string     `json:"url,omitempty"`
+}
+
+// Maintenance is whether the API is in maintenance mode, shared by every
+// server.
+type Maintenance struct {
+	Enabled bool
+	Message string
+	Since   *time.Time
+}
+
+// ChatImport tracks an uploaded chat export being split into a backup per
+// conversation.
+type ChatImport struct {
+	ID            string     `json:"id"`
+	UserID        string     `json:"user_id"`
+	TeamID        string     `json:"team_id,omitempty"`
+	Format        string     `json:"format"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	Conversations int        `json:"conversations"`
+	Imported      int        `json:"imported"`
+	Skipped       int        `json:"skipped"`
+	Projects      int        `json:"projects"`
+	RequestedAt   time.Time  `json:"requested_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+
+	// Actor is who the backups are recorded as made by
+	Actor DomainActor `json:"-"`
+	// BlobKey is where the export waits, encrypted, until it is imported;
+	// "" once it is
+	BlobKey string `json:"-"`
+	// KeyVersion is that of the key the export is encrypted with, as for
+	// Backup.KeyVersion
+	KeyVersion int `json:"-"`
+}
+
+// IntegrityFailure is one backup that failed verification.
+type IntegrityFailure struct {
+	BackupID   string    `json:"backup_id"`
+	UserID     string    `json:"user_id"`
+	Reason     string    `json:"reason"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// IntegrityRun is one pass of the backup integrity check. Backups whose
+// owner's data key is locked cannot be decrypted by the server, so only
+// their ciphertext is checked and they count as skipped.
+type IntegrityRun struct {
+	ID     string `json:"id"`
+	Mode   string `json:"mode"`
+	Status string `json:"status"`
+	// ScheduledFor is the day, as 2006-01-02 in UTC, a scheduled run is
+	// the check for; "" for one an admin started
+	ScheduledFor string             `json:"scheduled_for,omitempty"`
+	Checked      int                `json:"checked"`
+	OK           int                `json:"ok"`
+	Corrupt      int                `json:"corrupt"`
+	Skipped      int                `json:"skipped"`
+	Failures     []IntegrityFailure `json:"failures"`
+	RequestedAt  time.Time          `json:"requested_at"`
+	StartedAt    *time.Time         `json:"started_at,omitempty"`
+	CompletedAt  *time.Time         `json:"completed_at,omitempty"`
+
+	// Users holds the counts for each owner's backups, so a user sees
+	// only their own
+	Users map[string]IntegrityTally `json:"-"`
+}
+
+// IntegrityTally counts the backups of one owner an integrity run checked.
+type IntegrityTally struct {
+	Checked int `json:"checked"`
+	OK      int `json:"ok"`
+	Corrupt int `json:"corrupt"`
+	Skipped int `json:"skipped"`
+}
+
+// WarehouseFile is one dataset written by a warehouse export.
+type WarehouseFile struct {
+	Dataset  string `json:"dataset"`
+	Location string `json:"location"`
+	Rows     int    `json:"rows"`
+}
+
+// WarehouseExport is one run of the warehouse export, of one day's data.
+type WarehouseExport struct {
+	ID   string `json:"id"`
+	Date string `json:"date"`
+	// Scheduled runs are made once for each day, by whichever server
+	// claims the day first; admins can run any day again
+	Scheduled   bool            `json:"scheduled"`
+	Datasets    []string        `json:"datasets"`
+	Status      string          `json:"status"`
+	Files       []WarehouseFile `json:"files"`
+	Error       string          `json:"error,omitempty"`
+	RequestedBy string          `json:"requested_by,omitempty"`
+	StartedAt   time.Time       `json:"started_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// OAuthState is a sign-in started at a provider and not yet returned.
+type OAuthState struct {
+	StateHash      string
+	Provider       string
+	Verifier       string
+	AcceptPolicies bool
+	ExpiresAt      time.Time
+}
+
+// OAuthLogin is a finished sign-in waiting for the frontend to collect its
+// tokens.
+type OAuthLogin struct {
+	CodeHash  string
+	UserID    string
+	Provider  string
+	Created   bool
+	ExpiresAt time.Time
+}
+
+// FailedAttempts counts the recent failures at something guessable, such
+// as a login.
+type FailedAttempts struct {
+	Key         string
+	Failures    int
+	Lockouts    int
+	LastFailure time.Time
+	RetryAt     *time.Time
+	LockedUntil *time.Time
+}
@@ -0,0 +1,51 @@
+package storage
+
+import "context"
+
+type scopeKey struct{}
+
+// scope is the workspace a request works in: the caller's own records, or
+// those of one of their teams.
+type scope struct {
+	personal bool
+	teamID   string
+}
+
+// WithPersonal limits the backups, projects and QR codes seen through ctx
+// to those the user keeps for themselves, leaving out what they made in
+// teams.
+func WithPersonal(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope{personal: true})
+}
+
+// WithTeam limits the backups, projects and QR codes seen through ctx to
+// the team's, whichever member made them. Records are created in the team
+// by setting their TeamID.
+func WithTeam(ctx context.Context, teamID string) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope{teamID: teamID})
+}
+
+// TeamFrom returns the team ctx is limited to, if any.
+func TeamFrom(ctx context.Context) string {
+	s, _ := ctx.Value(scopeKey{}).(scope)
+	return s.teamID
+}
+
+// scopeClause limits a query on backups, projects or QR codes to the
+// workspace ctx is in. In a team, that is the team's rows whoever owns
+// them; otherwise it is userID's, and only those outside teams under
+// WithPersonal. Without a team, an empty userID adds no limit, as for
+// ownerClause; a context with no scope sees all of userID's rows, for
+// background work.
+func scopeClause(ctx context.Context, userID string, args []interface{}) (string, []interface{}) {
+	s, _ := ctx.Value(scopeKey{}).(scope)
+	switch {
+	case s.teamID != "":
+		return " AND team_id = ?", append(args, s.teamID)
+	case userID == "":
+		return "", args
+	case s.personal:
+		return " AND user_id = ? AND team_id IS NULL", append(args, userID)
+	}
+	return " AND user_id = ?", append(args, userID)
+}
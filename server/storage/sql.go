@@ -0,0 +1,3581 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite"
+
+	"backup-manager/store"
+)
+
+type dialect int
+
+const (
+	postgres dialect = iota
+	sqlite
+)
+
+// Config selects and tunes the database. URL is a postgres:// connection
+// string or sqlite:<path>. Replicas are only supported with PostgreSQL.
+type Config struct {
+	URL           string
+	ReplicaURLs   []string
+	MaxReplicaLag time.Duration
+	StickyWindow  time.Duration
+}
+
+// SQL is the Repository for PostgreSQL and SQLite. With PostgreSQL, reads
+// for a user go to a replica unless that user wrote recently.
+type SQL struct {
+	dialect dialect
+	db      *sql.DB   // SQLite
+	cluster *store.DB // PostgreSQL
+}
+
+// Open connects to the database in cfg.URL. It does not migrate.
+func Open(ctx context.Context, cfg Config) (*SQL, error) {
+	switch {
+	case strings.HasPrefix(cfg.URL, "postgres://"), strings.HasPrefix(cfg.URL, "postgresql://"):
+		cluster, err := store.Open(ctx, store.Config{
+			PrimaryDSN:   cfg.URL,
+			ReplicaDSNs:  cfg.ReplicaURLs,
+			MaxLag:       cfg.MaxReplicaLag,
+			StickyWindow: cfg.StickyWindow,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &SQL{dialect: postgres, cluster: cluster}, nil
+
+	case strings.HasPrefix(cfg.URL, "sqlite:"):
+		if len(cfg.ReplicaURLs) > 0 {
+			return nil, errors.New("storage: read replicas need PostgreSQL")
+		}
+		path := strings.TrimPrefix(strings.TrimPrefix(cfg.URL, "sqlite://"), "sqlite:")
+		db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+		if err != nil {
+			return nil, fmt.Errorf("storage: opening %s: %w", path, err)
+		}
+		// SQLite allows one writer; a single connection queues them
+		// instead of failing with "database is locked"
+		db.SetMaxOpenConns(1)
+		if err := db.PingContext(ctx); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("storage: opening %s: %w", path, err)
+		}
+		return &SQL{dialect: sqlite, db: db}, nil
+	}
+	return nil, fmt.Errorf("storage: unsupported database URL, want postgres:// or sqlite:")
+}
+
+// reader is the database to read key's records from.
+func (s *SQL) reader(key string) *sql.DB {
+	if s.cluster != nil {
+		return s.cluster.Reader(key)
+	}
+	return s.db
+}
+
+// writer is the database to write key's records to.
+func (s *SQL) writer(key string) *sql.DB {
+	if s.cluster != nil {
+		return s.cluster.Writer(key)
+	}
+	return s.db
+}
+
+// Replicas reports the PostgreSQL read replicas, if any.
+func (s *SQL) Replicas() []store.ReplicaStatus {
+	if s.cluster == nil {
+		return nil
+	}
+	return s.cluster.Replicas()
+}
+
+// CheckReplicas refreshes replica health; see store.DB.CheckReplicas.
+func (s *SQL) CheckReplicas(ctx context.Context) {
+	if s.cluster != nil {
+		s.cluster.CheckReplicas(ctx)
+	}
+}
+
+func (s *SQL) Close() error {
+	if s.cluster != nil {
+		return s.cluster.Close()
+	}
+	return s.db.Close()
+}
+
+// rebind turns ? placeholders into PostgreSQL's $1, $2, ...
+func (s *SQL) rebind(query string) string {
+	if s.dialect != postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// translate turns driver errors into ErrNotFound and ErrConflict. IDs are
+// UUID columns in PostgreSQL, so a malformed ID is simply not found.
+func translate(err error) error {
+	var pqErr *pq.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case errors.As(err, &pqErr) && pqErr.Code == "22P02": // invalid_text_representation
+		return ErrNotFound
+	case errors.As(err, &pqErr) && pqErr.Code == "23505": // unique_violation
+		return ErrConflict
+	case strings.Contains(err.Error(), "UNIQUE constraint failed"):
+		return ErrConflict
+	}
+	return err
+}
+
+// nullIfEmpty stores optional references as NULL.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// ownerClause limits a query to userID's rows. An empty userID adds no
+// limit.
+func ownerClause(userID string, args []interface{}) (string, []interface{}) {
+	if userID == "" {
+		return "", args
+	}
+	return " AND user_id = ?", append(args, userID)
+}
+
+func encodeList(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+	data, _ := json.Marshal(list)
+	return string(data)
+}
+
+func decodeList(data string) []string {
+	list := []string{}
+	json.Unmarshal([]byte(data), &list)
+	return list
+}
+
+// encodeFiles stores a project's files as NULL when it has none.
+func encodeFiles(files []ProjectFile) interface{} {
+	if len(files) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(files)
+	return string(data)
+}
+
+// exec runs a write and reports ErrNotFound when it touched no rows.
+func (s *SQL) exec(ctx context.Context, key, query string, args ...interface{}) error {
+	res, err := s.writer(key).ExecContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return translate(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQL) Users() UserRepository                       { return userRepo{s} }
+func (s *SQL) Backups() BackupRepository                   { return backupRepo{s} }
+func (s *SQL) Projects() ProjectRepository                 { return projectRepo{s} }
+func (s *SQL) QRCodes() QRCodeRepository                   { return qrCodeRepo{s} }
+func (s *SQL) Teams() TeamRepository                       { return teamRepo{s} }
+func (s *SQL) ProjectShares() ProjectShareRepository       { return projectShareRepo{s} }
+func (s *SQL) Collections() CollectionRepository           { return collectionRepo{s} }
+func (s *SQL) RefreshTokens() RefreshTokenRepository       { return refreshTokenRepo{s} }
+func (s *SQL) Sessions() SessionRepository                 { return sessionRepo{s} }
+func (s *SQL) Uploads() UploadRepository                   { return uploadRepo{s} }
+func (s *SQL) Retention() RetentionRepository              { return retentionRepo{s} }
+func (s *SQL) Keyrings() KeyringRepository                 { return keyringRepo{s} }
+func (s *SQL) TwoFactor() TwoFactorRepository              { return twoFactorRepo{s} }
+func (s *SQL) RecoveryCodes() RecoveryCodeRepository       { return recoveryCodeRepo{s} }
+func (s *SQL) LegalHolds() LegalHoldRepository             { return legalHoldRepo{s} }
+func (s *SQL) APIKeys() APIKeyRepository                   { return apiKeyRepo{s} }
+func (s *SQL) Policies() PolicyRepository                  { return policyRepo{s} }
+func (s *SQL) Webhooks() WebhookRepository                 { return webhookRepo{s} }
+func (s *SQL) DomainEvents() DomainEventRepository         { return domainEventRepo{s} }
+func (s *SQL) QRTemplates() QRTemplateRepository           { return qrTemplateRepo{s} }
+func (s *SQL) QRLogos() QRLogoRepository                   { return qrLogoRepo{s} }
+func (s *SQL) Connectors() ConnectorRepository             { return connectorRepo{s} }
+func (s *SQL) EmailChanges() EmailChangeRepository         { return emailChangeRepo{s} }
+func (s *SQL) DataExports() DataExportRepository           { return dataExportRepo{s} }
+func (s *SQL) APIKeyUsage() APIKeyUsageRepository          { return apiKeyUsageRepo{s} }
+func (s *SQL) Chunks() ChunkRepository                     { return chunkRepo{s} }
+func (s *SQL) Jobs() JobRepository                         { return jobRepo{s} }
+func (s *SQL) PasswordResets() PasswordResetRepository     { return passwordResetRepo{s} }
+func (s *SQL) Replication() ReplicationRepository          { return replicationRepo{s} }
+func (s *SQL) SignedLinks() SignedLinkRepository           { return signedLinkRepo{s} }
+func (s *SQL) Maintenance() MaintenanceRepository          { return maintenanceRepo{s} }
+func (s *SQL) ChatImports() ChatImportRepository           { return chatImportRepo{s} }
+func (s *SQL) IntegrityRuns() IntegrityRunRepository       { return integrityRunRepo{s} }
+func (s *SQL) WarehouseExports() WarehouseExportRepository { return warehouseExportRepo{s} }
+func (s *SQL) OAuth() OAuthRepository                      { return oauthRepo{s} }
+func (s *SQL) Attempts() AttemptRepository                 { return attemptRepo{s} }
+
+// Users
+
+type userRepo struct{ s *SQL }
+
+const userColumns = `id, email, password_hash, created_at, role`
+
+// Columns are read through COALESCE where the schema allows NULL, and
+// UUIDs through CAST so both dialects scan them as strings.
+const selectUser = `SELECT CAST(id AS TEXT), email, password_hash, created_at, role,
+	NOT COALESCE(is_active, TRUE), password_reset_required, deletion_scheduled_at,
+	COALESCE(subscription_tier, 'free'), storage_quota_bytes FROM users`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt, &u.Role, &u.Disabled, &u.PasswordResetRequired,
+		&u.DeletionScheduledAt, &u.Plan, &u.StorageQuota)
+	return u, translate(err)
+}
+
+func (r userRepo) Create(ctx context.Context, u User) error {
+	if u.Role == "" {
+		u.Role = RoleUser
+	}
+	_, err := r.s.writer(u.ID).ExecContext(ctx, r.s.rebind(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?)`),
+		u.ID, u.Email, u.PasswordHash, u.CreatedAt.UTC(), u.Role)
+	return translate(err)
+}
+
+func (r userRepo) Get(ctx context.Context, id string) (User, error) {
+	return scanUser(r.s.reader(id).QueryRowContext(ctx, r.s.rebind(selectUser+` WHERE id = ?`), id))
+}
+
+// GetByEmail ignores case. Logins come from the primary: a user who just
+// registered has no ID yet for the replica guard to key on.
+func (r userRepo) GetByEmail(ctx context.Context, email string) (User, error) {
+	return scanUser(r.s.writer("").QueryRowContext(ctx,
+		r.s.rebind(selectUser+` WHERE lower(email) = lower(?)`), email))
+}
+
+func (r userRepo) List(ctx context.Context, query string, limit, offset int) ([]User, error) {
+	where, args := ` WHERE 1 = 1`, []interface{}{}
+	if query != "" {
+		where += ` AND lower(email) LIKE lower(?)`
+		args = append(args, "%"+query+"%")
+	}
+	args = append(args, limit, offset)
+	return r.query(ctx, r.s.reader(""), selectUser+where+` ORDER BY created_at, id LIMIT ? OFFSET ?`, args...)
+}
+
+func (r userRepo) query(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]User, error) {
+	rows, err := db.QueryContext(ctx, r.s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (r userRepo) UpdateEmail(ctx context.Context, id, email string) error {
+	return r.s.exec(ctx, id, `UPDATE users SET email = ? WHERE id = ?`, email, id)
+}
+
+func (r userRepo) UpdateRole(ctx context.Context, id, role string) error {
+	return r.s.exec(ctx, id, `UPDATE users SET role = ? WHERE id = ?`, role, id)
+}
+
+func (r userRepo) SetDisabled(ctx context.Context, id string, disabled bool) error {
+	return r.s.exec(ctx, id, `UPDATE users SET is_active = ? WHERE id = ?`, !disabled, id)
+}
+
+func (r userRepo) SetPassword(ctx context.Context, id, hash string) error {
+	return r.s.exec(ctx, id, `UPDATE users SET password_hash = ?, password_reset_required = FALSE WHERE id = ?`, hash, id)
+}
+
+func (r userRepo) ReplacePasswordHash(ctx context.Context, id, oldHash, newHash string) error {
+	return r.s.exec(ctx, id, `UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?`, newHash, id, oldHash)
+}
+
+func (r userRepo) RequirePasswordReset(ctx context.Context, id string) error {
+	return r.s.exec(ctx, id, `UPDATE users SET password_reset_required = TRUE WHERE id = ?`, id)
+}
+
+func (r userRepo) ScheduleDeletion(ctx context.Context, id string, at *time.Time) error {
+	var value interface{}
+	if at != nil {
+		value = at.UTC()
+	}
+	return r.s.exec(ctx, id, `UPDATE users SET deletion_scheduled_at = ? WHERE id = ?`, value, id)
+}
+
+func (r userRepo) SetPlan(ctx context.Context, id, plan string, quota *int64) error {
+	return r.s.exec(ctx, id, `UPDATE users SET subscription_tier = ?, storage_quota_bytes = ? WHERE id = ?`, plan, quota, id)
+}
+
+// ListDeletionDue reads from the primary, since the users it returns are
+// about to be deleted.
+func (r userRepo) ListDeletionDue(ctx context.Context, now time.Time, limit int) ([]User, error) {
+	return r.query(ctx, r.s.writer(""), selectUser+` WHERE deletion_scheduled_at <= ? ORDER BY deletion_scheduled_at LIMIT ?`,
+		now.UTC(), limit)
+}
+
+// ListInactive reads from the primary, as ListDeletionDue does.
+func (r userRepo) ListInactive(ctx context.Context, cutoff time.Time, limit int) ([]User, error) {
+	return r.query(ctx, r.s.writer(""), selectUser+` WHERE role <> ? AND created_at < ?
+		AND NOT EXISTS (SELECT 1 FROM sessions WHERE sessions.user_id = users.id AND sessions.last_used_at >= ?)
+		AND NOT EXISTS (SELECT 1 FROM api_keys WHERE api_keys.user_id = users.id AND api_keys.last_used_at >= ?)
+		ORDER BY created_at LIMIT ?`, RoleAdmin, cutoff.UTC(), cutoff.UTC(), cutoff.UTC(), limit)
+}
+
+func (r userRepo) Delete(ctx context.Context, id string) error {
+	return r.s.exec(ctx, id, `DELETE FROM users WHERE id = ?`, id)
+}
+
+// Usage
+
+func (s *SQL) Usage(ctx context.Context) (Usage, error) {
+	var u Usage
+	db := s.reader("")
+	if err := db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*),
+		COALESCE(SUM(CASE WHEN NOT COALESCE(is_active, TRUE) THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN role = ? THEN 1 ELSE 0 END), 0) FROM users`), RoleAdmin).
+		Scan(&u.Users, &u.DisabledUsers, &u.Admins); err != nil {
+		return Usage{}, err
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(size_bytes), 0) FROM backups`).
+		Scan(&u.Backups, &u.BackupBytes); err != nil {
+		return Usage{}, err
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(stored_bytes), 0) FROM chunks`).
+		Scan(&u.StoredBytes); err != nil {
+		return Usage{}, err
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM projects`).Scan(&u.Projects); err != nil {
+		return Usage{}, err
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(short_code) FROM qr_codes`).
+		Scan(&u.QRCodes, &u.DynamicQRCodes); err != nil {
+		return Usage{}, err
+	}
+	return u, nil
+}
+
+func (s *SQL) UserUsage(ctx context.Context, userID string) (UserUsage, error) {
+	var u UserUsage
+	db := s.reader(userID)
+	if err := db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*), COALESCE(SUM(size_bytes), 0) FROM backups WHERE user_id = ?`), userID).
+		Scan(&u.Backups, &u.BackupBytes); err != nil {
+		return UserUsage{}, err
+	}
+	if err := db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM projects WHERE user_id = ?`), userID).
+		Scan(&u.Projects); err != nil {
+		return UserUsage{}, err
+	}
+	if err := db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM qr_codes WHERE user_id = ?`), userID).
+		Scan(&u.QRCodes); err != nil {
+		return UserUsage{}, err
+	}
+	return u, nil
+}
+
+// dateOf is the UTC date of a timestamp column, as YYYY-MM-DD.
+func (s *SQL) dateOf(column string) string {
+	if s.dialect == postgres {
+		return `TO_CHAR(` + column + ` AT TIME ZONE 'UTC', 'YYYY-MM-DD')`
+	}
+	// Timestamps are written in UTC, as text starting with the date
+	return `SUBSTR(` + column + `, 1, 10)`
+}
+
+func (s *SQL) Stats(ctx context.Context, userID string, since time.Time) (Stats, error) {
+	st := Stats{
+		ProjectsByLanguage: []LanguageStats{},
+		LinesOverTime:      []LinesDay{},
+		BackupsBySource:    []SourceStats{},
+		StorageGrowth:      []StorageDay{},
+	}
+	db := s.reader(userID)
+	sinceDate := since.UTC().Format("2006-01-02")
+
+	clause, args := scopeClause(ctx, userID, nil)
+	rows, err := db.QueryContext(ctx, s.rebind(`SELECT COALESCE(language, ''), COUNT(*), COALESCE(SUM(lines_of_code), 0)
+		FROM projects WHERE deleted_at IS NULL`+clause+` GROUP BY COALESCE(language, '') ORDER BY COUNT(*) DESC`), args...)
+	if err != nil {
+		return Stats{}, err
+	}
+	for rows.Next() {
+		var l LanguageStats
+		if err := rows.Scan(&l.Language, &l.Projects, &l.LinesOfCode); err != nil {
+			rows.Close()
+			return Stats{}, err
+		}
+		st.ProjectsByLanguage = append(st.ProjectsByLanguage, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	day := s.dateOf("created_at")
+	var lines int64
+	clause, args = scopeClause(ctx, userID, []interface{}{sinceDate})
+	if err := db.QueryRowContext(ctx, s.rebind(`SELECT COALESCE(SUM(lines_of_code), 0) FROM projects
+		WHERE deleted_at IS NULL AND `+day+` < ?`+clause), args...).Scan(&lines); err != nil {
+		return Stats{}, err
+	}
+	rows, err = db.QueryContext(ctx, s.rebind(`SELECT `+day+`, COUNT(*), COALESCE(SUM(lines_of_code), 0) FROM projects
+		WHERE deleted_at IS NULL AND `+day+` >= ?`+clause+` GROUP BY `+day+` ORDER BY `+day), args...)
+	if err != nil {
+		return Stats{}, err
+	}
+	for rows.Next() {
+		var d LinesDay
+		if err := rows.Scan(&d.Date, &d.Projects, &d.Lines); err != nil {
+			rows.Close()
+			return Stats{}, err
+		}
+		lines += d.Lines
+		d.TotalLines = lines
+		st.LinesOverTime = append(st.LinesOverTime, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	clause, args = scopeClause(ctx, userID, nil)
+	rows, err = db.QueryContext(ctx, s.rebind(`SELECT source, COUNT(*), COALESCE(SUM(size_bytes), 0)
+		FROM backups WHERE deleted_at IS NULL`+clause+` GROUP BY source ORDER BY COUNT(*) DESC`), args...)
+	if err != nil {
+		return Stats{}, err
+	}
+	for rows.Next() {
+		var src SourceStats
+		if err := rows.Scan(&src.Source, &src.Backups, &src.Bytes); err != nil {
+			rows.Close()
+			return Stats{}, err
+		}
+		st.BackupsBySource = append(st.BackupsBySource, src)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	var stored int64
+	clause, args = scopeClause(ctx, userID, []interface{}{sinceDate})
+	if err := db.QueryRowContext(ctx, s.rebind(`SELECT COALESCE(SUM(size_bytes), 0) FROM backups
+		WHERE `+day+` < ?`+clause), args...).Scan(&stored); err != nil {
+		return Stats{}, err
+	}
+	rows, err = db.QueryContext(ctx, s.rebind(`SELECT `+day+`, COUNT(*), COALESCE(SUM(size_bytes), 0) FROM backups
+		WHERE `+day+` >= ?`+clause+` GROUP BY `+day+` ORDER BY `+day), args...)
+	if err != nil {
+		return Stats{}, err
+	}
+	for rows.Next() {
+		var d StorageDay
+		if err := rows.Scan(&d.Date, &d.Backups, &d.Bytes); err != nil {
+			rows.Close()
+			return Stats{}, err
+		}
+		stored += d.Bytes
+		d.TotalBytes = stored
+		st.StorageGrowth = append(st.StorageGrowth, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	clause, args = scopeClause(ctx, userID, nil)
+	if err := db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM qr_codes WHERE 1 = 1`+clause), args...).
+		Scan(&st.QRCodes); err != nil {
+		return Stats{}, err
+	}
+	return st, nil
+}
+
+// Backups
+
+type backupRepo struct{ s *SQL }
+
+const backupColumns = `id, user_id, name, source, size_bytes, file_type, thumbnail_url, created_at,
+	content_preview, encrypted_data, title, summary, summary_model, checksum, ciphertext_checksum, blob_key, key_version,
+	chain_id, version, compression, team_id`
+
+const selectBackup = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), name, source, size_bytes, COALESCE(file_type, ''),
+	thumbnail_url, created_at, COALESCE(content_preview, ''), encrypted_data, title, summary, summary_model,
+	COALESCE(checksum, ''), ciphertext_checksum, blob_key, key_version, deleted_at,
+	COALESCE(CAST(chain_id AS TEXT), CAST(id AS TEXT)), version, compression, COALESCE(CAST(team_id AS TEXT), ''),
+	verified_at, corruption FROM backups`
+
+func scanBackup(row interface{ Scan(...interface{}) error }) (Backup, error) {
+	var b Backup
+	var deletedAt, verifiedAt sql.NullTime
+	err := row.Scan(&b.ID, &b.UserID, &b.Name, &b.Source, &b.Size, &b.FileType, &b.ThumbnailURL, &b.Timestamp,
+		&b.ContentPreview, &b.EncryptedData, &b.Title, &b.Summary, &b.SummaryModel, &b.Checksum, &b.CiphertextChecksum, &b.BlobKey,
+		&b.KeyVersion, &deletedAt, &b.ChainID, &b.Version, &b.Compression, &b.TeamID, &verifiedAt, &b.Corruption)
+	if deletedAt.Valid {
+		b.DeletedAt = &deletedAt.Time
+	}
+	if verifiedAt.Valid {
+		b.VerifiedAt = &verifiedAt.Time
+	}
+	return b, translate(err)
+}
+
+// Create starts a new chain when b has no ChainID.
+func (r backupRepo) Create(ctx context.Context, b Backup) error {
+	if b.ChainID == "" {
+		b.ChainID = b.ID
+	}
+	if b.Version == 0 {
+		b.Version = 1
+	}
+	_, err := r.s.writer(b.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO backups (`+backupColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		b.ID, b.UserID, b.Name, b.Source, b.Size, b.FileType, b.ThumbnailURL, b.Timestamp.UTC(),
+		b.ContentPreview, b.EncryptedData, b.Title, b.Summary, b.SummaryModel, b.Checksum, b.CiphertextChecksum, b.BlobKey,
+		b.KeyVersion, b.ChainID, b.Version, b.Compression, nullIfEmpty(b.TeamID))
+	return translate(err)
+}
+
+func (r backupRepo) Get(ctx context.Context, userID, id string) (Backup, error) {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return scanBackup(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectBackup+` WHERE id = ? AND deleted_at IS NULL`+clause), args...))
+}
+
+func (r backupRepo) List(ctx context.Context, userID string) ([]Backup, error) {
+	clause, args := scopeClause(ctx, userID, nil)
+	return r.query(ctx, r.s.reader(userID), selectBackup+` WHERE deleted_at IS NULL`+clause+` ORDER BY created_at DESC`, args...)
+}
+
+// LatestVersion reads from the primary, so a version uploaded a moment ago
+// is seen.
+func (r backupRepo) LatestVersion(ctx context.Context, userID, name, source string) (Backup, error) {
+	clause, args := scopeClause(ctx, userID, []interface{}{name, source})
+	return scanBackup(r.s.writer(userID).QueryRowContext(ctx, r.s.rebind(selectBackup+`
+		WHERE name = ? AND source = ?`+clause+` ORDER BY version DESC, created_at DESC LIMIT 1`), args...))
+}
+
+func (r backupRepo) Versions(ctx context.Context, userID, chainID string) ([]Backup, error) {
+	clause, args := scopeClause(ctx, userID, []interface{}{chainID})
+	return r.query(ctx, r.s.reader(userID), selectBackup+` WHERE chain_id = ? AND deleted_at IS NULL`+clause+` ORDER BY version DESC`, args...)
+}
+
+func (r backupRepo) GetTrashed(ctx context.Context, userID, id string) (Backup, error) {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return scanBackup(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectBackup+` WHERE id = ? AND deleted_at IS NOT NULL`+clause), args...))
+}
+
+func (r backupRepo) ListTrashed(ctx context.Context, userID string) ([]Backup, error) {
+	clause, args := scopeClause(ctx, userID, nil)
+	return r.query(ctx, r.s.reader(userID), selectBackup+` WHERE deleted_at IS NOT NULL`+clause+` ORDER BY deleted_at DESC`, args...)
+}
+
+// ListTrashedBefore reads from the primary, since the backups it returns
+// are about to be purged.
+func (r backupRepo) ListTrashedBefore(ctx context.Context, cutoff time.Time, limit int) ([]Backup, error) {
+	return r.query(ctx, r.s.writer(""), selectBackup+` WHERE deleted_at < ? ORDER BY deleted_at LIMIT ?`, cutoff.UTC(), limit)
+}
+
+// ListKeyVersionBelow reads from the primary, since the backups it returns
+// are about to be rewritten. Backups in the trash are included; they can
+// still be restored.
+func (r backupRepo) ListKeyVersionBelow(ctx context.Context, version, limit int) ([]Backup, error) {
+	return r.query(ctx, r.s.writer(""), selectBackup+` WHERE key_version > 0 AND key_version < ? ORDER BY key_version, id LIMIT ?`,
+		version, limit)
+}
+
+func (r backupRepo) query(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Backup, error) {
+	rows, err := db.QueryContext(ctx, r.s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backups := []Backup{}
+	for rows.Next() {
+		b, err := scanBackup(rows)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	return backups, rows.Err()
+}
+
+func (r backupRepo) CountByKeyVersion(ctx context.Context) (map[int]int, error) {
+	rows, err := r.s.reader("").QueryContext(ctx, `SELECT key_version, COUNT(*) FROM backups GROUP BY key_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[int]int{}
+	for rows.Next() {
+		var version, n int
+		if err := rows.Scan(&version, &n); err != nil {
+			return nil, err
+		}
+		counts[version] = n
+	}
+	return counts, rows.Err()
+}
+
+// Update saves the fields that change after upload.
+func (r backupRepo) Update(ctx context.Context, b Backup) error {
+	return r.s.exec(ctx, b.UserID, `UPDATE backups SET name = ?, thumbnail_url = ?, encrypted_data = ?, title = ?,
+		summary = ?, summary_model = ?, checksum = ?, ciphertext_checksum = ?, blob_key = ?, key_version = ?, compression = ?
+		WHERE id = ? AND user_id = ?`,
+		b.Name, b.ThumbnailURL, b.EncryptedData, b.Title, b.Summary, b.SummaryModel, b.Checksum, b.CiphertextChecksum, b.BlobKey,
+		b.KeyVersion, b.Compression, b.ID, b.UserID)
+}
+
+func (r backupRepo) SetVerified(ctx context.Context, id string, at time.Time, corruption string) error {
+	return r.s.exec(ctx, "", `UPDATE backups SET verified_at = ?, corruption = ? WHERE id = ?`, at.UTC(), corruption, id)
+}
+
+func (r backupRepo) Delete(ctx context.Context, userID, id string) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return r.s.exec(ctx, userID, `DELETE FROM backups WHERE id = ?`+clause, args...)
+}
+
+// Trash stamps the backup's projects with the same time as the backup,
+// which is how Restore tells them from projects trashed on their own.
+func (r backupRepo) Trash(ctx context.Context, userID, id string, at time.Time) error {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	clause, args := scopeClause(ctx, userID, []interface{}{at.UTC(), id})
+	res, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE backups SET deleted_at = ?
+		WHERE id = ? AND deleted_at IS NULL`+clause), args...)
+	if err != nil {
+		return translate(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE projects SET deleted_at = ?
+		WHERE backup_id = ? AND deleted_at IS NULL`), at.UTC(), id); err != nil {
+		return translate(err)
+	}
+	return tx.Commit()
+}
+
+func (r backupRepo) Restore(ctx context.Context, userID, id string) error {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Projects first, while the backup still has its deleted_at to match;
+	// the rollback undoes this if the backup turns out not to be the user's
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE projects SET deleted_at = NULL
+		WHERE backup_id = ? AND deleted_at = (SELECT deleted_at FROM backups WHERE id = ?)`), id, id); err != nil {
+		return translate(err)
+	}
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	res, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE backups SET deleted_at = NULL
+		WHERE id = ? AND deleted_at IS NOT NULL`+clause), args...)
+	if err != nil {
+		return translate(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// Projects
+
+type projectRepo struct{ s *SQL }
+
+const projectColumns = `id, user_id, backup_id, name, type, description, source, language, lines_of_code,
+	features, code, created_at, tags, starred, generated_description, description_model, team_id, files`
+
+const selectProject = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), COALESCE(CAST(backup_id AS TEXT), ''), name, type,
+	COALESCE(description, ''), source, COALESCE(language, ''), COALESCE(lines_of_code, 0), COALESCE(CAST(features AS TEXT), '[]'),
+	code, created_at, COALESCE(CAST(tags AS TEXT), '[]'), COALESCE(starred, FALSE), generated_description, description_model,
+	deleted_at, COALESCE(CAST(team_id AS TEXT), ''), COALESCE(CAST(files AS TEXT), '[]'), last_accessed_at, version FROM projects`
+
+func scanProject(row interface{ Scan(...interface{}) error }) (Project, error) {
+	var p Project
+	var features, tags, files string
+	var deletedAt, lastAccessedAt sql.NullTime
+	err := row.Scan(&p.ID, &p.UserID, &p.BackupID, &p.Name, &p.Type, &p.Description, &p.Source, &p.Language, &p.LinesOfCode,
+		&features, &p.Code, &p.Timestamp, &tags, &p.Starred, &p.GeneratedDescription, &p.DescriptionModel, &deletedAt, &p.TeamID,
+		&files, &lastAccessedAt, &p.Version)
+	p.Features = decodeList(features)
+	p.Tags = decodeList(tags)
+	json.Unmarshal([]byte(files), &p.Files)
+	if deletedAt.Valid {
+		p.DeletedAt = &deletedAt.Time
+	}
+	if lastAccessedAt.Valid {
+		p.LastAccessedAt = &lastAccessedAt.Time
+	}
+	return p, translate(err)
+}
+
+func (r projectRepo) Create(ctx context.Context, p Project) error {
+	_, err := r.s.writer(p.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO projects (`+projectColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		p.ID, p.UserID, nullIfEmpty(p.BackupID), p.Name, p.Type, p.Description, p.Source, p.Language, p.LinesOfCode,
+		encodeList(p.Features), p.Code, p.Timestamp.UTC(), encodeList(p.Tags), p.Starred, p.GeneratedDescription, p.DescriptionModel,
+		nullIfEmpty(p.TeamID), encodeFiles(p.Files))
+	return translate(err)
+}
+
+func (r projectRepo) Get(ctx context.Context, userID, id string) (Project, error) {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return scanProject(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectProject+` WHERE id = ? AND deleted_at IS NULL`+clause), args...))
+}
+
+func (r projectRepo) List(ctx context.Context, userID string) ([]Project, error) {
+	clause, args := scopeClause(ctx, userID, nil)
+	return r.query(ctx, r.s.reader(userID), selectProject+` WHERE deleted_at IS NULL`+clause+` ORDER BY created_at DESC`, args...)
+}
+
+func (r projectRepo) ListStarred(ctx context.Context, userID string) ([]Project, error) {
+	clause, args := scopeClause(ctx, userID, nil)
+	return r.query(ctx, r.s.reader(userID), selectProject+` WHERE deleted_at IS NULL AND starred = TRUE`+clause+
+		` ORDER BY created_at DESC`, args...)
+}
+
+func (r projectRepo) ListRecent(ctx context.Context, userID string, limit int) ([]Project, error) {
+	clause, args := scopeClause(ctx, userID, nil)
+	return r.query(ctx, r.s.reader(userID), selectProject+` WHERE deleted_at IS NULL AND last_accessed_at IS NOT NULL`+clause+
+		` ORDER BY last_accessed_at DESC LIMIT ?`, append(args, limit)...)
+}
+
+func (r projectRepo) Touch(ctx context.Context, id string, at time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE projects SET last_accessed_at = ? WHERE id = ?`, at.UTC(), id)
+}
+
+func (r projectRepo) GetTrashed(ctx context.Context, userID, id string) (Project, error) {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return scanProject(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectProject+` WHERE id = ? AND deleted_at IS NOT NULL`+clause), args...))
+}
+
+func (r projectRepo) ListTrashed(ctx context.Context, userID string) ([]Project, error) {
+	clause, args := scopeClause(ctx, userID, nil)
+	return r.query(ctx, r.s.reader(userID), selectProject+` WHERE deleted_at IS NOT NULL`+clause+` ORDER BY deleted_at DESC`, args...)
+}
+
+// ListTrashedBefore reads from the primary, since the projects it returns
+// are about to be purged.
+func (r projectRepo) ListTrashedBefore(ctx context.Context, cutoff time.Time, limit int) ([]Project, error) {
+	return r.query(ctx, r.s.writer(""), selectProject+` WHERE deleted_at < ? ORDER BY deleted_at LIMIT ?`, cutoff.UTC(), limit)
+}
+
+func (r projectRepo) query(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Project, error) {
+	rows, err := db.QueryContext(ctx, r.s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []Project{}
+	for rows.Next() {
+		p, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+const updateProject = `UPDATE projects SET name = ?, description = ?, features = ?, tags = ?, starred = ?,
+	generated_description = ?, description_model = ?, code = ?, files = ?, language = ?, lines_of_code = ?,
+	version = version + 1 WHERE id = ? AND user_id = ?`
+
+func updateProjectArgs(p Project) []interface{} {
+	return []interface{}{p.Name, p.Description, encodeList(p.Features), encodeList(p.Tags), p.Starred,
+		p.GeneratedDescription, p.DescriptionModel, p.Code, encodeFiles(p.Files), p.Language, p.LinesOfCode, p.ID, p.UserID}
+}
+
+// Update saves the fields a user or the summarizer can change.
+func (r projectRepo) Update(ctx context.Context, p Project) error {
+	return r.s.exec(ctx, p.UserID, updateProject, updateProjectArgs(p)...)
+}
+
+func (r projectRepo) UpdateIfVersion(ctx context.Context, p Project, version int) error {
+	err := r.s.exec(ctx, p.UserID, updateProject+` AND version = ?`, append(updateProjectArgs(p), version)...)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	// Tell a project that changed from one that is gone
+	var current int
+	err = r.s.writer(p.UserID).QueryRowContext(ctx, r.s.rebind(`SELECT version FROM projects WHERE id = ? AND user_id = ?`),
+		p.ID, p.UserID).Scan(&current)
+	if err != nil {
+		return translate(err)
+	}
+	return ErrStale
+}
+
+func (r projectRepo) Delete(ctx context.Context, userID, id string) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return r.s.exec(ctx, userID, `DELETE FROM projects WHERE id = ?`+clause, args...)
+}
+
+func (r projectRepo) Trash(ctx context.Context, userID, id string, at time.Time) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{at.UTC(), id})
+	return r.s.exec(ctx, userID, `UPDATE projects SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`+clause, args...)
+}
+
+func (r projectRepo) Restore(ctx context.Context, userID, id string) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return r.s.exec(ctx, userID, `UPDATE projects SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL`+clause, args...)
+}
+
+func (r projectRepo) SetTags(ctx context.Context, userID string, tags map[string][]string) error {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for id, list := range tags {
+		clause, args := scopeClause(ctx, userID, []interface{}{encodeList(list), id})
+		res, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE projects SET tags = ?, version = version + 1 WHERE id = ?`+clause), args...)
+		if err != nil {
+			return translate(err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+	}
+	return tx.Commit()
+}
+
+func (r projectRepo) Merge(ctx context.Context, keep Project, mergedIDs []string) error {
+	tx, err := r.s.writer(keep.UserID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, r.s.rebind(updateProject), updateProjectArgs(keep)...)
+	if err != nil {
+		return translate(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	for _, id := range mergedIDs {
+		clause, args := scopeClause(ctx, keep.UserID, []interface{}{id})
+		res, err := tx.ExecContext(ctx, r.s.rebind(`DELETE FROM projects WHERE id = ?`+clause), args...)
+		if err != nil {
+			return translate(err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+	}
+	return tx.Commit()
+}
+
+// QR codes
+
+type qrCodeRepo struct{ s *SQL }
+
+const qrCodeColumns = `id, user_id, content, ec_level, size, version, created_at, short_code, target, team_id, password_hash,
+	language, live_at, expires_at, landing_page`
+
+const selectQRCode = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), content, ec_level, size, version, created_at,
+	COALESCE(short_code, ''), target, COALESCE(CAST(team_id AS TEXT), ''), password_hash,
+	language, live_at, expires_at, landing_page FROM qr_codes`
+
+func scanQRCode(row interface{ Scan(...interface{}) error }) (QRCode, error) {
+	var q QRCode
+	var liveAt, expiresAt sql.NullTime
+	if err := row.Scan(&q.ID, &q.UserID, &q.Content, &q.ECLevel, &q.Size, &q.Version, &q.CreatedAt, &q.ShortCode, &q.Target, &q.TeamID,
+		&q.PasswordHash, &q.Language, &liveAt, &expiresAt, &q.LandingPage); err != nil {
+		return q, translate(err)
+	}
+	q.HasPassword = q.PasswordHash != ""
+	if liveAt.Valid {
+		q.LiveAt = &liveAt.Time
+	}
+	if expiresAt.Valid {
+		q.ExpiresAt = &expiresAt.Time
+	}
+	return q, nil
+}
+
+// nullTime stores an optional time as NULL.
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+const insertQRTarget = `INSERT INTO qr_code_targets (qr_code_id, target, changed_by, changed_at) VALUES (?, ?, ?, ?)`
+
+func (r qrCodeRepo) Create(ctx context.Context, q QRCode) error {
+	tx, err := r.s.writer(q.UserID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`INSERT INTO qr_codes (`+qrCodeColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		q.ID, q.UserID, q.Content, q.ECLevel, q.Size, q.Version, q.CreatedAt.UTC(), nullIfEmpty(q.ShortCode), q.Target,
+		nullIfEmpty(q.TeamID), q.PasswordHash, q.Language, nullTime(q.LiveAt), nullTime(q.ExpiresAt), q.LandingPage); err != nil {
+		return translate(err)
+	}
+	if q.Dynamic() {
+		if _, err := tx.ExecContext(ctx, r.s.rebind(insertQRTarget),
+			q.ID, q.Target, q.UserID, q.CreatedAt.UTC()); err != nil {
+			return translate(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r qrCodeRepo) Get(ctx context.Context, userID, id string) (QRCode, error) {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return scanQRCode(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectQRCode+` WHERE id = ?`+clause), args...))
+}
+
+func (r qrCodeRepo) GetByShortCode(ctx context.Context, shortCode string) (QRCode, error) {
+	return scanQRCode(r.s.reader("").QueryRowContext(ctx,
+		r.s.rebind(selectQRCode+` WHERE short_code = ?`), shortCode))
+}
+
+func (r qrCodeRepo) List(ctx context.Context, userID string) ([]QRCode, error) {
+	clause, args := scopeClause(ctx, userID, nil)
+	rows, err := r.s.reader(userID).QueryContext(ctx,
+		r.s.rebind(selectQRCode+` WHERE 1 = 1`+clause+` ORDER BY created_at DESC`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []QRCode{}
+	for rows.Next() {
+		q, err := scanQRCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, q)
+	}
+	return codes, rows.Err()
+}
+
+func (r qrCodeRepo) UpdateTarget(ctx context.Context, userID string, change QRTarget) error {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	clause, args := scopeClause(ctx, userID, []interface{}{change.Target, change.QRCodeID})
+	res, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE qr_codes SET target = ?
+		WHERE id = ? AND short_code IS NOT NULL`+clause), args...)
+	if err != nil {
+		return translate(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, r.s.rebind(insertQRTarget),
+		change.QRCodeID, change.Target, change.ChangedBy, change.ChangedAt.UTC()); err != nil {
+		return translate(err)
+	}
+	return tx.Commit()
+}
+
+func (r qrCodeRepo) SetPassword(ctx context.Context, userID, id, hash string) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{hash, id})
+	return r.s.exec(ctx, userID, `UPDATE qr_codes SET password_hash = ? WHERE id = ? AND short_code IS NOT NULL`+clause, args...)
+}
+
+func (r qrCodeRepo) UpdatePages(ctx context.Context, userID string, q QRCode) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{q.Language, nullTime(q.LiveAt), nullTime(q.ExpiresAt), q.LandingPage, q.ID})
+	return r.s.exec(ctx, userID, `UPDATE qr_codes SET language = ?, live_at = ?, expires_at = ?, landing_page = ?
+		WHERE id = ? AND short_code IS NOT NULL`+clause, args...)
+}
+
+func (r qrCodeRepo) Targets(ctx context.Context, userID, id string) ([]QRTarget, error) {
+	if _, err := r.Get(ctx, userID, id); err != nil {
+		return nil, err
+	}
+	rows, err := r.s.reader(userID).QueryContext(ctx, r.s.rebind(`SELECT CAST(qr_code_id AS TEXT), target,
+		CAST(changed_by AS TEXT), changed_at FROM qr_code_targets WHERE qr_code_id = ? ORDER BY changed_at DESC`), id)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	targets := []QRTarget{}
+	for rows.Next() {
+		var t QRTarget
+		if err := rows.Scan(&t.QRCodeID, &t.Target, &t.ChangedBy, &t.ChangedAt); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+func (r qrCodeRepo) Delete(ctx context.Context, userID, id string) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return r.s.exec(ctx, userID, `DELETE FROM qr_codes WHERE id = ?`+clause, args...)
+}
+
+// Teams
+
+// Memberships are read from the primary: a replica that hasn't seen a
+// member removed would still let them in.
+type teamRepo struct{ s *SQL }
+
+const selectTeamMember = `SELECT CAST(m.team_id AS TEXT), CAST(m.user_id AS TEXT), u.email, m.role, m.created_at
+	FROM team_members m JOIN users u ON u.id = m.user_id`
+
+func scanTeamMember(row interface{ Scan(...interface{}) error }) (TeamMember, error) {
+	var m TeamMember
+	err := row.Scan(&m.TeamID, &m.UserID, &m.Email, &m.Role, &m.JoinedAt)
+	return m, translate(err)
+}
+
+func (r teamRepo) Create(ctx context.Context, t Team, ownerID string) error {
+	tx, err := r.s.writer(ownerID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`INSERT INTO teams (id, name, created_at) VALUES (?, ?, ?)`),
+		t.ID, t.Name, t.CreatedAt.UTC()); err != nil {
+		return translate(err)
+	}
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`INSERT INTO team_members (team_id, user_id, role, created_at) VALUES (?, ?, ?, ?)`),
+		t.ID, ownerID, TeamOwner, t.CreatedAt.UTC()); err != nil {
+		return translate(err)
+	}
+	return tx.Commit()
+}
+
+func (r teamRepo) Get(ctx context.Context, id string) (Team, error) {
+	var t Team
+	err := r.s.writer("").QueryRowContext(ctx, r.s.rebind(`SELECT CAST(id AS TEXT), name, created_at FROM teams WHERE id = ?`), id).
+		Scan(&t.ID, &t.Name, &t.CreatedAt)
+	return t, translate(err)
+}
+
+func (r teamRepo) ListForUser(ctx context.Context, userID string) ([]Team, error) {
+	rows, err := r.s.writer(userID).QueryContext(ctx, r.s.rebind(`SELECT CAST(t.id AS TEXT), t.name, t.created_at, m.role
+		FROM teams t JOIN team_members m ON m.team_id = t.id WHERE m.user_id = ? ORDER BY t.created_at`), userID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	teams := []Team{}
+	for rows.Next() {
+		var t Team
+		if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt, &t.Role); err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+func (r teamRepo) Rename(ctx context.Context, id, name string) error {
+	return r.s.exec(ctx, "", `UPDATE teams SET name = ? WHERE id = ?`, name, id)
+}
+
+func (r teamRepo) Delete(ctx context.Context, id string) error {
+	return r.s.exec(ctx, "", `DELETE FROM teams WHERE id = ?`, id)
+}
+
+func (r teamRepo) Members(ctx context.Context, teamID string) ([]TeamMember, error) {
+	rows, err := r.s.writer("").QueryContext(ctx, r.s.rebind(selectTeamMember+` WHERE m.team_id = ? ORDER BY m.created_at`), teamID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	members := []TeamMember{}
+	for rows.Next() {
+		m, err := scanTeamMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (r teamRepo) Member(ctx context.Context, teamID, userID string) (TeamMember, error) {
+	return scanTeamMember(r.s.writer(userID).QueryRowContext(ctx,
+		r.s.rebind(selectTeamMember+` WHERE m.team_id = ? AND m.user_id = ?`), teamID, userID))
+}
+
+func (r teamRepo) AddMember(ctx context.Context, m TeamMember) error {
+	_, err := r.s.writer(m.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO team_members (team_id, user_id, role, created_at)
+		VALUES (?, ?, ?, ?)`), m.TeamID, m.UserID, m.Role, m.JoinedAt.UTC())
+	return translate(err)
+}
+
+func (r teamRepo) SetMemberRole(ctx context.Context, teamID, userID, role string) error {
+	return r.s.exec(ctx, userID, `UPDATE team_members SET role = ? WHERE team_id = ? AND user_id = ?`, role, teamID, userID)
+}
+
+func (r teamRepo) RemoveMember(ctx context.Context, teamID, userID string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM team_members WHERE team_id = ? AND user_id = ?`, teamID, userID)
+}
+
+const selectTeamInvite = `SELECT CAST(id AS TEXT), CAST(team_id AS TEXT), email, role, CAST(invited_by AS TEXT),
+	token_hash, created_at, expires_at FROM team_invites`
+
+func scanTeamInvite(row interface{ Scan(...interface{}) error }) (TeamInvite, error) {
+	var i TeamInvite
+	err := row.Scan(&i.ID, &i.TeamID, &i.Email, &i.Role, &i.InvitedBy, &i.TokenHash, &i.CreatedAt, &i.ExpiresAt)
+	return i, translate(err)
+}
+
+func (r teamRepo) CreateInvite(ctx context.Context, i TeamInvite) error {
+	tx, err := r.s.writer("").BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`DELETE FROM team_invites
+		WHERE team_id = ? AND (LOWER(email) = LOWER(?) OR expires_at <= ?)`),
+		i.TeamID, i.Email, i.CreatedAt.UTC()); err != nil {
+		return translate(err)
+	}
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`INSERT INTO team_invites
+		(id, team_id, email, role, invited_by, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		i.ID, i.TeamID, i.Email, i.Role, i.InvitedBy, i.TokenHash, i.CreatedAt.UTC(), i.ExpiresAt.UTC()); err != nil {
+		return translate(err)
+	}
+	return tx.Commit()
+}
+
+func (r teamRepo) Invites(ctx context.Context, teamID string, at time.Time) ([]TeamInvite, error) {
+	rows, err := r.s.writer("").QueryContext(ctx,
+		r.s.rebind(selectTeamInvite+` WHERE team_id = ? AND expires_at > ? ORDER BY created_at`), teamID, at.UTC())
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	invites := []TeamInvite{}
+	for rows.Next() {
+		i, err := scanTeamInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+func (r teamRepo) InviteByToken(ctx context.Context, tokenHash string, at time.Time) (TeamInvite, error) {
+	return scanTeamInvite(r.s.writer("").QueryRowContext(ctx,
+		r.s.rebind(selectTeamInvite+` WHERE token_hash = ? AND expires_at > ?`), tokenHash, at.UTC()))
+}
+
+func (r teamRepo) DeleteInvite(ctx context.Context, teamID, id string) error {
+	return r.s.exec(ctx, "", `DELETE FROM team_invites WHERE id = ? AND team_id = ?`, id, teamID)
+}
+
+// Collections
+
+type collectionRepo struct{ s *SQL }
+
+// selectCollection counts projects with a subquery so trashed ones are left
+// out.
+const selectCollection = `SELECT CAST(c.id AS TEXT), CAST(c.user_id AS TEXT), COALESCE(CAST(c.team_id AS TEXT), ''),
+	c.name, c.description, c.created_at,
+	(SELECT COUNT(*) FROM collection_projects cp JOIN projects p ON p.id = cp.project_id
+		WHERE cp.collection_id = c.id AND p.deleted_at IS NULL)
+	FROM collections c`
+
+func scanCollection(row interface{ Scan(...interface{}) error }) (Collection, error) {
+	var c Collection
+	err := row.Scan(&c.ID, &c.UserID, &c.TeamID, &c.Name, &c.Description, &c.CreatedAt, &c.ProjectCount)
+	return c, translate(err)
+}
+
+func (r collectionRepo) Create(ctx context.Context, c Collection) error {
+	_, err := r.s.writer(c.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO collections
+		(id, user_id, team_id, name, description, created_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		c.ID, c.UserID, nullIfEmpty(c.TeamID), c.Name, c.Description, c.CreatedAt.UTC())
+	return translate(err)
+}
+
+func (r collectionRepo) Get(ctx context.Context, userID, id string) (Collection, error) {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return scanCollection(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectCollection+` WHERE c.id = ?`+clause), args...))
+}
+
+func (r collectionRepo) List(ctx context.Context, userID string) ([]Collection, error) {
+	clause, args := scopeClause(ctx, userID, nil)
+	rows, err := r.s.reader(userID).QueryContext(ctx,
+		r.s.rebind(selectCollection+` WHERE 1 = 1`+clause+` ORDER BY c.name`), args...)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	collections := []Collection{}
+	for rows.Next() {
+		c, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, c)
+	}
+	return collections, rows.Err()
+}
+
+func (r collectionRepo) Update(ctx context.Context, userID string, c Collection) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{c.Name, c.Description, c.ID})
+	return r.s.exec(ctx, userID, `UPDATE collections SET name = ?, description = ? WHERE id = ?`+clause, args...)
+}
+
+func (r collectionRepo) Delete(ctx context.Context, userID, id string) error {
+	clause, args := scopeClause(ctx, userID, []interface{}{id})
+	return r.s.exec(ctx, userID, `DELETE FROM collections WHERE id = ?`+clause, args...)
+}
+
+func (r collectionRepo) Projects(ctx context.Context, id string) ([]Project, error) {
+	return projectRepo(r).query(ctx, r.s.writer(""), selectProject+` WHERE deleted_at IS NULL AND id IN
+		(SELECT project_id FROM collection_projects WHERE collection_id = ?)
+		ORDER BY (SELECT added_at FROM collection_projects WHERE collection_id = ? AND project_id = projects.id) DESC`, id, id)
+}
+
+func (r collectionRepo) AddProject(ctx context.Context, id, projectID string, at time.Time) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO collection_projects (collection_id, project_id, added_at)
+		VALUES (?, ?, ?)`), id, projectID, at.UTC())
+	return translate(err)
+}
+
+func (r collectionRepo) RemoveProject(ctx context.Context, id, projectID string) error {
+	return r.s.exec(ctx, "", `DELETE FROM collection_projects WHERE collection_id = ? AND project_id = ?`, id, projectID)
+}
+
+// Project shares
+
+// Shares are read from the primary so a revoked link stops working at once.
+type projectShareRepo struct{ s *SQL }
+
+const selectProjectShare = `SELECT CAST(id AS TEXT), CAST(project_id AS TEXT), CAST(user_id AS TEXT),
+	COALESCE(CAST(team_id AS TEXT), ''), token_hash, COALESCE(password_hash, ''), created_at, expires_at,
+	revoked_at, access_count, last_accessed_at FROM project_shares`
+
+func scanProjectShare(row interface{ Scan(...interface{}) error }) (ProjectShare, error) {
+	var sh ProjectShare
+	var expiresAt, revokedAt, lastAccessedAt sql.NullTime
+	err := row.Scan(&sh.ID, &sh.ProjectID, &sh.UserID, &sh.TeamID, &sh.TokenHash, &sh.PasswordHash, &sh.CreatedAt,
+		&expiresAt, &revokedAt, &sh.AccessCount, &lastAccessedAt)
+	if expiresAt.Valid {
+		sh.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		sh.RevokedAt = &revokedAt.Time
+	}
+	if lastAccessedAt.Valid {
+		sh.LastAccessedAt = &lastAccessedAt.Time
+	}
+	return sh, translate(err)
+}
+
+func (r projectShareRepo) Create(ctx context.Context, sh ProjectShare) error {
+	var expiresAt interface{}
+	if sh.ExpiresAt != nil {
+		expiresAt = sh.ExpiresAt.UTC()
+	}
+	_, err := r.s.writer(sh.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO project_shares
+		(id, project_id, user_id, team_id, token_hash, password_hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		sh.ID, sh.ProjectID, sh.UserID, nullIfEmpty(sh.TeamID), sh.TokenHash, nullIfEmpty(sh.PasswordHash),
+		sh.CreatedAt.UTC(), expiresAt)
+	return translate(err)
+}
+
+func (r projectShareRepo) GetByHash(ctx context.Context, hash string) (ProjectShare, error) {
+	return scanProjectShare(r.s.writer("").QueryRowContext(ctx,
+		r.s.rebind(selectProjectShare+` WHERE token_hash = ?`), hash))
+}
+
+func (r projectShareRepo) List(ctx context.Context, projectID string) ([]ProjectShare, error) {
+	rows, err := r.s.writer("").QueryContext(ctx,
+		r.s.rebind(selectProjectShare+` WHERE project_id = ? ORDER BY created_at DESC`), projectID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	shares := []ProjectShare{}
+	for rows.Next() {
+		sh, err := scanProjectShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, sh)
+	}
+	return shares, rows.Err()
+}
+
+func (r projectShareRepo) Revoke(ctx context.Context, projectID, id string, at time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE project_shares SET revoked_at = ? WHERE id = ? AND project_id = ? AND revoked_at IS NULL`,
+		at.UTC(), id, projectID)
+}
+
+func (r projectShareRepo) RecordAccess(ctx context.Context, id string, at time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE project_shares SET access_count = access_count + 1, last_accessed_at = ? WHERE id = ?`,
+		at.UTC(), id)
+}
+
+// Refresh tokens
+
+// Refresh tokens are read from the primary: a replica that hasn't seen a
+// rotation yet would accept the old token.
+type refreshTokenRepo struct{ s *SQL }
+
+const refreshTokenColumns = `id, user_id, session_id, token_hash, created_at, expires_at`
+
+const selectRefreshToken = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), COALESCE(CAST(session_id AS TEXT), ''),
+	token_hash, created_at, expires_at, revoked_at, COALESCE(CAST(replaced_by AS TEXT), '') FROM refresh_tokens`
+
+func scanRefreshToken(row interface{ Scan(...interface{}) error }) (RefreshToken, error) {
+	var t RefreshToken
+	var revokedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.SessionID, &t.TokenHash, &t.CreatedAt, &t.ExpiresAt, &revokedAt, &t.ReplacedBy)
+	if revokedAt.Valid {
+		t.RevokedAt = &revokedAt.Time
+	}
+	return t, translate(err)
+}
+
+const insertRefreshToken = `INSERT INTO refresh_tokens (` + refreshTokenColumns + `) VALUES (?, ?, ?, ?, ?, ?)`
+
+func refreshTokenArgs(t RefreshToken) []interface{} {
+	return []interface{}{t.ID, t.UserID, nullIfEmpty(t.SessionID), t.TokenHash, t.CreatedAt.UTC(), t.ExpiresAt.UTC()}
+}
+
+func (r refreshTokenRepo) Create(ctx context.Context, t RefreshToken) error {
+	_, err := r.s.writer(t.UserID).ExecContext(ctx, r.s.rebind(insertRefreshToken), refreshTokenArgs(t)...)
+	return translate(err)
+}
+
+func (r refreshTokenRepo) GetByHash(ctx context.Context, hash string) (RefreshToken, error) {
+	return scanRefreshToken(r.s.writer("").QueryRowContext(ctx,
+		r.s.rebind(selectRefreshToken+` WHERE token_hash = ?`), hash))
+}
+
+func (r refreshTokenRepo) Rotate(ctx context.Context, oldID string, next RefreshToken) error {
+	tx, err := r.s.writer(next.UserID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE refresh_tokens SET revoked_at = ?, replaced_by = ?
+		WHERE id = ? AND revoked_at IS NULL`), time.Now().UTC(), next.ID, oldID)
+	if err != nil {
+		return translate(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, r.s.rebind(insertRefreshToken), refreshTokenArgs(next)...); err != nil {
+		return translate(err)
+	}
+	if next.SessionID != "" {
+		if _, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE sessions SET expires_at = ?, last_used_at = ? WHERE id = ?`),
+			next.ExpiresAt.UTC(), next.CreatedAt.UTC(), next.SessionID); err != nil {
+			return translate(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r refreshTokenRepo) Revoke(ctx context.Context, id string) error {
+	return r.s.exec(ctx, "", `UPDATE refresh_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), id)
+}
+
+func (r refreshTokenRepo) RevokeUser(ctx context.Context, userID string) error {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, table := range []string{"refresh_tokens", "sessions"} {
+		if _, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE `+table+` SET revoked_at = ?
+			WHERE user_id = ? AND revoked_at IS NULL`), now, userID); err != nil {
+			return translate(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r refreshTokenRepo) DeleteExpired(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := r.s.writer("").ExecContext(ctx,
+		r.s.rebind(`DELETE FROM refresh_tokens WHERE expires_at < ?`), cutoff.UTC())
+	if err != nil {
+		return 0, translate(err)
+	}
+	return res.RowsAffected()
+}
+
+// Sessions
+
+// Sessions are read from the primary, like refresh tokens, so one revoked
+// is never seen as active.
+type sessionRepo struct{ s *SQL }
+
+const selectSession = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), user_agent, ip_address,
+	created_at, last_used_at, expires_at, revoked_at FROM sessions`
+
+func scanSession(row interface{ Scan(...interface{}) error }) (Session, error) {
+	var s Session
+	var revokedAt sql.NullTime
+	err := row.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &revokedAt)
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return s, translate(err)
+}
+
+func (r sessionRepo) Create(ctx context.Context, s Session) error {
+	_, err := r.s.writer(s.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO sessions
+		(id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		s.ID, s.UserID, s.UserAgent, s.IPAddress, s.CreatedAt.UTC(), s.LastUsedAt.UTC(), s.ExpiresAt.UTC())
+	return translate(err)
+}
+
+func (r sessionRepo) Get(ctx context.Context, id string) (Session, error) {
+	return scanSession(r.s.writer("").QueryRowContext(ctx, r.s.rebind(selectSession+` WHERE id = ?`), id))
+}
+
+func (r sessionRepo) ListActive(ctx context.Context, userID string, now time.Time) ([]Session, error) {
+	rows, err := r.s.writer(userID).QueryContext(ctx, r.s.rebind(selectSession+`
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC`), userID, now.UTC())
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, translate(rows.Err())
+}
+
+func (r sessionRepo) Touch(ctx context.Context, id, ip string, at time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE sessions SET last_used_at = ?, ip_address = ? WHERE id = ? AND revoked_at IS NULL`,
+		at.UTC(), ip, id)
+}
+
+func (r sessionRepo) Revoke(ctx context.Context, userID, id string) error {
+	n, err := r.revoke(ctx, userID, `id = ?`, id)
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r sessionRepo) RevokeOthers(ctx context.Context, userID, keepID string) (int64, error) {
+	return r.revoke(ctx, userID, `id <> ?`, keepID)
+}
+
+// revoke ends the user's active sessions matching where, and their refresh
+// tokens, in one transaction.
+func (r sessionRepo) revoke(ctx context.Context, userID, where string, arg interface{}) (int64, error) {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE refresh_tokens SET revoked_at = ?
+		WHERE revoked_at IS NULL AND session_id IN
+			(SELECT id FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND `+where+`)`),
+		now, userID, arg); err != nil {
+		return 0, translate(err)
+	}
+	res, err := tx.ExecContext(ctx, r.s.rebind(`UPDATE sessions SET revoked_at = ?
+		WHERE user_id = ? AND revoked_at IS NULL AND `+where), now, userID, arg)
+	if err != nil {
+		return 0, translate(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (r sessionRepo) DeleteEnded(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := r.s.writer("").ExecContext(ctx,
+		r.s.rebind(`DELETE FROM sessions WHERE expires_at < ? OR revoked_at < ?`), cutoff.UTC(), cutoff.UTC())
+	if err != nil {
+		return 0, translate(err)
+	}
+	return res.RowsAffected()
+}
+
+// Uploads
+
+// Uploads are read from the primary, so a part appended by one request is
+// seen by the next.
+type uploadRepo struct{ s *SQL }
+
+const selectUpload = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), COALESCE(CAST(team_id AS TEXT), ''), name,
+	length_bytes, offset_bytes, key_version, CAST(parts AS TEXT), created_at, expires_at FROM uploads`
+
+func scanUpload(row interface{ Scan(...interface{}) error }) (Upload, error) {
+	var u Upload
+	var parts string
+	if err := row.Scan(&u.ID, &u.UserID, &u.TeamID, &u.Name, &u.Length, &u.Offset, &u.KeyVersion, &parts,
+		&u.CreatedAt, &u.ExpiresAt); err != nil {
+		return u, translate(err)
+	}
+	u.Parts = []UploadPart{}
+	json.Unmarshal([]byte(parts), &u.Parts)
+	return u, nil
+}
+
+func encodeUploadParts(parts []UploadPart) string {
+	if parts == nil {
+		parts = []UploadPart{}
+	}
+	data, _ := json.Marshal(parts)
+	return string(data)
+}
+
+func (r uploadRepo) Create(ctx context.Context, u Upload) error {
+	_, err := r.s.writer(u.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO uploads
+		(id, user_id, team_id, name, length_bytes, offset_bytes, key_version, parts, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		u.ID, u.UserID, nullIfEmpty(u.TeamID), u.Name, u.Length, u.Offset, u.KeyVersion, encodeUploadParts(u.Parts),
+		u.CreatedAt.UTC(), u.ExpiresAt.UTC())
+	return translate(err)
+}
+
+func (r uploadRepo) Get(ctx context.Context, userID, id string) (Upload, error) {
+	return scanUpload(r.s.writer(userID).QueryRowContext(ctx,
+		r.s.rebind(selectUpload+` WHERE id = ? AND user_id = ?`), id, userID))
+}
+
+func (r uploadRepo) List(ctx context.Context, userID string) ([]Upload, error) {
+	return r.list(ctx, userID, ` WHERE user_id = ? ORDER BY created_at`, userID)
+}
+
+func (r uploadRepo) Append(ctx context.Context, u Upload, from int64) error {
+	err := r.s.exec(ctx, u.UserID, `UPDATE uploads SET offset_bytes = ?, parts = ?
+		WHERE id = ? AND user_id = ? AND offset_bytes = ?`,
+		u.Offset, encodeUploadParts(u.Parts), u.ID, u.UserID, from)
+	if errors.Is(err, ErrNotFound) {
+		return ErrStale
+	}
+	return err
+}
+
+func (r uploadRepo) Delete(ctx context.Context, userID, id string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM uploads WHERE id = ? AND user_id = ?`, id, userID)
+}
+
+func (r uploadRepo) ListExpired(ctx context.Context, cutoff time.Time) ([]Upload, error) {
+	return r.list(ctx, "", ` WHERE expires_at < ? ORDER BY expires_at`, cutoff.UTC())
+}
+
+func (r uploadRepo) list(ctx context.Context, key, where string, args ...interface{}) ([]Upload, error) {
+	rows, err := r.s.writer(key).QueryContext(ctx, r.s.rebind(selectUpload+where), args...)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	uploads := []Upload{}
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, translate(rows.Err())
+}
+
+// Retention policies
+
+type retentionRepo struct{ s *SQL }
+
+const selectRetentionPolicy = `SELECT CAST(user_id AS TEXT), keep_versions, max_age_days, CAST(sources AS TEXT), updated_at
+	FROM retention_policies`
+
+func scanRetentionPolicy(row interface{ Scan(...interface{}) error }) (RetentionPolicy, error) {
+	var p RetentionPolicy
+	var sources string
+	if err := row.Scan(&p.UserID, &p.KeepVersions, &p.MaxAgeDays, &sources, &p.UpdatedAt); err != nil {
+		return p, translate(err)
+	}
+	p.Sources = map[string]RetentionRule{}
+	json.Unmarshal([]byte(sources), &p.Sources)
+	return p, nil
+}
+
+func (r retentionRepo) Get(ctx context.Context, userID string) (RetentionPolicy, error) {
+	return scanRetentionPolicy(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectRetentionPolicy+` WHERE user_id = ?`), userID))
+}
+
+func (r retentionRepo) Put(ctx context.Context, p RetentionPolicy) error {
+	if p.Sources == nil {
+		p.Sources = map[string]RetentionRule{}
+	}
+	sources, _ := json.Marshal(p.Sources)
+	_, err := r.s.writer(p.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO retention_policies
+		(user_id, keep_versions, max_age_days, sources, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET keep_versions = excluded.keep_versions,
+			max_age_days = excluded.max_age_days, sources = excluded.sources, updated_at = excluded.updated_at`),
+		p.UserID, p.KeepVersions, p.MaxAgeDays, string(sources), p.UpdatedAt.UTC())
+	return translate(err)
+}
+
+func (r retentionRepo) Delete(ctx context.Context, userID string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM retention_policies WHERE user_id = ?`, userID)
+}
+
+func (r retentionRepo) List(ctx context.Context) ([]RetentionPolicy, error) {
+	rows, err := r.s.writer("").QueryContext(ctx, selectRetentionPolicy+` ORDER BY user_id`)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	policies := []RetentionPolicy{}
+	for rows.Next() {
+		p, err := scanRetentionPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, translate(rows.Err())
+}
+
+// Keyrings
+
+type keyringRepo struct{ s *SQL }
+
+func (r keyringRepo) Get(ctx context.Context, userID string) (Keyring, error) {
+	k := Keyring{UserID: userID}
+	var salt, byPassword, byRecovery string
+	var recoveryCreatedAt sql.NullTime
+	err := r.s.writer(userID).QueryRowContext(ctx, r.s.rebind(`SELECT password_salt, wrapped_by_password,
+		wrapped_by_recovery, recovery_created_at FROM user_keyrings WHERE user_id = ?`), userID).
+		Scan(&salt, &byPassword, &byRecovery, &recoveryCreatedAt)
+	if err != nil {
+		return Keyring{}, translate(err)
+	}
+	if k.PasswordSalt, err = base64.StdEncoding.DecodeString(salt); err != nil {
+		return Keyring{}, err
+	}
+	if k.WrappedByPassword, err = base64.StdEncoding.DecodeString(byPassword); err != nil {
+		return Keyring{}, err
+	}
+	if byRecovery != "" {
+		if k.WrappedByRecovery, err = base64.StdEncoding.DecodeString(byRecovery); err != nil {
+			return Keyring{}, err
+		}
+	}
+	if recoveryCreatedAt.Valid {
+		k.RecoveryCreatedAt = &recoveryCreatedAt.Time
+	}
+	return k, nil
+}
+
+func (r keyringRepo) Put(ctx context.Context, k Keyring) error {
+	var recoveryCreatedAt interface{}
+	if k.RecoveryCreatedAt != nil {
+		recoveryCreatedAt = k.RecoveryCreatedAt.UTC()
+	}
+	_, err := r.s.writer(k.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO user_keyrings
+		(user_id, password_salt, wrapped_by_password, wrapped_by_recovery, recovery_created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET password_salt = excluded.password_salt,
+			wrapped_by_password = excluded.wrapped_by_password, wrapped_by_recovery = excluded.wrapped_by_recovery,
+			recovery_created_at = excluded.recovery_created_at`),
+		k.UserID, base64.StdEncoding.EncodeToString(k.PasswordSalt), base64.StdEncoding.EncodeToString(k.WrappedByPassword),
+		base64.StdEncoding.EncodeToString(k.WrappedByRecovery), recoveryCreatedAt)
+	return translate(err)
+}
+
+func (r keyringRepo) Delete(ctx context.Context, userID string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM user_keyrings WHERE user_id = ?`, userID)
+}
+
+// Two-factor authentication
+
+type twoFactorRepo struct{ s *SQL }
+
+func (r twoFactorRepo) Get(ctx context.Context, userID string) (TwoFactor, error) {
+	t := TwoFactor{UserID: userID}
+	var enabledAt sql.NullTime
+	err := r.s.writer(userID).QueryRowContext(ctx, r.s.rebind(`SELECT secret, enabled, last_step, created_at, enabled_at
+		FROM two_factor WHERE user_id = ?`), userID).
+		Scan(&t.Secret, &t.Enabled, &t.LastStep, &t.CreatedAt, &enabledAt)
+	if err != nil {
+		return TwoFactor{}, translate(err)
+	}
+	if enabledAt.Valid {
+		t.EnabledAt = &enabledAt.Time
+	}
+	return t, nil
+}
+
+func (r twoFactorRepo) Put(ctx context.Context, t TwoFactor) error {
+	var enabledAt interface{}
+	if t.EnabledAt != nil {
+		enabledAt = t.EnabledAt.UTC()
+	}
+	_, err := r.s.writer(t.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO two_factor
+		(user_id, secret, enabled, last_step, created_at, enabled_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, enabled = excluded.enabled,
+			last_step = excluded.last_step, created_at = excluded.created_at, enabled_at = excluded.enabled_at`),
+		t.UserID, t.Secret, t.Enabled, t.LastStep, t.CreatedAt.UTC(), enabledAt)
+	return translate(err)
+}
+
+func (r twoFactorRepo) Enable(ctx context.Context, userID string, step int64, at time.Time) error {
+	return r.s.exec(ctx, userID, `UPDATE two_factor SET enabled = ?, enabled_at = ?, last_step = ?
+		WHERE user_id = ? AND enabled = ?`, true, at.UTC(), step, userID, false)
+}
+
+func (r twoFactorRepo) UseStep(ctx context.Context, userID string, step int64) error {
+	return r.s.exec(ctx, userID, `UPDATE two_factor SET last_step = ?
+		WHERE user_id = ? AND enabled = ? AND last_step < ?`, step, userID, true, step)
+}
+
+func (r twoFactorRepo) Delete(ctx context.Context, userID string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM two_factor WHERE user_id = ?`, userID)
+}
+
+// Recovery codes
+
+type recoveryCodeRepo struct{ s *SQL }
+
+func (r recoveryCodeRepo) Replace(ctx context.Context, userID string, hashes []string, at time.Time) error {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`DELETE FROM recovery_codes WHERE user_id = ?`), userID); err != nil {
+		return translate(err)
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, r.s.rebind(`INSERT INTO recovery_codes (user_id, code_hash, created_at)
+			VALUES (?, ?, ?)`), userID, hash, at.UTC()); err != nil {
+			return translate(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r recoveryCodeRepo) Use(ctx context.Context, userID, hash string, at time.Time) error {
+	return r.s.exec(ctx, userID, `UPDATE recovery_codes SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`, at.UTC(), userID, hash)
+}
+
+func (r recoveryCodeRepo) Get(ctx context.Context, userID string) (RecoveryCodes, error) {
+	rows, err := r.s.writer(userID).QueryContext(ctx, r.s.rebind(`SELECT created_at, used_at
+		FROM recovery_codes WHERE user_id = ?`), userID)
+	if err != nil {
+		return RecoveryCodes{}, translate(err)
+	}
+	defer rows.Close()
+
+	var c RecoveryCodes
+	for rows.Next() {
+		var usedAt sql.NullTime
+		if err := rows.Scan(&c.GeneratedAt, &usedAt); err != nil {
+			return RecoveryCodes{}, err
+		}
+		c.Total++
+		if !usedAt.Valid {
+			c.Remaining++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return RecoveryCodes{}, err
+	}
+	if c.Total == 0 {
+		return RecoveryCodes{}, ErrNotFound
+	}
+	return c, nil
+}
+
+func (r recoveryCodeRepo) Delete(ctx context.Context, userID string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+}
+
+// Legal holds
+
+type legalHoldRepo struct{ s *SQL }
+
+const selectLegalHold = `SELECT CAST(id AS TEXT), reason, CAST(backup_ids AS TEXT), CAST(user_ids AS TEXT),
+	placed_by, placed_at, released_by, released_at FROM legal_holds`
+
+func scanLegalHold(row interface{ Scan(...interface{}) error }) (LegalHold, error) {
+	var h LegalHold
+	var backupIDs, userIDs string
+	var releasedAt sql.NullTime
+	if err := row.Scan(&h.ID, &h.Reason, &backupIDs, &userIDs, &h.PlacedBy, &h.PlacedAt, &h.ReleasedBy, &releasedAt); err != nil {
+		return h, translate(err)
+	}
+	h.BackupIDs, h.UserIDs = decodeList(backupIDs), decodeList(userIDs)
+	if releasedAt.Valid {
+		h.ReleasedAt = &releasedAt.Time
+	}
+	return h, nil
+}
+
+func (r legalHoldRepo) Create(ctx context.Context, h LegalHold) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO legal_holds
+		(id, reason, backup_ids, user_ids, placed_by, placed_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		h.ID, h.Reason, encodeList(h.BackupIDs), encodeList(h.UserIDs), h.PlacedBy, h.PlacedAt.UTC())
+	return translate(err)
+}
+
+func (r legalHoldRepo) Get(ctx context.Context, id string) (LegalHold, error) {
+	return scanLegalHold(r.s.writer("").QueryRowContext(ctx, r.s.rebind(selectLegalHold+` WHERE id = ?`), id))
+}
+
+func (r legalHoldRepo) Release(ctx context.Context, id, releasedBy string, at time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE legal_holds SET released_by = ?, released_at = ?
+		WHERE id = ? AND released_at IS NULL`, releasedBy, at.UTC(), id)
+}
+
+func (r legalHoldRepo) List(ctx context.Context, includeReleased bool) ([]LegalHold, error) {
+	query := selectLegalHold
+	if !includeReleased {
+		query += ` WHERE released_at IS NULL`
+	}
+	// Holds are checked before anything is deleted, so they are read from
+	// the primary rather than a replica that may be behind
+	rows, err := r.s.writer("").QueryContext(ctx, query+` ORDER BY placed_at DESC`)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	holds := []LegalHold{}
+	for rows.Next() {
+		h, err := scanLegalHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	return holds, translate(rows.Err())
+}
+
+// API keys
+
+type apiKeyRepo struct{ s *SQL }
+
+// apiKeyTouchInterval is how stale last_used_at may get before Touch
+// writes it again.
+const apiKeyTouchInterval = time.Minute
+
+const selectAPIKey = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), name, prefix, key_hash, CAST(scopes AS TEXT),
+	rate_limit, expires_at, last_used_at, created_at, is_active FROM api_keys`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var k APIKey
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &scopes,
+		&k.RateLimit, &expiresAt, &lastUsedAt, &k.CreatedAt, &k.IsActive); err != nil {
+		return k, translate(err)
+	}
+	k.Scopes = decodeList(scopes)
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	return k, nil
+}
+
+func (r apiKeyRepo) Create(ctx context.Context, k APIKey) error {
+	var expiresAt interface{}
+	if k.ExpiresAt != nil {
+		expiresAt = k.ExpiresAt.UTC()
+	}
+	_, err := r.s.writer(k.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO api_keys
+		(id, user_id, name, prefix, key_hash, scopes, rate_limit, expires_at, created_at, is_active)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		k.ID, k.UserID, k.Name, k.Prefix, k.KeyHash, encodeList(k.Scopes), k.RateLimit, expiresAt, k.CreatedAt.UTC(), k.IsActive)
+	return translate(err)
+}
+
+func (r apiKeyRepo) Get(ctx context.Context, id string) (APIKey, error) {
+	return scanAPIKey(r.s.reader("").QueryRowContext(ctx, r.s.rebind(selectAPIKey+` WHERE id = ?`), id))
+}
+
+// GetByHash reads from the primary, so a key revoked a moment ago on a
+// replica that is behind still fails.
+func (r apiKeyRepo) GetByHash(ctx context.Context, hash string) (APIKey, error) {
+	return scanAPIKey(r.s.writer("").QueryRowContext(ctx, r.s.rebind(selectAPIKey+` WHERE key_hash = ?`), hash))
+}
+
+func (r apiKeyRepo) List(ctx context.Context, userID string) ([]APIKey, error) {
+	rows, err := r.s.reader(userID).QueryContext(ctx, r.s.rebind(selectAPIKey+` WHERE user_id = ? ORDER BY created_at DESC`), userID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, translate(rows.Err())
+}
+
+func (r apiKeyRepo) Touch(ctx context.Context, id string, at time.Time) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`UPDATE api_keys SET last_used_at = ?
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)`), at.UTC(), id, at.Add(-apiKeyTouchInterval).UTC())
+	return translate(err)
+}
+
+func (r apiKeyRepo) Revoke(ctx context.Context, userID, id string) error {
+	return r.s.exec(ctx, userID, `UPDATE api_keys SET is_active = ? WHERE id = ? AND user_id = ?`, false, id, userID)
+}
+
+func (r apiKeyRepo) RevokeUser(ctx context.Context, userID string) error {
+	_, err := r.s.writer(userID).ExecContext(ctx, r.s.rebind(`UPDATE api_keys SET is_active = ? WHERE user_id = ?`), false, userID)
+	return translate(err)
+}
+
+// Policies
+
+type policyRepo struct{ s *SQL }
+
+func (r policyRepo) Publish(ctx context.Context, d PolicyDocument) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO policy_documents
+		(type, version, title, url, content, require_acceptance, published_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		d.Type, d.Version, d.Title, d.URL, d.Content, d.RequireAcceptance, d.PublishedAt.UTC())
+	return translate(err)
+}
+
+func (r policyRepo) Documents(ctx context.Context) ([]PolicyDocument, error) {
+	rows, err := r.s.reader("").QueryContext(ctx, `SELECT type, version, title, url, content, require_acceptance, published_at
+		FROM policy_documents ORDER BY published_at, version`)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	docs := []PolicyDocument{}
+	for rows.Next() {
+		var d PolicyDocument
+		if err := rows.Scan(&d.Type, &d.Version, &d.Title, &d.URL, &d.Content, &d.RequireAcceptance, &d.PublishedAt); err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	return docs, translate(rows.Err())
+}
+
+func (r policyRepo) Accept(ctx context.Context, a PolicyAcceptance) error {
+	_, err := r.s.writer(a.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO policy_acceptances
+		(user_id, type, version, accepted_at, ip_address, user_agent) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, type, version) DO UPDATE SET accepted_at = excluded.accepted_at,
+			ip_address = excluded.ip_address, user_agent = excluded.user_agent`),
+		a.UserID, a.Type, a.Version, a.AcceptedAt.UTC(), a.IPAddress, a.UserAgent)
+	return translate(err)
+}
+
+func (r policyRepo) Acceptances(ctx context.Context, userID string) ([]PolicyAcceptance, error) {
+	rows, err := r.s.reader(userID).QueryContext(ctx, r.s.rebind(`SELECT type, version, accepted_at, ip_address, user_agent
+		FROM policy_acceptances WHERE user_id = ? ORDER BY accepted_at`), userID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	acceptances := []PolicyAcceptance{}
+	for rows.Next() {
+		a := PolicyAcceptance{UserID: userID}
+		if err := rows.Scan(&a.Type, &a.Version, &a.AcceptedAt, &a.IPAddress, &a.UserAgent); err != nil {
+			return nil, err
+		}
+		acceptances = append(acceptances, a)
+	}
+	return acceptances, translate(rows.Err())
+}
+
+// Webhooks
+
+type webhookRepo struct{ s *SQL }
+
+const selectWebhookEndpoint = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), url, CAST(events AS TEXT), CAST(secrets AS TEXT),
+	disabled, disabled_reason, consecutive_failures, failing_since, created_at FROM webhook_endpoints`
+
+func scanWebhookEndpoint(row interface{ Scan(...interface{}) error }) (WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	var events, secrets string
+	var failingSince sql.NullTime
+	if err := row.Scan(&e.ID, &e.UserID, &e.URL, &events, &secrets, &e.Disabled, &e.DisabledReason,
+		&e.ConsecutiveFailures, &failingSince, &e.CreatedAt); err != nil {
+		return e, translate(err)
+	}
+	e.Events = decodeList(events)
+	json.Unmarshal([]byte(secrets), &e.Secrets)
+	if failingSince.Valid {
+		e.FailingSince = &failingSince.Time
+	}
+	return e, nil
+}
+
+func encodeWebhookSecrets(secrets []WebhookSecret) string {
+	if secrets == nil {
+		secrets = []WebhookSecret{}
+	}
+	data, _ := json.Marshal(secrets)
+	return string(data)
+}
+
+func (r webhookRepo) CreateEndpoint(ctx context.Context, e WebhookEndpoint) error {
+	_, err := r.s.writer(e.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO webhook_endpoints
+		(id, user_id, url, events, secrets, created_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		e.ID, e.UserID, e.URL, encodeList(e.Events), encodeWebhookSecrets(e.Secrets), e.CreatedAt.UTC())
+	return translate(err)
+}
+
+func (r webhookRepo) GetEndpoint(ctx context.Context, userID, id string) (WebhookEndpoint, error) {
+	clause, args := ownerClause(userID, []interface{}{id})
+	return scanWebhookEndpoint(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectWebhookEndpoint+` WHERE id = ?`+clause), args...))
+}
+
+func (r webhookRepo) ListEndpoints(ctx context.Context, userID string) ([]WebhookEndpoint, error) {
+	rows, err := r.s.reader(userID).QueryContext(ctx,
+		r.s.rebind(selectWebhookEndpoint+` WHERE user_id = ? ORDER BY created_at`), userID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, translate(rows.Err())
+}
+
+func (r webhookRepo) UpdateEndpoint(ctx context.Context, e WebhookEndpoint) error {
+	return r.s.exec(ctx, e.UserID, `UPDATE webhook_endpoints SET url = ?, events = ? WHERE id = ? AND user_id = ?`,
+		e.URL, encodeList(e.Events), e.ID, e.UserID)
+}
+
+func (r webhookRepo) SetSecrets(ctx context.Context, userID, id string, secrets []WebhookSecret) error {
+	return r.s.exec(ctx, userID, `UPDATE webhook_endpoints SET secrets = ? WHERE id = ? AND user_id = ?`,
+		encodeWebhookSecrets(secrets), id, userID)
+}
+
+func (r webhookRepo) EnableEndpoint(ctx context.Context, userID, id string) error {
+	return r.s.exec(ctx, userID, `UPDATE webhook_endpoints SET disabled = ?, disabled_reason = '',
+		consecutive_failures = 0, failing_since = NULL WHERE id = ? AND user_id = ?`, false, id, userID)
+}
+
+func (r webhookRepo) DisableEndpoint(ctx context.Context, id, reason string) error {
+	return r.s.exec(ctx, "", `UPDATE webhook_endpoints SET disabled = ?, disabled_reason = ? WHERE id = ? AND disabled = ?`,
+		true, reason, id, false)
+}
+
+func (r webhookRepo) EndpointSucceeded(ctx context.Context, id string) error {
+	return r.s.exec(ctx, "", `UPDATE webhook_endpoints SET consecutive_failures = 0, failing_since = NULL WHERE id = ?`, id)
+}
+
+func (r webhookRepo) EndpointFailed(ctx context.Context, id string, at time.Time) (WebhookEndpoint, error) {
+	if err := r.s.exec(ctx, "", `UPDATE webhook_endpoints SET consecutive_failures = consecutive_failures + 1,
+		failing_since = COALESCE(failing_since, ?) WHERE id = ?`, at.UTC(), id); err != nil {
+		return WebhookEndpoint{}, err
+	}
+	return scanWebhookEndpoint(r.s.writer("").QueryRowContext(ctx, r.s.rebind(selectWebhookEndpoint+` WHERE id = ?`), id))
+}
+
+func (r webhookRepo) DeleteEndpoint(ctx context.Context, userID, id string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM webhook_endpoints WHERE id = ? AND user_id = ?`, id, userID)
+}
+
+// Deliveries are queue state, so like jobs they are read from the primary.
+
+const selectWebhookDelivery = `SELECT CAST(id AS TEXT), CAST(endpoint_id AS TEXT), CAST(user_id AS TEXT), event, CAST(payload AS TEXT),
+	status, attempts, response_status, last_error, next_attempt_at, created_at, delivered_at FROM webhook_deliveries`
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload string
+	var nextAttemptAt, deliveredAt sql.NullTime
+	if err := row.Scan(&d.ID, &d.EndpointID, &d.UserID, &d.Event, &payload, &d.Status, &d.Attempts,
+		&d.ResponseStatus, &d.LastError, &nextAttemptAt, &d.CreatedAt, &deliveredAt); err != nil {
+		return d, translate(err)
+	}
+	d.Payload = json.RawMessage(payload)
+	if nextAttemptAt.Valid {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return d, nil
+}
+
+func (r webhookRepo) queryDeliveries(ctx context.Context, query string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := r.s.writer("").QueryContext(ctx, r.s.rebind(query), args...)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, translate(rows.Err())
+}
+
+func (r webhookRepo) CreateDelivery(ctx context.Context, d WebhookDelivery) error {
+	var nextAttemptAt interface{}
+	if d.NextAttemptAt != nil {
+		nextAttemptAt = d.NextAttemptAt.UTC()
+	}
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO webhook_deliveries
+		(id, endpoint_id, user_id, event, payload, status, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		d.ID, d.EndpointID, d.UserID, d.Event, string(d.Payload), d.Status, nextAttemptAt, d.CreatedAt.UTC())
+	return translate(err)
+}
+
+func (r webhookRepo) GetDelivery(ctx context.Context, endpointID, id string) (WebhookDelivery, error) {
+	query, args := selectWebhookDelivery+` WHERE id = ?`, []interface{}{id}
+	if endpointID != "" {
+		query, args = query+` AND endpoint_id = ?`, append(args, endpointID)
+	}
+	return scanWebhookDelivery(r.s.writer("").QueryRowContext(ctx, r.s.rebind(query), args...))
+}
+
+func (r webhookRepo) ListDeliveries(ctx context.Context, endpointID string, limit int) ([]WebhookDelivery, error) {
+	return r.queryDeliveries(ctx, selectWebhookDelivery+` WHERE endpoint_id = ? ORDER BY created_at DESC LIMIT ?`, endpointID, limit)
+}
+
+func (r webhookRepo) ListDue(ctx context.Context, at time.Time, limit int) ([]WebhookDelivery, error) {
+	return r.queryDeliveries(ctx, selectWebhookDelivery+` WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY next_attempt_at LIMIT ?`, DeliveryPending, at.UTC(), limit)
+}
+
+func (r webhookRepo) Lease(ctx context.Context, id string, at, until time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE webhook_deliveries SET next_attempt_at = ?
+		WHERE id = ? AND status = ? AND next_attempt_at <= ?`, until.UTC(), id, DeliveryPending, at.UTC())
+}
+
+func (r webhookRepo) StartAttempt(ctx context.Context, id string, attempts int, until time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = ?
+		WHERE id = ? AND status = ? AND attempts = ?`, until.UTC(), id, DeliveryPending, attempts)
+}
+
+func (r webhookRepo) FinishAttempt(ctx context.Context, d WebhookDelivery) error {
+	var nextAttemptAt, deliveredAt interface{}
+	if d.NextAttemptAt != nil {
+		nextAttemptAt = d.NextAttemptAt.UTC()
+	}
+	if d.DeliveredAt != nil {
+		deliveredAt = d.DeliveredAt.UTC()
+	}
+	return r.s.exec(ctx, "", `UPDATE webhook_deliveries SET status = ?, response_status = ?, last_error = ?,
+		next_attempt_at = ?, delivered_at = ? WHERE id = ?`,
+		d.Status, d.ResponseStatus, d.LastError, nextAttemptAt, deliveredAt, d.ID)
+}
+
+func (r webhookRepo) PruneDeliveries(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := r.s.writer("").ExecContext(ctx,
+		r.s.rebind(`DELETE FROM webhook_deliveries WHERE status <> ? AND created_at < ?`), DeliveryPending, cutoff.UTC())
+	if err != nil {
+		return 0, translate(err)
+	}
+	return res.RowsAffected()
+}
+
+// Domain events
+
+type domainEventRepo struct{ s *SQL }
+
+// domainEventLock is the PostgreSQL advisory lock held while appending a
+// domain event. Without it an event could commit after one with a later
+// sequence, and a reader that had already moved past it would never see it.
+const domainEventLock = 727341
+
+func (r domainEventRepo) Append(ctx context.Context, e DomainEvent) (int64, error) {
+	actor, _ := json.Marshal(e.Actor)
+	var before, after interface{}
+	if len(e.Before) > 0 {
+		before = string(e.Before)
+	}
+	if len(e.After) > 0 {
+		after = string(e.After)
+	}
+
+	tx, err := r.s.writer("").BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if r.s.dialect == postgres {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, domainEventLock); err != nil {
+			return 0, err
+		}
+	}
+	var sequence int64
+	if err := tx.QueryRowContext(ctx, r.s.rebind(`INSERT INTO domain_events
+		(id, type, aggregate_type, aggregate_id, owner_id, actor, before_state, after_state, occurred_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING sequence`),
+		e.ID, e.Type, e.AggregateType, e.AggregateID, e.OwnerID, string(actor), before, after, e.OccurredAt.UTC()).
+		Scan(&sequence); err != nil {
+		return 0, translate(err)
+	}
+	return sequence, tx.Commit()
+}
+
+func (r domainEventRepo) List(ctx context.Context, f DomainEventFilter) ([]DomainEvent, error) {
+	query := `SELECT sequence, CAST(id AS TEXT), type, aggregate_type, aggregate_id, owner_id, CAST(actor AS TEXT),
+		CAST(before_state AS TEXT), CAST(after_state AS TEXT), occurred_at FROM domain_events WHERE sequence > ?`
+	args := []interface{}{f.After}
+	if f.AggregateType != "" {
+		query, args = query+` AND aggregate_type = ?`, append(args, f.AggregateType)
+	}
+	if f.AggregateID != "" {
+		query, args = query+` AND aggregate_id = ?`, append(args, f.AggregateID)
+	}
+	if f.OwnerID != "" {
+		query, args = query+` AND owner_id = ?`, append(args, f.OwnerID)
+	}
+	rows, err := r.s.reader("").QueryContext(ctx, r.s.rebind(query+` ORDER BY sequence LIMIT ?`), append(args, f.Limit)...)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	events := []DomainEvent{}
+	for rows.Next() {
+		var e DomainEvent
+		var actor string
+		var before, after sql.NullString
+		if err := rows.Scan(&e.Sequence, &e.ID, &e.Type, &e.AggregateType, &e.AggregateID, &e.OwnerID, &actor,
+			&before, &after, &e.OccurredAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(actor), &e.Actor)
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		events = append(events, e)
+	}
+	return events, translate(rows.Err())
+}
+
+// QR templates
+
+type qrTemplateRepo struct{ s *SQL }
+
+const selectQRTemplate = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), name, ec_level, size, format, CAST(style AS TEXT),
+	logo_id, logo_scale, created_at, updated_at FROM qr_templates`
+
+func scanQRTemplate(row interface{ Scan(...interface{}) error }) (QRTemplate, error) {
+	var t QRTemplate
+	var style string
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.ECLevel, &t.Size, &t.Format, &style,
+		&t.LogoID, &t.LogoScale, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return t, translate(err)
+	}
+	json.Unmarshal([]byte(style), &t.Style)
+	return t, nil
+}
+
+func (r qrTemplateRepo) Create(ctx context.Context, t QRTemplate) error {
+	style, _ := json.Marshal(t.Style)
+	_, err := r.s.writer(t.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO qr_templates
+		(id, user_id, name, ec_level, size, format, style, logo_id, logo_scale, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		t.ID, t.UserID, t.Name, t.ECLevel, t.Size, t.Format, string(style), t.LogoID, t.LogoScale,
+		t.CreatedAt.UTC(), t.UpdatedAt.UTC())
+	return translate(err)
+}
+
+func (r qrTemplateRepo) Get(ctx context.Context, userID, id string) (QRTemplate, error) {
+	return scanQRTemplate(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectQRTemplate+` WHERE id = ? AND user_id = ?`), id, userID))
+}
+
+func (r qrTemplateRepo) List(ctx context.Context, userID string) ([]QRTemplate, error) {
+	rows, err := r.s.reader(userID).QueryContext(ctx,
+		r.s.rebind(selectQRTemplate+` WHERE user_id = ? ORDER BY LOWER(name)`), userID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	templates := []QRTemplate{}
+	for rows.Next() {
+		t, err := scanQRTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, translate(rows.Err())
+}
+
+func (r qrTemplateRepo) Count(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := r.s.writer(userID).QueryRowContext(ctx,
+		r.s.rebind(`SELECT COUNT(*) FROM qr_templates WHERE user_id = ?`), userID).Scan(&n)
+	return n, translate(err)
+}
+
+func (r qrTemplateRepo) Update(ctx context.Context, t QRTemplate) error {
+	style, _ := json.Marshal(t.Style)
+	return r.s.exec(ctx, t.UserID, `UPDATE qr_templates SET name = ?, ec_level = ?, size = ?, format = ?, style = ?,
+		logo_id = ?, logo_scale = ?, updated_at = ? WHERE id = ? AND user_id = ?`,
+		t.Name, t.ECLevel, t.Size, t.Format, string(style), t.LogoID, t.LogoScale, t.UpdatedAt.UTC(), t.ID, t.UserID)
+}
+
+func (r qrTemplateRepo) Delete(ctx context.Context, userID, id string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM qr_templates WHERE id = ? AND user_id = ?`, id, userID)
+}
+
+// QR logos
+
+type qrLogoRepo struct{ s *SQL }
+
+const selectQRLogo = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), name, width, height, created_at FROM qr_logos`
+
+func scanQRLogo(row interface{ Scan(...interface{}) error }) (QRLogo, error) {
+	var l QRLogo
+	err := row.Scan(&l.ID, &l.UserID, &l.Name, &l.Width, &l.Height, &l.CreatedAt)
+	return l, translate(err)
+}
+
+func (r qrLogoRepo) Create(ctx context.Context, l QRLogo) error {
+	_, err := r.s.writer(l.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO qr_logos
+		(id, user_id, name, width, height, created_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		l.ID, l.UserID, l.Name, l.Width, l.Height, l.CreatedAt.UTC())
+	return translate(err)
+}
+
+func (r qrLogoRepo) Get(ctx context.Context, userID, id string) (QRLogo, error) {
+	return scanQRLogo(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectQRLogo+` WHERE id = ? AND user_id = ?`), id, userID))
+}
+
+func (r qrLogoRepo) List(ctx context.Context, userID string) ([]QRLogo, error) {
+	rows, err := r.s.reader(userID).QueryContext(ctx,
+		r.s.rebind(selectQRLogo+` WHERE user_id = ? ORDER BY created_at DESC`), userID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	logos := []QRLogo{}
+	for rows.Next() {
+		l, err := scanQRLogo(rows)
+		if err != nil {
+			return nil, err
+		}
+		logos = append(logos, l)
+	}
+	return logos, translate(rows.Err())
+}
+
+func (r qrLogoRepo) Delete(ctx context.Context, userID, id string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM qr_logos WHERE id = ? AND user_id = ?`, id, userID)
+}
+
+// Connectors
+
+type connectorRepo struct{ s *SQL }
+
+const selectConnector = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), type, name, url, username, secret,
+	interval_minutes, enabled, status, last_error, last_run_at, last_success_at, next_run_at,
+	files_fetched, backups_created, imports_queued, CAST(recent_runs AS TEXT), CAST(seen AS TEXT), created_at
+	FROM connectors`
+
+func scanConnector(row interface{ Scan(...interface{}) error }) (Connector, error) {
+	var c Connector
+	var lastRunAt, lastSuccessAt, nextRunAt sql.NullTime
+	var runs, seen string
+	if err := row.Scan(&c.ID, &c.UserID, &c.Type, &c.Name, &c.URL, &c.Username, &c.Secret,
+		&c.IntervalMinutes, &c.Enabled, &c.Status, &c.LastError, &lastRunAt, &lastSuccessAt, &nextRunAt,
+		&c.FilesFetched, &c.BackupsCreated, &c.ImportsQueued, &runs, &seen, &c.CreatedAt); err != nil {
+		return c, translate(err)
+	}
+	c.HasSecret = c.Secret != ""
+	if lastRunAt.Valid {
+		c.LastRunAt = &lastRunAt.Time
+	}
+	if lastSuccessAt.Valid {
+		c.LastSuccessAt = &lastSuccessAt.Time
+	}
+	if nextRunAt.Valid {
+		c.NextRunAt = &nextRunAt.Time
+	}
+	c.RecentRuns = []ConnectorRun{}
+	json.Unmarshal([]byte(runs), &c.RecentRuns)
+	c.Seen = map[string]ConnectorSeen{}
+	json.Unmarshal([]byte(seen), &c.Seen)
+	return c, nil
+}
+
+func encodeConnectorRuns(runs []ConnectorRun) string {
+	if runs == nil {
+		runs = []ConnectorRun{}
+	}
+	data, _ := json.Marshal(runs)
+	return string(data)
+}
+
+func encodeConnectorSeen(seen map[string]ConnectorSeen) string {
+	if seen == nil {
+		seen = map[string]ConnectorSeen{}
+	}
+	data, _ := json.Marshal(seen)
+	return string(data)
+}
+
+func (r connectorRepo) Create(ctx context.Context, c Connector) error {
+	_, err := r.s.writer(c.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO connectors
+		(id, user_id, type, name, url, username, secret, interval_minutes, enabled, status, next_run_at,
+		recent_runs, seen, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		c.ID, c.UserID, c.Type, c.Name, c.URL, c.Username, c.Secret, c.IntervalMinutes, c.Enabled, c.Status,
+		nullTime(c.NextRunAt), encodeConnectorRuns(c.RecentRuns), encodeConnectorSeen(c.Seen), c.CreatedAt.UTC())
+	return translate(err)
+}
+
+func (r connectorRepo) Get(ctx context.Context, userID, id string) (Connector, error) {
+	owner, args := ownerClause(userID, []interface{}{id})
+	return scanConnector(r.s.writer(userID).QueryRowContext(ctx,
+		r.s.rebind(selectConnector+` WHERE id = ?`+owner), args...))
+}
+
+func (r connectorRepo) query(ctx context.Context, key, query string, args ...interface{}) ([]Connector, error) {
+	rows, err := r.s.reader(key).QueryContext(ctx, r.s.rebind(query), args...)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	list := []Connector{}
+	for rows.Next() {
+		c, err := scanConnector(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, translate(rows.Err())
+}
+
+func (r connectorRepo) List(ctx context.Context, userID string) ([]Connector, error) {
+	return r.query(ctx, userID, selectConnector+` WHERE user_id = ? ORDER BY created_at`, userID)
+}
+
+func (r connectorRepo) Update(ctx context.Context, c Connector) error {
+	return r.s.exec(ctx, c.UserID, `UPDATE connectors SET name = ?, url = ?, username = ?, secret = ?,
+		interval_minutes = ?, enabled = ? WHERE id = ? AND user_id = ?`,
+		c.Name, c.URL, c.Username, c.Secret, c.IntervalMinutes, c.Enabled, c.ID, c.UserID)
+}
+
+func (r connectorRepo) Reschedule(ctx context.Context, userID, id string, next time.Time) error {
+	return r.s.exec(ctx, userID, `UPDATE connectors SET next_run_at = ? WHERE id = ? AND user_id = ? AND status <> ?`,
+		next.UTC(), id, userID, ConnectorRunning)
+}
+
+func (r connectorRepo) ListDue(ctx context.Context, at time.Time, limit int) ([]Connector, error) {
+	return r.query(ctx, "", selectConnector+` WHERE enabled = ? AND next_run_at <= ? ORDER BY next_run_at LIMIT ?`,
+		true, at.UTC(), limit)
+}
+
+func (r connectorRepo) Start(ctx context.Context, c Connector, at time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE connectors SET status = ?, recent_runs = ?, next_run_at = ?
+		WHERE id = ? AND (status <> ? OR next_run_at <= ?)`,
+		c.Status, encodeConnectorRuns(c.RecentRuns), nullTime(c.NextRunAt), c.ID, ConnectorRunning, at.UTC())
+}
+
+func (r connectorRepo) Finish(ctx context.Context, c Connector) error {
+	return r.s.exec(ctx, "", `UPDATE connectors SET status = ?, last_error = ?, last_run_at = ?, last_success_at = ?,
+		next_run_at = ?, files_fetched = ?, backups_created = ?, imports_queued = ?, recent_runs = ? WHERE id = ?`,
+		c.Status, c.LastError, nullTime(c.LastRunAt), nullTime(c.LastSuccessAt), nullTime(c.NextRunAt),
+		c.FilesFetched, c.BackupsCreated, c.ImportsQueued, encodeConnectorRuns(c.RecentRuns), c.ID)
+}
+
+func (r connectorRepo) SetSeen(ctx context.Context, id string, seen map[string]ConnectorSeen) error {
+	return r.s.exec(ctx, "", `UPDATE connectors SET seen = ? WHERE id = ?`, encodeConnectorSeen(seen), id)
+}
+
+func (r connectorRepo) Delete(ctx context.Context, userID, id string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM connectors WHERE id = ? AND user_id = ?`, id, userID)
+}
+
+// Email changes
+
+type emailChangeRepo struct{ s *SQL }
+
+const selectEmailChange = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), old_email, new_email, old_token_hash, new_token_hash,
+	old_confirmed_at, new_confirmed_at, created_at, expires_at FROM email_changes`
+
+func scanEmailChange(row interface{ Scan(...interface{}) error }) (EmailChange, error) {
+	var c EmailChange
+	var oldConfirmedAt, newConfirmedAt sql.NullTime
+	if err := row.Scan(&c.ID, &c.UserID, &c.OldEmail, &c.NewEmail, &c.OldTokenHash, &c.NewTokenHash,
+		&oldConfirmedAt, &newConfirmedAt, &c.CreatedAt, &c.ExpiresAt); err != nil {
+		return c, translate(err)
+	}
+	if oldConfirmedAt.Valid {
+		c.OldConfirmedAt = &oldConfirmedAt.Time
+	}
+	if newConfirmedAt.Valid {
+		c.NewConfirmedAt = &newConfirmedAt.Time
+	}
+	return c, nil
+}
+
+func (r emailChangeRepo) Start(ctx context.Context, c EmailChange) error {
+	tx, err := r.s.writer(c.UserID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`DELETE FROM email_changes WHERE user_id = ?`), c.UserID); err != nil {
+		return translate(err)
+	}
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`INSERT INTO email_changes
+		(id, user_id, old_email, new_email, old_token_hash, new_token_hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		c.ID, c.UserID, c.OldEmail, c.NewEmail, c.OldTokenHash, c.NewTokenHash, c.CreatedAt.UTC(), c.ExpiresAt.UTC()); err != nil {
+		return translate(err)
+	}
+	return tx.Commit()
+}
+
+func (r emailChangeRepo) Pending(ctx context.Context, userID string, at time.Time) (EmailChange, error) {
+	return scanEmailChange(r.s.reader(userID).QueryRowContext(ctx,
+		r.s.rebind(selectEmailChange+` WHERE user_id = ? AND expires_at > ?`), userID, at.UTC()))
+}
+
+func (r emailChangeRepo) ByToken(ctx context.Context, tokenHash string, at time.Time) (EmailChange, error) {
+	return scanEmailChange(r.s.writer("").QueryRowContext(ctx,
+		r.s.rebind(selectEmailChange+` WHERE (old_token_hash = ? OR new_token_hash = ?) AND expires_at > ?`),
+		tokenHash, tokenHash, at.UTC()))
+}
+
+func (r emailChangeRepo) Confirm(ctx context.Context, id string, old bool, at time.Time) error {
+	column := "new_confirmed_at"
+	if old {
+		column = "old_confirmed_at"
+	}
+	return r.s.exec(ctx, "", `UPDATE email_changes SET `+column+` = ? WHERE id = ?`, at.UTC(), id)
+}
+
+func (r emailChangeRepo) Delete(ctx context.Context, id string) error {
+	return r.s.exec(ctx, "", `DELETE FROM email_changes WHERE id = ?`, id)
+}
+
+func (r emailChangeRepo) Cancel(ctx context.Context, userID string) error {
+	return r.s.exec(ctx, userID, `DELETE FROM email_changes WHERE user_id = ?`, userID)
+}
+
+// Data exports
+
+type dataExportRepo struct{ s *SQL }
+
+const selectDataExport = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), status, error, archive_path,
+	requested_at, completed_at, expires_at FROM data_exports`
+
+func scanDataExport(row interface{ Scan(...interface{}) error }) (DataExport, error) {
+	var e DataExport
+	var completedAt, expiresAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.UserID, &e.Status, &e.Error, &e.ArchivePath,
+		&e.RequestedAt, &completedAt, &expiresAt); err != nil {
+		return e, translate(err)
+	}
+	if completedAt.Valid {
+		e.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		e.ExpiresAt = &expiresAt.Time
+	}
+	return e, nil
+}
+
+func (r dataExportRepo) Create(ctx context.Context, e DataExport) error {
+	_, err := r.s.writer(e.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO data_exports
+		(id, user_id, status, requested_at) VALUES (?, ?, ?, ?)`), e.ID, e.UserID, e.Status, e.RequestedAt.UTC())
+	return translate(err)
+}
+
+func (r dataExportRepo) Get(ctx context.Context, userID, id string) (DataExport, error) {
+	owner, args := ownerClause(userID, []interface{}{id})
+	return scanDataExport(r.s.writer(userID).QueryRowContext(ctx,
+		r.s.rebind(selectDataExport+` WHERE id = ?`+owner), args...))
+}
+
+func (r dataExportRepo) query(ctx context.Context, key, query string, args ...interface{}) ([]DataExport, error) {
+	rows, err := r.s.reader(key).QueryContext(ctx, r.s.rebind(query), args...)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	exports := []DataExport{}
+	for rows.Next() {
+		e, err := scanDataExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, translate(rows.Err())
+}
+
+func (r dataExportRepo) List(ctx context.Context, userID string) ([]DataExport, error) {
+	return r.query(ctx, userID, selectDataExport+` WHERE user_id = ? ORDER BY requested_at DESC`, userID)
+}
+
+func (r dataExportRepo) Update(ctx context.Context, e DataExport) error {
+	return r.s.exec(ctx, e.UserID, `UPDATE data_exports SET status = ?, error = ?, archive_path = ?,
+		completed_at = ?, expires_at = ? WHERE id = ?`,
+		e.Status, e.Error, e.ArchivePath, nullTime(e.CompletedAt), nullTime(e.ExpiresAt), e.ID)
+}
+
+func (r dataExportRepo) ListExpired(ctx context.Context, at time.Time, limit int) ([]DataExport, error) {
+	return r.query(ctx, "", selectDataExport+` WHERE expires_at <= ? ORDER BY expires_at LIMIT ?`, at.UTC(), limit)
+}
+
+func (r dataExportRepo) Delete(ctx context.Context, id string) error {
+	return r.s.exec(ctx, "", `DELETE FROM data_exports WHERE id = ?`, id)
+}
+
+// API key usage
+
+type apiKeyUsageRepo struct{ s *SQL }
+
+const selectAPIKeyUsage = `SELECT CAST(key_id AS TEXT), usage_date, requests, errors, rate_limited,
+	bytes_in, bytes_out FROM api_key_usage`
+
+func (r apiKeyUsageRepo) Add(ctx context.Context, u APIKeyUsageDay) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO api_key_usage
+		(key_id, usage_date, requests, errors, rate_limited, bytes_in, bytes_out) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key_id, usage_date) DO UPDATE SET requests = api_key_usage.requests + excluded.requests,
+		errors = api_key_usage.errors + excluded.errors,
+		rate_limited = api_key_usage.rate_limited + excluded.rate_limited,
+		bytes_in = api_key_usage.bytes_in + excluded.bytes_in,
+		bytes_out = api_key_usage.bytes_out + excluded.bytes_out`),
+		u.KeyID, u.Date, u.Requests, u.Errors, u.RateLimited, u.BytesIn, u.BytesOut)
+	return translate(err)
+}
+
+func (r apiKeyUsageRepo) query(ctx context.Context, query string, args ...interface{}) ([]APIKeyUsageDay, error) {
+	rows, err := r.s.reader("").QueryContext(ctx, r.s.rebind(query), args...)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	usage := []APIKeyUsageDay{}
+	for rows.Next() {
+		var u APIKeyUsageDay
+		if err := rows.Scan(&u.KeyID, &u.Date, &u.Requests, &u.Errors, &u.RateLimited,
+			&u.BytesIn, &u.BytesOut); err != nil {
+			return nil, translate(err)
+		}
+		usage = append(usage, u)
+	}
+	return usage, translate(rows.Err())
+}
+
+func (r apiKeyUsageRepo) Since(ctx context.Context, keyID, from string) ([]APIKeyUsageDay, error) {
+	return r.query(ctx, selectAPIKeyUsage+` WHERE key_id = ? AND usage_date >= ? ORDER BY usage_date`, keyID, from)
+}
+
+func (r apiKeyUsageRepo) OnDay(ctx context.Context, date string) ([]APIKeyUsageDay, error) {
+	return r.query(ctx, selectAPIKeyUsage+` WHERE usage_date = ?`, date)
+}
+
+func (r apiKeyUsageRepo) Prune(ctx context.Context, before string) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM api_key_usage WHERE usage_date < ?`), before)
+	return translate(err)
+}
+
+// Password resets
+
+type passwordResetRepo struct{ s *SQL }
+
+func (r passwordResetRepo) Start(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error {
+	_, err := r.s.writer(userID).ExecContext(ctx, r.s.rebind(`INSERT INTO password_resets (user_id, token_hash, expires_at)
+		VALUES (?, ?, ?) ON CONFLICT (user_id) DO UPDATE SET token_hash = excluded.token_hash,
+		expires_at = excluded.expires_at`), userID, tokenHash, expiresAt.UTC())
+	return translate(err)
+}
+
+func (r passwordResetRepo) Consume(ctx context.Context, tokenHash string, at time.Time) (string, error) {
+	var userID string
+	err := r.s.writer("").QueryRowContext(ctx, r.s.rebind(`SELECT CAST(user_id AS TEXT) FROM password_resets
+		WHERE token_hash = ? AND expires_at > ?`), tokenHash, at.UTC()).Scan(&userID)
+	if err != nil {
+		return "", translate(err)
+	}
+	// Whoever deletes the row consumes the reset
+	if err := r.s.exec(ctx, userID, `DELETE FROM password_resets WHERE token_hash = ?`, tokenHash); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func (r passwordResetRepo) Prune(ctx context.Context, at time.Time) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM password_resets WHERE expires_at <= ?`), at.UTC())
+	return translate(err)
+}
+
+// Blob replication
+
+type replicationRepo struct{ s *SQL }
+
+func (r replicationRepo) Add(ctx context.Context, c ReplicationChange) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO blob_replication
+		(blob_key, content_type, version, pending_since, changed_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (blob_key) DO UPDATE SET content_type = excluded.content_type, version = excluded.version,
+		changed_at = excluded.changed_at`),
+		c.Key, c.ContentType, c.Version, c.PendingSince.UTC(), c.ChangedAt.UTC())
+	return translate(err)
+}
+
+func (r replicationRepo) Done(ctx context.Context, key, version string) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM blob_replication WHERE blob_key = ? AND version = ?`),
+		key, version)
+	return translate(err)
+}
+
+func (r replicationRepo) Pending(ctx context.Context, before time.Time, limit int) ([]ReplicationChange, error) {
+	rows, err := r.s.writer("").QueryContext(ctx, r.s.rebind(`SELECT blob_key, content_type, version, pending_since, changed_at
+		FROM blob_replication WHERE changed_at <= ? ORDER BY pending_since LIMIT ?`), before.UTC(), limit)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	changes := []ReplicationChange{}
+	for rows.Next() {
+		var c ReplicationChange
+		if err := rows.Scan(&c.Key, &c.ContentType, &c.Version, &c.PendingSince, &c.ChangedAt); err != nil {
+			return nil, translate(err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, translate(rows.Err())
+}
+
+func (r replicationRepo) Backlog(ctx context.Context) (int, *time.Time, error) {
+	var count int
+	if err := r.s.writer("").QueryRowContext(ctx, `SELECT COUNT(*) FROM blob_replication`).Scan(&count); err != nil {
+		return 0, nil, translate(err)
+	}
+	if count == 0 {
+		return 0, nil, nil
+	}
+	// Not MIN(), which loses the column type on SQLite
+	var oldest time.Time
+	err := r.s.writer("").QueryRowContext(ctx,
+		`SELECT pending_since FROM blob_replication ORDER BY pending_since LIMIT 1`).Scan(&oldest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, translate(err)
+	}
+	return count, &oldest, nil
+}
+
+// Signed links
+
+type signedLinkRepo struct{ s *SQL }
+
+const selectSignedLink = `SELECT id, CAST(user_id AS TEXT), scope, resource_id, created_at, expires_at, revoked_at
+	FROM signed_links`
+
+func scanSignedLink(row interface{ Scan(...interface{}) error }) (SignedLink, error) {
+	var l SignedLink
+	var revokedAt sql.NullTime
+	if err := row.Scan(&l.ID, &l.UserID, &l.Scope, &l.ResourceID, &l.CreatedAt, &l.ExpiresAt, &revokedAt); err != nil {
+		return l, translate(err)
+	}
+	if revokedAt.Valid {
+		l.RevokedAt = &revokedAt.Time
+	}
+	return l, nil
+}
+
+func (r signedLinkRepo) Create(ctx context.Context, l SignedLink) error {
+	_, err := r.s.writer(l.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO signed_links
+		(id, user_id, scope, resource_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		l.ID, l.UserID, l.Scope, l.ResourceID, l.CreatedAt.UTC(), l.ExpiresAt.UTC())
+	return translate(err)
+}
+
+func (r signedLinkRepo) Get(ctx context.Context, id string) (SignedLink, error) {
+	return scanSignedLink(r.s.reader("").QueryRowContext(ctx, r.s.rebind(selectSignedLink+` WHERE id = ?`), id))
+}
+
+func (r signedLinkRepo) List(ctx context.Context, userID string, at time.Time) ([]SignedLink, error) {
+	rows, err := r.s.reader(userID).QueryContext(ctx,
+		r.s.rebind(selectSignedLink+` WHERE user_id = ? AND expires_at > ? ORDER BY created_at DESC`), userID, at.UTC())
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	links := []SignedLink{}
+	for rows.Next() {
+		l, err := scanSignedLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, translate(rows.Err())
+}
+
+func (r signedLinkRepo) Revoke(ctx context.Context, userID, id string, at time.Time) error {
+	return r.s.exec(ctx, userID, `UPDATE signed_links SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		at.UTC(), id, userID)
+}
+
+// IsRevoked reads from the primary, so a link stops working as soon as it
+// is revoked.
+func (r signedLinkRepo) IsRevoked(ctx context.Context, id string) (bool, error) {
+	var revoked bool
+	err := r.s.writer("").QueryRowContext(ctx, r.s.rebind(`SELECT revoked_at IS NOT NULL FROM signed_links WHERE id = ?`),
+		id).Scan(&revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return revoked, translate(err)
+}
+
+func (r signedLinkRepo) Prune(ctx context.Context, at time.Time) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM signed_links WHERE expires_at <= ?`), at.UTC())
+	return translate(err)
+}
+
+// Maintenance mode
+
+type maintenanceRepo struct{ s *SQL }
+
+// Get reads from the primary, so every server sees a change at once.
+func (r maintenanceRepo) Get(ctx context.Context) (Maintenance, error) {
+	var m Maintenance
+	var since sql.NullTime
+	err := r.s.writer("").QueryRowContext(ctx, `SELECT enabled, message, since FROM maintenance_mode WHERE id = 1`).
+		Scan(&m.Enabled, &m.Message, &since)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Maintenance{}, nil
+	}
+	if err != nil {
+		return m, translate(err)
+	}
+	if since.Valid {
+		m.Since = &since.Time
+	}
+	return m, nil
+}
+
+func (r maintenanceRepo) Set(ctx context.Context, m Maintenance) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO maintenance_mode (id, enabled, message, since)
+		VALUES (1, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET enabled = excluded.enabled, message = excluded.message,
+		since = excluded.since`), m.Enabled, m.Message, nullTime(m.Since))
+	return translate(err)
+}
+
+// Chat imports
+
+type chatImportRepo struct{ s *SQL }
+
+const selectChatImport = `SELECT CAST(id AS TEXT), CAST(user_id AS TEXT), COALESCE(CAST(team_id AS TEXT), ''), format,
+	status, error, conversations, imported, skipped, projects, CAST(actor AS TEXT), blob_key, key_version,
+	requested_at, completed_at FROM chat_imports`
+
+func scanChatImport(row interface{ Scan(...interface{}) error }) (ChatImport, error) {
+	var imp ChatImport
+	var actor string
+	var completedAt sql.NullTime
+	if err := row.Scan(&imp.ID, &imp.UserID, &imp.TeamID, &imp.Format, &imp.Status, &imp.Error, &imp.Conversations,
+		&imp.Imported, &imp.Skipped, &imp.Projects, &actor, &imp.BlobKey, &imp.KeyVersion, &imp.RequestedAt,
+		&completedAt); err != nil {
+		return imp, translate(err)
+	}
+	json.Unmarshal([]byte(actor), &imp.Actor)
+	if completedAt.Valid {
+		imp.CompletedAt = &completedAt.Time
+	}
+	return imp, nil
+}
+
+func (r chatImportRepo) Create(ctx context.Context, imp ChatImport) error {
+	actor, err := json.Marshal(imp.Actor)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.writer(imp.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO chat_imports
+		(id, user_id, team_id, format, status, actor, blob_key, key_version, requested_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		imp.ID, imp.UserID, nullIfEmpty(imp.TeamID), imp.Format, imp.Status, string(actor), imp.BlobKey,
+		imp.KeyVersion, imp.RequestedAt.UTC())
+	return translate(err)
+}
+
+// Get reads from the primary, as imports are followed while they run.
+func (r chatImportRepo) Get(ctx context.Context, userID, id string) (ChatImport, error) {
+	return scanChatImport(r.s.writer(userID).QueryRowContext(ctx,
+		r.s.rebind(selectChatImport+` WHERE id = ? AND user_id = ?`), id, userID))
+}
+
+func (r chatImportRepo) List(ctx context.Context, userID string) ([]ChatImport, error) {
+	rows, err := r.s.writer(userID).QueryContext(ctx,
+		r.s.rebind(selectChatImport+` WHERE user_id = ? ORDER BY requested_at DESC`), userID)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	imports := []ChatImport{}
+	for rows.Next() {
+		imp, err := scanChatImport(rows)
+		if err != nil {
+			return nil, err
+		}
+		imports = append(imports, imp)
+	}
+	return imports, translate(rows.Err())
+}
+
+func (r chatImportRepo) Update(ctx context.Context, imp ChatImport) error {
+	return r.s.exec(ctx, imp.UserID, `UPDATE chat_imports SET status = ?, error = ?, conversations = ?, imported = ?,
+		skipped = ?, projects = ?, blob_key = ?, completed_at = ? WHERE id = ? AND user_id = ?`,
+		imp.Status, imp.Error, imp.Conversations, imp.Imported, imp.Skipped, imp.Projects, imp.BlobKey,
+		nullTime(imp.CompletedAt), imp.ID, imp.UserID)
+}
+
+// Integrity runs
+
+type integrityRunRepo struct{ s *SQL }
+
+const selectIntegrityRun = `SELECT CAST(id AS TEXT), mode, status, COALESCE(scheduled_for, ''), checked, ok, corrupt,
+	skipped, CAST(failures AS TEXT), CAST(users AS TEXT), requested_at, started_at, completed_at FROM integrity_runs`
+
+func scanIntegrityRun(row interface{ Scan(...interface{}) error }) (IntegrityRun, error) {
+	var run IntegrityRun
+	var failures, users string
+	var startedAt, completedAt sql.NullTime
+	if err := row.Scan(&run.ID, &run.Mode, &run.Status, &run.ScheduledFor, &run.Checked, &run.OK, &run.Corrupt,
+		&run.Skipped, &failures, &users, &run.RequestedAt, &startedAt, &completedAt); err != nil {
+		return run, translate(err)
+	}
+	run.Failures = []IntegrityFailure{}
+	json.Unmarshal([]byte(failures), &run.Failures)
+	run.Users = map[string]IntegrityTally{}
+	json.Unmarshal([]byte(users), &run.Users)
+	if startedAt.Valid {
+		run.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		run.CompletedAt = &completedAt.Time
+	}
+	return run, nil
+}
+
+func encodeIntegrityRun(run IntegrityRun) (failures, users string) {
+	if run.Failures == nil {
+		run.Failures = []IntegrityFailure{}
+	}
+	if run.Users == nil {
+		run.Users = map[string]IntegrityTally{}
+	}
+	f, _ := json.Marshal(run.Failures)
+	u, _ := json.Marshal(run.Users)
+	return string(f), string(u)
+}
+
+func (r integrityRunRepo) Create(ctx context.Context, run IntegrityRun) error {
+	failures, users := encodeIntegrityRun(run)
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO integrity_runs
+		(id, mode, status, scheduled_for, failures, users, requested_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		run.ID, run.Mode, run.Status, nullIfEmpty(run.ScheduledFor), failures, users, run.RequestedAt.UTC())
+	return translate(err)
+}
+
+func (r integrityRunRepo) Get(ctx context.Context, id string) (IntegrityRun, error) {
+	return scanIntegrityRun(r.s.writer("").QueryRowContext(ctx, r.s.rebind(selectIntegrityRun+` WHERE id = ?`), id))
+}
+
+func (r integrityRunRepo) List(ctx context.Context, limit int) ([]IntegrityRun, error) {
+	rows, err := r.s.writer("").QueryContext(ctx,
+		r.s.rebind(selectIntegrityRun+` ORDER BY requested_at DESC LIMIT ?`), limit)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	runs := []IntegrityRun{}
+	for rows.Next() {
+		run, err := scanIntegrityRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, translate(rows.Err())
+}
+
+func (r integrityRunRepo) Start(ctx context.Context, id string, at, busySince time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE integrity_runs SET status = 'running', started_at = ?
+		WHERE id = ? AND status = 'queued' AND NOT EXISTS (
+			SELECT 1 FROM integrity_runs WHERE status = 'running' AND started_at > ?)`,
+		at.UTC(), id, busySince.UTC())
+}
+
+func (r integrityRunRepo) Update(ctx context.Context, run IntegrityRun) error {
+	failures, users := encodeIntegrityRun(run)
+	return r.s.exec(ctx, "", `UPDATE integrity_runs SET status = ?, checked = ?, ok = ?, corrupt = ?, skipped = ?,
+		failures = ?, users = ?, completed_at = ? WHERE id = ?`,
+		run.Status, run.Checked, run.OK, run.Corrupt, run.Skipped, failures, users, nullTime(run.CompletedAt), run.ID)
+}
+
+func (r integrityRunRepo) Prune(ctx context.Context, keep int) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM integrity_runs WHERE id NOT IN (
+		SELECT id FROM (SELECT id FROM integrity_runs ORDER BY requested_at DESC LIMIT ?) AS newest)`), keep)
+	return translate(err)
+}
+
+// Warehouse exports
+
+type warehouseExportRepo struct{ s *SQL }
+
+const selectWarehouseExport = `SELECT CAST(id AS TEXT), date, scheduled, CAST(datasets AS TEXT), status,
+	CAST(files AS TEXT), error, requested_by, started_at, completed_at FROM warehouse_exports`
+
+func scanWarehouseExport(row interface{ Scan(...interface{}) error }) (WarehouseExport, error) {
+	var e WarehouseExport
+	var datasets, files string
+	var completedAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.Date, &e.Scheduled, &datasets, &e.Status, &files, &e.Error, &e.RequestedBy,
+		&e.StartedAt, &completedAt); err != nil {
+		return e, translate(err)
+	}
+	e.Datasets = []string{}
+	json.Unmarshal([]byte(datasets), &e.Datasets)
+	e.Files = []WarehouseFile{}
+	json.Unmarshal([]byte(files), &e.Files)
+	if completedAt.Valid {
+		e.CompletedAt = &completedAt.Time
+	}
+	return e, nil
+}
+
+func encodeWarehouseFiles(files []WarehouseFile) string {
+	if files == nil {
+		files = []WarehouseFile{}
+	}
+	data, _ := json.Marshal(files)
+	return string(data)
+}
+
+func (r warehouseExportRepo) Create(ctx context.Context, e WarehouseExport) error {
+	datasets, err := json.Marshal(e.Datasets)
+	if err != nil {
+		return err
+	}
+	_, err = r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO warehouse_exports
+		(id, date, scheduled, datasets, status, files, error, requested_by, started_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		e.ID, e.Date, e.Scheduled, string(datasets), e.Status, encodeWarehouseFiles(e.Files), e.Error, e.RequestedBy,
+		e.StartedAt.UTC())
+	return translate(err)
+}
+
+func (r warehouseExportRepo) Get(ctx context.Context, id string) (WarehouseExport, error) {
+	return scanWarehouseExport(r.s.writer("").QueryRowContext(ctx,
+		r.s.rebind(selectWarehouseExport+` WHERE id = ?`), id))
+}
+
+func (r warehouseExportRepo) List(ctx context.Context, limit int) ([]WarehouseExport, error) {
+	rows, err := r.s.writer("").QueryContext(ctx,
+		r.s.rebind(selectWarehouseExport+` ORDER BY started_at DESC LIMIT ?`), limit)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	exports := []WarehouseExport{}
+	for rows.Next() {
+		e, err := scanWarehouseExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, translate(rows.Err())
+}
+
+func (r warehouseExportRepo) ScheduledDates(ctx context.Context, from string) ([]string, error) {
+	rows, err := r.s.writer("").QueryContext(ctx,
+		r.s.rebind(`SELECT date FROM warehouse_exports WHERE scheduled AND date >= ? ORDER BY date`), from)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer rows.Close()
+
+	dates := []string{}
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			return nil, translate(err)
+		}
+		dates = append(dates, date)
+	}
+	return dates, translate(rows.Err())
+}
+
+func (r warehouseExportRepo) Update(ctx context.Context, e WarehouseExport) error {
+	return r.s.exec(ctx, "", `UPDATE warehouse_exports SET status = ?, files = ?, error = ?, completed_at = ?
+		WHERE id = ?`, e.Status, encodeWarehouseFiles(e.Files), e.Error, nullTime(e.CompletedAt), e.ID)
+}
+
+func (r warehouseExportRepo) Prune(ctx context.Context, keep int) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM warehouse_exports WHERE id NOT IN (
+		SELECT id FROM (SELECT id FROM warehouse_exports ORDER BY started_at DESC LIMIT ?) AS newest)`), keep)
+	return translate(err)
+}
+
+// OAuth sign-ins
+
+type oauthRepo struct{ s *SQL }
+
+func (r oauthRepo) StartState(ctx context.Context, st OAuthState) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO oauth_states
+		(state_hash, provider, verifier, accept_policies, expires_at) VALUES (?, ?, ?, ?, ?)`),
+		st.StateHash, st.Provider, st.Verifier, st.AcceptPolicies, st.ExpiresAt.UTC())
+	return translate(err)
+}
+
+func (r oauthRepo) TakeState(ctx context.Context, stateHash string, at time.Time) (OAuthState, error) {
+	var st OAuthState
+	err := r.s.writer("").QueryRowContext(ctx, r.s.rebind(`SELECT state_hash, provider, verifier, accept_policies,
+		expires_at FROM oauth_states WHERE state_hash = ? AND expires_at > ?`), stateHash, at.UTC()).
+		Scan(&st.StateHash, &st.Provider, &st.Verifier, &st.AcceptPolicies, &st.ExpiresAt)
+	if err != nil {
+		return OAuthState{}, translate(err)
+	}
+	// Whoever deletes the row takes the state
+	if err := r.s.exec(ctx, "", `DELETE FROM oauth_states WHERE state_hash = ?`, stateHash); err != nil {
+		return OAuthState{}, err
+	}
+	return st, nil
+}
+
+func (r oauthRepo) AddLogin(ctx context.Context, l OAuthLogin) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`INSERT INTO oauth_logins
+		(code_hash, user_id, provider, created, expires_at) VALUES (?, ?, ?, ?, ?)`),
+		l.CodeHash, l.UserID, l.Provider, l.Created, l.ExpiresAt.UTC())
+	return translate(err)
+}
+
+func (r oauthRepo) Login(ctx context.Context, codeHash string, at time.Time) (OAuthLogin, error) {
+	var l OAuthLogin
+	err := r.s.writer("").QueryRowContext(ctx, r.s.rebind(`SELECT code_hash, CAST(user_id AS TEXT), provider, created,
+		expires_at FROM oauth_logins WHERE code_hash = ? AND expires_at > ?`), codeHash, at.UTC()).
+		Scan(&l.CodeHash, &l.UserID, &l.Provider, &l.Created, &l.ExpiresAt)
+	return l, translate(err)
+}
+
+func (r oauthRepo) FinishLogin(ctx context.Context, codeHash string) error {
+	return r.s.exec(ctx, "", `DELETE FROM oauth_logins WHERE code_hash = ?`, codeHash)
+}
+
+func (r oauthRepo) Prune(ctx context.Context, at time.Time) error {
+	if _, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM oauth_states WHERE expires_at <= ?`),
+		at.UTC()); err != nil {
+		return translate(err)
+	}
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM oauth_logins WHERE expires_at <= ?`), at.UTC())
+	return translate(err)
+}
+
+// Failed attempts
+
+type attemptRepo struct{ s *SQL }
+
+func (r attemptRepo) Get(ctx context.Context, key string) (FailedAttempts, error) {
+	a := FailedAttempts{Key: key}
+	var retryAt, lockedUntil sql.NullTime
+	err := r.s.writer("").QueryRowContext(ctx, r.s.rebind(`SELECT failures, lockouts, last_failure, retry_at,
+		locked_until FROM failed_attempts WHERE attempt_key = ?`), key).
+		Scan(&a.Failures, &a.Lockouts, &a.LastFailure, &retryAt, &lockedUntil)
+	if err != nil {
+		return a, translate(err)
+	}
+	if retryAt.Valid {
+		a.RetryAt = &retryAt.Time
+	}
+	if lockedUntil.Valid {
+		a.LockedUntil = &lockedUntil.Time
+	}
+	return a, nil
+}
+
+// Fail counts in a single statement, so failures arriving together at
+// different servers aren't lost.
+func (r attemptRepo) Fail(ctx context.Context, key string, at, forgetBefore time.Time) (FailedAttempts, error) {
+	const stale = `(failed_attempts.last_failure <= ? AND
+		(failed_attempts.locked_until IS NULL OR failed_attempts.locked_until <= ?))`
+	a := FailedAttempts{Key: key, LastFailure: at}
+	err := r.s.writer("").QueryRowContext(ctx, r.s.rebind(`INSERT INTO failed_attempts
+		(attempt_key, failures, lockouts, last_failure) VALUES (?, 1, 0, ?)
+		ON CONFLICT (attempt_key) DO UPDATE SET
+			failures = CASE WHEN `+stale+` THEN 1 ELSE failed_attempts.failures + 1 END,
+			lockouts = CASE WHEN `+stale+` THEN 0 ELSE failed_attempts.lockouts END,
+			retry_at = CASE WHEN `+stale+` THEN NULL ELSE failed_attempts.retry_at END,
+			locked_until = CASE WHEN `+stale+` THEN NULL ELSE failed_attempts.locked_until END,
+			last_failure = excluded.last_failure
+		RETURNING failures, lockouts`),
+		key, at.UTC(),
+		forgetBefore.UTC(), at.UTC(), forgetBefore.UTC(), at.UTC(),
+		forgetBefore.UTC(), at.UTC(), forgetBefore.UTC(), at.UTC()).Scan(&a.Failures, &a.Lockouts)
+	return a, translate(err)
+}
+
+func (r attemptRepo) Lock(ctx context.Context, key string, until time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE failed_attempts SET lockouts = lockouts + 1, locked_until = ?
+		WHERE attempt_key = ?`, until.UTC(), key)
+}
+
+func (r attemptRepo) Delay(ctx context.Context, key string, retryAt time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE failed_attempts SET retry_at = ? WHERE attempt_key = ?`, retryAt.UTC(), key)
+}
+
+func (r attemptRepo) Reset(ctx context.Context, key string) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM failed_attempts WHERE attempt_key = ?`), key)
+	return translate(err)
+}
+
+func (r attemptRepo) Prune(ctx context.Context, at, forgetBefore time.Time) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM failed_attempts
+		WHERE last_failure <= ? AND (locked_until IS NULL OR locked_until <= ?)`), forgetBefore.UTC(), at.UTC())
+	return translate(err)
+}
+
+// Chunks
+
+type chunkRepo struct{ s *SQL }
+
+const selectChunk = `SELECT CAST(user_id AS TEXT), address, blob_key, size_bytes, stored_bytes, compression, used_at FROM chunks`
+
+func scanChunk(row interface{ Scan(...interface{}) error }) (Chunk, error) {
+	var c Chunk
+	err := row.Scan(&c.UserID, &c.Address, &c.BlobKey, &c.Size, &c.StoredSize, &c.Compression, &c.UsedAt)
+	return c, translate(err)
+}
+
+func (r chunkRepo) Use(ctx context.Context, userID, address string, at time.Time) (Chunk, error) {
+	if err := r.s.exec(ctx, userID, `UPDATE chunks SET used_at = ? WHERE user_id = ? AND address = ?`,
+		at.UTC(), userID, address); err != nil {
+		return Chunk{}, err
+	}
+	return scanChunk(r.s.writer(userID).QueryRowContext(ctx,
+		r.s.rebind(selectChunk+` WHERE user_id = ? AND address = ?`), userID, address))
+}
+
+func (r chunkRepo) Add(ctx context.Context, c Chunk) error {
+	_, err := r.s.writer(c.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO chunks
+		(user_id, address, blob_key, size_bytes, stored_bytes, compression, used_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		c.UserID, c.Address, c.BlobKey, c.Size, c.StoredSize, c.Compression, c.UsedAt.UTC())
+	return translate(err)
+}
+
+func (r chunkRepo) AddReferences(ctx context.Context, userID, backupID string, addresses []string) error {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := r.insertReferences(ctx, tx, userID, backupID, addresses); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r chunkRepo) SetReferences(ctx context.Context, userID, backupID string, addresses []string) error {
+	tx, err := r.s.writer(userID).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, r.s.rebind(`DELETE FROM backup_chunks WHERE backup_id = ?`), backupID); err != nil {
+		return translate(err)
+	}
+	if err := r.insertReferences(ctx, tx, userID, backupID, addresses); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertReferences skips references the backup already has, so a chunk
+// repeated within a backup is referenced once.
+func (r chunkRepo) insertReferences(ctx context.Context, tx *sql.Tx, userID, backupID string, addresses []string) error {
+	stmt, err := tx.PrepareContext(ctx, r.s.rebind(`INSERT INTO backup_chunks (backup_id, user_id, address)
+		VALUES (?, ?, ?) ON CONFLICT DO NOTHING`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, address := range addresses {
+		if _, err := stmt.ExecContext(ctx, backupID, userID, address); err != nil {
+			return translate(err)
+		}
+	}
+	return nil
+}
+
+func (r chunkRepo) Release(ctx context.Context, backupID string) error {
+	_, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`DELETE FROM backup_chunks WHERE backup_id = ?`), backupID)
+	return translate(err)
+}
+
+const unreferencedChunk = ` AND NOT EXISTS (SELECT 1 FROM backup_chunks
+	WHERE backup_chunks.user_id = chunks.user_id AND backup_chunks.address = chunks.address)`
+
+func (r chunkRepo) ListUnreferenced(ctx context.Context, cutoff time.Time, limit int) ([]Chunk, error) {
+	rows, err := r.s.writer("").QueryContext(ctx,
+		r.s.rebind(selectChunk+` WHERE used_at < ?`+unreferencedChunk+` ORDER BY used_at LIMIT ?`), cutoff.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := []Chunk{}
+	for rows.Next() {
+		c, err := scanChunk(rows)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+func (r chunkRepo) Delete(ctx context.Context, c Chunk, cutoff time.Time) error {
+	return r.s.exec(ctx, c.UserID, `DELETE FROM chunks WHERE user_id = ? AND address = ? AND used_at < ?`+unreferencedChunk,
+		c.UserID, c.Address, cutoff.UTC())
+}
+
+// Jobs
+
+// Jobs are read from the primary: a worker claiming one, or a client
+// polling it, must see the latest status.
+type jobRepo struct{ s *SQL }
+
+const selectJob = `SELECT CAST(id AS TEXT), COALESCE(CAST(user_id AS TEXT), ''), type, status, CAST(payload AS TEXT),
+	COALESCE(CAST(result AS TEXT), ''), error, attempts, created_at, queued_at, started_at, finished_at FROM jobs`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (Job, error) {
+	var j Job
+	var payload, result string
+	var startedAt, finishedAt sql.NullTime
+	err := row.Scan(&j.ID, &j.UserID, &j.Type, &j.Status, &payload, &result, &j.Error, &j.Attempts,
+		&j.CreatedAt, &j.QueuedAt, &startedAt, &finishedAt)
+	j.Payload = json.RawMessage(payload)
+	if result != "" {
+		j.Result = json.RawMessage(result)
+	}
+	if startedAt.Valid {
+		j.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		j.FinishedAt = &finishedAt.Time
+	}
+	return j, translate(err)
+}
+
+func (r jobRepo) queryJobs(ctx context.Context, query string, args ...interface{}) ([]Job, error) {
+	rows, err := r.s.writer("").QueryContext(ctx, r.s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func (r jobRepo) Create(ctx context.Context, j Job) error {
+	_, err := r.s.writer(j.UserID).ExecContext(ctx, r.s.rebind(`INSERT INTO jobs
+		(id, user_id, type, status, payload, created_at, queued_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		j.ID, nullIfEmpty(j.UserID), j.Type, j.Status, string(j.Payload), j.CreatedAt.UTC(), j.QueuedAt.UTC())
+	return translate(err)
+}
+
+func (r jobRepo) Get(ctx context.Context, userID, id string) (Job, error) {
+	clause, args := ownerClause(userID, []interface{}{id})
+	return scanJob(r.s.writer(userID).QueryRowContext(ctx, r.s.rebind(selectJob+` WHERE id = ?`+clause), args...))
+}
+
+func (r jobRepo) List(ctx context.Context, userID string, limit int, except ...string) ([]Job, error) {
+	query, args := selectJob+` WHERE user_id = ?`, []interface{}{userID}
+	for _, t := range except {
+		query, args = query+` AND type <> ?`, append(args, t)
+	}
+	return r.queryJobs(ctx, query+` ORDER BY created_at DESC LIMIT ?`, append(args, limit)...)
+}
+
+func (r jobRepo) Claim(ctx context.Context, id string, at time.Time) (Job, error) {
+	if err := r.s.exec(ctx, "", `UPDATE jobs SET status = ?, started_at = ?, attempts = attempts + 1
+		WHERE id = ? AND status = ?`, JobRunning, at.UTC(), id, JobQueued); err != nil {
+		return Job{}, err
+	}
+	return r.Get(ctx, "", id)
+}
+
+func (r jobRepo) Finish(ctx context.Context, j Job) error {
+	var result interface{}
+	if len(j.Result) > 0 {
+		result = string(j.Result)
+	}
+	var finishedAt interface{}
+	if j.FinishedAt != nil {
+		finishedAt = j.FinishedAt.UTC()
+	}
+	return r.s.exec(ctx, j.UserID, `UPDATE jobs SET status = ?, result = ?, error = ?, finished_at = ?
+		WHERE id = ? AND status = ?`, j.Status, result, j.Error, finishedAt, j.ID, JobRunning)
+}
+
+func (r jobRepo) ListQueued(ctx context.Context, cutoff time.Time, limit int) ([]Job, error) {
+	return r.queryJobs(ctx, selectJob+` WHERE status = ? AND queued_at < ? ORDER BY queued_at LIMIT ?`,
+		JobQueued, cutoff.UTC(), limit)
+}
+
+func (r jobRepo) Requeue(ctx context.Context, id string, at time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE jobs SET queued_at = ? WHERE id = ? AND status = ?`, at.UTC(), id, JobQueued)
+}
+
+func (r jobRepo) Release(ctx context.Context, id string, at time.Time) error {
+	return r.s.exec(ctx, "", `UPDATE jobs SET status = ?, started_at = NULL, queued_at = ? WHERE id = ? AND status = ?`,
+		JobQueued, at.UTC(), id, JobRunning)
+}
+
+func (r jobRepo) FailStale(ctx context.Context, cutoff time.Time, reason string) (int64, error) {
+	res, err := r.s.writer("").ExecContext(ctx, r.s.rebind(`UPDATE jobs SET status = ?, error = ?, finished_at = ?
+		WHERE status = ? AND started_at < ?`), JobFailed, reason, time.Now().UTC(), JobRunning, cutoff.UTC())
+	if err != nil {
+		return 0, translate(err)
+	}
+	return res.RowsAffected()
+}
+
+func (r jobRepo) ListFinishedBefore(ctx context.Context, cutoff time.Time, limit int) ([]Job, error) {
+	return r.queryJobs(ctx, selectJob+` WHERE finished_at < ? ORDER BY finished_at LIMIT ?`, cutoff.UTC(), limit)
+}
+
+func (r jobRepo) Delete(ctx context.Context, id string) error {
+	return r.s.exec(ctx, "", `DELETE FROM jobs WHERE id = ?`, id)
+}
@@ -0,0 +1,778 @@
+// Package storage persists users, backups, projects and QR codes. One SQL
+// implementation serves PostgreSQL, for hosted deployments, and SQLite, for
+// a single server; DATABASE_URL picks between them.
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for a missing record, and for one that exists
+	// but belongs to someone else.
+	ErrNotFound = errors.New("storage: not found")
+	// ErrConflict is returned when a unique value, such as an email
+	// address, is already taken.
+	ErrConflict = errors.New("storage: already exists")
+	// ErrStale is returned when a record has changed since the version an
+	// update was made against.
+	ErrStale = errors.New("storage: changed since read")
+)
+
+// Repository is the database.
+type Repository interface {
+	Users() UserRepository
+	Backups() BackupRepository
+	Projects() ProjectRepository
+	QRCodes() QRCodeRepository
+	Teams() TeamRepository
+	ProjectShares() ProjectShareRepository
+	Collections() CollectionRepository
+	RefreshTokens() RefreshTokenRepository
+	Sessions() SessionRepository
+	Uploads() UploadRepository
+	Retention() RetentionRepository
+	Keyrings() KeyringRepository
+	TwoFactor() TwoFactorRepository
+	RecoveryCodes() RecoveryCodeRepository
+	LegalHolds() LegalHoldRepository
+	APIKeys() APIKeyRepository
+	Policies() PolicyRepository
+	Webhooks() WebhookRepository
+	DomainEvents() DomainEventRepository
+	QRTemplates() QRTemplateRepository
+	QRLogos() QRLogoRepository
+	Connectors() ConnectorRepository
+	EmailChanges() EmailChangeRepository
+	DataExports() DataExportRepository
+	APIKeyUsage() APIKeyUsageRepository
+	Chunks() ChunkRepository
+	Jobs() JobRepository
+	PasswordResets() PasswordResetRepository
+	Replication() ReplicationRepository
+	SignedLinks() SignedLinkRepository
+	Maintenance() MaintenanceRepository
+	ChatImports() ChatImportRepository
+	IntegrityRuns() IntegrityRunRepository
+	WarehouseExports() WarehouseExportRepository
+	OAuth() OAuthRepository
+	Attempts() AttemptRepository
+
+	// Usage totals users, backups, projects and QR codes across all owners.
+	Usage(ctx context.Context) (Usage, error)
+	// UserUsage totals the backups, projects and QR codes of one user.
+	UserUsage(ctx context.Context, userID string) (UserUsage, error)
+	// Stats aggregates the user's projects, backups and QR codes in the
+	// context's workspace, with series from since onwards.
+	Stats(ctx context.Context, userID string, since time.Time) (Stats, error)
+	// Migrate brings the schema up to date.
+	Migrate(ctx context.Context) error
+	Close() error
+}
+
+type UserRepository interface {
+	Create(ctx context.Context, u User) error
+	Get(ctx context.Context, id string) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// List returns users whose email contains query, or all users when it
+	// is empty, oldest first.
+	List(ctx context.Context, query string, limit, offset int) ([]User, error)
+	UpdateEmail(ctx context.Context, id, email string) error
+	UpdateRole(ctx context.Context, id, role string) error
+	SetDisabled(ctx context.Context, id string, disabled bool) error
+	// SetPassword replaces the password hash and clears
+	// PasswordResetRequired.
+	SetPassword(ctx context.Context, id, hash string) error
+	// ReplacePasswordHash swaps oldHash for newHash, the same password
+	// hashed another way. It returns ErrNotFound if the hash is no longer
+	// oldHash, so a password changed meanwhile is left alone.
+	ReplacePasswordHash(ctx context.Context, id, oldHash, newHash string) error
+	RequirePasswordReset(ctx context.Context, id string) error
+	// ScheduleDeletion sets when the user is to be deleted; a nil at
+	// cancels it.
+	ScheduleDeletion(ctx context.Context, id string, at *time.Time) error
+	// ListDeletionDue returns up to limit users scheduled for deletion at
+	// or before now.
+	ListDeletionDue(ctx context.Context, now time.Time, limit int) ([]User, error)
+	// ListInactive returns up to limit users, other than admins, made before
+	// cutoff who haven't used a session or API key since, oldest first.
+	ListInactive(ctx context.Context, cutoff time.Time, limit int) ([]User, error)
+	// SetPlan sets the user's plan and their own storage quota; a nil
+	// quota leaves them with the plan's.
+	SetPlan(ctx context.Context, id, plan string, quota *int64) error
+	// Delete removes the user and everything they own.
+	Delete(ctx context.Context, id string) error
+}
+
+// Methods taking a userID only see that user's records; an empty userID
+// means any owner, for admin and background work. A context from
+// WithPersonal or WithTeam narrows or widens that to one workspace. Get and List leave out
+// records in the trash, which the Trashed methods return instead.
+type BackupRepository interface {
+	Create(ctx context.Context, b Backup) error
+	Get(ctx context.Context, userID, id string) (Backup, error)
+	// List returns the user's backups, newest first.
+	List(ctx context.Context, userID string) ([]Backup, error)
+	// LatestVersion returns the highest version, in the trash or not, of
+	// the user's backup named name from source. ErrConflict from Create
+	// means another upload took the next version first.
+	LatestVersion(ctx context.Context, userID, name, source string) (Backup, error)
+	// Versions returns the backups in a chain, newest version first.
+	Versions(ctx context.Context, userID, chainID string) ([]Backup, error)
+	Update(ctx context.Context, b Backup) error
+	// SetVerified records that the backup was checked against its
+	// checksums at at, and what was wrong with it, "" if nothing.
+	SetVerified(ctx context.Context, id string, at time.Time, corruption string) error
+	// Delete removes a backup for good, in the trash or not, along with the
+	// projects extracted from it.
+	Delete(ctx context.Context, userID, id string) error
+	// Trash moves a backup and the projects extracted from it to the trash
+	// in one transaction.
+	Trash(ctx context.Context, userID, id string, at time.Time) error
+	// Restore takes a backup out of the trash, with the projects that went
+	// in along with it.
+	Restore(ctx context.Context, userID, id string) error
+	GetTrashed(ctx context.Context, userID, id string) (Backup, error)
+	// ListTrashed returns the user's trashed backups, most recently
+	// trashed first.
+	ListTrashed(ctx context.Context, userID string) ([]Backup, error)
+	// ListTrashedBefore returns up to limit backups of any owner trashed
+	// before cutoff, oldest first.
+	ListTrashedBefore(ctx context.Context, cutoff time.Time, limit int) ([]Backup, error)
+	// ListKeyVersionBelow returns up to limit backups of any owner under a
+	// server key older than version, oldest key first.
+	ListKeyVersionBelow(ctx context.Context, version, limit int) ([]Backup, error)
+	// CountByKeyVersion counts backups by the key they are under.
+	CountByKeyVersion(ctx context.Context) (map[int]int, error)
+}
+
+type ProjectRepository interface {
+	Create(ctx context.Context, p Project) error
+	Get(ctx context.Context, userID, id string) (Project, error)
+	// List returns the user's projects, newest first.
+	List(ctx context.Context, userID string) ([]Project, error)
+	// Update saves p, whatever its version, and moves it to the next one.
+	Update(ctx context.Context, p Project) error
+	// UpdateIfVersion saves p only if the project is still at version;
+	// ErrStale means it has changed since.
+	UpdateIfVersion(ctx context.Context, p Project, version int) error
+	// Delete removes a project for good, in the trash or not.
+	Delete(ctx context.Context, userID, id string) error
+	// Merge saves keep and deletes the merged projects in one transaction.
+	Merge(ctx context.Context, keep Project, mergedIDs []string) error
+	// SetTags replaces the tags of several projects, by ID, in one
+	// transaction.
+	SetTags(ctx context.Context, userID string, tags map[string][]string) error
+	// ListStarred returns the user's starred projects, newest first.
+	ListStarred(ctx context.Context, userID string) ([]Project, error)
+	// ListRecent returns up to limit of the user's projects, most recently
+	// accessed first, leaving out those never accessed.
+	ListRecent(ctx context.Context, userID string, limit int) ([]Project, error)
+	// Touch records that a project was accessed.
+	Touch(ctx context.Context, id string, at time.Time) error
+	Trash(ctx context.Context, userID, id string, at time.Time) error
+	Restore(ctx context.Context, userID, id string) error
+	GetTrashed(ctx context.Context, userID, id string) (Project, error)
+	// ListTrashed returns the user's trashed projects, most recently
+	// trashed first.
+	ListTrashed(ctx context.Context, userID string) ([]Project, error)
+	// ListTrashedBefore returns up to limit projects of any owner trashed
+	// before cutoff, oldest first.
+	ListTrashedBefore(ctx context.Context, cutoff time.Time, limit int) ([]Project, error)
+}
+
+type QRCodeRepository interface {
+	// Create saves a code; a dynamic code's first target starts its
+	// history. ErrConflict means the short code is taken.
+	Create(ctx context.Context, q QRCode) error
+	Get(ctx context.Context, userID, id string) (QRCode, error)
+	GetByShortCode(ctx context.Context, shortCode string) (QRCode, error)
+	// List returns the user's codes, newest first.
+	List(ctx context.Context, userID string) ([]QRCode, error)
+	// UpdateTarget points a dynamic code somewhere else and appends the
+	// change to its history in one transaction.
+	UpdateTarget(ctx context.Context, userID string, change QRTarget) error
+	// Targets returns a dynamic code's history, newest first.
+	Targets(ctx context.Context, userID, id string) ([]QRTarget, error)
+	// SetPassword sets the hash of a dynamic code's password, or removes
+	// the password if hash is empty.
+	SetPassword(ctx context.Context, userID, id, hash string) error
+	// UpdatePages saves a dynamic code's Language, LiveAt, ExpiresAt and
+	// LandingPage.
+	UpdatePages(ctx context.Context, userID string, q QRCode) error
+	Delete(ctx context.Context, userID, id string) error
+}
+
+type TeamRepository interface {
+	// Create saves a team with ownerID as its first owner in one
+	// transaction.
+	Create(ctx context.Context, t Team, ownerID string) error
+	Get(ctx context.Context, id string) (Team, error)
+	// ListForUser returns the teams userID is a member of, with their role
+	// in each, oldest first.
+	ListForUser(ctx context.Context, userID string) ([]Team, error)
+	Rename(ctx context.Context, id, name string) error
+	// Delete removes a team along with its members, backups, projects and
+	// QR codes.
+	Delete(ctx context.Context, id string) error
+	// Members returns a team's members, longest-standing first.
+	Members(ctx context.Context, teamID string) ([]TeamMember, error)
+	Member(ctx context.Context, teamID, userID string) (TeamMember, error)
+	// AddMember returns ErrConflict if the user is already a member.
+	AddMember(ctx context.Context, m TeamMember) error
+	SetMemberRole(ctx context.Context, teamID, userID, role string) error
+	RemoveMember(ctx context.Context, teamID, userID string) error
+	// CreateInvite saves an invite in place of any to the same address,
+	// ignoring case, and the team's expired ones.
+	CreateInvite(ctx context.Context, i TeamInvite) error
+	// Invites returns a team's invites that haven't expired at at, oldest
+	// first.
+	Invites(ctx context.Context, teamID string, at time.Time) ([]TeamInvite, error)
+	// InviteByToken returns the invite with the token hash, unless it has
+	// expired at at.
+	InviteByToken(ctx context.Context, tokenHash string, at time.Time) (TeamInvite, error)
+	DeleteInvite(ctx context.Context, teamID, id string) error
+}
+
+// CollectionRepository limits what it reads and changes to the workspace
+// of the context, as ProjectRepository does.
+type CollectionRepository interface {
+	Create(ctx context.Context, c Collection) error
+	Get(ctx context.Context, userID, id string) (Collection, error)
+	// List returns the user's collections by name.
+	List(ctx context.Context, userID string) ([]Collection, error)
+	Update(ctx context.Context, userID string, c Collection) error
+	Delete(ctx context.Context, userID, id string) error
+	// Projects returns the projects in a collection not in the trash, most
+	// recently added first.
+	Projects(ctx context.Context, id string) ([]Project, error)
+	// AddProject returns ErrConflict if the project is already in the
+	// collection.
+	AddProject(ctx context.Context, id, projectID string, at time.Time) error
+	RemoveProject(ctx context.Context, id, projectID string) error
+}
+
+type ProjectShareRepository interface {
+	Create(ctx context.Context, s ProjectShare) error
+	// GetByHash finds a share, revoked or expired or not, by the SHA-256 of
+	// its token.
+	GetByHash(ctx context.Context, hash string) (ProjectShare, error)
+	// List returns a project's shares, newest first.
+	List(ctx context.Context, projectID string) ([]ProjectShare, error)
+	// Revoke returns ErrNotFound if the share isn't the project's or was
+	// already revoked.
+	Revoke(ctx context.Context, projectID, id string, at time.Time) error
+	// RecordAccess counts a view of the shared project.
+	RecordAccess(ctx context.Context, id string, at time.Time) error
+}
+
+type RefreshTokenRepository interface {
+	Create(ctx context.Context, t RefreshToken) error
+	// GetByHash finds a token, revoked or not, by the SHA-256 of its value.
+	GetByHash(ctx context.Context, hash string) (RefreshToken, error)
+	// Rotate revokes oldID and saves next in its place in one transaction,
+	// extending next's session to expire with it. It returns ErrNotFound if
+	// oldID was already revoked, so a token can only be rotated once.
+	Rotate(ctx context.Context, oldID string, next RefreshToken) error
+	Revoke(ctx context.Context, id string) error
+	// RevokeUser revokes all of the user's tokens and sessions, logging
+	// them out everywhere.
+	RevokeUser(ctx context.Context, userID string) error
+	// DeleteExpired removes tokens that expired before cutoff.
+	DeleteExpired(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+type SessionRepository interface {
+	Create(ctx context.Context, s Session) error
+	Get(ctx context.Context, id string) (Session, error)
+	// ListActive returns the user's sessions that are neither revoked nor
+	// expired at now, most recently used first.
+	ListActive(ctx context.Context, userID string, now time.Time) ([]Session, error)
+	// Touch records the session being used at at from ip.
+	Touch(ctx context.Context, id, ip string, at time.Time) error
+	// Revoke ends one of the user's sessions and revokes its refresh
+	// tokens. It returns ErrNotFound if the user has no such active session.
+	Revoke(ctx context.Context, userID, id string) error
+	// RevokeOthers ends every active session of the user but keepID,
+	// returning how many it ended.
+	RevokeOthers(ctx context.Context, userID, keepID string) (int64, error)
+	// DeleteEnded removes sessions that expired or were revoked before
+	// cutoff.
+	DeleteEnded(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// RetentionRepository holds each user's retention policy, if they
+// set one.
+type RetentionRepository interface {
+	// Get returns ErrNotFound if the user has no policy.
+	Get(ctx context.Context, userID string) (RetentionPolicy, error)
+	// Put saves p in place of the user's policy, if any.
+	Put(ctx context.Context, p RetentionPolicy) error
+	// Delete returns ErrNotFound if the user has no policy.
+	Delete(ctx context.Context, userID string) error
+	// List returns every user's policy.
+	List(ctx context.Context) ([]RetentionPolicy, error)
+}
+
+// KeyringRepository holds users' wrapped data keys. Losing one loses the
+// user's data, so writes must succeed before anything is encrypted with it.
+type KeyringRepository interface {
+	// Get returns ErrNotFound for a user without a data key.
+	Get(ctx context.Context, userID string) (Keyring, error)
+	// Put saves k in place of the user's keyring, if any.
+	Put(ctx context.Context, k Keyring) error
+	// Delete returns ErrNotFound if the user has no keyring.
+	Delete(ctx context.Context, userID string) error
+}
+
+// TwoFactorRepository holds users' authenticator enrollments.
+type TwoFactorRepository interface {
+	// Get returns ErrNotFound for a user who hasn't started enrolling.
+	Get(ctx context.Context, userID string) (TwoFactor, error)
+	// Put saves t in place of the user's enrollment, if any.
+	Put(ctx context.Context, t TwoFactor) error
+	// Enable turns on a pending enrollment with the step of its first code.
+	// It returns ErrNotFound if there is none or it is already on.
+	Enable(ctx context.Context, userID string, step int64, at time.Time) error
+	// UseStep records the step of an accepted code. It returns ErrNotFound
+	// unless the enrollment is on and step is later than any used, so two
+	// logins racing with one code can't both succeed.
+	UseStep(ctx context.Context, userID string, step int64) error
+	// Delete returns ErrNotFound if the user has no enrollment.
+	Delete(ctx context.Context, userID string) error
+}
+
+// RecoveryCodeRepository holds the hashes of users' recovery codes.
+type RecoveryCodeRepository interface {
+	// Replace swaps the user's codes for a new set.
+	Replace(ctx context.Context, userID string, hashes []string, at time.Time) error
+	// Use marks an unused code used. It returns ErrNotFound if the user has
+	// no such code or it was used already.
+	Use(ctx context.Context, userID, hash string, at time.Time) error
+	// Get returns ErrNotFound for a user without codes.
+	Get(ctx context.Context, userID string) (RecoveryCodes, error)
+	// Delete returns ErrNotFound if the user has no codes.
+	Delete(ctx context.Context, userID string) error
+}
+
+// LegalHoldRepository holds legal holds. Released holds are kept so the
+// history stays auditable.
+type LegalHoldRepository interface {
+	Create(ctx context.Context, h LegalHold) error
+	Get(ctx context.Context, id string) (LegalHold, error)
+	// Release returns ErrNotFound unless the hold is active.
+	Release(ctx context.Context, id, releasedBy string, at time.Time) error
+	// List returns the active holds, and the released ones too if asked,
+	// newest first.
+	List(ctx context.Context, includeReleased bool) ([]LegalHold, error)
+}
+
+// APIKeyRepository holds users' API keys, revoked ones included.
+type APIKeyRepository interface {
+	Create(ctx context.Context, k APIKey) error
+	Get(ctx context.Context, id string) (APIKey, error)
+	// GetByHash finds the key a request presented.
+	GetByHash(ctx context.Context, hash string) (APIKey, error)
+	// List returns the user's keys, newest first.
+	List(ctx context.Context, userID string) ([]APIKey, error)
+	// Touch records that the key was used at at. The time is only written
+	// once a minute or so, not on every request.
+	Touch(ctx context.Context, id string, at time.Time) error
+	// Revoke returns ErrNotFound if the user has no such key.
+	Revoke(ctx context.Context, userID, id string) error
+	// RevokeUser revokes every key of the user.
+	RevokeUser(ctx context.Context, userID string) error
+}
+
+// PolicyRepository holds every published version of the legal documents
+// and every acceptance of one.
+type PolicyRepository interface {
+	// Publish returns ErrConflict if the version was published already.
+	Publish(ctx context.Context, d PolicyDocument) error
+	// Documents returns every version of every document, oldest first.
+	Documents(ctx context.Context) ([]PolicyDocument, error)
+	// Accept records an acceptance, replacing an earlier one of the same
+	// version.
+	Accept(ctx context.Context, a PolicyAcceptance) error
+	// Acceptances returns the user's acceptances, oldest first.
+	Acceptances(ctx context.Context, userID string) ([]PolicyAcceptance, error)
+}
+
+// WebhookRepository holds webhook endpoints and the deliveries made to
+// them. Deleting an endpoint deletes its deliveries.
+type WebhookRepository interface {
+	CreateEndpoint(ctx context.Context, e WebhookEndpoint) error
+	// GetEndpoint returns one of the user's endpoints, or anyone's if
+	// userID is empty.
+	GetEndpoint(ctx context.Context, userID, id string) (WebhookEndpoint, error)
+	// ListEndpoints returns the user's endpoints, oldest first.
+	ListEndpoints(ctx context.Context, userID string) ([]WebhookEndpoint, error)
+	// UpdateEndpoint saves e's URL and events.
+	UpdateEndpoint(ctx context.Context, e WebhookEndpoint) error
+	SetSecrets(ctx context.Context, userID, id string, secrets []WebhookSecret) error
+	// EnableEndpoint clears an endpoint's disabled state and failures.
+	EnableEndpoint(ctx context.Context, userID, id string) error
+	// DisableEndpoint returns ErrNotFound if the endpoint is already
+	// disabled, so only one caller reports it.
+	DisableEndpoint(ctx context.Context, id, reason string) error
+	// EndpointSucceeded clears the endpoint's run of failures.
+	EndpointSucceeded(ctx context.Context, id string) error
+	// EndpointFailed counts a failed delivery, starting the run of failures
+	// at at if there isn't one, and returns the endpoint.
+	EndpointFailed(ctx context.Context, id string, at time.Time) (WebhookEndpoint, error)
+	DeleteEndpoint(ctx context.Context, userID, id string) error
+
+	CreateDelivery(ctx context.Context, d WebhookDelivery) error
+	// GetDelivery returns one of the endpoint's deliveries, or any
+	// endpoint's if endpointID is empty.
+	GetDelivery(ctx context.Context, endpointID, id string) (WebhookDelivery, error)
+	// ListDeliveries returns up to limit of the endpoint's deliveries,
+	// newest first.
+	ListDeliveries(ctx context.Context, endpointID string, limit int) ([]WebhookDelivery, error)
+	// ListDue returns up to limit pending deliveries of any endpoint whose
+	// next attempt is due at at, oldest first.
+	ListDue(ctx context.Context, at time.Time, limit int) ([]WebhookDelivery, error)
+	// Lease puts off a due delivery's next attempt until until, so one
+	// caller queues it. It returns ErrNotFound if the delivery isn't due
+	// at at.
+	Lease(ctx context.Context, id string, at, until time.Time) error
+	// StartAttempt counts an attempt at a pending delivery that has had
+	// attempts attempts, and puts off the next until until. It returns
+	// ErrNotFound if the delivery isn't pending or another attempt started
+	// first.
+	StartAttempt(ctx context.Context, id string, attempts int, until time.Time) error
+	// FinishAttempt saves d's status, response, error, next attempt and
+	// delivery time.
+	FinishAttempt(ctx context.Context, d WebhookDelivery) error
+	// PruneDeliveries deletes deliveries made before cutoff that are no
+	// longer pending, and returns how many.
+	PruneDeliveries(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// DomainEventRepository is the append-only log of domain events.
+type DomainEventRepository interface {
+	// Append records e and returns the sequence it was given. Appends are
+	// serialized, so events become visible in sequence order and a reader
+	// resuming after a sequence misses none.
+	Append(ctx context.Context, e DomainEvent) (int64, error)
+	// List returns up to f.Limit events matching f in sequence order.
+	List(ctx context.Context, f DomainEventFilter) ([]DomainEvent, error)
+}
+
+// QRTemplateRepository holds users' QR code templates. Names are unique per
+// user, ignoring case: Create and Update return ErrConflict for a name the
+// user already has.
+type QRTemplateRepository interface {
+	Create(ctx context.Context, t QRTemplate) error
+	Get(ctx context.Context, userID, id string) (QRTemplate, error)
+	// List returns the user's templates by name.
+	List(ctx context.Context, userID string) ([]QRTemplate, error)
+	Count(ctx context.Context, userID string) (int, error)
+	// Update saves t's name, options and UpdatedAt.
+	Update(ctx context.Context, t QRTemplate) error
+	Delete(ctx context.Context, userID, id string) error
+}
+
+// QRLogoRepository holds the records of users' saved logos.
+type QRLogoRepository interface {
+	Create(ctx context.Context, logo QRLogo) error
+	Get(ctx context.Context, userID, id string) (QRLogo, error)
+	// List returns the user's logos, newest first.
+	List(ctx context.Context, userID string) ([]QRLogo, error)
+	Delete(ctx context.Context, userID, id string) error
+}
+
+// ConnectorRepository holds users' connectors. While one runs its next run
+// is a lease, so a run whose server went away is started again once it
+// runs out.
+type ConnectorRepository interface {
+	Create(ctx context.Context, c Connector) error
+	// Get returns one of the user's connectors, or anyone's if userID is
+	// empty.
+	Get(ctx context.Context, userID, id string) (Connector, error)
+	// List returns the user's connectors, oldest first.
+	List(ctx context.Context, userID string) ([]Connector, error)
+	// Update saves c's name, URL, credentials, interval and whether it is
+	// enabled.
+	Update(ctx context.Context, c Connector) error
+	// Reschedule moves the connector's next run to next, unless it is
+	// running, when it returns ErrNotFound.
+	Reschedule(ctx context.Context, userID, id string, next time.Time) error
+	// ListDue returns up to limit enabled connectors of any user whose next
+	// run is due at at.
+	ListDue(ctx context.Context, at time.Time, limit int) ([]Connector, error)
+	// Start saves c's status, recent runs and next run, unless the
+	// connector is running and its next run isn't due at at, when it
+	// returns ErrNotFound.
+	Start(ctx context.Context, c Connector, at time.Time) error
+	// Finish saves c's status, error, run times, next run, totals and
+	// recent runs.
+	Finish(ctx context.Context, c Connector) error
+	SetSeen(ctx context.Context, id string, seen map[string]ConnectorSeen) error
+	Delete(ctx context.Context, userID, id string) error
+}
+
+// EmailChangeRepository holds pending email changes, at most one per user.
+type EmailChangeRepository interface {
+	// Start saves c in place of the user's pending change, if any.
+	Start(ctx context.Context, c EmailChange) error
+	// Pending returns the user's change, unless it has expired at at.
+	Pending(ctx context.Context, userID string, at time.Time) (EmailChange, error)
+	// ByToken returns the change with the token hash for either address,
+	// unless it has expired at at.
+	ByToken(ctx context.Context, tokenHash string, at time.Time) (EmailChange, error)
+	// Confirm records that the old address, or the new one, confirmed the
+	// change at at.
+	Confirm(ctx context.Context, id string, old bool, at time.Time) error
+	// Delete returns ErrNotFound if the change is already gone, so only one
+	// caller completes or cancels it.
+	Delete(ctx context.Context, id string) error
+	Cancel(ctx context.Context, userID string) error
+}
+
+// DataExportRepository holds data-subject export requests.
+type DataExportRepository interface {
+	Create(ctx context.Context, e DataExport) error
+	// Get returns one of the user's exports, or anyone's if userID is
+	// empty.
+	Get(ctx context.Context, userID, id string) (DataExport, error)
+	// List returns the user's exports, newest first.
+	List(ctx context.Context, userID string) ([]DataExport, error)
+	// Update saves e's status, error, archive path and times.
+	Update(ctx context.Context, e DataExport) error
+	// ListExpired returns up to limit exports of any user that expire at
+	// or before at.
+	ListExpired(ctx context.Context, at time.Time, limit int) ([]DataExport, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// APIKeyUsageRepository holds daily rollups of API key usage. Dates are
+// UTC and formatted YYYY-MM-DD, so they compare as strings.
+type APIKeyUsageRepository interface {
+	// Add adds u's counts to the key's rollup for u.Date.
+	Add(ctx context.Context, u APIKeyUsageDay) error
+	// Since returns the key's rollups from the given date on, oldest first.
+	Since(ctx context.Context, keyID, from string) ([]APIKeyUsageDay, error)
+	// OnDay returns every key's rollup for date.
+	OnDay(ctx context.Context, date string) ([]APIKeyUsageDay, error)
+	// Prune deletes rollups from before the given date.
+	Prune(ctx context.Context, before string) error
+}
+
+// PasswordResetRepository holds the reset links admins have sent, at most
+// one per user. Only the SHA-256 of each token is kept.
+type PasswordResetRepository interface {
+	// Start saves a reset for the user in place of any earlier one.
+	Start(ctx context.Context, userID, tokenHash string, expiresAt time.Time) error
+	// Consume deletes the reset with the token hash and returns its user,
+	// unless it has expired at at. Only one caller consumes a reset; the
+	// rest get ErrNotFound.
+	Consume(ctx context.Context, tokenHash string, at time.Time) (string, error)
+	// Prune deletes resets that expired at or before at.
+	Prune(ctx context.Context, at time.Time) error
+}
+
+// ReplicationRepository is the outbox of blob changes not yet copied to
+// the replica.
+type ReplicationRepository interface {
+	// Add records a change, replacing the key's version and content type
+	// but keeping when it first fell behind.
+	Add(ctx context.Context, c ReplicationChange) error
+	// Done clears the key if version is still its latest change.
+	Done(ctx context.Context, key, version string) error
+	// Pending returns up to limit changes made at or before before, oldest
+	// first.
+	Pending(ctx context.Context, before time.Time, limit int) ([]ReplicationChange, error)
+	// Backlog returns how many keys are pending and, if any are, when the
+	// oldest fell behind.
+	Backlog(ctx context.Context) (int, *time.Time, error)
+}
+
+// SignedLinkRepository holds the signed links users have handed out.
+type SignedLinkRepository interface {
+	Create(ctx context.Context, l SignedLink) error
+	Get(ctx context.Context, id string) (SignedLink, error)
+	// List returns the user's links that have not expired at at, newest
+	// first.
+	List(ctx context.Context, userID string, at time.Time) ([]SignedLink, error)
+	// Revoke returns ErrNotFound if the user has no such link or it is
+	// already revoked.
+	Revoke(ctx context.Context, userID, id string, at time.Time) error
+	// IsRevoked reports whether the link was revoked; links never recorded
+	// are not.
+	IsRevoked(ctx context.Context, id string) (bool, error)
+	// Prune deletes links that expired at or before at.
+	Prune(ctx context.Context, at time.Time) error
+}
+
+// MaintenanceRepository holds maintenance mode.
+type MaintenanceRepository interface {
+	// Get returns maintenance mode, off if it was never set.
+	Get(ctx context.Context) (Maintenance, error)
+	Set(ctx context.Context, m Maintenance) error
+}
+
+// ChatImportRepository holds chat exports queued to be imported, and the
+// outcome of ones that were.
+type ChatImportRepository interface {
+	Create(ctx context.Context, imp ChatImport) error
+	Get(ctx context.Context, userID, id string) (ChatImport, error)
+	// List returns the user's imports, newest first.
+	List(ctx context.Context, userID string) ([]ChatImport, error)
+	// Update saves an import's status, counts, error and blob key.
+	Update(ctx context.Context, imp ChatImport) error
+}
+
+// IntegrityRunRepository holds the runs of the backup integrity check.
+type IntegrityRunRepository interface {
+	// Create returns ErrConflict if a run is already scheduled for the
+	// same day.
+	Create(ctx context.Context, run IntegrityRun) error
+	Get(ctx context.Context, id string) (IntegrityRun, error)
+	// List returns the newest limit runs, newest first.
+	List(ctx context.Context, limit int) ([]IntegrityRun, error)
+	// Start moves a run from "queued" to "running". It returns ErrNotFound
+	// if the run isn't queued, or another run started after busySince is
+	// still running.
+	Start(ctx context.Context, id string, at, busySince time.Time) error
+	// Update saves a run's status, counts and failures.
+	Update(ctx context.Context, run IntegrityRun) error
+	// Prune deletes all but the newest keep runs.
+	Prune(ctx context.Context, keep int) error
+}
+
+// WarehouseExportRepository holds the runs of the warehouse export.
+type WarehouseExportRepository interface {
+	// Create returns ErrConflict for a scheduled run of a day that already
+	// has one.
+	Create(ctx context.Context, e WarehouseExport) error
+	Get(ctx context.Context, id string) (WarehouseExport, error)
+	// List returns the newest limit runs, newest first.
+	List(ctx context.Context, limit int) ([]WarehouseExport, error)
+	// ScheduledDates returns the days from from (YYYY-MM-DD) on that have a
+	// scheduled run.
+	ScheduledDates(ctx context.Context, from string) ([]string, error)
+	// Update saves a run's status, files and error.
+	Update(ctx context.Context, e WarehouseExport) error
+	// Prune deletes all but the newest keep runs.
+	Prune(ctx context.Context, keep int) error
+}
+
+// OAuthRepository holds sign-ins in progress at an OAuth provider, and
+// finished ones waiting to be traded for tokens. Only the SHA-256 of each
+// state and one-time code is kept.
+type OAuthRepository interface {
+	StartState(ctx context.Context, s OAuthState) error
+	// TakeState deletes the state with the hash and returns it, unless it
+	// has expired at at. Only one caller takes a state; the rest get
+	// ErrNotFound.
+	TakeState(ctx context.Context, stateHash string, at time.Time) (OAuthState, error)
+	AddLogin(ctx context.Context, l OAuthLogin) error
+	// Login returns the login with the code hash, unless it has expired at
+	// at. It is left in place, so the code can be sent again with a second
+	// factor.
+	Login(ctx context.Context, codeHash string, at time.Time) (OAuthLogin, error)
+	// FinishLogin deletes the login with the code hash. Only one caller
+	// finishes a login; the rest get ErrNotFound.
+	FinishLogin(ctx context.Context, codeHash string) error
+	// Prune deletes states and logins that expired at or before at.
+	Prune(ctx context.Context, at time.Time) error
+}
+
+// AttemptRepository counts failed attempts by key, so every server sees
+// the same counts and lockouts.
+type AttemptRepository interface {
+	// Get returns the failures for key, or ErrNotFound if there are none.
+	Get(ctx context.Context, key string) (FailedAttempts, error)
+	// Fail counts a failure for key at at and returns the counts after it.
+	// Earlier failures are forgotten first if the last was at or before
+	// forgetBefore and key isn't locked at at. Concurrent failures are each
+	// counted.
+	Fail(ctx context.Context, key string, at, forgetBefore time.Time) (FailedAttempts, error)
+	// Lock locks key until until, counting a lockout.
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Delay makes key wait until retryAt before trying again.
+	Delay(ctx context.Context, key string, retryAt time.Time) error
+	// Reset forgets key's failures.
+	Reset(ctx context.Context, key string) error
+	// Prune forgets keys whose last failure was at or before forgetBefore
+	// and that aren't locked at at.
+	Prune(ctx context.Context, at, forgetBefore time.Time) error
+}
+
+// UploadRepository holds resumable uploads while their parts arrive.
+type UploadRepository interface {
+	Create(ctx context.Context, u Upload) error
+	// Get returns one of the user's uploads.
+	Get(ctx context.Context, userID, id string) (Upload, error)
+	// List returns the user's uploads, oldest first.
+	List(ctx context.Context, userID string) ([]Upload, error)
+	// Append saves u's Offset and Parts after a part was stored. It returns
+	// ErrStale if the upload is no longer at offset from, because another
+	// part was appended first.
+	Append(ctx context.Context, u Upload, from int64) error
+	// Delete returns ErrNotFound if the user has no such upload.
+	Delete(ctx context.Context, userID, id string) error
+	// ListExpired returns uploads that expired before cutoff, across all
+	// users.
+	ListExpired(ctx context.Context, cutoff time.Time) ([]Upload, error)
+}
+
+// ChunkRepository tracks the deduplicated chunks backups are stored in and
+// which backups reference them. A chunk nothing references is deleted once
+// it has gone unused for a while, so an upload can reuse one between
+// finding it and referencing it.
+type ChunkRepository interface {
+	// Use marks the user's chunk with address as used at at and returns it,
+	// or ErrNotFound if it isn't stored.
+	Use(ctx context.Context, userID, address string, at time.Time) (Chunk, error)
+	// Add records a stored chunk. ErrConflict means another upload stored
+	// the same content first.
+	Add(ctx context.Context, c Chunk) error
+	// AddReferences adds to the chunks a backup references.
+	AddReferences(ctx context.Context, userID, backupID string, addresses []string) error
+	// SetReferences replaces the chunks a backup references in one
+	// transaction.
+	SetReferences(ctx context.Context, userID, backupID string, addresses []string) error
+	// Release drops all of a backup's references.
+	Release(ctx context.Context, backupID string) error
+	// ListUnreferenced returns up to limit chunks of any owner that no
+	// backup references and that were last used before cutoff.
+	ListUnreferenced(ctx context.Context, cutoff time.Time, limit int) ([]Chunk, error)
+	// Delete removes a chunk's record if it is still unreferenced and
+	// unused since cutoff, and returns ErrNotFound otherwise.
+	Delete(ctx context.Context, c Chunk, cutoff time.Time) error
+}
+
+// JobRepository tracks background jobs. The queue only carries their IDs,
+// so a job is claimed here before it runs, and one pushed twice runs once.
+type JobRepository interface {
+	Create(ctx context.Context, j Job) error
+	// Get returns a job of userID's, or of any owner if userID is empty.
+	Get(ctx context.Context, userID, id string) (Job, error)
+	// List returns up to limit of the user's jobs, newest first, leaving
+	// out jobs of the types in except.
+	List(ctx context.Context, userID string, limit int, except ...string) ([]Job, error)
+	// Claim marks a queued job running and returns it, or ErrNotFound if
+	// it isn't queued.
+	Claim(ctx context.Context, id string, at time.Time) (Job, error)
+	// Finish saves a running job's status, result and error.
+	Finish(ctx context.Context, j Job) error
+	// ListQueued returns up to limit jobs of any owner queued before
+	// cutoff, oldest first.
+	ListQueued(ctx context.Context, cutoff time.Time, limit int) ([]Job, error)
+	// Requeue records that a queued job was pushed to the queue again at at.
+	Requeue(ctx context.Context, id string, at time.Time) error
+	// Release puts a running job back in the queue, as of at, for a worker
+	// that stopped before finishing it.
+	Release(ctx context.Context, id string, at time.Time) error
+	// FailStale fails jobs that started running before cutoff, whose
+	// worker must have died, and returns how many there were.
+	FailStale(ctx context.Context, cutoff time.Time, reason string) (int64, error)
+	// ListFinishedBefore returns up to limit jobs of any owner that
+	// finished before cutoff, oldest first.
+	ListFinishedBefore(ctx context.Context, cutoff time.Time, limit int) ([]Job, error)
+	Delete(ctx context.Context, id string) error
+}
@@ -0,0 +1,233 @@
+// Package store routes SQL traffic between a primary database and its read
+// replicas. Writes always go to the primary. Reads go to a healthy replica
+// unless the caller wrote recently, in which case a lagging replica could
+// hand back data older than what the caller just saved.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Config describes the databases to open. The DSNs are PostgreSQL
+// connection strings.
+type Config struct {
+	PrimaryDSN  string
+	ReplicaDSNs []string
+	// MaxLag takes a replica out of rotation once it falls further behind
+	MaxLag time.Duration
+	// StickyWindow is how long reads for a key stay on the primary after a
+	// write for that key
+	StickyWindow time.Duration
+}
+
+// Defaults for Config fields left zero.
+const (
+	DefaultMaxLag       = 10 * time.Second
+	DefaultStickyWindow = 5 * time.Second
+)
+
+// ErrNoPrimary is returned by Open without a primary DSN.
+var ErrNoPrimary = errors.New("store: primary DSN is required")
+
+// lagQuery reports how far a PostgreSQL standby is behind, in seconds. A
+// standby that has replayed everything it received is not behind, however
+// long ago the last transaction was.
+const lagQuery = `SELECT CASE
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+// DB is a primary and its replicas.
+type DB struct {
+	primary  *sql.DB
+	replicas []*replica
+	next     uint64
+
+	maxLag       time.Duration
+	stickyWindow time.Duration
+
+	mu     sync.Mutex
+	writes map[string]time.Time
+}
+
+type replica struct {
+	name string
+	db   *sql.DB
+
+	// Guarded by DB.mu
+	healthy bool
+	lag     time.Duration
+	err     string
+	checked time.Time
+}
+
+// ReplicaStatus is the last health check of one replica.
+type ReplicaStatus struct {
+	Name       string     `json:"name"`
+	Healthy    bool       `json:"healthy"`
+	LagSeconds float64    `json:"lag_seconds"`
+	Error      string     `json:"error,omitempty"`
+	CheckedAt  *time.Time `json:"checked_at,omitempty"`
+}
+
+// Open opens the primary and replicas. Replicas start out of rotation until
+// the first CheckReplicas finds them healthy.
+func Open(ctx context.Context, cfg Config) (*DB, error) {
+	if cfg.PrimaryDSN == "" {
+		return nil, ErrNoPrimary
+	}
+	if cfg.MaxLag <= 0 {
+		cfg.MaxLag = DefaultMaxLag
+	}
+	if cfg.StickyWindow <= 0 {
+		cfg.StickyWindow = DefaultStickyWindow
+	}
+
+	primary, err := sql.Open("postgres", cfg.PrimaryDSN)
+	if err != nil {
+		return nil, fmt.Errorf("store: opening primary: %w", err)
+	}
+	if err := primary.PingContext(ctx); err != nil {
+		primary.Close()
+		return nil, fmt.Errorf("store: connecting to primary: %w", err)
+	}
+
+	db := &DB{
+		primary:      primary,
+		maxLag:       cfg.MaxLag,
+		stickyWindow: cfg.StickyWindow,
+		writes:       make(map[string]time.Time),
+	}
+	for i, dsn := range cfg.ReplicaDSNs {
+		conn, err := sql.Open("postgres", dsn)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("store: opening replica %d: %w", i+1, err)
+		}
+		db.replicas = append(db.replicas, &replica{name: replicaName(dsn, i), db: conn})
+	}
+	db.CheckReplicas(ctx)
+	return db, nil
+}
+
+// replicaName identifies a replica in status output without its password.
+func replicaName(dsn string, i int) string {
+	if u, err := url.Parse(dsn); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return fmt.Sprintf("replica-%d", i+1)
+}
+
+// Primary returns the primary, for writes and transactions.
+func (db *DB) Primary() *sql.DB {
+	return db.primary
+}
+
+// Writer returns the primary and marks key, usually a user ID, as written,
+// so Reader keeps that key's reads on the primary for the sticky window.
+func (db *DB) Writer(key string) *sql.DB {
+	if key != "" && len(db.replicas) > 0 {
+		db.mu.Lock()
+		db.writes[key] = time.Now()
+		db.mu.Unlock()
+	}
+	return db.primary
+}
+
+// Reader returns a database to read key's data from: the primary if key
+// was written within the sticky window or no replica is healthy, otherwise
+// the next healthy replica.
+func (db *DB) Reader(key string) *sql.DB {
+	if len(db.replicas) == 0 {
+		return db.primary
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if written, ok := db.writes[key]; ok && time.Since(written) < db.stickyWindow {
+		return db.primary
+	}
+
+	start := atomic.AddUint64(&db.next, 1)
+	for i := range db.replicas {
+		r := db.replicas[(start+uint64(i))%uint64(len(db.replicas))]
+		if r.healthy {
+			return r.db
+		}
+	}
+	return db.primary
+}
+
+// CheckReplicas pings each replica and measures its lag, taking replicas
+// that are down or too far behind out of rotation. It also forgets writes
+// older than the sticky window.
+func (db *DB) CheckReplicas(ctx context.Context) {
+	for _, r := range db.replicas {
+		var lagSeconds float64
+		err := r.db.QueryRowContext(ctx, lagQuery).Scan(&lagSeconds)
+		lag := time.Duration(lagSeconds * float64(time.Second))
+
+		db.mu.Lock()
+		r.checked = time.Now()
+		r.lag = lag
+		switch {
+		case err != nil:
+			r.healthy, r.err = false, err.Error()
+		case lag > db.maxLag:
+			r.healthy, r.err = false, fmt.Sprintf("lag %s exceeds %s", lag.Round(time.Millisecond), db.maxLag)
+		default:
+			r.healthy, r.err = true, ""
+		}
+		db.mu.Unlock()
+	}
+
+	db.mu.Lock()
+	for key, written := range db.writes {
+		if time.Since(written) >= db.stickyWindow {
+			delete(db.writes, key)
+		}
+	}
+	db.mu.Unlock()
+}
+
+// Replicas reports the last health check of each replica.
+func (db *DB) Replicas() []ReplicaStatus {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	statuses := make([]ReplicaStatus, 0, len(db.replicas))
+	for _, r := range db.replicas {
+		status := ReplicaStatus{
+			Name:       r.name,
+			Healthy:    r.healthy,
+			LagSeconds: r.lag.Seconds(),
+			Error:      r.err,
+		}
+		if !r.checked.IsZero() {
+			checked := r.checked
+			status.CheckedAt = &checked
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (db *DB) Close() error {
+	err := db.primary.Close()
+	for _, r := range db.replicas {
+		if rerr := r.db.Close(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+// Package streamcrypt encrypts streams of any length with AES-256-GCM in
+// fixed-size chunks, so neither side ever holds more than a chunk.
+//
+// Each stream derives its own key from the caller's key and a random salt
+// with HKDF-SHA256. Chunk nonces are a random prefix, the chunk's counter and
+// a flag set only on the last chunk, so chunks can't be reordered, dropped,
+// or cut off at a chunk boundary without failing authentication.
+package streamcrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Magic starts every stream. Its leading zero byte can't begin base64
+	// or other text, so streams are told apart from older formats.
+	Magic = "\x00BMENC1\n"
+
+	// ChunkSize is the plaintext carried by each chunk but the last.
+	ChunkSize = 64 << 10
+
+	saltSize   = 16
+	prefixSize = 7
+	// HeaderSize is the length of the header before the first chunk.
+	HeaderSize = len(Magic) + saltSize + prefixSize
+	// Overhead is what each chunk adds to its plaintext.
+	Overhead = 16
+)
+
+var (
+	// ErrNotStream is returned by NewReader for data without the header.
+	ErrNotStream = errors.New("streamcrypt: not an encrypted stream")
+	// ErrCorrupt is returned when a chunk fails authentication or the
+	// stream ends before its last chunk.
+	ErrCorrupt = errors.New("streamcrypt: stream is corrupt or truncated")
+)
+
+// IsStream reports whether data, at least the first len(Magic) bytes of a
+// stored object, begins an encrypted stream.
+func IsStream(data []byte) bool {
+	return len(data) >= len(Magic) && string(data[:len(Magic)]) == Magic
+}
+
+func newAEAD(key, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(Magic)), subkey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	n := make([]byte, 0, prefixSize+5)
+	n = append(n, prefix...)
+	n = binary.BigEndian.AppendUint32(n, counter)
+	if last {
+		return append(n, 1)
+	}
+	return append(n, 0)
+}
+
+type writer struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	sealed  []byte
+	closed  bool
+}
+
+// NewWriter returns a writer that encrypts to dst under key, which must be
+// 32 bytes. Close writes the last chunk and must be called; it does not
+// close dst.
+func NewWriter(dst io.Writer, key []byte) (io.WriteCloser, error) {
+	header := make([]byte, HeaderSize)
+	copy(header, Magic)
+	if _, err := io.ReadFull(rand.Reader, header[len(Magic):]); err != nil {
+		return nil, err
+	}
+	salt := header[len(Magic) : len(Magic)+saltSize]
+	aead, err := newAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+	return &writer{
+		dst:    dst,
+		aead:   aead,
+		prefix: header[len(Magic)+saltSize:],
+		buf:    make([]byte, 0, ChunkSize),
+		sealed: make([]byte, 0, ChunkSize+Overhead),
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("streamcrypt: write after close")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, since the
+		// last chunk has to be flagged as such
+		if len(w.buf) == ChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) flush(last bool) error {
+	if w.counter == math.MaxUint32 {
+		return errors.New("streamcrypt: stream too long")
+	}
+	w.sealed = w.aead.Seal(w.sealed[:0], nonce(w.prefix, w.counter, last), w.buf, nil)
+	if _, err := w.dst.Write(w.sealed); err != nil {
+		return err
+	}
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+type reader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+// NewReader returns a reader of the plaintext of the stream in src. Reads
+// fail with ErrCorrupt if the stream was tampered with or cut short, and a
+// caller must not act on what it has read until it reaches io.EOF.
+func NewReader(src io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotStream
+		}
+		return nil, err
+	}
+	if !IsStream(header) {
+		return nil, ErrNotStream
+	}
+	aead, err := newAEAD(key, header[len(Magic):len(Magic)+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		src:    bufio.NewReaderSize(src, ChunkSize+Overhead),
+		aead:   aead,
+		prefix: header[len(Magic)+saltSize:],
+		sealed: make([]byte, ChunkSize+Overhead),
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next opens the following chunk. A chunk is the last one when the data
+// ends with it, whether or not it is full.
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	last := false
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < Overhead {
+		return ErrCorrupt
+	}
+
+	plain, err := r.aead.Open(r.sealed[:0], nonce(r.prefix, r.counter, last), r.sealed[:n], nil)
+	if err != nil {
+		return ErrCorrupt
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/llm"
+)
+
+const (
+	summaryTimeout        = 2 * time.Minute
+	maxSummaryInput       = 24000 // characters sent to the model
+	summaryRegenPerMinute = 5
+)
+
+var (
+	summarizer     llm.Provider
+	summaryQueue   = make(chan summaryJob, 100)
+	summaryLimiter = newRateLimiter()
+)
+
+// summaryJob is an item waiting for generated text. Exactly one of backup
+// and project is set; text is the plaintext to summarize.
+type summaryJob struct {
+	backup  *Backup
+	project *Project
+	text    string
+}
+
+// initSummarizer configures generated titles, summaries and descriptions
+// from LLM_PROVIDER: "openai", "anthropic", or "local" for any server with
+// an OpenAI-compatible API. It stays disabled when unset.
+func initSummarizer() {
+	provider := config.Get("LLM_PROVIDER")
+	if provider == "" {
+		return
+	}
+	model := config.Get("LLM_MODEL")
+	if model == "" {
+		fatal("LLM_MODEL must be set when LLM_PROVIDER is")
+	}
+
+	switch provider {
+	case "openai":
+		summarizer = &llm.OpenAI{URL: config.Get("LLM_BASE_URL"), APIKey: config.Get("LLM_API_KEY"), Model: model}
+	case "anthropic":
+		summarizer = &llm.Anthropic{URL: config.Get("LLM_BASE_URL"), APIKey: config.Get("LLM_API_KEY"), Model: model}
+	case "local":
+		if config.Get("LLM_BASE_URL") == "" {
+			fatal("LLM_BASE_URL must be set when LLM_PROVIDER=local")
+		}
+		summarizer = &llm.OpenAI{URL: config.Get("LLM_BASE_URL"), APIKey: config.Get("LLM_API_KEY"), Model: model}
+	default:
+		fatal("Unknown LLM_PROVIDER", "provider", provider)
+	}
+
+	go runSummaryWorker()
+}
+
+// enqueueBackupSummary schedules a title and summary for a new backup. Only
+// text uploads are summarized, as those are the parsed conversations.
+func enqueueBackupSummary(b Backup, content []byte) {
+	if summarizer == nil || (b.FileType != "text" && b.FileType != "json") {
+		return
+	}
+	enqueueSummary(summaryJob{backup: &b, text: string(content)})
+}
+
+// enqueueProjectDescription schedules a description for a project extracted
+// from a backup.
+func enqueueProjectDescription(p Project) {
+	if summarizer == nil {
+		return
+	}
+	enqueueSummary(summaryJob{project: &p, text: p.Code})
+}
+
+func enqueueSummary(job summaryJob) {
+	select {
+	case summaryQueue <- job:
+	default:
+		slog.Warn("Summary queue full, skipping", "job", job.describe())
+	}
+}
+
+func (j summaryJob) describe() string {
+	if j.backup != nil {
+		return "backup " + j.backup.ID
+	}
+	return "project " + j.project.ID
+}
+
+func runSummaryWorker() {
+	for job := range summaryQueue {
+		waitOutMaintenance()
+
+		ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+		var err error
+		if job.backup != nil {
+			err = summarizeBackup(ctx, systemActor, job.backup, job.text)
+		} else {
+			err = describeProject(ctx, systemActor, job.project)
+		}
+		cancel()
+
+		if err != nil {
+			slog.Error("Summarizing failed", "job", job.describe(), "error", err)
+		}
+	}
+}
+
+const backupSummaryPrompt = `You summarize exported AI chat conversations for a personal archive.
+Reply with only a JSON object of the form {"title": "...", "summary": "..."}.
+The title is at most 8 words. The summary is 2 to 4 sentences on what was discussed and any conclusions.
+Write in the language of the conversation.`
+
+const projectDescriptionPrompt = `You describe code extracted from AI chat conversations for a project catalogue.
+Reply with only 1 to 3 plain sentences on what the code does and how it is used. Do not use markdown.`
+
+// summarizeBackup generates and saves a title and summary for b.
+func summarizeBackup(ctx context.Context, actor DomainActor, b *Backup, text string) error {
+	reply, err := summarizer.Complete(ctx, llm.Prompt{
+		System: backupSummaryPrompt,
+		User:   truncate(text, maxSummaryInput),
+	})
+	if err != nil {
+		return err
+	}
+
+	var generated struct {
+		Title   string `json:"title"`
+		Summary string `json:"summary"`
+	}
+	// Models sometimes wrap JSON in prose or code fences
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return fmt.Errorf("reply is not JSON: %q", truncate(reply, 200))
+	}
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &generated); err != nil {
+		return fmt.Errorf("decoding reply: %w", err)
+	}
+	if generated.Summary == "" {
+		return errors.New("reply has no summary")
+	}
+
+	before := *b
+	b.Title = truncate(strings.TrimSpace(generated.Title), 200)
+	b.Summary = strings.TrimSpace(generated.Summary)
+	b.SummaryModel = summarizer.Name()
+
+	if err := db.Backups().Update(ctx, *b); err != nil {
+		return fmt.Errorf("saving summary: %w", err)
+	}
+
+	recordDomainEvent(actor, DomainEvent{
+		Type:          "backup.updated",
+		AggregateType: aggregateBackup,
+		AggregateID:   b.ID,
+		OwnerID:       b.UserID,
+		Before:        snapshot(before),
+		After:         snapshot(*b),
+	}, map[string]interface{}{"fields": []string{"title", "summary", "summary_model"}})
+
+	indexDocuments(backupDocument(*b))
+	return nil
+}
+
+// describeProject generates and saves a description for p.
+func describeProject(ctx context.Context, actor DomainActor, p *Project) error {
+	input := fmt.Sprintf("Name: %s\nLanguage: %s\n\n%s", p.Name, p.Language, p.Code)
+	reply, err := summarizer.Complete(ctx, llm.Prompt{
+		System:    projectDescriptionPrompt,
+		User:      truncate(input, maxSummaryInput),
+		MaxTokens: 256,
+	})
+	if err != nil {
+		return err
+	}
+	if reply == "" {
+		return errors.New("empty reply")
+	}
+
+	before := *p
+	p.GeneratedDescription = reply
+	p.DescriptionModel = summarizer.Name()
+
+	if err := db.Projects().Update(ctx, *p); err != nil {
+		return fmt.Errorf("saving description: %w", err)
+	}
+	p.Version++
+
+	recordDomainEvent(actor, DomainEvent{
+		Type:          "project.updated",
+		AggregateType: aggregateProject,
+		AggregateID:   p.ID,
+		OwnerID:       p.UserID,
+		Before:        snapshot(before),
+		After:         snapshot(*p),
+	}, map[string]interface{}{"fields": []string{"generated_description", "description_model"}})
+
+	indexDocuments(projectDocument(*p))
+	return nil
+}
+
+// allowRegeneration writes the rejection and returns false when generation
+// is disabled or the caller is regenerating too often.
+func allowRegeneration(w http.ResponseWriter, userID string) bool {
+	if summarizer == nil {
+		http.Error(w, "Summaries are not enabled on this server", http.StatusNotImplemented)
+		return false
+	}
+	if allowed, _, retryAfter := summaryLimiter.allow(userID, summaryRegenPerMinute); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Too many requests, slow down", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// Handlers
+func regenerateBackupSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if !allowRegeneration(w, userID) {
+		return
+	}
+
+	backup, err := db.Backups().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+
+	plaintext, err := openBackup(r.Context(), backup)
+	if errors.Is(err, errDataKeyLocked) {
+		writeError(w, http.StatusLocked, errCodeDataKeyLocked, "Your data key is locked; log in again or restore it with your recovery key")
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Reading backup failed", "backup_id", id, "error", err)
+		http.Error(w, "Error decrypting backup", http.StatusInternalServerError)
+		return
+	}
+	// Uploads only summarize the start of a large file too
+	content, err := io.ReadAll(io.LimitReader(plaintext, maxProcessedBytes))
+	plaintext.Close()
+	if err != nil {
+		logger(r.Context()).Error("Reading backup failed", "backup_id", id, "error", err)
+		http.Error(w, "Error decrypting backup", http.StatusInternalServerError)
+		return
+	}
+	text := string(content)
+	if strings.TrimSpace(text) == "" {
+		http.Error(w, "Backup has no text to summarize", http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), summaryTimeout)
+	defer cancel()
+	if err := summarizeBackup(ctx, requestActor(r), &backup, text); err != nil {
+		logger(r.Context()).Error("Summarizing backup failed", "backup_id", id, "error", err)
+		http.Error(w, "Error generating summary", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":            backup.ID,
+		"title":         backup.Title,
+		"summary":       backup.Summary,
+		"summary_model": backup.SummaryModel,
+	})
+}
+
+func regenerateProjectDescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if !allowRegeneration(w, userID) {
+		return
+	}
+
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+
+	if strings.TrimSpace(project.Code) == "" {
+		http.Error(w, "Project has no code to describe", http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), summaryTimeout)
+	defer cancel()
+	if err := describeProject(ctx, requestActor(r), &project); err != nil {
+		logger(r.Context()).Error("Describing project failed", "project_id", id, "error", err)
+		http.Error(w, "Error generating description", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":                    project.ID,
+		"generated_description": project.GeneratedDescription,
+		"description_model":     project.DescriptionModel,
+	})
+}
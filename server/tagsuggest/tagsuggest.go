@@ -0,0 +1,192 @@
+// Package tagsuggest proposes tags for a piece of code from its language,
+// the frameworks it imports, and the tags its owner already uses.
+package tagsuggest
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Reasons a tag is suggested.
+const (
+	ReasonLanguage  = "language"
+	ReasonFramework = "framework"
+	ReasonHistory   = "previously_used"
+)
+
+// Suggestion is one proposed tag. Score orders suggestions; it is not a
+// probability.
+type Suggestion struct {
+	Tag    string  `json:"tag"`
+	Reason string  `json:"reason"`
+	Score  float64 `json:"score"`
+}
+
+// importPatterns find imported module names, per language family.
+var importPatterns = []*regexp.Regexp{
+	// Python
+	regexp.MustCompile(`(?m)^\s*(?:from\s+([\w.]+)\s+import|import\s+([\w.]+))`),
+	// JavaScript and TypeScript
+	regexp.MustCompile(`(?:import\s[^'"]*?from\s*|import\s*|require\(\s*)['"]([@\w][\w./@-]*)['"]`),
+	// Go, inside import blocks and single imports
+	regexp.MustCompile(`(?m)^\s*(?:import\s+)?(?:\w+\s+)?"([\w.-]+(?:/[\w.-]+)+)"`),
+	// Ruby
+	regexp.MustCompile(`(?m)^\s*require\s+['"]([\w/-]+)['"]`),
+	// Rust
+	regexp.MustCompile(`(?m)^\s*(?:use|extern\s+crate)\s+(\w+)`),
+	// Java and Kotlin
+	regexp.MustCompile(`(?m)^\s*import\s+(?:static\s+)?([\w.]+)`),
+	// C and C++
+	regexp.MustCompile(`(?m)^\s*#include\s*[<"]([\w./]+)[>"]`),
+}
+
+// frameworks maps an import, or the prefix of one, to the tag it suggests.
+var frameworks = map[string]string{
+	// Python
+	"django": "django", "flask": "flask", "fastapi": "fastapi", "pandas": "pandas",
+	"numpy": "numpy", "torch": "pytorch", "tensorflow": "tensorflow", "sklearn": "scikit-learn",
+	"requests": "http", "sqlalchemy": "sqlalchemy", "pytest": "testing", "asyncio": "async",
+	"matplotlib": "data-viz", "openai": "openai", "anthropic": "anthropic", "langchain": "langchain",
+	// JavaScript and TypeScript
+	"react": "react", "react-dom": "react", "next": "nextjs", "vue": "vue", "@angular": "angular",
+	"svelte": "svelte", "express": "express", "axios": "http", "socket.io": "websocket", "ws": "websocket",
+	"jest": "testing", "vitest": "testing", "mongoose": "mongodb", "prisma": "prisma", "@prisma": "prisma",
+	"three": "threejs", "d3": "data-viz", "tailwindcss": "tailwind", "electron": "electron",
+	// Go
+	"github.com/gorilla/mux": "gorilla", "github.com/gorilla/websocket": "websocket",
+	"github.com/gin-gonic/gin": "gin", "github.com/labstack/echo": "echo", "github.com/spf13/cobra": "cli",
+	"gorm.io/gorm": "gorm", "github.com/lib/pq": "postgres", "github.com/jackc/pgx": "postgres",
+	"google.golang.org/grpc": "grpc", "github.com/stretchr/testify": "testing",
+	// Ruby
+	"rails": "rails", "sinatra": "sinatra", "rspec": "testing",
+	// Rust
+	"tokio": "async", "serde": "serde", "actix_web": "actix", "axum": "axum", "rocket": "rocket",
+	// Java and Kotlin
+	"org.springframework": "spring", "org.junit": "testing", "android": "android",
+	// C and C++
+	"Qt": "qt", "opencv2": "opencv", "SDL2": "sdl",
+}
+
+// FrameworkTags returns the tags for frameworks imported by code, sorted.
+func FrameworkTags(code string) []string {
+	found := make(map[string]bool)
+	for _, pattern := range importPatterns {
+		for _, m := range pattern.FindAllStringSubmatch(code, -1) {
+			for _, name := range m[1:] {
+				if name == "" {
+					continue
+				}
+				if tag, ok := lookupFramework(name); ok {
+					found[tag] = true
+				}
+			}
+		}
+	}
+
+	tags := make([]string, 0, len(found))
+	for tag := range found {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// lookupFramework matches an import against frameworks, trying the whole
+// name and then shorter prefixes ("django.db.models" -> "django").
+func lookupFramework(name string) (string, bool) {
+	for {
+		if tag, ok := frameworks[name]; ok {
+			return tag, true
+		}
+		i := strings.LastIndexAny(name, "./")
+		if i <= 0 {
+			return "", false
+		}
+		name = name[:i]
+	}
+}
+
+// normalize makes tags comparable: "React.js", "react" and "reactjs" are the
+// same tag.
+func normalize(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	tag = strings.NewReplacer(" ", "-", "_", "-").Replace(tag)
+	for _, suffix := range []string{".js", "js"} {
+		if strings.HasSuffix(tag, suffix) && len(tag) > len(suffix)+1 {
+			tag = strings.TrimSuffix(tag, suffix)
+			break
+		}
+	}
+	return tag
+}
+
+var wordPattern = regexp.MustCompile(`[A-Za-z][A-Za-z0-9]+`)
+
+// Suggest proposes up to limit tags for code in language. used maps the
+// owner's existing tags to how many items carry them, and existing are the
+// item's current tags, which are never suggested again. When a suggestion
+// matches a tag the owner already uses, the owner's spelling wins.
+func Suggest(code, language string, used map[string]int, existing []string, limit int) []Suggestion {
+	spelling := make(map[string]string)
+	for tag := range used {
+		spelling[normalize(tag)] = tag
+	}
+	skip := make(map[string]bool)
+	for _, tag := range existing {
+		skip[normalize(tag)] = true
+	}
+
+	best := make(map[string]Suggestion)
+	add := func(tag, reason string, score float64) {
+		key := normalize(tag)
+		if key == "" || skip[key] {
+			return
+		}
+		if own, ok := spelling[key]; ok {
+			tag = own
+			// Consistency with the owner's tags is worth a little extra
+			score += 0.1
+		}
+		if s, ok := best[key]; !ok || score > s.Score {
+			best[key] = Suggestion{Tag: tag, Reason: reason, Score: score}
+		}
+	}
+
+	if language != "" {
+		add(strings.ToLower(language), ReasonLanguage, 0.9)
+	}
+	for _, tag := range FrameworkTags(code) {
+		add(tag, ReasonFramework, 0.8)
+	}
+
+	// Tags the owner uses elsewhere whose words appear in the code
+	words := make(map[string]bool)
+	for _, w := range wordPattern.FindAllString(code, -1) {
+		words[strings.ToLower(w)] = true
+	}
+	total := 0
+	for _, n := range used {
+		total += n
+	}
+	for tag, n := range used {
+		if words[normalize(tag)] || words[strings.ToLower(tag)] {
+			add(tag, ReasonHistory, 0.4+0.3*float64(n)/float64(total))
+		}
+	}
+
+	suggestions := make([]Suggestion, 0, len(best))
+	for _, s := range best {
+		suggestions = append(suggestions, s)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].Tag < suggestions[j].Tag
+	})
+	if limit > 0 && len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"backup-manager/search"
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const teamInviteTTL = 7 * 24 * time.Hour
+
+// teamRoleRank orders team roles, as roleRank does account roles, so what
+// is open to a role is open to every role above it.
+var teamRoleRank = map[string]int{
+	storage.TeamViewer: 1,
+	storage.TeamEditor: 2,
+	storage.TeamOwner:  3,
+}
+
+// workspaceMiddleware puts a request in the workspace it works on. With an
+// X-Team-ID header that is the team's, which the caller must be a member
+// of, and only editors and owners can make changes in it; without one it
+// is the caller's own records, leaving out what they made in teams. The
+// /api/teams routes check roles in the team in their path themselves.
+func workspaceMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		teamID := r.Header.Get("X-Team-ID")
+		if teamID == "" {
+			next(w, r.WithContext(storage.WithPersonal(r.Context())))
+			return
+		}
+
+		member, err := db.Teams().Member(r.Context(), teamID, r.Header.Get("X-User-ID"))
+		if err != nil {
+			writeStorageError(w, r, err, "Team")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !teamRoleAtLeast(member, storage.TeamEditor) {
+			writeError(w, http.StatusForbidden, errCodeTeamRoleRequired, "Viewers can't make changes in the team")
+			return
+		}
+		addLogAttrs(r, "team_id", teamID)
+		next(w, r.WithContext(storage.WithTeam(r.Context(), teamID)))
+	}
+}
+
+func teamRoleAtLeast(member storage.TeamMember, role string) bool {
+	return teamRoleRank[member.Role] >= teamRoleRank[role]
+}
+
+// loadTeamMembership loads the team in the request's path with the caller's
+// membership of it, answering for the handler if they aren't a member or
+// their role is below role. Teams the caller isn't in are not found, as
+// with anything else of someone else's.
+func loadTeamMembership(w http.ResponseWriter, r *http.Request, role string) (storage.Team, storage.TeamMember, bool) {
+	teamID := mux.Vars(r)["id"]
+	member, err := db.Teams().Member(r.Context(), teamID, r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Team")
+		return storage.Team{}, storage.TeamMember{}, false
+	}
+	if !teamRoleAtLeast(member, role) {
+		writeError(w, http.StatusForbidden, errCodeTeamRoleRequired, "This requires the "+role+" role in the team")
+		return storage.Team{}, storage.TeamMember{}, false
+	}
+	team, err := db.Teams().Get(r.Context(), teamID)
+	if err != nil {
+		writeStorageError(w, r, err, "Team")
+		return storage.Team{}, storage.TeamMember{}, false
+	}
+	team.Role = member.Role
+	return team, member, true
+}
+
+// countOwners counts the owners among members, which a team never runs
+// out of.
+func countOwners(members []storage.TeamMember) int {
+	n := 0
+	for _, m := range members {
+		if m.Role == storage.TeamOwner {
+			n++
+		}
+	}
+	return n
+}
+
+// deleteTeam deletes a team with everything in it: its backups, in the
+// trash or not, with their blobs, and its projects and QR codes, which go
+// with its row. It refuses while a legal hold covers one of its backups.
+func deleteTeam(ctx context.Context, teamID string) error {
+	ctx = storage.WithTeam(ctx, teamID)
+	backups, err := db.Backups().List(ctx, "")
+	if err != nil {
+		return err
+	}
+	trashed, err := db.Backups().ListTrashed(ctx, "")
+	if err != nil {
+		return err
+	}
+	projects, err := db.Projects().List(ctx, "")
+	if err != nil {
+		return err
+	}
+	holds, err := legalHolds.active(ctx)
+	if err != nil {
+		return err
+	}
+	backups = append(backups, trashed...)
+	for _, b := range backups {
+		if len(heldBy(holds, b.ID, b.UserID)) > 0 {
+			return errLegalHold
+		}
+	}
+
+	var docs []string
+	for _, b := range backups {
+		if err := purgeBackup(ctx, b); err != nil {
+			return fmt.Errorf("purging backup %s: %w", b.ID, err)
+		}
+		docs = append(docs, search.DocumentID(search.TypeBackup, b.ID))
+	}
+	for _, p := range projects {
+		docs = append(docs, search.DocumentID(search.TypeProject, p.ID))
+	}
+	if len(docs) > 0 {
+		removeDocuments(docs...)
+	}
+	// Invites go with the team's row
+	return db.Teams().Delete(ctx, teamID)
+}
+
+// leaveTeams takes a user out of their teams before their account is
+// deleted. A team they are alone in is deleted; one they are the last
+// owner of passes to its longest-standing other member.
+func leaveTeams(ctx context.Context, userID string) error {
+	teams, err := db.Teams().ListForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, team := range teams {
+		members, err := db.Teams().Members(ctx, team.ID)
+		if err != nil {
+			return err
+		}
+		if len(members) == 1 {
+			if err := deleteTeam(ctx, team.ID); err != nil {
+				return fmt.Errorf("deleting team %s: %w", team.ID, err)
+			}
+			continue
+		}
+		if team.Role == storage.TeamOwner && countOwners(members) == 1 {
+			for _, m := range members {
+				if m.UserID != userID {
+					if err := db.Teams().SetMemberRole(ctx, team.ID, m.UserID, storage.TeamOwner); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Invites
+
+// TeamInvite asks someone, by email, to join a team; see
+// storage.TeamInvite.
+type TeamInvite = storage.TeamInvite
+
+// createTeamInvite saves an invite in place of any of the same address to
+// the team and returns the plaintext token.
+func createTeamInvite(ctx context.Context, teamID, email, role, invitedBy string) (TeamInvite, string, error) {
+	token := generateToken()
+	now := time.Now()
+	invite := TeamInvite{
+		ID:        generateID(),
+		TeamID:    teamID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: invitedBy,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(teamInviteTTL),
+	}
+	if err := db.Teams().CreateInvite(ctx, invite); err != nil {
+		return TeamInvite{}, "", err
+	}
+	return invite, token, nil
+}
+
+func sendTeamInvite(invite TeamInvite, team storage.Team, inviter, token string) error {
+	return sendEmail(invite.Email, "You're invited to join "+team.Name,
+		inviter+" invited you to join the team "+team.Name+" as "+article(invite.Role)+" "+invite.Role+".\n\n"+
+			"To accept, log in with this address, or sign up with it, and open: "+
+			frontendLink("/teams/invites/accept?token="+token)+"\n\n"+
+			"The invite expires in 7 days. If you weren't expecting it, you can ignore this email.")
+}
+
+func article(word string) string {
+	if strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an"
+	}
+	return "a"
+}
+
+// Handlers
+
+// createTeamHandler starts a team with the caller as its owner.
+func createTeamHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Name string `json:"name" validate:"required,max=100"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		writeFieldError(w, "name", "required", "name is required")
+		return
+	}
+
+	team := storage.Team{ID: generateID(), Name: name, CreatedAt: time.Now(), Role: storage.TeamOwner}
+	if err := db.Teams().Create(r.Context(), team, userID); err != nil {
+		writeStorageError(w, r, err, "Team")
+		return
+	}
+	recordAudit(r, AuditEvent{Action: "team.created", ResourceType: "team", ResourceID: team.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(team)
+}
+
+// listTeamsHandler lists the teams the caller is in, with their role in
+// each.
+func listTeamsHandler(w http.ResponseWriter, r *http.Request) {
+	teams, err := db.Teams().ListForUser(r.Context(), r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Teams")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teams)
+}
+
+// getTeamHandler answers a team with its members, for any member.
+func getTeamHandler(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := loadTeamMembership(w, r, storage.TeamViewer)
+	if !ok {
+		return
+	}
+	members, err := db.Teams().Members(r.Context(), team.ID)
+	if err != nil {
+		writeStorageError(w, r, err, "Team members")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"team": team, "members": members})
+}
+
+// updateTeamHandler renames a team.
+func updateTeamHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name" validate:"required,max=100"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		writeFieldError(w, "name", "required", "name is required")
+		return
+	}
+
+	team, _, ok := loadTeamMembership(w, r, storage.TeamOwner)
+	if !ok {
+		return
+	}
+	if err := db.Teams().Rename(r.Context(), team.ID, name); err != nil {
+		writeStorageError(w, r, err, "Team")
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "team.renamed",
+		ResourceType: "team",
+		ResourceID:   team.ID,
+		Metadata:     map[string]interface{}{"from": team.Name, "to": name},
+	})
+	team.Name = name
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(team)
+}
+
+// deleteTeamHandler deletes a team and everything in it at once; unlike a
+// backup, a team doesn't go to the trash.
+func deleteTeamHandler(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := loadTeamMembership(w, r, storage.TeamOwner)
+	if !ok {
+		return
+	}
+	err := deleteTeam(r.Context(), team.ID)
+	if errors.Is(err, errLegalHold) {
+		writeError(w, http.StatusConflict, "legal_hold", "A backup in this team is under legal hold, so the team can't be deleted now")
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Error deleting team", "team_id", team.ID, "error", err)
+		writeError(w, http.StatusInternalServerError, errCodeDatabase, "Error deleting team")
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "team.deleted",
+		ResourceType: "team",
+		ResourceID:   team.ID,
+		Metadata:     map[string]interface{}{"name": team.Name},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createTeamInviteHandler emails someone an invite to join the team with a
+// role. Inviting the same address again replaces its invite.
+func createTeamInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email" validate:"required,email"`
+		Role  string `json:"role" validate:"required,oneof=viewer editor owner"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+
+	team, _, ok := loadTeamMembership(w, r, storage.TeamOwner)
+	if !ok {
+		return
+	}
+	members, err := db.Teams().Members(r.Context(), team.ID)
+	if err != nil {
+		writeStorageError(w, r, err, "Team members")
+		return
+	}
+	for _, m := range members {
+		if strings.EqualFold(m.Email, email) {
+			http.Error(w, email+" is already a member of the team", http.StatusConflict)
+			return
+		}
+	}
+
+	invite, token, err := createTeamInvite(r.Context(), team.ID, email, req.Role, r.Header.Get("X-User-ID"))
+	if err != nil {
+		writeStorageError(w, r, err, "Invite")
+		return
+	}
+	if err := sendTeamInvite(invite, team, r.Header.Get("X-User-Email"), token); err != nil {
+		logger(r.Context()).Error("Error sending team invite", "team_id", team.ID, "error", err)
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "team.member_invited",
+		ResourceType: "team",
+		ResourceID:   team.ID,
+		Metadata:     map[string]interface{}{"invite_id": invite.ID, "role": invite.Role},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+func listTeamInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := loadTeamMembership(w, r, storage.TeamOwner)
+	if !ok {
+		return
+	}
+	invites, err := db.Teams().Invites(r.Context(), team.ID, time.Now())
+	if err != nil {
+		writeStorageError(w, r, err, "Invites")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+func deleteTeamInviteHandler(w http.ResponseWriter, r *http.Request) {
+	team, _, ok := loadTeamMembership(w, r, storage.TeamOwner)
+	if !ok {
+		return
+	}
+	inviteID := mux.Vars(r)["inviteId"]
+	if err := db.Teams().DeleteInvite(r.Context(), team.ID, inviteID); err != nil {
+		writeStorageError(w, r, err, "Invite")
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "team.invite_revoked",
+		ResourceType: "team",
+		ResourceID:   team.ID,
+		Metadata:     map[string]interface{}{"invite_id": inviteID},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// acceptTeamInviteHandler makes the caller a member of the team they were
+// invited to. The invite only works for the account with the address it
+// was sent to, so a forwarded email can't be used by someone else.
+func acceptTeamInviteHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Token string `json:"token" validate:"required"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	invite, err := db.Teams().InviteByToken(r.Context(), hashToken(req.Token), time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "Invalid or expired invite", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Invite")
+		return
+	}
+	user, err := db.Users().Get(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+	if !strings.EqualFold(user.Email, invite.Email) {
+		http.Error(w, "This invite was sent to another email address", http.StatusForbidden)
+		return
+	}
+
+	err = db.Teams().AddMember(r.Context(), storage.TeamMember{
+		TeamID:   invite.TeamID,
+		UserID:   userID,
+		Role:     invite.Role,
+		JoinedAt: time.Now(),
+	})
+	if errors.Is(err, storage.ErrConflict) {
+		db.Teams().DeleteInvite(r.Context(), invite.TeamID, invite.ID)
+		http.Error(w, "You are already a member of this team", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, err, "Team")
+		return
+	}
+	if err := db.Teams().DeleteInvite(r.Context(), invite.TeamID, invite.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger(r.Context()).Error("Error deleting accepted invite", "invite_id", invite.ID, "error", err)
+	}
+
+	team, err := db.Teams().Get(r.Context(), invite.TeamID)
+	if err != nil {
+		writeStorageError(w, r, err, "Team")
+		return
+	}
+	team.Role = invite.Role
+	recordAudit(r, AuditEvent{
+		Action:       "team.member_joined",
+		ResourceType: "team",
+		ResourceID:   team.ID,
+		Metadata:     map[string]interface{}{"invite_id": invite.ID, "role": invite.Role},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(team)
+}
+
+// updateTeamMemberHandler changes a member's role. The last owner can't be
+// made anything else, so a team always has someone who can manage it.
+func updateTeamMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role string `json:"role" validate:"required,oneof=viewer editor owner"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	team, _, ok := loadTeamMembership(w, r, storage.TeamOwner)
+	if !ok {
+		return
+	}
+	memberID := mux.Vars(r)["userId"]
+	member, ok := loadTeamMember(w, r, team.ID, memberID)
+	if !ok {
+		return
+	}
+	if member.Role == storage.TeamOwner && req.Role != storage.TeamOwner {
+		members, err := db.Teams().Members(r.Context(), team.ID)
+		if err != nil {
+			writeStorageError(w, r, err, "Team members")
+			return
+		}
+		if countOwners(members) == 1 {
+			http.Error(w, "The team's last owner must stay an owner", http.StatusConflict)
+			return
+		}
+	}
+	if err := db.Teams().SetMemberRole(r.Context(), team.ID, memberID, req.Role); err != nil {
+		writeStorageError(w, r, err, "Team member")
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "team.member_role_changed",
+		ResourceType: "team",
+		ResourceID:   team.ID,
+		Metadata:     map[string]interface{}{"user_id": memberID, "from": member.Role, "to": req.Role},
+	})
+	member.Role = req.Role
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+}
+
+// removeTeamMemberHandler takes a member out of a team: an owner removing
+// anyone, or a member leaving. What they made stays with the team. The last
+// owner can't leave; they can make someone else an owner or delete the
+// team.
+func removeTeamMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	memberID := mux.Vars(r)["userId"]
+
+	role := storage.TeamOwner
+	if memberID == userID {
+		role = storage.TeamViewer
+	}
+	team, _, ok := loadTeamMembership(w, r, role)
+	if !ok {
+		return
+	}
+	member, ok := loadTeamMember(w, r, team.ID, memberID)
+	if !ok {
+		return
+	}
+	if member.Role == storage.TeamOwner {
+		members, err := db.Teams().Members(r.Context(), team.ID)
+		if err != nil {
+			writeStorageError(w, r, err, "Team members")
+			return
+		}
+		if countOwners(members) == 1 {
+			http.Error(w, "The team's last owner can't leave; make someone else an owner or delete the team", http.StatusConflict)
+			return
+		}
+	}
+	if err := db.Teams().RemoveMember(r.Context(), team.ID, memberID); err != nil {
+		writeStorageError(w, r, err, "Team member")
+		return
+	}
+	action := "team.member_removed"
+	if memberID == userID {
+		action = "team.member_left"
+	}
+	recordAudit(r, AuditEvent{
+		Action:       action,
+		ResourceType: "team",
+		ResourceID:   team.ID,
+		Metadata:     map[string]interface{}{"user_id": memberID, "role": member.Role},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func loadTeamMember(w http.ResponseWriter, r *http.Request, teamID, userID string) (storage.TeamMember, bool) {
+	member, err := db.Teams().Member(r.Context(), teamID, userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Team member")
+		return storage.TeamMember{}, false
+	}
+	return member, true
+}
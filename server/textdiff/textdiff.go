@@ -0,0 +1,240 @@
+// Package textdiff compares text line by line, with Myers' algorithm, and
+// writes the result as a unified diff, the format of diff -u and git.
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxEdits bounds the search for the shortest edit script, whose memory
+// grows with its square. Texts further apart are shown as one replacement.
+const maxEdits = 1000
+
+type Op int
+
+const (
+	Equal Op = iota
+	Delete
+	Insert
+)
+
+// Edit is one line of the script turning a into b. A and B are the line's
+// index in a and b; for an insert, A is where it goes in a, and for a
+// delete, B is where it would have been in b.
+type Edit struct {
+	Op   Op
+	A, B int
+	Line string
+}
+
+// Lines splits text into lines without their line endings.
+func Lines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Diff returns a shortest edit script from the lines of a to those of b.
+func Diff(a, b string) []Edit {
+	return DiffLines(Lines(a), Lines(b))
+}
+
+// DiffLines returns a shortest edit script from al to bl, whose elements
+// needn't be lines of text: any strings equal when they are the same.
+func DiffLines(al, bl []string) []Edit {
+	// Lines in common at either end need no search
+	prefix := 0
+	for prefix < len(al) && prefix < len(bl) && al[prefix] == bl[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(al)-prefix && suffix < len(bl)-prefix && al[len(al)-1-suffix] == bl[len(bl)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]Edit, 0, len(al)+len(bl))
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, Edit{Equal, i, i, al[i]})
+	}
+	for _, e := range myers(al[prefix:len(al)-suffix], bl[prefix:len(bl)-suffix]) {
+		e.A += prefix
+		e.B += prefix
+		edits = append(edits, e)
+	}
+	for i := suffix; i > 0; i-- {
+		edits = append(edits, Edit{Equal, len(al) - i, len(bl) - i, al[len(al)-i]})
+	}
+	return edits
+}
+
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxEdits)
+	// v[k+offset] is how far along a the furthest path on diagonal k got
+	offset := limit + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, d)
+			}
+		}
+	}
+	return replace(a, b)
+}
+
+// backtrack follows the furthest paths recorded in trace, the v of each
+// round d clipped to diagonals -d..d, back from the end of both texts.
+func backtrack(a, b []string, trace [][]int, d int) []Edit {
+	var edits []Edit
+	x, y := len(a), len(b)
+	for ; d > 0; d-- {
+		prev := trace[d] // v as round d started, so as round d-1 left it
+		at := func(k int) int { return prev[k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, Edit{Equal, x, y, a[x]})
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, Edit{Insert, x, y, b[y]})
+		} else {
+			x--
+			edits = append(edits, Edit{Delete, x, y, a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		edits = append(edits, Edit{Equal, x, y, a[x]})
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// replace is the script deleting all of a and inserting all of b.
+func replace(a, b []string) []Edit {
+	edits := make([]Edit, 0, len(a)+len(b))
+	for i, line := range a {
+		edits = append(edits, Edit{Delete, i, 0, line})
+	}
+	for i, line := range b {
+		edits = append(edits, Edit{Insert, len(a), i, line})
+	}
+	return edits
+}
+
+// Count returns how many lines the edits add and remove.
+func Count(edits []Edit) (added, removed int) {
+	for _, e := range edits {
+		switch e.Op {
+		case Insert:
+			added++
+		case Delete:
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// Unified writes edits as a unified diff between files named from and to,
+// with context unchanged lines around each change. It is empty when the
+// texts are the same.
+func Unified(edits []Edit, from, to string, context int) string {
+	var out strings.Builder
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+		// A hunk runs from context lines before this change to context
+		// lines after the last change less than 2*context lines later
+		start := max(0, i-context)
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].Op != Equal {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		end = min(len(edits), end+context)
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", from, to)
+		}
+		writeHunk(&out, edits[start:end])
+		i = end
+	}
+	return out.String()
+}
+
+func writeHunk(out *strings.Builder, hunk []Edit) {
+	aLen, bLen := 0, 0
+	for _, e := range hunk {
+		if e.Op != Insert {
+			aLen++
+		}
+		if e.Op != Delete {
+			bLen++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(hunk[0].A, aLen), hunkRange(hunk[0].B, bLen))
+	for _, e := range hunk {
+		switch e.Op {
+		case Equal:
+			out.WriteString(" ")
+		case Delete:
+			out.WriteString("-")
+		case Insert:
+			out.WriteString("+")
+		}
+		out.WriteString(e.Line)
+		out.WriteString("\n")
+	}
+}
+
+// hunkRange is a hunk's start line and length; an empty range starts at
+// the line before it.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	xdraw "golang.org/x/image/draw"
+
+	"backup-manager/config"
+)
+
+// Thumbnail sizes, as the longest edge in pixels.
+var thumbnailSizes = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  512,
+}
+
+var safePathComponent = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+const (
+	defaultThumbnailSize = "medium"
+	thumbnailQuality     = 80
+	thumbnailMaxPixels   = 50_000_000 // refuse to decode anything larger
+)
+
+func thumbnailDir() string {
+	if dir := config.Get("THUMBNAIL_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "backup-manager-thumbnails")
+}
+
+// isSafePathComponent guards IDs that end up in file paths.
+func isSafePathComponent(id string) bool {
+	return safePathComponent.MatchString(id)
+}
+
+func thumbnailPath(ownerID, itemID, size string) string {
+	return filepath.Join(thumbnailDir(), ownerID, itemID, size+".jpg.enc")
+}
+
+// generateThumbnails renders every thumbnail size for an image and caches
+// them, encrypted like the originals, under the owner's directory. It is
+// used for image backups and for attachments extracted from exports.
+func generateThumbnails(ownerID, itemID string, content []byte) error {
+	if !isSafePathComponent(ownerID) || !isSafePathComponent(itemID) {
+		return fmt.Errorf("invalid thumbnail owner or item ID")
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return fmt.Errorf("image too large for thumbnailing: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(thumbnailPath(ownerID, itemID, "")), 0o700); err != nil {
+		return err
+	}
+
+	for size, edge := range thumbnailSizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeToFit(src, edge), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return err
+		}
+
+		encrypted, err := encrypt(buf.String())
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(thumbnailPath(ownerID, itemID, size), []byte(encrypted), 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resizeToFit scales src so its longest edge is at most edge pixels,
+// flattening transparency onto white since the output is JPEG.
+func resizeToFit(src image.Image, edge int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > edge || h > edge {
+		if w >= h {
+			w, h = edge, max(1, h*edge/w)
+		} else {
+			w, h = max(1, w*edge/h), edge
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, xdraw.Src)
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, b, xdraw.Over, nil)
+	return dst
+}
+
+func loadThumbnail(ownerID, itemID, size string) ([]byte, error) {
+	encrypted, err := os.ReadFile(thumbnailPath(ownerID, itemID, size))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decrypt(string(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(plaintext), nil
+}
+
+// serveThumbnail writes a cached thumbnail with caching headers. Thumbnails
+// never change once generated, so the ETag is a hash of the image itself.
+func serveThumbnail(w http.ResponseWriter, r *http.Request, ownerID, itemID string) {
+	if !isSafePathComponent(ownerID) || !isSafePathComponent(itemID) {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = defaultThumbnailSize
+	}
+	if _, ok := thumbnailSizes[size]; !ok {
+		http.Error(w, "size must be small, medium or large", http.StatusBadRequest)
+		return
+	}
+
+	data, err := loadThumbnail(ownerID, itemID, size)
+	if os.IsNotExist(err) {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error loading thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("Cache-Control", "private, max-age=86400, immutable")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(data)
+}
+
+// Handlers
+func getBackupThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	// Thumbnails live under the directory of the backup's owner, who in a
+	// team may be another member, so the backup is looked up in the
+	// caller's workspace first
+	backup, err := db.Backups().Get(r.Context(), r.Header.Get("X-User-ID"), mux.Vars(r)["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Thumbnail")
+		return
+	}
+	serveThumbnail(w, r, backup.UserID, backup.ID)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"backup-manager/config"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server speaks TLS, and with it HTTP/2, when given a certificate.
+// TLS_CERT_FILE and TLS_KEY_FILE name one to use. DOMAIN, a comma-separated
+// list of host names, has one obtained from Let's Encrypt and renewed
+// instead: ACME_EMAIL is given to it for expiry notices, ACME_CACHE_DIR
+// keeps the certificate between restarts and ACME_DIRECTORY_URL picks
+// another authority, such as Let's Encrypt's staging one. With DOMAIN, PORT
+// defaults to 443 and HTTP_PORT, 80 by default, answers the authority's
+// challenges and redirects everything else to HTTPS. Without either the
+// server speaks plain HTTP, for a proxy in front to terminate TLS.
+
+const defaultACMECacheDir = "certs"
+
+func tlsDomains() []string {
+	var domains []string
+	for _, d := range strings.Split(config.Get("DOMAIN"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// defaultPort is the port served when PORT is unset.
+func defaultPort() string {
+	if len(tlsDomains()) > 0 {
+		return "443"
+	}
+	return "8080"
+}
+
+// configureTLS sets srv up to speak TLS if configured to and returns how to
+// start it, along with the plain HTTP server to run beside it, if any.
+func configureTLS(srv *http.Server) (start func() error, companion *http.Server) {
+	certFile, keyFile := config.Get("TLS_CERT_FILE"), config.Get("TLS_KEY_FILE")
+	domains := tlsDomains()
+
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		if len(domains) > 0 {
+			fatal("Set either DOMAIN or TLS_CERT_FILE, not both")
+		}
+		// Fail at startup rather than on the first connection
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			fatal("Error loading TLS certificate", "error", err)
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		slog.Info("Serving TLS", "certificate", certFile)
+		return func() error { return srv.ListenAndServeTLS(certFile, keyFile) }, nil
+
+	case len(domains) > 0:
+		dir := config.Get("ACME_CACHE_DIR")
+		if dir == "" {
+			dir = defaultACMECacheDir
+		}
+		certs := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(dir),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      config.Get("ACME_EMAIL"),
+		}
+		if url := config.Get("ACME_DIRECTORY_URL"); url != "" {
+			certs.Client = &acme.Client{DirectoryURL: url}
+		}
+		srv.TLSConfig = certs.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+
+		httpPort := config.Get("HTTP_PORT")
+		if httpPort == "" {
+			httpPort = "80"
+		}
+		companion = &http.Server{
+			Addr:              ":" + httpPort,
+			Handler:           certs.HTTPHandler(redirectToHTTPS(domains, srv.Addr)),
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+		}
+		slog.Info("Serving TLS with certificates from ACME", "domains", domains, "http_port", httpPort)
+		return func() error { return srv.ListenAndServeTLS("", "") }, companion
+	}
+	return srv.ListenAndServe, nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same path over HTTPS on
+// addr. Hosts other than domains go to the first, so the Host header can't
+// redirect anywhere else.
+func redirectToHTTPS(domains []string, addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := domains[0]
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			r.Host = h
+		}
+		for _, d := range domains {
+			if strings.EqualFold(d, r.Host) {
+				host = d
+				break
+			}
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/search"
+	"backup-manager/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultTrashRetentionDays = 30
+	// Records purged per retention run, of each kind
+	purgeTrashBatch = 500
+)
+
+// trashRetention is how long deleted backups and projects can be restored
+// before retention purges them: TRASH_RETENTION_DAYS, or 30 days.
+func trashRetention() time.Duration {
+	days, err := strconv.Atoi(config.Get("TRASH_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultTrashRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func purgeAt(deletedAt *time.Time) time.Time {
+	if deletedAt == nil {
+		return time.Time{}
+	}
+	return deletedAt.Add(trashRetention())
+}
+
+// trashSearchDocuments are the search documents of a backup and the projects
+// extracted from it, which leave the index while they are in the trash.
+func trashSearchDocuments(ctx context.Context, userID, backupID string) ([]string, error) {
+	projects, err := db.Projects().List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{search.DocumentID(search.TypeBackup, backupID)}
+	for _, p := range projects {
+		if p.BackupID == backupID {
+			ids = append(ids, search.DocumentID(search.TypeProject, p.ID))
+		}
+	}
+	return ids, nil
+}
+
+// purgeBackup deletes a trashed backup for good: its row, the projects
+// extracted from it, its thumbnails and its blob.
+func purgeBackup(ctx context.Context, b Backup) error {
+	if err := db.Backups().Delete(ctx, b.UserID, b.ID); err != nil {
+		return err
+	}
+	if isSafePathComponent(b.UserID) && isSafePathComponent(b.ID) {
+		if err := os.RemoveAll(filepath.Dir(thumbnailPath(b.UserID, b.ID, ""))); err != nil {
+			logger(ctx).Error("Error removing thumbnails", "backup_id", b.ID, "error", err)
+		}
+	}
+	deleteBackupBlob(ctx, b.UserID, b.ID)
+	return nil
+}
+
+// projectHeld returns the IDs of the holds covering the backup a project
+// was extracted from.
+func projectHeld(holds []LegalHold, p Project) []string {
+	if p.BackupID == "" {
+		return nil
+	}
+	return heldBy(holds, p.BackupID, p.UserID)
+}
+
+// purgeExpiredTrash purges backups and projects that have been in the trash
+// longer than trashRetention. Backups under legal hold stay in the trash
+// until the hold is released.
+func purgeExpiredTrash() {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-trashRetention())
+
+	holds, err := legalHolds.active(ctx)
+	if err != nil {
+		slog.Error("Error loading legal holds", "error", err)
+		return
+	}
+	backups, err := db.Backups().ListTrashedBefore(ctx, cutoff, purgeTrashBatch)
+	if err != nil {
+		slog.Error("Error loading trashed backups", "error", err)
+		return
+	}
+	for _, b := range backups {
+		if len(heldBy(holds, b.ID, b.UserID)) > 0 {
+			continue
+		}
+		if err := purgeBackup(ctx, b); err != nil {
+			slog.Error("Error purging backup", "backup_id", b.ID, "error", err)
+			continue
+		}
+		recordDomainEvent(systemActor, DomainEvent{
+			Type:          "backup.purged",
+			AggregateType: aggregateBackup,
+			AggregateID:   b.ID,
+			OwnerID:       b.UserID,
+			Before:        snapshot(b),
+		}, nil)
+	}
+
+	// Listed after the backups, whose projects went with them
+	projects, err := db.Projects().ListTrashedBefore(ctx, cutoff, purgeTrashBatch)
+	if err != nil {
+		slog.Error("Error loading trashed projects", "error", err)
+		return
+	}
+	for _, p := range projects {
+		if len(projectHeld(holds, p)) > 0 {
+			continue
+		}
+		if err := db.Projects().Delete(ctx, p.UserID, p.ID); err != nil {
+			slog.Error("Error purging project", "project_id", p.ID, "error", err)
+			continue
+		}
+		recordDomainEvent(systemActor, DomainEvent{
+			Type:          "project.purged",
+			AggregateType: aggregateProject,
+			AggregateID:   p.ID,
+			OwnerID:       p.UserID,
+			Before:        snapshot(p),
+		}, nil)
+	}
+}
+
+type trashedBackup struct {
+	Backup
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+type trashedProject struct {
+	Project
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// Handlers
+
+func getTrashHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	backups, err := db.Backups().ListTrashed(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Backups")
+		return
+	}
+	projects, err := db.Projects().ListTrashed(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+
+	resp := struct {
+		RetentionDays int              `json:"retention_days"`
+		Backups       []trashedBackup  `json:"backups"`
+		Projects      []trashedProject `json:"projects"`
+	}{
+		RetentionDays: int(trashRetention() / (24 * time.Hour)),
+		Backups:       make([]trashedBackup, 0, len(backups)),
+		Projects:      make([]trashedProject, 0, len(projects)),
+	}
+	for _, b := range backups {
+		resp.Backups = append(resp.Backups, trashedBackup{b, purgeAt(b.DeletedAt)})
+	}
+	for _, p := range projects {
+		resp.Projects = append(resp.Projects, trashedProject{p, purgeAt(p.DeletedAt)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// restoreBackupHandler takes a backup out of the trash, with the projects
+// deleted along with it, and puts them back in search.
+func restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	trashed, err := db.Backups().GetTrashed(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	if err := db.Backups().Restore(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	backup, err := db.Backups().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	projects, err := db.Projects().List(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+
+	// Backups are embedded from their summary and preview here, as the
+	// content itself isn't decrypted
+	doc := backupDocument(backup)
+	docs := []search.Document{doc}
+	enqueueEmbedding(doc, "")
+	restored := 0
+	for _, p := range projects {
+		if p.BackupID == id {
+			doc := projectDocument(p)
+			docs = append(docs, doc)
+			enqueueEmbedding(doc, "")
+			restored++
+		}
+	}
+	indexDocuments(docs...)
+
+	recordAudit(r, AuditEvent{Action: "backup.restored", ResourceType: "backup", ResourceID: id})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "backup.restored",
+		AggregateType: aggregateBackup,
+		AggregateID:   id,
+		OwnerID:       userID,
+		Before:        snapshot(trashed),
+		After:         snapshot(backup),
+	}, map[string]interface{}{"projects": restored})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backup)
+}
+
+// purgeBackupHandler deletes a trashed backup for good without waiting for
+// retention.
+func purgeBackupHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	backup, err := db.Backups().GetTrashed(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+	holdIDs, err := legalHolds.backupHeld(r.Context(), id, backup.UserID)
+	if err != nil {
+		writeStorageError(w, r, err, "Legal holds")
+		return
+	}
+	if len(holdIDs) > 0 {
+		recordAudit(r, AuditEvent{
+			Action:       "backup.purge_blocked",
+			ResourceType: "backup",
+			ResourceID:   id,
+			Metadata:     map[string]interface{}{"hold_ids": holdIDs},
+		})
+		writeLegalHoldError(w, holdIDs)
+		return
+	}
+	if err := purgeBackup(r.Context(), backup); err != nil {
+		writeStorageError(w, r, err, "Backup")
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "backup.purged", ResourceType: "backup", ResourceID: id})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "backup.purged",
+		AggregateType: aggregateBackup,
+		AggregateID:   id,
+		OwnerID:       userID,
+		Before:        snapshot(backup),
+	}, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreProjectHandler takes a project out of the trash. One deleted with
+// its backup comes back when the backup is restored.
+func restoreProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	trashed, err := db.Projects().GetTrashed(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	if trashed.BackupID != "" {
+		_, err := db.Backups().GetTrashed(r.Context(), userID, trashed.BackupID)
+		if err == nil {
+			http.Error(w, "The backup this project came from is in the trash; restore it instead", http.StatusConflict)
+			return
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			writeStorageError(w, r, err, "Backup")
+			return
+		}
+	}
+	if err := db.Projects().Restore(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	project, err := db.Projects().Get(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+
+	doc := projectDocument(project)
+	indexDocuments(doc)
+	enqueueEmbedding(doc, "")
+
+	recordAudit(r, AuditEvent{Action: "project.restored", ResourceType: "project", ResourceID: id})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "project.restored",
+		AggregateType: aggregateProject,
+		AggregateID:   id,
+		OwnerID:       userID,
+		Before:        snapshot(trashed),
+		After:         snapshot(project),
+	}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+func purgeProjectHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	project, err := db.Projects().GetTrashed(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+	holds, err := legalHolds.active(r.Context())
+	if err != nil {
+		writeStorageError(w, r, err, "Legal holds")
+		return
+	}
+	if holdIDs := projectHeld(holds, project); len(holdIDs) > 0 {
+		writeLegalHoldError(w, holdIDs)
+		return
+	}
+	if err := db.Projects().Delete(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Project")
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "project.purged", ResourceType: "project", ResourceID: id})
+	recordDomainEvent(requestActor(r), DomainEvent{
+		Type:          "project.purged",
+		AggregateType: aggregateProject,
+		AggregateID:   id,
+		OwnerID:       userID,
+		Before:        snapshot(project),
+	}, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// emptyTrashHandler purges everything in the user's trash except backups
+// under legal hold, and their projects, which it lists.
+func emptyTrashHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	actor := requestActor(r)
+
+	holds, err := legalHolds.active(r.Context())
+	if err != nil {
+		writeStorageError(w, r, err, "Legal holds")
+		return
+	}
+	backups, err := db.Backups().ListTrashed(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Backups")
+		return
+	}
+	held := []string{}
+	purgedBackups := 0
+	for _, b := range backups {
+		if len(heldBy(holds, b.ID, b.UserID)) > 0 {
+			held = append(held, b.ID)
+			continue
+		}
+		if err := purgeBackup(r.Context(), b); err != nil {
+			writeStorageError(w, r, err, "Backup")
+			return
+		}
+		purgedBackups++
+		recordDomainEvent(actor, DomainEvent{
+			Type:          "backup.purged",
+			AggregateType: aggregateBackup,
+			AggregateID:   b.ID,
+			OwnerID:       userID,
+			Before:        snapshot(b),
+		}, nil)
+	}
+
+	projects, err := db.Projects().ListTrashed(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Projects")
+		return
+	}
+	purgedProjects := 0
+	for _, p := range projects {
+		if len(projectHeld(holds, p)) > 0 {
+			continue
+		}
+		if err := db.Projects().Delete(r.Context(), userID, p.ID); err != nil {
+			writeStorageError(w, r, err, "Project")
+			return
+		}
+		purgedProjects++
+		recordDomainEvent(actor, DomainEvent{
+			Type:          "project.purged",
+			AggregateType: aggregateProject,
+			AggregateID:   p.ID,
+			OwnerID:       userID,
+			Before:        snapshot(p),
+		}, nil)
+	}
+
+	recordAudit(r, AuditEvent{
+		Action:       "trash.emptied",
+		ResourceType: "trash",
+		Metadata: map[string]interface{}{
+			"backups":  purgedBackups,
+			"projects": purgedProjects,
+			"held":     held,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"purged_backups":  purgedBackups,
+		"purged_projects": purgedProjects,
+		"held_backup_ids": held,
+	})
+}
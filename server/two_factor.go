@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"image/png"
+	"net/http"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/qr"
+	"backup-manager/storage"
+	"backup-manager/totp"
+)
+
+const (
+	// twoFactorPendingTTL is how long a secret waits for its first code
+	// before enrollment has to start over
+	twoFactorPendingTTL = 10 * time.Minute
+	// twoFactorAttemptsPerMinute bounds guesses at a user's codes, on top of
+	// the per-address limit on login
+	twoFactorAttemptsPerMinute = 5
+	twoFactorQRSize            = 256
+	defaultTOTPIssuer          = "Backup Manager"
+)
+
+var twoFactorLimiter = newRateLimiter()
+
+// twoFactorRegistry keeps users' authenticator secrets in the two_factor
+// table, encrypted with the server key. A secret only guards logins once a
+// code from the app has confirmed it.
+type twoFactorRegistry struct{}
+
+var twoFactor = &twoFactorRegistry{}
+
+// enrollment loads the user's enrollment, ok false if they have none.
+func (reg *twoFactorRegistry) enrollment(ctx context.Context, userID string) (storage.TwoFactor, bool, error) {
+	e, err := db.TwoFactor().Get(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return e, false, nil
+	}
+	return e, err == nil, err
+}
+
+// matches checks code against the enrollment's secret, returning its step.
+func (reg *twoFactorRegistry) matches(e storage.TwoFactor, code string) (int64, bool, error) {
+	secret, err := decrypt(e.Secret)
+	if err != nil {
+		return 0, false, err
+	}
+	step, ok := totp.Verify(secret, code, time.Now())
+	return step, ok, nil
+}
+
+// begin starts enrollment with a new secret, replacing any pending one. It
+// fails if two-factor authentication is already on.
+func (reg *twoFactorRegistry) begin(ctx context.Context, userID string) (string, bool, error) {
+	e, ok, err := reg.enrollment(ctx, userID)
+	if err != nil {
+		return "", false, err
+	}
+	if ok && e.Enabled {
+		return "", false, nil
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", false, err
+	}
+	encrypted, err := encrypt(secret)
+	if err != nil {
+		return "", false, err
+	}
+	if err := db.TwoFactor().Put(ctx, storage.TwoFactor{UserID: userID, Secret: encrypted, CreatedAt: time.Now()}); err != nil {
+		return "", false, err
+	}
+	return secret, true, nil
+}
+
+// confirm turns on a pending enrollment once code matches its secret.
+func (reg *twoFactorRegistry) confirm(ctx context.Context, userID, code string) (bool, error) {
+	e, ok, err := reg.enrollment(ctx, userID)
+	if err != nil || !ok || e.Enabled || time.Since(e.CreatedAt) > twoFactorPendingTTL {
+		return false, err
+	}
+	step, ok, err := reg.matches(e, code)
+	if err != nil || !ok {
+		return false, err
+	}
+	err = db.TwoFactor().Enable(ctx, userID, step, time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// verify checks a login code. Each code works once.
+func (reg *twoFactorRegistry) verify(ctx context.Context, userID, code string) (bool, error) {
+	e, ok, err := reg.enrollment(ctx, userID)
+	if err != nil || !ok || !e.Enabled {
+		return false, err
+	}
+	step, ok, err := reg.matches(e, code)
+	if err != nil || !ok || step <= e.LastStep {
+		return false, err
+	}
+	err = db.TwoFactor().UseStep(ctx, userID, step)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (reg *twoFactorRegistry) enabled(ctx context.Context, userID string) (bool, error) {
+	e, ok, err := reg.enrollment(ctx, userID)
+	return ok && e.Enabled, err
+}
+
+func (reg *twoFactorRegistry) remove(ctx context.Context, userID string) error {
+	if err := db.TwoFactor().Delete(ctx, userID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (reg *twoFactorRegistry) status(ctx context.Context, userID string) (map[string]interface{}, error) {
+	e, ok, err := reg.enrollment(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return map[string]interface{}{"enabled": false, "pending": false}, nil
+	}
+	status := map[string]interface{}{
+		"enabled": e.Enabled,
+		"pending": !e.Enabled && time.Since(e.CreatedAt) <= twoFactorPendingTTL,
+	}
+	if e.EnabledAt != nil {
+		status["enabled_at"] = e.EnabledAt.Format(time.RFC3339)
+	}
+	return status, nil
+}
+
+// secondFactors lists the ways userID can complete a login, empty when
+// their password is enough.
+func secondFactors(ctx context.Context, userID string) ([]string, error) {
+	methods := []string{}
+	enabled, err := twoFactor.enabled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return methods, nil
+	}
+	methods = append(methods, "totp")
+
+	enrolled, err := recoveryCodes.enrolled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if enrolled {
+		methods = append(methods, "recovery_code")
+	}
+	return methods, nil
+}
+
+// checkSecondFactor verifies the TOTP or recovery code given for a user who
+// has the second factors methods. On failure it writes the response and
+// returns false.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, userID string, methods []string, totpCode, recoveryCode string) bool {
+	if totpCode == "" && recoveryCode == "" {
+		writeAPIError(w, &apiError{
+			Status:  http.StatusUnauthorized,
+			Code:    "mfa_required",
+			Message: "A second factor is required",
+			Details: map[string]interface{}{"methods": methods},
+		})
+		return false
+	}
+	if !limitRequest(w, twoFactorLimiter, userID, twoFactorAttemptsPerMinute) {
+		return false
+	}
+
+	if totpCode != "" {
+		ok, err := twoFactor.verify(r.Context(), userID, totpCode)
+		if err != nil {
+			writeStorageError(w, r, err, "Two-factor authentication")
+			return false
+		}
+		if !ok {
+			http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	ok, err := recoveryCodes.consume(r.Context(), userID, recoveryCode)
+	if err != nil {
+		writeStorageError(w, r, err, "Recovery codes")
+		return false
+	}
+	if !ok {
+		http.Error(w, "Invalid recovery code", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func totpIssuer() string {
+	if issuer := config.Get("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return defaultTOTPIssuer
+}
+
+// enrollmentQR renders uri as a PNG data URL for the frontend to show.
+func enrollmentQR(uri string) (string, error) {
+	code, err := qr.Encode(uri, qr.ECMedium)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code.Image(twoFactorQRSize, qr.QuietZone, color.Black, color.White)); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Handlers
+
+// beginTwoFactorHandler issues a new secret to scan into an authenticator
+// app. Two-factor authentication is only on once a code from the app is
+// sent to confirmTwoFactorHandler.
+func beginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	secret, ok, err := twoFactor.begin(r.Context(), userID)
+	if err != nil {
+		logger(r.Context()).Error("Error starting two-factor enrollment", "error", err)
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	uri := totp.URI(totpIssuer(), r.Header.Get("X-User-Email"), secret)
+	image, err := enrollmentQR(uri)
+	if err != nil {
+		logger(r.Context()).Error("Error rendering enrollment QR code", "error", err)
+		http.Error(w, "Error rendering QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":      secret,
+		"otpauth_url": uri,
+		"qr_code":     image,
+		"expires_at":  time.Now().Add(twoFactorPendingTTL).Format(time.RFC3339),
+	})
+}
+
+// confirmTwoFactorHandler turns two-factor authentication on with the first
+// code from the app, and returns a fresh set of recovery codes for when the
+// app is lost.
+func confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Code string `json:"code" validate:"required"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if !limitRequest(w, twoFactorLimiter, userID, twoFactorAttemptsPerMinute) {
+		return
+	}
+	confirmed, err := twoFactor.confirm(r.Context(), userID, req.Code)
+	if err != nil {
+		writeStorageError(w, r, err, "Two-factor authentication")
+		return
+	}
+	if !confirmed {
+		http.Error(w, "Invalid or expired code; start enrollment again if it keeps failing", http.StatusUnprocessableEntity)
+		return
+	}
+
+	codes, err := recoveryCodes.regenerate(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Recovery codes")
+		return
+	}
+	recordAudit(r, AuditEvent{Action: "account.two_factor_enabled", ResourceType: "user", ResourceID: userID})
+	emitWebhook(userID, "account.two_factor_enabled", map[string]string{"id": userID})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":        true,
+		"recovery_codes": codes,
+	})
+}
+
+func getTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	status, err := twoFactor.status(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Two-factor authentication")
+		return
+	}
+	if status["recovery_codes"], err = recoveryCodes.status(r.Context(), userID); err != nil {
+		writeStorageError(w, r, err, "Recovery codes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// disableTwoFactorHandler turns two-factor authentication off, along with
+// the recovery codes, given a current code or a recovery code.
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	methods, err := secondFactors(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Two-factor authentication")
+		return
+	}
+	if len(methods) == 0 {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusNotFound)
+		return
+	}
+	if !checkSecondFactor(w, r, userID, methods, req.Code, req.RecoveryCode) {
+		return
+	}
+
+	if err := twoFactor.remove(r.Context(), userID); err != nil {
+		writeStorageError(w, r, err, "Two-factor authentication")
+		return
+	}
+	if err := recoveryCodes.remove(r.Context(), userID); err != nil {
+		writeStorageError(w, r, err, "Recovery codes")
+		return
+	}
+	recordAudit(r, AuditEvent{Action: "account.two_factor_disabled", ResourceType: "user", ResourceID: userID})
+	emitWebhook(userID, "account.two_factor_disabled", map[string]string{"id": userID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-manager/storage"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	dataKeySize      = 32
+	dataKeyUnlockTTL = 24 * time.Hour // matches the session token lifetime
+
+	// Argon2id parameters for deriving the key that wraps a user's data key
+	// from their password.
+	kdfTime    = 1
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+)
+
+var (
+	errNoDataKey     = errors.New("user has no data key")
+	errDataKeyLocked = errors.New("data key is locked")
+	errWrongKey      = errors.New("wrong password or recovery key")
+	errLegalHold     = errors.New("data is under legal hold")
+
+	recoveryKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+type unlockedDataKey struct {
+	key       []byte
+	expiresAt time.Time
+}
+
+// userKeyRegistry unlocks users' data keys from the keyrings stored in the
+// database, each the data key wrapped under every secret that can unlock
+// it. The data key itself is never stored, so losing the password without
+// a recovery key means losing the data; unlocked keys are only held in
+// memory, for the length of a session.
+type userKeyRegistry struct {
+	mu       sync.Mutex
+	unlocked map[string]unlockedDataKey
+}
+
+var userKeys = &userKeyRegistry{
+	unlocked: make(map[string]unlockedDataKey),
+}
+
+func passwordKEK(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, kdfTime, kdfMemory, kdfThreads, dataKeySize)
+}
+
+// keyring loads the user's keyring, errNoDataKey if they have none.
+func (reg *userKeyRegistry) keyring(ctx context.Context, userID string) (storage.Keyring, error) {
+	kr, err := db.Keyrings().Get(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return kr, errNoDataKey
+	}
+	return kr, err
+}
+
+func (reg *userKeyRegistry) keep(userID string, dataKey []byte) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.unlocked[userID] = unlockedDataKey{key: dataKey, expiresAt: time.Now().Add(dataKeyUnlockTTL)}
+}
+
+// create generates a data key for a new user and wraps it with their password.
+func (reg *userKeyRegistry) create(ctx context.Context, userID, password string) error {
+	dataKey := make([]byte, dataKeySize)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	wrapped, err := sealWithKey(passwordKEK(password, salt), dataKey)
+	if err != nil {
+		return err
+	}
+	if err := db.Keyrings().Put(ctx, storage.Keyring{UserID: userID, PasswordSalt: salt, WrappedByPassword: wrapped}); err != nil {
+		return err
+	}
+	reg.keep(userID, dataKey)
+	return nil
+}
+
+// unlock unwraps the data key with the user's password and keeps it in
+// memory for the length of a session.
+func (reg *userKeyRegistry) unlock(ctx context.Context, userID, password string) error {
+	kr, err := reg.keyring(ctx, userID)
+	if err != nil {
+		return err
+	}
+	dataKey, err := openWithKey(passwordKEK(password, kr.PasswordSalt), kr.WrappedByPassword)
+	if err != nil {
+		return errWrongKey
+	}
+	reg.keep(userID, dataKey)
+	return nil
+}
+
+// dataKey returns the user's unlocked data key. errNoDataKey means the
+// account predates per-user keys and uses the server key.
+func (reg *userKeyRegistry) dataKey(ctx context.Context, userID string) ([]byte, error) {
+	reg.mu.Lock()
+	u, ok := reg.unlocked[userID]
+	if ok && time.Now().After(u.expiresAt) {
+		delete(reg.unlocked, userID)
+		ok = false
+	}
+	reg.mu.Unlock()
+	if ok {
+		return u.key, nil
+	}
+
+	if _, err := reg.keyring(ctx, userID); err != nil {
+		return nil, err
+	}
+	return nil, errDataKeyLocked
+}
+
+// createRecoveryKey wraps the unlocked data key under a new random recovery
+// key, replacing any previous one, and returns it formatted for the user.
+func (reg *userKeyRegistry) createRecoveryKey(ctx context.Context, userID string) (string, error) {
+	dataKey, err := reg.dataKey(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	kr, err := reg.keyring(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	recoveryKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(recoveryKey); err != nil {
+		return "", err
+	}
+	if kr.WrappedByRecovery, err = sealWithKey(recoveryKey, dataKey); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	kr.RecoveryCreatedAt = &now
+	if err := db.Keyrings().Put(ctx, kr); err != nil {
+		return "", err
+	}
+	return formatRecoveryKey(recoveryKey), nil
+}
+
+// removeRecoveryKey returns false if the user had none.
+func (reg *userKeyRegistry) removeRecoveryKey(ctx context.Context, userID string) (bool, error) {
+	kr, err := reg.keyring(ctx, userID)
+	if errors.Is(err, errNoDataKey) {
+		return false, nil
+	}
+	if err != nil || kr.WrappedByRecovery == nil {
+		return false, err
+	}
+	kr.WrappedByRecovery, kr.RecoveryCreatedAt = nil, nil
+	return true, db.Keyrings().Put(ctx, kr)
+}
+
+// recover unwraps the data key with a recovery key and re-wraps it under
+// newPassword, for users whose password was reset and so no longer opens
+// the old wrapping. The recovery key stays valid.
+func (reg *userKeyRegistry) recover(ctx context.Context, userID, recoveryKey, newPassword string) error {
+	key, err := parseRecoveryKey(recoveryKey)
+	if err != nil {
+		return errWrongKey
+	}
+
+	kr, err := reg.keyring(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if kr.WrappedByRecovery == nil {
+		return errNoDataKey
+	}
+
+	dataKey, err := openWithKey(key, kr.WrappedByRecovery)
+	if err != nil {
+		return errWrongKey
+	}
+
+	kr.PasswordSalt = make([]byte, 16)
+	if _, err := rand.Read(kr.PasswordSalt); err != nil {
+		return err
+	}
+	if kr.WrappedByPassword, err = sealWithKey(passwordKEK(newPassword, kr.PasswordSalt), dataKey); err != nil {
+		return err
+	}
+	if err := db.Keyrings().Put(ctx, kr); err != nil {
+		return err
+	}
+	reg.keep(userID, dataKey)
+	return nil
+}
+
+func (reg *userKeyRegistry) status(ctx context.Context, userID string) (map[string]interface{}, error) {
+	kr, err := reg.keyring(ctx, userID)
+	if errors.Is(err, errNoDataKey) {
+		return map[string]interface{}{"data_key": false, "recovery_key": false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reg.mu.Lock()
+	u, unlocked := reg.unlocked[userID]
+	reg.mu.Unlock()
+	status := map[string]interface{}{
+		"data_key":     true,
+		"unlocked":     unlocked && time.Now().Before(u.expiresAt),
+		"recovery_key": kr.WrappedByRecovery != nil,
+	}
+	if kr.RecoveryCreatedAt != nil {
+		status["recovery_key_created_at"] = kr.RecoveryCreatedAt.Format(time.RFC3339)
+	}
+	return status, nil
+}
+
+// destroy deletes the user's keyring, which makes everything encrypted with
+// their data key unreadable. It refuses while a legal hold covers the user.
+func (reg *userKeyRegistry) destroy(ctx context.Context, userID string) error {
+	held, err := legalHolds.userHeld(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if held {
+		return errLegalHold
+	}
+	if err := db.Keyrings().Delete(ctx, userID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.unlocked, userID)
+	return nil
+}
+
+func (reg *userKeyRegistry) pruneUnlocked() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	now := time.Now()
+	for userID, u := range reg.unlocked {
+		if now.After(u.expiresAt) {
+			delete(reg.unlocked, userID)
+		}
+	}
+}
+
+// formatRecoveryKey renders the key as base32 in groups of four characters.
+func formatRecoveryKey(key []byte) string {
+	encoded := recoveryKeyEncoding.EncodeToString(key)
+	groups := make([]string, 0, len(encoded)/4+1)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:min(i+4, len(encoded))])
+	}
+	return strings.Join(groups, "-")
+}
+
+func parseRecoveryKey(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, "-", ""))
+	s = strings.Join(strings.Fields(s), "")
+
+	key, err := recoveryKeyEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("recovery key has wrong length")
+	}
+	return key, nil
+}
+
+// decryptForUser opens data sealed whole with the user's data key, as
+// backups were before uploads were streamed. Data stored before the account
+// had a data key is still under the server key, so that is tried second;
+// a key version tag marks data that certainly is.
+func decryptForUser(ctx context.Context, userID, ciphertext string) (string, error) {
+	if _, _, tagged := splitKeyVersion(ciphertext); tagged {
+		return decrypt(ciphertext)
+	}
+	key, err := userKeys.dataKey(ctx, userID)
+	if errors.Is(err, errNoDataKey) {
+		return decrypt(ciphertext)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openWithKey(key, data)
+	if err != nil {
+		return decrypt(ciphertext)
+	}
+	return string(plaintext), nil
+}
+
+// Handlers
+func createRecoveryKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	recoveryKey, err := userKeys.createRecoveryKey(r.Context(), userID)
+	switch {
+	case errors.Is(err, errNoDataKey):
+		http.Error(w, "This account has no data key to recover", http.StatusConflict)
+		return
+	case errors.Is(err, errDataKeyLocked):
+		http.Error(w, "Log in again to unlock your data key", http.StatusLocked)
+		return
+	case err != nil:
+		http.Error(w, "Error creating recovery key", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "account.recovery_key_created", ResourceType: "user", ResourceID: userID})
+
+	if r.URL.Query().Get("download") == "true" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="recovery-key.txt"`)
+		fmt.Fprintf(w, "Data recovery key for %s\n", r.Header.Get("X-User-Email"))
+		fmt.Fprintf(w, "Generated %s. Keep it somewhere safe: it is the only way to\n", time.Now().Format(time.RFC1123))
+		fmt.Fprintf(w, "recover your encrypted backups if you lose your password.\n\n")
+		fmt.Fprintln(w, recoveryKey)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"recovery_key": recoveryKey,
+	})
+}
+
+func getRecoveryKeyHandler(w http.ResponseWriter, r *http.Request) {
+	writeKeyStatus(w, r, r.Header.Get("X-User-ID"))
+}
+
+// writeKeyStatus answers with the state of the user's data key.
+func writeKeyStatus(w http.ResponseWriter, r *http.Request, userID string) {
+	status, err := userKeys.status(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Data key")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func deleteRecoveryKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	removed, err := userKeys.removeRecoveryKey(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Recovery key")
+		return
+	}
+	if !removed {
+		http.Error(w, "No recovery key", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "account.recovery_key_removed", ResourceType: "user", ResourceID: userID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recoverDataKeyHandler re-wraps the data key after a password reset. The
+// caller is logged in with the new password, which is checked again here
+// before it is used to wrap the key.
+func recoverDataKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		RecoveryKey string `json:"recovery_key"`
+		Password    string `json:"password"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	user, err := db.Users().Get(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "User")
+		return
+	}
+
+	if !passwordMatches(r.Context(), user.PasswordHash, req.Password) {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+
+	err = userKeys.recover(r.Context(), userID, req.RecoveryKey, req.Password)
+	switch {
+	case errors.Is(err, errNoDataKey):
+		http.Error(w, "No recovery key is set up for this account", http.StatusNotFound)
+		return
+	case errors.Is(err, errWrongKey):
+		recordAudit(r, AuditEvent{Action: "account.recovery_key_failed", ResourceType: "user", ResourceID: userID})
+		http.Error(w, "Invalid recovery key", http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, "Error recovering data key", http.StatusInternalServerError)
+		return
+	}
+
+	logger(r.Context()).Info("Data key recovered")
+	recordAudit(r, AuditEvent{Action: "account.data_key_recovered", ResourceType: "user", ResourceID: userID})
+
+	writeKeyStatus(w, r, userID)
+}
+
+// unlockDataKeyHandler unlocks the data key with the account password for a
+// user who logged in without it, such as through an OAuth provider.
+func unlockDataKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	err := userKeys.unlock(r.Context(), userID, req.Password)
+	switch {
+	case errors.Is(err, errNoDataKey):
+		http.Error(w, "This account has no data key", http.StatusNotFound)
+		return
+	case errors.Is(err, errWrongKey):
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, "Error unlocking data key", http.StatusInternalServerError)
+		return
+	}
+
+	writeKeyStatus(w, r, userID)
+}
@@ -0,0 +1,316 @@
+// Package validate checks decoded request bodies against the rules in their
+// fields' `validate` tags and reports every field at fault, not just the
+// first.
+//
+// Rules are separated by commas:
+//
+//	required    not empty; strings are trimmed first
+//	min=N       at least N characters, items, or as a number, N
+//	max=N       at most N characters, items, or as a number, N
+//	oneof=a b   one of the words given
+//	oneofci=a b one of the words given, in any case
+//	email       an email address
+//	url         an absolute http or https URL
+//	https       an absolute https URL
+//	password    a strong enough password, see Password
+//	dive        check the rules of each struct in a slice
+//
+// Apart from required, the rules of an empty string or slice are skipped,
+// so optional fields only need checking when set. Fields are named by their
+// JSON names, nested ones as "style.foreground" or "items[2].content".
+package validate
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FieldError is what is wrong with one field.
+type FieldError struct {
+	Field string `json:"field"`
+	// Rule is the rule the field broke, such as "required" or "max"
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Errors are the fields at fault in a request.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Add records a fault found outside of tags, such as one that depends on
+// several fields.
+func (e *Errors) Add(field, rule, message string) {
+	*e = append(*e, FieldError{Field: field, Rule: rule, Message: message})
+}
+
+// Err returns e as an error, or nil if there are no faults.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Struct checks v, a struct or pointer to one, returning the fields at
+// fault.
+func Struct(v interface{}) Errors {
+	var errs Errors
+	val := reflect.Indirect(reflect.ValueOf(v))
+	if val.Kind() == reflect.Struct {
+		checkStruct(&errs, val, "")
+	}
+	return errs
+}
+
+func checkStruct(errs *Errors, v reflect.Value, prefix string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		// Embedded structs' fields are the request's own, as in encoding/json
+		if f.Anonymous && name == "" {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				checkStruct(errs, fv, prefix)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		checkField(errs, fv, prefix+name, f.Tag.Get("validate"))
+	}
+}
+
+func checkField(errs *Errors, v reflect.Value, field, tag string) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			if hasRule(tag, "required") {
+				errs.Add(field, "required", field+" is required")
+			}
+			return
+		}
+		v = v.Elem()
+	}
+
+	if tag != "" && tag != "-" {
+		for _, rule := range strings.Split(tag, ",") {
+			name, arg, _ := strings.Cut(rule, "=")
+			if msg := checkRule(v, name, arg, field); msg != "" {
+				// Clients needn't tell the two apart
+				if name == "oneofci" {
+					name = "oneof"
+				}
+				errs.Add(field, name, msg)
+				// Later rules would only repeat the fault
+				break
+			}
+		}
+	}
+
+	// Nested structs are checked wherever they are; slices of them only
+	// when asked, as their items may be many
+	switch {
+	case v.Kind() == reflect.Struct:
+		checkStruct(errs, v, field+".")
+	case v.Kind() == reflect.Slice && hasRule(tag, "dive"):
+		for i := 0; i < v.Len(); i++ {
+			item := reflect.Indirect(v.Index(i))
+			if item.Kind() == reflect.Struct {
+				checkStruct(errs, item, field+"["+strconv.Itoa(i)+"].")
+			}
+		}
+	}
+}
+
+func hasRule(tag, rule string) bool {
+	for _, r := range strings.Split(tag, ",") {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRule returns the message for a broken rule, or "".
+func checkRule(v reflect.Value, rule, arg, field string) string {
+	if rule == "required" {
+		if empty(v) {
+			return field + " is required"
+		}
+		return ""
+	}
+	if rule == "dive" {
+		return ""
+	}
+	if (v.Kind() == reflect.String || v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0 {
+		return ""
+	}
+
+	switch rule {
+	case "min", "max":
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("validate: %s of %s is not a number", rule, field))
+		}
+		return checkBound(v, rule, n, field)
+	case "oneof", "oneofci":
+		words := strings.Fields(arg)
+		if v.Kind() == reflect.String && !oneOf(words, v.String(), rule == "oneofci") {
+			return fmt.Sprintf("%s must be %s", field, orList(words))
+		}
+	case "email":
+		if v.Kind() == reflect.String && !Email(strings.TrimSpace(v.String())) {
+			return field + " must be an email address"
+		}
+	case "url", "https":
+		if v.Kind() == reflect.String && !absoluteURL(v.String(), rule == "https") {
+			if rule == "https" {
+				return field + " must be an absolute https URL"
+			}
+			return field + " must be an absolute http or https URL"
+		}
+	case "password":
+		if v.Kind() == reflect.String {
+			if msg := Password(v.String()); msg != "" {
+				return field + " " + msg
+			}
+		}
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q on %s", rule, field))
+	}
+	return ""
+}
+
+func empty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func checkBound(v reflect.Value, rule string, n float64, field string) string {
+	var got float64
+	var unit string
+	switch v.Kind() {
+	case reflect.String:
+		got, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Map:
+		got, unit = float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		got = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		got = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		got = v.Float()
+	default:
+		return ""
+	}
+	bound := strconv.FormatFloat(n, 'f', -1, 64)
+	if rule == "min" && got < n {
+		return field + " must be at least " + bound + unit
+	}
+	if rule == "max" && got > n {
+		return field + " must be at most " + bound + unit
+	}
+	return ""
+}
+
+func oneOf(words []string, s string, anyCase bool) bool {
+	for _, w := range words {
+		if w == s || (anyCase && strings.EqualFold(w, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// orList joins words as "a, b or c".
+func orList(words []string) string {
+	if len(words) == 1 {
+		return words[0]
+	}
+	return strings.Join(words[:len(words)-1], ", ") + " or " + words[len(words)-1]
+}
+
+var emailPattern = regexp.MustCompile(`^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$`)
+
+// Email reports whether s looks like an email address, as the users
+// table's email_format constraint has it.
+func Email(s string) bool {
+	return len(s) <= 254 && emailPattern.MatchString(s)
+}
+
+func absoluteURL(s string, httpsOnly bool) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Scheme == "https" || (!httpsOnly && u.Scheme == "http")
+}
+
+// Password rules. bcrypt ignores bytes past the 72nd, so longer passwords
+// would only seem stronger.
+const (
+	PasswordMinLength = 10
+	PasswordMaxBytes  = 72
+	// passwordClasses is how many of lower case, upper case, digits and
+	// symbols a password must mix
+	passwordClasses = 3
+)
+
+// Password returns what is wrong with p as a password, to follow the
+// field's name, or "" if it is strong enough.
+func Password(p string) string {
+	if utf8.RuneCountInString(p) < PasswordMinLength {
+		return fmt.Sprintf("must be at least %d characters", PasswordMinLength)
+	}
+	if len(p) > PasswordMaxBytes {
+		return fmt.Sprintf("must be at most %d bytes", PasswordMaxBytes)
+	}
+	var lower, upper, digit, symbol int
+	for _, r := range p {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < passwordClasses {
+		return "must mix at least three of lower case letters, upper case letters, digits and symbols"
+	}
+	return ""
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"backup-manager/config"
+	"backup-manager/objectstore"
+	"backup-manager/storage"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Datasets the warehouse export writes, each to
+// <dataset>/dt=YYYY-MM-DD/part-00000.parquet under WAREHOUSE_EXPORT_URL. The
+// dt= partitioning is what Athena, BigQuery and Hive expect.
+const (
+	datasetScans       = "scans"
+	datasetAPIKeyUsage = "api_key_usage"
+	datasetAuditLogs   = "audit_logs"
+
+	warehouseExportInterval = time.Hour
+	maxWarehouseExportRuns  = 100
+	// warehouseBackfillDays is how far back the scheduler exports days
+	// that were missed, as far back as audit events are kept
+	warehouseBackfillDays = auditBufferDays
+)
+
+var warehouseDatasets = []string{datasetScans, datasetAPIKeyUsage, datasetAuditLogs}
+
+type scanRow struct {
+	Date        string  `parquet:"date"`
+	QRID        string  `parquet:"qr_id"`
+	OwnerID     string  `parquet:"owner_id"`
+	CountryCode string  `parquet:"country_code,dict"`
+	Country     string  `parquet:"country,dict"`
+	RegionCode  string  `parquet:"region_code,dict"`
+	Region      string  `parquet:"region"`
+	City        string  `parquet:"city"`
+	Latitude    float64 `parquet:"latitude"`
+	Longitude   float64 `parquet:"longitude"`
+	Scans       int64   `parquet:"scans"`
+}
+
+type apiKeyUsageParquetRow struct {
+	Date        string `parquet:"date"`
+	KeyID       string `parquet:"key_id"`
+	UserID      string `parquet:"user_id"`
+	Requests    int64  `parquet:"requests"`
+	Errors      int64  `parquet:"errors"`
+	RateLimited int64  `parquet:"rate_limited"`
+	BytesIn     int64  `parquet:"bytes_in"`
+	BytesOut    int64  `parquet:"bytes_out"`
+}
+
+type auditLogRow struct {
+	ID           string    `parquet:"id"`
+	CreatedAt    time.Time `parquet:"created_at,timestamp(millisecond)"`
+	UserID       string    `parquet:"user_id"`
+	Action       string    `parquet:"action,dict"`
+	ResourceType string    `parquet:"resource_type,dict"`
+	ResourceID   string    `parquet:"resource_id"`
+	IPAddress    string    `parquet:"ip_address"`
+	UserAgent    string    `parquet:"user_agent"`
+	Metadata     string    `parquet:"metadata"` // JSON
+}
+
+// WarehouseFile is one dataset written by an export run.
+type WarehouseFile = storage.WarehouseFile
+
+// WarehouseExport is one run of the export; see storage.WarehouseExport.
+type WarehouseExport = storage.WarehouseExport
+
+type warehouseExportPayload struct {
+	ExportID string `json:"export_id"`
+}
+
+var warehouseStore objectstore.Store
+
+// initWarehouseExport opens WAREHOUSE_EXPORT_URL, an s3:// URL or a local
+// directory. Without it the export is off.
+func initWarehouseExport() {
+	target := config.Get("WAREHOUSE_EXPORT_URL")
+	if target == "" {
+		return
+	}
+	store, err := objectstore.Open(target, s3ConfigFromEnv())
+	if err != nil {
+		fatal("Invalid WAREHOUSE_EXPORT_URL", "error", err)
+	}
+	warehouseStore = store
+}
+
+// s3ConfigFromEnv reads the credentials used for s3:// object store URLs.
+func s3ConfigFromEnv() objectstore.S3Config {
+	return objectstore.S3Config{
+		Endpoint:  config.Get("S3_ENDPOINT"),
+		Region:    config.Get("S3_REGION"),
+		AccessKey: config.Get("S3_ACCESS_KEY_ID"),
+		SecretKey: config.Get("S3_SECRET_ACCESS_KEY"),
+		PathStyle: config.Get("S3_PATH_STYLE") == "true",
+	}
+}
+
+// queueWarehouseExport records a run of date's datasets and queues a job
+// to write them. A scheduled run of a day that already has one returns
+// storage.ErrConflict.
+func queueWarehouseExport(ctx context.Context, date string, datasets []string, scheduled bool, requestedBy string) (WarehouseExport, error) {
+	run := WarehouseExport{
+		ID:          generateID(),
+		Date:        date,
+		Scheduled:   scheduled,
+		Datasets:    datasets,
+		Status:      exportStatusPending,
+		Files:       []WarehouseFile{},
+		RequestedBy: requestedBy,
+		StartedAt:   time.Now(),
+	}
+	if err := db.WarehouseExports().Create(ctx, run); err != nil {
+		return WarehouseExport{}, err
+	}
+	if err := db.WarehouseExports().Prune(ctx, maxWarehouseExportRuns); err != nil {
+		slog.Error("Error pruning warehouse exports", "error", err)
+	}
+	if _, err := enqueueJob(ctx, "", jobWarehouseExport, warehouseExportPayload{ExportID: run.ID}); err != nil {
+		now := time.Now()
+		run.Status = exportStatusFailed
+		run.Error = "The export couldn't be queued"
+		run.CompletedAt = &now
+		db.WarehouseExports().Update(ctx, run)
+		return WarehouseExport{}, err
+	}
+	return run, nil
+}
+
+// runWarehouseExportJob writes the datasets of a run queued by
+// queueWarehouseExport. As with data exports, the run keeps its own status
+// rather than failing the job.
+func runWarehouseExportJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload warehouseExportPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+	run, err := db.WarehouseExports().Get(ctx, payload.ExportID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if run.Status != exportStatusPending {
+		return nil, nil
+	}
+	run.Status = exportStatusProcessing
+	if err := db.WarehouseExports().Update(ctx, run); err != nil {
+		return nil, err
+	}
+
+	day, _ := time.Parse(usageDateFormat, run.Date)
+	var failure error
+	for _, dataset := range run.Datasets {
+		file, err := exportDataset(ctx, dataset, day)
+		if err != nil {
+			failure = fmt.Errorf("%s: %w", dataset, err)
+			break
+		}
+		run.Files = append(run.Files, file)
+	}
+	if ctx.Err() != nil {
+		// Stopped by shutdown; the job is queued again and writes the
+		// files again
+		run.Status = exportStatusPending
+		run.Files = nil
+		return nil, db.WarehouseExports().Update(context.WithoutCancel(ctx), run)
+	}
+
+	now := time.Now()
+	run.CompletedAt = &now
+	run.Status = exportStatusCompleted
+	if failure != nil {
+		slog.Error("Warehouse export failed", "export_id", run.ID, "date", run.Date, "error", failure)
+		run.Status = exportStatusFailed
+		run.Error = failure.Error()
+	}
+	return nil, db.WarehouseExports().Update(ctx, run)
+}
+
+// exportDataset writes one dataset's rows for day. An existing file for the
+// same day is replaced, so re-running an export is safe.
+func exportDataset(ctx context.Context, dataset string, day time.Time) (WarehouseFile, error) {
+	date := day.Format(usageDateFormat)
+
+	var buf bytes.Buffer
+	var rows int
+	var err error
+	switch dataset {
+	case datasetScans:
+		rows, err = writeScanRows(ctx, &buf, day)
+	case datasetAPIKeyUsage:
+		rows, err = writeAPIKeyUsageRows(ctx, &buf, date)
+	case datasetAuditLogs:
+		rows, err = writeAuditLogRows(&buf, date)
+	default:
+		err = fmt.Errorf("unknown dataset")
+	}
+	if err != nil {
+		return WarehouseFile{}, err
+	}
+
+	key := fmt.Sprintf("%s/dt=%s/part-00000.parquet", dataset, date)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	if err := warehouseStore.Put(ctx, key, buf.Bytes(), "application/vnd.apache.parquet"); err != nil {
+		return WarehouseFile{}, err
+	}
+	return WarehouseFile{Dataset: dataset, Location: warehouseStore.Location(key), Rows: rows}, nil
+}
+
+func writeScanRows(ctx context.Context, buf *bytes.Buffer, day time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	counts, err := scanAnalytics.Daily(ctx, day)
+	if err != nil {
+		return 0, err
+	}
+	rows := make([]scanRow, 0, len(counts))
+	for _, c := range counts {
+		rows = append(rows, scanRow{
+			Date:        c.Date,
+			QRID:        c.QRID,
+			OwnerID:     c.OwnerID,
+			CountryCode: c.CountryCode,
+			Country:     c.Country,
+			RegionCode:  c.RegionCode,
+			Region:      c.Region,
+			City:        c.City,
+			Latitude:    c.Latitude,
+			Longitude:   c.Longitude,
+			Scans:       c.Scans,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].QRID < rows[j].QRID })
+	return len(rows), parquet.Write(buf, rows, parquet.Compression(&parquet.Snappy))
+}
+
+func writeAPIKeyUsageRows(ctx context.Context, buf *bytes.Buffer, date string) (int, error) {
+	usage, err := apiKeyUsage.onDay(ctx, date)
+	if err != nil {
+		return 0, err
+	}
+	rows := make([]apiKeyUsageParquetRow, 0, len(usage))
+	for _, u := range usage {
+		rows = append(rows, apiKeyUsageParquetRow{
+			Date:        date,
+			KeyID:       u.KeyID,
+			UserID:      apiKeys.owner(ctx, u.KeyID),
+			Requests:    u.Requests,
+			Errors:      u.Errors,
+			RateLimited: u.RateLimited,
+			BytesIn:     u.BytesIn,
+			BytesOut:    u.BytesOut,
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].KeyID < rows[j].KeyID })
+	return len(rows), parquet.Write(buf, rows, parquet.Compression(&parquet.Snappy))
+}
+
+func writeAuditLogRows(buf *bytes.Buffer, date string) (int, error) {
+	events := auditLog.onDay(date)
+	rows := make([]auditLogRow, 0, len(events))
+	for _, e := range events {
+		var metadata []byte
+		if len(e.Metadata) > 0 {
+			metadata, _ = json.Marshal(e.Metadata)
+		}
+		rows = append(rows, auditLogRow{
+			ID:           e.ID,
+			CreatedAt:    e.CreatedAt.UTC(),
+			UserID:       e.UserID,
+			Action:       e.Action,
+			ResourceType: e.ResourceType,
+			ResourceID:   e.ResourceID,
+			IPAddress:    e.IPAddress,
+			UserAgent:    e.UserAgent,
+			Metadata:     string(metadata),
+		})
+	}
+	return len(rows), parquet.Write(buf, rows, parquet.Compression(&parquet.Snappy))
+}
+
+// queueScheduledWarehouseExports exports each of the last
+// warehouseBackfillDays days that hasn't been, oldest first, so days
+// missed while no server was running are caught up. Every server looks
+// hourly; the first to claim a day is the one that queues its export.
+func queueScheduledWarehouseExports() {
+	if warehouseStore == nil {
+		return
+	}
+	ctx := context.Background()
+	today := time.Now().UTC()
+	exported, err := db.WarehouseExports().ScheduledDates(ctx, today.AddDate(0, 0, -warehouseBackfillDays).Format(usageDateFormat))
+	if err != nil {
+		slog.Error("Error listing warehouse exports", "error", err)
+		return
+	}
+	for days := warehouseBackfillDays; days >= 1; days-- {
+		date := today.AddDate(0, 0, -days).Format(usageDateFormat)
+		if contains(exported, date) {
+			continue
+		}
+		_, err := queueWarehouseExport(ctx, date, warehouseDatasets, true, "")
+		if errors.Is(err, storage.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Error queueing warehouse export", "date", date, "error", err)
+			return
+		}
+	}
+}
+
+// Handlers
+func createWarehouseExportHandler(w http.ResponseWriter, r *http.Request) {
+	if warehouseStore == nil {
+		http.Error(w, "Warehouse export is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		Date     string   `json:"date"` // YYYY-MM-DD, defaults to yesterday
+		Datasets []string `json:"datasets"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if req.Date == "" {
+		req.Date = time.Now().UTC().AddDate(0, 0, -1).Format(usageDateFormat)
+	}
+	if day, err := time.Parse(usageDateFormat, req.Date); err != nil || day.After(time.Now()) {
+		http.Error(w, "date must be YYYY-MM-DD and not in the future", http.StatusBadRequest)
+		return
+	}
+	if len(req.Datasets) == 0 {
+		req.Datasets = warehouseDatasets
+	}
+	for _, d := range req.Datasets {
+		if !contains(warehouseDatasets, d) {
+			http.Error(w, fmt.Sprintf("unknown dataset %q", d), http.StatusBadRequest)
+			return
+		}
+	}
+
+	run, err := queueWarehouseExport(r.Context(), req.Date, req.Datasets, false, r.Header.Get("X-User-Email"))
+	if err != nil {
+		writeEnqueueError(w, r, err)
+		return
+	}
+	recordAudit(r, AuditEvent{
+		Action:       "warehouse_export.requested",
+		ResourceType: "warehouse_export",
+		ResourceID:   run.ID,
+		Metadata:     map[string]interface{}{"date": req.Date, "datasets": req.Datasets},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
+
+func getWarehouseExportsHandler(w http.ResponseWriter, r *http.Request) {
+	runs, err := db.WarehouseExports().List(r.Context(), maxWarehouseExportRuns)
+	if err != nil {
+		writeStorageError(w, r, err, "Warehouse exports")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"configured": warehouseStore != nil,
+		"datasets":   warehouseDatasets,
+		"runs":       runs,
+	})
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"backup-manager/config"
+	"backup-manager/storage"
+)
+
+const (
+	webhookSecretPrefix = "whsec_"
+
+	webhookTimeout        = 10 * time.Second
+	webhookMaxAttempts    = 10
+	webhookBaseBackoff    = 30 * time.Second
+	webhookMaxBackoff     = 6 * time.Hour
+	webhookRetryInterval  = 15 * time.Second
+	webhookRetryBatch     = 500
+	webhookDeliveryLimit  = 100            // deliveries listed per endpoint
+	webhookSecretOverlap  = 24 * time.Hour // old secret keeps signing after rotation
+	webhookDeliveryTTL    = 30 * 24 * time.Hour
+	webhookResponseLength = 1024
+	// A delivery waiting in the job queue or being sent is leased for
+	// webhookLease, longer than jobRequeueAfter, before the retry scan
+	// queues it again.
+	webhookLease = 15 * time.Minute
+
+	// An endpoint is disabled once it has failed every attempt for this long
+	// and at least this many times in a row.
+	webhookDisableAfter    = 72 * time.Hour
+	webhookDisableFailures = 20
+)
+
+// webhookEvents are the events an endpoint can subscribe to. Domain events
+// among them are sent by recordDomainEvent; the rest where they happen.
+var webhookEvents = map[string]bool{
+	"backup.created":    true,
+	"backup.deleted":    true,
+	"backup.corrupted":  true,
+	"export.completed":  true,
+	"project.created":   true,
+	"project.updated":   true,
+	"project.deleted":   true,
+	"project.extracted": true,
+	"qr_code.created":   true,
+	"qr_code.updated":   true,
+	"qr.scanned":        true,
+	"job.completed":     true,
+	"job.failed":        true,
+
+	"user.email_changed":          true,
+	"auth.password_reset":         true,
+	"account.two_factor_enabled":  true,
+	"account.two_factor_disabled": true,
+}
+
+// WebhookEndpoint is a URL that receives signed event notifications.
+type WebhookEndpoint = storage.WebhookEndpoint
+
+// WebhookDelivery is one event sent to one endpoint, with its retry state.
+type WebhookDelivery = storage.WebhookDelivery
+
+type webhookRegistry struct{}
+
+var webhooks = &webhookRegistry{}
+
+// webhookClient refuses to connect to the server's own network in
+// production, as connectorClient does, since the URL is the user's.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: connectorDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+	// A redirect could point the signed payload somewhere the user never
+	// configured.
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func generateWebhookSecret() string {
+	return webhookSecretPrefix + generateToken()
+}
+
+// add saves a new endpoint with a new signing secret and returns the
+// secret.
+func (reg *webhookRegistry) add(ctx context.Context, endpoint *WebhookEndpoint) (string, error) {
+	secret := generateWebhookSecret()
+	sealed, err := encrypt(secret)
+	if err != nil {
+		return "", err
+	}
+	endpoint.ID = generateID()
+	endpoint.CreatedAt = time.Now()
+	endpoint.Secrets = []storage.WebhookSecret{{Value: sealed}}
+	if err := db.Webhooks().CreateEndpoint(ctx, *endpoint); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// rotateSecret issues a new signing secret. The previous one keeps signing
+// alongside it for webhookSecretOverlap so receivers can switch over.
+func (reg *webhookRegistry) rotateSecret(ctx context.Context, userID, id string) (string, error) {
+	endpoint, err := db.Webhooks().GetEndpoint(ctx, userID, id)
+	if err != nil {
+		return "", err
+	}
+	secret := generateWebhookSecret()
+	sealed, err := encrypt(secret)
+	if err != nil {
+		return "", err
+	}
+
+	secrets := []storage.WebhookSecret{{Value: sealed}}
+	if len(endpoint.Secrets) > 0 {
+		expires := time.Now().Add(webhookSecretOverlap)
+		previous := endpoint.Secrets[0]
+		previous.ExpiresAt = &expires
+		secrets = append(secrets, previous)
+	}
+	if err := db.Webhooks().SetSecrets(ctx, userID, id, secrets); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// emitWebhook records a delivery for every enabled endpoint of userID that
+// subscribes to event, and queues them for sending.
+func emitWebhook(userID, event string, data interface{}) {
+	ctx := context.Background()
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"created_at": time.Now().Format(time.RFC3339),
+		"data":       data,
+	})
+	if err != nil {
+		slog.Error("Error encoding webhook", "event", event, "error", err)
+		return
+	}
+
+	endpoints, err := db.Webhooks().ListEndpoints(ctx, userID)
+	if err != nil {
+		slog.Error("Error loading webhooks", "event", event, "error", err)
+		return
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Disabled || !contains(endpoint.Events, event) {
+			continue
+		}
+		if _, err := addWebhookDelivery(ctx, endpoint, event, payload); err != nil {
+			slog.Error("Error saving webhook delivery", "webhook_id", endpoint.ID, "event", event, "error", err)
+		}
+	}
+}
+
+// addWebhookDelivery saves a delivery of payload to endpoint and queues it.
+// The delivery is leased from the start, so if queueing fails the retry
+// scan picks it up once the lease runs out: delivery is at least once.
+func addWebhookDelivery(ctx context.Context, endpoint WebhookEndpoint, event string, payload json.RawMessage) (WebhookDelivery, error) {
+	now := time.Now()
+	lease := now.Add(webhookLease)
+	d := WebhookDelivery{
+		ID:            generateID(),
+		EndpointID:    endpoint.ID,
+		UserID:        endpoint.UserID,
+		Event:         event,
+		Payload:       payload,
+		Status:        storage.DeliveryPending,
+		NextAttemptAt: &lease,
+		CreatedAt:     now,
+	}
+	if err := db.Webhooks().CreateDelivery(ctx, d); err != nil {
+		return WebhookDelivery{}, err
+	}
+	queueWebhookDelivery(ctx, d)
+	return d, nil
+}
+
+type webhookDeliveryPayload struct {
+	DeliveryID string `json:"delivery_id"`
+	// Attempts is how many attempts the delivery had when it was queued,
+	// so a delivery queued twice is only attempted once.
+	Attempts int `json:"attempts"`
+}
+
+func queueWebhookDelivery(ctx context.Context, d WebhookDelivery) {
+	payload := webhookDeliveryPayload{DeliveryID: d.ID, Attempts: d.Attempts}
+	if _, err := enqueueJob(ctx, d.UserID, jobWebhookDelivery, payload); err != nil {
+		slog.Warn("Error queueing webhook delivery; it will be retried", "delivery_id", d.ID, "error", err)
+	}
+}
+
+// queueDueWebhookDeliveries queues pending deliveries whose backoff, or
+// lease, has run out.
+func queueDueWebhookDeliveries() {
+	ctx := context.Background()
+	now := time.Now()
+
+	due, err := db.Webhooks().ListDue(ctx, now, webhookRetryBatch)
+	if err != nil {
+		slog.Error("Error listing due webhook deliveries", "error", err)
+		return
+	}
+	for _, d := range due {
+		err := db.Webhooks().Lease(ctx, d.ID, now, now.Add(webhookLease))
+		if errors.Is(err, storage.ErrNotFound) {
+			// Another server queued it
+			continue
+		}
+		if err != nil {
+			slog.Error("Error leasing webhook delivery", "delivery_id", d.ID, "error", err)
+			continue
+		}
+		queueWebhookDelivery(ctx, d)
+	}
+}
+
+// runWebhookDeliveryJob makes one attempt at a delivery. A failed attempt
+// isn't a failed job: the delivery keeps its own status and retries.
+func runWebhookDeliveryJob(ctx context.Context, job storage.Job) (interface{}, error) {
+	var payload webhookDeliveryPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, err
+	}
+
+	d, err := db.Webhooks().GetDelivery(ctx, "", payload.DeliveryID)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Deleted with its endpoint
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := db.Webhooks().GetEndpoint(ctx, "", d.EndpointID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Claim the attempt so a delivery queued twice isn't sent twice. Until
+	// it finishes, the lease keeps the retry scan off it.
+	err = db.Webhooks().StartAttempt(ctx, d.ID, payload.Attempts, time.Now().Add(webhookLease))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.Attempts = payload.Attempts + 1
+	d.NextAttemptAt = nil
+
+	if endpoint.Disabled {
+		d.Status = storage.DeliveryFailed
+		d.LastError = "The endpoint is disabled"
+		return webhookAttemptResult(d), db.Webhooks().FinishAttempt(ctx, d)
+	}
+	secrets, err := activeSecrets(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := sendWebhook(ctx, endpoint.URL, secrets, d)
+	d.ResponseStatus = status
+	if err == nil {
+		now := time.Now()
+		d.Status = storage.DeliverySucceeded
+		d.DeliveredAt = &now
+		d.LastError = ""
+		if err := db.Webhooks().FinishAttempt(ctx, d); err != nil {
+			return nil, err
+		}
+		return webhookAttemptResult(d), db.Webhooks().EndpointSucceeded(ctx, endpoint.ID)
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts >= webhookMaxAttempts {
+		d.Status = storage.DeliveryFailed
+	} else {
+		next := time.Now().Add(webhookBackoff(d.Attempts))
+		d.NextAttemptAt = &next
+	}
+	if err := db.Webhooks().FinishAttempt(ctx, d); err != nil {
+		return nil, err
+	}
+	return webhookAttemptResult(d), recordWebhookFailure(ctx, endpoint.ID)
+}
+
+func webhookAttemptResult(d WebhookDelivery) map[string]interface{} {
+	return map[string]interface{}{"delivery_id": d.ID, "status": d.Status, "attempts": d.Attempts}
+}
+
+// recordWebhookFailure counts a failed delivery against the endpoint and
+// disables it once it has been failing long enough, telling its owner.
+func recordWebhookFailure(ctx context.Context, id string) error {
+	endpoint, err := db.Webhooks().EndpointFailed(ctx, id, time.Now())
+	if err != nil {
+		return err
+	}
+	if endpoint.Disabled || endpoint.ConsecutiveFailures < webhookDisableFailures ||
+		endpoint.FailingSince == nil || time.Since(*endpoint.FailingSince) < webhookDisableAfter {
+		return nil
+	}
+
+	reason := fmt.Sprintf("Disabled after %d consecutive failed deliveries", endpoint.ConsecutiveFailures)
+	err = db.Webhooks().DisableEndpoint(ctx, id, reason)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Disabled by another attempt
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	notifyWebhookDisabled(ctx, endpoint.UserID, endpoint.URL, reason)
+	return nil
+}
+
+// webhookBackoff is exponential in the attempt number, with jitter so
+// retries for a recovering endpoint don't all land at once.
+func webhookBackoff(attempt int) time.Duration {
+	backoff := webhookBaseBackoff << (attempt - 1)
+	if backoff > webhookMaxBackoff || backoff <= 0 {
+		backoff = webhookMaxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// activeSecrets returns the secrets currently signing for the endpoint.
+func activeSecrets(endpoint WebhookEndpoint) ([]string, error) {
+	var secrets []string
+	for _, s := range endpoint.Secrets {
+		if s.ExpiresAt != nil && !time.Now().Before(*s.ExpiresAt) {
+			continue
+		}
+		secret, err := decrypt(s.Value)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// signWebhook computes the X-Webhook-Signature header: the timestamp and
+// one HMAC-SHA256 of "timestamp.body" per active secret, so receivers keep
+// verifying during a secret rotation.
+func signWebhook(secrets []string, timestamp int64, body []byte) string {
+	parts := []string{"t=" + strconv.FormatInt(timestamp, 10)}
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%d.", timestamp)
+		mac.Write(body)
+		parts = append(parts, "v1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func sendWebhook(ctx context.Context, target string, secrets []string, d WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "backup-manager-webhooks/1.0")
+	req.Header.Set("X-Webhook-ID", d.ID)
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Signature", signWebhook(secrets, time.Now().Unix(), d.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, webhookResponseLength))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func notifyWebhookDisabled(ctx context.Context, userID, target, reason string) {
+	slog.Info("Webhook endpoint disabled", "url", target, "reason", reason)
+	user, err := db.Users().Get(ctx, userID)
+	if err != nil {
+		slog.Error("Error loading webhook owner", "user_id", userID, "error", err)
+		return
+	}
+
+	body := fmt.Sprintf("We stopped sending webhooks to %s.\n\n%s. Fix the endpoint, then re-enable it from your webhook settings:\n\n%s\n",
+		target, reason, frontendLink("/settings/webhooks"))
+	if err := sendEmail(user.Email, "Your webhook endpoint was disabled", body); err != nil {
+		slog.Error("Error sending webhook disabled email", "error", err)
+	}
+}
+
+func pruneWebhookDeliveries() {
+	n, err := db.Webhooks().PruneDeliveries(context.Background(), time.Now().Add(-webhookDeliveryTTL))
+	if err != nil {
+		slog.Error("Error pruning webhook deliveries", "error", err)
+	} else if n > 0 {
+		slog.Info("Pruned webhook deliveries", "count", n)
+	}
+}
+
+// validWebhookURL requires https, or http outside production. In
+// production the host can't be a private, loopback or link-local address
+// either; names are checked as they are dialed, see connectorDialControl.
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if config.Get("ENV") != "production" {
+		return u.Scheme == "https" || u.Scheme == "http"
+	}
+	host := u.Hostname()
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && privateAddress(ip) {
+		return false
+	}
+	return u.Scheme == "https"
+}
+
+// Handlers
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		URL    string   `json:"url" validate:"required,max=2048"`
+		Events []string `json:"events" validate:"required"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if !validWebhookURL(req.URL) {
+		writeFieldError(w, "url", "https", "url must be an absolute https URL")
+		return
+	}
+	if msg := checkWebhookEvents(req.Events); msg != "" {
+		writeFieldError(w, "events", "oneof", msg)
+		return
+	}
+
+	endpoint := &WebhookEndpoint{
+		UserID: userID,
+		URL:    req.URL,
+		Events: req.Events,
+	}
+	secret, err := webhooks.add(r.Context(), endpoint)
+	if err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "webhook.created", ResourceType: "webhook", ResourceID: endpoint.ID})
+
+	// The secret is only ever returned here and from rotation
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"webhook": endpoint,
+		"secret":  secret,
+	})
+}
+
+// checkWebhookEvents returns what is wrong with an endpoint's events, or
+// "" if nothing is.
+func checkWebhookEvents(events []string) string {
+	if len(events) == 0 {
+		return "events is required"
+	}
+	for _, event := range events {
+		if !webhookEvents[event] {
+			return "Unknown event: " + event
+		}
+	}
+	return ""
+}
+
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	endpoints, err := db.Webhooks().ListEndpoints(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, r, err, "Webhooks")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoints)
+}
+
+// getWebhookEventsHandler lists the events endpoints can subscribe to.
+func getWebhookEventsHandler(w http.ResponseWriter, r *http.Request) {
+	events := make([]string, 0, len(webhookEvents))
+	for event := range webhookEvents {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	endpoint, err := db.Webhooks().GetEndpoint(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+// updateWebhookHandler changes an endpoint's URL or events; fields left out
+// are kept.
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		URL    *string  `json:"url" validate:"max=2048"`
+		Events []string `json:"events"`
+	}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.URL != nil && !validWebhookURL(*req.URL) {
+		writeFieldError(w, "url", "https", "url must be an absolute https URL")
+		return
+	}
+	if req.Events != nil {
+		if msg := checkWebhookEvents(req.Events); msg != "" {
+			writeFieldError(w, "events", "oneof", msg)
+			return
+		}
+	}
+
+	endpoint, err := db.Webhooks().GetEndpoint(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+	if req.URL != nil {
+		endpoint.URL = *req.URL
+	}
+	if req.Events != nil {
+		endpoint.Events = req.Events
+	}
+	if err := db.Webhooks().UpdateEndpoint(r.Context(), endpoint); err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "webhook.updated", ResourceType: "webhook", ResourceID: id})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if err := db.Webhooks().DeleteEndpoint(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "webhook.deleted", ResourceType: "webhook", ResourceID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func rotateWebhookSecretHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	secret, err := webhooks.rotateSecret(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+
+	recordAudit(r, AuditEvent{Action: "webhook.secret_rotated", ResourceType: "webhook", ResourceID: id})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":                    secret,
+		"previous_secret_valid_for": webhookSecretOverlap.String(),
+	})
+}
+
+func enableWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if err := db.Webhooks().EnableEndpoint(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+
+	endpoint, err := db.Webhooks().GetEndpoint(r.Context(), userID, id)
+	if err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	id := mux.Vars(r)["id"]
+
+	if _, err := db.Webhooks().GetEndpoint(r.Context(), userID, id); err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+	deliveries, err := db.Webhooks().ListDeliveries(r.Context(), id, webhookDeliveryLimit)
+	if err != nil {
+		writeStorageError(w, r, err, "Deliveries")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redeliverWebhookHandler sends a past delivery again as a new delivery
+// with the same payload, keeping the original's history intact.
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	vars := mux.Vars(r)
+
+	endpoint, err := db.Webhooks().GetEndpoint(r.Context(), userID, vars["id"])
+	if err != nil {
+		writeStorageError(w, r, err, "Webhook")
+		return
+	}
+	if endpoint.Disabled {
+		http.Error(w, "Webhook is disabled; enable it first", http.StatusConflict)
+		return
+	}
+
+	original, err := db.Webhooks().GetDelivery(r.Context(), endpoint.ID, vars["deliveryId"])
+	if err != nil {
+		writeStorageError(w, r, err, "Delivery")
+		return
+	}
+	delivery, err := addWebhookDelivery(r.Context(), endpoint, original.Event, original.Payload)
+	if err != nil {
+		writeStorageError(w, r, err, "Delivery")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
@@ -0,0 +1,253 @@
+// Package websocket is the server side of the WebSocket protocol (RFC
+// 6455), as much of it as pushing messages to browsers needs: the upgrade
+// handshake, text and binary messages either way, and ping, pong and close.
+// Extensions and subprotocols are not negotiated.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcodes of the frames in a message.
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// Close codes.
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseTooLarge      = 1009
+)
+
+// MaxMessageSize bounds a message read from the client.
+const MaxMessageSize = 64 << 10
+
+// acceptGUID is appended to the client's key to prove the server speaks
+// the protocol.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	// ErrNotWebSocket is returned by Upgrade for a request that isn't a
+	// WebSocket handshake. Nothing has been written to the response.
+	ErrNotWebSocket = errors.New("websocket: not a websocket handshake")
+	// ErrClosed is returned by Read once the client has closed the
+	// connection.
+	ErrClosed = errors.New("websocket: connection closed")
+)
+
+// Conn is an upgraded connection. Writes may come from any goroutine;
+// reads from one at a time.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+// Upgrade completes the handshake and takes over the connection. The
+// server's read and write deadlines no longer apply to it.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, ErrNotWebSocket
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, br: rw.Reader}, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteMessage sends a text or binary message, giving up after timeout.
+func (c *Conn) WriteMessage(op int, data []byte, timeout time.Duration) error {
+	return c.writeFrame(op, data, timeout)
+}
+
+// Ping asks the client to answer, which keeps proxies from dropping an
+// idle connection and shows Read the client is still there.
+func (c *Conn) Ping(timeout time.Duration) error {
+	return c.writeFrame(OpPing, nil, timeout)
+}
+
+func (c *Conn) writeFrame(op int, data []byte, timeout time.Duration) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// Server frames are a single unmasked frame each
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | byte(op)
+	switch n := len(data); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Read returns the next text or binary message, answering pings and
+// skipping pongs on the way. It returns ErrClosed once the client closes
+// the connection, after answering the close, and fails if nothing at all
+// arrives within timeout.
+func (c *Conn) Read(timeout time.Duration) (op int, data []byte, err error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+		fin, frameOp, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOp {
+		case OpPing:
+			if err := c.writeFrame(OpPong, payload, timeout); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.Close(code, "")
+			return 0, nil, ErrClosed
+		case OpText, OpBinary:
+			if op != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected a continuation frame")
+			}
+			op = frameOp
+		case OpContinuation:
+			if op == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+		if len(data)+len(payload) > MaxMessageSize {
+			return 0, nil, c.fail(CloseTooLarge, "message too large")
+		}
+		data = append(data, payload...)
+		if fin {
+			return op, data, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op int, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	op = int(head[0] & 0x0f)
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "client frames must be masked")
+	}
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	control := op >= OpClose
+	if control && (n > 125 || !fin) {
+		return false, 0, nil, c.fail(CloseProtocolError, "invalid control frame")
+	}
+	if n > MaxMessageSize {
+		return false, 0, nil, c.fail(CloseTooLarge, "message too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// fail closes the connection for a protocol violation and returns why.
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return errors.New("websocket: " + reason)
+}
+
+// Close sends a close frame, best effort, and closes the connection.
+func (c *Conn) Close(code int, reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		c.writeFrame(OpClose, append(payload, reason...), time.Second)
+		err = c.conn.Close()
+	})
+	return err
+}